@@ -0,0 +1,350 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"strings"
+
+	"vmx2vmi/pkg/config"
+	"vmx2vmi/pkg/failure"
+)
+
+// command is a subcommand of the tool. Each parses its own flags, with a flag set of its own, and
+// runs with its arguments.
+type command struct {
+	name    string
+	args    string
+	summary string
+	// flags are the flags the command accepts; nil accepts all but the otherFlags.
+	flags []string
+	// nargs is the number of arguments the command takes, -1 for any number.
+	nargs int
+	// run runs the action with the arguments of the command.
+	run func(args []string)
+}
+
+// The command of the run and the flag set it was parsed with.
+var (
+	runCommand *command
+	runFlags   *flag.FlagSet
+)
+
+// generalFlags are accepted by every command.
+var generalFlags = []string{"config", "log-level", "log-format"}
+
+var vcenterFlags = []string{"vcenter-url", "vcenter-user", "vcenter-insecure", "vcenter-thumbprint"}
+
+// warmFlags are accepted by the steps of a warm migration copying the disks of the VM.
+var warmFlags = slices.Concat(vcenterFlags, []string{"vm", "warm-state", "warm-disk-output", "output-dir", "vddk-libdir", "vddk-transports", "read-workers", "bwlimit", "bwlimit-total", "progress", "snapshot-quiesce"})
+
+// otherFlags are the flags of the disk copies, warm migrations, plans, server and controller, which
+// the conversions, the commands taking every other flag, do not use.
+var otherFlags = []string{
+	"disk-output", "disk-format", "qcow2-cluster-size", "qcow2-compress", "disk-engine", "transfer", "transfer-image",
+	"vddk-libdir", "vddk-transports", "vddk-snapshot", "source-snapshot", "snapshot-quiesce", "since-change-id", "read-workers",
+	"resume", "verify", "verify-image", "upload-dv", "upload-size", "uploadproxy-url", "uploadproxy-insecure",
+	"inject-virtio-drivers", "virtio-win", "linux-boot-check", "warm-state", "warm-disk-output", "cutover-shutdown",
+	"shutdown-timeout", "cutover-disconnect-nics", "cutover-start", "metrics-addr", "inventory-filter", "serve-dir",
+	"serve-token-file", "controller-dir", "controller-namespace",
+}
+
+var commands = []command{
+	{
+		name:    "convert",
+		args:    "[<path-to-vmx>...]",
+		summary: "Convert VMX files, OVA archives or OVF descriptors, or the -vm VMs of vCenter, to KubeVirt manifests",
+		nargs:   -1,
+		run:     runConvert,
+	},
+	{
+		name:    "apply",
+		args:    "[<path-to-vmx>...]",
+		summary: "Convert VMs like convert, then apply the manifests to the cluster of -kubeconfig",
+		nargs:   -1,
+		run: func(args []string) {
+			*applyResources = true
+			runConvert(args)
+		},
+	},
+	{
+		name:    "diff",
+		args:    "[<path-to-vmx>...]",
+		summary: "Convert VMs like convert, then compare their VirtualMachines with those in the cluster of -kubeconfig field by field, without writing anything",
+		nargs:   -1,
+		run: func(args []string) {
+			diffCluster = true
+			runConvert(args)
+		},
+	},
+	{
+		name:    "inspect vmdk",
+		args:    "<path-to-vmdk>",
+		summary: "Display the descriptor of a VMDK",
+		flags:   []string{"o"},
+		nargs:   1,
+		run:     func(args []string) { runInspectVMDK(args[0]) },
+	},
+	{
+		name:    "inspect vmx",
+		args:    "<path-to-vmx>",
+		summary: "Display the configuration read from a VMX, OVA or OVF: the VM, its controllers, disks, CD-ROMs, network adapters and settings",
+		flags:   []string{"o"},
+		nargs:   1,
+		run:     func(args []string) { runInspectVMX(args[0]) },
+	},
+	{
+		name:    "inspect disks",
+		args:    "<path-to-vmdk-or-vmx>",
+		summary: "Report the capacity, allocation, provisioning, snapshot depth and suggested PVC size of a VMDK, or of the disks of a VMX, OVA or OVF",
+		flags:   []string{"o"},
+		nargs:   1,
+		run:     func(args []string) { runDiskReport(args[0]) },
+	},
+	{
+		name:    "convert-disk",
+		args:    "<path-to-vmdk>",
+		summary: "Convert a VMDK, a disk inside an OVA (<archive>.ova/<disk>.vmdk) or, with -disk-engine vddk, a disk of the -vm VM, e.g. scsi0:0, to a raw or qcow2 image",
+		flags: slices.Concat(vcenterFlags, []string{"vm", "disk-output", "disk-format", "qcow2-cluster-size", "qcow2-compress", "disk-engine",
+			"transfer", "transfer-image", "vddk-libdir", "vddk-transports", "vddk-snapshot", "vddk-secret", "vddk-init-image", "source-snapshot",
+			"snapshot-quiesce", "since-change-id", "read-workers", "bwlimit", "bwlimit-total", "progress", "resume", "verify",
+			"inject-virtio-drivers", "virtio-win", "linux-boot-check", "namespace", "kubeconfig"}),
+		nargs: 1,
+		run:   func(args []string) { runConvertDisk(args[0]) },
+	},
+	{
+		name:    "upload-disk",
+		args:    "<path-to-vmdk>",
+		summary: "Upload a VMDK, or <archive>.ova/<disk>.vmdk, to a DataVolume of the cluster of -kubeconfig through the CDI upload proxy",
+		flags: []string{"upload-dv", "upload-size", "namespace", "storage-class", "uploadproxy-url", "uploadproxy-insecure", "kubeconfig",
+			"read-workers", "bwlimit", "bwlimit-total", "progress", "verify", "verify-image"},
+		nargs: 1,
+		run:   func(args []string) { runUploadDisk(args[0]) },
+	},
+	{
+		name:    "plan run",
+		args:    "<plan.yaml>",
+		summary: "Run a migration plan, resuming where its previous run stopped",
+		flags:   []string{"parallel", "datastore-budget", "network-budget", "metrics-addr"},
+		nargs:   1,
+		run:     func(args []string) { runPlan(args[0]) },
+	},
+	{
+		name:    "check",
+		args:    "[<path-to-vmx>...]",
+		summary: "Check VMX files or the -vm VMs of vCenter for what stops or changes their migration",
+		flags:   append([]string{"vmx", "vm", "disk-source", "o"}, vcenterFlags...),
+		nargs:   -1,
+		run:     runCheck,
+	},
+	{
+		name:    "preflight",
+		summary: "Check the cluster of -kubeconfig for KubeVirt, CDI, the networks, storage class, snapshots and feature gates a conversion needs, and print a pass/fail report",
+		flags:   []string{"namespace", "storage-class", "disk-source", "network-map", "net-binding", "filesystem", "shared-disk-map", "output-kind", "kubeconfig", "o"},
+		nargs:   0,
+		run:     func([]string) { runPreflight() },
+	},
+	{
+		name:    "warm precopy",
+		summary: "Copy the disks of the -vm VM of vCenter from a snapshot while it runs: in full the first time, then only the changes since the previous precopy (Changed Block Tracking)",
+		flags:   warmFlags,
+		nargs:   0,
+		run:     func([]string) { runWarm("precopy") },
+	},
+	{
+		name:    "warm cutover",
+		summary: "Shut the -vm VM down, copy the changes since the last precopy, and start the KubeVirt VM -name in -namespace of the cluster of -kubeconfig",
+		flags: slices.Concat(warmFlags, []string{"cutover-shutdown", "shutdown-timeout", "cutover-disconnect-nics", "cutover-start", "v2v", "v2v-image",
+			"v2v-guest-os", "inject-virtio-drivers", "virtio-win", "linux-boot-check", "name", "namespace", "kubeconfig"}),
+		nargs: 0,
+		run:   func([]string) { runWarm("cutover") },
+	},
+	{
+		name:    "warm status",
+		summary: "Show the phase, the disks and the syncs of the warm migration of the -vm VM",
+		flags:   []string{"vm", "warm-state", "output-dir", "o"},
+		nargs:   0,
+		run:     func([]string) { runWarm("status") },
+	},
+	{
+		name:    "inventory",
+		summary: "List the VMs of vCenter or an ESXi host",
+		flags:   append([]string{"inventory-filter", "o"}, vcenterFlags...),
+		nargs:   0,
+		run:     func([]string) { runInventory() },
+	},
+	{
+		name:    "serve",
+		args:    "<address>",
+		summary: "Serve a REST API submitting conversion jobs, reporting their status and progress, and returning the manifests they generated",
+		flags:   append([]string{"serve-dir", "serve-token-file", "parallel"}, vcenterFlags...),
+		nargs:   1,
+		run:     func(args []string) { runServe(args[0]) },
+	},
+	{
+		name:    "controller",
+		summary: "Reconcile the VMwareMigration resources of the cluster: warm migrations of vCenter VMs declared in their spec",
+		flags:   []string{"controller-dir", "controller-namespace", "parallel", "kubeconfig"},
+		nargs:   0,
+		run:     func([]string) { runController() },
+	},
+	{
+		name:    "wizard",
+		summary: "Convert a VM step by step, answering questions instead of giving flags, with a preview of the manifests",
+		flags:   append([]string{"namespace", "output-dir", "kubeconfig"}, vcenterFlags...),
+		nargs:   0,
+		run:     func([]string) { runWizard() },
+	},
+}
+
+// findCommand returns the command args start with and the arguments following its name, or
+// convert when args are flags or VMX files.
+func findCommand(args []string) (*command, []string, error) {
+	for i := range commands {
+		words := strings.Fields(commands[i].name)
+		if len(args) >= len(words) && slices.Equal(args[:len(words)], words) {
+			return &commands[i], args[len(words):], nil
+		}
+	}
+	if len(args) == 0 {
+		return &commands[0], args, nil
+	}
+	switch args[0] {
+	case "inspect":
+		return nil, nil, fmt.Errorf("inspect needs vmdk, vmx or disks, e.g. %s inspect vmdk <path-to-vmdk>", os.Args[0])
+	case "plan":
+		return nil, nil, fmt.Errorf("plan needs run, e.g. %s plan run <plan.yaml>", os.Args[0])
+	case "warm":
+		return nil, nil, fmt.Errorf("warm needs precopy, cutover or status, e.g. %s warm precopy -vm <inventory-path-or-id>", os.Args[0])
+	}
+	return &commands[0], args, nil
+}
+
+// accepts reports whether the command takes the flag name.
+func (c *command) accepts(name string) bool {
+	if slices.Contains(generalFlags, name) {
+		return true
+	}
+	if c.flags == nil {
+		return !slices.Contains(otherFlags, name)
+	}
+	return slices.Contains(c.flags, name)
+}
+
+// flagSet returns the flag set of the command, bound to the flags of flags.go it accepts.
+func (c *command) flagSet() *flag.FlagSet {
+	fset := flag.NewFlagSet(c.name, flag.ContinueOnError)
+	flag.VisitAll(func(f *flag.Flag) {
+		if c.accepts(f.Name) {
+			fset.Var(f.Value, f.Name, f.Usage)
+		}
+	})
+	fset.Usage = func() {
+		fmt.Fprintf(fset.Output(), "Usage: %s\n\n%s.\n", strings.TrimSpace(strings.Join([]string{os.Args[0], c.name, "[flags]", c.args}, " ")), c.summary)
+		fmt.Fprintf(fset.Output(), "\nFlags:\n")
+		fset.PrintDefaults()
+	}
+	return fset
+}
+
+// parse parses the flags of the command into runFlags and returns its arguments. It exits on -h,
+// and on a flag the command does not take.
+func (c *command) parse(args []string) []string {
+	fset := c.flagSet()
+	if err := fset.Parse(args); errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	} else if err != nil {
+		os.Exit(failure.Usage.ExitCode())
+	}
+	positional := fset.Args()
+	if c.nargs >= 0 && len(positional) != c.nargs {
+		fmt.Fprintf(fset.Output(), "%s takes %d argument(s), got %d\n", c.name, c.nargs, len(positional))
+		fset.Usage()
+		os.Exit(failure.Usage.ExitCode())
+	}
+	runCommand, runFlags = c, fset
+	return positional
+}
+
+// parseCommandLine parses the arguments of the program and returns the command they give, convert
+// when they start with a flag or a VMX file, and its arguments. -h alone prints the usage of the
+// program.
+func parseCommandLine() (*command, []string) {
+	args := os.Args[1:]
+	if len(args) == 1 && slices.Contains([]string{"-h", "-help", "--help"}, args[0]) {
+		flag.Usage()
+		os.Exit(0)
+	}
+	cmd, rest, err := findCommand(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(failure.Usage.ExitCode())
+	}
+	return cmd, cmd.parse(rest)
+}
+
+// applyDefaults sets the runFlags the command line did not set from their environment variable,
+// or else from the configuration file: configPath, $VMX2VMI_CONFIG or ~/.vmx2vmi.yaml when it
+// exists.
+func applyDefaults(configPath string) error {
+	set := make(map[string]bool)
+	runFlags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	explicit := configPath != ""
+	if !explicit {
+		configPath = os.Getenv(config.FileEnv)
+		explicit = configPath != ""
+	}
+	if !explicit {
+		configPath = config.DefaultPath()
+	}
+	var defaults map[string][]string
+	if configPath != "" {
+		var err error
+		defaults, err = config.Load(configPath)
+		if errors.Is(err, fs.ErrNotExist) && !explicit {
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for name := range defaults {
+		if flag.Lookup(name) == nil {
+			return failure.Errorf(failure.Usage, "configuration %s: unknown option %s", configPath, name)
+		}
+	}
+	// The runs of the VMs of a plan read the same file.
+	if explicit {
+		os.Setenv(config.FileEnv, configPath)
+	}
+
+	var err error
+	runFlags.VisitAll(func(f *flag.Flag) {
+		if err != nil || set[f.Name] || slices.Contains(config.Reserved, f.Name) {
+			return
+		}
+		values, source := defaults[f.Name], "configuration "+configPath
+		if env, ok := os.LookupEnv(config.EnvName(f.Name)); ok {
+			values, source = []string{env}, "$"+config.EnvName(f.Name)
+		}
+		for _, value := range values {
+			if setErr := runFlags.Set(f.Name, value); setErr != nil {
+				err = failure.Errorf(failure.Usage, "invalid value %q for -%s in %s: %w", value, f.Name, source, setErr)
+				return
+			}
+		}
+	})
+	return err
+}
+
+// printCommands lists the commands in the usage of the program.
+func printCommands() {
+	fmt.Fprintf(os.Stderr, "Commands, each taking flags of its own (see %s <command> -h):\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-14s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\n")
+}
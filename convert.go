@@ -0,0 +1,1070 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"vmx2vmi/pkg/cluster"
+	"vmx2vmi/pkg/conflict"
+	"vmx2vmi/pkg/failure"
+	"vmx2vmi/pkg/kubevirt"
+	"vmx2vmi/pkg/logging"
+	"vmx2vmi/pkg/manifest"
+	"vmx2vmi/pkg/readiness"
+	"vmx2vmi/pkg/report"
+	"vmx2vmi/pkg/v2v"
+	"vmx2vmi/pkg/validate"
+	"vmx2vmi/pkg/vmx"
+	"vmx2vmi/pkg/vsphere"
+
+	corev1 "k8s.io/api/core/v1"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+// conversion is the conversion of one VM, filled in by the stages of convertVM.
+type conversion struct {
+	vsphereClient *vsphere.Client
+	// vmxPath is the VMX file, or with -vm the datastore path of the VMX of the VM.
+	vmxPath   string
+	vmxConfig *vmx.VMXConfig
+
+	vm     *kubevirtv1.VirtualMachine
+	report *report.Report
+	// storage places the claims of the disks, and evictionStrategy is the one of -eviction-strategy.
+	storage          kubevirt.StorageOptions
+	evictionStrategy kubevirtv1.EvictionStrategy
+
+	// primary is the object written to <name>.yaml, the VM or the pool wrapping it.
+	primary manifest.Object
+	// companions are the resources generated alongside the VM.
+	companions []companion
+	// objects are primary and the objects of the companions, sorted.
+	objects []manifest.Object
+
+	// basePath is the path of the generated files without suffix and extension.
+	basePath string
+}
+
+// clusterApply is how applyAndWait applies the manifests of a conversion, checked by
+// prepareApply before they are written.
+type clusterApply struct {
+	client  *cluster.Client
+	options cluster.ApplyOptions
+	// convertGuest converts the guest with -v2v job before the first boot of the VM.
+	convertGuest bool
+	waitStage    readiness.Stage
+}
+
+// convertVM converts one VM, source being a VMX file or, with vsphereClient, a -vm VM, and reports
+// whether diff found it different in the cluster. first is the first VM of the run.
+func convertVM(vsphereClient *vsphere.Client, source string, first bool) (drifted bool) {
+	c := parseVM(vsphereClient, source)
+	c.buildVM()
+	c.addCompanions()
+	if diffCluster {
+		return c.diffCluster()
+	}
+	apply, skip := c.prepareApply()
+	if skip {
+		return false
+	}
+	if *toStdout {
+		c.writeStdout(first)
+		c.writeReport()
+	} else {
+		changed := c.writeFiles()
+		if *diffOnly {
+			return false
+		}
+		if changed {
+			c.writeReport()
+		}
+	}
+	if *applyResources {
+		c.applyAndWait(apply)
+	}
+	return false
+}
+
+// parseVM reads the VMX of source, a VMX file or, with vsphereClient, a -vm VM, and checks that
+// -disk-source can read its disks.
+func parseVM(vsphereClient *vsphere.Client, source string) *conversion {
+	c := &conversion{vsphereClient: vsphereClient, vmxPath: source}
+	var err error
+	if vsphereClient != nil {
+		c.vmxConfig, c.vmxPath, err = vsphereClient.ReadVMX(context.Background(), source)
+		if err != nil {
+			fatalf("Failed to read VM %s from %s: %v", source, *vcenterURL, err)
+		}
+	} else if c.vmxConfig, err = vmx.ParseVMX(c.vmxPath); err != nil {
+		fatalf("Failed to parse VMX file: %v", err)
+	}
+	switch *diskSource {
+	case "pvc", "vddk", "http", "upload":
+	default:
+		exitf(failure.Usage, "Unsupported -disk-source '%s', must be pvc, vddk, http or upload", *diskSource)
+	}
+	if c.vmxConfig.Encrypted && *diskSource == "vddk" {
+		logging.Warnf("%s uses VM encryption, the vSphere user of -vddk-secret needs the Cryptographic operations privileges to read its disks.\n", c.vmxPath)
+	} else if c.vmxConfig.Encrypted {
+		exitf(failure.Unsupported, "%s uses VM encryption, its configuration and disks cannot be read without the key server. Decrypt the VM in vSphere (or remove encryption in Workstation/Fusion) before converting, or transfer the disks through VDDK with vCenter credentials.", c.vmxPath)
+	}
+	return c
+}
+
+// buildVM builds the VirtualMachine of the VMX with the conversion options, and the report of
+// what was mapped.
+func (c *conversion) buildVM() {
+	vmxConfig := c.vmxConfig
+	vmOptions := c.vmOptions()
+	kvVM, err := kubevirt.CreateKubeVirtVM(vmxConfig, vmOptions)
+	if err != nil {
+		fatalf("Failed to create KubeVirt VM object: %v", err)
+	}
+	c.vm = kvVM
+	userLabels := make(map[string]string)
+	for _, value := range labels {
+		key, labelValue, err := kubevirt.ParseLabel(value)
+		if err != nil {
+			fatalf("Failed to parse -label: %v", err)
+		}
+		userLabels[key] = labelValue
+	}
+	userAnnotations := make(map[string]string)
+	for _, value := range annotations {
+		key, annotationValue, err := kubevirt.ParseAnnotation(value)
+		if err != nil {
+			fatalf("Failed to parse -annotation: %v", err)
+		}
+		userAnnotations[key] = annotationValue
+	}
+	convertedAt := conversionTime()
+	kubevirt.ApplyProvenance(kvVM, vmxConfig, c.vmxPath, converterVersion(), convertedAt)
+	kubevirt.ApplyMetadata(kvVM, userLabels, userAnnotations)
+
+	var rdmMappings []kubevirt.RDMMapping
+	for _, value := range rdmMaps {
+		mapping, err := kubevirt.ParseRDMMapping(value)
+		if err != nil {
+			fatalf("Failed to parse -rdm-map: %v", err)
+		}
+		rdmMappings = append(rdmMappings, mapping)
+	}
+	if err := kubevirt.AttachRawDeviceMappings(kvVM, vmxConfig.Disks, rdmMappings); err != nil {
+		fatalf("Failed to convert raw device mappings: %v", err)
+	}
+
+	sharedClaims := make(map[string]string)
+	for _, value := range sharedDiskMaps {
+		diskID, claimName, err := kubevirt.ParseSharedDiskMapping(value)
+		if err != nil {
+			fatalf("Failed to parse -shared-disk-map: %v", err)
+		}
+		sharedClaims[diskID] = claimName
+	}
+	if err := kubevirt.AttachSharedDisks(kvVM, vmxConfig.Disks, sharedClaims); err != nil {
+		fatalf("Failed to convert shared disks: %v", err)
+	}
+	kubevirt.OrderDisks(kvVM, vmxConfig.Disks)
+	kubevirt.ApplyDiskSerials(kvVM, vmxConfig)
+
+	c.report = report.New(kvVM.Name, c.vmxPath, vmxConfig)
+	c.report.ConverterVersion, c.report.ConvertedAt = converterVersion(), convertedAt.UTC().Truncate(time.Second)
+	ioTuning := kubevirt.IOTuningOptions{
+		SupplementalPoolThreads: uint32(*ioThreadCount),
+		BlockMultiQueue:         *blockMultiQueue,
+		Disks:                   make(map[string]kubevirt.DiskTuning),
+	}
+	if *ioThreadsPolicy != "" {
+		if ioTuning.ThreadsPolicy, err = kubevirt.ParseIOThreadsPolicy(*ioThreadsPolicy); err != nil {
+			fatalf("Failed to parse -io-threads-policy: %v", err)
+		}
+	}
+	for _, value := range diskTunings {
+		diskID, tuning, err := kubevirt.ParseDiskTuning(value)
+		if err != nil {
+			fatalf("Failed to parse -disk-tuning: %v", err)
+		}
+		ioTuning.Disks[diskID] = tuning
+	}
+	applied, err := kubevirt.ApplyIOTuning(kvVM, vmxConfig, ioTuning)
+	if err != nil {
+		fatalf("Failed to apply I/O tuning: %v", err)
+	}
+	c.report.Mappings = append(c.report.Mappings, applied...)
+
+	networkOptions := kubevirt.NetworkOptions{Models: make(map[string]string), Bindings: make(map[string]string)}
+	for _, value := range nicModels {
+		adapter, model, err := kubevirt.ParseNICModel(value)
+		if err != nil {
+			fatalf("Failed to parse -nic-model: %v", err)
+		}
+		networkOptions.Models[adapter] = model
+	}
+	for _, value := range netBindings {
+		adapter, binding, err := kubevirt.ParseNetBinding(value)
+		if err != nil {
+			fatalf("Failed to parse -net-binding: %v", err)
+		}
+		networkOptions.Bindings[adapter] = binding
+	}
+	if *networkMapPath != "" {
+		if networkOptions.Map, err = kubevirt.LoadNetworkMap(*networkMapPath); err != nil {
+			fatalf("Failed to load -network-map: %v", err)
+		}
+	}
+	applied, err = kubevirt.ApplyNetworks(kvVM, vmxConfig, networkOptions)
+	if err != nil {
+		fatalf("Failed to convert network adapters: %v", err)
+	}
+	c.report.Mappings = append(c.report.Mappings, applied...)
+
+	for _, d := range vmOptions.Disks {
+		if d.BootOrder == 0 && d.VolumeSource.PersistentVolumeClaim != nil {
+			c.report.Mappings = append(c.report.Mappings, fmt.Sprintf("data disk %s attached as %s from PVC %s", d.SourceID, d.Name, d.VolumeSource.PersistentVolumeClaim.ClaimName))
+		}
+	}
+
+	c.applyDiskSource()
+	c.applyScheduling()
+	c.applyGuestSetup()
+}
+
+// vmOptions returns the options the VirtualMachine is created with: its disks and their claims,
+// its run strategy and its devices.
+func (c *conversion) vmOptions() kubevirt.VMOptions {
+	dataClaims := make(map[string]string)
+	for _, value := range diskMaps {
+		diskID, claimName, err := kubevirt.ParseDiskMapping(value)
+		if err != nil {
+			fatalf("Failed to parse -disk-map: %v", err)
+		}
+		dataClaims[diskID] = claimName
+	}
+	vmName := *outputVMName
+	if vmName == "" {
+		vmName = kubevirt.SanitizeName(c.vmxConfig.DisplayName)
+	}
+	bootClaim := strings.ReplaceAll(*pvcName, "{name}", vmName)
+	buses := make(map[string]kubevirtv1.DiskBus)
+	for _, value := range diskBuses {
+		diskID, bus, err := kubevirt.ParseDiskBus(value)
+		if err != nil {
+			fatalf("Failed to parse -disk-bus: %v", err)
+		}
+		buses[diskID] = bus
+	}
+	disks, err := kubevirt.DiskDefinitions(c.vmxConfig, bootClaim, dataClaims, buses)
+	if err != nil {
+		fatalf("Failed to map disks: %v", err)
+	}
+
+	runStrategy := kubevirtv1.RunStrategyHalted
+	if *runVM {
+		runStrategy = kubevirtv1.RunStrategyAlways
+	}
+	if *runStrategyName != "" {
+		if runStrategy, err = kubevirt.ParseRunStrategy(*runStrategyName); err != nil {
+			fatalf("Failed to parse -run-strategy: %v", err)
+		}
+		if *runVM && runStrategy != kubevirtv1.RunStrategyAlways {
+			exitf(failure.Usage, "-run conflicts with -run-strategy %s", runStrategy)
+		}
+	}
+
+	vmOptions := kubevirt.VMOptions{
+		Name:        *outputVMName,
+		Namespace:   *namespace,
+		RunStrategy: runStrategy,
+		Disks:       disks,
+
+		AutoattachGraphicsDevice: autoattachGraphics.value,
+		AutoattachSerialConsole:  autoattachSerialConsole.value,
+		AutoattachMemBalloon:     autoattachMemBalloon.value,
+	}
+	for i, value := range gpus {
+		name, deviceName, err := kubevirt.ParseDeviceRequest(value)
+		if err != nil {
+			fatalf("Failed to parse -gpu: %v", err)
+		}
+		if name == "" {
+			name = fmt.Sprintf("gpu%d", i)
+		}
+		vmOptions.GPUs = append(vmOptions.GPUs, kubevirtv1.GPU{Name: name, DeviceName: deviceName})
+	}
+	for i, value := range hostDevices {
+		name, deviceName, err := kubevirt.ParseDeviceRequest(value)
+		if err != nil {
+			fatalf("Failed to parse -host-device: %v", err)
+		}
+		if name == "" {
+			name = fmt.Sprintf("hostdevice%d", i)
+		}
+		vmOptions.HostDevices = append(vmOptions.HostDevices, kubevirtv1.HostDevice{Name: name, DeviceName: deviceName})
+	}
+	if *tablet {
+		vmOptions.Inputs = append(vmOptions.Inputs, kubevirt.TabletInput())
+	}
+	for _, value := range filesystems {
+		def, err := kubevirt.ParseFilesystem(value)
+		if err != nil {
+			fatalf("Failed to parse -filesystem: %v", err)
+		}
+		vmOptions.Filesystems = append(vmOptions.Filesystems, def)
+	}
+	return vmOptions
+}
+
+// applyDiskSource sets where the claims of the disks go, and with -disk-source vddk, http or
+// upload, the DataVolume templates importing the disks.
+func (c *conversion) applyDiskSource() {
+	var err error
+	c.storage = kubevirt.StorageOptions{StorageClass: *storageClass, Datastore: kubevirt.DatastoreOf(*vddkDatastorePath, "")}
+	if c.storage.Datastore == "" && c.vsphereClient != nil {
+		c.storage.Datastore = kubevirt.DatastoreOf(c.vmxPath, "")
+	} else if c.storage.Datastore == "" {
+		if absPath, err := filepath.Abs(c.vmxPath); err == nil {
+			c.storage.Datastore = kubevirt.DatastoreOf(absPath, "")
+		}
+	}
+	if *storageMapPath != "" {
+		if c.storage.Map, err = kubevirt.LoadStorageMap(*storageMapPath); err != nil {
+			fatalf("Failed to load -storage-map: %v", err)
+		}
+	}
+
+	var imported []kubevirt.ImportedDisk
+	switch *diskSource {
+	case "vddk":
+		if *vddkURL == "" || *vddkSecret == "" {
+			exitf(failure.Usage, "-disk-source vddk requires -vddk-url and -vddk-secret")
+		}
+		imported, err = kubevirt.ApplyVDDKSource(c.vm, c.vmxConfig, kubevirt.VDDKSource{
+			URL:           *vddkURL,
+			SecretRef:     *vddkSecret,
+			Thumbprint:    *vddkThumbprint,
+			InitImageURL:  *vddkInitImage,
+			DatastorePath: *vddkDatastorePath,
+			VMUUID:        *vddkVMUUID,
+		}, c.storage)
+	case "http":
+		if *httpURL == "" {
+			exitf(failure.Usage, "-disk-source http requires -http-url")
+		}
+		imported, err = kubevirt.ApplyHTTPSource(c.vm, c.vmxConfig, kubevirt.HTTPSource{
+			BaseURL:       *httpURL,
+			SecretRef:     *httpSecret,
+			CertConfigMap: *httpCertConfigMap,
+		}, c.storage)
+	case "upload":
+		imported, err = kubevirt.ApplyUploadSource(c.vm, c.vmxConfig, c.storage)
+	}
+	if err != nil {
+		fatalf("Failed to configure the %s DataVolume templates: %v", *diskSource, err)
+	}
+	for _, d := range imported {
+		c.report.Mappings = append(c.report.Mappings, fmt.Sprintf("disk %s imported by a CDI %s DataVolume named %s", d.DiskID, d.Source, d.DataVolume))
+	}
+}
+
+// applyScheduling sets the placement, scheduling hints, machine, eviction strategy, memory
+// overcommit and shutdown of the VM.
+func (c *conversion) applyScheduling() {
+	kvVM, vmxConfig := c.vm, c.vmxConfig
+	placement := &kubevirt.Placement{}
+	var err error
+	if *placementPath != "" {
+		if placement, err = kubevirt.LoadPlacement(*placementPath); err != nil {
+			fatalf("Failed to load -placement: %v", err)
+		}
+	}
+	selector, err := kubevirt.ParseKeyValueList(*nodeSelector)
+	if err != nil {
+		fatalf("Failed to parse -node-selector: %v", err)
+	}
+	if len(selector) > 0 && placement.NodeSelector == nil {
+		placement.NodeSelector = make(map[string]string)
+	}
+	for k, v := range selector {
+		placement.NodeSelector[k] = v
+	}
+	for _, value := range tolerations {
+		toleration, err := kubevirt.ParseToleration(value)
+		if err != nil {
+			fatalf("Failed to parse -toleration: %v", err)
+		}
+		placement.Tolerations = append(placement.Tolerations, toleration)
+	}
+	antiAffinity, err := kubevirt.ParseKeyValueList(*antiAffinityLabels)
+	if err != nil {
+		fatalf("Failed to parse -anti-affinity-label: %v", err)
+	}
+	if len(antiAffinity) > 0 && placement.AntiAffinityLabels == nil {
+		placement.AntiAffinityLabels = make(map[string]string)
+	}
+	for k, v := range antiAffinity {
+		placement.AntiAffinityLabels[k] = v
+	}
+	c.report.Mappings = append(c.report.Mappings, kubevirt.ApplyPlacement(kvVM, *placement)...)
+
+	priorityClasses, err := kubevirt.ParseKeyValueList(*priorityClassMap)
+	if err != nil {
+		fatalf("Failed to parse -priority-class-map: %v", err)
+	}
+	nodeLabels, err := kubevirt.ParseKeyValueList(*performanceNodeLabels)
+	if err != nil {
+		fatalf("Failed to parse -performance-node-labels: %v", err)
+	}
+	applied := kubevirt.ApplySchedulingHints(kvVM, vmxConfig, kubevirt.SchedulingOptions{
+		DedicatedCPUsForAffinity: *dedicatedCPUs,
+		PriorityClasses:          priorityClasses,
+		PerformanceNodeLabels:    nodeLabels,
+	})
+	c.report.Mappings = append(c.report.Mappings, applied...)
+	c.report.Mappings = append(c.report.Mappings, kubevirt.ApplyMachine(kvVM, vmxConfig, kubevirt.MachineOptions{
+		MachineType: *machineType,
+		CPUModel:    *cpuModel,
+	})...)
+	if *evictionStrategyName != "" {
+		if c.evictionStrategy, err = kubevirt.ParseEvictionStrategy(*evictionStrategyName); err != nil {
+			fatalf("Failed to parse -eviction-strategy: %v", err)
+		}
+		kvVM.Spec.Template.Spec.EvictionStrategy = &c.evictionStrategy
+	}
+	applied, err = kubevirt.ApplyMemoryOvercommit(kvVM, vmxConfig, kubevirt.MemoryOptions{
+		OvercommitRatio:         *overcommitRatio,
+		OvercommitGuestOverhead: *overcommitGuestOverhead,
+	})
+	if err != nil {
+		fatalf("Failed to apply -overcommit-ratio: %v", err)
+	}
+	c.report.Mappings = append(c.report.Mappings, applied...)
+
+	var gracePeriod *int64
+	if *terminationGracePeriod != "" {
+		seconds, err := kubevirt.ParseGracePeriod(*terminationGracePeriod)
+		if err != nil {
+			fatalf("Failed to parse -termination-grace-period: %v", err)
+		}
+		gracePeriod = &seconds
+	}
+	c.report.Mappings = append(c.report.Mappings, kubevirt.ApplyTerminationGracePeriod(kvVM, vmxConfig, gracePeriod)...)
+	if *hypervEnlightenments {
+		c.report.Mappings = append(c.report.Mappings, kubevirt.ApplyWindowsFeatures(kvVM, vmxConfig)...)
+	}
+}
+
+// applyGuestSetup attaches what sets the guest up on its first boot, cloud-init or sysprep, and
+// the guest agent and its probes.
+func (c *conversion) applyGuestSetup() {
+	kvVM, vmxConfig := c.vm, c.vmxConfig
+	var cloudInit kubevirt.CloudInitOptions
+	if *cloudInitPath != "" {
+		data, err := os.ReadFile(*cloudInitPath)
+		if err != nil {
+			fatalf("Failed to read -cloud-init: %v", err)
+		}
+		cloudInit.UserData = string(data)
+	}
+	if *cloudInitNetworkPath != "" {
+		data, err := os.ReadFile(*cloudInitNetworkPath)
+		if err != nil {
+			fatalf("Failed to read -cloud-init-network-config: %v", err)
+		}
+		cloudInit.NetworkData = string(data)
+	}
+	for _, value := range sshKeys {
+		key, err := kubevirt.ParseSSHKey(value)
+		if err != nil {
+			fatalf("Failed to parse -ssh-key: %v", err)
+		}
+		cloudInit.SSHKeys = append(cloudInit.SSHKeys, key)
+	}
+	applied, err := kubevirt.ApplyCloudInit(kvVM, cloudInit)
+	if err != nil {
+		fatalf("Failed to attach cloud-init: %v", err)
+	}
+	if *ipConfigPath != "" {
+		ipConfig, err := kubevirt.LoadIPConfig(*ipConfigPath)
+		if err != nil {
+			fatalf("Failed to load -ip-config: %v", err)
+		}
+		staticIPs, err := kubevirt.ApplyStaticIPs(kvVM, vmxConfig, ipConfig)
+		if err != nil {
+			fatalf("Failed to apply -ip-config: %v", err)
+		}
+		applied = append(applied, staticIPs...)
+	}
+	if len(applied) > 0 && vmxConfig.GuestOSFamily() != "linux" {
+		logging.Warnf("cloud-init is meant for Linux guests, guest OS is '%s'; the disk is ignored unless the guest runs cloud-init or cloudbase-init.\n", vmxConfig.GuestOS)
+	}
+	c.report.Mappings = append(c.report.Mappings, applied...)
+
+	applied, err = kubevirt.ApplySysprep(kvVM, vmxConfig, kubevirt.SysprepOptions{
+		ConfigMap: *sysprepConfigMap,
+		Secret:    *sysprepSecret,
+	})
+	if err != nil {
+		fatalf("Failed to attach the sysprep answer file: %v", err)
+	}
+	c.report.Mappings = append(c.report.Mappings, applied...)
+
+	injected, err := kubevirt.ApplyGuestAgentGuidance(kvVM, vmxConfig, *injectGuestAgent)
+	if err != nil {
+		fatalf("Failed to add the qemu-guest-agent installation to the cloud-init user data: %v", err)
+	}
+	if injected {
+		c.report.Mappings = append(c.report.Mappings, "cloud-init disk installing qemu-guest-agent on first boot")
+	} else if *injectGuestAgent {
+		logging.Warnf("-inject-guest-agent only applies to Linux guests, guest OS is '%s'.\n", vmxConfig.GuestOS)
+	}
+	c.report.GuestAgent = kubevirt.GuestAgentGuidance(vmxConfig)
+
+	var probeRequests []kubevirt.ProbeRequest
+	for _, value := range probes {
+		request, err := kubevirt.ParseProbe(value)
+		if err != nil {
+			fatalf("Failed to parse -probe: %v", err)
+		}
+		if request.Handler.GuestAgentPing != nil && !injected {
+			logging.Warnf("The guest-agent probe fails until qemu-guest-agent runs in the guest; install it or use -inject-guest-agent.\n")
+		}
+		probeRequests = append(probeRequests, request)
+	}
+	applied, err = kubevirt.ApplyProbes(kvVM, probeRequests)
+	if err != nil {
+		fatalf("Failed to add probes: %v", err)
+	}
+	c.report.Mappings = append(c.report.Mappings, applied...)
+}
+
+// addCompanions generates the resources of the VM alongside it: the Secrets of its SSH keys and
+// of large cloud-init data, its instancetype and preference, and its PVCs. It then wraps the VM in
+// a pool with -output-kind VirtualMachinePool, and collects and validates the objects written.
+func (c *conversion) addCompanions() {
+	kvVM, vmxConfig := c.vm, c.vmxConfig
+	propagation, err := kubevirt.ParseSSHPropagation(*sshPropagation)
+	if err != nil {
+		fatalf("Failed to parse -ssh-propagation: %v", err)
+	}
+	credentials := kubevirt.AccessCredentialOptions{SecretName: *sshSecret, Propagation: propagation}
+	if *sshUsers != "" {
+		credentials.Users = strings.Split(*sshUsers, ",")
+	}
+	if *sshKeyFile != "" {
+		data, err := os.ReadFile(*sshKeyFile)
+		if err != nil {
+			fatalf("Failed to read -ssh-key-file: %v", err)
+		}
+		keys, err := kubevirt.ParseSSHKeyFile(string(data))
+		if err != nil {
+			fatalf("Failed to parse -ssh-key-file %s: %v", *sshKeyFile, err)
+		}
+		if credentials.SecretName == "" {
+			credentials.SecretName = kvVM.Name + "-ssh-keys"
+		}
+		c.companions = append(c.companions, companion{
+			suffix:      "-ssh-keys",
+			description: "SSH key Secret manifest",
+			objects:     []manifest.Object{kubevirt.SSHKeySecret(kvVM, credentials.SecretName, keys)},
+		})
+	}
+	applied, err := kubevirt.ApplyAccessCredentials(kvVM, credentials)
+	if err != nil {
+		fatalf("Failed to add the SSH key access credentials: %v", err)
+	}
+	c.report.Mappings = append(c.report.Mappings, applied...)
+
+	if secret := kubevirt.MoveLargeCloudInitToSecret(kvVM); secret != nil {
+		c.report.Mappings = append(c.report.Mappings, fmt.Sprintf("cloud-init data too large to inline, moved to Secret %s", secret.Name))
+		c.companions = append(c.companions, companion{
+			suffix:      "-cloudinit",
+			description: "cloud-init Secret manifest",
+			objects:     []manifest.Object{secret},
+		})
+	}
+
+	if *useInstancetype {
+		objects, applied, err := kubevirt.ApplyInstancetype(kvVM, vmxConfig)
+		if err != nil {
+			fatalf("Failed to move sizing into an instancetype: %v", err)
+		}
+		c.report.Mappings = append(c.report.Mappings, applied...)
+		documents := make([]manifest.Object, len(objects))
+		for i, obj := range objects {
+			documents[i] = obj.(manifest.Object)
+		}
+		c.companions = append(c.companions, companion{
+			suffix:      "-instancetype",
+			description: "instancetype and preference manifests",
+			objects:     documents,
+		})
+	}
+	// The target version checks the instancetype as well.
+	c.applyTarget()
+
+	c.primary = kvVM
+	switch *outputKind {
+	case "VirtualMachine":
+		if vmxConfig.Template {
+			logging.Infof("%s is a vSphere template; -output-kind VirtualMachinePool -replicas <n> stamps out VMs from it.\n", c.vmxPath)
+		}
+	case "VirtualMachinePool":
+		if !vmxConfig.Template {
+			logging.Warnf("%s is not a vSphere template: every replica of the pool boots a clone of its disks with the same hostname, machine ID and domain membership; generalize the guest, e.g. with sysprep or cloud-init, or convert a template.", c.vmxPath)
+		}
+		pool, applied, err := kubevirt.CreateVirtualMachinePool(kvVM, vmxConfig, int32(*replicas))
+		if err != nil {
+			fatalf("Failed to create the VirtualMachinePool: %v", err)
+		}
+		c.report.Mappings = append(c.report.Mappings, applied...)
+		c.primary = pool
+	default:
+		exitf(failure.Usage, "Invalid -output-kind '%s': must be VirtualMachine or VirtualMachinePool", *outputKind)
+	}
+
+	var pvcs []*corev1.PersistentVolumeClaim
+	if *createPVC {
+		if *diskSource != "pvc" {
+			exitf(failure.Usage, "-create-pvc only applies to -disk-source pvc, DataVolume templates create their own PVCs")
+		}
+		volumeMode, err := kubevirt.ParseVolumeMode(*pvcVolumeMode)
+		if err != nil {
+			fatalf("Failed to parse -pvc-volume-mode: %v", err)
+		}
+		accessMode, err := kubevirt.ParseAccessMode(*pvcAccessMode)
+		if err != nil {
+			fatalf("Failed to parse -pvc-access-mode: %v", err)
+		}
+		pvcStorage := c.storage
+		pvcStorage.VolumeMode = volumeMode
+		pvcStorage.AccessMode = accessMode
+		pvcs, err = kubevirt.CreatePVCs(kvVM, vmxConfig, kubevirt.PVCOptions{
+			Overhead: *pvcOverhead,
+			Storage:  pvcStorage,
+		})
+		if err != nil {
+			fatalf("Failed to create PVC manifests: %v", err)
+		}
+		objects := make([]manifest.Object, len(pvcs))
+		for i, pvc := range pvcs {
+			objects[i] = pvc
+		}
+		c.companions = append(c.companions, companion{
+			suffix:      "-pvcs",
+			description: "PVC manifests",
+			objects:     objects,
+		})
+	}
+
+	if c.evictionStrategy == kubevirtv1.EvictionStrategyLiveMigrate || c.evictionStrategy == kubevirtv1.EvictionStrategyLiveMigrateIfPossible {
+		blockers := kubevirt.MigrationBlockers(kvVM, pvcs)
+		for _, blocker := range blockers {
+			c.report.Requirements = append(c.report.Requirements, report.Finding{
+				Feature: "Live migration",
+				Setting: "-eviction-strategy " + string(c.evictionStrategy),
+				Detail:  "blocked: " + blocker,
+			})
+		}
+		if len(blockers) > 0 && c.evictionStrategy == kubevirtv1.EvictionStrategyLiveMigrate {
+			exitf(failure.Unsupported, "-eviction-strategy LiveMigrate, but the VM cannot live migrate: %s", strings.Join(blockers, "; "))
+		}
+		for _, blocker := range blockers {
+			logging.Warnf("The VM will be shut down instead of migrated on eviction: %s.\n", blocker)
+		}
+	}
+
+	c.report.Settings = report.AuditSettings(vmxConfig, kvVM)
+	c.objects = []manifest.Object{c.primary}
+	for _, companion := range c.companions {
+		c.objects = append(c.objects, companion.objects...)
+	}
+	manifest.Sort(c.objects)
+	if *validateManifests {
+		invalid := false
+		for _, obj := range c.objects {
+			for _, err := range validate.Validate(obj) {
+				logging.Errorf("%s %s: %v\n", manifest.Kind(obj), obj.GetName(), err)
+				invalid = true
+			}
+		}
+		if invalid {
+			fatalf("The generated manifests would be rejected by the cluster; fix the conversion options or pass -validate=false")
+		}
+	}
+}
+
+// applyTarget adapts the VM to the KubeVirt version of -target-kubevirt-version, and adds the
+// feature gates it needs to the report.
+func (c *conversion) applyTarget() {
+	if *targetKubeVirtVersion == "" {
+		return
+	}
+	var target *kubevirt.Target
+	var err error
+	if *targetKubeVirtVersion == "auto" {
+		target, err = kubevirt.DetectTarget(context.Background(), clusterClient(*kubeconfig))
+		if err != nil {
+			fatalf("Failed to detect the KubeVirt version of the cluster: %v", err)
+		}
+		logging.Infof("Generating manifests for KubeVirt %s, as installed in the cluster\n", target.Version)
+	} else {
+		version, err := kubevirt.ParseVersion(*targetKubeVirtVersion)
+		if err != nil {
+			fatalf("Failed to parse -target-kubevirt-version: %v", err)
+		}
+		target = &kubevirt.Target{Version: version}
+	}
+	applied, gates, warnings, err := kubevirt.ApplyTarget(c.vm, *outputKind == "VirtualMachinePool", *target)
+	if err != nil {
+		fatalf("The VM cannot be generated for KubeVirt %s: %v", target.Version, err)
+	}
+	c.report.Mappings = append(c.report.Mappings, applied...)
+	for _, gate := range gates {
+		c.report.Requirements = append(c.report.Requirements, report.Finding{
+			Feature: "KubeVirt feature gate",
+			Setting: "KubeVirt " + target.Version.String(),
+			Detail:  gate,
+		})
+	}
+	for _, warning := range warnings {
+		logging.Warnf("%s.\n", warning)
+	}
+}
+
+// diffCluster compares the primary object with the one in the cluster, and reports whether they
+// differ.
+func (c *conversion) diffCluster() bool {
+	if *applyResources || *dryRun != "" || *toStdout || *diffOnly {
+		exitf(failure.Usage, "diff only compares with the cluster and cannot be combined with -apply, -dry-run, -stdout or -diff")
+	}
+	differs, err := clusterDrift(clusterClient(*kubeconfig), c.primary)
+	if err != nil {
+		fatalf("Failed to compare %s %s with the cluster: %v", manifest.Kind(c.primary), c.primary.GetName(), err)
+	}
+	return differs
+}
+
+// prepareApply checks the options applying the manifests, and with -apply or -on-conflict checks
+// the cluster for conflicts before anything is written. skip is true when -on-conflict skip skips
+// the VM.
+func (c *conversion) prepareApply() (apply *clusterApply, skip bool) {
+	if *dryRun != "" && *dryRun != "server" {
+		exitf(failure.Usage, "Invalid -dry-run '%s': must be server", *dryRun)
+	}
+	if *dryRun != "" && !*applyResources {
+		exitf(failure.Usage, "-dry-run requires -apply")
+	}
+	if *applyResources && *diffOnly {
+		exitf(failure.Usage, "-apply cannot be combined with -diff, which only reports changes")
+	}
+	apply = &clusterApply{options: cluster.ApplyOptions{DryRun: *dryRun == "server"}}
+	var err error
+	if apply.waitStage, err = readiness.ParseStage(*waitFor); err != nil {
+		exitf(failure.Usage, "-wait-for: %v", err)
+	}
+	if *waitTimeout > 0 {
+		if !*applyResources || *dryRun != "" {
+			exitf(failure.Usage, "-wait requires -apply without -dry-run")
+		}
+		if _, ok := c.primary.(*kubevirtv1.VirtualMachine); !ok {
+			exitf(failure.Usage, "-wait follows a single VM and cannot be combined with -output-kind %s", manifest.Kind(c.primary))
+		}
+	}
+	apply.convertGuest = *v2vMode != "" && v2v.Selects(v2vGuests, c.vmxConfig.GuestOS, c.vmxConfig.GuestOSFamily())
+	if apply.convertGuest {
+		if *v2vMode == v2v.ModeLocal {
+			exitf(failure.Usage, "-v2v local converts the disks of a warm cutover on this host; the disks of a VM conversion are converted in the cluster with -v2v job")
+		}
+		if !*applyResources || *dryRun != "" {
+			exitf(failure.Usage, "-v2v job converts the claims of the VM once applied, which requires -apply without -dry-run")
+		}
+		if _, ok := c.primary.(*kubevirtv1.VirtualMachine); !ok {
+			exitf(failure.Usage, "-v2v job converts the disks of a single VM and cannot be combined with -output-kind %s", manifest.Kind(c.primary))
+		}
+	}
+	if *applyResources && *onConflict == "" {
+		*onConflict = string(conflict.Fail)
+	}
+	if *onConflict == "" {
+		return apply, false
+	}
+	mode, err := conflict.ParseMode(*onConflict)
+	if err != nil {
+		exitf(failure.Usage, "-on-conflict: %v", err)
+	}
+	apply.client = clusterClient(*kubeconfig)
+	conflicts, err := conflict.Check(context.Background(), apply.client, c.objects, logging.Warnf)
+	if err != nil {
+		fatalf("Failed to check the cluster for conflicts: %v", err)
+	}
+	for _, c := range conflicts {
+		logging.Infof("Conflict: %s\n", c)
+	}
+	if len(conflicts) > 0 {
+		switch mode {
+		case conflict.Fail:
+			exitf(failure.Cluster, "%d conflicts with existing resources; pass -on-conflict skip, overwrite or merge to go on", len(conflicts))
+		case conflict.Skip:
+			logging.Infof("Skipping %s %s/%s: %d conflicts with existing resources\n", manifest.Kind(c.primary), c.primary.GetNamespace(), c.primary.GetName(), len(conflicts))
+			return nil, true
+		case conflict.Overwrite:
+			apply.options.Force = true
+		}
+	}
+	return apply, false
+}
+
+// encoding returns the encoding of -o.
+func (c *conversion) encoding() manifest.Encoding {
+	encoding, err := manifest.ParseEncoding(*outputFormat)
+	if err != nil {
+		fatalf("Failed to parse -o: %v", err)
+	}
+	return encoding
+}
+
+// writeStdout writes the manifests to standard output as one stream, after those of the previous
+// VMs unless first.
+func (c *conversion) writeStdout(first bool) {
+	if *diffOnly {
+		exitf(failure.Usage, "-diff compares with previously written files and cannot be combined with -stdout")
+	}
+	if *manifestFormat != "files" && *manifestFormat != "bundle" {
+		exitf(failure.Usage, "-stdout writes all manifests as one stream and cannot be combined with -output-format %s", *manifestFormat)
+	}
+	encoding := c.encoding()
+	data, err := manifest.Marshal(c.objects, encoding)
+	if err != nil {
+		fatalf("Failed to marshal KubeVirt manifests: %v", err)
+	}
+	if !first && encoding == manifest.YAML {
+		// The manifests of the previous VMX file end the YAML stream so far.
+		data = append([]byte("---\n"), data...)
+	}
+	if _, err := os.Stdout.Write(data); err != nil {
+		fatalf("Failed to write KubeVirt manifests to standard output: %v", err)
+	}
+}
+
+// writeFiles logs how the manifests differ from those written by a previous run and, unless
+// -diff, writes them to -output-dir in -output-format. It reports whether the primary manifest
+// changed.
+func (c *conversion) writeFiles() (changed bool) {
+	encoding := c.encoding()
+	outputDir := *outputDirPath
+	if outputDir == "" && c.vsphereClient != nil {
+		outputDir = "."
+	} else if outputDir == "" {
+		outputDir = filepath.Dir(c.vmxPath)
+	}
+	nameTemplate, err := manifest.ParseNameTemplate(*outputName)
+	if err != nil {
+		fatalf("Failed to parse -output-name: %v", err)
+	}
+	baseName, err := nameTemplate.Render(manifest.NameData{
+		Name:      c.vm.Name,
+		Namespace: c.vm.Namespace,
+		Kind:      manifest.Kind(c.primary),
+		Source:    strings.TrimSuffix(filepath.Base(c.vmxPath), filepath.Ext(c.vmxPath)),
+	})
+	if err != nil {
+		fatalf("Failed to render -output-name: %v", err)
+	}
+	c.basePath = filepath.Join(outputDir, baseName)
+	outputPath := c.basePath + encoding.Ext()
+
+	var manifestData []byte
+	manifestKind := manifest.Kind(c.primary)
+	switch *manifestFormat {
+	case "files", "directory", "kustomize":
+		manifestData, err = manifest.Marshal([]manifest.Object{c.primary}, encoding)
+	case "openshift-template":
+		if *diffOnly {
+			exitf(failure.Usage, "-diff cannot compare OpenShift Templates, use another -output-format")
+		}
+		template, err := manifest.OpenShiftTemplate(c.objects, c.primary)
+		if err != nil {
+			fatalf("Failed to create the OpenShift Template: %v", err)
+		}
+		manifestData, err = manifest.Marshal([]manifest.Object{template}, encoding)
+		manifestKind = "OpenShift Template"
+	case "helm":
+		if *diffOnly {
+			exitf(failure.Usage, "-diff cannot compare Helm templates, use another -output-format")
+		}
+		if encoding != manifest.YAML {
+			exitf(failure.Usage, "Helm charts are written in YAML, -o %s is not supported with -output-format helm", encoding)
+		}
+	case "bundle":
+		manifestData, err = manifest.Marshal(c.objects, encoding)
+	default:
+		exitf(failure.Usage, "Invalid -output-format '%s': must be files, bundle, directory, kustomize, helm or openshift-template", *manifestFormat)
+	}
+	if err != nil {
+		fatalf("Failed to marshal KubeVirt manifests: %v", err)
+	}
+	manifestDir := c.basePath
+	var overlays []manifest.Overlay
+	switch {
+	case *manifestFormat == "kustomize":
+		// The base of the overlays; with -output-format directory the directory is the base.
+		manifestDir = filepath.Join(c.basePath, "base")
+		if *overlaysPath == "" {
+			logging.Infof("Note: -output-format kustomize without -overlays writes the base only.\n")
+			break
+		}
+		o, err := manifest.LoadOverlays(*overlaysPath)
+		if err != nil {
+			fatalf("Failed to load -overlays: %v", err)
+		}
+		overlays = o.Overlays
+	case *overlaysPath != "":
+		exitf(failure.Usage, "-overlays requires -output-format kustomize")
+	}
+	if *manifestFormat == "directory" || *manifestFormat == "kustomize" {
+		outputPath = filepath.Join(manifestDir, manifest.FileName(c.primary, encoding))
+	}
+
+	// Templates are not manifests to compare; Helm charts and OpenShift Templates are always written.
+	changed = true
+	if *manifestFormat != "helm" && *manifestFormat != "openshift-template" {
+		if changed, err = reportDrift(outputPath, c.primary); err != nil {
+			fatalf("Failed to compare with previously generated manifest %s: %v", outputPath, err)
+		}
+	}
+	if *manifestFormat == "bundle" && !changed {
+		if changed, err = bundleChanged(outputPath, manifestData, c.primary); err != nil {
+			fatalf("Failed to compare with previously generated manifest %s: %v", outputPath, err)
+		}
+	}
+	if *diffOnly {
+		return changed
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.basePath), 0755); err != nil {
+		fatalf("Failed to create output directory %s: %v", filepath.Dir(c.basePath), err)
+	}
+	switch *manifestFormat {
+	case "files":
+		for _, companion := range c.companions {
+			path := c.basePath + companion.suffix + encoding.Ext()
+			logging.Infof("Writing %s to: %s\n", companion.description, path)
+			data, err := manifest.Marshal(companion.objects, encoding)
+			if err != nil {
+				fatalf("Failed to marshal %s: %v", companion.description, err)
+			}
+			if err := os.WriteFile(path, data, 0644); err != nil {
+				fatalf("Failed to write %s to file %s: %v", companion.description, path, err)
+			}
+		}
+	case "directory", "kustomize":
+		if err := os.MkdirAll(manifestDir, 0755); err != nil {
+			fatalf("Failed to create manifest directory %s: %v", manifestDir, err)
+		}
+		for _, obj := range c.objects {
+			if obj == c.primary {
+				continue
+			}
+			path, err := manifest.WriteFile(manifestDir, obj, encoding)
+			if err != nil {
+				fatalf("Failed to write %s %s manifest to %s: %v", manifest.Kind(obj), obj.GetName(), manifestDir, err)
+			}
+			logging.Infof("Writing %s %s manifest to: %s\n", manifest.Kind(obj), obj.GetName(), path)
+		}
+		path, err := manifest.WriteKustomization(manifestDir, c.objects, encoding)
+		if err != nil {
+			fatalf("Failed to write kustomization.yaml to %s: %v", manifestDir, err)
+		}
+		logging.Infof("Writing kustomization.yaml to: %s\n", path)
+		paths, err := manifest.WriteOverlays(c.basePath, c.objects, overlays)
+		if err != nil {
+			fatalf("Failed to write kustomize overlays to %s: %v", c.basePath, err)
+		}
+		for _, path := range paths {
+			logging.Infof("Writing kustomize overlay to: %s\n", path)
+		}
+	case "helm":
+		paths, err := manifest.WriteHelmChart(c.basePath, c.objects, c.vm.Name, converterVersion())
+		if err != nil {
+			fatalf("Failed to write Helm chart to %s: %v", c.basePath, err)
+		}
+		for _, path := range paths {
+			logging.Infof("Writing Helm chart file to: %s\n", path)
+		}
+	}
+	if changed && manifestData != nil {
+		logging.Infof("Writing KubeVirt %s manifest to: %s\n", manifestKind, outputPath)
+		if err := os.WriteFile(outputPath, manifestData, 0644); err != nil {
+			fatalf("Failed to write KubeVirt manifest to file %s: %v", outputPath, err)
+		}
+	}
+	return changed
+}
+
+// writeReport writes the conversion report: as text on standard error with -stdout, otherwise
+// to <name>-report.txt and <name>-report.json next to the manifests.
+func (c *conversion) writeReport() {
+	if *toStdout {
+		if err := c.report.WriteText(os.Stderr); err != nil {
+			fatalf("Failed to write conversion report: %v", err)
+		}
+		return
+	}
+	for _, format := range []struct {
+		ext   string
+		write func(io.Writer) error
+	}{{".txt", c.report.WriteText}, {".json", c.report.WriteJSON}} {
+		reportPath := c.basePath + "-report" + format.ext
+		reportFile, err := os.Create(reportPath)
+		if err != nil {
+			fatalf("Failed to create conversion report %s: %v", reportPath, err)
+		}
+		logging.Infof("Writing conversion report to: %s\n", reportPath)
+		if err := format.write(reportFile); err != nil {
+			fatalf("Failed to write conversion report %s: %v", reportPath, err)
+		}
+		if err := reportFile.Close(); err != nil {
+			fatalf("Failed to write conversion report %s: %v", reportPath, err)
+		}
+	}
+}
+
+// applyAndWait applies the manifests to the cluster, converting the guest with -v2v job before
+// the VM first starts, then with -wait waits for the VM.
+func (c *conversion) applyAndWait(apply *clusterApply) {
+	kvVM := c.vm
+	if apply.client == nil {
+		apply.client = clusterClient(*kubeconfig)
+	}
+	if apply.convertGuest {
+		// The VM is applied halted, so that the guest is converted before its first boot,
+		// then again with its run strategy.
+		runStrategy := kvVM.Spec.RunStrategy
+		halted := kubevirtv1.RunStrategyHalted
+		kvVM.Spec.RunStrategy = &halted
+		applyObjects(apply.client, c.objects, apply.options)
+		ctx := context.Background()
+		logf := logging.Infof
+		if _, err := readiness.Wait(ctx, apply.client, kvVM, readiness.Imported, logf); err != nil {
+			fatalf("The disks of VM %s/%s are not imported: %v", kvVM.Namespace, kvVM.Name, err)
+		}
+		kvVM.Spec.RunStrategy = runStrategy
+		if err := v2v.RunJob(ctx, apply.client, kvVM.Namespace, kvVM.Name, v2v.Claims(kvVM), v2v.JobOptions{Image: *v2vImage, Logf: logf}); err != nil {
+			fatalf("Failed to convert the guest of VM %s/%s: %v", kvVM.Namespace, kvVM.Name, err)
+		}
+		if runStrategy == nil || *runStrategy != halted {
+			applyObjects(apply.client, []manifest.Object{kvVM}, apply.options)
+		}
+	} else {
+		applyObjects(apply.client, c.objects, apply.options)
+	}
+	if *waitTimeout > 0 {
+		waitReady(apply.client, kvVM, *waitTimeout, apply.waitStage)
+	}
+}
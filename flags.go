@@ -0,0 +1,230 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"vmx2vmi/pkg/logging"
+	"vmx2vmi/pkg/progress"
+	"vmx2vmi/pkg/transfer"
+	"vmx2vmi/pkg/v2v"
+	"vmx2vmi/pkg/vmdk"
+	"vmx2vmi/pkg/vsphere"
+)
+
+// The flags of every action. A command parses those of its action with a flag set of its own,
+// bound to the same values; without a command, the command line sets any of them.
+var (
+	vcenterURL              = flag.String("vcenter-url", "", "vCenter or standalone ESXi host URL the -vm VMs are read from through the VI/JSON API of vSphere 8.0 Update 1 and later, e.g. https://vcenter.example.com; the password is read from $VCENTER_PASSWORD")
+	vcenterUser             = flag.String("vcenter-user", "", "vSphere user of -vcenter-url, e.g. migration@vsphere.local")
+	vcenterInsecure         = flag.Bool("vcenter-insecure", false, "Skip TLS verification of -vcenter-url")
+	vcenterThumbprint       = flag.String("vcenter-thumbprint", "", "SHA-1 or SHA-256 thumbprint of the -vcenter-url certificate, trusted instead of the system roots (a SHA-1 one also defaults -vddk-thumbprint)")
+	parallel                = flag.Int("parallel", 1, "Number of VMs of a plan run, or of the several -vmx files or -vm VMs of a conversion or -download-dir, converted at the same time, each by its own run of vmx2vmi so that a failing VM does not stop the others; with serve, the number of jobs run at a time; with controller, the number of migration steps run at a time")
+	serveDir                = flag.String("serve-dir", "vmx2vmi-jobs", "Directory serve keeps its jobs in, one directory each with the plan, uploaded files, status, logs and manifests of the job")
+	serveTokenFile          = flag.String("serve-token-file", "", "File holding the bearer token the requests to serve must carry in their Authorization header; without it anyone reaching the address can run conversions")
+	controllerDir           = flag.String("controller-dir", "vmx2vmi-migrations", "Directory controller keeps the migrations in, one directory each with the manifests, the warm migration state and the output of the last run of each step")
+	controllerNamespace     = flag.String("controller-namespace", "", "Namespace of the VMwareMigrations controller reconciles (default all namespaces)")
+	metricsAddr             = flag.String("metrics-addr", "", "Address plan run serves Prometheus metrics on at /metrics while it runs, e.g. :9100: the phase, attempts, failures and duration of each VM, and the bytes copied, throughput and retries of its disks")
+	warmStatePath           = flag.String("warm-state", "", "State file of the warm migration (defaults to <vm>.warm.json in -output-dir)")
+	cutoverShutdown         = flag.String("cutover-shutdown", vsphere.ShutdownGuest, "How the warm cutover stops the source VM: guest shuts the guest down through VMware Tools and powers the VM off after -shutdown-timeout, hard powers it off at once, manual fails while it still runs")
+	shutdownTimeout         = flag.Duration("shutdown-timeout", 5*time.Minute, "Time the warm cutover waits for the guest to shut down through VMware Tools before it powers the VM off")
+	cutoverDisconnectNICs   = flag.Bool("cutover-disconnect-nics", false, "Disconnect the network adapters of the source VM once the warm cutover stopped it, and keep them disconnected at power on, so that it cannot run on the network next to the KubeVirt VM")
+	v2vMode                 = flag.String("v2v", "", "Convert the guest with virt-v2v-in-place (virtio drivers, initramfs, bootloader) before the VM first starts: local on this host, on the disks of the warm cutover, or job in a Kubernetes Job mounting the claims of the VM, after -apply or the warm cutover (default none)")
+	v2vImage                = flag.String("v2v-image", v2v.DefaultImage, "Image providing virt-v2v-in-place for -v2v job")
+	injectVirtio            = flag.Bool("inject-virtio-drivers", false, "Inject the virtio storage and network drivers of -virtio-win into the Windows guest of the convert-disk output or of the warm cutover disks, and register the storage drivers as boot drivers, so that Windows boots from virtio disks")
+	virtioWin               = flag.String("virtio-win", v2v.DefaultVirtioWin, "virtio-win ISO, or the directory it was extracted to, providing the drivers of -inject-virtio-drivers and of -v2v local for Windows guests")
+	linuxBootCheck          = flag.String("linux-boot-check", "", "Check the Linux guest of the convert-disk output or of the warm cutover disks for fstab entries and GRUB root= and resume= parameters naming /dev/sdX, /dev/hdX or by-path and by-id devices, which break on virtio disks, and for initramfs images without the virtio modules: report logs them, fix also replaces the device names with filesystem UUIDs (default none)")
+	cutoverStart            = flag.Bool("cutover-start", true, "Start the KubeVirt VM -name in -namespace of the cluster of -kubeconfig at the end of the warm cutover; -cutover-start=false leaves it stopped")
+	downloadDir             = flag.String("download-dir", "", "Download the VMX, NVRAM and disk files of the -vm VMs through the datastore file API into a directory per VM in this directory, for conversions without NFS or SSH access to the datastores; with -pvc the downloaded VMX files are then converted")
+	pvcName                 = flag.String("pvc", "", "Name of the PVC for the primary VMDK (for VM conversion); {name} is replaced by the VM name, which sets one claim per VM when converting several VMX files")
+	outputVMName            = flag.String("name", "", "Name for the KubeVirt VirtualMachine resource (defaults to VMX displayName)")
+	namespace               = flag.String("namespace", "default", "Namespace for the KubeVirt VirtualMachine")
+	machineType             = flag.String("machine-type", "", "Machine type of the VM, e.g. q35 or pc (defaults to pc for legacy guests and virtual hardware before version 7, q35 otherwise)")
+	cpuModel                = flag.String("cpu-model", "", "CPU model of the VM: host-passthrough, host-model or a named model (defaults to host-passthrough with vhv.enable, the cluster default otherwise)")
+	tablet                  = flag.Bool("tablet", false, "Add a USB tablet so the VNC console pointer follows the mouse")
+	hypervEnlightenments    = flag.Bool("hyperv", true, "Give Windows guests (Vista/2008 and later) the Hyper-V enlightenments and timer settings of the KubeVirt common templates; -hyperv=false leaves them out")
+	ioThreadsPolicy         = flag.String("io-threads-policy", "", "IOThreads policy of the VM: shared, auto or supplementalPool (default none)")
+	ioThreadCount           = flag.Uint("io-thread-count", 0, "Number of IOThreads of -io-threads-policy supplementalPool")
+	blockMultiQueue         = flag.Bool("block-multiqueue", false, "Give every virtio disk one queue per vCPU (blockMultiQueue)")
+	networkMapPath          = flag.String("network-map", "", "YAML or JSON file mapping VMware network names to pod, skip or a NetworkAttachmentDefinition")
+	storageMapPath          = flag.String("storage-map", "", "YAML or JSON file mapping VMware datastores to the storageClass, volumeMode and accessMode of generated PVCs and DataVolumes")
+	terminationGracePeriod  = flag.String("termination-grace-period", "", "Time the guest gets to shut down through ACPI before it is powered off, in seconds or as a duration such as 10m (default 0 with powerType.powerOff = hard, the cluster default otherwise)")
+	overcommitRatio         = flag.Float64("overcommit-ratio", 1, "Ratio of memory.guest to resources.requests.memory, e.g. 1.5 requests two thirds of the guest memory (never below the sched.mem.min reservation)")
+	overcommitGuestOverhead = flag.Bool("overcommit-guest-overhead", false, "Leave the memory overhead of virt-launcher and QEMU out of the pod memory request")
+	outputKind              = flag.String("output-kind", "VirtualMachine", "Kind of the generated manifest: VirtualMachine, or VirtualMachinePool to stamp out -replicas VMs from a template")
+	validateManifests       = flag.Bool("validate", true, "Check the generated manifests offline against the KubeVirt, CDI and Kubernetes schema and admission rules before writing them; -validate=false skips the check")
+	outputDirPath           = flag.String("output-dir", "", "Directory the manifests and conversion report of a VM conversion are written to (defaults to the directory of the VMX, or the current directory with -vm)")
+	outputName              = flag.String("output-name", "{{.Name}}", "Go template of the base name of the generated files, e.g. {{.Namespace}}_{{.Name}}; fields .Name, .Namespace, .Kind and .Source (VMX file name without extension)")
+	manifestFormat          = flag.String("output-format", "files", "Layout of the generated manifests: files (<name>.yaml and one file per kind of companion resource), bundle (all resources in <name>.yaml), directory (<name>/ with one file per resource and a kustomization.yaml), kustomize (a base in <name>/base and the -overlays in <name>/overlays) helm (a chart in <name>/ with values for the namespace, run strategy, storage class and networks) or openshift-template (an OpenShift Template in <name>.yaml with NAME, NAMESPACE and PVC size parameters)")
+	overlaysPath            = flag.String("overlays", "", "YAML or JSON file listing the environments of -output-format kustomize, each with a name, namespace, storageClass and networks mapping the Multus networks of the VM")
+	replicas                = flag.Int("replicas", 1, "Number of VMs of -output-kind VirtualMachinePool")
+	evictionStrategyName    = flag.String("eviction-strategy", "", "spec.template.spec.evictionStrategy of the VM: LiveMigrate, LiveMigrateIfPossible, None or External (defaults to the cluster setting); LiveMigrate fails when the VM cannot live migrate")
+	runVM                   = flag.Bool("run", false, "Deprecated: same as -run-strategy Always")
+	runStrategyName         = flag.String("run-strategy", "", "spec.runStrategy of the VM: Always, Halted, Manual, RerunOnFailure or Once (default Halted)")
+	outputFormat            = flag.String("o", "", "Output format of inspect disks and preflight (table or json, default table), check (text or json, default text), inventory (table, json or csv, default table), inspect vmdk and warm status (json) and VM conversion (yaml or json, default yaml)")
+	toStdout                = flag.Bool("stdout", false, "Write the manifests of a VM conversion to standard output, e.g. to pipe them into kubectl apply -f -, instead of files next to the VMX; logs and the conversion report go to standard error")
+	diskOutputPath          = flag.String("disk-output", "", "Destination image file or block device for convert-disk (defaults to <vmdk>.<format>, or <vm>-<disk>.<format> with -disk-engine vddk)")
+	diskFormat              = flag.String("disk-format", "raw", "Image format written by convert-disk: raw or qcow2")
+	qcow2ClusterSize        = flag.Int("qcow2-cluster-size", 65536, "Cluster size in bytes of qcow2 images written by convert-disk")
+	qcow2Compress           = flag.Bool("qcow2-compress", false, "Compress the clusters of qcow2 images written by convert-disk")
+	diskEngine              = flag.String("disk-engine", "native", "Engine used by convert-disk: native, qemu-img for VMDK variants the native reader does not support, or vddk to read a disk of the -vm VM through VDDK with nbdkit")
+	transferMode            = flag.String("transfer", "local", "Where convert-disk -disk-engine vddk copies the disk of the -vm VM: local on this host, or job in a Kubernetes Job in -namespace of the cluster of -kubeconfig, next to the storage, writing a raw image to the claim -disk-output names")
+	transferImage           = flag.String("transfer-image", "", "Image running vmx2vmi, with nbdkit and its vddk plugin, in the Job of -transfer job")
+	vddkLibDir              = flag.String("vddk-libdir", "/opt/vmware-vix-disklib-distrib", "Directory the VDDK library was extracted to, for -disk-engine vddk")
+	vddkTransports          = flag.String("vddk-transports", "", "VDDK transport modes tried in order by -disk-engine vddk, e.g. san:hotadd:nbdssl (default: the fastest available)")
+	vddkSnapshot            = flag.String("vddk-snapshot", "", "Snapshot of the -vm VM whose disk -disk-engine vddk reads, e.g. snapshot-7; needed for a consistent image of a running VM")
+	sourceSnapshot          = flag.Bool("source-snapshot", false, "Snapshot the -vm VM before -disk-engine vddk reads its disk, and remove the snapshot after the copy, for a consistent image of a running VM")
+	snapshotQuiesce         = flag.Bool("snapshot-quiesce", false, "Quiesce the guest file systems through VMware Tools for the snapshots of -source-snapshot and of warm precopies, so the image is consistent for the applications as well")
+	sinceChangeID           = flag.String("since-change-id", "", "Only copy the blocks changed since this change ID (printed by the previous sync) into the existing raw -disk-output; requires Changed Block Tracking")
+	uploadDataVolume        = flag.String("upload-dv", "", "Name of the upload DataVolume created by upload-disk (defaults to the VMDK file name)")
+	uploadSize              = flag.String("upload-size", "", "Storage request of the upload DataVolume (defaults to the disk capacity rounded up to GiB)")
+	storageClass            = flag.String("storage-class", "", "StorageClass of the upload DataVolume and of generated DataVolume templates and PVCs (defaults to the cluster default)")
+	uploadProxyURL          = flag.String("uploadproxy-url", "", "URL of the CDI upload proxy (defaults to the uploadProxyURL of the CDIConfig)")
+	uploadProxyInsecure     = flag.Bool("uploadproxy-insecure", false, "Skip TLS verification of the CDI upload proxy")
+	readWorkers             = flag.Int("read-workers", 4, fmt.Sprintf("Number of %d MiB chunks of the source disk read concurrently by convert-disk and upload-disk (1 reads sequentially)", vmdk.ReadAheadChunk>>20))
+	bwLimit                 = flag.String("bwlimit", "", "Bandwidth limit of each disk transfer (convert-disk reads, upload-disk uploads) in bytes per second, e.g. 100Mi or 1G")
+	bwLimitTotal            = flag.String("bwlimit-total", "", "Bandwidth limit shared by all disk transfers of the run in bytes per second, e.g. 400Mi")
+	progressMode            = flag.String("progress", progress.ModeAuto, "Progress of convert-disk and upload-disk: auto (bars on a terminal), bar, json (JSON lines on stdout) or none")
+	resume                  = flag.Bool("resume", false, "Save the progress of a raw convert-disk every GiB and continue an interrupted conversion of the same disk")
+	verifyDisk              = flag.Bool("verify", false, "Read the converted image (convert-disk) or the uploaded PVC (upload-disk, through a pod) back and compare it with the source disk")
+	verifyImage             = flag.String("verify-image", transfer.DefaultVerifyImage, "Image providing sh, head and sha256sum for the upload-disk -verify pod")
+	applyResources          = flag.Bool("apply", false, "Create or update the generated resources in the cluster of -kubeconfig with a server-side apply, after writing the manifests")
+	dryRun                  = flag.String("dry-run", "", "With -apply, server to have the API server validate and admit the resources without persisting them")
+	waitTimeout             = flag.Duration("wait", 0, "With -apply, wait up to this long, e.g. 30m, for the VM to reach -wait-for and print a summary; fails when it does not")
+	waitFor                 = flag.String("wait-for", "agent", "Stage -wait waits for: imported (DataVolumes populated), running (VMI running) or agent (guest agent connected)")
+	targetKubeVirtVersion   = flag.String("target-kubevirt-version", "", "KubeVirt release the manifests are generated for, e.g. 1.2, or auto to read it from the cluster of -kubeconfig; fields are rewritten to their form in that release or fail the conversion (default: latest)")
+	onConflict              = flag.String("on-conflict", "", "Check the cluster for VMs, pools, PVCs and DataVolumes of the same name not applied by vmx2vmi for the same VM, and for VMs using its fixed MAC addresses, then fail, skip (write and apply nothing), overwrite (-apply takes over their fields) or merge (-apply keeps the fields of other managers) (default fail with -apply, no check otherwise)")
+	kubeconfig              = flag.String("kubeconfig", "", "Path to the kubeconfig used to reach the cluster (defaults to $KUBECONFIG, ~/.kube/config or the in-cluster service account)")
+	diskSource              = flag.String("disk-source", "pvc", "Source of the VM disks: pvc (-pvc and -disk-map name existing claims), or vddk, http or upload (they name DataVolume templates importing the disks)")
+	vddkURL                 = flag.String("vddk-url", "", "vCenter or ESXi SDK URL for -disk-source vddk, e.g. https://vcenter.example.com/sdk (defaults to -vcenter-url)")
+	vddkSecret              = flag.String("vddk-secret", "", "Secret with the vSphere accessKeyId and secretKey for -disk-source vddk and -transfer job")
+	vddkThumbprint          = flag.String("vddk-thumbprint", "", "SHA-1 thumbprint of the vCenter/ESXi certificate for -disk-source vddk")
+	vddkInitImage           = flag.String("vddk-init-image", "", "Image containing the VDDK library for -disk-source vddk (defaults to the v2v-vmware ConfigMap) and -transfer job (defaults to the library of -transfer-image)")
+	vddkDatastorePath       = flag.String("vddk-datastore-path", "", "Datastore path of the VM directory for -disk-source vddk, e.g. \"[datastore1] vmlin01\"")
+	httpURL                 = flag.String("http-url", "", "URL of the directory serving the VMDK files for -disk-source http")
+	httpSecret              = flag.String("http-secret", "", "Secret with the accessKeyId and secretKey of the HTTP server for -disk-source http")
+	httpCertConfigMap       = flag.String("http-cert-configmap", "", "ConfigMap with the CA bundle of the HTTP server for -disk-source http")
+	vddkVMUUID              = flag.String("vddk-vm-uuid", "", "BIOS UUID of the VM for -disk-source vddk (defaults to uuid.bios from the VMX)")
+	createPVC               = flag.Bool("create-pvc", false, "Write PVC manifests for the VM disks to <name>-pvcs.yaml, sized from the VMDK capacity")
+	pvcOverhead             = flag.Float64("pvc-overhead", 0.055, "Fraction of the disk capacity added to Filesystem PVCs created by -create-pvc for filesystem overhead")
+	pvcVolumeMode           = flag.String("pvc-volume-mode", "Filesystem", "volumeMode of the PVCs created by -create-pvc: Filesystem or Block")
+	pvcAccessMode           = flag.String("pvc-access-mode", "ReadWriteOnce", "Access mode of the PVCs created by -create-pvc: ReadWriteOnce, ReadWriteMany (needed for live migration) or ReadWriteOncePod")
+	useInstancetype         = flag.Bool("use-instancetype", false, "Size the VM with a u1 common instancetype when one matches, or a generated VirtualMachineInstancetype, plus a VirtualMachinePreference written to <name>-instancetype.yaml")
+	dedicatedCPUs           = flag.Bool("dedicated-cpus-for-affinity", false, "Request dedicated CPUs (CPU manager) for VMs pinned with sched.cpu.affinity")
+	priorityClassMap        = flag.String("priority-class-map", "", "Map vSphere CPU share levels to PriorityClass names, e.g. high=tier1,low=batch")
+	performanceNodeLabels   = flag.String("performance-node-labels", "", "Node labels required for VMs with CPU affinity, high shares or a reservation, e.g. node-role/perf=true")
+	cloudInitPath           = flag.String("cloud-init", "", "File with cloud-init user data attached to the VM on a cloudInitNoCloud disk (Linux guests)")
+	cloudInitNetworkPath    = flag.String("cloud-init-network-config", "", "File with the cloud-init network configuration (version 1 or 2) attached with the user data")
+	ipConfigPath            = flag.String("ip-config", "", "YAML or JSON file with the static addresses of the guest network adapters, rendered as a cloud-init network configuration matching the preserved MAC addresses")
+	sshSecret               = flag.String("ssh-secret", "", "Secret of SSH public keys injected into the VM through accessCredentials (defaults to <name>-ssh-keys with -ssh-key-file)")
+	sshKeyFile              = flag.String("ssh-key-file", "", "authorized_keys or .pub file whose keys are written to a Secret manifest in <name>-ssh-keys.yaml and injected through accessCredentials")
+	sshPropagation          = flag.String("ssh-propagation", "cloud-init", "How -ssh-secret keys reach the guest: cloud-init (first boot) or guest-agent (kept in sync by qemu-guest-agent, needs -ssh-users)")
+	sshUsers                = flag.String("ssh-users", "", "Comma separated guest users receiving the keys with -ssh-propagation guest-agent")
+	sysprepConfigMap        = flag.String("sysprep-configmap", "", "ConfigMap holding the autounattend.xml sysprep answer file attached to the VM (Windows guests)")
+	sysprepSecret           = flag.String("sysprep-secret", "", "Secret holding the autounattend.xml sysprep answer file attached to the VM (Windows guests)")
+	placementPath           = flag.String("placement", "", "YAML or JSON file with the nodeSelector, affinity, tolerations and antiAffinityLabels of the VM")
+	nodeSelector            = flag.String("node-selector", "", "Node labels the VM must run on, e.g. node-role.kubernetes.io/db=,disktype=ssd")
+	antiAffinityLabels      = flag.String("anti-affinity-label", "", "Labels added to the VM that no other pod on its node may carry, to spread e.g. database cluster members: app=db01-cluster")
+	injectGuestAgent        = flag.Bool("inject-guest-agent", false, "Attach a cloud-init disk installing qemu-guest-agent on first boot (Linux guests)")
+	diffOnly                = flag.Bool("diff", false, "Only report changes against a previously generated manifest, without overwriting it")
+	logLevel                = flag.String("log-level", "info", "Lowest level of the logged messages: debug, info, warn or error")
+	logFormat               = flag.String("log-format", logging.Text, "Format of the log on standard error: text lines, or json objects with the time, level and message for automation parsing the log")
+	configPath              = flag.String("config", "", "YAML file of defaults of the options not given on the command line, by option name, e.g. namespace: vm2kv-poc; $VMX2VMI_<OPTION> variables such as $VMX2VMI_STORAGE_CLASS take precedence over it (defaults to $VMX2VMI_CONFIG or ~/.vmx2vmi.yaml)")
+)
+
+// The repeatable flags and those left unset by default, registered by init.
+var (
+	vmxPaths                stringSliceFlag
+	vmRefs                  stringSliceFlag
+	datastoreBudgets        stringSliceFlag
+	networkBudgets          stringSliceFlag
+	inventoryFilters        stringSliceFlag
+	warmDiskOutputs         stringSliceFlag
+	v2vGuests               stringSliceFlag
+	gpus                    stringSliceFlag
+	hostDevices             stringSliceFlag
+	filesystems             stringSliceFlag
+	autoattachGraphics      optionalBoolFlag
+	autoattachSerialConsole optionalBoolFlag
+	autoattachMemBalloon    optionalBoolFlag
+	diskTunings             stringSliceFlag
+	nicModels               stringSliceFlag
+	netBindings             stringSliceFlag
+	probes                  stringSliceFlag
+	labels                  stringSliceFlag
+	annotations             stringSliceFlag
+	rdmMaps                 stringSliceFlag
+	diskMaps                stringSliceFlag
+	diskBuses               stringSliceFlag
+	sharedDiskMaps          stringSliceFlag
+	sshKeys                 stringSliceFlag
+	tolerations             stringSliceFlag
+)
+
+func init() {
+	flag.Var(&vmxPaths, "vmx", "Path to the VMX file, or an OVA archive or OVF descriptor (for VM conversion); repeat it, pass a quoted glob such as 'vms/*/*.vmx' or list more VMX files as arguments to convert several VMs with the same options")
+	flag.Var(&vmRefs, "vm", "VM read from -vcenter-url instead of a VMX file (for VM conversion): its inventory path, e.g. DC1/vm/web/web01, or its ID, e.g. vm-42; on a standalone ESXi host its name is enough (repeatable)")
+	flag.Var(&datastoreBudgets, "datastore-budget", "Budget of the disk transfers of the VMs of plan run or -parallel read from a datastore: <datastore>=<transfers>[,<rate>], e.g. ds-ssd=4,400Mi, at most transfers at once, 0 for any number, sharing rate in bytes per second; the datastore * budgets those without their own and the VMs of -parallel (repeatable)")
+	flag.Var(&networkBudgets, "network-budget", "Budget of the disk transfers of the VMs of plan run over a network path, as -datastore-budget: <network>=<transfers>[,<rate>], e.g. wan=1,100Mi (repeatable)")
+	flag.Var(&inventoryFilters, "inventory-filter", "Filter of inventory: folder=<inventory path>, cluster=<name>, tag=[<category>:]<tag>, power=on|off|suspended or name=<glob> (repeatable; a VM matches one value of every key)")
+	flag.Var(&warmDiskOutputs, "warm-disk-output", "Raw image or block device a disk of the warm migration is copied to: <disk>=<path>, e.g. scsi0:0=/dev/vg0/web01-boot (repeatable; default <vm>-<disk>.raw in -output-dir)")
+	flag.Var(&v2vGuests, "v2v-guest-os", "Guests -v2v converts: windows, linux, other or a glob of VMware guest OS identifiers, e.g. rhel6* (repeatable; default every guest)")
+	flag.Var(&gpus, "gpu", "Pass a GPU or vGPU through to the VM: <deviceName> or <name>=<deviceName>, e.g. nvidia.com/TU104GL_Tesla_T4 (repeatable)")
+	flag.Var(&hostDevices, "host-device", "Pass a host PCI or USB device through to the VM: <deviceName> or <name>=<deviceName> as permitted in the KubeVirt CR (repeatable)")
+	flag.Var(&filesystems, "filesystem", "Share a volume with the guest over virtiofs: <name>=pvc:<claim>, <name>=configmap:<name> or <name>=secret:<name> (repeatable)")
+	flag.Var(&autoattachGraphics, "autoattach-graphics", "Attach a VNC graphics device; -autoattach-graphics=false for headless VMs (default false when the VMX has svga.present = FALSE, the cluster default otherwise)")
+	flag.Var(&autoattachSerialConsole, "autoattach-serial-console", "Attach a serial console, e.g. for appliances managed over it; -autoattach-serial-console=false to leave it out (default: cluster default)")
+	flag.Var(&autoattachMemBalloon, "autoattach-mem-balloon", "Attach a virtio memory balloon; -autoattach-mem-balloon=false to leave it out (default false when the VMX has sched.mem.maxmemctl = 0, the cluster default otherwise)")
+	flag.Var(&diskTunings, "disk-tuning", "Cache and I/O mode of a disk: <disk>=cache=none|writethrough,io=native|threads,dedicatedIOThread (repeatable)")
+	flag.Var(&nicModels, "nic-model", "Interface model of the network adapters, <model> or <adapter>=<model> e.g. ethernet1=e1000e (repeatable; default derived from virtualDev and guest OS)")
+	flag.Var(&netBindings, "net-binding", "Binding of the network adapters, <binding> or <adapter>=<binding>: masquerade (pod network), bridge, sriov or macvtap (Multus network of the port group) (repeatable; default masquerade for ethernet0, bridge otherwise)")
+	flag.Var(&probes, "probe", "Readiness and liveness probe of the VM: [readiness=|liveness=]guest-agent, tcp:<port> or http:<path>:<port> (repeatable; without a kind it sets both)")
+	flag.Var(&labels, "label", "Label added to the VM and its VMI: <key>=<value> (repeatable)")
+	flag.Var(&annotations, "annotation", "Annotation added to the VM: <key>=<value> (repeatable)")
+	flag.Var(&rdmMaps, "rdm-map", "Map a raw device mapping disk to a cluster device: <disk>=pvc:<claim> or <disk>=hostdisk:<path> (repeatable)")
+	flag.Var(&diskMaps, "disk-map", "Map a data disk to the PVC holding its data: <disk>=<claim> (repeatable, by default scsi0:1 uses <pvc>-data-scsi0-1)")
+	flag.Var(&diskBuses, "disk-bus", "Bus of the disks, <bus> or <disk>=<bus> e.g. scsi0:1=virtio: virtio, scsi or sata (repeatable; default scsi for SCSI disks, sata for SATA and IDE disks, virtio for NVMe disks, sata for every disk of Windows guests)")
+	flag.Var(&sharedDiskMaps, "shared-disk-map", "Map a multi-writer/shared-bus disk to a ReadWriteMany block PVC: <disk>=<claim> (repeatable)")
+	flag.Var(&sshKeys, "ssh-key", "SSH public key authorized for the default user through cloud-init, e.g. \"ssh-ed25519 AAAA... user@host\" (repeatable)")
+	flag.Var(&tolerations, "toleration", "Taint tolerated by the VM: <key>[=<value>][:<effect>] (repeatable)")
+}
+
+// optionalBoolFlag is a boolean flag that stays nil when not given, so the default is left to the cluster.
+type optionalBoolFlag struct {
+	value *bool
+}
+
+func (f *optionalBoolFlag) String() string {
+	if f.value == nil {
+		return ""
+	}
+	return strconv.FormatBool(*f.value)
+}
+
+func (f *optionalBoolFlag) Set(value string) error {
+	v, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	f.value = &v
+	return nil
+}
+
+func (f *optionalBoolFlag) IsBoolFlag() bool {
+	return true
+}
+
+// stringSliceFlag collects the values of a flag that may be repeated.
+type stringSliceFlag []string
+
+func (s *stringSliceFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringSliceFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
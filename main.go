@@ -1,109 +1,1572 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"io"
+	"net/http"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"reflect"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"vmx2vmi/pkg/batch"
+	"vmx2vmi/pkg/cluster"
+	"vmx2vmi/pkg/compat"
+	"vmx2vmi/pkg/config"
+	"vmx2vmi/pkg/controller"
+	"vmx2vmi/pkg/convert"
+	"vmx2vmi/pkg/diff"
+	"vmx2vmi/pkg/failure"
 	"vmx2vmi/pkg/kubevirt"
+	"vmx2vmi/pkg/logging"
+	"vmx2vmi/pkg/manifest"
+	"vmx2vmi/pkg/metrics"
+	"vmx2vmi/pkg/ova"
+	"vmx2vmi/pkg/plan"
+	"vmx2vmi/pkg/preflight"
+	"vmx2vmi/pkg/progress"
+	"vmx2vmi/pkg/readiness"
+	"vmx2vmi/pkg/report"
+	"vmx2vmi/pkg/server"
+	"vmx2vmi/pkg/transfer"
+	"vmx2vmi/pkg/v2v"
 	"vmx2vmi/pkg/vmdk"
 	"vmx2vmi/pkg/vmx"
+	"vmx2vmi/pkg/vsphere"
+	"vmx2vmi/pkg/warm"
+	"vmx2vmi/pkg/wizard"
 
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	kubevirtv1 "kubevirt.io/api/core/v1"
 	"sigs.k8s.io/yaml"
 )
 
-func main() {
-	vmxPath := flag.String("vmx", "", "Path to the VMX file (for VM conversion)")
-	pvcName := flag.String("pvc", "", "Name of the PVC for the primary VMDK (for VM conversion)")
-	outputVMName := flag.String("name", "", "Name for the KubeVirt VirtualMachine resource (defaults to VMX displayName)")
-	namespace := flag.String("namespace", "default", "Namespace for the KubeVirt VirtualMachine")
-	runVM := flag.Bool("run", false, "Set the VM to run immediately (spec.running=true)")
-	vmdkInfoPath := flag.String("vmdk-info", "", "Path to a VMDK file to extract and display its descriptor")
+// version is the converter version stamped on generated manifests, set at build time with
+// -ldflags "-X main.version=<version>".
+var version string
+
+// converterVersion returns version, or the module version recorded by the Go toolchain.
+func converterVersion() string {
+	if version != "" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "(devel)"
+}
+
+// conversionTime returns the time stamped on the converted manifests: now, or the Unix time of
+// $SOURCE_DATE_EPOCH for reproducible outputs such as checked-in samples.
+func conversionTime() time.Time {
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+		seconds, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			exitf(failure.Usage, "$SOURCE_DATE_EPOCH %q: expected a number of seconds since the Unix epoch", epoch)
+		}
+		return time.Unix(seconds, 0)
+	}
+	return time.Now()
+}
 
+func main() {
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage of %s:\n\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "To display VMDK descriptor info (this action is exclusive):\n")
-		fmt.Fprintf(os.Stderr, "  %s -vmdk-info <path-to-vmdk>\n\n", os.Args[0])
+		printCommands()
+		fmt.Fprintf(os.Stderr, "Without a command, the flags and arguments are those of convert.\n\n")
+		fmt.Fprintf(os.Stderr, "To display VMDK descriptor info:\n")
+		fmt.Fprintf(os.Stderr, "  %s inspect vmdk [-o json] <path-to-vmdk>\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "To report disk capacity and provisioning:\n")
+		fmt.Fprintf(os.Stderr, "  %s inspect disks [-o table|json] <path-to-vmdk-or-vmx>\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "To convert a VMDK to a raw or qcow2 image:\n")
+		fmt.Fprintf(os.Stderr, "  %s convert-disk [-disk-format raw|qcow2] [-disk-output <file-or-block-device>] [-since-change-id <id>] <path-to-vmdk>\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "To upload a VMDK to a DataVolume through the CDI upload proxy:\n")
+		fmt.Fprintf(os.Stderr, "  %s upload-disk [-upload-dv <name>] [-namespace <ns>] [-upload-size <size>] [-storage-class <class>] <path-to-vmdk>\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "To run a migration plan:\n")
+		fmt.Fprintf(os.Stderr, "  %s plan run [-parallel <n>] <plan.yaml>\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "To list the VMs of vCenter or an ESXi host:\n")
+		fmt.Fprintf(os.Stderr, "  %s inventory -vcenter-url <url> -vcenter-user <user> [-inventory-filter <key>=<value>]... [-o table|json|csv]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "To migrate a running VM with incremental syncs, then a cutover:\n")
+		fmt.Fprintf(os.Stderr, "  %s warm precopy|cutover -vcenter-url <url> -vcenter-user <user> -vm <inventory-path-or-id> [-warm-disk-output <disk>=<path>]...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s warm status -vm <inventory-path-or-id> [-o json]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "To download the files of VMs from their datastores (converted as well with -pvc):\n")
+		fmt.Fprintf(os.Stderr, "  %s convert -vcenter-url <url> -vcenter-user <user> -vm <inventory-path-or-id> -download-dir <dir>\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "To check the cluster before a migration:\n")
+		fmt.Fprintf(os.Stderr, "  %s preflight [-namespace <ns>] [-storage-class <class>] [-network-map <file>] [-disk-source <source>] [-o table|json]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "To check VMs for what stops or changes their migration:\n")
+		fmt.Fprintf(os.Stderr, "  %s check [-disk-source <source>] [-o text|json] <path-to-vmx>...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s check -vcenter-url <url> -vcenter-user <user> -vm <inventory-path-or-id>... [-o text|json]\n\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "To convert VMX to KubeVirt VirtualMachine YAML:\n")
-		fmt.Fprintf(os.Stderr, "  %s -vmx <path-to-vmx> -pvc <pvc-name> [other-options]\n\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "Options for VM conversion and general use:\n")
-		flag.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "  %s convert -pvc <pvc-name> [flags] <path-to-vmx>...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -vmx <path-to-vmx> -pvc <pvc-name> [flags]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s convert -vcenter-url <url> -vcenter-user <user> -vm <inventory-path-or-id> -pvc <pvc-name> [flags]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Flags of convert, apply and diff, and general flags:\n")
+		commands[0].flagSet().PrintDefaults()
+	}
+	cmd, args := parseCommandLine()
+	// The log is set up once the options are known; their errors go to the default logger.
+	if err := applyDefaults(*configPath); err != nil {
+		logging.Errorf("%v", err)
+		os.Exit(failure.KindOf(err).ExitCode())
 	}
-	flag.Parse()
+	if err := logging.Setup(os.Stderr, *logLevel, *logFormat); err != nil {
+		logging.Errorf("%v", err)
+		os.Exit(failure.Usage.ExitCode())
+	}
+	// The runs converting the VMs of a plan or batch log the same way.
+	os.Setenv(config.EnvName("log-level"), *logLevel)
+	os.Setenv(config.EnvName("log-format"), *logFormat)
+
+	cmd.run(args)
+}
 
-	// Handle VMDK info extraction if the -vmdk-info flag is provided. This action takes precedence.
-	if *vmdkInfoPath != "" {
-		// If -vmdk-info is specified, it's the primary action.
-		// Warn if other potentially conflicting/irrelevant flags for other actions are present.
-		if *vmxPath != "" || *pvcName != "" || *outputVMName != "" || *namespace != "default" || *runVM {
-			log.Println("Warning: Other flags (-vmx, -pvc, -name, -namespace, -run) are ignored when -vmdk-info is specified.")
+// runServe serves the REST API on addr. The jobs are plans, run like the plan run command.
+func runServe(addr string) {
+	command, err := os.Executable()
+	if err != nil {
+		fatalf("%v", err)
+	}
+	var token string
+	if *serveTokenFile != "" {
+		data, err := os.ReadFile(*serveTokenFile)
+		if err != nil {
+			fatalf("Failed to read -serve-token-file: %v", err)
 		}
+		token = strings.TrimSpace(string(data))
+	}
+	var vcenter *plan.VCenter
+	if *vcenterURL != "" {
+		vcenter = &plan.VCenter{URL: *vcenterURL, User: *vcenterUser, Insecure: *vcenterInsecure, Thumbprint: *vcenterThumbprint}
+	}
+	// The conversions report the progress of their disk copies as JSON lines for the API.
+	os.Setenv(config.EnvName("progress"), progress.ModeJSON)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	api, err := server.New(ctx, server.Options{
+		Dir:      *serveDir,
+		Command:  command,
+		Parallel: *parallel,
+		Token:    token,
+		VCenter:  vcenter,
+		Metrics:  metrics.New(plan.Pending, plan.Running, plan.Skipped, plan.Succeeded, plan.Failed),
+	})
+	if err != nil {
+		fatalf("%v", err)
+	}
+	httpServer := &http.Server{Addr: addr, Handler: api.Handler(), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		httpServer.Shutdown(context.Background())
+	}()
+	if token == "" {
+		logging.Warnf("-serve-token-file is not set, anyone reaching %s can run conversions", addr)
+	}
+	logging.Infof("Serving the API on %s, jobs in %s\n", addr, *serveDir)
+	if err := httpServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		fatalf("Failed to serve the API: %v", err)
+	}
+	// Interrupted jobs record their state before the server exits.
+	api.Wait()
+}
 
-		descriptor, isVMDK, err := vmdk.ExtractVMDKDescriptor(*vmdkInfoPath)
+// runWizard asks for a VM and how to convert it, then converts it with a run of this binary.
+func runWizard() {
+	command, err := os.Executable()
+	if err != nil {
+		fatalf("%v", err)
+	}
+	var args []string
+	var client *cluster.Client
+	// Without a cluster, the storage classes and networks are typed instead of picked.
+	if cfg, err := cluster.LoadConfig(*kubeconfig, ""); err == nil {
+		client, err = cluster.NewClient(cfg)
+		if err != nil {
+			fatalf("Failed to create cluster client: %v", err)
+		}
+		if *kubeconfig != "" {
+			args = append(args, "-kubeconfig", *kubeconfig)
+		}
+	} else {
+		logging.Warnf("No cluster to list the storage classes and networks from: %v", err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	err = wizard.Run(ctx, wizard.Options{
+		In:      os.Stdin,
+		Out:     os.Stdout,
+		Command: command,
+		Args:    args,
+		VCenter: vsphere.Config{
+			URL:        *vcenterURL,
+			Username:   *vcenterUser,
+			Insecure:   *vcenterInsecure,
+			Thumbprint: *vcenterThumbprint,
+		},
+		Cluster:   client,
+		Namespace: *namespace,
+		OutputDir: *outputDirPath,
+	})
+	if err != nil {
+		fatalf("%v", err)
+	}
+}
+
+// runController reconciles the VMwareMigration resources. Each step of a migration is a run of
+// this binary, like the VMs of a plan.
+func runController() {
+	command, err := os.Executable()
+	if err != nil {
+		fatalf("%v", err)
+	}
+	var args []string
+	if *kubeconfig != "" {
+		// The steps run in the directories of the migrations.
+		path, err := filepath.Abs(*kubeconfig)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		args = append(args, "-kubeconfig", path)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	c := controller.New(clusterClient(*kubeconfig), controller.Options{
+		Dir:       *controllerDir,
+		Command:   command,
+		Args:      args,
+		Parallel:  *parallel,
+		Namespace: *controllerNamespace,
+	})
+	scope := "all namespaces"
+	if *controllerNamespace != "" {
+		scope = "namespace " + *controllerNamespace
+	}
+	logging.Infof("Reconciling the VMwareMigrations of %s, migrations in %s\n", scope, *controllerDir)
+	if err := c.Run(ctx); err != nil {
+		fatalf("%v", err)
+	}
+}
+
+// runPlan runs the migration plan of planFile. Each VM is converted by a run of this binary, so that
+// a VM failing does not stop the others.
+func runPlan(planFile string) {
+	budgets := transferBudgets()
+	migrationPlan, err := plan.Load(planFile)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	for _, name := range migrationPlan.OptionNames() {
+		if flag.Lookup(name) == nil {
+			exitf(failure.Parse, "Plan %s: unknown option %s", planFile, name)
+		}
+	}
+	command, err := os.Executable()
+	if err != nil {
+		fatalf("%v", err)
+	}
+	var registry *metrics.Registry
+	var observe func(i int, u progress.Update)
+	if *metricsAddr != "" {
+		registry = metrics.New(plan.Pending, plan.Running, plan.Skipped, plan.Succeeded, plan.Failed)
+		for _, vm := range migrationPlan.VMs {
+			registry.Add(vm.Source())
+		}
+		metricsServer, err := metrics.Serve(*metricsAddr, registry)
 		if err != nil {
-			if isVMDK {
-				log.Fatalf("Error extracting descriptor from VMDK file '%s': %v\n", *vmdkInfoPath, err)
+			fatalf("-metrics-addr: %v", err)
+		}
+		defer metricsServer.Close()
+		// The conversions report the progress of their disk copies as JSON lines for the metrics.
+		os.Setenv(config.EnvName("progress"), progress.ModeJSON)
+		observe = func(i int, u progress.Update) { registry.Observe(migrationPlan.VMs[i].Source(), u) }
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	total, done, failed := len(migrationPlan.VMs), 0, 0
+	status, err := migrationPlan.Run(ctx, command, budgets, func(i int, vm plan.VMStatus) {
+		registry.ObserveVM(vm.Source, vm)
+		switch vm.State {
+		case plan.Skipped:
+			done++
+			logging.Infof("Skipping %s (%d/%d), converted by a previous run\n", vm.Source, i+1, total)
+		case plan.Running:
+			logging.Infof("Converting %s (%d/%d), log in %s\n", vm.Source, i+1, total, vm.Log)
+		case plan.Succeeded:
+			done++
+			logging.Infof("Converted %s (%d/%d done, %d failed)\n", vm.Source, done, total, failed)
+		case plan.Failed:
+			done, failed = done+1, failed+1
+			logging.Errorf("Failed to convert %s: %s (%d/%d done, %d failed)\n", vm.Source, vm.Error, done, total, failed)
+		}
+	}, observe)
+	if err != nil {
+		fatalf("Failed to run plan: %v", err)
+	}
+	if err := plan.WriteTable(os.Stdout, status); err != nil {
+		fatalf("Failed to write plan status: %v", err)
+	}
+	logging.Infof("Plan status saved to %s\n", migrationPlan.StatusPath())
+	if status.Failed() {
+		var errs []error
+		converted := 0
+		for _, vm := range status.VMs {
+			if vm.State == plan.Succeeded {
+				converted++
 			} else {
-				log.Fatalf("File '%s' is not a recognized VMDK or error occurred: %v\n", *vmdkInfoPath, err)
+				errs = append(errs, vm.Err())
 			}
 		}
-		fmt.Printf("--- VMDK Descriptor for: %s ---\n%s\n--- End Descriptor ---\n", *vmdkInfoPath, descriptor)
+		os.Exit(failure.OfBatch(errs, converted).ExitCode())
+	}
+}
+
+// runInventory lists the VMs of -vcenter-url.
+func runInventory() {
+	vsphereClient := vsphereLogin()
+	defer vsphereClient.Logout(context.Background())
+	if *outputFormat != "" && *outputFormat != "table" && *outputFormat != "json" && *outputFormat != "csv" {
+		exitf(failure.Usage, "Unsupported -o '%s', must be table, json or csv", *outputFormat)
+	}
+	var filters []vsphere.InventoryFilter
+	for _, s := range inventoryFilters {
+		filter, err := vsphere.ParseInventoryFilter(s)
+		if err != nil {
+			exitf(failure.Usage, "-inventory-filter: %v", err)
+		}
+		filters = append(filters, filter)
+	}
+	vms, err := vsphereClient.Inventory(context.Background(), filters)
+	if err != nil {
+		fatalf("Failed to list VMs: %v", err)
+	}
+	switch *outputFormat {
+	case "json":
+		out, err := json.MarshalIndent(vms, "", "  ")
+		if err != nil {
+			fatalf("Failed to marshal inventory: %v", err)
+		}
+		fmt.Println(string(out))
+	case "csv":
+		err = report.WriteInventoryCSV(os.Stdout, vms)
+	default:
+		err = report.WriteInventoryTable(os.Stdout, vms)
+	}
+	if err != nil {
+		fatalf("Failed to write inventory: %v", err)
+	}
+}
+
+// runWarm runs the step of the warm migration of a VM given by action: a precopy while it runs,
+// the cutover, or the status.
+func runWarm(action string) {
+	checkGuestFlags()
+	transferRate, globalLimiter := transferLimits()
+	var vsphereClient *vsphere.Client
+	if len(vmRefs) > 0 && action != "status" {
+		vsphereClient = vsphereLogin()
+		defer vsphereClient.Logout(context.Background())
+	}
+	statePath := *warmStatePath
+	if statePath == "" {
+		if len(vmRefs) != 1 {
+			exitf(failure.Usage, "warm %s migrates the VM of -vm, which requires one -vm", action)
+		}
+		statePath = filepath.Join(*outputDirPath, kubevirt.SanitizeName(path.Base(vmRefs[0]))+".warm.json")
+	}
+	if action == "status" {
+		state, err := warm.LoadState(statePath)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		if *outputFormat == "json" {
+			out, err := json.MarshalIndent(state, "", "  ")
+			if err != nil {
+				fatalf("Failed to marshal warm migration state: %v", err)
+			}
+			fmt.Println(string(out))
+		} else if err := warm.WriteStatus(os.Stdout, state); err != nil {
+			fatalf("Failed to write warm migration status: %v", err)
+		}
+		return
+	}
+	if action != "precopy" && action != "cutover" {
+		exitf(failure.Usage, "Unsupported warm step '%s', must be precopy, cutover or status", action)
+	}
+	if *injectVirtio && *v2vMode != "" {
+		exitf(failure.Usage, "virt-v2v installs the virtio drivers itself, -inject-virtio-drivers cannot be combined with -v2v; -virtio-win sets where virt-v2v reads them from")
+	}
+	if vsphereClient == nil || len(vmRefs) != 1 {
+		exitf(failure.Usage, "warm %s migrates the VM of -vm, which requires one -vm with -vcenter-url", action)
+	}
+	outputs := make(map[string]string)
+	for _, value := range warmDiskOutputs {
+		disk, output, ok := strings.Cut(value, "=")
+		if !ok || disk == "" || output == "" {
+			exitf(failure.Usage, "Invalid -warm-disk-output '%s', expected <disk>=<path>", value)
+		}
+		outputs[disk] = output
+	}
+	shutdown, err := vsphere.ParseShutdown(*cutoverShutdown)
+	if err != nil {
+		exitf(failure.Usage, "-cutover-shutdown: %v", err)
+	}
+	tracker, err := progress.New(*progressMode)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	opts := warm.Options{
+		VDDK:            vsphere.VDDKOptions{LibDir: *vddkLibDir, Transports: *vddkTransports},
+		Outputs:         outputs,
+		Dir:             *outputDirPath,
+		ReadWorkers:     *readWorkers,
+		Limiters:        []*transfer.Limiter{transfer.NewLimiter(transferRate), globalLimiter},
+		Tracker:         tracker,
+		Quiesce:         *snapshotQuiesce,
+		Shutdown:        shutdown,
+		ShutdownTimeout: *shutdownTimeout,
+		DisconnectNICs:  *cutoverDisconnectNICs,
+		Logf:            logging.Infof,
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var state *warm.State
+	tracker.Start()
+	if action == "precopy" {
+		state, err = warm.Precopy(ctx, vsphereClient, vmRefs[0], statePath, opts)
+	} else {
+		state, err = warm.Cutover(ctx, vsphereClient, statePath, opts)
+	}
+	tracker.Stop()
+	if err != nil {
+		fatalf("The %s of VM %s failed: %v", action, vmRefs[0], err)
+	}
+	for _, summary := range state.Syncs[len(state.Syncs)-1].Summaries {
+		logging.Infof("%s", summary)
+	}
+	if action == "precopy" {
+		logging.Infof("Precopy %d of VM %s done, state in %s; run warm precopy again to copy the new changes, or warm cutover\n", len(state.Syncs), state.VMName, statePath)
 		return
 	}
+	logging.Infof("VM %s is stopped and its disks hold its final state\n", state.VMName)
+	name := *outputVMName
+	if name == "" {
+		name = kubevirt.SanitizeName(state.VMName)
+	}
+	vmPath, err := cluster.ResourcePath(kubevirtv1.GroupVersion.String(), "VirtualMachine", *namespace, name)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	if *v2vMode != "" || *injectVirtio || *linuxBootCheck != "" {
+		config, err := vsphereClient.VMConfig(ctx, vsphere.MoRef{Type: "VirtualMachine", Value: state.VM})
+		if err != nil {
+			fatalf("%v", err)
+		}
+		guestOS := ova.GuestOS(config.GuestID)
+		family := (&vmx.VMXConfig{GuestOS: guestOS}).GuestOSFamily()
+		var disks []v2v.Disk
+		for _, disk := range state.Disks {
+			info, err := os.Stat(disk.Output)
+			if err != nil {
+				fatalf("%v", err)
+			}
+			disks = append(disks, v2v.Disk{Path: disk.Output, Block: info.Mode()&os.ModeDevice != 0})
+		}
+		logf := logging.Infof
+		if *v2vMode != "" || *injectVirtio {
+			if *injectVirtio && family != "windows" {
+				logging.Infof("Not injecting the virtio drivers into VM %s: guest OS %s is not Windows\n", state.VMName, guestOS)
+			} else if *injectVirtio {
+				if err := v2v.InjectDrivers(ctx, disks, *virtioWin, logf); err != nil {
+					fatalf("Failed to inject the virtio drivers into VM %s: %v", state.VMName, err)
+				}
+			} else if !v2v.Selects(v2vGuests, guestOS, family) {
+				logging.Infof("Not converting the guest of VM %s with virt-v2v: guest OS %s is not selected by -v2v-guest-os\n", state.VMName, guestOS)
+			} else if *v2vMode == v2v.ModeLocal {
+				logging.Infof("Converting the guest of VM %s with virt-v2v\n", state.VMName)
+				if err := v2v.RunLocal(ctx, state.VMName, disks, v2v.LocalOptions{VirtioWin: *virtioWin, Logf: logf}); err != nil {
+					fatalf("Failed to convert the guest of VM %s: %v", state.VMName, err)
+				}
+			} else {
+				client := clusterClient(*kubeconfig)
+				var vm kubevirtv1.VirtualMachine
+				if err := client.Get(ctx, vmPath, &vm); err != nil {
+					fatalf("Failed to read VirtualMachine %s/%s, whose claims -v2v job converts: %v", *namespace, name, err)
+				}
+				if err := v2v.RunJob(ctx, client, *namespace, name, v2v.Claims(&vm), v2v.JobOptions{
+					Image: *v2vImage,
+					Logf:  logging.Infof,
+				}); err != nil {
+					fatalf("Failed to convert the guest of VM %s: %v", state.VMName, err)
+				}
+			}
+		}
+		if *linuxBootCheck != "" && family != "linux" {
+			logging.Infof("Not checking the boot settings of VM %s: guest OS %s is not Linux\n", state.VMName, guestOS)
+		} else if *linuxBootCheck != "" {
+			if err := checkLinuxBoot(ctx, disks, *linuxBootCheck == v2v.BootCheckFix, "VM "+state.VMName); err != nil {
+				fatalf("Failed to check the boot settings of VM %s: %v", state.VMName, err)
+			}
+		}
+	}
+	if !*cutoverStart {
+		return
+	}
+	if err := clusterClient(*kubeconfig).MergePatch(ctx, vmPath, map[string]any{"spec": map[string]any{"runStrategy": kubevirtv1.RunStrategyAlways, "running": nil}}); err != nil {
+		if cluster.IsNotFound(err) {
+			exitf(failure.Cluster, "VirtualMachine %s/%s is not in the cluster; apply the manifest of the VM with -pvc naming the claims the disks were copied to, and start it, or name it with -name and -namespace", *namespace, name)
+		}
+		fatalf("Failed to start VirtualMachine %s/%s: %v", *namespace, name, err)
+	}
+	logging.Infof("Started VirtualMachine %s/%s\n", *namespace, name)
+}
 
-	// Handle VMX to KubeVirt VM conversion.
-	// Both -vmx and -pvc must be provided for this action.
-	if *vmxPath != "" && *pvcName != "" {
-		vmxConfig, err := vmx.ParseVMX(*vmxPath)
+// runInspectVMDK displays the descriptor of the VMDK at vmdkPath.
+func runInspectVMDK(vmdkPath string) {
+	if *outputFormat == "json" {
+		info, err := report.DescribeVMDK(vmdkPath)
+		if err != nil {
+			fatalf("Failed to read VMDK file '%s': %v\n", vmdkPath, err)
+		}
+		out, err := json.MarshalIndent(info, "", "  ")
 		if err != nil {
-			log.Fatalf("Error parsing VMX file: %v", err)
+			fatalf("Failed to marshal VMDK info: %v", err)
 		}
+		fmt.Println(string(out))
+		return
+	} else if *outputFormat != "" && *outputFormat != "table" {
+		exitf(failure.Usage, "Unsupported -o '%s' for inspect vmdk, must be json", *outputFormat)
+	}
+
+	descriptor, isVMDK, err := vmdk.ExtractVMDKDescriptor(vmdkPath)
+	var foreign *vmdk.ForeignFormatError
+	if errors.As(err, &foreign) {
+		fatalf("%v\n", foreign)
+	} else if err != nil {
+		if isVMDK {
+			fatalf("Failed to extract descriptor from VMDK file '%s': %v\n", vmdkPath, err)
+		} else {
+			fatalf("File '%s' is not a recognized VMDK or error occurred: %v\n", vmdkPath, err)
+		}
+	}
+	fmt.Printf("--- VMDK Descriptor for: %s ---\n%s\n--- End Descriptor ---\n", vmdkPath, descriptor)
+}
 
-		kvVM, err := kubevirt.CreateKubeVirtVM(vmxConfig, *pvcName, *outputVMName, *namespace, *runVM)
+// runInspectVMX prints the configuration read from the VMX, OVA or OVF at vmxPath.
+func runInspectVMX(vmxPath string) {
+	if *outputFormat != "" && *outputFormat != "table" && *outputFormat != "json" {
+		exitf(failure.Usage, "Unsupported -o '%s', must be table or json", *outputFormat)
+	}
+	vmxConfig, err := vmx.ParseVMX(vmxPath)
+	if err != nil {
+		fatalf("Failed to parse VMX file: %v", err)
+	}
+
+	if *outputFormat == "json" {
+		out, err := json.MarshalIndent(vmxConfig, "", "  ")
 		if err != nil {
-			log.Fatalf("Error creating KubeVirt VM object: %v", err)
+			fatalf("Failed to marshal VMX configuration: %v", err)
 		}
+		fmt.Println(string(out))
+	} else if err := report.WriteVMX(os.Stdout, vmxConfig); err != nil {
+		fatalf("Failed to write VMX configuration: %v", err)
+	}
+}
 
-		yamlData, err := yaml.Marshal(kvVM)
+// runDiskReport reports the capacity and provisioning of the VMDK at diskPath, or of the disks of
+// the VMX, OVA or OVF at diskPath.
+func runDiskReport(diskPath string) {
+	if *outputFormat != "" && *outputFormat != "table" && *outputFormat != "json" {
+		exitf(failure.Usage, "Unsupported -o '%s', must be table or json", *outputFormat)
+	}
+	var usages []report.DiskUsage
+	if strings.EqualFold(filepath.Ext(diskPath), ".vmx") || vmx.IsOVF(diskPath) {
+		vmxConfig, err := vmx.ParseVMX(diskPath)
 		if err != nil {
-			log.Fatalf("Error marshalling KubeVirt VM to YAML: %v", err)
+			fatalf("Failed to parse VMX file: %v", err)
 		}
+		usages = report.MeasureVMXDisks(vmxConfig)
+	} else {
+		usages = append(usages, report.MeasureDisk(filepath.Base(diskPath), diskPath))
+	}
 
-		// Determine output path
-		vmxDir := filepath.Dir(*vmxPath)
-		outputYAMLFileName := kvVM.Name + ".yaml"
-		outputYAMLPath := filepath.Join(vmxDir, outputYAMLFileName)
+	if *outputFormat == "json" {
+		out, err := json.MarshalIndent(usages, "", "  ")
+		if err != nil {
+			fatalf("Failed to marshal disk report: %v", err)
+		}
+		fmt.Println(string(out))
+	} else if err := report.WriteDiskTable(os.Stdout, usages); err != nil {
+		fatalf("Failed to write disk report: %v", err)
+	}
+}
 
-		log.Printf("Writing KubeVirt VirtualMachine YAML to: %s\n", outputYAMLPath)
-		err = os.WriteFile(outputYAMLPath, yamlData, 0644)
+// runPreflight checks the cluster before a migration.
+func runPreflight() {
+	if *outputFormat != "" && *outputFormat != "table" && *outputFormat != "json" {
+		exitf(failure.Usage, "Unsupported -o '%s', must be table or json", *outputFormat)
+	}
+	opts := preflight.Options{
+		Namespace:    *namespace,
+		StorageClass: *storageClass,
+		DiskSource:   *diskSource,
+		Pool:         *outputKind == "VirtualMachinePool",
+		Filesystems:  len(filesystems) > 0,
+		SharedDisks:  len(sharedDiskMaps) > 0,
+	}
+	for _, binding := range netBindings {
+		if _, value, ok := strings.Cut(binding, "="); ok {
+			binding = value
+		}
+		opts.Bindings = append(opts.Bindings, binding)
+	}
+	if *networkMapPath != "" {
+		networkMap, err := kubevirt.LoadNetworkMap(*networkMapPath)
+		if err != nil {
+			fatalf("Failed to load -network-map: %v", err)
+		}
+		for _, entry := range networkMap.Networks {
+			if entry.Target != "pod" && entry.Target != "skip" {
+				opts.Networks = append(opts.Networks, entry.Target)
+			}
+			if entry.Binding != "" {
+				opts.Bindings = append(opts.Bindings, entry.Binding)
+			}
+		}
+	}
+	results := preflight.Run(context.Background(), clusterClient(*kubeconfig), opts)
+	if *outputFormat == "json" {
+		out, err := json.MarshalIndent(results, "", "  ")
 		if err != nil {
-			log.Fatalf("Error writing KubeVirt VM YAML to file %s: %v", outputYAMLPath, err)
+			fatalf("Failed to marshal preflight report: %v", err)
+		}
+		fmt.Println(string(out))
+	} else if err := preflight.WriteTable(os.Stdout, results); err != nil {
+		fatalf("Failed to write preflight report: %v", err)
+	}
+	if preflight.Failed(results) {
+		os.Exit(failure.Cluster.ExitCode())
+	}
+}
+
+// runCheck checks the VMs of -vmx, of args or of -vm for what stops or changes their migration.
+func runCheck(args []string) {
+	vmxPaths, sourceFlag := vmSources(args)
+	var vsphereClient *vsphere.Client
+	if sourceFlag == "vm" {
+		vsphereClient = vsphereLogin()
+		defer vsphereClient.Logout(context.Background())
+	}
+	if *outputFormat != "" && *outputFormat != "text" && *outputFormat != "json" {
+		exitf(failure.Usage, "Unsupported -o '%s', must be text or json", *outputFormat)
+	}
+	if len(vmxPaths) == 0 {
+		exitf(failure.Usage, "check requires -vmx files or -vm VMs")
+	}
+	ctx := context.Background()
+	var reports []compat.Report
+	for _, source := range vmxPaths {
+		r := compat.Report{Source: source}
+		var vmxConfig *vmx.VMXConfig
+		var vmConfig *vsphere.VMConfig
+		var err error
+		if vsphereClient != nil {
+			ref, err := vsphereClient.FindVM(ctx, source)
+			if err != nil {
+				fatalf("Failed to read VM %s from %s: %v", source, *vcenterURL, err)
+			}
+			if vmConfig, err = vsphereClient.VMConfig(ctx, ref); err != nil {
+				fatalf("Failed to read VM %s from %s: %v", source, *vcenterURL, err)
+			}
+			if vmxConfig, r.Source, err = vsphereClient.ReadVMX(ctx, source); err != nil {
+				fatalf("Failed to read VM %s from %s: %v", source, *vcenterURL, err)
+			}
+		} else if vmxConfig, err = vmx.ParseVMX(source); err != nil {
+			fatalf("Failed to parse VMX file %s: %v", source, err)
+		}
+		r.VM = vmxConfig.DisplayName
+		r.Findings = compat.Check(vmxConfig, vmConfig, compat.Options{DiskSource: *diskSource})
+		reports = append(reports, r)
+	}
+	if *outputFormat == "json" {
+		out, err := json.MarshalIndent(reports, "", "  ")
+		if err != nil {
+			fatalf("Failed to marshal compatibility report: %v", err)
+		}
+		fmt.Println(string(out))
+	} else if err := compat.WriteText(os.Stdout, reports); err != nil {
+		fatalf("Failed to write compatibility report: %v", err)
+	}
+	if compat.Failed(reports) {
+		os.Exit(failure.Unsupported.ExitCode())
+	}
+}
+
+// runConvertDisk converts the VMDK at vmdkPath, or the disk of the -vm VM it names, to a raw or
+// qcow2 image.
+func runConvertDisk(vmdkPath string) {
+	checkGuestFlags()
+	transferRate, globalLimiter := transferLimits()
+	var vsphereClient *vsphere.Client
+	if len(vmRefs) > 0 {
+		vsphereClient = vsphereLogin()
+		defer vsphereClient.Logout(context.Background())
+	}
+	var remote *vsphere.Disk
+	if vsphereClient != nil && *diskEngine != "vddk" {
+		exitf(failure.Usage, "The disks of a -vm VM are read with -disk-engine vddk, or downloaded with -download-dir and converted as files")
+	}
+	if *diskFormat != "raw" && *diskFormat != "qcow2" {
+		exitf(failure.Usage, "Unsupported -disk-format '%s', must be raw or qcow2", *diskFormat)
+	}
+	if *sinceChangeID != "" && *diskFormat != "raw" {
+		exitf(failure.Usage, "-since-change-id only supports -disk-format raw")
+	}
+	engine, err := convert.Lookup(*diskEngine)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	tracker, err := progress.New(*progressMode)
+	if err != nil {
+		fatalf("%v", err)
+	}
+
+	// With -transfer job, the conversion runs as a run of vmx2vmi in a Job, with the options
+	// of the copy.
+	if *transferMode != "local" && *transferMode != "job" {
+		exitf(failure.Usage, "Unsupported -transfer '%s', must be local or job", *transferMode)
+	}
+	if *transferMode == "job" {
+		switch {
+		case *diskEngine != "vddk" || vsphereClient == nil || len(vmRefs) != 1:
+			exitf(failure.Usage, "-transfer job copies a disk of the VM of -vm read with -disk-engine vddk, which requires one -vm with -vcenter-url")
+		case *diskOutputPath == "":
+			exitf(failure.Usage, "-transfer job writes to the claim -disk-output names, e.g. -disk-output web01-boot")
+		case *diskFormat != "raw":
+			exitf(failure.Usage, "-transfer job writes raw images, KubeVirt reads no other format from a claim")
+		case *vddkSecret == "" || *transferImage == "":
+			exitf(failure.Usage, "-transfer job needs -transfer-image, and -vddk-secret with the vCenter user and password the Job reads the disk with")
+		case *injectVirtio || *linuxBootCheck != "":
+			exitf(failure.Usage, "-inject-virtio-drivers and -linux-boot-check read the -disk-output on this host, they cannot be combined with -transfer job; convert the guest with -v2v job once the VM is applied")
+		}
+		args := []string{"-vcenter-url", *vcenterURL, "-vcenter-user", "$(VCENTER_USER)", "-vm", vmRefs[0], "-disk-engine", "vddk"}
+		forwarded := []string{
+			"vcenter-insecure", "vcenter-thumbprint", "vddk-transports", "vddk-snapshot", "source-snapshot", "snapshot-quiesce",
+			"since-change-id", "read-workers", "bwlimit", "verify", "log-level",
+		}
+		runFlags.Visit(func(f *flag.Flag) {
+			if slices.Contains(forwarded, f.Name) {
+				args = append(args, "-"+f.Name+"="+f.Value.String())
+			}
+		})
+		diskProgress := tracker.Add(vmdkPath, 0)
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		tracker.Start()
+		err := transfer.RunConvertJob(ctx, clusterClient(*kubeconfig), transfer.ConvertJobOptions{
+			Namespace:     *namespace,
+			Name:          kubevirt.SanitizeName(path.Base(vmRefs[0])),
+			Image:         *transferImage,
+			VDDKInitImage: *vddkInitImage,
+			Secret:        *vddkSecret,
+			Claim:         *diskOutputPath,
+			Disk:          vmdkPath,
+			Args:          args,
+			Progress:      diskProgress,
+			Logf:          logging.Infof,
+		})
+		if err == nil {
+			diskProgress.Done()
+		}
+		tracker.Stop()
+		if err != nil {
+			fatalf("Failed to convert disk %s of VM %s: %v", vmdkPath, vmRefs[0], err)
+		}
+		return
+	}
+
+	// removeSnapshot removes the snapshot of -source-snapshot; the errors below call it before
+	// exiting, as fatalf skips deferred calls.
+	removeSnapshot := func() {}
+	if *diskEngine == "vddk" {
+		if vsphereClient == nil || len(vmRefs) != 1 {
+			exitf(failure.Usage, "-disk-engine vddk reads a disk of the VM of -vm, which requires one -vm with -vcenter-url")
+		}
+		snapshot := *vddkSnapshot
+		if *sourceSnapshot {
+			if snapshot != "" {
+				exitf(failure.Usage, "-source-snapshot takes a snapshot of its own, it cannot be combined with -vddk-snapshot")
+			}
+			ctx := context.Background()
+			vm, err := vsphereClient.FindVM(ctx, vmRefs[0])
+			if err != nil {
+				fatalf("%v", err)
+			}
+			logging.Infof("Taking a snapshot of VM %s\n", vmRefs[0])
+			ref, err := vsphereClient.CreateSnapshot(ctx, vm, "vmx2vmi-copy", "Disk copy by vmx2vmi, removed after the copy", *snapshotQuiesce)
+			if err != nil {
+				fatalf("%v", err)
+			}
+			snapshot = ref.Value
+			removeSnapshot = func() {
+				if remote != nil {
+					remote.Close()
+				}
+				logging.Infof("Removing snapshot %s of VM %s\n", ref.Value, vmRefs[0])
+				if err := vsphereClient.RemoveSnapshot(ctx, ref); err != nil {
+					logging.Warnf("%v; remove it in vSphere\n", err)
+				}
+			}
+		} else if *snapshotQuiesce {
+			logging.Warnf("-snapshot-quiesce only applies to the snapshots of -source-snapshot and warm precopies.")
+		}
+		remote, err = vsphereClient.OpenDisk(context.Background(), vmRefs[0], vmdkPath, vsphere.VDDKOptions{
+			LibDir:     *vddkLibDir,
+			Transports: *vddkTransports,
+			Snapshot:   snapshot,
+		})
+		if err != nil {
+			removeSnapshot()
+			fatalf("Failed to open disk %s of VM %s: %v", vmdkPath, vmRefs[0], err)
+		}
+		defer remote.Close()
+	} else if *sourceSnapshot {
+		exitf(failure.Usage, "-source-snapshot snapshots the -vm VM read with -disk-engine vddk")
+	}
+	output := *diskOutputPath
+	if output == "" && remote != nil {
+		output = kubevirt.SanitizeName(remote.VMName+"-"+remote.ID) + "." + *diskFormat
+	} else if output == "" {
+		output = strings.TrimSuffix(vmdkPath, filepath.Ext(vmdkPath)) + "." + *diskFormat
+		if archive, member, ok := ova.SplitPath(vmdkPath); ok {
+			// The image of an OVA member goes next to the archive.
+			output = filepath.Join(filepath.Dir(archive), strings.TrimSuffix(path.Base(member), path.Ext(member))+"."+*diskFormat)
+		}
+	}
+	diskProgress := tracker.Add(filepath.Base(vmdkPath), 0)
+	logging.Infof("Converting %s to %s image %s with the %s engine\n", vmdkPath, *diskFormat, output, engine.Name())
+	tracker.Start()
+	result, err := engine.Convert(context.Background(), vmdkPath, output, convert.Options{
+		Format:        *diskFormat,
+		ClusterSize:   *qcow2ClusterSize,
+		Compress:      *qcow2Compress,
+		SinceChangeID: *sinceChangeID,
+		ReadWorkers:   *readWorkers,
+		Limiters:      []*transfer.Limiter{transfer.NewLimiter(transferRate), globalLimiter},
+		Progress:      diskProgress,
+		Resume:        *resume,
+		Verify:        *verifyDisk,
+		Remote:        remoteDisk(remote),
+	})
+	if err == nil {
+		diskProgress.Done()
+	}
+	tracker.Stop()
+	removeSnapshot()
+	if err != nil {
+		fatalf("Failed to convert disk: %v", err)
+	}
+	logging.Infof("%s", result.Summary)
+	if result.SHA256 != "" {
+		logging.Infof("sha256 of disk content: %s\n", result.SHA256)
+	}
+	if *verifyDisk {
+		logging.Infof("Verified %s against %s\n", output, vmdkPath)
+	}
+	if result.ChangeID != "" {
+		logging.Infof("Change ID for the next incremental sync (-since-change-id): %s\n", result.ChangeID)
+	}
+	if *injectVirtio {
+		disk := v2v.Disk{Path: output, Format: *diskFormat}
+		if info, err := os.Stat(output); err == nil && info.Mode()&os.ModeDevice != 0 {
+			disk.Block = true
+		}
+		if err := v2v.InjectDrivers(context.Background(), []v2v.Disk{disk}, *virtioWin, logging.Infof); err != nil {
+			fatalf("Failed to inject the virtio drivers into %s: %v", output, err)
+		}
+	}
+	if *linuxBootCheck != "" {
+		disk := v2v.Disk{Path: output, Format: *diskFormat}
+		if info, err := os.Stat(output); err == nil && info.Mode()&os.ModeDevice != 0 {
+			disk.Block = true
+		}
+		if err := checkLinuxBoot(context.Background(), []v2v.Disk{disk}, *linuxBootCheck == v2v.BootCheckFix, output); err != nil {
+			fatalf("Failed to check the boot settings of %s: %v", output, err)
 		}
+	}
+}
+
+// runUploadDisk uploads the VMDK at vmdkPath to a DataVolume through the CDI upload proxy.
+func runUploadDisk(vmdkPath string) {
+	transferRate, globalLimiter := transferLimits()
+	disk, err := vmdk.Open(vmdkPath)
+	if err != nil {
+		fatalf("Failed to open VMDK: %v", err)
+	}
+	defer disk.Close()
+
+	name := *uploadDataVolume
+	if name == "" {
+		base := filepath.Base(vmdkPath)
+		name = kubevirt.SanitizeName(strings.TrimSuffix(base, filepath.Ext(base)))
+	}
+	size := *uploadSize
+	if size == "" {
+		size = fmt.Sprintf("%dGi", (disk.Size()+(1<<30)-1)>>30)
+	}
+	cfg, err := cluster.LoadConfig(*kubeconfig, "")
+	if err != nil {
+		fatalf("Failed to load kubeconfig: %v", err)
+	}
+	client, err := cluster.NewClient(cfg)
+	if err != nil {
+		fatalf("Failed to create cluster client: %v", err)
+	}
+
+	tracker, err := progress.New(*progressMode)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	diskProgress := tracker.Add(name, disk.Size())
+	logging.Infof("Uploading %s (%d bytes) to DataVolume %s/%s\n", vmdkPath, disk.Size(), *namespace, name)
+	tracker.Start()
+	src := diskProgress.Wrap(vmdk.NewReadAhead(disk, disk.Size(), *readWorkers))
+	ctx := context.Background()
+	sum, err := transfer.Upload(ctx, client, src, disk.Size(), transfer.UploadOptions{
+		Namespace:    *namespace,
+		DataVolume:   name,
+		Size:         size,
+		StorageClass: *storageClass,
+		ProxyURL:     *uploadProxyURL,
+		Insecure:     *uploadProxyInsecure,
+		Retries:      3,
+		OnRetry:      diskProgress.Retry,
+		Verify:       *verifyDisk,
+		VerifyImage:  *verifyImage,
+		Throttle: func(r io.Reader) io.Reader {
+			return transfer.LimitReader(ctx, r, transfer.NewLimiter(transferRate), globalLimiter)
+		},
+	})
+	if err == nil {
+		diskProgress.Done()
+	}
+	tracker.Stop()
+	if err != nil {
+		fatalf("Failed to upload disk: %v", err)
+	}
+	logging.Infof("sha256 of disk content: %s (recorded in %s)\n", sum, transfer.DigestAnnotation)
+	if *verifyDisk {
+		logging.Infof("Verified the content of PVC %s/%s\n", *namespace, name)
+	}
+	logging.Infof("Uploaded %s to DataVolume %s/%s, reference it with -pvc %s\n", vmdkPath, *namespace, name, name)
+}
+
+// diffCluster is set by the diff command, which compares the VMs with those in the cluster
+// instead of writing their manifests.
+var diffCluster bool
+
+// runConvert converts the VMs of -vmx, of args or of -vm to KubeVirt manifests, or downloads the
+// -vm VMs to -download-dir.
+func runConvert(args []string) {
+	checkGuestFlags()
+	sources, sourceFlag := vmSources(args)
+	if len(sources) > 1 && *pvcName != "" {
+		if *outputVMName != "" {
+			exitf(failure.Usage, "-name names one VM and cannot be combined with several VMX files")
+		}
+		if len(diskMaps) > 0 {
+			exitf(failure.Usage, "-disk-map names the claims of one VM and cannot be combined with several VMX files")
+		}
+		if !strings.Contains(*pvcName, "{name}") {
+			exitf(failure.Usage, "-pvc must contain {name} when converting several VMX files, so each VM gets its own claim, e.g. -pvc '{name}-boot'")
+		}
+	}
+
+	// Several VMs are converted or downloaded in parallel as the VMs of a plan, each by a run of
+	// this binary, so that a VM failing does not stop the others.
+	if *parallel > 1 && len(sources) > 1 && (*pvcName != "" || *downloadDir != "") {
+		runBatch(sources, sourceFlag)
 		return
 	}
+	var vsphereClient *vsphere.Client
+	if sourceFlag == "vm" {
+		vsphereClient = vsphereLogin()
+		defer vsphereClient.Logout(context.Background())
+	}
+	if *downloadDir != "" {
+		if vsphereClient == nil {
+			exitf(failure.Usage, "-download-dir downloads the -vm VMs and requires -vm")
+		}
+		sources = downloadVMs(vsphereClient, sources)
+		if *pvcName == "" {
+			return
+		}
+		// The downloaded VMs are converted as local VMX files.
+		vsphereClient = nil
+	}
+	if len(sources) == 0 || *pvcName == "" {
+		badUsage(sources)
+	}
+
+	// Each VM is converted as if it were the only one; a failure stops the remaining ones.
+	// drifted counts the VMs diff found different in the cluster.
+	drifted := 0
+	for i, source := range sources {
+		if len(sources) > 1 {
+			logging.Infof("Converting %s (%d/%d)\n", source, i+1, len(sources))
+		}
+		if convertVM(vsphereClient, source, i == 0) {
+			drifted++
+		}
+	}
+	if drifted > 0 {
+		os.Exit(failure.General.ExitCode())
+	}
+}
+
+// runBatch converts or downloads sources, given with -sourceFlag, each by a run of this binary.
+func runBatch(sources []string, sourceFlag string) {
+	budgets := transferBudgets()
+	if *toStdout {
+		exitf(failure.Usage, "-stdout writes the manifests of all VMs as one stream and cannot be combined with -parallel")
+	}
+	command, err := os.Executable()
+	if err != nil {
+		fatalf("%v", err)
+	}
+	jobs := make([]batch.Job, len(sources))
+	for i, source := range sources {
+		jobs[i] = batch.Job{Source: source, Args: batchArgs(sourceFlag, source)}
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	logging.Infof("Converting %d VMs, %d at a time\n", len(jobs), min(*parallel, len(jobs)))
+	results := batch.Run(ctx, command, jobs, budgets, os.Stderr, func(job batch.Job, result *batch.Result, progress batch.Progress) {
+		switch {
+		case result == nil:
+			logging.Infof("Converting %s (%d running, %d pending)\n", job.Source, progress.Running, progress.Pending())
+		case result.Err != nil:
+			logging.Errorf("Failed to convert %s after %s: %v (%d/%d done, %d failed)\n", job.Source, result.Duration, result.Err, progress.Succeeded+progress.Failed, progress.Total, progress.Failed)
+		default:
+			logging.Infof("Converted %s in %s (%d/%d done, %d failed)\n", job.Source, result.Duration, progress.Succeeded+progress.Failed, progress.Total, progress.Failed)
+		}
+	})
+	if err := batch.WriteTable(os.Stdout, results); err != nil {
+		fatalf("Failed to write the results of the conversions: %v", err)
+	}
+	if !batch.AllSucceeded(results) {
+		var errs []error
+		converted := 0
+		for _, result := range results {
+			if result.State == batch.Succeeded {
+				converted++
+			} else {
+				errs = append(errs, result.Err)
+			}
+		}
+		os.Exit(failure.OfBatch(errs, converted).ExitCode())
+	}
+}
 
-	// If neither primary action was fully specified, provide specific error messages.
-	if *vmxPath != "" && *pvcName == "" {
-		log.Println("Error: -pvc flag is required with -vmx for VM conversion.")
-		flag.Usage()
-		os.Exit(1)
+// downloadVMs downloads the files of the refs VMs to -download-dir and returns their VMX files.
+func downloadVMs(vsphereClient *vsphere.Client, refs []string) []string {
+	transferRate, globalLimiter := transferLimits()
+	tracker, err := progress.New(*progressMode)
+	if err != nil {
+		fatalf("%v", err)
 	}
-	if *vmxPath == "" && *pvcName != "" {
-		log.Println("Error: -vmx flag is required with -pvc for VM conversion.")
-		flag.Usage()
-		os.Exit(1)
+	ctx := context.Background()
+	files := map[string]*progress.Disk{}
+	opts := vsphere.DownloadOptions{
+		Retries: 5,
+		Throttle: func(r io.Reader) io.Reader {
+			return transfer.LimitReader(ctx, r, transfer.NewLimiter(transferRate), globalLimiter)
+		},
+		Progress: func(name string, size int64) func(int64) {
+			// The VMX, NVRAM and descriptors are too small for a bar.
+			if size < 1<<20 {
+				return func(int64) {}
+			}
+			file := tracker.Add(name, size)
+			files[name] = file
+			return func(written int64) {
+				file.Set(written)
+				if written == size {
+					file.Done()
+				}
+			}
+		},
+		OnRetry: func(name string) { files[name].Retry() },
 	}
-	// Handle cases where optional flags are provided without the necessary primary flags for conversion.
-	if (*outputVMName != "" || *namespace != "default" || *runVM) && (*vmxPath == "" || *pvcName == "") && *vmdkInfoPath == "" {
-		log.Println("Error: Optional flags like -name, -namespace, -run require both -vmx and -pvc for VM conversion.")
-		flag.Usage()
-		os.Exit(1)
+	var downloaded []string
+	tracker.Start()
+	for _, ref := range refs {
+		vmxPath, err := vsphereClient.DownloadVM(ctx, ref, *downloadDir, opts)
+		if err != nil {
+			tracker.Stop()
+			fatalf("Failed to download VM %s: %v", ref, err)
+		}
+		logging.Infof("Downloaded VM %s to %s\n", ref, filepath.Dir(vmxPath))
+		downloaded = append(downloaded, vmxPath)
 	}
+	tracker.Stop()
+	return downloaded
+}
 
-	// Default case: No action specified or insufficient flags for any action.
-	log.Println("Error: Please specify an action by providing appropriate flags. Use -h or --help for usage.")
+// badUsage explains why the convert flags give no VM to convert, sources being the VMs they
+// give, and exits.
+func badUsage(sources []string) {
+	if len(sources) > 0 && *pvcName == "" {
+		logging.Errorf("-pvc flag is required with -vmx for VM conversion.")
+		runFlags.Usage()
+		os.Exit(failure.Usage.ExitCode())
+	}
+	if len(sources) == 0 && *pvcName != "" {
+		logging.Errorf("-vmx or -vm flag is required with -pvc for VM conversion.")
+		runFlags.Usage()
+		os.Exit(failure.Usage.ExitCode())
+	}
+	// Handle cases where optional flags are provided without the VMs to convert.
+	if *outputVMName != "" || *namespace != "default" || *runVM || *runStrategyName != "" || *diffOnly || diffCluster {
+		logging.Errorf("Optional flags like -name, -namespace, -run, -run-strategy and -diff require both -vmx and -pvc for VM conversion, as does diff.")
+		runFlags.Usage()
+		os.Exit(failure.Usage.ExitCode())
+	}
+
+	// Default case: no command and no VM to convert.
+	logging.Errorf("Please specify a command, or the VMs to convert with -vmx and -pvc. Use -h or --help for usage.")
 	flag.Usage()
-	os.Exit(1)
+	os.Exit(failure.Usage.ExitCode())
+}
+
+// vmSources returns the VMs of the run and the flag giving one of them alone: the VMX files of
+// -vmx and args, their quoted globs expanded, or the -vm VMs.
+func vmSources(args []string) ([]string, string) {
+	paths, err := expandVMXPaths(append(vmxPaths, args...))
+	if err != nil {
+		fatalf("%v", err)
+	}
+	if len(vmRefs) == 0 {
+		return paths, "vmx"
+	}
+	if len(paths) > 0 {
+		exitf(failure.Usage, "-vm reads the VMs from vCenter and cannot be combined with -vmx")
+	}
+	return vmRefs, "vm"
+}
+
+// vsphereLogin connects to -vcenter-url, which the -vm VMs are read from like VMX files, their
+// configuration coming from the API instead of a file, and defaults the VDDK flags to it.
+func vsphereLogin() *vsphere.Client {
+	if *vcenterURL == "" || *vcenterUser == "" {
+		exitf(failure.Usage, "-vm and inventory require -vcenter-url and -vcenter-user, with the password in $VCENTER_PASSWORD")
+	}
+	vsphereClient, err := vsphere.Login(context.Background(), vsphere.Config{
+		URL:        *vcenterURL,
+		Username:   *vcenterUser,
+		Password:   os.Getenv("VCENTER_PASSWORD"),
+		Insecure:   *vcenterInsecure,
+		Thumbprint: *vcenterThumbprint,
+	})
+	if err != nil {
+		fatalf("Failed to connect to vSphere: %v", err)
+	}
+	if vsphereClient.IsVCenter() {
+		logging.Infof("Connected to %s\n", vsphereClient.Product())
+	} else {
+		logging.Infof("Connected to %s, a standalone host: -vm takes the VM names\n", vsphereClient.Product())
+	}
+	if *vddkURL == "" {
+		*vddkURL = strings.TrimSuffix(strings.TrimSuffix(*vcenterURL, "/"), "/sdk") + "/sdk"
+	}
+	if *vddkThumbprint == "" && len(strings.ReplaceAll(*vcenterThumbprint, ":", "")) == 40 {
+		*vddkThumbprint = *vcenterThumbprint
+	}
+	return vsphereClient
+}
+
+// transferBudgets returns the budgets the runs of the VMs of plans and -parallel are scheduled
+// within.
+func transferBudgets() transfer.SchedulerConfig {
+	if *parallel < 1 {
+		exitf(failure.Usage, "-parallel must be 1 or more")
+	}
+	budgets := transfer.SchedulerConfig{MaxConcurrent: *parallel}
+	var err error
+	if budgets.Datastores, budgets.DefaultDatastore, err = transfer.ParseBudgets(datastoreBudgets); err != nil {
+		exitf(failure.Usage, "-datastore-budget: %v", err)
+	}
+	if budgets.Networks, budgets.DefaultNetwork, err = transfer.ParseBudgets(networkBudgets); err != nil {
+		exitf(failure.Usage, "-network-budget: %v", err)
+	}
+	return budgets
+}
+
+// transferLimits returns the rate of -bwlimit, each disk transfer getting a limiter of its own,
+// and the limiter of -bwlimit-total shared by all.
+func transferLimits() (int64, *transfer.Limiter) {
+	transferRate, err := transfer.ParseRate(*bwLimit)
+	if err != nil {
+		exitf(failure.Usage, "-bwlimit: %v", err)
+	}
+	totalRate, err := transfer.ParseRate(*bwLimitTotal)
+	if err != nil {
+		exitf(failure.Usage, "-bwlimit-total: %v", err)
+	}
+	return transferRate, transfer.NewLimiter(totalRate)
+}
+
+// checkGuestFlags checks the flags converting the guest.
+func checkGuestFlags() {
+	if *v2vMode != "" {
+		if _, err := v2v.ParseMode(*v2vMode); err != nil {
+			exitf(failure.Usage, "-v2v: %v", err)
+		}
+	}
+	if *linuxBootCheck != "" {
+		if _, err := v2v.ParseBootCheck(*linuxBootCheck); err != nil {
+			exitf(failure.Usage, "-linux-boot-check: %v", err)
+		}
+	}
+	if err := v2v.ValidateSelectors(v2vGuests); err != nil {
+		exitf(failure.Usage, "-v2v-guest-os: %v", err)
+	}
+}
+
+// remoteDisk returns disk as the convert.RemoteDisk of a conversion, nil when there is none.
+func remoteDisk(disk *vsphere.Disk) convert.RemoteDisk {
+	if disk == nil {
+		return nil
+	}
+	return disk
+}
+
+// checkLinuxBoot checks, and with fix fixes, the boot settings of the Linux guest of disks and
+// logs its issues; subject names the guest in the log.
+func checkLinuxBoot(ctx context.Context, disks []v2v.Disk, fix bool, subject string) error {
+	issues, err := v2v.CheckBoot(ctx, disks, fix)
+	if err != nil {
+		return err
+	}
+	if len(issues) == 0 {
+		logging.Infof("The boot settings of %s do not depend on the VMware disk controllers\n", subject)
+		return nil
+	}
+	for _, issue := range issues {
+		if issue.Fixed {
+			logging.Infof("Fixed in %s: %s\n", subject, issue)
+		} else {
+			logging.Warnf("%s may not boot on virtio: %s\n", subject, issue)
+		}
+	}
+	return nil
+}
+
+// batchArgs returns the arguments of the run of this binary converting source alone, given with
+// -sourceFlag: the command of this run, and the flags set on it but the sources and -parallel.
+func batchArgs(sourceFlag, source string) []string {
+	args := strings.Fields(runCommand.name)
+	runFlags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "vmx", "vm", "parallel", "datastore-budget", "network-budget":
+			return
+		}
+		if values, ok := f.Value.(*stringSliceFlag); ok {
+			for _, value := range *values {
+				args = append(args, "-"+f.Name+"="+value)
+			}
+			return
+		}
+		args = append(args, "-"+f.Name+"="+f.Value.String())
+	})
+	return append(args, "-"+sourceFlag+"="+source)
+}
+
+// expandVMXPaths expands the glob patterns among the -vmx values and arguments, which the
+// shell did not expand because they were quoted, and drops files given twice.
+func expandVMXPaths(values []string) ([]string, error) {
+	var paths []string
+	seen := make(map[string]bool)
+	for _, value := range values {
+		matches := []string{value}
+		if strings.ContainsAny(value, "*?[") {
+			var err error
+			if matches, err = filepath.Glob(value); err != nil {
+				return nil, fmt.Errorf("invalid VMX pattern '%s': %w", value, err)
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("no VMX file matches '%s'", value)
+			}
+		}
+		for _, path := range matches {
+			if !seen[filepath.Clean(path)] {
+				seen[filepath.Clean(path)] = true
+				paths = append(paths, path)
+			}
+		}
+	}
+	return paths, nil
+}
+
+// applyObjects server-side applies objects, sorted so that each comes after what it references,
+// and logs the result of each.
+func applyObjects(client *cluster.Client, objects []manifest.Object, opts cluster.ApplyOptions) {
+	suffix := ""
+	if opts.DryRun {
+		suffix = " (server dry run)"
+	}
+	ctx := context.Background()
+	for _, obj := range objects {
+		result, err := client.Apply(ctx, obj, opts)
+		if err != nil {
+			fatalf("Failed to apply %s %s: %v", manifest.Kind(obj), obj.GetName(), err)
+		}
+		name := obj.GetName()
+		if obj.GetNamespace() != "" {
+			name = obj.GetNamespace() + "/" + name
+		}
+		logging.Infof("%s %s %s%s\n", manifest.Kind(obj), name, result, suffix)
+	}
+}
+
+// clusterClient returns a client for the cluster of kubeconfig.
+func clusterClient(kubeconfig string) *cluster.Client {
+	cfg, err := cluster.LoadConfig(kubeconfig, "")
+	if err != nil {
+		fatalf("Failed to load kubeconfig: %v", err)
+	}
+	client, err := cluster.NewClient(cfg)
+	if err != nil {
+		fatalf("Failed to create cluster client: %v", err)
+	}
+	return client
+}
+
+// fatalf logs a formatted error and exits with the status of the kind of the first error of args,
+// failure.General when it has none. Like os.Exit, it skips deferred calls.
+func fatalf(format string, args ...any) {
+	kind := failure.General
+	for _, arg := range args {
+		if err, ok := arg.(error); ok {
+			kind = failure.KindOf(err)
+			break
+		}
+	}
+	exitf(kind, format, args...)
+}
+
+// exitf logs a formatted error and exits with the status of kind.
+func exitf(kind failure.Kind, format string, args ...any) {
+	logging.Errorf(format, args...)
+	os.Exit(kind.ExitCode())
+}
+
+// waitReady waits up to timeout for the applied vm to reach stage, then logs how long each
+// step took. It exits when the VM fails or does not get there in time.
+func waitReady(client *cluster.Client, vm *kubevirtv1.VirtualMachine, timeout time.Duration, stage readiness.Stage) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	logging.Infof("Waiting up to %s for VM %s/%s\n", timeout, vm.Namespace, vm.Name)
+	steps, err := readiness.Wait(ctx, client, vm, stage, logging.Infof)
+	logging.Infof("Summary of VM %s/%s:\n", vm.Namespace, vm.Name)
+	for _, step := range steps {
+		logging.Infof("  %-8s %s\n", step.Elapsed, step.Description)
+	}
+	if err != nil {
+		fatalf("VM %s/%s is not ready: %v", vm.Namespace, vm.Name, err)
+	}
+	if len(steps) > 0 {
+		logging.Infof("VM %s/%s ready in %s\n", vm.Namespace, vm.Name, steps[len(steps)-1].Elapsed)
+	}
+}
+
+// companion is a group of resources generated alongside the VM, written to <name><suffix>.<encoding>
+// with -output-format files.
+type companion struct {
+	suffix      string
+	description string
+	objects     []manifest.Object
+}
+
+// reportDrift compares newObj with a manifest previously written to outputPath and logs
+// which fields would change and why. It returns true when the file is missing or differs.
+// When outputPath holds several documents, newObj is compared with the one of the same kind and name.
+func reportDrift(outputPath string, newObj manifest.Object) (bool, error) {
+	existingData, err := os.ReadFile(outputPath)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	documents, err := manifest.Split(existingData)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse existing manifest: %w", err)
+	}
+	existingData = nil
+	for _, doc := range documents {
+		if doc.Kind == manifest.Kind(newObj) && doc.Name == newObj.GetName() {
+			existingData = doc.Data
+		}
+	}
+	if existingData == nil {
+		logging.Infof("Existing manifest %s has no %s %s, it will be replaced.\n", outputPath, manifest.Kind(newObj), newObj.GetName())
+		return true, nil
+	}
+	existingObj := reflect.New(reflect.TypeOf(newObj).Elem()).Interface().(manifest.Object)
+	if err := yaml.Unmarshal(existingData, existingObj); err != nil {
+		return false, fmt.Errorf("failed to parse existing manifest: %w", err)
+	}
+
+	// The conversion time alone is not a change; compare as if it were the previous one.
+	comparedObj := newObj.DeepCopyObject().(manifest.Object)
+	annotations := comparedObj.GetAnnotations()
+	if convertedAt, ok := existingObj.GetAnnotations()[kubevirt.ConvertedAtAnnotation]; ok {
+		annotations[kubevirt.ConvertedAtAnnotation] = convertedAt
+	} else {
+		delete(annotations, kubevirt.ConvertedAtAnnotation)
+	}
+	changes, err := diff.Compare(existingObj, comparedObj)
+	if err != nil {
+		return false, err
+	}
+	if len(changes) == 0 {
+		logging.Infof("Existing manifest %s is up to date, not rewriting it.\n", outputPath)
+		return false, nil
+	}
+
+	oldHash := existingObj.GetAnnotations()[kubevirt.SourceHashAnnotation]
+	newHash := newObj.GetAnnotations()[kubevirt.SourceHashAnnotation]
+	switch {
+	case oldHash == "":
+		logging.Infof("Existing manifest %s carries no source hash; it was generated by an older version or edited by hand.\n", outputPath)
+	case oldHash != newHash:
+		logging.Infof("Source VMX changed since last conversion (sha256 %s -> %s).\n", oldHash, newHash)
+	default:
+		logging.Infof("Source VMX is unchanged; differences come from conversion options or a newer converter.\n")
+	}
+	logging.Infof("%d field(s) would change in %s:\n", len(changes), outputPath)
+	for _, c := range changes {
+		logging.Infof("  %s\n", c)
+	}
+	return true, nil
+}
+
+// serverFields are the metadata fields the API server maintains, which no conversion sets.
+var serverFields = []string{"uid", "resourceVersion", "generation", "creationTimestamp", "managedFields", "selfLink"}
+
+// clusterDrift compares obj with the resource of the same name in the cluster of client, as a new
+// -apply of obj would leave it with the defaults of the cluster, and lists the fields that differ
+// with the field manager that set them. It reports whether any field differs, or the resource is
+// missing.
+func clusterDrift(client *cluster.Client, obj manifest.Object) (bool, error) {
+	ctx := context.Background()
+	apiVersion, kind := obj.GetObjectKind().GroupVersionKind().ToAPIVersionAndKind()
+	path, err := cluster.ResourcePath(apiVersion, kind, obj.GetNamespace(), obj.GetName())
+	if err != nil {
+		return false, err
+	}
+	var live map[string]any
+	if err := client.Get(ctx, path, &live); cluster.IsNotFound(err) {
+		logging.Infof("%s %s/%s does not exist in the cluster.\n", kind, obj.GetNamespace(), obj.GetName())
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	// The conversion time alone is not a change; compare as if it were the one in the cluster.
+	desired := obj.DeepCopyObject().(manifest.Object)
+	liveAnnotations, _, _ := unstructured.NestedStringMap(live, "metadata", "annotations")
+	if annotations := desired.GetAnnotations(); annotations != nil {
+		if convertedAt, ok := liveAnnotations[kubevirt.ConvertedAtAnnotation]; ok {
+			annotations[kubevirt.ConvertedAtAnnotation] = convertedAt
+		} else {
+			delete(annotations, kubevirt.ConvertedAtAnnotation)
+		}
+	}
+	var applied map[string]any
+	if err := client.PreviewApply(ctx, desired, &applied); err != nil {
+		return false, err
+	}
+	owners, err := diff.Owners(live)
+	if err != nil {
+		return false, err
+	}
+	for _, o := range []map[string]any{live, applied} {
+		delete(o, "status")
+		for _, field := range serverFields {
+			unstructured.RemoveNestedField(o, "metadata", field)
+		}
+	}
+	changes, err := diff.Compare(live, applied)
+	if err != nil {
+		return false, err
+	}
+	if len(changes) == 0 {
+		logging.Infof("%s %s/%s matches the conversion, applying it again changes nothing.\n", kind, obj.GetNamespace(), obj.GetName())
+		return false, nil
+	}
+
+	oldHash := liveAnnotations[kubevirt.SourceHashAnnotation]
+	newHash := obj.GetAnnotations()[kubevirt.SourceHashAnnotation]
+	switch {
+	case oldHash == "":
+		logging.Infof("%s %s/%s carries no source hash; it was not applied by vmx2vmi, or by an older version.\n", kind, obj.GetNamespace(), obj.GetName())
+	case oldHash != newHash:
+		logging.Infof("Source VMX changed since the conversion applied to the cluster (sha256 %s -> %s).\n", oldHash, newHash)
+	}
+	logging.Infof("%d field(s) of %s %s/%s differ from the conversion:\n", len(changes), kind, obj.GetNamespace(), obj.GetName())
+	for _, c := range changes {
+		if manager := owners[c.Path]; manager != "" {
+			logging.Infof("  %s (set by %s)\n", c, manager)
+		} else {
+			logging.Infof("  %s\n", c)
+		}
+	}
+	return true, nil
+}
+
+// bundleChanged reports whether the documents of the bundle previously written to outputPath,
+// other than primary, differ from those of bundle.
+func bundleChanged(outputPath string, bundle []byte, primary manifest.Object) (bool, error) {
+	existingData, err := os.ReadFile(outputPath)
+	if err != nil {
+		return false, err
+	}
+	companions := func(data []byte) ([][]byte, error) {
+		documents, err := manifest.Split(data)
+		if err != nil {
+			return nil, err
+		}
+		var others [][]byte
+		for _, doc := range documents {
+			if doc.Kind != manifest.Kind(primary) || doc.Name != primary.GetName() {
+				others = append(others, doc.Data)
+			}
+		}
+		return others, nil
+	}
+	existing, err := companions(existingData)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse existing manifest: %w", err)
+	}
+	generated, err := companions(bundle)
+	if err != nil {
+		return false, err
+	}
+	if !reflect.DeepEqual(existing, generated) {
+		logging.Infof("Resources bundled with %s %s in %s changed.\n", manifest.Kind(primary), primary.GetName(), outputPath)
+		return true, nil
+	}
+	return false, nil
 }
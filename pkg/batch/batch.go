@@ -0,0 +1,205 @@
+// Package batch converts several VMs at once. Each VM is converted by its own run of vmx2vmi, so
+// that a VM failing, or running out of memory, does not stop the others, and the runs, with their
+// disk transfers, are scheduled within the budgets of a transfer.Scheduler.
+package batch
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"vmx2vmi/pkg/failure"
+	"vmx2vmi/pkg/logging"
+	"vmx2vmi/pkg/transfer"
+)
+
+// Job is the conversion of one VM.
+type Job struct {
+	// Source is the VMX file or -vm reference of the VM; it prefixes the lines of its output.
+	Source string
+	// Args are the arguments of its run of vmx2vmi.
+	Args []string
+}
+
+// States of a Result.
+const (
+	Succeeded = "succeeded"
+	Failed    = "failed"
+	// NotRun jobs did not start before the batch was interrupted.
+	NotRun = "not run"
+)
+
+// Result is the outcome of a Job. Err is the last error a failed conversion logged.
+type Result struct {
+	Source   string
+	State    string
+	Err      error
+	Duration time.Duration
+}
+
+// Progress counts the jobs of a batch by state.
+type Progress struct {
+	Total, Running, Succeeded, Failed int
+}
+
+// Pending returns the number of jobs not started yet.
+func (p Progress) Pending() int {
+	return p.Total - p.Running - p.Succeeded - p.Failed
+}
+
+// Run runs command, the vmx2vmi binary, for each job, as budgets let them run, each with its share
+// of their bandwidth, and returns their results in the order of jobs; jobs not started when ctx
+// is done are NotRun. The output of each run goes to out line by line, prefixed with the source of
+// its job. notify is called, never concurrently, when a job starts, with a nil result, and when
+// it ends.
+func Run(ctx context.Context, command string, jobs []Job, budgets transfer.SchedulerConfig, out io.Writer, notify func(job Job, result *Result, progress Progress)) []Result {
+	var mu sync.Mutex
+	progress := Progress{Total: len(jobs)}
+	results := make([]Result, len(jobs))
+	transfers := make([]transfer.Job, len(jobs))
+	for i, job := range jobs {
+		results[i] = Result{Source: job.Source, State: NotRun}
+		transfers[i] = transfer.Job{ID: job.Source, VM: job.Source, Run: func(ctx context.Context, grant transfer.Grant) error {
+			runJob(ctx, command, job, grant.Rate, out, &mu, &results[i], &progress, notify)
+			return nil
+		}}
+	}
+	transfer.NewScheduler(budgets).Run(ctx, transfers)
+	return results
+}
+
+// runJob runs one job of Run at rate, recording its result.
+func runJob(ctx context.Context, command string, job Job, rate int64, out io.Writer, mu *sync.Mutex, result *Result, progress *Progress, notify func(job Job, result *Result, progress Progress)) {
+	mu.Lock()
+	progress.Running++
+	notify(job, nil, *progress)
+	mu.Unlock()
+
+	start := time.Now()
+	job.Args = WithRate(job.Args, rate)
+	err := run(ctx, command, job, out, mu)
+
+	mu.Lock()
+	defer mu.Unlock()
+	result.State, result.Err, result.Duration = Succeeded, err, time.Since(start).Truncate(time.Second)
+	progress.Running--
+	if err != nil {
+		result.State = Failed
+		progress.Failed++
+	} else {
+		progress.Succeeded++
+	}
+	notify(job, result, *progress)
+}
+
+// WithRate returns the arguments of a run of vmx2vmi sharing rate bytes per second among its disk
+// transfers: args with -bwlimit-total lowered to rate. A rate of 0 leaves them unchanged.
+func WithRate(args []string, rate int64) []string {
+	if rate <= 0 {
+		return args
+	}
+	for i, arg := range args {
+		name, value, ok := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if name != "bwlimit-total" || !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		if !ok && i+1 < len(args) {
+			value = args[i+1]
+		}
+		if limit, err := transfer.ParseRate(value); err == nil && limit > 0 && limit <= rate {
+			return args
+		}
+	}
+	return append(slices.Clip(args), "-bwlimit-total", strconv.FormatInt(rate, 10))
+}
+
+// AllSucceeded reports whether every job of results succeeded.
+func AllSucceeded(results []Result) bool {
+	return !slices.ContainsFunc(results, func(r Result) bool { return r.State != Succeeded })
+}
+
+// WriteTable renders results as an aligned table.
+func WriteTable(w io.Writer, results []Result) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "VM\tSTATE\tDURATION\tDETAIL")
+	for _, r := range results {
+		duration, detail := "-", "-"
+		if r.State != NotRun {
+			duration = r.Duration.String()
+		}
+		if r.Err != nil {
+			detail = r.Err.Error()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", r.Source, r.State, duration, detail)
+	}
+	return tw.Flush()
+}
+
+// withSource marks a line of the output of a run with the source of its job: a JSON log record
+// gets a source attribute, other lines a [source] prefix.
+func withSource(line, source string) string {
+	if strings.HasPrefix(line, "{") && json.Valid([]byte(line)) {
+		attr, _ := json.Marshal(source)
+		return `{"source":` + string(attr) + "," + strings.TrimPrefix(line, "{")
+	}
+	return "[" + source + "] " + line
+}
+
+// run runs one job, writing its output to out under mu.
+func run(ctx context.Context, command string, job Job, out io.Writer, mu *sync.Mutex) error {
+	cmd := exec.CommandContext(ctx, command, job.Args...)
+	output, writer := io.Pipe()
+	cmd.Stdout, cmd.Stderr = writer, writer
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start the conversion: %w", err)
+	}
+	done := make(chan string)
+	go func() {
+		var last, lastError string
+		scanner := bufio.NewScanner(output)
+		for scanner.Scan() {
+			line := scanner.Text()
+			mu.Lock()
+			fmt.Fprintln(out, withSource(line, job.Source))
+			mu.Unlock()
+			message, level := logging.Message(line)
+			if message == "" {
+				continue
+			}
+			last = message
+			if level >= slog.LevelError {
+				lastError = message
+			}
+		}
+		// Drain what a line too long for the scanner left, so the run does not block on it.
+		io.Copy(io.Discard, output)
+		done <- cmp.Or(lastError, last)
+	}()
+	err := cmd.Wait()
+	writer.Close()
+	last := <-done
+	if err != nil {
+		// The exit status of the run tells the kind of its failure.
+		kind := failure.General
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			kind = failure.FromExitCode(exitErr.ExitCode())
+		}
+		if last != "" {
+			return failure.Wrap(kind, errors.New(last))
+		}
+		return failure.Wrap(kind, err)
+	}
+	return nil
+}
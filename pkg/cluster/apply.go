@@ -0,0 +1,123 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// FieldManager owns the fields of the resources applied by vmx2vmi.
+const FieldManager = "vmx2vmi"
+
+// resource is the API collection of a kind.
+type resource struct {
+	plural     string
+	namespaced bool
+}
+
+// resources lists the kinds the converter generates.
+var resources = map[string]resource{
+	"Namespace":                         {"namespaces", false},
+	"NetworkAttachmentDefinition":       {"network-attachment-definitions", true},
+	"Secret":                            {"secrets", true},
+	"ConfigMap":                         {"configmaps", true},
+	"VirtualMachineInstancetype":        {"virtualmachineinstancetypes", true},
+	"VirtualMachineClusterInstancetype": {"virtualmachineclusterinstancetypes", false},
+	"VirtualMachinePreference":          {"virtualmachinepreferences", true},
+	"VirtualMachineClusterPreference":   {"virtualmachineclusterpreferences", false},
+	"PersistentVolumeClaim":             {"persistentvolumeclaims", true},
+	"DataVolume":                        {"datavolumes", true},
+	"VirtualMachine":                    {"virtualmachines", true},
+	"VirtualMachinePool":                {"virtualmachinepools", true},
+}
+
+// ResourcePath returns the API path of the object named name of the given apiVersion and kind.
+// namespace is ignored for cluster-scoped kinds.
+func ResourcePath(apiVersion, kind, namespace, name string) (string, error) {
+	r, ok := resources[kind]
+	if !ok {
+		return "", fmt.Errorf("unsupported kind %s", kind)
+	}
+	prefix := "/apis/" + apiVersion
+	if !strings.Contains(apiVersion, "/") {
+		prefix = "/api/" + apiVersion
+	}
+	if !r.namespaced {
+		return fmt.Sprintf("%s/%s/%s", prefix, r.plural, name), nil
+	}
+	if namespace == "" {
+		return "", fmt.Errorf("%s %s has no namespace", kind, name)
+	}
+	return fmt.Sprintf("%s/namespaces/%s/%s/%s", prefix, namespace, r.plural, name), nil
+}
+
+// ApplyOptions tunes Apply.
+type ApplyOptions struct {
+	// DryRun has the API server validate and admit the object without persisting it.
+	DryRun bool
+	// Force takes over the fields owned by other field managers instead of failing on conflicts.
+	Force bool
+}
+
+// Apply creates or updates obj with a server-side apply owned by FieldManager. It returns
+// "created" or "configured", as kubectl apply reports it.
+func (c *Client) Apply(ctx context.Context, obj runtime.Object, opts ApplyOptions) (string, error) {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return "", err
+	}
+	apiVersion, kind := obj.GetObjectKind().GroupVersionKind().ToAPIVersionAndKind()
+	path, err := ResourcePath(apiVersion, kind, accessor.GetNamespace(), accessor.GetName())
+	if err != nil {
+		return "", err
+	}
+
+	result := "configured"
+	if err := c.Get(ctx, path, nil); IsNotFound(err) {
+		result = "created"
+	} else if err != nil {
+		return "", err
+	}
+
+	query := url.Values{"fieldManager": {FieldManager}}
+	if opts.DryRun {
+		query.Set("dryRun", "All")
+	}
+	if opts.Force {
+		query.Set("force", "true")
+	}
+	// JSON is valid YAML, so the object is sent as an apply patch as is.
+	if _, err := c.do(ctx, http.MethodPatch, path+"?"+query.Encode(), "application/apply-patch+yaml", obj); err != nil {
+		return "", err
+	}
+	return result, nil
+}
+
+// PreviewApply decodes into out the object a forced Apply of obj would leave in the cluster, with
+// the defaults and mutations of admission, without persisting it.
+func (c *Client) PreviewApply(ctx context.Context, obj runtime.Object, out any) error {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return err
+	}
+	apiVersion, kind := obj.GetObjectKind().GroupVersionKind().ToAPIVersionAndKind()
+	path, err := ResourcePath(apiVersion, kind, accessor.GetNamespace(), accessor.GetName())
+	if err != nil {
+		return err
+	}
+	query := url.Values{"fieldManager": {FieldManager}, "dryRun": {"All"}, "force": {"true"}}
+	data, err := c.do(ctx, http.MethodPatch, path+"?"+query.Encode(), "application/apply-patch+yaml", obj)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,262 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"vmx2vmi/pkg/failure"
+)
+
+// Client is a minimal JSON client for the Kubernetes API.
+type Client struct {
+	Config *Config
+	http   *http.Client
+}
+
+// APIError is a non-2xx response of the API server, decoded from its Status body when possible.
+type APIError struct {
+	Code    int
+	Reason  string
+	Message string
+}
+
+func (e *APIError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("%s (%d): %s", e.Reason, e.Code, e.Message)
+	}
+	return fmt.Sprintf("%s (%d)", http.StatusText(e.Code), e.Code)
+}
+
+// Kind classifies the responses of the API server as cluster failures.
+func (e *APIError) Kind() failure.Kind {
+	return failure.Cluster
+}
+
+// IsNotFound reports whether err is a 404 from the API server.
+func IsNotFound(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}
+
+// IsAlreadyExists reports whether err is a 409 AlreadyExists from the API server.
+func IsAlreadyExists(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusConflict && apiErr.Reason == "AlreadyExists"
+}
+
+// IsForbidden reports whether err is a 403 from the API server.
+func IsForbidden(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusForbidden
+}
+
+// NewClient returns a client for cfg.
+func NewClient(cfg *Config) (*Client, error) {
+	tlsConfig, err := TLSConfig(cfg.CAData, cfg.Insecure)
+	if err != nil {
+		return nil, failure.Wrap(failure.Cluster, err)
+	}
+	if len(cfg.CertData) > 0 {
+		cert, err := tls.X509KeyPair(cfg.CertData, cfg.KeyData)
+		if err != nil {
+			return nil, failure.Errorf(failure.Cluster, "invalid client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return &Client{
+		Config: cfg,
+		http: &http.Client{
+			Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment},
+			Timeout:   60 * time.Second,
+		},
+	}, nil
+}
+
+// TLSConfig returns a TLS configuration trusting caData in addition to the system roots.
+func TLSConfig(caData []byte, insecure bool) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecure}
+	if len(caData) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(caData) {
+			return nil, fmt.Errorf("no valid certificate in certificate authority data")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+// Do sends body (when not nil) as JSON to the API path and decodes the response into out
+// (when not nil).
+func (c *Client) Do(ctx context.Context, method, path string, body, out any) error {
+	data, err := c.do(ctx, method, path, "application/json", body)
+	if err != nil {
+		return err
+	}
+	if out != nil {
+		if err := json.Unmarshal(data, out); err != nil {
+			return failure.Errorf(failure.Cluster, "%s %s: failed to decode response: %w", method, path, err)
+		}
+	}
+	return nil
+}
+
+// do sends body encoded as JSON with the given content type and returns the raw response body.
+func (c *Client) do(ctx context.Context, method, path, contentType string, body any) ([]byte, error) {
+	resp, err := c.send(ctx, method, path, contentType, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, failure.Errorf(failure.Cluster, "%s %s: failed to read response: %w", method, path, err)
+	}
+	return data, nil
+}
+
+// send sends body encoded as JSON with the given content type and returns the response, whose
+// body the caller closes. Non-2xx responses are returned as an APIError.
+func (c *Client) send(ctx context.Context, method, path, contentType string, body any) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode request: %w", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.Config.Server+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.Config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Config.Token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, failure.Errorf(failure.Cluster, "%s %s: %w", method, path, err)
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, failure.Errorf(failure.Cluster, "%s %s: failed to read response: %w", method, path, err)
+	}
+	return nil, fmt.Errorf("%s %s: %w", method, path, statusError(resp.StatusCode, data))
+}
+
+// statusError returns the APIError of a response with code and a Status body.
+func statusError(code int, data []byte) *APIError {
+	apiErr := &APIError{Code: code, Reason: http.StatusText(code)}
+	var status struct {
+		Reason  string `json:"reason"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(data, &status) == nil {
+		if status.Reason != "" {
+			apiErr.Reason = status.Reason
+		}
+		apiErr.Message = status.Message
+	}
+	return apiErr
+}
+
+// Get reads the object at path into out.
+func (c *Client) Get(ctx context.Context, path string, out any) error {
+	return c.Do(ctx, http.MethodGet, path, nil, out)
+}
+
+// Create posts obj to the collection at path and decodes the created object into out.
+func (c *Client) Create(ctx context.Context, path string, obj, out any) error {
+	return c.Do(ctx, http.MethodPost, path, obj, out)
+}
+
+// GetRaw returns the unparsed body at path, e.g. pod logs.
+func (c *Client) GetRaw(ctx context.Context, path string) ([]byte, error) {
+	return c.do(ctx, http.MethodGet, path, "", nil)
+}
+
+// MergePatch applies a JSON merge patch to the object at path.
+func (c *Client) MergePatch(ctx context.Context, path string, patch any) error {
+	_, err := c.do(ctx, http.MethodPatch, path, "application/merge-patch+json", patch)
+	return err
+}
+
+// JSONPatch applies a JSON patch, a list of operations, to the object at path.
+func (c *Client) JSONPatch(ctx context.Context, path string, patch any) error {
+	_, err := c.do(ctx, http.MethodPatch, path, "application/json-patch+json", patch)
+	return err
+}
+
+// Delete deletes the object at path. A missing object is not an error.
+func (c *Client) Delete(ctx context.Context, path string) error {
+	_, err := c.do(ctx, http.MethodDelete, path, "", nil)
+	if IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// WatchEvent is a change to an object of a watched collection.
+type WatchEvent struct {
+	// Type is ADDED, MODIFIED, DELETED or BOOKMARK.
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// Watch calls fn with the changes to the collection at path after resourceVersion, until the API
+// server ends the watch after timeout, which must be shorter than the timeout of the client, ctx
+// is done or fn returns an error. A resourceVersion too old to watch from is a 410 APIError: list
+// the collection again.
+func (c *Client) Watch(ctx context.Context, path, resourceVersion string, timeout time.Duration, fn func(WatchEvent) error) error {
+	query := url.Values{
+		"watch":               {"true"},
+		"resourceVersion":     {resourceVersion},
+		"timeoutSeconds":      {strconv.Itoa(int(timeout.Seconds()))},
+		"allowWatchBookmarks": {"true"},
+	}
+	resp, err := c.send(ctx, http.MethodGet, path+"?"+query.Encode(), "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event WatchEvent
+		if err := decoder.Decode(&event); errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return failure.Errorf(failure.Cluster, "watch %s: %w", path, err)
+		}
+		if event.Type == "ERROR" {
+			var status struct {
+				Code int `json:"code"`
+			}
+			json.Unmarshal(event.Object, &status)
+			return fmt.Errorf("watch %s: %w", path, statusError(status.Code, event.Object))
+		}
+		if err := fn(event); err != nil {
+			return err
+		}
+	}
+}
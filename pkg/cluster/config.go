@@ -0,0 +1,226 @@
+package cluster
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"vmx2vmi/pkg/failure"
+
+	"sigs.k8s.io/yaml"
+)
+
+// serviceAccountDir holds the credentials mounted into pods.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// Config holds what is needed to reach a Kubernetes API server.
+type Config struct {
+	Server string
+	// Namespace is the namespace of the selected context, empty when unset.
+	Namespace string
+	Token     string
+	CAData    []byte
+	CertData  []byte
+	KeyData   []byte
+	Insecure  bool
+}
+
+// kubeconfig is the subset of the kubeconfig file format understood by LoadConfig.
+type kubeconfig struct {
+	CurrentContext string `json:"current-context"`
+	Clusters       []struct {
+		Name    string `json:"name"`
+		Cluster struct {
+			Server                   string `json:"server"`
+			CertificateAuthority     string `json:"certificate-authority"`
+			CertificateAuthorityData string `json:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `json:"insecure-skip-tls-verify"`
+		} `json:"cluster"`
+	} `json:"clusters"`
+	Users []struct {
+		Name string `json:"name"`
+		User struct {
+			Token                 string `json:"token"`
+			TokenFile             string `json:"tokenFile"`
+			ClientCertificate     string `json:"client-certificate"`
+			ClientCertificateData string `json:"client-certificate-data"`
+			ClientKey             string `json:"client-key"`
+			ClientKeyData         string `json:"client-key-data"`
+			Exec                  any    `json:"exec"`
+			AuthProvider          any    `json:"auth-provider"`
+		} `json:"user"`
+	} `json:"users"`
+	Contexts []struct {
+		Name    string `json:"name"`
+		Context struct {
+			Cluster   string `json:"cluster"`
+			User      string `json:"user"`
+			Namespace string `json:"namespace"`
+		} `json:"context"`
+	} `json:"contexts"`
+}
+
+// LoadConfig reads the kubeconfig at path, or the first file of $KUBECONFIG, or ~/.kube/config,
+// and selects contextName (the current context when empty). Without any kubeconfig, the
+// service account of the pod is used when running in a cluster.
+func LoadConfig(path, contextName string) (*Config, error) {
+	cfg, err := loadConfig(path, contextName)
+	return cfg, failure.Wrap(failure.Cluster, err)
+}
+
+func loadConfig(path, contextName string) (*Config, error) {
+	if path == "" {
+		path = defaultKubeconfigPath()
+	}
+	if path == "" {
+		if os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+			return inClusterConfig()
+		}
+		return nil, fmt.Errorf("no kubeconfig found, set -kubeconfig or $KUBECONFIG")
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read kubeconfig %s: %w", path, err)
+	}
+	var kc kubeconfig
+	if err := yaml.Unmarshal(content, &kc); err != nil {
+		return nil, fmt.Errorf("failed to parse kubeconfig %s: %w", path, err)
+	}
+	cfg, err := kc.resolve(contextName, filepath.Dir(path))
+	if err != nil {
+		return nil, fmt.Errorf("kubeconfig %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+func defaultKubeconfigPath() string {
+	if env := os.Getenv("KUBECONFIG"); env != "" {
+		for _, p := range filepath.SplitList(env) {
+			if _, err := os.Stat(p); err == nil {
+				return p
+			}
+		}
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		p := filepath.Join(home, ".kube", "config")
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+	}
+	return ""
+}
+
+func (kc *kubeconfig) resolve(contextName, dir string) (*Config, error) {
+	if contextName == "" {
+		contextName = kc.CurrentContext
+	}
+	if contextName == "" {
+		return nil, fmt.Errorf("no current-context set")
+	}
+
+	cfg := &Config{}
+	var clusterName, userName string
+	found := false
+	for _, c := range kc.Contexts {
+		if c.Name == contextName {
+			clusterName, userName, cfg.Namespace = c.Context.Cluster, c.Context.User, c.Context.Namespace
+			found = true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("context %q not found", contextName)
+	}
+
+	found = false
+	for _, c := range kc.Clusters {
+		if c.Name != clusterName {
+			continue
+		}
+		found = true
+		cfg.Server = strings.TrimSuffix(c.Cluster.Server, "/")
+		cfg.Insecure = c.Cluster.InsecureSkipTLSVerify
+		var err error
+		if cfg.CAData, err = fileOrData(dir, c.Cluster.CertificateAuthority, c.Cluster.CertificateAuthorityData); err != nil {
+			return nil, fmt.Errorf("cluster %q certificate authority: %w", clusterName, err)
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("cluster %q not found", clusterName)
+	}
+
+	for _, u := range kc.Users {
+		if u.Name != userName {
+			continue
+		}
+		if u.User.Exec != nil || u.User.AuthProvider != nil {
+			return nil, fmt.Errorf("user %q authenticates through an exec or auth-provider plugin, which is not supported; use a token or client certificate", userName)
+		}
+		cfg.Token = u.User.Token
+		if u.User.TokenFile != "" {
+			token, err := os.ReadFile(absPath(dir, u.User.TokenFile))
+			if err != nil {
+				return nil, fmt.Errorf("user %q token file: %w", userName, err)
+			}
+			cfg.Token = strings.TrimSpace(string(token))
+		}
+		var err error
+		if cfg.CertData, err = fileOrData(dir, u.User.ClientCertificate, u.User.ClientCertificateData); err != nil {
+			return nil, fmt.Errorf("user %q client certificate: %w", userName, err)
+		}
+		if cfg.KeyData, err = fileOrData(dir, u.User.ClientKey, u.User.ClientKeyData); err != nil {
+			return nil, fmt.Errorf("user %q client key: %w", userName, err)
+		}
+	}
+	return cfg, nil
+}
+
+// fileOrData returns the base64 decoded data, or the content of file (relative to dir).
+func fileOrData(dir, file, data string) ([]byte, error) {
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	if file != "" {
+		return os.ReadFile(absPath(dir, file))
+	}
+	return nil, nil
+}
+
+func absPath(dir, p string) string {
+	if filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(dir, p)
+}
+
+// inClusterConfig builds a Config from the pod's service account.
+func inClusterConfig() (*Config, error) {
+	token, err := os.ReadFile(filepath.Join(serviceAccountDir, "token"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service account token: %w", err)
+	}
+	ca, err := os.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service account CA: %w", err)
+	}
+	namespace, _ := os.ReadFile(filepath.Join(serviceAccountDir, "namespace"))
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if port == "" {
+		port = "443"
+	}
+	return &Config{
+		Server:    "https://" + joinHostPort(host, port),
+		Namespace: strings.TrimSpace(string(namespace)),
+		Token:     strings.TrimSpace(string(token)),
+		CAData:    ca,
+	}, nil
+}
+
+func joinHostPort(host, port string) string {
+	if strings.Contains(host, ":") {
+		return "[" + host + "]:" + port
+	}
+	return host + ":" + port
+}
@@ -0,0 +1,288 @@
+// Package compat checks a VM, from its VMX or from vCenter, for what stops or changes its
+// migration to KubeVirt, before anything is copied: unsupported devices, snapshot chains, raw
+// device mappings, passthrough hardware, encryption or Fault Tolerance. Each finding carries a
+// severity and what to do about it.
+package compat
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"vmx2vmi/pkg/report"
+	"vmx2vmi/pkg/vmdk"
+	"vmx2vmi/pkg/vmx"
+	"vmx2vmi/pkg/vsphere"
+)
+
+// Severity tells how a finding affects the migration.
+type Severity string
+
+const (
+	// Error stops the conversion, or the VM from booting, until it is remediated.
+	Error Severity = "ERROR"
+	// Warning migrates the VM with a feature lost, or with an extra option or step.
+	Warning Severity = "WARNING"
+	// Info needs no action, but is worth knowing before the migration.
+	Info Severity = "INFO"
+)
+
+// Finding is the outcome of a rule for one setting or device of the VM.
+type Finding struct {
+	Rule     string   `json:"rule"`
+	Severity Severity `json:"severity"`
+	// Device is the disk, device or VMX keys the finding is about, empty for the VM as a whole.
+	Device      string `json:"device,omitempty"`
+	Detail      string `json:"detail"`
+	Remediation string `json:"remediation,omitempty"`
+}
+
+// Report is the compatibility report of one VM.
+type Report struct {
+	VM string `json:"vm"`
+	// Source is the VMX file, or the datastore path of the VMX of a vCenter VM.
+	Source   string    `json:"source"`
+	Findings []Finding `json:"findings"`
+}
+
+// Options describes the migration the VM is checked for, from the conversion options.
+type Options struct {
+	// DiskSource is the -disk-source of the conversion: pvc, vddk, http or upload.
+	DiskSource string
+}
+
+// Check runs the rules on vmxConfig and, for a VM read from vCenter, on its configuration vm,
+// nil for a VMX file. The findings are sorted by severity, errors first.
+func Check(vmxConfig *vmx.VMXConfig, vm *vsphere.VMConfig, opts Options) []Finding {
+	findings := []Finding{}
+	add := func(rule string, severity Severity, device, remediation, format string, args ...any) {
+		findings = append(findings, Finding{
+			Rule:        rule,
+			Severity:    severity,
+			Device:      device,
+			Detail:      fmt.Sprintf(format, args...),
+			Remediation: remediation,
+		})
+	}
+
+	if vmxConfig.Encrypted {
+		if opts.DiskSource == "vddk" {
+			add("encryption", Warning, "", "Grant the vSphere user of -vddk-secret the Cryptographic operations privileges.",
+				"the VM uses VM encryption; VDDK decrypts its disks through vCenter")
+		} else {
+			add("encryption", Error, "", "Decrypt the VM in vSphere (or remove its encryption in Workstation or Fusion), or read its disks through VDDK with -disk-source vddk.",
+				"the VM uses VM encryption; its disks cannot be read without the key server")
+		}
+	}
+	if vm != nil && vm.FtInfo != nil {
+		add("fault-tolerance", Error, "", "Turn Fault Tolerance off in vSphere before the migration, and rely on KubeVirt live migration and node failure handling instead.",
+			"the VM is protected by Fault Tolerance, which has no equivalent in KubeVirt and prevents the snapshots the disk copies take")
+	}
+
+	for _, d := range vmxConfig.Disks {
+		checkDisk(d, add)
+	}
+	if vm != nil {
+		for _, d := range vm.Hardware.Device {
+			if d.Type != "VirtualDisk" || d.Backing == nil || d.Backing.Parent == nil {
+				continue
+			}
+			depth := 0
+			for p := d.Backing.Parent; p != nil; p = p.Parent {
+				depth++
+			}
+			add("snapshot-chain", Warning, d.Backing.FileName, "Delete or consolidate the snapshots of the VM in vSphere before the migration, or read the disks through VDDK, which reads the whole chain.",
+				"the disk is a snapshot delta over %d parent disks; copying its files alone loses the data of its parents", depth)
+		}
+	}
+
+	checkDevices(vmxConfig, add)
+
+	switch vmxConfig.GuestOSFamily() {
+	case "windows":
+		add("guest-drivers", Info, "", "Its disks are attached on SATA; for virtio disks, convert the guest with -v2v or inject the drivers with -inject-virtio-drivers, then convert the VM with -disk-bus virtio.",
+			"Windows has no inbox virtio drivers and fails to boot from a virtio disk (INACCESSIBLE_BOOT_DEVICE)")
+	case "other":
+		add("guest-os", Warning, "", "Check that the guest has virtio drivers, or convert it with -v2v.",
+			"guest OS %q is neither Windows nor Linux, which KubeVirt does not test", vmxConfig.GuestOS)
+	}
+	if vmxConfig.ToolsDetected {
+		add("vmware-tools", Info, "tools.*", "Uninstall VMware Tools after the migration (-v2v removes them) and install qemu-guest-agent.",
+			"VMware Tools are installed in the guest; they do nothing on KubeVirt")
+	}
+	if vmxConfig.NestedVirtualization {
+		add("nested-virtualization", Warning, "vhv.enable", "Enable nested virtualization (kvm_intel nested=1 or kvm_amd nested=1) on the nodes the VM runs on.",
+			"the guest runs its own hypervisor")
+	}
+
+	for _, f := range report.AuditLostFeatures(vmxConfig) {
+		add("lost-feature", Warning, f.Setting, "", "%s: %s", f.Feature, f.Detail)
+	}
+
+	sort.SliceStable(findings, func(i, j int) bool {
+		return severityRank(findings[i].Severity) < severityRank(findings[j].Severity)
+	})
+	return findings
+}
+
+// checkDisk runs the rules of a disk.
+func checkDisk(d vmx.Disk, add func(rule string, severity Severity, device, remediation, format string, args ...any)) {
+	id := d.ID()
+	switch d.RawDeviceMapping {
+	case "physical":
+		add("raw-device-mapping", Error, id, fmt.Sprintf("Present the LUN to the cluster and map it with -rdm-map %s=pvc:<claim> or %s=hostdisk:<path>; it is attached as a lun disk.", id, id),
+			"the disk is a physical-compatibility raw device mapping of a SAN LUN (%s); the conversion stops until it is mapped", d.FileName)
+	case "virtual":
+		add("raw-device-mapping", Error, id, fmt.Sprintf("Present the LUN to the cluster and map it with -rdm-map %s=pvc:<claim>, or migrate it to a VMDK with Storage vMotion first.", id),
+			"the disk is a virtual-compatibility raw device mapping of a SAN LUN (%s); the conversion stops until it is mapped", d.FileName)
+	}
+	if d.Shared() {
+		add("shared-disk", Warning, id, fmt.Sprintf("Import it into a ReadWriteMany PVC with volumeMode Block and pass -shared-disk-map %s=<claim>.", id),
+			"the disk is shared with other VMs (sharing=%q, sharedBus=%q), e.g. by a WSFC or Oracle RAC cluster", d.Sharing, d.SharedBus)
+	}
+	if strings.EqualFold(d.Mode, "independent-nonpersistent") {
+		add("disk-mode", Warning, id, "Keep it only if the guest does not depend on losing its changes, e.g. for a kiosk; otherwise nothing is needed.",
+			"the disk is independent-nonpersistent: vSphere discards its changes at power off, KubeVirt keeps them")
+	}
+	if d.Descriptor == nil || !d.Descriptor.HasParent() || d.Path == "" {
+		return
+	}
+	chain, err := vmdk.OpenChain(d.Path)
+	var chainErr *vmdk.ChainError
+	switch {
+	case errors.As(err, &chainErr):
+		add("snapshot-chain", Error, id, "Restore the missing or modified parent disk, or point the parentFileNameHint of the child to the disk whose CID matches.",
+			"%v", chainErr)
+	case err != nil:
+		add("snapshot-chain", Error, id, "", "the snapshot chain of the disk cannot be read: %v", err)
+	default:
+		defer chain.Close()
+		add("snapshot-chain", Info, id, "Delete or consolidate the snapshots of the VM before the migration to copy a single disk.",
+			"the disk is a snapshot delta over %d parent disks; the conversion reads the whole chain", len(chain.Layers)-1)
+	}
+}
+
+// checkDevices runs the rules of the devices other than disks, from the VMX keys of vmxConfig.
+func checkDevices(vmxConfig *vmx.VMXConfig, add func(rule string, severity Severity, device, remediation, format string, args ...any)) {
+	present := func(prefix string) []string {
+		var ids []string
+		for key := range vmxConfig.Raw {
+			id := key[:max(len(key)-len(".present"), 0)]
+			if !strings.EqualFold(key[len(id):], ".present") || !strings.HasPrefix(strings.ToLower(id), strings.ToLower(prefix)) {
+				continue
+			}
+			if enabled, _ := vmxConfig.GetBool(key); enabled {
+				ids = append(ids, id)
+			}
+		}
+		sort.Strings(ids)
+		return ids
+	}
+
+	for _, id := range present("pciPassthru") {
+		if profile, ok := vmxConfig.Get(id + ".vgpu"); ok && profile != "" {
+			add("passthrough", Warning, id, "Pass a vGPU of the cluster through with -gpu <deviceName>, as permitted in the KubeVirt CR, and install its guest driver.",
+				"the VM has an NVIDIA vGPU of profile %s", profile)
+			continue
+		}
+		add("passthrough", Warning, id, "Pass the device of a node through with -host-device <deviceName>, as permitted in the KubeVirt CR.",
+			"a PCI device of the ESXi host is passed through to the VM (DirectPath I/O)")
+	}
+	var usb []string
+	for key := range vmxConfig.Raw {
+		if strings.HasPrefix(strings.ToLower(key), "usb.autoconnect.device") {
+			usb = append(usb, key)
+		}
+	}
+	sort.Strings(usb)
+	for _, key := range usb {
+		value, _ := vmxConfig.Get(key)
+		add("usb-passthrough", Warning, key, "Pass the device of a node through with -host-device, or reach it over the network, e.g. with USB over IP.",
+			"a USB device of the host is connected to the VM (%s)", value)
+	}
+	for _, id := range present("serial") {
+		fileType, _ := vmxConfig.Get(id + ".fileType")
+		if fileType == "" || strings.EqualFold(fileType, "thinprint") {
+			continue
+		}
+		add("serial-port", Warning, id, "Use the serial console of KubeVirt (virtctl console) instead; a licensing dongle or device behind it needs another solution.",
+			"the VM has a serial port connected to a %s, which is not kept", fileType)
+	}
+	for _, id := range present("parallel") {
+		add("parallel-port", Warning, id, "Remove the port, or replace the device behind it, e.g. with a network printer.",
+			"KubeVirt has no parallel ports")
+	}
+	for _, id := range present("floppy") {
+		add("floppy", Info, id, "Remove the drive in vSphere, or copy what it holds to a disk or a cloud-init volume.",
+			"KubeVirt has no floppy drives; the drive is dropped")
+	}
+	if enabled, _ := vmxConfig.GetBool("vtpm.present"); enabled {
+		add("vtpm", Warning, "vtpm.present", "Suspend BitLocker, or export the keys sealed in the vTPM, before the migration; add a persistent TPM (spec.domain.devices.tpm) to the KubeVirt VM if the guest needs one.",
+			"the VM has a virtual TPM, whose keys are not migrated")
+	}
+}
+
+// severityRank orders severities, errors first.
+func severityRank(s Severity) int {
+	switch s {
+	case Error:
+		return 0
+	case Warning:
+		return 1
+	}
+	return 2
+}
+
+// Failed reports whether a report has an error.
+func Failed(reports []Report) bool {
+	for _, r := range reports {
+		for _, f := range r.Findings {
+			if f.Severity == Error {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// WriteText writes reports in a human readable form, each finding with its remediation.
+func WriteText(w io.Writer, reports []Report) error {
+	var b strings.Builder
+	for i, r := range reports {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		counts := make(map[Severity]int)
+		for _, f := range r.Findings {
+			counts[f.Severity]++
+		}
+		fmt.Fprintf(&b, "Compatibility report for VM %s\n", r.VM)
+		fmt.Fprintf(&b, "Source: %s\n", r.Source)
+		fmt.Fprintf(&b, "Result: %s, %s, %s\n\n", plural(counts[Error], "error"), plural(counts[Warning], "warning"), plural(counts[Info], "note"))
+		if len(r.Findings) == 0 {
+			b.WriteString("  No findings, the VM converts as it is.\n")
+		}
+		for _, f := range r.Findings {
+			device := ""
+			if f.Device != "" {
+				device = " [" + f.Device + "]"
+			}
+			fmt.Fprintf(&b, "  %-7s %s%s: %s\n", f.Severity, f.Rule, device, f.Detail)
+			if f.Remediation != "" {
+				fmt.Fprintf(&b, "          Remediation: %s\n", f.Remediation)
+			}
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// plural returns n and noun, in the plural unless n is 1.
+func plural(n int, noun string) string {
+	if n == 1 {
+		return "1 " + noun
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
@@ -0,0 +1,85 @@
+// Package config reads defaults of the command-line options from a configuration file and from
+// environment variables, so that runs sharing a namespace, mappings, a storage class or a vCenter
+// do not repeat them on every command line.
+package config
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"vmx2vmi/pkg/failure"
+
+	"sigs.k8s.io/yaml"
+)
+
+// FileEnv names the configuration file when -config does not.
+const FileEnv = "VMX2VMI_CONFIG"
+
+// envPrefix prefixes the environment variables of the options.
+const envPrefix = "VMX2VMI_"
+
+// Reserved are the options a configuration file or environment variable cannot set: those
+// selecting the VMs or the configuration itself.
+var Reserved = []string{"config", "vmx", "vm", "name"}
+
+// DefaultPath returns ~/.vmx2vmi.yaml, or "" when the home directory is unknown.
+func DefaultPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".vmx2vmi.yaml")
+}
+
+// EnvName returns the environment variable setting the option name, e.g. VMX2VMI_STORAGE_CLASS
+// for storage-class.
+func EnvName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// Load reads the configuration file at path: a YAML or JSON map of option names, without the
+// dash, to a string, number or boolean, or a list of them for repeatable options. It returns the
+// values of each option as the command line would give them.
+func Load(path string) (map[string][]string, error) {
+	values, err := load(path)
+	return values, failure.Wrap(failure.Parse, err)
+}
+
+func load(path string) (map[string][]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read configuration: %w", err)
+	}
+	var options map[string]any
+	if err := yaml.Unmarshal(data, &options); err != nil {
+		return nil, fmt.Errorf("failed to parse configuration %s: %w", path, err)
+	}
+	values := make(map[string][]string, len(options))
+	for _, name := range slices.Sorted(maps.Keys(options)) {
+		if slices.Contains(Reserved, name) {
+			return nil, failure.Errorf(failure.Usage, "configuration %s: option %s cannot be set in a configuration file", path, name)
+		}
+		list, ok := options[name].([]any)
+		if !ok {
+			list = []any{options[name]}
+		}
+		for _, v := range list {
+			switch v := v.(type) {
+			case string:
+				values[name] = append(values[name], v)
+			case float64:
+				values[name] = append(values[name], strconv.FormatFloat(v, 'f', -1, 64))
+			case bool:
+				values[name] = append(values[name], strconv.FormatBool(v))
+			default:
+				return nil, fmt.Errorf("configuration %s: option %s must be a string, number, boolean or a list of them", path, name)
+			}
+		}
+	}
+	return values, nil
+}
@@ -0,0 +1,197 @@
+// Package conflict finds the resources of a cluster a conversion would collide with: resources
+// of the same name that vmx2vmi did not apply, and VMs using the fixed MAC addresses of the VM.
+package conflict
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"vmx2vmi/pkg/cluster"
+	"vmx2vmi/pkg/kubevirt"
+	"vmx2vmi/pkg/manifest"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+// Mode is what -on-conflict does with conflicts.
+type Mode string
+
+const (
+	// Fail stops the conversion.
+	Fail Mode = "fail"
+	// Skip leaves the VM out: nothing is written or applied.
+	Skip Mode = "skip"
+	// Overwrite applies the resources, taking over the fields other managers set.
+	Overwrite Mode = "overwrite"
+	// Merge applies the resources next to the fields other managers set, failing when both set one.
+	Merge Mode = "merge"
+)
+
+// ParseMode parses an -on-conflict value.
+func ParseMode(s string) (Mode, error) {
+	switch m := Mode(s); m {
+	case Fail, Skip, Overwrite, Merge:
+		return m, nil
+	}
+	return "", fmt.Errorf("invalid mode '%s': must be fail, skip, overwrite or merge", s)
+}
+
+// Conflict is a resource of the cluster in the way of the conversion.
+type Conflict struct {
+	Kind      string
+	Namespace string
+	Name      string
+	Reason    string
+}
+
+func (c Conflict) String() string {
+	return fmt.Sprintf("%s %s/%s %s", c.Kind, c.Namespace, c.Name, c.Reason)
+}
+
+// Check returns the conflicts of objects with the cluster: the VMs, pools, PVCs and DataVolumes,
+// including those of the DataVolume templates of a VM, that exist and were not applied by vmx2vmi
+// from the same source VM, and the VMs and VMIs of any namespace using a fixed MAC address of the
+// VM. The MAC addresses are not checked when listing VMs across namespaces is forbidden; warn
+// reports it.
+func Check(ctx context.Context, client *cluster.Client, objects []manifest.Object, warn func(format string, args ...any)) ([]Conflict, error) {
+	var conflicts []Conflict
+	check := func(apiVersion, kind, namespace, name string, ours func(*metav1.PartialObjectMetadata) string) error {
+		path, err := cluster.ResourcePath(apiVersion, kind, namespace, name)
+		if err != nil {
+			return err
+		}
+		var existing metav1.PartialObjectMetadata
+		if err := client.Get(ctx, path, &existing); err != nil {
+			if cluster.IsNotFound(err) {
+				return nil
+			}
+			return fmt.Errorf("failed to read %s %s/%s: %w", kind, namespace, name, err)
+		}
+		if reason := ours(&existing); reason != "" {
+			conflicts = append(conflicts, Conflict{Kind: kind, Namespace: namespace, Name: name, Reason: reason})
+		}
+		return nil
+	}
+
+	var vm *kubevirtv1.VirtualMachine
+	for _, obj := range objects {
+		apiVersion, kind := obj.GetObjectKind().GroupVersionKind().ToAPIVersionAndKind()
+		switch kind {
+		case "VirtualMachine", "VirtualMachinePool", "PersistentVolumeClaim", "DataVolume":
+		default:
+			continue
+		}
+		var templates []kubevirtv1.DataVolumeTemplateSpec
+		if o, ok := obj.(*kubevirtv1.VirtualMachine); ok {
+			vm = o
+			templates = o.Spec.DataVolumeTemplates
+		}
+		if err := check(apiVersion, kind, obj.GetNamespace(), obj.GetName(), func(existing *metav1.PartialObjectMetadata) string {
+			return notOurs(existing, obj)
+		}); err != nil {
+			return nil, err
+		}
+		// KubeVirt creates the DataVolumes of the templates, owned by the VM.
+		for _, template := range templates {
+			if err := check("cdi.kubevirt.io/v1beta1", "DataVolume", obj.GetNamespace(), template.Name, func(existing *metav1.PartialObjectMetadata) string {
+				for _, owner := range existing.OwnerReferences {
+					if owner.Kind == kind && owner.Name == obj.GetName() {
+						return ""
+					}
+				}
+				return fmt.Sprintf("exists and is not owned by %s %s", kind, obj.GetName())
+			}); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if vm == nil {
+		return conflicts, nil
+	}
+	macs := make(map[string]string)
+	for _, iface := range vm.Spec.Template.Spec.Domain.Devices.Interfaces {
+		if iface.MacAddress != "" {
+			macs[strings.ToLower(iface.MacAddress)] = iface.Name
+		}
+	}
+	if len(macs) == 0 {
+		return conflicts, nil
+	}
+	macConflicts, err := checkMACs(ctx, client, vm, macs)
+	if cluster.IsForbidden(err) {
+		warn("cannot list VMs across namespaces to check for MAC address collisions: %v", err)
+		return conflicts, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append(conflicts, macConflicts...), nil
+}
+
+// notOurs returns why existing, of the same kind and name as obj, is not a previous apply of
+// obj, or "" when it is.
+func notOurs(existing *metav1.PartialObjectMetadata, obj manifest.Object) string {
+	applied := false
+	for _, entry := range existing.ManagedFields {
+		if entry.Manager == cluster.FieldManager && entry.Operation == metav1.ManagedFieldsOperationApply {
+			applied = true
+		}
+	}
+	if !applied {
+		return "exists and was not applied by vmx2vmi"
+	}
+	for _, key := range []string{kubevirt.SourceUUIDAnnotation, kubevirt.SourceVCUUIDAnnotation} {
+		want, have := obj.GetAnnotations()[key], existing.Annotations[key]
+		if want != "" && have != "" && want != have {
+			return fmt.Sprintf("was converted from another VMware VM (%s %s)", key, have)
+		}
+	}
+	return ""
+}
+
+// checkMACs returns the VMs and VMIs other than vm using one of macs, the fixed MAC addresses of
+// vm, lower-cased, by interface name.
+func checkMACs(ctx context.Context, client *cluster.Client, vm *kubevirtv1.VirtualMachine, macs map[string]string) ([]Conflict, error) {
+	var conflicts []Conflict
+	seen := make(map[string]bool)
+	add := func(kind, namespace, name, mac string) {
+		iface, ok := macs[strings.ToLower(mac)]
+		key := namespace + "/" + name + "/" + strings.ToLower(mac)
+		if !ok || seen[key] || (namespace == vm.Namespace && name == vm.Name) {
+			return
+		}
+		seen[key] = true
+		conflicts = append(conflicts, Conflict{Kind: kind, Namespace: namespace, Name: name,
+			Reason: fmt.Sprintf("uses MAC address %s, set on interface %s", mac, iface)})
+	}
+
+	var vmis kubevirtv1.VirtualMachineInstanceList
+	if err := client.Get(ctx, "/apis/kubevirt.io/v1/virtualmachineinstances", &vmis); err != nil {
+		return nil, fmt.Errorf("failed to list VMIs: %w", err)
+	}
+	for _, vmi := range vmis.Items {
+		for _, iface := range vmi.Status.Interfaces {
+			add("VirtualMachineInstance", vmi.Namespace, vmi.Name, iface.MAC)
+		}
+		for _, iface := range vmi.Spec.Domain.Devices.Interfaces {
+			add("VirtualMachineInstance", vmi.Namespace, vmi.Name, iface.MacAddress)
+		}
+	}
+	// A stopped VM takes its MAC addresses back when it starts.
+	var vms kubevirtv1.VirtualMachineList
+	if err := client.Get(ctx, "/apis/kubevirt.io/v1/virtualmachines", &vms); err != nil {
+		return nil, fmt.Errorf("failed to list VMs: %w", err)
+	}
+	for _, other := range vms.Items {
+		if other.Spec.Template == nil {
+			continue
+		}
+		for _, iface := range other.Spec.Template.Spec.Domain.Devices.Interfaces {
+			add("VirtualMachine", other.Namespace, other.Name, iface.MacAddress)
+		}
+	}
+	return conflicts, nil
+}
@@ -0,0 +1,500 @@
+// Package controller reconciles VMwareMigration resources, so that warm migrations are declared
+// in the cluster, e.g. from GitOps, instead of run by hand. Each migration applies the manifest
+// of its VM, stopped, then copies its disks with a precopy at every interval, and cuts over once
+// its spec asks for it; the steps run as runs of vmx2vmi, like the VMs of a plan, and their
+// progress is kept in the status of the resource.
+package controller
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"vmx2vmi/pkg/cluster"
+	"vmx2vmi/pkg/failure"
+	"vmx2vmi/pkg/logging"
+	"vmx2vmi/pkg/plan"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// Steps of a migration, each a run of vmx2vmi.
+const (
+	// stepPrepare applies the manifest of the VM with the Halted run strategy.
+	stepPrepare = "prepare"
+	stepPrecopy = "precopy"
+	stepCutover = "cutover"
+)
+
+const (
+	// defaultPrecopyInterval is the time between two precopies when the spec does not set it.
+	defaultPrecopyInterval = time.Hour
+	// retryDelay is the time a failed step waits before it runs again, unless the spec changes.
+	retryDelay = 5 * time.Minute
+	// watchTimeout ends each watch, below the timeout of the cluster client; the migrations are
+	// then listed again, which starts the precopies that came due.
+	watchTimeout = 30 * time.Second
+)
+
+// managedOptions are set by the fields of a migration or by the controller, and cannot be given
+// in its options.
+var managedOptions = []string{
+	"vm", "vmx", "name", "namespace", "pvc", "network-map", "storage-map",
+	"vcenter-url", "vcenter-user", "vcenter-insecure", "vcenter-thumbprint",
+	"apply", "run-strategy", "warm-state", "warm-disk-output",
+}
+
+// copyOptions tune the copies of the disks by the precopies and the cutover.
+var copyOptions = []string{"bwlimit", "read-workers", "snapshot-quiesce", "vddk-transports"}
+
+// stepOptions are the options a migration may give each of its steps: the prepare step takes those
+// shaping the manifest of the VM, the precopies those tuning the copies, and the cutover those
+// tuning the copies and the cutover from values. Options naming files on the host of the
+// controller, where the steps run, are not among them.
+var stepOptions = map[string][]string{
+	stepPrepare: slices.Concat(plan.ManifestOptions, []string{"on-conflict"}),
+	stepPrecopy: copyOptions,
+	stepCutover: slices.Concat(copyOptions, []string{
+		"cutover-disconnect-nics", "cutover-shutdown", "cutover-start", "inject-virtio-drivers", "linux-boot-check",
+		"shutdown-timeout", "v2v", "v2v-image",
+	}),
+}
+
+// Options configures a Controller.
+type Options struct {
+	// Dir keeps the files of the migrations, in <namespace>/<name>: the manifests, the state of
+	// the warm migration and the output of the last run of each step.
+	Dir string
+	// Command is the vmx2vmi binary running the steps.
+	Command string
+	// Args are given to the runs using the cluster, the prepare step and the cutover, e.g.
+	// -kubeconfig.
+	Args []string
+	// Parallel is the number of steps run at a time.
+	Parallel int
+	// Namespace is the namespace of the migrations reconciled, all namespaces when empty.
+	Namespace string
+}
+
+// Controller reconciles the VMwareMigrations of a cluster.
+type Controller struct {
+	client *cluster.Client
+	opts   Options
+	slots  chan struct{}
+	wg     sync.WaitGroup
+
+	mu sync.Mutex
+	// running cancels the step of each migration, by <namespace>/<name>, while it runs.
+	running map[string]context.CancelFunc
+}
+
+// New returns a controller of the migrations of the cluster of client.
+func New(client *cluster.Client, opts Options) *Controller {
+	return &Controller{client: client, opts: opts, slots: make(chan struct{}, max(opts.Parallel, 1)), running: make(map[string]context.CancelFunc)}
+}
+
+// collection returns the API path of the migrations reconciled.
+func (c *Controller) collection() string {
+	if c.opts.Namespace == "" {
+		return fmt.Sprintf("/apis/%s/%s/%s", Group, Version, Resource)
+	}
+	return fmt.Sprintf("/apis/%s/%s/namespaces/%s/%s", Group, Version, c.opts.Namespace, Resource)
+}
+
+// path returns the API path of the migration name in namespace.
+func path(namespace, name string) string {
+	return fmt.Sprintf("/apis/%s/%s/namespaces/%s/%s/%s", Group, Version, namespace, Resource, name)
+}
+
+// Run reconciles the migrations until ctx is done, then waits for the steps it started, which
+// record their interruption. The error is about the first listing of the migrations, e.g. when
+// the CustomResourceDefinition is not installed; later errors are logged and retried.
+func (c *Controller) Run(ctx context.Context) error {
+	defer c.wg.Wait()
+	listed := false
+	for ctx.Err() == nil {
+		var list MigrationList
+		if err := c.client.Get(ctx, c.collection(), &list); err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			if !listed {
+				return fmt.Errorf("failed to list the VMwareMigrations: %w", err)
+			}
+			logging.Warnf("Failed to list the VMwareMigrations: %v", err)
+			sleep(ctx, watchTimeout)
+			continue
+		}
+		listed = true
+		for i := range list.Items {
+			c.reconcile(ctx, &list.Items[i])
+		}
+		err := c.client.Watch(ctx, c.collection(), list.ResourceVersion, watchTimeout, func(event cluster.WatchEvent) error {
+			if event.Type == "BOOKMARK" {
+				return nil
+			}
+			var m Migration
+			if err := json.Unmarshal(event.Object, &m); err != nil {
+				return fmt.Errorf("failed to decode VMwareMigration: %w", err)
+			}
+			if event.Type == "DELETED" {
+				c.cancel(&m)
+				return nil
+			}
+			c.reconcile(ctx, &m)
+			return nil
+		})
+		if err != nil && ctx.Err() == nil {
+			logging.Debugf("Watch of the VMwareMigrations ended: %v", err)
+		}
+	}
+	return nil
+}
+
+// sleep waits for d, or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
+
+// reconcile starts the next step of m in the background, unless one runs or none is due.
+func (c *Controller) reconcile(ctx context.Context, m *Migration) {
+	if next(m, time.Now()) == "" {
+		return
+	}
+	key := m.Namespace + "/" + m.Name
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.running[key]; ok {
+		return
+	}
+	stepCtx, cancel := context.WithCancel(ctx)
+	c.running[key] = cancel
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		defer func() {
+			c.mu.Lock()
+			delete(c.running, key)
+			c.mu.Unlock()
+			cancel()
+		}()
+		select {
+		case c.slots <- struct{}{}:
+		case <-stepCtx.Done():
+			return
+		}
+		defer func() { <-c.slots }()
+		c.step(stepCtx, m.Namespace, m.Name)
+	}()
+}
+
+// cancel stops the step of the deleted migration m. Its files are left in the directory of the
+// controller.
+func (c *Controller) cancel(m *Migration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cancel, ok := c.running[m.Namespace+"/"+m.Name]; ok {
+		logging.Infof("Stopping migration %s/%s, deleted\n", m.Namespace, m.Name)
+		cancel()
+	}
+}
+
+// next returns the step of m due at now, or "" when none is.
+func next(m *Migration, now time.Time) string {
+	s := m.Status
+	changed := s.ObservedGeneration != m.Generation
+	switch {
+	case s.Phase == PhaseCompleted, s.Phase == PhaseFailed && !changed:
+		return ""
+	case s.RetryAfter != nil && !changed && now.Before(s.RetryAfter.Time):
+		return ""
+	case s.Precopies == 0 && s.Phase != PhasePrecopy && s.Phase != PhaseCutover:
+		return stepPrepare
+	case s.Precopies > 0 && (s.Phase == PhaseCutover || m.Spec.Cutover || m.Spec.CutoverTime != nil && !now.Before(m.Spec.CutoverTime.Time)):
+		return stepCutover
+	case s.LastPrecopy == nil || !now.Before(s.LastPrecopy.Add(m.precopyInterval())):
+		return stepPrecopy
+	}
+	return ""
+}
+
+func (m *Migration) precopyInterval() time.Duration {
+	if m.Spec.PrecopyInterval == nil {
+		return defaultPrecopyInterval
+	}
+	return m.Spec.PrecopyInterval.Duration
+}
+
+// validate checks the spec of m.
+func (m *Migration) validate() error {
+	switch {
+	case m.Spec.VM == "":
+		return failure.Errorf(failure.Usage, "spec.vm is not set")
+	case m.Spec.VCenter.URL == "" || m.Spec.VCenter.Secret == "":
+		return failure.Errorf(failure.Usage, "spec.vcenter needs a url and a secret")
+	case m.Spec.PVC == "":
+		return failure.Errorf(failure.Usage, "spec.pvc is not set, e.g. '{name}-boot'")
+	case m.Spec.PrecopyInterval != nil && m.Spec.PrecopyInterval.Duration <= 0:
+		return failure.Errorf(failure.Usage, "spec.precopyInterval must be positive")
+	}
+	for _, name := range slices.Sorted(maps.Keys(m.Spec.Options)) {
+		if slices.Contains(managedOptions, name) {
+			return failure.Errorf(failure.Usage, "option %s is set by the fields of the migration", name)
+		}
+		known := false
+		for _, options := range stepOptions {
+			known = known || slices.Contains(options, name)
+		}
+		if !known {
+			return failure.Errorf(failure.Usage, "option %s is unknown or cannot be used in a migration", name)
+		}
+	}
+	// The disks are copied into the directory of the migration, never elsewhere on the host.
+	for _, disk := range slices.Sorted(maps.Keys(m.Spec.DiskOutputs)) {
+		if output := m.Spec.DiskOutputs[disk]; !filepath.IsLocal(output) {
+			return failure.Errorf(failure.Usage, "spec.diskOutputs: %s of disk %s is not a relative path in the directory of the migration", output, disk)
+		}
+	}
+	if err := m.Spec.Options.Validate(); err != nil {
+		return failure.Wrap(failure.Usage, err)
+	}
+	return nil
+}
+
+// step runs the step due of the migration name in namespace and records it in its status. The
+// migration is read again, as the one listed may predate the end of its previous step.
+func (c *Controller) step(ctx context.Context, namespace, name string) {
+	key := namespace + "/" + name
+	var m Migration
+	if err := c.client.Get(ctx, path(namespace, name), &m); err != nil {
+		if !cluster.IsNotFound(err) && ctx.Err() == nil {
+			logging.Errorf("Failed to read migration %s: %v", key, err)
+		}
+		return
+	}
+	step := next(&m, time.Now())
+	if step == "" {
+		return
+	}
+	status := m.Status
+	status.ObservedGeneration = m.Generation
+	status.Phase, status.RetryAfter = cmp.Or(status.Phase, PhasePending), nil
+	if err := m.validate(); err != nil {
+		logging.Errorf("Invalid migration %s: %v", key, err)
+		c.fail(&m, &status, "Invalid", err)
+		c.saveStatus(ctx, &m, status)
+		return
+	}
+	// A failed migration whose spec changed resumes where it stopped.
+	if status.Phase == PhaseFailed && status.Precopies > 0 {
+		status.Phase = PhasePrecopy
+	} else if status.Phase == PhaseFailed {
+		status.Phase = PhasePending
+	}
+	if step == stepCutover {
+		status.Phase = PhaseCutover
+	}
+	c.setCondition(&m, &status, ConditionProgressing, metav1.ConditionTrue, "Running", fmt.Sprintf("The %s is running", step))
+	if err := c.saveStatus(ctx, &m, status); err != nil {
+		return
+	}
+
+	logging.Infof("Running the %s of migration %s\n", step, key)
+	err := c.run(ctx, &m, step)
+	if ctx.Err() != nil {
+		// The step is interrupted, by the deletion of the migration or the end of the controller.
+		c.setCondition(&m, &status, ConditionProgressing, metav1.ConditionFalse, "Interrupted", fmt.Sprintf("The %s was interrupted", step))
+		c.saveStatus(context.WithoutCancel(ctx), &m, status)
+		return
+	}
+	if err != nil {
+		logging.Errorf("The %s of migration %s failed: %v", step, key, err)
+		c.setCondition(&m, &status, ConditionProgressing, metav1.ConditionFalse, "Failed", fmt.Sprintf("The %s failed", step))
+		c.fail(&m, &status, "StepFailed", fmt.Errorf("%s: %w", step, err))
+		c.saveStatus(ctx, &m, status)
+		return
+	}
+
+	now := metav1.Now()
+	status.Message, status.RetryAfter = "", nil
+	c.setCondition(&m, &status, ConditionDegraded, metav1.ConditionFalse, "Succeeded", fmt.Sprintf("The %s succeeded", step))
+	switch step {
+	case stepPrepare:
+		status.Phase = PhasePrecopy
+		c.setCondition(&m, &status, ConditionProgressing, metav1.ConditionTrue, "Waiting", "The VM is applied, stopped, and waits for its first precopy")
+	case stepPrecopy:
+		status.Phase = PhasePrecopy
+		status.Precopies++
+		status.LastPrecopy = &now
+		c.setCondition(&m, &status, ConditionProgressing, metav1.ConditionTrue, "Waiting", fmt.Sprintf("Precopy %d done, waiting for the next one or the cutover", status.Precopies))
+	case stepCutover:
+		status.Phase = PhaseCompleted
+		c.setCondition(&m, &status, ConditionProgressing, metav1.ConditionFalse, "Completed", "The cutover is done")
+		c.setCondition(&m, &status, ConditionReady, metav1.ConditionTrue, "Completed", "The disks hold the final state of the VM")
+	}
+	logging.Infof("Migration %s: the %s succeeded\n", key, step)
+	c.saveStatus(ctx, &m, status)
+}
+
+// fail records err in status. Errors of the spec or of the VM fail the migration until its spec
+// changes; the others are retried after retryDelay.
+func (c *Controller) fail(m *Migration, status *MigrationStatus, reason string, err error) {
+	status.Message = err.Error()
+	switch failure.KindOf(err) {
+	case failure.Usage, failure.Parse, failure.Unsupported:
+		status.Phase, status.RetryAfter = PhaseFailed, nil
+		c.setCondition(m, status, ConditionProgressing, metav1.ConditionFalse, reason, "The migration stops until its spec changes")
+		c.setCondition(m, status, ConditionReady, metav1.ConditionFalse, reason, status.Message)
+	default:
+		retryAfter := metav1.NewTime(time.Now().Add(retryDelay))
+		status.RetryAfter = &retryAfter
+	}
+	c.setCondition(m, status, ConditionDegraded, metav1.ConditionTrue, reason, status.Message)
+}
+
+func (c *Controller) setCondition(m *Migration, status *MigrationStatus, conditionType string, value metav1.ConditionStatus, reason, message string) {
+	meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             value,
+		Reason:             reason,
+		Message:            message,
+		ObservedGeneration: m.Generation,
+	})
+}
+
+// saveStatus replaces the status of m.
+func (c *Controller) saveStatus(ctx context.Context, m *Migration, status MigrationStatus) error {
+	patch := []map[string]any{{"op": "add", "path": "/status", "value": status}}
+	err := c.client.JSONPatch(ctx, path(m.Namespace, m.Name)+"/status", patch)
+	if err != nil && !cluster.IsNotFound(err) {
+		logging.Errorf("Failed to save the status of migration %s/%s: %v", m.Namespace, m.Name, err)
+	}
+	return err
+}
+
+// run runs step of m in its directory, with the output in <step>.log there. Its error is the
+// last error the run logged, of the kind of its exit status.
+func (c *Controller) run(ctx context.Context, m *Migration, step string) error {
+	dir := filepath.Join(c.opts.Dir, m.Namespace, m.Name)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create the directory of the migration: %w", err)
+	}
+	args, password, err := c.args(ctx, m, dir, step)
+	if err != nil {
+		return err
+	}
+	logPath := filepath.Join(dir, step+".log")
+	logFile, err := os.Create(logPath)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+	cmd := exec.CommandContext(ctx, c.opts.Command, args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "VCENTER_PASSWORD="+password)
+	cmd.Stdout, cmd.Stderr = logFile, logFile
+	// An interrupted warm migration removes its snapshot before it exits.
+	cmd.Cancel = func() error { return cmd.Process.Signal(os.Interrupt) }
+	cmd.WaitDelay = time.Minute
+	if runErr := cmd.Run(); runErr != nil {
+		kind := failure.General
+		var exitErr *exec.ExitError
+		if errors.As(runErr, &exitErr) {
+			kind = failure.FromExitCode(exitErr.ExitCode())
+		}
+		if f, err := os.Open(logPath); err == nil {
+			defer f.Close()
+			if last := logging.LastMessage(f); last != "" {
+				return failure.Wrap(kind, errors.New(last))
+			}
+		}
+		return failure.Wrap(kind, runErr)
+	}
+	return nil
+}
+
+// args returns the arguments of the run of step of m, and the vCenter password it is given in
+// its environment. The mappings of m are written to files in dir.
+func (c *Controller) args(ctx context.Context, m *Migration, dir, step string) ([]string, string, error) {
+	secretPath, err := cluster.ResourcePath("v1", "Secret", m.Namespace, m.Spec.VCenter.Secret)
+	if err != nil {
+		return nil, "", err
+	}
+	var secret corev1.Secret
+	if err := c.client.Get(ctx, secretPath, &secret); err != nil {
+		return nil, "", fmt.Errorf("failed to read the vCenter Secret %s: %w", m.Spec.VCenter.Secret, err)
+	}
+	user, password := string(secret.Data["accessKeyId"]), string(secret.Data["secretKey"])
+	if user == "" || password == "" {
+		return nil, "", failure.Errorf(failure.Usage, "Secret %s needs the vCenter user in accessKeyId and its password in secretKey", m.Spec.VCenter.Secret)
+	}
+
+	source := []string{"-vcenter-url", m.Spec.VCenter.URL, "-vcenter-user", user, "-vm", m.Spec.VM}
+	if m.Spec.VCenter.Insecure {
+		source = append(source, "-vcenter-insecure")
+	}
+	if m.Spec.VCenter.Thumbprint != "" {
+		source = append(source, "-vcenter-thumbprint", m.Spec.VCenter.Thumbprint)
+	}
+	// The VM the prepare step applies and the cutover starts.
+	target := slices.Concat(c.opts.Args, []string{"-namespace", cmp.Or(m.Spec.TargetNamespace, m.Namespace)})
+	if m.Spec.Name != "" {
+		target = append(target, "-name", m.Spec.Name)
+	}
+	var args []string
+	switch step {
+	case stepPrepare:
+		args = slices.Concat(source, target, []string{"-pvc", m.Spec.PVC, "-apply", "-run-strategy", "Halted"})
+		if m.Spec.NetworkMap != nil {
+			if err := writeYAML(filepath.Join(dir, "networks.yaml"), m.Spec.NetworkMap); err != nil {
+				return nil, "", err
+			}
+			args = append(args, "-network-map", "networks.yaml")
+		}
+		if m.Spec.StorageMap != nil {
+			if err := writeYAML(filepath.Join(dir, "storage.yaml"), m.Spec.StorageMap); err != nil {
+				return nil, "", err
+			}
+			args = append(args, "-storage-map", "storage.yaml")
+		}
+	default:
+		args = slices.Concat([]string{"warm", step}, source, []string{"-warm-state", "warm.json"})
+		for _, disk := range slices.Sorted(maps.Keys(m.Spec.DiskOutputs)) {
+			args = append(args, "-warm-disk-output", disk+"="+m.Spec.DiskOutputs[disk])
+		}
+		if step == stepCutover {
+			args = append(args, target...)
+		}
+	}
+	// Each step takes its own options only.
+	options := maps.Clone(m.Spec.Options)
+	maps.DeleteFunc(options, func(name string, _ any) bool { return !slices.Contains(stepOptions[step], name) })
+	return append(args, options.Args()...), password, nil
+}
+
+// writeYAML writes v to the file at path, e.g. a mapping of a migration for its -network-map.
+func writeYAML(path string, v any) error {
+	data, err := yaml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", filepath.Base(path), err)
+	}
+	return nil
+}
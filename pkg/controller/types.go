@@ -0,0 +1,97 @@
+package controller
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"vmx2vmi/pkg/kubevirt"
+	"vmx2vmi/pkg/plan"
+)
+
+// Group, Version and Kind of the VMwareMigration custom resource.
+const (
+	Group    = "vmx2vmi.beezy.dev"
+	Version  = "v1alpha1"
+	Kind     = "VMwareMigration"
+	Resource = "vmwaremigrations"
+)
+
+// Phases of a migration.
+const (
+	PhasePending   = "Pending"
+	PhasePrecopy   = "Precopy"
+	PhaseCutover   = "Cutover"
+	PhaseCompleted = "Completed"
+	PhaseFailed    = "Failed"
+)
+
+// Types of the conditions of a migration.
+const (
+	// ConditionReady is true once the cutover started the KubeVirt VM.
+	ConditionReady = "Ready"
+	// ConditionProgressing is true while a step of the migration runs.
+	ConditionProgressing = "Progressing"
+	// ConditionDegraded is true after a step failed, until a step succeeds.
+	ConditionDegraded = "Degraded"
+)
+
+// Migration is a VMwareMigration: the warm migration of a vSphere VM to a KubeVirt VM.
+type Migration struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata"`
+	Spec              MigrationSpec   `json:"spec"`
+	Status            MigrationStatus `json:"status,omitempty"`
+}
+
+// MigrationList is a list of VMwareMigrations.
+type MigrationList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata"`
+	Items           []Migration `json:"items"`
+}
+
+// MigrationSpec is the migration the controller reconciles.
+type MigrationSpec struct {
+	VCenter VCenterRef `json:"vcenter"`
+	// VM is the VM in vCenter, as -vm takes it.
+	VM string `json:"vm"`
+	// Name is the name of the KubeVirt VM, the sanitized VM name by default.
+	Name string `json:"name,omitempty"`
+	// TargetNamespace is the namespace of the KubeVirt VM, that of the migration by default.
+	TargetNamespace string `json:"targetNamespace,omitempty"`
+	// PVC names the claim of the first disk, as -pvc takes it.
+	PVC        string               `json:"pvc"`
+	NetworkMap *kubevirt.NetworkMap `json:"networkMap,omitempty"`
+	StorageMap *kubevirt.StorageMap `json:"storageMap,omitempty"`
+	// DiskOutputs gives the raw image each disk is copied to, by disk, as a relative path in the
+	// directory of the migration.
+	DiskOutputs map[string]string `json:"diskOutputs,omitempty"`
+	// Options are the command-line options of every step, without the dash.
+	Options plan.Options `json:"options,omitempty"`
+	// PrecopyInterval is the time between two precopies, one hour by default.
+	PrecopyInterval *metav1.Duration `json:"precopyInterval,omitempty"`
+	// Cutover starts the cutover after the first precopy; CutoverTime starts it once reached.
+	Cutover     bool         `json:"cutover,omitempty"`
+	CutoverTime *metav1.Time `json:"cutoverTime,omitempty"`
+}
+
+// VCenterRef locates the vCenter of the VM. The Secret, in the namespace of the migration, holds
+// the user in accessKeyId and the password in secretKey.
+type VCenterRef struct {
+	URL        string `json:"url"`
+	Secret     string `json:"secret"`
+	Insecure   bool   `json:"insecure,omitempty"`
+	Thumbprint string `json:"thumbprint,omitempty"`
+}
+
+// MigrationStatus is the progress of a migration.
+type MigrationStatus struct {
+	ObservedGeneration int64  `json:"observedGeneration,omitempty"`
+	Phase              string `json:"phase,omitempty"`
+	// Precopies is the number of precopies done, LastPrecopy the end of the last one.
+	Precopies   int          `json:"precopies,omitempty"`
+	LastPrecopy *metav1.Time `json:"lastPrecopy,omitempty"`
+	// RetryAfter is when the step that failed runs again, unless the spec changes before.
+	RetryAfter *metav1.Time       `json:"retryAfter,omitempty"`
+	Message    string             `json:"message,omitempty"`
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
@@ -0,0 +1,86 @@
+package convert
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"vmx2vmi/pkg/progress"
+	"vmx2vmi/pkg/transfer"
+)
+
+// Options selects the image written by an Engine.
+type Options struct {
+	Format      string // raw or qcow2
+	ClusterSize int    // qcow2 cluster size in bytes
+	Compress    bool   // Compress qcow2 clusters
+	// SinceChangeID, when set, only copies the blocks changed since that change ID into the
+	// existing raw image at the destination (native and vddk engines, raw format only).
+	SinceChangeID string
+	// ReadWorkers is the number of chunks of the source disk read concurrently ahead of the
+	// writer; fewer than two reads sequentially.
+	ReadWorkers int
+	// Limiters cap the rate at which the source disk is read, e.g. a per-transfer and a
+	// global -bwlimit.
+	Limiters []*transfer.Limiter
+	// Progress, when set, is updated as the source disk is read.
+	Progress *progress.Disk
+	// Resume saves the progress of raw conversions next to the image and continues an
+	// interrupted conversion of the same source (native engine, raw format only).
+	Resume bool
+	// Verify reads the written image back and checks it holds the same content as the source.
+	Verify bool
+	// Remote is the disk read by the vddk engine.
+	Remote RemoteDisk
+}
+
+// Result summarizes a conversion.
+type Result struct {
+	// Summary is a human readable account of what was written.
+	Summary string
+	// SHA256 is the hex encoded digest of the virtual disk content, when the engine computes it.
+	SHA256 string
+	// ChangeID identifies the converted state of a disk with Changed Block Tracking, for the
+	// next incremental sync. Empty when the disk does not track changes.
+	ChangeID string
+}
+
+// Engine converts a VMDK to a raw or qcow2 image.
+type Engine interface {
+	// Name is the value selecting the engine with -disk-engine.
+	Name() string
+	// Convert writes the image of src to dst. Its errors are failure.Transfer, unless their
+	// cause has another kind, such as an unreadable or unsupported VMDK.
+	Convert(ctx context.Context, src, dst string, opts Options) (Result, error)
+}
+
+var engines = map[string]Engine{}
+
+func register(e Engine) {
+	engines[e.Name()] = e
+}
+
+func init() {
+	register(Native{})
+	register(QemuImg{})
+	register(VDDK{})
+}
+
+// Lookup returns the engine registered under name.
+func Lookup(name string) (Engine, error) {
+	if e, ok := engines[name]; ok {
+		return e, nil
+	}
+	return nil, fmt.Errorf("unknown disk engine '%s', must be one of %s", name, strings.Join(Names(), ", "))
+}
+
+// Names lists the registered engines.
+func Names() []string {
+	names := make([]string, 0, len(engines))
+	for name := range engines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,196 @@
+package convert
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"vmx2vmi/pkg/failure"
+	"vmx2vmi/pkg/logging"
+	"vmx2vmi/pkg/transfer"
+	"vmx2vmi/pkg/vmdk"
+)
+
+// Native converts disks with the built-in VMDK reader and image writers.
+type Native struct{}
+
+// Name implements Engine.
+func (Native) Name() string { return "native" }
+
+// Convert implements Engine.
+func (e Native) Convert(ctx context.Context, src, dst string, opts Options) (Result, error) {
+	result, err := e.convert(ctx, src, dst, opts)
+	return result, failure.Wrap(failure.Transfer, err)
+}
+
+func (Native) convert(ctx context.Context, src, dst string, opts Options) (Result, error) {
+	chain, err := vmdk.OpenChain(src)
+	var chainErr *vmdk.ChainError
+	var foreign *vmdk.ForeignFormatError
+	if errors.As(err, &chainErr) || errors.As(err, &foreign) || errors.Is(err, vmdk.ErrEncrypted) {
+		return Result{}, err
+	} else if err != nil {
+		return Result{}, fmt.Errorf("failed to open VMDK (-disk-engine qemu-img may support it): %w", err)
+	}
+	defer chain.Close()
+	opts.Progress.SetTotal(chain.Size())
+	if depth := len(chain.Layers); depth > 1 {
+		logging.Infof("Flattening snapshot chain of %d disks onto base %s\n", depth, chain.Layers[depth-1].Path)
+	}
+
+	if opts.Format == "qcow2" {
+		if opts.SinceChangeID != "" {
+			return Result{}, failure.Errorf(failure.Usage, "incremental sync only supports raw images")
+		}
+		if opts.Verify {
+			return Result{}, failure.Errorf(failure.Usage, "the native engine only verifies raw images, use -disk-engine qemu-img to verify qcow2")
+		}
+		if opts.Resume {
+			return Result{}, failure.Errorf(failure.Usage, "only raw conversions can be resumed")
+		}
+		digest := vmdk.NewDigestReaderAt(opts.Progress.Wrap(transfer.LimitReaderAt(ctx, vmdk.NewReadAhead(chain, chain.Size(), opts.ReadWorkers), opts.Limiters...)))
+		stats, err := vmdk.WriteQcow2(digest, chain.Size(), dst, vmdk.Qcow2Options{
+			ClusterSize: opts.ClusterSize,
+			Compress:    opts.Compress,
+		})
+		if err != nil {
+			return Result{}, err
+		}
+		sum, err := digest.Sum(chain.Size())
+		if err != nil {
+			return Result{}, err
+		}
+		return Result{
+			Summary: fmt.Sprintf("Wrote %d data clusters, %d compressed clusters, %d zero clusters skipped (%d bytes on disk)",
+				stats.DataClusters, stats.CompressedClusters, stats.ZeroClusters, stats.FileSize),
+			SHA256: sum,
+		}, nil
+	}
+
+	tracking, err := chain.ChangeTracking()
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to read change tracking: %w", err)
+	}
+	var result Result
+	if opts.SinceChangeID != "" {
+		if tracking == nil {
+			return Result{}, fmt.Errorf("incremental sync needs Changed Block Tracking, but %s has no changeTrackPath (enable ctkEnabled on the VM)", chain.Layers[0].Path)
+		}
+		ranges, err := tracking.ChangedRanges(opts.SinceChangeID)
+		if errors.Is(err, vmdk.ErrChangeTrackingReset) {
+			return Result{}, fmt.Errorf("%w; run a full conversion", err)
+		} else if err != nil {
+			return Result{}, err
+		}
+		var changed int64
+		for _, r := range ranges {
+			changed += min(r.Offset+r.Length, chain.Size()) - r.Offset
+		}
+		opts.Progress.SetTotal(changed)
+		stats, err := vmdk.UpdateRaw(opts.Progress.Wrap(transfer.LimitReaderAt(ctx, chain, opts.Limiters...)), chain.Size(), dst, ranges)
+		if err != nil {
+			return Result{}, err
+		}
+		result.Summary = fmt.Sprintf("Copied %d changed ranges: %d data bytes, %d zero bytes", len(ranges), stats.DataBytes, stats.ZeroBytes)
+	} else {
+		if result, err = writeRaw(ctx, src, chain, dst, opts); err != nil {
+			return Result{}, err
+		}
+	}
+	if opts.Verify {
+		if result.SHA256 == "" {
+			if result.SHA256, err = vmdk.SHA256(vmdk.NewReadAhead(chain, chain.Size(), opts.ReadWorkers), chain.Size()); err != nil {
+				return Result{}, fmt.Errorf("failed to hash source disk: %w", err)
+			}
+		}
+		if err := verifyRaw(dst, chain.Size(), result.SHA256); err != nil {
+			return Result{}, err
+		}
+	}
+	if tracking != nil {
+		result.ChangeID = tracking.ChangeID()
+	}
+	return result, nil
+}
+
+// writeRaw copies chain to the raw image at dst. With opts.Resume, progress is saved every
+// vmdk.ResumeSegment bytes and a previous interrupted copy is continued.
+func writeRaw(ctx context.Context, src string, chain *vmdk.Chain, dst string, opts Options) (Result, error) {
+	size := chain.Size()
+	var state *resumeState
+	if opts.Resume {
+		var err error
+		if state, err = loadResumeState(src, chain, dst); err != nil {
+			return Result{}, err
+		}
+	}
+	if !opts.Resume {
+		os.Remove(resumeStatePath(dst))
+	}
+	if state == nil {
+		state = &resumeState{Source: src, Size: size, CIDs: chainCIDs(chain)}
+	} else {
+		logging.Infof("Resuming the conversion of %s at offset %d (%d%%)\n", src, state.Offset, state.Offset*100/size)
+	}
+
+	reader := opts.Progress.Wrap(transfer.LimitReaderAt(ctx, vmdk.NewReadAhead(chain, size, opts.ReadWorkers), opts.Limiters...))
+	digest := vmdk.NewDigestReaderAt(reader)
+	if state.Offset > 0 {
+		opts.Progress.SetTotal(size - state.Offset)
+		var err error
+		if digest, err = vmdk.ResumeDigestReaderAt(reader, state.Digest, state.Offset); err != nil {
+			return Result{}, err
+		}
+	}
+
+	var checkpoint func(vmdk.RawCheckpoint) error
+	if opts.Resume {
+		checkpoint = func(c vmdk.RawCheckpoint) error {
+			digestState, offset, err := digest.State()
+			if err != nil {
+				return err
+			}
+			if offset != c.Offset {
+				return fmt.Errorf("digest at offset %d does not match checkpoint at %d", offset, c.Offset)
+			}
+			state.Offset, state.Digest = c.Offset, digestState
+			state.Ranges = append(state.Ranges, completedRange{Offset: c.Start, Length: c.Offset - c.Start, SHA256: c.SHA256})
+			return state.save(dst)
+		}
+	}
+	stats, err := vmdk.WriteRawFrom(digest, size, dst, state.Offset, checkpoint)
+	if err != nil {
+		if opts.Resume && len(state.Ranges) > 0 {
+			err = fmt.Errorf("%w (run again with -resume to continue at offset %d)", err, state.Offset)
+		}
+		return Result{}, err
+	}
+	if opts.Resume {
+		os.Remove(resumeStatePath(dst))
+	}
+
+	result := Result{Summary: fmt.Sprintf("Wrote %d data bytes, %d zero bytes left sparse", stats.DataBytes, stats.ZeroBytes)}
+	if result.SHA256, err = digest.Sum(size); err != nil {
+		return Result{}, err
+	}
+	return result, nil
+}
+
+// verifyRaw re-reads the first size bytes of a raw image and compares their digest with want.
+// Block devices may be larger than the disk, so only the disk size is hashed.
+func verifyRaw(path string, size int64, want string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s for verification: %w", path, err)
+	}
+	defer f.Close()
+	got, err := vmdk.SHA256(f, size)
+	if err != nil {
+		return fmt.Errorf("failed to hash %s: %w", path, err)
+	}
+	if got != want {
+		return fmt.Errorf("verification failed: %s has sha256 %s, source disk has %s", path, got, want)
+	}
+	return nil
+}
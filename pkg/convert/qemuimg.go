@@ -0,0 +1,154 @@
+package convert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"vmx2vmi/pkg/failure"
+	"vmx2vmi/pkg/ova"
+	"vmx2vmi/pkg/progress"
+)
+
+// QemuImg converts disks by running qemu-img, which reads VMDK sub-formats the native
+// reader does not support. Snapshot chains are followed by qemu-img itself.
+type QemuImg struct{}
+
+// Name implements Engine.
+func (QemuImg) Name() string { return "qemu-img" }
+
+// Convert implements Engine.
+func (e QemuImg) Convert(ctx context.Context, src, dst string, opts Options) (Result, error) {
+	result, err := e.convert(ctx, src, dst, opts)
+	return result, failure.Wrap(failure.Transfer, err)
+}
+
+func (QemuImg) convert(ctx context.Context, src, dst string, opts Options) (Result, error) {
+	if opts.SinceChangeID != "" {
+		return Result{}, failure.Errorf(failure.Usage, "incremental sync is only supported by the native and vddk engines")
+	}
+	if opts.Resume {
+		return Result{}, failure.Errorf(failure.Usage, "resuming conversions is only supported by the native engine")
+	}
+	if _, _, ok := ova.SplitPath(src); ok {
+		return Result{}, failure.Errorf(failure.Usage, "qemu-img cannot read disks inside an OVA archive, use -disk-engine native")
+	}
+	binary, err := exec.LookPath("qemu-img")
+	if err != nil {
+		return Result{}, fmt.Errorf("qemu-img not found on PATH, install qemu-utils (or qemu-img) or use -disk-engine native: %w", err)
+	}
+
+	args := []string{"convert", "-f", "vmdk", "-O", opts.Format}
+	if opts.Format == "qcow2" {
+		if opts.Compress {
+			args = append(args, "-c")
+		}
+		if opts.ClusterSize > 0 {
+			args = append(args, "-o", fmt.Sprintf("cluster_size=%d", opts.ClusterSize))
+		}
+	}
+	if opts.ReadWorkers > 1 {
+		// qemu-img caps its parallel coroutines at 16.
+		args = append(args, "-m", fmt.Sprint(min(opts.ReadWorkers, 16)))
+	}
+	var rate int64
+	for _, l := range opts.Limiters {
+		if l.Rate() > 0 && (rate == 0 || l.Rate() < rate) {
+			rate = l.Rate()
+		}
+	}
+	if rate > 0 {
+		// qemu-img applies a single rate limit, the strictest one is used.
+		args = append(args, "-r", fmt.Sprint(rate))
+	}
+	// Block devices already exist and must be written in place.
+	if info, err := os.Stat(dst); err == nil && info.Mode()&os.ModeDevice != 0 {
+		args = append(args, "-n")
+	}
+	var stdout io.Writer
+	if opts.Progress != nil {
+		if size, err := virtualSize(ctx, binary, src); err == nil {
+			args = append(args, "-p")
+			opts.Progress.SetTotal(size)
+			stdout = &progressParser{disk: opts.Progress, size: size}
+		}
+	}
+	args = append(args, src, dst)
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, binary, args...)
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return Result{}, fmt.Errorf("qemu-img %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+
+	if opts.Verify {
+		// compare exits 1 when the images differ and prints the first differing offset.
+		args := []string{"compare", "-f", "vmdk", "-F", opts.Format, src, dst}
+		var stdout bytes.Buffer
+		stderr.Reset()
+		cmd := exec.CommandContext(ctx, binary, args...)
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			return Result{}, fmt.Errorf("verification failed: qemu-img %s: %w: %s", strings.Join(args, " "), err,
+				strings.TrimSpace(stdout.String()+" "+stderr.String()))
+		}
+	}
+
+	summary := fmt.Sprintf("qemu-img wrote %s", dst)
+	if info, err := os.Stat(dst); err == nil && info.Mode().IsRegular() {
+		summary += fmt.Sprintf(" (%d bytes)", info.Size())
+	}
+	return Result{Summary: summary}, nil
+}
+
+// virtualSize returns the size of the disk at src as reported by qemu-img info.
+func virtualSize(ctx context.Context, binary, src string) (int64, error) {
+	out, err := exec.CommandContext(ctx, binary, "info", "-f", "vmdk", "--output=json", src).Output()
+	if err != nil {
+		return 0, err
+	}
+	var info struct {
+		VirtualSize int64 `json:"virtual-size"`
+	}
+	if err := json.Unmarshal(out, &info); err != nil {
+		return 0, err
+	}
+	return info.VirtualSize, nil
+}
+
+// progressParser turns the "(42.17/100%)" updates qemu-img -p prints into progress.
+type progressParser struct {
+	disk *progress.Disk
+	size int64
+	buf  []byte
+}
+
+func (p *progressParser) Write(b []byte) (int, error) {
+	p.buf = append(p.buf, b...)
+	for {
+		start := bytes.IndexByte(p.buf, '(')
+		end := bytes.Index(p.buf, []byte("/100%)"))
+		if start < 0 || end < 0 {
+			break
+		}
+		if start < end {
+			if percent, err := strconv.ParseFloat(string(p.buf[start+1:end]), 64); err == nil {
+				p.disk.Set(int64(percent / 100 * float64(p.size)))
+			}
+		}
+		p.buf = p.buf[end+len("/100%)"):]
+	}
+	if len(p.buf) > 256 {
+		p.buf = p.buf[len(p.buf)-64:]
+	}
+	return len(b), nil
+}
@@ -0,0 +1,114 @@
+package convert
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"vmx2vmi/pkg/logging"
+	"vmx2vmi/pkg/vmdk"
+)
+
+// resumeState is saved next to a raw image while it is written, so that an interrupted
+// conversion can continue where it stopped.
+type resumeState struct {
+	Source string `json:"source"`
+	Size   int64  `json:"size"`
+	// CIDs identify the content of every layer of the source chain; any write to the source
+	// changes them and invalidates the state.
+	CIDs []string `json:"cids"`
+	// Offset is the end of the data synced to the image.
+	Offset int64 `json:"offset"`
+	// Digest is the serialized sha256 of the disk content before Offset.
+	Digest []byte `json:"digest"`
+	// Ranges records the checksum of each completed range of the image.
+	Ranges []completedRange `json:"ranges"`
+}
+
+type completedRange struct {
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+	SHA256 string `json:"sha256"`
+}
+
+// resumeStatePath returns the state file of the image at dst.
+func resumeStatePath(dst string) string {
+	return filepath.Join(filepath.Dir(dst), "."+filepath.Base(dst)+".vmx2vmi-resume.json")
+}
+
+// chainCIDs lists the CID of every layer of chain.
+func chainCIDs(chain *vmdk.Chain) []string {
+	var cids []string
+	for _, layer := range chain.Layers {
+		cids = append(cids, layer.Descriptor.CID)
+	}
+	return cids
+}
+
+// loadResumeState returns the saved state of a previous conversion of chain to dst, or nil
+// when there is none or it no longer applies. The last completed range is re-read from dst
+// and checked against its checksum before the state is trusted.
+func loadResumeState(src string, chain *vmdk.Chain, dst string) (*resumeState, error) {
+	data, err := os.ReadFile(resumeStatePath(dst))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var state resumeState
+	if err := json.Unmarshal(data, &state); err != nil {
+		logging.Warnf("Ignoring unreadable resume state %s: %v", resumeStatePath(dst), err)
+		return nil, nil
+	}
+	if state.Size != chain.Size() || !slices.Equal(state.CIDs, chainCIDs(chain)) {
+		logging.Warnf("%s changed since the interrupted conversion of %s, starting over", src, dst)
+		return nil, nil
+	}
+	if len(state.Ranges) == 0 || state.Offset <= 0 || state.Offset >= state.Size {
+		return nil, nil
+	}
+
+	last := state.Ranges[len(state.Ranges)-1]
+	f, err := os.Open(dst)
+	if err != nil {
+		logging.Warnf("Cannot resume, %v", err)
+		return nil, nil
+	}
+	defer f.Close()
+	sum, err := vmdk.SHA256(sectionAt{f, last.Offset}, last.Length)
+	if err != nil || sum != last.SHA256 {
+		logging.Warnf("%s does not hold the data copied before the interruption, starting over", dst)
+		return nil, nil
+	}
+	return &state, nil
+}
+
+// save writes the state atomically.
+func (s *resumeState) save(dst string) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	path := resumeStatePath(dst)
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return fmt.Errorf("failed to save resume state: %w", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("failed to save resume state: %w", err)
+	}
+	return nil
+}
+
+// sectionAt shifts reads of r by base.
+type sectionAt struct {
+	r    *os.File
+	base int64
+}
+
+func (s sectionAt) ReadAt(p []byte, off int64) (int, error) {
+	return s.r.ReadAt(p, s.base+off)
+}
@@ -0,0 +1,104 @@
+package convert
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"vmx2vmi/pkg/failure"
+	"vmx2vmi/pkg/transfer"
+	"vmx2vmi/pkg/vmdk"
+)
+
+// RemoteDisk is a disk read from its hypervisor rather than from a file, such as a vSphere disk
+// read through VDDK.
+type RemoteDisk interface {
+	io.ReaderAt
+	Size() int64
+	// ChangeID identifies the state being read for the next incremental read, "" when the
+	// disk does not track changes.
+	ChangeID() string
+	// ChangedRanges returns the areas written since the state of changeID.
+	ChangedRanges(ctx context.Context, changeID string) ([]vmdk.Range, error)
+}
+
+// VDDK converts the RemoteDisk of Options, read through the VDDK library; src only names it.
+type VDDK struct{}
+
+// Name implements Engine.
+func (VDDK) Name() string { return "vddk" }
+
+// Convert implements Engine.
+func (e VDDK) Convert(ctx context.Context, src, dst string, opts Options) (Result, error) {
+	result, err := e.convert(ctx, src, dst, opts)
+	return result, failure.Wrap(failure.Transfer, err)
+}
+
+func (VDDK) convert(ctx context.Context, src, dst string, opts Options) (Result, error) {
+	disk := opts.Remote
+	if disk == nil {
+		return Result{}, failure.Errorf(failure.Usage, "the vddk engine reads the disks of VMs in vSphere, name the VM with -vm")
+	}
+	if opts.Resume {
+		return Result{}, failure.Errorf(failure.Usage, "resuming conversions is only supported by the native engine; the vddk engine can sync the rest with -since-change-id")
+	}
+	size := disk.Size()
+	opts.Progress.SetTotal(size)
+	result := Result{ChangeID: disk.ChangeID()}
+
+	if opts.SinceChangeID != "" {
+		if opts.Format != "raw" {
+			return Result{}, failure.Errorf(failure.Usage, "incremental sync only supports raw images")
+		}
+		if opts.Verify {
+			return Result{}, failure.Errorf(failure.Usage, "an incremental sync cannot be verified, verify the image with a full conversion")
+		}
+		ranges, err := disk.ChangedRanges(ctx, opts.SinceChangeID)
+		if err != nil {
+			return Result{}, err
+		}
+		var changed int64
+		for _, r := range ranges {
+			changed += min(r.Offset+r.Length, size) - r.Offset
+		}
+		opts.Progress.SetTotal(changed)
+		stats, err := vmdk.UpdateRaw(opts.Progress.Wrap(transfer.LimitReaderAt(ctx, disk, opts.Limiters...)), size, dst, ranges)
+		if err != nil {
+			return Result{}, err
+		}
+		result.Summary = fmt.Sprintf("Copied %d changed ranges: %d data bytes, %d zero bytes", len(ranges), stats.DataBytes, stats.ZeroBytes)
+		return result, nil
+	}
+
+	digest := vmdk.NewDigestReaderAt(opts.Progress.Wrap(transfer.LimitReaderAt(ctx, vmdk.NewReadAhead(disk, size, opts.ReadWorkers), opts.Limiters...)))
+	if opts.Format == "qcow2" {
+		if opts.Verify {
+			return Result{}, failure.Errorf(failure.Usage, "the vddk engine only verifies raw images")
+		}
+		stats, err := vmdk.WriteQcow2(digest, size, dst, vmdk.Qcow2Options{
+			ClusterSize: opts.ClusterSize,
+			Compress:    opts.Compress,
+		})
+		if err != nil {
+			return Result{}, err
+		}
+		result.Summary = fmt.Sprintf("Wrote %d data clusters, %d compressed clusters, %d zero clusters skipped (%d bytes on disk)",
+			stats.DataClusters, stats.CompressedClusters, stats.ZeroClusters, stats.FileSize)
+	} else {
+		stats, err := vmdk.WriteRaw(digest, size, dst)
+		if err != nil {
+			return Result{}, err
+		}
+		result.Summary = fmt.Sprintf("Wrote %d data bytes, %d zero bytes left sparse", stats.DataBytes, stats.ZeroBytes)
+	}
+	var err error
+	if result.SHA256, err = digest.Sum(size); err != nil {
+		return Result{}, err
+	}
+	if opts.Verify {
+		if err := verifyRaw(dst, size, result.SHA256); err != nil {
+			return Result{}, err
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,114 @@
+package diff
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Change describes a single field whose value differs between two objects.
+// Path is a dotted JSON path (e.g. "spec.template.spec.domain.cpu.cores").
+// Old or New is empty when the field is absent on that side.
+type Change struct {
+	Path string
+	Old  string
+	New  string
+}
+
+// String renders the change in a compact, human readable form.
+func (c Change) String() string {
+	switch {
+	case c.Old == "":
+		return fmt.Sprintf("+ %s: %s", c.Path, c.New)
+	case c.New == "":
+		return fmt.Sprintf("- %s: %s", c.Path, c.Old)
+	default:
+		return fmt.Sprintf("~ %s: %s -> %s", c.Path, c.Old, c.New)
+	}
+}
+
+// Compare returns the leaf fields that differ between oldObj and newObj.
+// Both objects are round-tripped through JSON, so any value that marshals
+// (Kubernetes API types, maps, structs) can be compared. Results are sorted by path.
+func Compare(oldObj, newObj any) ([]Change, error) {
+	oldFlat, err := flatten(oldObj)
+	if err != nil {
+		return nil, fmt.Errorf("failed to flatten old object: %w", err)
+	}
+	newFlat, err := flatten(newObj)
+	if err != nil {
+		return nil, fmt.Errorf("failed to flatten new object: %w", err)
+	}
+
+	var changes []Change
+	for path, oldVal := range oldFlat {
+		newVal, ok := newFlat[path]
+		if !ok {
+			changes = append(changes, Change{Path: path, Old: oldVal})
+		} else if newVal != oldVal {
+			changes = append(changes, Change{Path: path, Old: oldVal, New: newVal})
+		}
+	}
+	for path, newVal := range newFlat {
+		if _, ok := oldFlat[path]; !ok {
+			changes = append(changes, Change{Path: path, New: newVal})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes, nil
+}
+
+// flatten converts obj into a map of dotted JSON paths to the JSON encoding of each leaf.
+func flatten(obj any) (map[string]string, error) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	var generic any
+	if err := json.Unmarshal(data, &generic); err != nil {
+		return nil, err
+	}
+	out := make(map[string]string)
+	walk("", generic, out)
+	return out, nil
+}
+
+func walk(prefix string, v any, out map[string]string) {
+	switch val := v.(type) {
+	case map[string]any:
+		if len(val) == 0 {
+			if prefix != "" {
+				out[prefix] = "{}"
+			}
+			return
+		}
+		for k, child := range val {
+			walk(join(prefix, k), child, out)
+		}
+	case []any:
+		if len(val) == 0 {
+			out[prefix] = "[]"
+			return
+		}
+		for i, child := range val {
+			walk(fmt.Sprintf("%s[%d]", prefix, i), child, out)
+		}
+	case nil:
+		// Absent and null are treated the same.
+	default:
+		encoded, _ := json.Marshal(val)
+		out[prefix] = string(encoded)
+	}
+}
+
+func join(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	if strings.ContainsAny(key, ".[]") {
+		return fmt.Sprintf("%s[%q]", prefix, key)
+	}
+	return prefix + "." + key
+}
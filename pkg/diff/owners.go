@@ -0,0 +1,105 @@
+package diff
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Owners returns the field manager of each leaf field of obj, an object read from the cluster, by
+// the path Compare gives the field. The managers come from the managedFields of its metadata; a
+// field several managers share is given the one listed last.
+func Owners(obj any) (map[string]string, error) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	var generic map[string]any
+	if err := json.Unmarshal(data, &generic); err != nil {
+		return nil, err
+	}
+	var object struct {
+		Metadata struct {
+			ManagedFields []struct {
+				Manager  string         `json:"manager"`
+				FieldsV1 map[string]any `json:"fieldsV1"`
+			} `json:"managedFields"`
+		} `json:"metadata"`
+	}
+	if err := json.Unmarshal(data, &object); err != nil {
+		return nil, err
+	}
+	owners := make(map[string]string)
+	for _, entry := range object.Metadata.ManagedFields {
+		own("", generic, entry.FieldsV1, entry.Manager, owners)
+	}
+	return owners, nil
+}
+
+// own records manager as the owner of the fields of v, at prefix, the fieldsV1 set fields lists.
+// A set without children owns v and everything below it.
+func own(prefix string, v any, fields map[string]any, manager string, owners map[string]string) {
+	children := 0
+	for key := range fields {
+		if key != "." {
+			children++
+		}
+	}
+	if children == 0 {
+		leaves := make(map[string]string)
+		walk(prefix, v, leaves)
+		for path := range leaves {
+			owners[path] = manager
+		}
+		return
+	}
+	for key, child := range fields {
+		childFields, _ := child.(map[string]any)
+		kind, name, _ := strings.Cut(key, ":")
+		switch kind {
+		case "f":
+			// A field of a map.
+			if m, ok := v.(map[string]any); ok {
+				if value, ok := m[name]; ok {
+					own(join(prefix, name), value, childFields, manager, owners)
+				}
+			}
+		case "k", "v", "i":
+			// An item of a list, by the values of its key fields, its own value or its index.
+			list, _ := v.([]any)
+			var key any
+			if kind != "i" && json.Unmarshal([]byte(name), &key) != nil {
+				continue
+			}
+			for i, item := range list {
+				if matches(kind, name, key, i, item) {
+					own(fmt.Sprintf("%s[%d]", prefix, i), item, childFields, manager, owners)
+				}
+			}
+		}
+	}
+}
+
+// matches reports whether item, at index i of its list, is the item a fieldsV1 key of kind
+// designates: name for an index, key for a value or the values of key fields.
+func matches(kind, name string, key any, i int, item any) bool {
+	switch kind {
+	case "i":
+		return name == strconv.Itoa(i)
+	case "v":
+		return reflect.DeepEqual(item, key)
+	}
+	fields, ok := key.(map[string]any)
+	m, isMap := item.(map[string]any)
+	if !ok || !isMap {
+		return false
+	}
+	for field, value := range fields {
+		if !reflect.DeepEqual(m[field], value) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,126 @@
+// Package failure classifies the errors of vmx2vmi by kind, and maps each kind to the exit status
+// of the run, so that the scripts and pipelines orchestrating migrations can branch on the kind
+// of failure instead of matching the log.
+package failure
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Kind is the kind of a failure; its value is the exit status of a run failing with it.
+type Kind int
+
+const (
+	// General is a failure of no other kind.
+	General Kind = 1
+	// Usage is an invalid command line, configuration or combination of options.
+	Usage Kind = 2
+	// Parse is a VMX, OVF, VMDK, plan or mapping file that cannot be read or parsed.
+	Parse Kind = 3
+	// Unsupported is a source VM or disk using a feature the conversion does not support.
+	Unsupported Kind = 4
+	// Transfer is a failed copy, conversion, download or upload of disk data.
+	Transfer Kind = 5
+	// Cluster is a Kubernetes API request that failed or was rejected.
+	Cluster Kind = 6
+	// Partial is a plan or batch in which some VMs were converted and others failed.
+	Partial Kind = 7
+)
+
+var names = map[Kind]string{
+	General:     "general",
+	Usage:       "usage",
+	Parse:       "parse",
+	Unsupported: "unsupported",
+	Transfer:    "transfer",
+	Cluster:     "cluster",
+	Partial:     "partial",
+}
+
+func (k Kind) String() string {
+	if name, ok := names[k]; ok {
+		return name
+	}
+	return fmt.Sprintf("kind %d", int(k))
+}
+
+// ExitCode returns the exit status of a run failing with k.
+func (k Kind) ExitCode() int {
+	return int(k)
+}
+
+// FromExitCode returns the kind of the exit status of a run, General for statuses of no kind.
+func FromExitCode(code int) Kind {
+	if _, ok := names[Kind(code)]; ok {
+		return Kind(code)
+	}
+	return General
+}
+
+// kinded is implemented by the errors that know their kind, such as Error and the API errors of
+// the cluster package.
+type kinded interface {
+	error
+	Kind() Kind
+}
+
+// Error is an error of a kind.
+type Error struct {
+	kind Kind
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Kind returns the kind of the error.
+func (e *Error) Kind() Kind {
+	return e.kind
+}
+
+// Wrap returns err as an error of kind, or err itself when it is nil or already has a kind: the
+// innermost classification, closest to the cause, wins.
+func Wrap(kind Kind, err error) error {
+	var k kinded
+	if err == nil || errors.As(err, &k) {
+		return err
+	}
+	return &Error{kind: kind, Err: err}
+}
+
+// Errorf formats an error of kind like fmt.Errorf.
+func Errorf(kind Kind, format string, args ...any) error {
+	return &Error{kind: kind, Err: fmt.Errorf(format, args...)}
+}
+
+// KindOf returns the kind of err, General when it has none.
+func KindOf(err error) Kind {
+	var k kinded
+	if errors.As(err, &k) {
+		return k.Kind()
+	}
+	return General
+}
+
+// OfBatch returns the kind of failure of a plan or batch of VMs, given the errors of those that
+// failed and the number of those converted: Partial when some were, otherwise the kind shared by
+// all the errors, or General.
+func OfBatch(errs []error, converted int) Kind {
+	if converted > 0 {
+		return Partial
+	}
+	kind := General
+	for i, err := range errs {
+		if i > 0 && KindOf(err) != kind {
+			return General
+		}
+		kind = KindOf(err)
+	}
+	return kind
+}
@@ -0,0 +1,97 @@
+package kubevirt
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+// AccessCredentialOptions wires a Secret of SSH public keys into the VM through accessCredentials.
+type AccessCredentialOptions struct {
+	// SecretName is the Secret holding the keys; every value of the Secret is an authorized_keys entry.
+	SecretName string
+	// Propagation is cloud-init, which writes the keys on first boot through the cloud-init
+	// disk, or guest-agent, which keeps them in sync at runtime through qemu-guest-agent.
+	Propagation string
+	// Users are the guest users receiving the keys with guest-agent propagation.
+	Users []string
+}
+
+// ParseSSHPropagation validates an -ssh-propagation value.
+func ParseSSHPropagation(value string) (string, error) {
+	switch value {
+	case "cloud-init", "guest-agent":
+		return value, nil
+	}
+	return "", fmt.Errorf("invalid SSH key propagation '%s': must be cloud-init or guest-agent", value)
+}
+
+// SSHKeySecret returns a Secret named name holding keys, one authorized_keys line each, to be
+// referenced by ApplyAccessCredentials.
+func SSHKeySecret(vm *kubevirtv1.VirtualMachine, name string, keys []string) *corev1.Secret {
+	return &corev1.Secret{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: vm.Namespace,
+			Labels:    map[string]string{kubevirtv1.AppLabel: vm.Name},
+		},
+		StringData: map[string]string{"authorized_keys": strings.Join(keys, "\n") + "\n"},
+	}
+}
+
+// ParseSSHKeyFile parses the content of an authorized_keys or .pub file, skipping blank lines
+// and comments.
+func ParseSSHKeyFile(content string) ([]string, error) {
+	var keys []string
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := ParseSSHKey(line)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no SSH public key found")
+	}
+	return keys, nil
+}
+
+// ApplyAccessCredentials references the SSH key Secret of opts from vm. With cloud-init
+// propagation KubeVirt adds the keys to the cloud-init disk, which is attached when missing.
+// It returns a description of the credential, for the conversion report.
+func ApplyAccessCredentials(vm *kubevirtv1.VirtualMachine, opts AccessCredentialOptions) ([]string, error) {
+	if opts.SecretName == "" {
+		return nil, nil
+	}
+	credential := &kubevirtv1.SSHPublicKeyAccessCredential{
+		Source: kubevirtv1.SSHPublicKeyAccessCredentialSource{
+			Secret: &kubevirtv1.AccessCredentialSecretSource{SecretName: opts.SecretName},
+		},
+	}
+	var description string
+	switch opts.Propagation {
+	case "guest-agent":
+		if len(opts.Users) == 0 {
+			return nil, fmt.Errorf("guest-agent propagation of SSH keys needs the guest users receiving them")
+		}
+		credential.PropagationMethod.QemuGuestAgent = &kubevirtv1.QemuGuestAgentSSHPublicKeyAccessCredentialPropagation{Users: opts.Users}
+		description = "kept in sync by qemu-guest-agent for " + strings.Join(opts.Users, ", ")
+	default:
+		credential.PropagationMethod.NoCloud = &kubevirtv1.NoCloudSSHPublicKeyAccessCredentialPropagation{}
+		source := cloudInitSource(vm)
+		if source.UserData == "" && source.UserDataSecretRef == nil {
+			source.UserData = cloudConfigHeader + "\n"
+		}
+		description = "written by cloud-init on first boot"
+	}
+	vm.Spec.Template.Spec.AccessCredentials = append(vm.Spec.Template.Spec.AccessCredentials, kubevirtv1.AccessCredential{SSHPublicKey: credential})
+	return []string{fmt.Sprintf("SSH public keys from Secret %s %s", opts.SecretName, description)}, nil
+}
@@ -0,0 +1,202 @@
+package kubevirt
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// cloudConfigHeader starts every cloud-config user data document.
+const cloudConfigHeader = "#cloud-config"
+
+// cloudInitInlineLimit is the largest user or network data KubeVirt accepts inline in the VM spec.
+const cloudInitInlineLimit = 2048
+
+// cloudInitVolume is the name of the cloud-init disk and volume.
+const cloudInitVolume = "cloudinitdisk"
+
+// CloudInitOptions configures the first-boot customization of the guest with cloud-init.
+type CloudInitOptions struct {
+	// UserData is the user data given with -cloud-init, empty for none.
+	UserData string
+	// NetworkData is the network configuration (version 1 or 2), empty for none.
+	NetworkData string
+	// SSHKeys are public keys authorized for the default user of the cloud image.
+	SSHKeys []string
+}
+
+// ApplyCloudInit attaches a cloudInitNoCloud disk carrying the user data, SSH keys and network
+// configuration of opts to vm. SSH keys are merged into the user data as ssh_authorized_keys,
+// which requires a #cloud-config document. It returns a description of what was attached, for
+// the conversion report.
+func ApplyCloudInit(vm *kubevirtv1.VirtualMachine, opts CloudInitOptions) ([]string, error) {
+	var applied []string
+	if opts.UserData != "" {
+		if err := AttachCloudInitUserData(vm, opts.UserData); err != nil {
+			return nil, err
+		}
+		applied = append(applied, "cloud-init user data from -cloud-init")
+	}
+	if len(opts.SSHKeys) > 0 {
+		keys, err := SSHKeysUserData(opts.SSHKeys)
+		if err != nil {
+			return nil, err
+		}
+		if err := AttachCloudInitUserData(vm, keys); err != nil {
+			return nil, fmt.Errorf("failed to add the SSH keys: %w", err)
+		}
+		applied = append(applied, fmt.Sprintf("cloud-init authorizing %d SSH key(s) for the default user", len(opts.SSHKeys)))
+	}
+	if opts.NetworkData != "" {
+		if err := AttachCloudInitNetworkData(vm, opts.NetworkData); err != nil {
+			return nil, err
+		}
+		applied = append(applied, "cloud-init network configuration from -cloud-init-network-config")
+	}
+	return applied, nil
+}
+
+// ParseSSHKey validates a -ssh-key value, an OpenSSH public key line.
+func ParseSSHKey(value string) (string, error) {
+	key := strings.TrimSpace(value)
+	fields := strings.Fields(key)
+	if len(fields) < 2 || !(strings.HasPrefix(fields[0], "ssh-") || strings.HasPrefix(fields[0], "ecdsa-") || strings.HasPrefix(fields[0], "sk-")) {
+		return "", fmt.Errorf("invalid SSH public key '%s': expected an OpenSSH public key such as 'ssh-ed25519 AAAA... user@host'", value)
+	}
+	return key, nil
+}
+
+// SSHKeysUserData returns a cloud-config authorizing keys for the default user.
+func SSHKeysUserData(keys []string) (string, error) {
+	data, err := yaml.Marshal(map[string]any{"ssh_authorized_keys": keys})
+	if err != nil {
+		return "", err
+	}
+	return cloudConfigHeader + "\n" + string(data), nil
+}
+
+// mergeCloudConfig merges two cloud-config documents. Lists such as packages, runcmd or
+// ssh_authorized_keys are concatenated; any other key set to different values in both is an error.
+func mergeCloudConfig(base, extra string) (string, error) {
+	var merged, add map[string]any
+	for _, doc := range []struct {
+		text string
+		into *map[string]any
+	}{{base, &merged}, {extra, &add}} {
+		if !strings.HasPrefix(strings.TrimSpace(doc.text), cloudConfigHeader) {
+			return "", fmt.Errorf("user data is not a #cloud-config document and cannot be combined with other first-boot settings")
+		}
+		if err := yaml.Unmarshal([]byte(doc.text), doc.into); err != nil {
+			return "", fmt.Errorf("failed to parse cloud-config: %w", err)
+		}
+	}
+	if merged == nil {
+		merged = make(map[string]any)
+	}
+	for key, value := range add {
+		existing, ok := merged[key]
+		if !ok {
+			merged[key] = value
+			continue
+		}
+		existingList, isList := existing.([]any)
+		valueList, valueIsList := value.([]any)
+		switch {
+		case isList && valueIsList:
+			merged[key] = append(existingList, valueList...)
+		case !reflect.DeepEqual(existing, value):
+			return "", fmt.Errorf("cloud-config key %s is set twice with different values", key)
+		}
+	}
+	data, err := yaml.Marshal(merged)
+	if err != nil {
+		return "", err
+	}
+	return cloudConfigHeader + "\n" + string(data), nil
+}
+
+// cloudInitSource returns the cloudInitNoCloud source of vm, adding the cloud-init disk and
+// volume when missing.
+func cloudInitSource(vm *kubevirtv1.VirtualMachine) *kubevirtv1.CloudInitNoCloudSource {
+	spec := &vm.Spec.Template.Spec
+	for i := range spec.Volumes {
+		if spec.Volumes[i].Name == cloudInitVolume && spec.Volumes[i].CloudInitNoCloud != nil {
+			return spec.Volumes[i].CloudInitNoCloud
+		}
+	}
+	spec.Domain.Devices.Disks = append(spec.Domain.Devices.Disks, kubevirtv1.Disk{
+		Name: cloudInitVolume,
+		DiskDevice: kubevirtv1.DiskDevice{
+			Disk: &kubevirtv1.DiskTarget{Bus: "virtio"},
+		},
+	})
+	spec.Volumes = append(spec.Volumes, kubevirtv1.Volume{
+		Name:         cloudInitVolume,
+		VolumeSource: kubevirtv1.VolumeSource{CloudInitNoCloud: &kubevirtv1.CloudInitNoCloudSource{}},
+	})
+	return spec.Volumes[len(spec.Volumes)-1].CloudInitNoCloud
+}
+
+// AttachCloudInitUserData adds a cloudInitNoCloud volume carrying userData, and its disk, to vm.
+// When vm already has cloud-init user data, both are merged as cloud-config documents.
+func AttachCloudInitUserData(vm *kubevirtv1.VirtualMachine, userData string) error {
+	source := cloudInitSource(vm)
+	if source.UserData == "" {
+		source.UserData = userData
+		return nil
+	}
+	merged, err := mergeCloudConfig(source.UserData, userData)
+	if err != nil {
+		return err
+	}
+	source.UserData = merged
+	return nil
+}
+
+// AttachCloudInitNetworkData sets the cloud-init network configuration (version 1 or 2) of vm.
+func AttachCloudInitNetworkData(vm *kubevirtv1.VirtualMachine, networkData string) error {
+	source := cloudInitSource(vm)
+	if source.NetworkData != "" {
+		return fmt.Errorf("cloud-init network data is already set")
+	}
+	source.NetworkData = networkData
+	return nil
+}
+
+// MoveLargeCloudInitToSecret moves cloud-init user and network data exceeding what KubeVirt
+// accepts inline into a Secret named <vm>-cloudinit and references it from the volume.
+// It returns the Secret to create alongside the VM, nil when everything fits inline.
+func MoveLargeCloudInitToSecret(vm *kubevirtv1.VirtualMachine) *corev1.Secret {
+	var source *kubevirtv1.CloudInitNoCloudSource
+	for i := range vm.Spec.Template.Spec.Volumes {
+		if vm.Spec.Template.Spec.Volumes[i].Name == cloudInitVolume {
+			source = vm.Spec.Template.Spec.Volumes[i].CloudInitNoCloud
+		}
+	}
+	if source == nil || (len(source.UserData) <= cloudInitInlineLimit && len(source.NetworkData) <= cloudInitInlineLimit) {
+		return nil
+	}
+
+	secret := &corev1.Secret{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      vm.Name + "-cloudinit",
+			Namespace: vm.Namespace,
+			Labels:    map[string]string{kubevirtv1.AppLabel: vm.Name},
+		},
+		StringData: map[string]string{"userdata": source.UserData},
+	}
+	source.UserDataSecretRef = &corev1.LocalObjectReference{Name: secret.Name}
+	source.UserData = ""
+	if source.NetworkData != "" {
+		secret.StringData["networkdata"] = source.NetworkData
+		source.NetworkDataSecretRef = &corev1.LocalObjectReference{Name: secret.Name}
+		source.NetworkData = ""
+	}
+	return secret
+}
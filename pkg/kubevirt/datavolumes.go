@@ -0,0 +1,144 @@
+package kubevirt
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	"vmx2vmi/pkg/transfer"
+	"vmx2vmi/pkg/vmx"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+	cdiv1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
+)
+
+// HTTPSource describes where CDI downloads the VMDKs from with its HTTP source.
+type HTTPSource struct {
+	// BaseURL is the URL of the directory serving the disk files; each disk is fetched from
+	// BaseURL/<file name>.
+	BaseURL string
+	// SecretRef names the Secret holding the basic auth user (accessKeyId) and password (secretKey), empty for none.
+	SecretRef string
+	// CertConfigMap names the ConfigMap holding the CA bundle of the server, empty to use the system roots.
+	CertConfigMap string
+}
+
+// ImportedDisk records a DataVolume template generated for a VMX disk.
+type ImportedDisk struct {
+	DiskID     string // VMX device identifier, e.g. scsi0:1
+	DataVolume string
+	Source     string // vddk, http, upload, or blank for blank OVF disks
+}
+
+// importSource returns the CDI source importing a VMX disk.
+type importSource func(d vmx.Disk) (*cdiv1.DataVolumeSource, error)
+
+// ApplyHTTPSource replaces the PVCs of the regular disks with DataVolume templates downloading
+// each VMDK from src.BaseURL. CDI converts the VMDK while importing, which requires a
+// single-file (monolithic or streamOptimized) disk.
+func ApplyHTTPSource(vm *kubevirtv1.VirtualMachine, vmxConfig *vmx.VMXConfig, src HTTPSource, storage StorageOptions) ([]ImportedDisk, error) {
+	base, err := url.Parse(src.BaseURL)
+	if err != nil || base.Scheme == "" || base.Host == "" {
+		return nil, fmt.Errorf("invalid HTTP base URL '%s'", src.BaseURL)
+	}
+	return applyDataVolumeTemplates(vm, vmxConfig, "http", storage, func(d vmx.Disk) (*cdiv1.DataVolumeSource, error) {
+		if d.Descriptor != nil && len(d.Descriptor.Extents) > 1 {
+			return nil, fmt.Errorf("disk %s (%s) has %d extent files, CDI can only import a single-file VMDK over HTTP; convert it with convert-disk first",
+				d.ID(), d.FileName, len(d.Descriptor.Extents))
+		}
+		fileURL := base.JoinPath(path.Base(strings.ReplaceAll(d.FileName, "\\", "/")))
+		return &cdiv1.DataVolumeSource{
+			HTTP: &cdiv1.DataVolumeSourceHTTP{
+				URL:           fileURL.String(),
+				SecretRef:     src.SecretRef,
+				CertConfigMap: src.CertConfigMap,
+			},
+		}, nil
+	})
+}
+
+// ApplyUploadSource replaces the PVCs of the regular disks with upload DataVolume templates,
+// to be filled with upload-disk once the VM manifest is applied.
+func ApplyUploadSource(vm *kubevirtv1.VirtualMachine, vmxConfig *vmx.VMXConfig, storage StorageOptions) ([]ImportedDisk, error) {
+	return applyDataVolumeTemplates(vm, vmxConfig, "upload", storage, func(vmx.Disk) (*cdiv1.DataVolumeSource, error) {
+		return &cdiv1.DataVolumeSource{Upload: &cdiv1.DataVolumeSourceUpload{}}, nil
+	})
+}
+
+// applyDataVolumeTemplates turns the PVC volume of every regular disk into a DataVolume of the same
+// name, created from a template importing the disk with source, sized from the VMDK capacity and
+// placed according to storage.
+// Shared disks and raw device mappings keep their existing claims.
+func applyDataVolumeTemplates(vm *kubevirtv1.VirtualMachine, vmxConfig *vmx.VMXConfig, kind string, storage StorageOptions, source importSource) ([]ImportedDisk, error) {
+	primary, ok := primaryDisk(vmxConfig.Disks)
+	if !ok {
+		return nil, fmt.Errorf("the VM has no disk to import")
+	}
+
+	spec := &vm.Spec.Template.Spec
+	var imported []ImportedDisk
+	for _, d := range vmxConfig.Disks {
+		if d.RawDeviceMapping != "" || (d.Shared() && d.ID() != primary.ID()) {
+			continue
+		}
+		name := diskName(d, primary)
+		var volume *kubevirtv1.Volume
+		for i := range spec.Volumes {
+			if spec.Volumes[i].Name == name && spec.Volumes[i].PersistentVolumeClaim != nil {
+				volume = &spec.Volumes[i]
+			}
+		}
+		if volume == nil {
+			return nil, fmt.Errorf("the VM has no %s PVC volume to replace", name)
+		}
+		if d.CapacityBytes == 0 {
+			return nil, fmt.Errorf("size of disk %s (%s) is unknown, its descriptor must be readable to size the DataVolume", d.ID(), d.FileName)
+		}
+		// Blank disks of an OVF have no data to import.
+		diskKind := "blank"
+		dvSource := &cdiv1.DataVolumeSource{Blank: &cdiv1.DataVolumeBlankImage{}}
+		if d.Provisioning != "blank" {
+			diskKind = kind
+			var err error
+			if dvSource, err = source(d); err != nil {
+				return nil, err
+			}
+		}
+
+		dvName := volume.PersistentVolumeClaim.ClaimName
+		volume.VolumeSource = kubevirtv1.VolumeSource{DataVolume: &kubevirtv1.DataVolumeSource{Name: dvName}}
+		template := kubevirtv1.DataVolumeTemplateSpec{
+			ObjectMeta: metav1.ObjectMeta{Name: dvName},
+			Spec: cdiv1.DataVolumeSpec{
+				Source: dvSource,
+				Storage: &cdiv1.StorageSpec{
+					Resources: corev1.VolumeResourceRequirements{
+						Requests: corev1.ResourceList{
+							corev1.ResourceStorage: *resource.NewQuantity(int64(d.CapacityBytes), resource.BinarySI),
+						},
+					},
+				},
+			},
+		}
+		target := storage.forDisk(d)
+		if target.StorageClass != "" {
+			template.Spec.Storage.StorageClassName = Ptr(target.StorageClass)
+		}
+		if target.VolumeMode != "" {
+			template.Spec.Storage.VolumeMode = Ptr(target.VolumeMode)
+		}
+		if target.AccessMode != "" {
+			template.Spec.Storage.AccessModes = []corev1.PersistentVolumeAccessMode{target.AccessMode}
+		}
+		if dvSource.Upload != nil {
+			template.Annotations = map[string]string{transfer.BindImmediateAnnotation: "true"}
+		}
+		vm.Spec.DataVolumeTemplates = append(vm.Spec.DataVolumeTemplates, template)
+		imported = append(imported, ImportedDisk{DiskID: d.ID(), DataVolume: dvName, Source: diskKind})
+	}
+	return imported, nil
+}
@@ -0,0 +1,84 @@
+package kubevirt
+
+import (
+	"fmt"
+	"strings"
+
+	"vmx2vmi/pkg/vmx"
+
+	corev1 "k8s.io/api/core/v1"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+// FilesystemDefinition is a virtiofs filesystem shared with the guest together with the volume backing it.
+type FilesystemDefinition struct {
+	Name         string
+	VolumeSource kubevirtv1.VolumeSource
+}
+
+// ParseDeviceRequest parses a -gpu or -host-device value, <deviceName> or <name>=<deviceName>, where
+// deviceName is the resource advertised by the device plugin, e.g. nvidia.com/TU104GL_Tesla_T4.
+// The name is empty when not given.
+func ParseDeviceRequest(value string) (name string, deviceName string, err error) {
+	name, deviceName, ok := strings.Cut(value, "=")
+	if !ok {
+		name, deviceName = "", value
+	}
+	if deviceName == "" || (ok && SanitizeName(name) != name) {
+		return "", "", fmt.Errorf("invalid device request '%s': expected <deviceName> or <name>=<deviceName> with a lower case name", value)
+	}
+	return name, deviceName, nil
+}
+
+// ParseFilesystem parses a -filesystem value of the form <name>=pvc:<claim>, <name>=configmap:<name>
+// or <name>=secret:<name>.
+func ParseFilesystem(value string) (FilesystemDefinition, error) {
+	name, target, ok := strings.Cut(value, "=")
+	if !ok || name == "" || SanitizeName(name) != name {
+		return FilesystemDefinition{}, fmt.Errorf("invalid filesystem '%s': expected <name>=pvc:<claim>, <name>=configmap:<name> or <name>=secret:<name>", value)
+	}
+	kind, ref, ok := strings.Cut(target, ":")
+	if !ok || ref == "" {
+		return FilesystemDefinition{}, fmt.Errorf("invalid filesystem source '%s': expected pvc:<claim>, configmap:<name> or secret:<name>", target)
+	}
+	def := FilesystemDefinition{Name: name}
+	switch strings.ToLower(kind) {
+	case "pvc":
+		def.VolumeSource = claimSource(ref)
+	case "configmap":
+		def.VolumeSource = kubevirtv1.VolumeSource{ConfigMap: &kubevirtv1.ConfigMapVolumeSource{
+			LocalObjectReference: corev1.LocalObjectReference{Name: ref},
+		}}
+	case "secret":
+		def.VolumeSource = kubevirtv1.VolumeSource{Secret: &kubevirtv1.SecretVolumeSource{SecretName: ref}}
+	default:
+		return FilesystemDefinition{}, fmt.Errorf("invalid filesystem source kind '%s': must be pvc, configmap or secret", kind)
+	}
+	return def, nil
+}
+
+// TabletInput returns a USB tablet, which gives VNC consoles an absolute pointer so the mouse
+// follows the cursor, as the VMware console does.
+func TabletInput() kubevirtv1.Input {
+	return kubevirtv1.Input{Name: "tablet", Type: kubevirtv1.InputTypeTablet, Bus: kubevirtv1.InputBusUSB}
+}
+
+// applyAutoattach sets the autoattach switches of devices from opts. Unset switches follow the
+// VMX: a VM without SVGA adapter (svga.present = FALSE) is headless and gets no graphics device,
+// and a VM with ballooning disabled (sched.mem.maxmemctl = 0) gets no memory balloon. Otherwise
+// the KubeVirt defaults apply.
+func applyAutoattach(devices *kubevirtv1.Devices, vmxConfig *vmx.VMXConfig, opts VMOptions) {
+	devices.AutoattachGraphicsDevice = opts.AutoattachGraphicsDevice
+	if devices.AutoattachGraphicsDevice == nil {
+		if present, ok := vmxConfig.GetBool("svga.present"); ok && !present {
+			devices.AutoattachGraphicsDevice = Ptr(false)
+		}
+	}
+	devices.AutoattachSerialConsole = opts.AutoattachSerialConsole
+	devices.AutoattachMemBalloon = opts.AutoattachMemBalloon
+	if devices.AutoattachMemBalloon == nil {
+		if maxBalloon, ok := vmxConfig.GetInt("sched.mem.maxmemctl"); ok && maxBalloon == 0 {
+			devices.AutoattachMemBalloon = Ptr(false)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package kubevirt
+
+import (
+	"fmt"
+	"maps"
+	"sort"
+	"strings"
+
+	"vmx2vmi/pkg/vmx"
+
+	corev1 "k8s.io/api/core/v1"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+// DiskDefinition is a disk of the generated VirtualMachine together with the volume backing it.
+type DiskDefinition struct {
+	Name string
+	// SourceID is the VMX device identifier the disk was converted from, e.g. scsi0:1. Empty when
+	// the disk has no VMX counterpart.
+	SourceID string
+	Bus      kubevirtv1.DiskBus
+	// BootOrder is the disk's position in the boot order, 0 for disks the VM does not boot from.
+	BootOrder    uint
+	VolumeSource kubevirtv1.VolumeSource
+}
+
+// ParseDiskMapping parses a -disk-map value of the form <disk>=<claim>.
+func ParseDiskMapping(value string) (diskID string, claimName string, err error) {
+	diskID, claimName, ok := strings.Cut(value, "=")
+	if !ok || diskID == "" || claimName == "" {
+		return "", "", fmt.Errorf("invalid disk mapping '%s': expected <disk>=<claim>", value)
+	}
+	return strings.ToLower(diskID), claimName, nil
+}
+
+// diskBuses are the buses -disk-bus accepts.
+var diskBuses = []kubevirtv1.DiskBus{kubevirtv1.DiskBusVirtio, kubevirtv1.DiskBusSCSI, kubevirtv1.DiskBusSATA}
+
+// ParseDiskBus parses a -disk-bus value, <bus> for every disk or <disk>=<bus>.
+func ParseDiskBus(value string) (diskID string, bus kubevirtv1.DiskBus, err error) {
+	diskID, name, ok := strings.Cut(value, "=")
+	if !ok {
+		diskID, name = "", value
+	}
+	for _, b := range diskBuses {
+		if kubevirtv1.DiskBus(name) == b {
+			return strings.ToLower(diskID), b, nil
+		}
+	}
+	return "", "", fmt.Errorf("invalid disk bus '%s': must be virtio, scsi or sata", name)
+}
+
+// DefaultDiskBus picks the bus closest to the VMware controller of d that the guest can boot
+// from without extra drivers. SCSI disks stay on SCSI, SATA and IDE disks move to SATA, and NVMe
+// disks, which KubeVirt does not emulate, to virtio. Windows has no inbox driver for virtio-blk
+// nor virtio-scsi, so its disks go to SATA whatever their controller.
+func DefaultDiskBus(d vmx.Disk, guestFamily string) kubevirtv1.DiskBus {
+	if guestFamily == "windows" {
+		return kubevirtv1.DiskBusSATA
+	}
+	switch d.Bus {
+	case "scsi":
+		return kubevirtv1.DiskBusSCSI
+	case "sata", "ide":
+		return kubevirtv1.DiskBusSATA
+	}
+	return kubevirtv1.DiskBusVirtio
+}
+
+// DiskDefinitions derives the regular disks of the VM from the VMX, in controller/unit order.
+// The primary disk becomes disk0, boots first and uses pvcName. Every other disk is a data disk
+// backed by the claim given for its device in claims, or <pvcName>-<disk name> by default.
+// Each disk takes the bus given for its device in buses, else the one given for every disk under
+// the empty key, else DefaultDiskBus. Raw device mappings and shared disks are left to
+// AttachRawDeviceMappings and AttachSharedDisks. A VMX without a usable disk still yields disk0
+// so the VM has something to boot from. Neither claims nor buses are modified.
+func DiskDefinitions(vmxConfig *vmx.VMXConfig, pvcName string, claims map[string]string, buses map[string]kubevirtv1.DiskBus) ([]DiskDefinition, error) {
+	family := vmxConfig.GuestOSFamily()
+	busOf := func(d vmx.Disk) kubevirtv1.DiskBus {
+		if bus, ok := buses[d.ID()]; ok {
+			return bus
+		}
+		if bus, ok := buses[""]; ok {
+			return bus
+		}
+		return DefaultDiskBus(d, family)
+	}
+	primary, hasPrimary := primaryDisk(vmxConfig.Disks)
+	if !hasPrimary {
+		return []DiskDefinition{{Name: "disk0", Bus: busOf(vmx.Disk{}), BootOrder: 1, VolumeSource: claimSource(pvcName)}}, nil
+	}
+
+	// The claims and buses left once every disk took its own are given for slots without a disk.
+	claims = maps.Clone(claims)
+	unused := maps.Clone(buses)
+	delete(unused, "")
+	var defs []DiskDefinition
+	for _, d := range vmxConfig.Disks {
+		if d.RawDeviceMapping != "" || (d.Shared() && d.ID() != primary.ID()) {
+			continue
+		}
+		def := DiskDefinition{
+			Name:     diskName(d, primary),
+			SourceID: d.ID(),
+			Bus:      busOf(d),
+		}
+		delete(unused, d.ID())
+		claimName, mapped := claims[d.ID()]
+		delete(claims, d.ID())
+		if d.ID() == primary.ID() {
+			if mapped {
+				return nil, fmt.Errorf("disk %s is the primary disk, its claim is set with -pvc", d.ID())
+			}
+			def.BootOrder = 1
+			claimName = pvcName
+		} else if !mapped {
+			claimName = pvcName + "-" + def.Name
+		}
+		def.VolumeSource = claimSource(claimName)
+		defs = append(defs, def)
+	}
+
+	for diskID := range claims {
+		return nil, fmt.Errorf("disk mapping given for %s, but the VMX has no regular disk at that slot", diskID)
+	}
+	for diskID := range unused {
+		return nil, fmt.Errorf("disk bus given for %s, but the VMX has no regular disk at that slot", diskID)
+	}
+	return defs, nil
+}
+
+// claimSource returns a volume source referencing an existing PVC.
+func claimSource(claimName string) kubevirtv1.VolumeSource {
+	return kubevirtv1.VolumeSource{
+		PersistentVolumeClaim: &kubevirtv1.PersistentVolumeClaimVolumeSource{
+			PersistentVolumeClaimVolumeSource: corev1.PersistentVolumeClaimVolumeSource{
+				ClaimName: claimName,
+			},
+		},
+	}
+}
+
+// OrderDisks sorts the disks and volumes of vm in VMX controller/unit order, so disks appended
+// later by AttachRawDeviceMappings and AttachSharedDisks take the slot they had in the source VM.
+// Disks without a VMX counterpart, such as cloud-init disks, keep their relative order at the end.
+func OrderDisks(vm *kubevirtv1.VirtualMachine, disks []vmx.Disk) {
+	primary, _ := primaryDisk(disks)
+	rank := make(map[string]int, len(disks))
+	for i, d := range disks {
+		rank[diskName(d, primary)] = i
+	}
+	position := func(name string) int {
+		if i, ok := rank[name]; ok {
+			return i
+		}
+		return len(disks)
+	}
+
+	spec := &vm.Spec.Template.Spec
+	sort.SliceStable(spec.Domain.Devices.Disks, func(i, j int) bool {
+		return position(spec.Domain.Devices.Disks[i].Name) < position(spec.Domain.Devices.Disks[j].Name)
+	})
+	sort.SliceStable(spec.Volumes, func(i, j int) bool {
+		return position(spec.Volumes[i].Name) < position(spec.Volumes[j].Name)
+	})
+}
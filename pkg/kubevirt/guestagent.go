@@ -0,0 +1,61 @@
+package kubevirt
+
+import (
+	"fmt"
+
+	"vmx2vmi/pkg/vmx"
+
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+// GuestAgentAnnotation tells operators whether the guest needs qemu-guest-agent installed.
+const GuestAgentAnnotation = "vmx2vmi.beezy.dev/guest-agent"
+
+// guestAgentUserData installs qemu-guest-agent on first boot and stops open-vm-tools, which
+// only spins and logs errors outside of VMware.
+const guestAgentUserData = `#cloud-config
+packages:
+  - qemu-guest-agent
+runcmd:
+  - [sh, -c, "systemctl disable --now vmtoolsd.service open-vm-tools.service 2>/dev/null || true"]
+  - [systemctl, enable, --now, qemu-guest-agent.service]
+`
+
+// GuestAgentGuidance returns a short recommendation about the guest agent for the VM's guest OS.
+// Removing VMware Tools is only advised when the VMX shows they are installed.
+func GuestAgentGuidance(vmxConfig *vmx.VMXConfig) string {
+	if !vmxConfig.ToolsDetected {
+		switch vmxConfig.GuestOSFamily() {
+		case "linux":
+			return "VMware Tools not detected; install qemu-guest-agent"
+		case "windows":
+			return "VMware Tools not detected; install the virtio-win guest tools (qemu-ga and drivers)"
+		}
+		return fmt.Sprintf("VMware Tools not detected; check whether a QEMU guest agent exists for guest OS '%s'", vmxConfig.GuestOS)
+	}
+	switch vmxConfig.GuestOSFamily() {
+	case "linux":
+		return "VMware Tools detected; install qemu-guest-agent and remove open-vm-tools"
+	case "windows":
+		return "VMware Tools detected; install the virtio-win guest tools (qemu-ga and drivers) and uninstall VMware Tools"
+	}
+	return fmt.Sprintf("VMware Tools detected; check whether a QEMU guest agent exists for guest OS '%s' and remove VMware Tools", vmxConfig.GuestOS)
+}
+
+// ApplyGuestAgentGuidance annotates vm with the guest agent recommendation and, when inject is set and
+// the guest is Linux, attaches a cloud-init disk installing qemu-guest-agent on first boot, merged
+// with any user data already attached. It returns whether the cloud-init user data was added.
+func ApplyGuestAgentGuidance(vm *kubevirtv1.VirtualMachine, vmxConfig *vmx.VMXConfig, inject bool) (bool, error) {
+	if vm.Annotations == nil {
+		vm.Annotations = make(map[string]string)
+	}
+	vm.Annotations[GuestAgentAnnotation] = GuestAgentGuidance(vmxConfig)
+
+	if !inject || vmxConfig.GuestOSFamily() != "linux" {
+		return false, nil
+	}
+	if err := AttachCloudInitUserData(vm, guestAgentUserData); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,69 @@
+package kubevirt
+
+import (
+	"strings"
+
+	"vmx2vmi/pkg/vmx"
+
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+// spinlockRetries is the number of spinlock attempts before Windows notifies the hypervisor,
+// the value used by the KubeVirt common templates.
+const spinlockRetries = 8191
+
+// windowsSupportsHyperv reports whether the guest is a Windows release that uses Hyper-V
+// enlightenments, Vista and Server 2008 or later.
+func windowsSupportsHyperv(vmxConfig *vmx.VMXConfig) bool {
+	if vmxConfig.GuestOSFamily() != "windows" {
+		return false
+	}
+	guest := strings.ToLower(vmxConfig.GuestOS)
+	for _, prefix := range legacyGuestPrefixes {
+		if strings.HasPrefix(guest, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// ApplyWindowsFeatures gives Windows guests the Hyper-V enlightenments and timer settings of the
+// KubeVirt common templates: without them Windows busy-waits on spinlocks, takes a VM exit for
+// every APIC access and loses time under load. The frequencies and reenlightenment
+// enlightenments are left out, as they restrict live migration to nodes with the same TSC
+// frequency. Other guests, and Windows releases older than Vista, are left unchanged.
+// It returns a description of the applied settings, for the conversion report.
+func ApplyWindowsFeatures(vm *kubevirtv1.VirtualMachine, vmxConfig *vmx.VMXConfig) []string {
+	if !windowsSupportsHyperv(vmxConfig) {
+		return nil
+	}
+	enabled := &kubevirtv1.FeatureState{}
+	domain := &vm.Spec.Template.Spec.Domain
+	if domain.Features == nil {
+		domain.Features = &kubevirtv1.Features{}
+	}
+	domain.Features.ACPI = kubevirtv1.FeatureState{}
+	domain.Features.APIC = &kubevirtv1.FeatureAPIC{}
+	domain.Features.Hyperv = &kubevirtv1.FeatureHyperv{
+		Relaxed:    enabled,
+		VAPIC:      enabled,
+		VPIndex:    enabled,
+		Spinlocks:  &kubevirtv1.FeatureSpinlocks{Retries: Ptr(uint32(spinlockRetries))},
+		SyNIC:      enabled,
+		SyNICTimer: &kubevirtv1.SyNICTimer{Direct: enabled},
+		TLBFlush:   enabled,
+		IPI:        enabled,
+		Runtime:    enabled,
+		Reset:      enabled,
+	}
+	domain.Clock = &kubevirtv1.Clock{
+		ClockOffset: kubevirtv1.ClockOffset{UTC: &kubevirtv1.ClockOffsetUTC{}},
+		Timer: &kubevirtv1.Timer{
+			HPET:   &kubevirtv1.HPETTimer{Enabled: Ptr(false)},
+			PIT:    &kubevirtv1.PITTimer{TickPolicy: kubevirtv1.PITTickPolicyDelay},
+			RTC:    &kubevirtv1.RTCTimer{TickPolicy: kubevirtv1.RTCTickPolicyCatchup},
+			Hyperv: &kubevirtv1.HypervTimer{},
+		},
+	}
+	return []string{"guestOS=" + vmxConfig.GuestOS + " -> Hyper-V enlightenments (relaxed, vapic, vpindex, spinlocks, synic, stimer, tlbflush, ipi, runtime, reset) and Hyper-V clock, HPET off"}
+}
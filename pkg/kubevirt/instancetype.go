@@ -0,0 +1,146 @@
+package kubevirt
+
+import (
+	"fmt"
+	"math"
+
+	"vmx2vmi/pkg/vmx"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+	instancetypev1beta1 "kubevirt.io/api/instancetype/v1beta1"
+)
+
+// u1Instancetypes is the "universal" series of the KubeVirt common-instancetypes, deployed
+// cluster-wide by virt-operator. It only sets vCPUs and memory.
+var u1Instancetypes = []struct {
+	name      string
+	vcpus     uint32
+	memoryMiB int64
+}{
+	{"u1.nano", 1, 512},
+	{"u1.micro", 1, 1024},
+	{"u1.small", 1, 2048},
+	{"u1.medium", 1, 4096},
+	{"u1.2xmedium", 2, 4096},
+	{"u1.large", 2, 8192},
+	{"u1.xlarge", 4, 16384},
+	{"u1.2xlarge", 8, 32768},
+	{"u1.4xlarge", 16, 65536},
+	{"u1.8xlarge", 32, 131072},
+}
+
+// ApplyInstancetype moves the CPU and memory sizing of vm into an instancetype and describes its
+// firmware, CPU topology and device defaults in a preference, and references both from the VM.
+// The firmware ApplyMachine set stays on the VM, which takes precedence over the preference.
+// VMs matching a u1 common instancetype exactly reference the cluster-wide one; otherwise, or when
+// dedicated CPUs, a CPU model or memory overcommit are requested, a VirtualMachineInstancetype
+// named after the VM is generated. The preference is always generated
+// from the VMX, its disk bus and interface model being those of the boot disk and first
+// interface of vm, so that devices added later get what the guest drives. It returns the
+// manifests to create alongside the VM and what was mapped.
+func ApplyInstancetype(vm *kubevirtv1.VirtualMachine, vmxConfig *vmx.VMXConfig) ([]runtime.Object, []string, error) {
+	domain := &vm.Spec.Template.Spec.Domain
+	if domain.CPU == nil || domain.Memory == nil || domain.Memory.Guest == nil {
+		return nil, nil, fmt.Errorf("the VM has no CPU and memory sizing to move into an instancetype")
+	}
+	vcpus := vmxConfig.NumVCPUs
+	memory := *domain.Memory.Guest
+	dedicated := domain.CPU.DedicatedCPUPlacement
+	model := domain.CPU.Model
+	// A memory request below the guest memory becomes the overcommit percentage of the instancetype.
+	overcommitPercent := 0
+	if request, ok := domain.Resources.Requests[corev1.ResourceMemory]; ok && request.Cmp(memory) < 0 {
+		overcommitPercent = int(math.Round(100 * (1 - request.AsApproximateFloat64()/memory.AsApproximateFloat64())))
+		delete(domain.Resources.Requests, corev1.ResourceMemory)
+	}
+
+	var objects []runtime.Object
+	var mappings []string
+	match := ""
+	if !dedicated && model == "" && overcommitPercent == 0 {
+		for _, it := range u1Instancetypes {
+			if it.vcpus == vcpus && it.memoryMiB == vmxConfig.MemoryMiB {
+				match = it.name
+			}
+		}
+	}
+	if match != "" {
+		vm.Spec.Instancetype = &kubevirtv1.InstancetypeMatcher{Kind: "VirtualMachineClusterInstancetype", Name: match}
+		mappings = append(mappings, fmt.Sprintf("%d vCPUs, %d MiB -> common instancetype %s", vcpus, vmxConfig.MemoryMiB, match))
+	} else {
+		instancetype := &instancetypev1beta1.VirtualMachineInstancetype{
+			TypeMeta:   metav1.TypeMeta{APIVersion: instancetypev1beta1.SchemeGroupVersion.String(), Kind: "VirtualMachineInstancetype"},
+			ObjectMeta: metav1.ObjectMeta{Name: vm.Name, Namespace: vm.Namespace},
+			Spec: instancetypev1beta1.VirtualMachineInstancetypeSpec{
+				CPU:    instancetypev1beta1.CPUInstancetype{Guest: vcpus},
+				Memory: instancetypev1beta1.MemoryInstancetype{Guest: memory},
+			},
+		}
+		if dedicated {
+			instancetype.Spec.CPU.DedicatedCPUPlacement = Ptr(true)
+		}
+		if model != "" {
+			instancetype.Spec.CPU.Model = Ptr(model)
+		}
+		instancetype.Spec.Memory.OvercommitPercent = overcommitPercent
+		objects = append(objects, instancetype)
+		vm.Spec.Instancetype = &kubevirtv1.InstancetypeMatcher{Kind: "VirtualMachineInstancetype", Name: vm.Name}
+		mappings = append(mappings, fmt.Sprintf("%d vCPUs, %d MiB -> VirtualMachineInstancetype %s", vcpus, vmxConfig.MemoryMiB, vm.Name))
+	}
+
+	preference := &instancetypev1beta1.VirtualMachinePreference{
+		TypeMeta:   metav1.TypeMeta{APIVersion: instancetypev1beta1.SchemeGroupVersion.String(), Kind: "VirtualMachinePreference"},
+		ObjectMeta: metav1.ObjectMeta{Name: vm.Name, Namespace: vm.Namespace},
+		Spec: instancetypev1beta1.VirtualMachinePreferenceSpec{
+			CPU: &instancetypev1beta1.CPUPreferences{PreferredCPUTopology: Ptr(instancetypev1beta1.Cores)},
+			Devices: &instancetypev1beta1.DevicePreferences{
+				PreferredDiskBus:        preferredDiskBus(vm, vmxConfig),
+				PreferredInterfaceModel: preferredInterfaceModel(vm, vmxConfig),
+			},
+		},
+	}
+	if vmxConfig.Firmware == "efi" {
+		preference.Spec.Firmware = &instancetypev1beta1.FirmwarePreferences{
+			PreferredEfi: &kubevirtv1.EFI{SecureBoot: Ptr(vmxConfig.SecureBoot)},
+		}
+		if vmxConfig.SecureBoot {
+			// Secure boot firmware only runs with SMM enabled.
+			preference.Spec.Features = &instancetypev1beta1.FeaturePreferences{PreferredSmm: &kubevirtv1.FeatureState{}}
+		}
+		mappings = append(mappings, fmt.Sprintf("firmware=efi, secure boot %t -> VirtualMachinePreference %s", vmxConfig.SecureBoot, vm.Name))
+	} else {
+		preference.Spec.Firmware = &instancetypev1beta1.FirmwarePreferences{PreferredUseBios: Ptr(true)}
+	}
+	objects = append(objects, preference)
+	vm.Spec.Preference = &kubevirtv1.PreferenceMatcher{Kind: "VirtualMachinePreference", Name: vm.Name}
+
+	// KubeVirt rejects VMs setting fields an instancetype also provides.
+	domain.CPU = nil
+	domain.Memory = nil
+	return objects, mappings, nil
+}
+
+// preferredDiskBus returns the bus of the disk vm boots from, or DefaultDiskBus for the guest
+// when it has none.
+func preferredDiskBus(vm *kubevirtv1.VirtualMachine, vmxConfig *vmx.VMXConfig) kubevirtv1.DiskBus {
+	for _, disk := range vm.Spec.Template.Spec.Domain.Devices.Disks {
+		if disk.BootOrder != nil && *disk.BootOrder == 1 && disk.Disk != nil && disk.Disk.Bus != "" {
+			return disk.Disk.Bus
+		}
+	}
+	return DefaultDiskBus(vmx.Disk{}, vmxConfig.GuestOSFamily())
+}
+
+// preferredInterfaceModel returns the model of the first interface of vm, or DefaultNICModel
+// for the guest when it has none.
+func preferredInterfaceModel(vm *kubevirtv1.VirtualMachine, vmxConfig *vmx.VMXConfig) string {
+	for _, iface := range vm.Spec.Template.Spec.Domain.Devices.Interfaces {
+		if iface.Model != "" {
+			return iface.Model
+		}
+	}
+	return DefaultNICModel(vmx.NIC{}, vmxConfig.GuestOSFamily())
+}
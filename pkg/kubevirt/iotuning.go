@@ -0,0 +1,147 @@
+package kubevirt
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"vmx2vmi/pkg/vmx"
+
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+// IOTuningOptions configures the I/O threads and queues of the VM and the cache and I/O
+// mode of individual disks. The zero value leaves the KubeVirt defaults.
+type IOTuningOptions struct {
+	// ThreadsPolicy is shared, auto or supplementalPool, empty to disable IOThreads.
+	ThreadsPolicy kubevirtv1.IOThreadsPolicy
+	// SupplementalPoolThreads is the number of IOThreads of the supplementalPool policy.
+	SupplementalPoolThreads uint32
+	// BlockMultiQueue gives every virtio disk one queue per vCPU.
+	BlockMultiQueue bool
+	// Disks holds per-disk settings keyed by VMX device identifier, e.g. scsi0:1.
+	Disks map[string]DiskTuning
+}
+
+// DiskTuning holds the cache and I/O settings of a disk.
+type DiskTuning struct {
+	Cache             kubevirtv1.DriverCache
+	IO                kubevirtv1.DriverIO
+	DedicatedIOThread bool
+}
+
+// ParseIOThreadsPolicy validates a -io-threads-policy value.
+func ParseIOThreadsPolicy(value string) (kubevirtv1.IOThreadsPolicy, error) {
+	switch policy := kubevirtv1.IOThreadsPolicy(value); policy {
+	case kubevirtv1.IOThreadsPolicyShared, kubevirtv1.IOThreadsPolicyAuto, kubevirtv1.IOThreadsPolicySupplementalPool:
+		return policy, nil
+	}
+	return "", fmt.Errorf("invalid IOThreads policy '%s': must be shared, auto or supplementalPool", value)
+}
+
+// ParseDiskTuning parses a -disk-tuning value of the form <disk>=<setting>[,<setting>...], where
+// a setting is cache=none|writethrough, io=native|threads or dedicatedIOThread.
+func ParseDiskTuning(value string) (string, DiskTuning, error) {
+	diskID, settings, ok := strings.Cut(value, "=")
+	if !ok || diskID == "" || settings == "" {
+		return "", DiskTuning{}, fmt.Errorf("invalid disk tuning '%s': expected <disk>=cache=<mode>,io=<mode>,dedicatedIOThread", value)
+	}
+	var tuning DiskTuning
+	for _, setting := range strings.Split(settings, ",") {
+		key, mode, _ := strings.Cut(strings.TrimSpace(setting), "=")
+		switch key {
+		case "cache":
+			switch cache := kubevirtv1.DriverCache(mode); cache {
+			case kubevirtv1.CacheNone, kubevirtv1.CacheWriteThrough:
+				tuning.Cache = cache
+			default:
+				return "", DiskTuning{}, fmt.Errorf("invalid cache mode '%s' for %s: must be none or writethrough", mode, diskID)
+			}
+		case "io":
+			switch io := kubevirtv1.DriverIO(mode); io {
+			case kubevirtv1.IONative, kubevirtv1.IOThreads:
+				tuning.IO = io
+			default:
+				return "", DiskTuning{}, fmt.Errorf("invalid I/O mode '%s' for %s: must be native or threads", mode, diskID)
+			}
+		case "dedicatedIOThread":
+			tuning.DedicatedIOThread = true
+		default:
+			return "", DiskTuning{}, fmt.Errorf("invalid disk tuning setting '%s' for %s: must be cache=<mode>, io=<mode> or dedicatedIOThread", setting, diskID)
+		}
+	}
+	return strings.ToLower(diskID), tuning, nil
+}
+
+// ApplyIOTuning applies opts to vm. It fails on settings QEMU rejects, such as native I/O on a
+// host-cached disk, and on host caching of shared disks, which would corrupt data written by
+// the other cluster members. It returns a description of each setting applied, for the conversion report.
+func ApplyIOTuning(vm *kubevirtv1.VirtualMachine, vmxConfig *vmx.VMXConfig, opts IOTuningOptions) ([]string, error) {
+	var applied []string
+	domain := &vm.Spec.Template.Spec.Domain
+
+	if opts.ThreadsPolicy != "" {
+		domain.IOThreadsPolicy = Ptr(opts.ThreadsPolicy)
+		if opts.ThreadsPolicy == kubevirtv1.IOThreadsPolicySupplementalPool {
+			if opts.SupplementalPoolThreads == 0 {
+				return nil, fmt.Errorf("the supplementalPool IOThreads policy needs a thread count")
+			}
+			domain.IOThreads = &kubevirtv1.DiskIOThreads{SupplementalPoolThreadCount: Ptr(opts.SupplementalPoolThreads)}
+		}
+		applied = append(applied, fmt.Sprintf("ioThreadsPolicy %s", opts.ThreadsPolicy))
+	}
+	if opts.BlockMultiQueue {
+		domain.Devices.BlockMultiQueue = Ptr(true)
+		applied = append(applied, "blockMultiQueue")
+	}
+
+	primary, _ := primaryDisk(vmxConfig.Disks)
+	sources := make(map[string]vmx.Disk, len(vmxConfig.Disks))
+	for _, d := range vmxConfig.Disks {
+		sources[d.ID()] = d
+	}
+	diskIDs := make([]string, 0, len(opts.Disks))
+	for diskID := range opts.Disks {
+		diskIDs = append(diskIDs, diskID)
+	}
+	sort.Strings(diskIDs)
+	for _, diskID := range diskIDs {
+		tuning := opts.Disks[diskID]
+		source, ok := sources[diskID]
+		if !ok {
+			return nil, fmt.Errorf("disk tuning given for %s, but the VMX has no disk at that slot", diskID)
+		}
+		if source.Shared() && tuning.Cache != "" && tuning.Cache != kubevirtv1.CacheNone {
+			return nil, fmt.Errorf("disk %s is shared between VMs, it cannot use the %s host cache", diskID, tuning.Cache)
+		}
+		if tuning.IO == kubevirtv1.IONative && tuning.Cache != "" && tuning.Cache != kubevirtv1.CacheNone {
+			return nil, fmt.Errorf("disk %s: native I/O requires cache=none, got %s", diskID, tuning.Cache)
+		}
+
+		name := diskName(source, primary)
+		var disk *kubevirtv1.Disk
+		for i := range domain.Devices.Disks {
+			if domain.Devices.Disks[i].Name == name {
+				disk = &domain.Devices.Disks[i]
+			}
+		}
+		if disk == nil {
+			return nil, fmt.Errorf("disk %s is not attached to the VM", diskID)
+		}
+		var settings []string
+		if tuning.Cache != "" {
+			disk.Cache = tuning.Cache
+			settings = append(settings, "cache "+string(tuning.Cache))
+		}
+		if tuning.IO != "" {
+			disk.IO = tuning.IO
+			settings = append(settings, "io "+string(tuning.IO))
+		}
+		if tuning.DedicatedIOThread {
+			disk.DedicatedIOThread = Ptr(true)
+			settings = append(settings, "dedicated IOThread")
+		}
+		applied = append(applied, fmt.Sprintf("disk %s: %s", diskID, strings.Join(settings, ", ")))
+	}
+	return applied, nil
+}
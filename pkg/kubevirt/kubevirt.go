@@ -2,37 +2,96 @@ package kubevirt
 
 import (
 	"fmt"
+	"regexp"
 	"strings"
 
 	"vmx2vmi/pkg/vmx" // Assuming vmx package is in this path
 
-	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	kubevirtv1 "kubevirt.io/api/core/v1"
 )
 
+// SourceHashAnnotation records the sha256 of the VMX a manifest was generated from,
+// so a later run can tell whether the source drifted since the last conversion.
+const SourceHashAnnotation = "vmx2vmi.beezy.dev/source-vmx-sha256"
+
+// DisplayNameAnnotation keeps the VMX displayName verbatim when it had to be altered
+// to form a valid Kubernetes resource name.
+const DisplayNameAnnotation = "vmx2vmi.beezy.dev/display-name"
+
+// invalidNameChars matches runs of characters, dashes included, to be collapsed into a single dash.
+var invalidNameChars = regexp.MustCompile("[^a-z0-9]+")
+
+// SanitizeName turns name into a valid Kubernetes resource name (DNS label): lower case, with
+// anything outside the DNS label alphabet (spaces, underscores, quotes, non-ASCII characters
+// decoded from the VMX) collapsed into single dashes, and at most 63 characters.
+// It returns an empty string when nothing usable is left.
+func SanitizeName(name string) string {
+	name = invalidNameChars.ReplaceAllString(strings.ToLower(name), "-")
+	name = strings.Trim(name, "-")
+	if len(name) > 63 { // K8s names often have length limits
+		name = strings.TrimRight(name[:63], "-")
+	}
+	return name
+}
+
 // Ptr returns a pointer to the given value.
 // Useful for struct fields that are pointers to primitive types.
 func Ptr[T any](v T) *T {
 	return &v
 }
 
-func CreateKubeVirtVM(vmxConfig *vmx.VMXConfig, pvcName string, vmNameOverride string, namespace string, startVM bool) (*kubevirtv1.VirtualMachine, error) {
-	vmName := vmNameOverride
+// runStrategies are the spec.runStrategy values accepted by KubeVirt.
+var runStrategies = []kubevirtv1.VirtualMachineRunStrategy{
+	kubevirtv1.RunStrategyAlways,
+	kubevirtv1.RunStrategyHalted,
+	kubevirtv1.RunStrategyManual,
+	kubevirtv1.RunStrategyRerunOnFailure,
+	kubevirtv1.RunStrategyOnce,
+}
+
+// ParseRunStrategy validates a -run-strategy value, matched case-insensitively.
+func ParseRunStrategy(value string) (kubevirtv1.VirtualMachineRunStrategy, error) {
+	for _, strategy := range runStrategies {
+		if strings.EqualFold(value, string(strategy)) {
+			return strategy, nil
+		}
+	}
+	return "", fmt.Errorf("invalid run strategy '%s': must be Always, Halted, Manual, RerunOnFailure or Once", value)
+}
+
+// VMOptions configures the VirtualMachine built by CreateKubeVirtVM beyond what the VMX describes.
+type VMOptions struct {
+	// Name overrides the VMX displayName as the VM name.
+	Name        string
+	Namespace   string
+	RunStrategy kubevirtv1.VirtualMachineRunStrategy
+	// Disks are attached in order.
+	Disks []DiskDefinition
+	// GPUs and HostDevices pass devices advertised by a device plugin through to the guest.
+	GPUs        []kubevirtv1.GPU
+	HostDevices []kubevirtv1.HostDevice
+	Inputs      []kubevirtv1.Input
+	// Filesystems are shared with the guest over virtiofs.
+	Filesystems []FilesystemDefinition
+	// AutoattachGraphicsDevice, AutoattachSerialConsole and AutoattachMemBalloon add or leave out
+	// the VNC graphics device, serial console and memory balloon; nil derives the graphics device
+	// and balloon from the VMX and leaves the serial console to the cluster default.
+	AutoattachGraphicsDevice *bool
+	AutoattachSerialConsole  *bool
+	AutoattachMemBalloon     *bool
+}
+
+// CreateKubeVirtVM builds the VirtualMachine for vmxConfig with the disks and devices of opts.
+func CreateKubeVirtVM(vmxConfig *vmx.VMXConfig, opts VMOptions) (*kubevirtv1.VirtualMachine, error) {
+	vmName := opts.Name
 	if vmName == "" {
 		vmName = vmxConfig.DisplayName
 	}
 
-	// Basic sanitization for Kubernetes resource name
-	vmName = strings.ToLower(vmName)
-	vmName = strings.ReplaceAll(vmName, " ", "-")
-	vmName = strings.ReplaceAll(vmName, "_", "-")
-	// A more robust sanitization regex might be: reg := regexp.MustCompile("[^a-z0-9-]+")
-	// vmName = reg.ReplaceAllString(vmName, "")
-	if len(vmName) > 63 { // K8s names often have length limits
-		vmName = vmName[:63]
-	}
+	// Basic sanitization for Kubernetes resource name; the original name is kept in DisplayNameAnnotation.
+	vmName = SanitizeName(vmName)
 	if vmName == "" { // if displayname was e.g. "  "
 		return nil, fmt.Errorf("derived VM name is empty. Please provide a valid name via -name flag or ensure VMX displayName is suitable")
 	}
@@ -50,10 +109,10 @@ func CreateKubeVirtVM(vmxConfig *vmx.VMXConfig, pvcName string, vmNameOverride s
 		},
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      vmName,
-			Namespace: namespace,
+			Namespace: opts.Namespace,
 		},
 		Spec: kubevirtv1.VirtualMachineSpec{
-			Running: Ptr(startVM),
+			RunStrategy: Ptr(opts.RunStrategy),
 			Template: &kubevirtv1.VirtualMachineInstanceTemplateSpec{
 				ObjectMeta: metav1.ObjectMeta{
 					Labels: map[string]string{
@@ -69,17 +128,6 @@ func CreateKubeVirtVM(vmxConfig *vmx.VMXConfig, pvcName string, vmNameOverride s
 							Guest: &memoryQuantity,
 						},
 						Devices: kubevirtv1.Devices{
-							Disks: []kubevirtv1.Disk{
-								{
-									Name:      "disk0", // Name for the disk device
-									BootOrder: Ptr(uint(1)),
-									DiskDevice: kubevirtv1.DiskDevice{
-										Disk: &kubevirtv1.DiskTarget{
-											Bus: "virtio", // Defaulting to virtio. Could be sata, scsi.
-										},
-									},
-								},
-							},
 							Interfaces: []kubevirtv1.Interface{
 								{
 									Name: "default",
@@ -99,21 +147,45 @@ func CreateKubeVirtVM(vmxConfig *vmx.VMXConfig, pvcName string, vmNameOverride s
 							},
 						},
 					},
-					Volumes: []kubevirtv1.Volume{
-						{
-							Name: "disk0", // Must match a disk name in devices.disks
-							VolumeSource: kubevirtv1.VolumeSource{
-								PersistentVolumeClaim: &kubevirtv1.PersistentVolumeClaimVolumeSource{
-									PersistentVolumeClaimVolumeSource: corev1.PersistentVolumeClaimVolumeSource{
-										ClaimName: pvcName, // The PVC containing the VMDK data
-									},
-								},
-							},
-						},
-					},
 				},
 			},
 		},
 	}
+	spec := &vm.Spec.Template.Spec
+	for _, def := range opts.Disks {
+		disk := kubevirtv1.Disk{
+			Name: def.Name,
+			DiskDevice: kubevirtv1.DiskDevice{
+				Disk: &kubevirtv1.DiskTarget{Bus: def.Bus},
+			},
+		}
+		if def.BootOrder > 0 {
+			disk.BootOrder = Ptr(def.BootOrder)
+		}
+		spec.Domain.Devices.Disks = append(spec.Domain.Devices.Disks, disk)
+		spec.Volumes = append(spec.Volumes, kubevirtv1.Volume{Name: def.Name, VolumeSource: def.VolumeSource})
+	}
+	for _, def := range opts.Filesystems {
+		spec.Domain.Devices.Filesystems = append(spec.Domain.Devices.Filesystems, kubevirtv1.Filesystem{
+			Name:     def.Name,
+			Virtiofs: &kubevirtv1.FilesystemVirtiofs{},
+		})
+		spec.Volumes = append(spec.Volumes, kubevirtv1.Volume{Name: def.Name, VolumeSource: def.VolumeSource})
+	}
+	spec.Domain.Devices.GPUs = opts.GPUs
+	spec.Domain.Devices.HostDevices = opts.HostDevices
+	spec.Domain.Devices.Inputs = opts.Inputs
+	applyAutoattach(&spec.Domain.Devices, vmxConfig, opts)
+
+	annotations := make(map[string]string)
+	if vmxConfig.SourceSHA256 != "" {
+		annotations[SourceHashAnnotation] = vmxConfig.SourceSHA256
+	}
+	if opts.Name == "" && vmxConfig.DisplayName != vmName {
+		annotations[DisplayNameAnnotation] = vmxConfig.DisplayName
+	}
+	if len(annotations) > 0 {
+		vm.Annotations = annotations
+	}
 	return vm, nil
 }
@@ -0,0 +1,97 @@
+package kubevirt
+
+import (
+	"fmt"
+	"strings"
+
+	"vmx2vmi/pkg/vmx"
+
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+// legacyGuestPrefixes are VMware guest OS identifiers of systems that predate PCI Express and
+// AHCI support and fail to boot or lose their disks on the q35 machine type.
+var legacyGuestPrefixes = []string{
+	"dos", "win31", "win95", "win98", "winme", "winnt", "win2000", "winxp", "winnet",
+	"rhel2", "rhel3", "rhel4", "sles9", "other24xlinux", "solaris8", "solaris9", "netware",
+}
+
+// MachineOptions overrides the machine type and CPU model derived from the VMX.
+// Empty fields keep the derived value.
+type MachineOptions struct {
+	MachineType string
+	// CPUModel is host-passthrough, host-model or a named libvirt model such as Cascadelake-Server.
+	CPUModel string
+}
+
+// DefaultMachineType returns q35, or pc (i440fx) for guests too old for q35: legacy guest OSes
+// and virtual hardware older than version 7 (ESX 3.x era).
+func DefaultMachineType(vmxConfig *vmx.VMXConfig) string {
+	guest := strings.ToLower(vmxConfig.GuestOS)
+	for _, prefix := range legacyGuestPrefixes {
+		if strings.HasPrefix(guest, prefix) {
+			return "pc"
+		}
+	}
+	if vmxConfig.VirtualHWVersion > 0 && vmxConfig.VirtualHWVersion < 7 {
+		return "pc"
+	}
+	return "q35"
+}
+
+// DefaultCPUModel returns host-passthrough for VMs running nested hypervisors (vhv.enable),
+// which need the host virtualization extensions, and an empty string otherwise so the
+// cluster-wide default CPU model applies.
+func DefaultCPUModel(vmxConfig *vmx.VMXConfig) string {
+	if vmxConfig.NestedVirtualization {
+		return kubevirtv1.CPUModeHostPassthrough
+	}
+	return ""
+}
+
+// ApplyMachine sets the machine type and CPU model of vm, from opts or derived from the VMX, and
+// boots it with UEFI, and secure boot with the SMM it needs, when the VMX has firmware = "efi";
+// KubeVirt boots with BIOS otherwise, which a UEFI guest cannot boot from.
+// It returns a description of each setting applied, for the conversion report.
+func ApplyMachine(vm *kubevirtv1.VirtualMachine, vmxConfig *vmx.VMXConfig, opts MachineOptions) []string {
+	var applied []string
+	domain := &vm.Spec.Template.Spec.Domain
+
+	machineType := opts.MachineType
+	if machineType == "" {
+		machineType = DefaultMachineType(vmxConfig)
+		if machineType == "pc" {
+			applied = append(applied, fmt.Sprintf("guestOS=%q, virtualHW.version=%d -> machine type pc (i440fx), the cluster must list it in emulatedMachines",
+				vmxConfig.GuestOS, vmxConfig.VirtualHWVersion))
+		}
+	}
+	domain.Machine = &kubevirtv1.Machine{Type: machineType}
+
+	cpuModel := opts.CPUModel
+	if cpuModel == "" {
+		cpuModel = DefaultCPUModel(vmxConfig)
+		if cpuModel != "" {
+			applied = append(applied, fmt.Sprintf("vhv.enable=TRUE -> CPU model %s for nested virtualization", cpuModel))
+		}
+	}
+	if cpuModel != "" {
+		if domain.CPU == nil {
+			domain.CPU = &kubevirtv1.CPU{}
+		}
+		domain.CPU.Model = cpuModel
+	}
+
+	if vmxConfig.Firmware == "efi" {
+		domain.Firmware = &kubevirtv1.Firmware{
+			Bootloader: &kubevirtv1.Bootloader{EFI: &kubevirtv1.EFI{SecureBoot: Ptr(vmxConfig.SecureBoot)}},
+		}
+		if vmxConfig.SecureBoot {
+			if domain.Features == nil {
+				domain.Features = &kubevirtv1.Features{}
+			}
+			domain.Features.SMM = &kubevirtv1.FeatureState{}
+		}
+		applied = append(applied, fmt.Sprintf("firmware=efi, secure boot %t -> EFI bootloader", vmxConfig.SecureBoot))
+	}
+	return applied
+}
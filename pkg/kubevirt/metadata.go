@@ -0,0 +1,96 @@
+package kubevirt
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"vmx2vmi/pkg/vmx"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+// Provenance annotations record where a manifest comes from, for auditing migrated fleets.
+const (
+	// SourcePathAnnotation is the path of the source VMX as given to the converter.
+	SourcePathAnnotation = "vmx2vmi.beezy.dev/source-vmx"
+	// SourceUUIDAnnotation is the BIOS UUID of the source VM (uuid.bios).
+	SourceUUIDAnnotation = "vmx2vmi.beezy.dev/source-uuid"
+	// SourceVCUUIDAnnotation is the vCenter instance UUID of the source VM (vc.uuid).
+	SourceVCUUIDAnnotation = "vmx2vmi.beezy.dev/source-vc-uuid"
+	// ConverterVersionAnnotation is the version of vmx2vmi that generated the manifest.
+	ConverterVersionAnnotation = "vmx2vmi.beezy.dev/converter-version"
+	// ConvertedAtAnnotation is the time of the conversion, in RFC 3339 UTC. Re-running a
+	// conversion does not count it as a change.
+	ConvertedAtAnnotation = "vmx2vmi.beezy.dev/converted-at"
+)
+
+// ParseLabel validates a -label value of the form <key>=<value>.
+func ParseLabel(value string) (string, string, error) {
+	key, labelValue, ok := strings.Cut(value, "=")
+	if !ok {
+		return "", "", fmt.Errorf("invalid label '%s': expected <key>=<value>", value)
+	}
+	if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+		return "", "", fmt.Errorf("invalid label key '%s': %s", key, strings.Join(errs, "; "))
+	}
+	if errs := validation.IsValidLabelValue(labelValue); len(errs) > 0 {
+		return "", "", fmt.Errorf("invalid label value '%s': %s", labelValue, strings.Join(errs, "; "))
+	}
+	return key, labelValue, nil
+}
+
+// ParseAnnotation validates an -annotation value of the form <key>=<value>.
+func ParseAnnotation(value string) (string, string, error) {
+	key, annotationValue, ok := strings.Cut(value, "=")
+	if !ok {
+		return "", "", fmt.Errorf("invalid annotation '%s': expected <key>=<value>", value)
+	}
+	if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+		return "", "", fmt.Errorf("invalid annotation key '%s': %s", key, strings.Join(errs, "; "))
+	}
+	return key, annotationValue, nil
+}
+
+// ApplyMetadata adds labels to the VM and its template, so the VMI and its pod carry them for
+// services and network policies, and annotations to the VM.
+func ApplyMetadata(vm *kubevirtv1.VirtualMachine, labels, annotations map[string]string) {
+	for k, v := range labels {
+		if vm.Labels == nil {
+			vm.Labels = make(map[string]string)
+		}
+		if vm.Spec.Template.ObjectMeta.Labels == nil {
+			vm.Spec.Template.ObjectMeta.Labels = make(map[string]string)
+		}
+		vm.Labels[k] = v
+		vm.Spec.Template.ObjectMeta.Labels[k] = v
+	}
+	for k, v := range annotations {
+		if vm.Annotations == nil {
+			vm.Annotations = make(map[string]string)
+		}
+		vm.Annotations[k] = v
+	}
+}
+
+// ApplyProvenance stamps vm with the source VMX path and identifiers, the converter version and
+// the conversion time.
+func ApplyProvenance(vm *kubevirtv1.VirtualMachine, vmxConfig *vmx.VMXConfig, sourcePath, converterVersion string, now time.Time) {
+	provenance := map[string]string{
+		SourcePathAnnotation:       sourcePath,
+		ConverterVersionAnnotation: converterVersion,
+		ConvertedAtAnnotation:      now.UTC().Format(time.RFC3339),
+	}
+	if biosUUID, ok := vmxConfig.Get("uuid.bios"); ok {
+		if uuid, err := formatVMwareUUID(biosUUID); err == nil {
+			provenance[SourceUUIDAnnotation] = uuid
+		}
+	}
+	if vcUUID, ok := vmxConfig.Get("vc.uuid"); ok {
+		if uuid, err := formatVMwareUUID(vcUUID); err == nil {
+			provenance[SourceVCUUIDAnnotation] = uuid
+		}
+	}
+	ApplyMetadata(vm, nil, provenance)
+}
@@ -0,0 +1,87 @@
+package kubevirt
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+// evictionStrategies are the spec.template.spec.evictionStrategy values accepted by KubeVirt.
+var evictionStrategies = []kubevirtv1.EvictionStrategy{
+	kubevirtv1.EvictionStrategyNone,
+	kubevirtv1.EvictionStrategyLiveMigrate,
+	kubevirtv1.EvictionStrategyLiveMigrateIfPossible,
+	kubevirtv1.EvictionStrategyExternal,
+}
+
+// ParseEvictionStrategy validates an -eviction-strategy value, matched case-insensitively.
+func ParseEvictionStrategy(value string) (kubevirtv1.EvictionStrategy, error) {
+	for _, strategy := range evictionStrategies {
+		if strings.EqualFold(value, string(strategy)) {
+			return strategy, nil
+		}
+	}
+	return "", fmt.Errorf("invalid eviction strategy '%s': must be LiveMigrate, LiveMigrateIfPossible, None or External", value)
+}
+
+// MigrationBlockers lists what in vm prevents live migration: volumes on storage that is not
+// ReadWriteMany, host disks, bridge binding on the pod network, passthrough devices and virtiofs
+// filesystems. pvcs are the claims generated alongside the VM, whose access mode is known; the
+// access mode of existing claims cannot be checked offline.
+func MigrationBlockers(vm *kubevirtv1.VirtualMachine, pvcs []*corev1.PersistentVolumeClaim) []string {
+	var blockers []string
+	spec := &vm.Spec.Template.Spec
+
+	accessModes := make(map[string][]corev1.PersistentVolumeAccessMode)
+	for _, pvc := range pvcs {
+		accessModes[pvc.Name] = pvc.Spec.AccessModes
+	}
+	for _, template := range vm.Spec.DataVolumeTemplates {
+		if template.Spec.Storage != nil {
+			accessModes[template.Name] = template.Spec.Storage.AccessModes
+		}
+	}
+	for _, volume := range spec.Volumes {
+		var claimName string
+		switch {
+		case volume.PersistentVolumeClaim != nil:
+			claimName = volume.PersistentVolumeClaim.ClaimName
+		case volume.DataVolume != nil:
+			claimName = volume.DataVolume.Name
+		case volume.HostDisk != nil:
+			blockers = append(blockers, fmt.Sprintf("volume %s is a host disk, local to its node", volume.Name))
+			continue
+		default:
+			continue
+		}
+		modes, known := accessModes[claimName]
+		if known && len(modes) > 0 && !slices.Contains(modes, corev1.ReadWriteMany) {
+			blockers = append(blockers, fmt.Sprintf("volume %s uses claim %s with access mode %s, live migration needs ReadWriteMany", volume.Name, claimName, modes[0]))
+		}
+	}
+
+	podNetworks := make(map[string]bool)
+	for _, network := range spec.Networks {
+		if network.Pod != nil {
+			podNetworks[network.Name] = true
+		}
+	}
+	for _, iface := range spec.Domain.Devices.Interfaces {
+		if iface.Bridge != nil && podNetworks[iface.Name] {
+			blockers = append(blockers, fmt.Sprintf("interface %s uses bridge binding on the pod network, use masquerade", iface.Name))
+		}
+	}
+	for _, gpu := range spec.Domain.Devices.GPUs {
+		blockers = append(blockers, fmt.Sprintf("GPU %s (%s) is passed through", gpu.Name, gpu.DeviceName))
+	}
+	for _, device := range spec.Domain.Devices.HostDevices {
+		blockers = append(blockers, fmt.Sprintf("host device %s (%s) is passed through", device.Name, device.DeviceName))
+	}
+	for _, fs := range spec.Domain.Devices.Filesystems {
+		blockers = append(blockers, fmt.Sprintf("filesystem %s is shared over virtiofs", fs.Name))
+	}
+	return blockers
+}
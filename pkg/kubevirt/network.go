@@ -0,0 +1,289 @@
+package kubevirt
+
+import (
+	"cmp"
+	"fmt"
+	"os"
+	"strings"
+
+	"vmx2vmi/pkg/failure"
+	"vmx2vmi/pkg/vmx"
+
+	kubevirtv1 "kubevirt.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// nicModels are the interface models KubeVirt can emulate.
+var nicModels = []string{"virtio", "e1000", "e1000e", "igb", "rtl8139", "pcnet", "ne2k_pci"}
+
+// netBindings are the supported ways of connecting an interface to its network.
+var netBindings = []string{"masquerade", "bridge", "sriov", "macvtap"}
+
+// NetworkOptions configures the interfaces generated for the VMX network adapters.
+type NetworkOptions struct {
+	// Models overrides the interface model per adapter, keyed by VMX adapter name (ethernet0).
+	// The "" key applies to every adapter without its own entry.
+	Models map[string]string
+	// Bindings overrides the binding per adapter, keyed like Models: masquerade attaches the
+	// adapter to the pod network, bridge, sriov and macvtap to its Multus network.
+	Bindings map[string]string
+	// Map translates VMware port groups to networks, nil to use the defaults.
+	Map *NetworkMap
+}
+
+// NetworkMap translates VMware network names (ethernetN.networkName) to cluster networks.
+// It is read from a YAML or JSON file so batch conversions map networks the same way.
+type NetworkMap struct {
+	Networks []NetworkMapping `json:"networks"`
+}
+
+// NetworkMapping maps one VMware port group.
+type NetworkMapping struct {
+	// Source is the VMware network name, matched exactly.
+	Source string `json:"source"`
+	// Target is "pod" for the pod network, "skip" to drop the adapter, or the name of a
+	// NetworkAttachmentDefinition, optionally as <namespace>/<name>.
+	Target string `json:"target"`
+	// Binding optionally overrides the binding, defaulting to masquerade on the pod network and bridge otherwise.
+	Binding string `json:"binding,omitempty"`
+	// Model optionally overrides the interface model.
+	Model string `json:"model,omitempty"`
+}
+
+// LoadNetworkMap reads and validates a network mapping file.
+func LoadNetworkMap(path string) (*NetworkMap, error) {
+	m, err := loadNetworkMap(path)
+	return m, failure.Wrap(failure.Parse, err)
+}
+
+func loadNetworkMap(path string) (*NetworkMap, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read network map: %w", err)
+	}
+	var m NetworkMap
+	if err := yaml.UnmarshalStrict(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to parse network map %s: %w", path, err)
+	}
+	seen := make(map[string]bool)
+	for _, entry := range m.Networks {
+		if entry.Source == "" || entry.Target == "" {
+			return nil, fmt.Errorf("network map %s: every entry needs a source and a target", path)
+		}
+		if seen[entry.Source] {
+			return nil, fmt.Errorf("network map %s: network %q is mapped twice", path, entry.Source)
+		}
+		seen[entry.Source] = true
+		if entry.Binding != "" {
+			if _, _, err := ParseNetBinding(entry.Binding); err != nil {
+				return nil, fmt.Errorf("network map %s, network %q: %w", path, entry.Source, err)
+			}
+		}
+		if entry.Model != "" {
+			if _, _, err := ParseNICModel(entry.Model); err != nil {
+				return nil, fmt.Errorf("network map %s, network %q: %w", path, entry.Source, err)
+			}
+		}
+	}
+	return &m, nil
+}
+
+// lookup returns the mapping of a VMware network.
+func (m *NetworkMap) lookup(networkName string) (NetworkMapping, bool) {
+	if m == nil {
+		return NetworkMapping{}, false
+	}
+	for _, entry := range m.Networks {
+		if entry.Source == networkName {
+			return entry, true
+		}
+	}
+	return NetworkMapping{}, false
+}
+
+// ParseNICModel parses a -nic-model value, <model> for every adapter or <adapter>=<model>.
+func ParseNICModel(value string) (adapter string, model string, err error) {
+	adapter, model, ok := strings.Cut(value, "=")
+	if !ok {
+		adapter, model = "", value
+	}
+	adapter = strings.ToLower(adapter)
+	for _, m := range nicModels {
+		if model == m {
+			return adapter, model, nil
+		}
+	}
+	return "", "", fmt.Errorf("invalid interface model '%s': must be one of %s", model, strings.Join(nicModels, ", "))
+}
+
+// ParseNetBinding parses a -net-binding value, <binding> for every adapter or <adapter>=<binding>.
+func ParseNetBinding(value string) (adapter string, binding string, err error) {
+	adapter, binding, ok := strings.Cut(value, "=")
+	if !ok {
+		adapter, binding = "", value
+	}
+	adapter = strings.ToLower(adapter)
+	for _, b := range netBindings {
+		if binding == b {
+			return adapter, binding, nil
+		}
+	}
+	return "", "", fmt.Errorf("invalid network binding '%s': must be one of %s", binding, strings.Join(netBindings, ", "))
+}
+
+// lookupAdapter returns the value for an adapter from a per-adapter option map, falling back to the "" key.
+func lookupAdapter(values map[string]string, nic vmx.NIC) (string, bool) {
+	if v, ok := values[nicName(nic)]; ok {
+		return v, true
+	}
+	v, ok := values[""]
+	return v, ok
+}
+
+// bindInterface connects iface to the pod network, when nad is empty, or to the Multus network
+// nad with binding. Masquerade only works on the pod network, SR-IOV and macvtap only on Multus
+// networks. SR-IOV passes a VF through, so it has no model. Macvtap is a network binding plugin
+// that must be registered in the KubeVirt CR.
+func bindInterface(iface *kubevirtv1.Interface, network *kubevirtv1.Network, binding, nad string) (string, error) {
+	if nad == "" {
+		switch binding {
+		case "masquerade":
+			iface.InterfaceBindingMethod = kubevirtv1.InterfaceBindingMethod{Masquerade: &kubevirtv1.InterfaceMasquerade{}}
+		case "bridge":
+			iface.InterfaceBindingMethod = kubevirtv1.InterfaceBindingMethod{Bridge: &kubevirtv1.InterfaceBridge{}}
+		default:
+			return "", fmt.Errorf("%s binding needs a Multus network, not the pod network", binding)
+		}
+		network.NetworkSource = kubevirtv1.NetworkSource{Pod: &kubevirtv1.PodNetwork{}}
+		return "pod network", nil
+	}
+	switch binding {
+	case "bridge":
+		iface.InterfaceBindingMethod = kubevirtv1.InterfaceBindingMethod{Bridge: &kubevirtv1.InterfaceBridge{}}
+	case "sriov":
+		iface.InterfaceBindingMethod = kubevirtv1.InterfaceBindingMethod{SRIOV: &kubevirtv1.InterfaceSRIOV{}}
+		iface.Model = ""
+	case "macvtap":
+		iface.Binding = &kubevirtv1.PluginBinding{Name: "macvtap"}
+	case "masquerade":
+		return "", fmt.Errorf("masquerade binding only works on the pod network")
+	default:
+		return "", fmt.Errorf("unsupported network binding '%s'", binding)
+	}
+	network.NetworkSource = kubevirtv1.NetworkSource{Multus: &kubevirtv1.MultusNetwork{NetworkName: nad}}
+	return "Multus network " + nad, nil
+}
+
+// nicName returns the VMX name of an adapter, e.g. ethernet0.
+func nicName(nic vmx.NIC) string {
+	return fmt.Sprintf("ethernet%d", nic.Index)
+}
+
+// DefaultNICModel picks the interface model closest to the VMware adapter that the guest can
+// drive without extra drivers. Paravirtual vmxnet adapters become virtio on Linux, whose kernel
+// ships the driver, and e1000e on Windows, which has no inbox virtio driver.
+func DefaultNICModel(nic vmx.NIC, guestFamily string) string {
+	switch strings.ToLower(nic.VirtualDev) {
+	case "e1000":
+		return "e1000"
+	case "e1000e":
+		return "e1000e"
+	case "vlance":
+		return "pcnet"
+	}
+	if guestFamily == "windows" {
+		return "e1000e"
+	}
+	return "virtio"
+}
+
+// ApplyNetworks replaces the default interface of vm with one interface per VMX network adapter,
+// in ethernetN order. Adapters are mapped by -nic-model and -net-binding style options first,
+// then by the network map entry of their port group. Otherwise the first adapter keeps the pod
+// network through masquerade as the "default" interface, and the others are bridged to a Multus
+// network named after their VMware port group, which needs a NetworkAttachmentDefinition of that
+// name. Adapters not connected at power on start with their link down. A VMX without adapters
+// keeps the default interface. It returns a description of each adapter mapping, for the conversion report.
+func ApplyNetworks(vm *kubevirtv1.VirtualMachine, vmxConfig *vmx.VMXConfig, opts NetworkOptions) ([]string, error) {
+	if len(vmxConfig.NICs) == 0 {
+		return nil, nil
+	}
+	known := make(map[string]bool, len(vmxConfig.NICs))
+	for _, nic := range vmxConfig.NICs {
+		known[nicName(nic)] = true
+	}
+	for _, values := range []map[string]string{opts.Models, opts.Bindings} {
+		for adapter := range values {
+			if adapter != "" && !known[adapter] {
+				return nil, fmt.Errorf("network option given for %s, but the VMX has no such network adapter", adapter)
+			}
+		}
+	}
+
+	var applied []string
+	var interfaces []kubevirtv1.Interface
+	var networks []kubevirtv1.Network
+	podNetwork := ""
+	family := vmxConfig.GuestOSFamily()
+	for _, nic := range vmxConfig.NICs {
+		mapping, mapped := opts.Map.lookup(nic.NetworkName)
+		if mapped && mapping.Target == "skip" {
+			applied = append(applied, fmt.Sprintf("%s (%s, %q) skipped by the network map", nicName(nic), nic.VirtualDev, nic.NetworkName))
+			continue
+		}
+
+		model, ok := lookupAdapter(opts.Models, nic)
+		if !ok {
+			model = cmp.Or(mapping.Model, DefaultNICModel(nic, family))
+		}
+		binding, ok := lookupAdapter(opts.Bindings, nic)
+		if !ok {
+			binding = mapping.Binding
+		}
+
+		// nad stays empty for the pod network.
+		nad := SanitizeName(nic.NetworkName)
+		switch {
+		case mapped && mapping.Target == "pod":
+			nad = ""
+		case mapped:
+			nad = mapping.Target
+		case binding == "masquerade", binding == "" && len(interfaces) == 0:
+			nad = ""
+		case nad == "":
+			return nil, fmt.Errorf("network adapter %s has no port group name to derive a NetworkAttachmentDefinition from, map it with -network-map", nicName(nic))
+		}
+		if binding == "" {
+			binding = "bridge"
+			if nad == "" {
+				binding = "masquerade"
+			}
+		}
+
+		iface := kubevirtv1.Interface{Name: nicName(nic), Model: model}
+		if nad == "" {
+			if podNetwork != "" {
+				return nil, fmt.Errorf("network adapters %s and %s are both attached to the pod network, only one interface can be", podNetwork, nicName(nic))
+			}
+			podNetwork = nicName(nic)
+			iface.Name = "default"
+		}
+		network := kubevirtv1.Network{Name: iface.Name}
+		target, err := bindInterface(&iface, &network, binding, nad)
+		if err != nil {
+			return nil, fmt.Errorf("network adapter %s: %w", nicName(nic), err)
+		}
+		if !nic.StartConnected {
+			iface.State = kubevirtv1.InterfaceStateLinkDown
+		}
+
+		interfaces = append(interfaces, iface)
+		networks = append(networks, network)
+		applied = append(applied, fmt.Sprintf("%s (%s, %q) -> interface %s, %s binding, model %s, %s",
+			nicName(nic), nic.VirtualDev, nic.NetworkName, iface.Name, binding, cmp.Or(iface.Model, "none"), target))
+	}
+
+	vm.Spec.Template.Spec.Domain.Devices.Interfaces = interfaces
+	vm.Spec.Template.Spec.Networks = networks
+	return applied, nil
+}
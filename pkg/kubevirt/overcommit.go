@@ -0,0 +1,50 @@
+package kubevirt
+
+import (
+	"fmt"
+	"math"
+
+	"vmx2vmi/pkg/vmx"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+// MemoryOptions controls how much memory the VM pod requests compared to what the guest sees.
+type MemoryOptions struct {
+	// OvercommitRatio is memory.guest divided by resources.requests.memory; 1 requests all guest memory.
+	OvercommitRatio float64
+	// OvercommitGuestOverhead leaves the memory overhead of virt-launcher and QEMU out of the pod request.
+	OvercommitGuestOverhead bool
+}
+
+// ApplyMemoryOvercommit sets resources.requests.memory of vm to memory.guest divided by the
+// overcommit ratio, rounded up to MiB, but never below the memory reserved in vSphere
+// (sched.mem.min), which the guest was promised. It returns a description of the settings
+// applied, for the conversion report.
+func ApplyMemoryOvercommit(vm *kubevirtv1.VirtualMachine, vmxConfig *vmx.VMXConfig, opts MemoryOptions) ([]string, error) {
+	if opts.OvercommitRatio < 1 {
+		return nil, fmt.Errorf("memory overcommit ratio must be at least 1, got %g", opts.OvercommitRatio)
+	}
+	var applied []string
+	domain := &vm.Spec.Template.Spec.Domain
+	if opts.OvercommitRatio > 1 {
+		requestMiB := int64(math.Ceil(float64(vmxConfig.MemoryMiB) / opts.OvercommitRatio))
+		reason := fmt.Sprintf("overcommit ratio %g", opts.OvercommitRatio)
+		if reserved := vmxConfig.Scheduling.MemMinMiB; reserved > requestMiB {
+			requestMiB = min(reserved, vmxConfig.MemoryMiB)
+			reason = fmt.Sprintf("memory reservation sched.mem.min=%d MiB", reserved)
+		}
+		if domain.Resources.Requests == nil {
+			domain.Resources.Requests = corev1.ResourceList{}
+		}
+		domain.Resources.Requests[corev1.ResourceMemory] = *resource.NewQuantity(requestMiB<<20, resource.BinarySI)
+		applied = append(applied, fmt.Sprintf("memory %d MiB, %s -> resources.requests.memory %dMi", vmxConfig.MemoryMiB, reason, requestMiB))
+	}
+	if opts.OvercommitGuestOverhead {
+		domain.Resources.OvercommitGuestOverhead = true
+		applied = append(applied, "overcommitGuestOverhead: the VM memory overhead is not requested")
+	}
+	return applied, nil
+}
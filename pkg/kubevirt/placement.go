@@ -0,0 +1,151 @@
+package kubevirt
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"vmx2vmi/pkg/failure"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// Placement selects the nodes the VM may run on. It is read from a YAML or JSON file with the
+// fields of a pod spec, and completed by -node-selector, -toleration and -anti-affinity-label.
+type Placement struct {
+	NodeSelector map[string]string   `json:"nodeSelector,omitempty"`
+	Affinity     *corev1.Affinity    `json:"affinity,omitempty"`
+	Tolerations  []corev1.Toleration `json:"tolerations,omitempty"`
+	// AntiAffinityLabels are added to the VM and keep it off nodes already running a VM with
+	// the same labels, like a vSphere DRS anti-affinity rule.
+	AntiAffinityLabels map[string]string `json:"antiAffinityLabels,omitempty"`
+}
+
+// LoadPlacement reads a placement file.
+func LoadPlacement(path string) (*Placement, error) {
+	placement, err := loadPlacement(path)
+	return placement, failure.Wrap(failure.Parse, err)
+}
+
+func loadPlacement(path string) (*Placement, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read placement: %w", err)
+	}
+	var p Placement
+	if err := yaml.UnmarshalStrict(data, &p); err != nil {
+		return nil, fmt.Errorf("failed to parse placement %s: %w", path, err)
+	}
+	for _, toleration := range p.Tolerations {
+		if err := validateToleration(toleration); err != nil {
+			return nil, fmt.Errorf("placement %s: %w", path, err)
+		}
+	}
+	return &p, nil
+}
+
+// ParseToleration parses a -toleration value in the syntax of kubectl taint, <key>[=<value>][:<effect>].
+// Without a value the toleration matches any value of the key; without an effect, any effect.
+func ParseToleration(value string) (corev1.Toleration, error) {
+	spec, effect, _ := strings.Cut(value, ":")
+	key, taintValue, hasValue := strings.Cut(spec, "=")
+	toleration := corev1.Toleration{Key: key, Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffect(effect)}
+	if hasValue {
+		toleration.Operator = corev1.TolerationOpEqual
+		toleration.Value = taintValue
+	}
+	if key == "" {
+		return corev1.Toleration{}, fmt.Errorf("invalid toleration '%s': expected <key>[=<value>][:<effect>]", value)
+	}
+	if err := validateToleration(toleration); err != nil {
+		return corev1.Toleration{}, err
+	}
+	return toleration, nil
+}
+
+// validateToleration checks the effect of a toleration, which the API server would otherwise reject.
+func validateToleration(toleration corev1.Toleration) error {
+	switch toleration.Effect {
+	case "", corev1.TaintEffectNoSchedule, corev1.TaintEffectPreferNoSchedule, corev1.TaintEffectNoExecute:
+		return nil
+	}
+	return fmt.Errorf("invalid toleration effect '%s' for key %s: must be NoSchedule, PreferNoSchedule or NoExecute", toleration.Effect, toleration.Key)
+}
+
+// ApplyPlacement sets the node selector, affinity and tolerations of p on the VM template.
+// Anti-affinity labels are added to the template and required to be absent from the other pods
+// of the node, so VMs sharing them land on different nodes. It returns a description of each
+// setting applied, for the conversion report.
+func ApplyPlacement(vm *kubevirtv1.VirtualMachine, p Placement) []string {
+	var applied []string
+	spec := &vm.Spec.Template.Spec
+
+	if len(p.NodeSelector) > 0 {
+		if spec.NodeSelector == nil {
+			spec.NodeSelector = make(map[string]string)
+		}
+		for k, v := range p.NodeSelector {
+			spec.NodeSelector[k] = v
+		}
+		applied = append(applied, "nodeSelector "+formatLabels(p.NodeSelector))
+	}
+	if p.Affinity != nil {
+		spec.Affinity = p.Affinity.DeepCopy()
+		applied = append(applied, "affinity from the placement file")
+	}
+	if len(p.Tolerations) > 0 {
+		spec.Tolerations = append(spec.Tolerations, p.Tolerations...)
+		for _, toleration := range p.Tolerations {
+			applied = append(applied, "toleration of taint "+formatToleration(toleration))
+		}
+	}
+	if len(p.AntiAffinityLabels) > 0 {
+		labels := vm.Spec.Template.ObjectMeta.Labels
+		if labels == nil {
+			labels = make(map[string]string)
+			vm.Spec.Template.ObjectMeta.Labels = labels
+		}
+		for k, v := range p.AntiAffinityLabels {
+			labels[k] = v
+		}
+		if spec.Affinity == nil {
+			spec.Affinity = &corev1.Affinity{}
+		}
+		if spec.Affinity.PodAntiAffinity == nil {
+			spec.Affinity.PodAntiAffinity = &corev1.PodAntiAffinity{}
+		}
+		anti := spec.Affinity.PodAntiAffinity
+		anti.RequiredDuringSchedulingIgnoredDuringExecution = append(anti.RequiredDuringSchedulingIgnoredDuringExecution, corev1.PodAffinityTerm{
+			LabelSelector: &metav1.LabelSelector{MatchLabels: p.AntiAffinityLabels},
+			TopologyKey:   corev1.LabelHostname,
+		})
+		applied = append(applied, "anti-affinity: no two VMs labelled "+formatLabels(p.AntiAffinityLabels)+" on the same node")
+	}
+	return applied
+}
+
+// formatLabels renders labels as a sorted k=v,k=v list.
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// formatToleration renders a toleration in the syntax of ParseToleration.
+func formatToleration(toleration corev1.Toleration) string {
+	s := toleration.Key
+	if toleration.Operator == corev1.TolerationOpEqual {
+		s += "=" + toleration.Value
+	}
+	if toleration.Effect != "" {
+		s += ":" + string(toleration.Effect)
+	}
+	return s
+}
@@ -0,0 +1,97 @@
+package kubevirt
+
+import (
+	"fmt"
+
+	"vmx2vmi/pkg/vmx"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+	poolv1alpha1 "kubevirt.io/api/pool/v1alpha1"
+	cdiv1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
+)
+
+// PoolLabel selects the VMs of a VirtualMachinePool.
+const PoolLabel = "kubevirt.io/vmpool"
+
+// CreateVirtualMachinePool wraps vm into a VirtualMachinePool of replicas VMs named
+// <pool>-<index>. Every replica needs disks of its own, so the claims of the converted disks
+// become DataVolume templates cloning them, the converted disks acting as golden images; shared
+// disks stay shared between the replicas. The pool carries the labels and annotations of vm.
+// Raw device mappings, upload DataVolumes and fixed MAC addresses cannot be replicated.
+func CreateVirtualMachinePool(vm *kubevirtv1.VirtualMachine, vmxConfig *vmx.VMXConfig, replicas int32) (*poolv1alpha1.VirtualMachinePool, []string, error) {
+	if replicas < 0 {
+		return nil, nil, fmt.Errorf("the replica count must not be negative, got %d", replicas)
+	}
+	for _, d := range vmxConfig.Disks {
+		if d.RawDeviceMapping != "" {
+			return nil, nil, fmt.Errorf("disk %s is a raw device mapping, its LUN cannot be replicated into a pool", d.ID())
+		}
+	}
+	for _, template := range vm.Spec.DataVolumeTemplates {
+		if template.Spec.Source != nil && template.Spec.Source.Upload != nil {
+			return nil, nil, fmt.Errorf("DataVolume %s is filled by upload, which cannot be replicated into a pool; use -disk-source pvc, vddk or http", template.Name)
+		}
+	}
+	for _, iface := range vm.Spec.Template.Spec.Domain.Devices.Interfaces {
+		if iface.MacAddress != "" {
+			return nil, nil, fmt.Errorf("interface %s has the fixed MAC address %s, which the replicas cannot share", iface.Name, iface.MacAddress)
+		}
+	}
+
+	spec := vm.Spec.DeepCopy()
+	var mappings []string
+	shareable := make(map[string]bool)
+	for _, disk := range spec.Template.Spec.Domain.Devices.Disks {
+		shareable[disk.Name] = disk.Shareable != nil && *disk.Shareable
+	}
+	for i := range spec.Template.Spec.Volumes {
+		volume := &spec.Template.Spec.Volumes[i]
+		if volume.PersistentVolumeClaim == nil || shareable[volume.Name] {
+			continue
+		}
+		claimName := volume.PersistentVolumeClaim.ClaimName
+		volume.VolumeSource = kubevirtv1.VolumeSource{DataVolume: &kubevirtv1.DataVolumeSource{Name: claimName}}
+		spec.DataVolumeTemplates = append(spec.DataVolumeTemplates, kubevirtv1.DataVolumeTemplateSpec{
+			ObjectMeta: metav1.ObjectMeta{Name: claimName},
+			Spec: cdiv1.DataVolumeSpec{
+				Source: &cdiv1.DataVolumeSource{
+					PVC: &cdiv1.DataVolumeSourcePVC{Namespace: vm.Namespace, Name: claimName},
+				},
+				// CDI sizes clones after their source claim.
+				Storage: &cdiv1.StorageSpec{},
+			},
+		})
+		mappings = append(mappings, fmt.Sprintf("volume %s cloned from PVC %s for every pool replica", volume.Name, claimName))
+	}
+
+	selector := map[string]string{PoolLabel: vm.Name}
+	templateLabels := map[string]string{PoolLabel: vm.Name}
+	for k, v := range vm.Labels {
+		templateLabels[k] = v
+	}
+	if spec.Template.ObjectMeta.Labels == nil {
+		spec.Template.ObjectMeta.Labels = make(map[string]string)
+	}
+	spec.Template.ObjectMeta.Labels[PoolLabel] = vm.Name
+
+	pool := &poolv1alpha1.VirtualMachinePool{
+		TypeMeta: metav1.TypeMeta{APIVersion: poolv1alpha1.SchemeGroupVersion.String(), Kind: "VirtualMachinePool"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        vm.Name,
+			Namespace:   vm.Namespace,
+			Labels:      vm.Labels,
+			Annotations: vm.Annotations,
+		},
+		Spec: poolv1alpha1.VirtualMachinePoolSpec{
+			Replicas: Ptr(replicas),
+			Selector: &metav1.LabelSelector{MatchLabels: selector},
+			VirtualMachineTemplate: &poolv1alpha1.VirtualMachineTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: templateLabels},
+				Spec:       *spec,
+			},
+		},
+	}
+	mappings = append(mappings, fmt.Sprintf("VirtualMachinePool %s of %d replicas instead of a single VM", vm.Name, replicas))
+	return pool, mappings, nil
+}
@@ -0,0 +1,42 @@
+package kubevirt
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"vmx2vmi/pkg/vmx"
+
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+// ParseGracePeriod parses a -termination-grace-period value, in seconds or as a duration such as 10m.
+func ParseGracePeriod(value string) (int64, error) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil && seconds >= 0 {
+		return seconds, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 || d%time.Second != 0 {
+		return 0, fmt.Errorf("invalid termination grace period '%s': expected whole seconds or a duration such as 10m", value)
+	}
+	return int64(d / time.Second), nil
+}
+
+// ApplyTerminationGracePeriod sets how long the guest gets to shut down cleanly through ACPI
+// before it is powered off, on stop or node drain. gracePeriod overrides the VMX; otherwise a VM
+// powered off hard in vSphere (powerType.powerOff = hard) is stopped immediately, and VMs shutting
+// down their guest keep the cluster default. It returns a description of the setting, for the
+// conversion report.
+func ApplyTerminationGracePeriod(vm *kubevirtv1.VirtualMachine, vmxConfig *vmx.VMXConfig, gracePeriod *int64) []string {
+	if gracePeriod != nil {
+		vm.Spec.Template.Spec.TerminationGracePeriodSeconds = Ptr(*gracePeriod)
+		return nil
+	}
+	powerOff, _ := vmxConfig.Get("powerType.powerOff")
+	if strings.EqualFold(powerOff, "hard") {
+		vm.Spec.Template.Spec.TerminationGracePeriodSeconds = Ptr(int64(0))
+		return []string{"powerType.powerOff=hard -> terminationGracePeriodSeconds 0, the VM is powered off without guest shutdown"}
+	}
+	return nil
+}
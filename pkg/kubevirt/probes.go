@@ -0,0 +1,117 @@
+package kubevirt
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+// ProbeRequest is a probe given with -probe.
+type ProbeRequest struct {
+	// Kind is readiness, liveness, or empty for both.
+	Kind    string
+	Handler kubevirtv1.Handler
+	// Description is the probe as given, without its kind.
+	Description string
+}
+
+// ParseProbe parses a -probe value, [readiness=|liveness=]<check> where check is guest-agent,
+// tcp:<port> or http:<path>:<port>.
+func ParseProbe(value string) (ProbeRequest, error) {
+	request := ProbeRequest{}
+	check := value
+	if kind, rest, ok := strings.Cut(value, "="); ok {
+		if kind != "readiness" && kind != "liveness" {
+			return ProbeRequest{}, fmt.Errorf("invalid probe kind '%s': must be readiness or liveness", kind)
+		}
+		request.Kind, check = kind, rest
+	}
+	request.Description = check
+
+	invalid := fmt.Errorf("invalid probe '%s': expected guest-agent, tcp:<port> or http:<path>:<port>", check)
+	kind, rest, _ := strings.Cut(check, ":")
+	switch kind {
+	case "guest-agent":
+		if rest != "" {
+			return ProbeRequest{}, invalid
+		}
+		request.Handler.GuestAgentPing = &kubevirtv1.GuestAgentPing{}
+	case "tcp":
+		port, err := parsePort(rest)
+		if err != nil {
+			return ProbeRequest{}, invalid
+		}
+		request.Handler.TCPSocket = &corev1.TCPSocketAction{Port: intstr.FromInt32(port)}
+	case "http":
+		i := strings.LastIndex(rest, ":")
+		if i < 0 || !strings.HasPrefix(rest, "/") {
+			return ProbeRequest{}, invalid
+		}
+		port, err := parsePort(rest[i+1:])
+		if err != nil {
+			return ProbeRequest{}, invalid
+		}
+		request.Handler.HTTPGet = &corev1.HTTPGetAction{Path: rest[:i], Port: intstr.FromInt32(port)}
+	default:
+		return ProbeRequest{}, invalid
+	}
+	return request, nil
+}
+
+// parsePort parses a TCP port number.
+func parsePort(value string) (int32, error) {
+	port, err := strconv.ParseInt(value, 10, 32)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port '%s'", value)
+	}
+	return int32(port), nil
+}
+
+// ApplyProbes renders the probes on the VMI template. A probe without a kind becomes both the
+// readiness and the liveness probe. Liveness probes wait two minutes before the first check, as
+// a migrated guest may run a file system check or driver installation on its first boot, and
+// restart the VM after three failures. TCP and HTTP probes reach the guest through the pod
+// network. It returns a description of each probe, for the conversion report.
+func ApplyProbes(vm *kubevirtv1.VirtualMachine, requests []ProbeRequest) ([]string, error) {
+	var applied []string
+	spec := &vm.Spec.Template.Spec
+	podNetwork := false
+	for _, network := range spec.Networks {
+		podNetwork = podNetwork || network.Pod != nil
+	}
+	for _, request := range requests {
+		if !podNetwork && request.Handler.GuestAgentPing == nil {
+			return nil, fmt.Errorf("probe %s needs an interface on the pod network, use a guest-agent probe", request.Description)
+		}
+		if request.Kind == "" || request.Kind == "readiness" {
+			if spec.ReadinessProbe != nil {
+				return nil, fmt.Errorf("more than one readiness probe given")
+			}
+			spec.ReadinessProbe = &kubevirtv1.Probe{
+				Handler:             request.Handler,
+				InitialDelaySeconds: 10,
+				PeriodSeconds:       10,
+				TimeoutSeconds:      5,
+			}
+			applied = append(applied, "readiness probe "+request.Description)
+		}
+		if request.Kind == "" || request.Kind == "liveness" {
+			if spec.LivenessProbe != nil {
+				return nil, fmt.Errorf("more than one liveness probe given")
+			}
+			spec.LivenessProbe = &kubevirtv1.Probe{
+				Handler:             request.Handler,
+				InitialDelaySeconds: 120,
+				PeriodSeconds:       20,
+				TimeoutSeconds:      5,
+				FailureThreshold:    3,
+			}
+			applied = append(applied, "liveness probe "+request.Description)
+		}
+	}
+	return applied, nil
+}
@@ -0,0 +1,109 @@
+package kubevirt
+
+import (
+	"fmt"
+	"math"
+
+	"vmx2vmi/pkg/vmx"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+// PVCOptions configures the PVC manifests generated by CreatePVCs.
+type PVCOptions struct {
+	// Overhead is the fraction of the virtual capacity added for filesystem overhead on
+	// Filesystem volumes, where the disk is stored as disk.img. Block volumes get the bare capacity.
+	Overhead float64
+	Storage  StorageOptions
+}
+
+// ParseVolumeMode validates a -pvc-volume-mode value.
+func ParseVolumeMode(value string) (corev1.PersistentVolumeMode, error) {
+	switch mode := corev1.PersistentVolumeMode(value); mode {
+	case corev1.PersistentVolumeFilesystem, corev1.PersistentVolumeBlock:
+		return mode, nil
+	}
+	return "", fmt.Errorf("invalid volume mode '%s': must be Filesystem or Block", value)
+}
+
+// ParseAccessMode validates a -pvc-access-mode value.
+func ParseAccessMode(value string) (corev1.PersistentVolumeAccessMode, error) {
+	switch mode := corev1.PersistentVolumeAccessMode(value); mode {
+	case corev1.ReadWriteOnce, corev1.ReadWriteMany, corev1.ReadWriteOncePod:
+		return mode, nil
+	}
+	return "", fmt.Errorf("invalid access mode '%s': must be ReadWriteOnce, ReadWriteMany or ReadWriteOncePod", value)
+}
+
+// CreatePVCs returns a PVC manifest for every regular disk of vm backed by a PersistentVolumeClaim,
+// sized from the VMDK virtual capacity and placed according to the datastore of the disk. Shared
+// disks and raw device mappings are left out, their claims must be bound to storage the cluster
+// already shares.
+func CreatePVCs(vm *kubevirtv1.VirtualMachine, vmxConfig *vmx.VMXConfig, opts PVCOptions) ([]*corev1.PersistentVolumeClaim, error) {
+	if opts.Overhead < 0 {
+		return nil, fmt.Errorf("PVC overhead must not be negative, got %g", opts.Overhead)
+	}
+	primary, ok := primaryDisk(vmxConfig.Disks)
+	if !ok {
+		return nil, fmt.Errorf("the VM has no disk to create a PVC for")
+	}
+
+	claims := make(map[string]string)
+	for _, volume := range vm.Spec.Template.Spec.Volumes {
+		if volume.PersistentVolumeClaim != nil {
+			claims[volume.Name] = volume.PersistentVolumeClaim.ClaimName
+		}
+	}
+
+	var pvcs []*corev1.PersistentVolumeClaim
+	for _, d := range vmxConfig.Disks {
+		if d.RawDeviceMapping != "" || (d.Shared() && d.ID() != primary.ID()) {
+			continue
+		}
+		claimName, ok := claims[diskName(d, primary)]
+		if !ok {
+			continue
+		}
+		if d.CapacityBytes == 0 {
+			return nil, fmt.Errorf("size of disk %s (%s) is unknown, its descriptor must be readable to size the PVC", d.ID(), d.FileName)
+		}
+
+		storage := opts.Storage.forDisk(d)
+		size := float64(d.CapacityBytes)
+		if storage.VolumeMode != corev1.PersistentVolumeBlock {
+			size *= 1 + opts.Overhead
+		}
+		// Round up to whole MiB, storage backends allocate in larger units anyway.
+		mib := int64(math.Ceil(size / (1 << 20)))
+
+		pvc := &corev1.PersistentVolumeClaim{
+			TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "PersistentVolumeClaim"},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      claimName,
+				Namespace: vm.Namespace,
+				Labels:    map[string]string{kubevirtv1.AppLabel: vm.Name},
+			},
+			Spec: corev1.PersistentVolumeClaimSpec{
+				Resources: corev1.VolumeResourceRequirements{
+					Requests: corev1.ResourceList{
+						corev1.ResourceStorage: *resource.NewQuantity(mib<<20, resource.BinarySI),
+					},
+				},
+			},
+		}
+		if storage.AccessMode != "" {
+			pvc.Spec.AccessModes = []corev1.PersistentVolumeAccessMode{storage.AccessMode}
+		}
+		if storage.VolumeMode != "" {
+			pvc.Spec.VolumeMode = Ptr(storage.VolumeMode)
+		}
+		if storage.StorageClass != "" {
+			pvc.Spec.StorageClassName = Ptr(storage.StorageClass)
+		}
+		pvcs = append(pvcs, pvc)
+	}
+	return pvcs, nil
+}
@@ -0,0 +1,103 @@
+package kubevirt
+
+import (
+	"fmt"
+	"strings"
+
+	"vmx2vmi/pkg/vmx"
+
+	corev1 "k8s.io/api/core/v1"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+// RDMMapping tells the converter which cluster-side device backs a raw device mapping.
+// Exactly one of PVCName or HostDiskPath is set.
+type RDMMapping struct {
+	DiskID       string // VMX device identifier, e.g. scsi0:1
+	PVCName      string // Block-mode PVC bound to a PV that points at the same LUN
+	HostDiskPath string // Path of the LUN on the node, e.g. /dev/disk/by-id/wwn-0x...
+}
+
+// ParseRDMMapping parses a -rdm-map value of the form <disk>=pvc:<claim> or <disk>=hostdisk:<path>.
+func ParseRDMMapping(value string) (RDMMapping, error) {
+	diskID, target, ok := strings.Cut(value, "=")
+	if !ok || diskID == "" {
+		return RDMMapping{}, fmt.Errorf("invalid RDM mapping '%s': expected <disk>=pvc:<claim> or <disk>=hostdisk:<path>", value)
+	}
+	kind, ref, ok := strings.Cut(target, ":")
+	if !ok || ref == "" {
+		return RDMMapping{}, fmt.Errorf("invalid RDM mapping target '%s': expected pvc:<claim> or hostdisk:<path>", target)
+	}
+
+	mapping := RDMMapping{DiskID: strings.ToLower(diskID)}
+	switch strings.ToLower(kind) {
+	case "pvc":
+		mapping.PVCName = ref
+	case "hostdisk":
+		mapping.HostDiskPath = ref
+	default:
+		return RDMMapping{}, fmt.Errorf("invalid RDM mapping target kind '%s': must be pvc or hostdisk", kind)
+	}
+	return mapping, nil
+}
+
+// AttachRawDeviceMappings adds a disk and volume to vm for every raw device mapping in disks.
+// Physical-mode RDMs become LUN disks so SCSI commands reach the device, virtual-mode RDMs become
+// regular virtio disks. It fails if an RDM has no mapping, since its data does not live in a VMDK
+// and silently dropping it would produce a VM missing a disk.
+func AttachRawDeviceMappings(vm *kubevirtv1.VirtualMachine, disks []vmx.Disk, mappings []RDMMapping) error {
+	byDisk := make(map[string]RDMMapping, len(mappings))
+	for _, m := range mappings {
+		byDisk[m.DiskID] = m
+	}
+
+	spec := &vm.Spec.Template.Spec
+	for _, d := range disks {
+		if d.RawDeviceMapping == "" {
+			continue
+		}
+		mapping, ok := byDisk[d.ID()]
+		if !ok {
+			return fmt.Errorf("disk %s (%s) is a %s-compatibility raw device mapping: its data lives on a SAN LUN, not in a VMDK, and cannot be copied. "+
+				"Present the same LUN to the cluster and pass -rdm-map %s=pvc:<block-pvc> (a PV with volumeMode Block pointing at the LUN) "+
+				"or -rdm-map %s=hostdisk:/dev/disk/by-id/<wwn>",
+				d.ID(), d.FileName, d.RawDeviceMapping, d.ID(), d.ID())
+		}
+		delete(byDisk, d.ID())
+
+		name := diskName(d, vmx.Disk{})
+		disk := kubevirtv1.Disk{Name: name}
+		if d.RawDeviceMapping == "physical" {
+			disk.DiskDevice = kubevirtv1.DiskDevice{LUN: &kubevirtv1.LunTarget{Bus: "scsi"}}
+		} else {
+			disk.DiskDevice = kubevirtv1.DiskDevice{Disk: &kubevirtv1.DiskTarget{Bus: "virtio"}}
+		}
+		applySharing(&disk, d)
+
+		volume := kubevirtv1.Volume{Name: name}
+		if mapping.PVCName != "" {
+			volume.VolumeSource = kubevirtv1.VolumeSource{
+				PersistentVolumeClaim: &kubevirtv1.PersistentVolumeClaimVolumeSource{
+					PersistentVolumeClaimVolumeSource: corev1.PersistentVolumeClaimVolumeSource{
+						ClaimName: mapping.PVCName,
+					},
+				},
+			}
+		} else {
+			volume.VolumeSource = kubevirtv1.VolumeSource{
+				HostDisk: &kubevirtv1.HostDisk{
+					Path: mapping.HostDiskPath,
+					Type: kubevirtv1.HostDiskExists,
+				},
+			}
+		}
+
+		spec.Domain.Devices.Disks = append(spec.Domain.Devices.Disks, disk)
+		spec.Volumes = append(spec.Volumes, volume)
+	}
+
+	for diskID := range byDisk {
+		return fmt.Errorf("RDM mapping given for %s, but the VMX has no raw device mapping at that slot", diskID)
+	}
+	return nil
+}
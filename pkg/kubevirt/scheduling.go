@@ -0,0 +1,105 @@
+package kubevirt
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"vmx2vmi/pkg/vmx"
+
+	corev1 "k8s.io/api/core/v1"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+// SchedulingOptions controls how vSphere resource allocation settings are translated.
+// The zero value translates nothing.
+type SchedulingOptions struct {
+	// DedicatedCPUsForAffinity requests dedicated CPUs from the CPU manager for VMs pinned
+	// to host CPUs in vSphere (sched.cpu.affinity).
+	DedicatedCPUsForAffinity bool
+	// PriorityClasses maps a CPU share level (low, normal, high) to a PriorityClass name.
+	PriorityClasses map[string]string
+	// PerformanceNodeLabels, when set, is required through node affinity for VMs that had
+	// CPU affinity, high CPU shares or a CPU reservation in vSphere.
+	PerformanceNodeLabels map[string]string
+}
+
+// ParseKeyValueList parses a comma separated list of key=value pairs.
+func ParseKeyValueList(value string) (map[string]string, error) {
+	pairs := make(map[string]string)
+	if value == "" {
+		return pairs, nil
+	}
+	for _, item := range strings.Split(value, ",") {
+		k, v, ok := strings.Cut(item, "=")
+		k = strings.TrimSpace(k)
+		if !ok || k == "" {
+			return nil, fmt.Errorf("invalid key=value pair '%s'", item)
+		}
+		pairs[k] = strings.TrimSpace(v)
+	}
+	return pairs, nil
+}
+
+// ApplySchedulingHints translates CPU affinity, shares and reservations into CPU manager,
+// PriorityClass and node affinity settings according to opts. It returns a description of
+// each setting applied, for the conversion report.
+func ApplySchedulingHints(vm *kubevirtv1.VirtualMachine, vmxConfig *vmx.VMXConfig, opts SchedulingOptions) []string {
+	var applied []string
+	spec := &vm.Spec.Template.Spec
+	sched := vmxConfig.Scheduling
+	level := vmxConfig.CPUShareLevel()
+
+	if sched.CPUAffinity != "" && opts.DedicatedCPUsForAffinity {
+		if spec.Domain.CPU == nil {
+			spec.Domain.CPU = &kubevirtv1.CPU{}
+		}
+		spec.Domain.CPU.DedicatedCPUPlacement = true
+		applied = append(applied, fmt.Sprintf("sched.cpu.affinity=%q -> dedicatedCpuPlacement (CPU manager)", sched.CPUAffinity))
+	}
+
+	if className := opts.PriorityClasses[level]; className != "" {
+		spec.PriorityClassName = className
+		applied = append(applied, fmt.Sprintf("CPU shares %s -> priorityClassName %s", level, className))
+	}
+
+	performanceTier := sched.CPUAffinity != "" || level == "high" || sched.CPUMinMHz > 0
+	if performanceTier && len(opts.PerformanceNodeLabels) > 0 {
+		keys := make([]string, 0, len(opts.PerformanceNodeLabels))
+		for k := range opts.PerformanceNodeLabels {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		var expressions []corev1.NodeSelectorRequirement
+		for _, k := range keys {
+			expressions = append(expressions, corev1.NodeSelectorRequirement{
+				Key:      k,
+				Operator: corev1.NodeSelectorOpIn,
+				Values:   []string{opts.PerformanceNodeLabels[k]},
+			})
+		}
+		if spec.Affinity == nil {
+			spec.Affinity = &corev1.Affinity{}
+		}
+		if spec.Affinity.NodeAffinity == nil {
+			spec.Affinity.NodeAffinity = &corev1.NodeAffinity{}
+		}
+		required := spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution
+		if required == nil {
+			required = &corev1.NodeSelector{}
+			spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = required
+		}
+		if len(required.NodeSelectorTerms) == 0 {
+			required.NodeSelectorTerms = []corev1.NodeSelectorTerm{{}}
+		}
+		// Terms are ORed; add the requirements to every term so they always apply.
+		for i := range required.NodeSelectorTerms {
+			required.NodeSelectorTerms[i].MatchExpressions = append(required.NodeSelectorTerms[i].MatchExpressions, expressions...)
+		}
+		applied = append(applied, fmt.Sprintf("performance tier (affinity=%q, shares=%s, reservation=%dMHz) -> required node labels %v",
+			sched.CPUAffinity, level, sched.CPUMinMHz, opts.PerformanceNodeLabels))
+	}
+
+	return applied
+}
@@ -0,0 +1,59 @@
+package kubevirt
+
+import (
+	"strings"
+
+	"vmx2vmi/pkg/vmx"
+
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+// diskName returns the name of the KubeVirt disk generated for a VMX disk.
+func diskName(d vmx.Disk, primary vmx.Disk) string {
+	switch {
+	case d.RawDeviceMapping != "":
+		return "rdm-" + strings.ReplaceAll(d.ID(), ":", "-")
+	case d.ID() == primary.ID():
+		return "disk0"
+	case d.Shared():
+		return "shared-" + strings.ReplaceAll(d.ID(), ":", "-")
+	}
+	return "data-" + strings.ReplaceAll(d.ID(), ":", "-")
+}
+
+// ApplyDiskSerials sets each disk's serial to its VMDK ddb.uuid when the VMX has disk.EnableUUID
+// set, so guests that mount filesystems by WWN or serial still find their disks. virtio-blk
+// exposes only the first 20 characters of a serial to the guest; SCSI exposes all of them.
+func ApplyDiskSerials(vm *kubevirtv1.VirtualMachine, vmxConfig *vmx.VMXConfig) {
+	if !vmxConfig.DiskEnableUUID {
+		return
+	}
+	primary, _ := primaryDisk(vmxConfig.Disks)
+	devices := vm.Spec.Template.Spec.Domain.Devices.Disks
+	for _, d := range vmxConfig.Disks {
+		if d.Descriptor == nil {
+			continue
+		}
+		uuid := d.Descriptor.UUID()
+		name := diskName(d, primary)
+		if uuid == "" {
+			continue
+		}
+		for i := range devices {
+			if devices[i].Name == name {
+				devices[i].Serial = uuid
+			}
+		}
+	}
+}
+
+// DiskNames returns the name of the KubeVirt disk generated for each VMX disk, keyed by its device
+// identifier, e.g. scsi0:1.
+func DiskNames(disks []vmx.Disk) map[string]string {
+	primary, _ := primaryDisk(disks)
+	names := make(map[string]string, len(disks))
+	for _, d := range disks {
+		names[d.ID()] = diskName(d, primary)
+	}
+	return names
+}
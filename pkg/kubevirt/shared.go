@@ -0,0 +1,106 @@
+package kubevirt
+
+import (
+	"fmt"
+	"strings"
+
+	"vmx2vmi/pkg/vmx"
+
+	corev1 "k8s.io/api/core/v1"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+// ParseSharedDiskMapping parses a -shared-disk-map value of the form <disk>=<claim>.
+func ParseSharedDiskMapping(value string) (diskID string, claimName string, err error) {
+	diskID, claimName, ok := strings.Cut(value, "=")
+	if !ok || diskID == "" || claimName == "" {
+		return "", "", fmt.Errorf("invalid shared disk mapping '%s': expected <disk>=<claim>", value)
+	}
+	return strings.ToLower(diskID), claimName, nil
+}
+
+// primaryDisk returns the VMX disk backing disk0, i.e. the first disk that is not a raw device mapping.
+func primaryDisk(disks []vmx.Disk) (vmx.Disk, bool) {
+	for _, d := range disks {
+		if d.RawDeviceMapping == "" {
+			return d, true
+		}
+	}
+	return vmx.Disk{}, false
+}
+
+// applySharing marks disk as shareable when the source disk is shared between VMs.
+// Disks on a physically shared bus (cross-host clusters such as WSFC) become SCSI LUNs with
+// persistent reservation support, which requires the PersistentReservation feature gate.
+func applySharing(disk *kubevirtv1.Disk, d vmx.Disk) {
+	if !d.Shared() {
+		return
+	}
+	disk.Shareable = Ptr(true)
+	disk.Cache = kubevirtv1.CacheNone
+	if strings.EqualFold(d.SharedBus, "physical") {
+		if disk.LUN == nil {
+			disk.DiskDevice = kubevirtv1.DiskDevice{LUN: &kubevirtv1.LunTarget{Bus: "scsi"}}
+		}
+		disk.LUN.Reservation = true
+	}
+}
+
+// AttachSharedDisks converts disks shared by clustered guests (multi-writer or shared SCSI bus)
+// into shareable KubeVirt disks. The primary disk is updated in place; every other shared disk
+// must be mapped to a ReadWriteMany block PVC through claims, otherwise an error is returned
+// rather than producing a VM with a private copy of a disk the cluster expects to share.
+// Raw device mappings are handled by AttachRawDeviceMappings.
+func AttachSharedDisks(vm *kubevirtv1.VirtualMachine, disks []vmx.Disk, claims map[string]string) error {
+	spec := &vm.Spec.Template.Spec
+	primary, hasPrimary := primaryDisk(disks)
+
+	for _, d := range disks {
+		if !d.Shared() || d.RawDeviceMapping != "" {
+			continue
+		}
+		if hasPrimary && d.ID() == primary.ID() {
+			for i := range spec.Domain.Devices.Disks {
+				if spec.Domain.Devices.Disks[i].Name == "disk0" {
+					applySharing(&spec.Domain.Devices.Disks[i], d)
+				}
+			}
+			continue
+		}
+
+		claimName, ok := claims[d.ID()]
+		if !ok {
+			return fmt.Errorf("disk %s (%s) is shared between VMs (sharing=%q, sharedBus=%q), typically for a WSFC or Oracle RAC cluster. "+
+				"Import it into a ReadWriteMany PVC with volumeMode Block and pass -shared-disk-map %s=<claim>; "+
+				"converting it as a regular disk would break the cluster",
+				d.ID(), d.FileName, d.Sharing, d.SharedBus, d.ID())
+		}
+		delete(claims, d.ID())
+
+		name := diskName(d, primary)
+		disk := kubevirtv1.Disk{
+			Name: name,
+			DiskDevice: kubevirtv1.DiskDevice{
+				Disk: &kubevirtv1.DiskTarget{Bus: "virtio"},
+			},
+		}
+		applySharing(&disk, d)
+
+		spec.Domain.Devices.Disks = append(spec.Domain.Devices.Disks, disk)
+		spec.Volumes = append(spec.Volumes, kubevirtv1.Volume{
+			Name: name,
+			VolumeSource: kubevirtv1.VolumeSource{
+				PersistentVolumeClaim: &kubevirtv1.PersistentVolumeClaimVolumeSource{
+					PersistentVolumeClaimVolumeSource: corev1.PersistentVolumeClaimVolumeSource{
+						ClaimName: claimName,
+					},
+				},
+			},
+		})
+	}
+
+	for diskID := range claims {
+		return fmt.Errorf("shared disk mapping given for %s, but the VMX has no shared disk at that slot", diskID)
+	}
+	return nil
+}
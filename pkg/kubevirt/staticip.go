@@ -0,0 +1,165 @@
+package kubevirt
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+
+	"vmx2vmi/pkg/failure"
+	"vmx2vmi/pkg/vmx"
+
+	kubevirtv1 "kubevirt.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// IPConfig is the IP configuration of the guest in vSphere, read from a YAML or JSON file so
+// servers with static addresses come up with the same addresses in the cluster.
+type IPConfig struct {
+	Interfaces []InterfaceIP `json:"interfaces"`
+}
+
+// InterfaceIP is the static configuration of one network adapter.
+type InterfaceIP struct {
+	// Adapter is the VMX adapter name, e.g. ethernet0.
+	Adapter string `json:"adapter"`
+	// Addresses are the addresses in CIDR notation, e.g. 10.1.20.15/24.
+	Addresses []string `json:"addresses"`
+	// Gateways are the default gateways, at most one per address family.
+	Gateways    []string `json:"gateways,omitempty"`
+	Nameservers []string `json:"nameservers,omitempty"`
+	Search      []string `json:"search,omitempty"`
+	MTU         int      `json:"mtu,omitempty"`
+}
+
+// LoadIPConfig reads and validates an IP configuration file.
+func LoadIPConfig(path string) (*IPConfig, error) {
+	config, err := loadIPConfig(path)
+	return config, failure.Wrap(failure.Parse, err)
+}
+
+func loadIPConfig(path string) (*IPConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read IP configuration: %w", err)
+	}
+	var c IPConfig
+	if err := yaml.UnmarshalStrict(data, &c); err != nil {
+		return nil, fmt.Errorf("failed to parse IP configuration %s: %w", path, err)
+	}
+	seen := make(map[string]bool)
+	for i := range c.Interfaces {
+		entry := &c.Interfaces[i]
+		entry.Adapter = strings.ToLower(entry.Adapter)
+		if entry.Adapter == "" || len(entry.Addresses) == 0 {
+			return nil, fmt.Errorf("IP configuration %s: every interface needs an adapter and addresses", path)
+		}
+		if seen[entry.Adapter] {
+			return nil, fmt.Errorf("IP configuration %s: adapter %s is configured twice", path, entry.Adapter)
+		}
+		seen[entry.Adapter] = true
+		for _, address := range entry.Addresses {
+			if _, err := netip.ParsePrefix(address); err != nil {
+				return nil, fmt.Errorf("IP configuration %s, adapter %s: invalid address '%s', expected CIDR notation such as 10.1.20.15/24", path, entry.Adapter, address)
+			}
+		}
+		families := make(map[bool]bool)
+		for _, gateway := range entry.Gateways {
+			ip, err := netip.ParseAddr(gateway)
+			if err != nil {
+				return nil, fmt.Errorf("IP configuration %s, adapter %s: invalid gateway '%s'", path, entry.Adapter, gateway)
+			}
+			if families[ip.Is4()] {
+				return nil, fmt.Errorf("IP configuration %s, adapter %s: more than one gateway for the same address family", path, entry.Adapter)
+			}
+			families[ip.Is4()] = true
+		}
+		for _, nameserver := range entry.Nameservers {
+			if _, err := netip.ParseAddr(nameserver); err != nil {
+				return nil, fmt.Errorf("IP configuration %s, adapter %s: invalid nameserver '%s'", path, entry.Adapter, nameserver)
+			}
+		}
+	}
+	return &c, nil
+}
+
+// ApplyStaticIPs renders the addresses of ipConfig as a cloud-init network configuration
+// (version 2) and attaches it to vm. Each configured interface is matched in the guest by its
+// MAC address, so the VM interface keeps the MAC address of the VMware adapter; the guest
+// interface name usually changes with the new PCI layout. Static addresses need a layer 2
+// network, so adapters on the pod network behind masquerade cannot be configured. It returns a
+// description of each configured adapter, for the conversion report.
+func ApplyStaticIPs(vm *kubevirtv1.VirtualMachine, vmxConfig *vmx.VMXConfig, ipConfig *IPConfig) ([]string, error) {
+	if ipConfig == nil || len(ipConfig.Interfaces) == 0 {
+		return nil, nil
+	}
+	nics := make(map[string]vmx.NIC, len(vmxConfig.NICs))
+	for _, nic := range vmxConfig.NICs {
+		nics[nicName(nic)] = nic
+	}
+
+	var applied []string
+	ethernets := make(map[string]any)
+	interfaces := vm.Spec.Template.Spec.Domain.Devices.Interfaces
+	for _, entry := range ipConfig.Interfaces {
+		nic, ok := nics[entry.Adapter]
+		if !ok {
+			return nil, fmt.Errorf("IP configuration given for %s, but the VMX has no such network adapter", entry.Adapter)
+		}
+		if nic.MACAddress == "" {
+			return nil, fmt.Errorf("network adapter %s has no MAC address in the VMX to match it in the guest", entry.Adapter)
+		}
+		var iface *kubevirtv1.Interface
+		for i := range interfaces {
+			if interfaces[i].Name == entry.Adapter {
+				iface = &interfaces[i]
+			}
+		}
+		if iface == nil {
+			return nil, fmt.Errorf("network adapter %s is on the pod network or skipped, static addresses need a bridge, sriov or macvtap binding to a Multus network", entry.Adapter)
+		}
+		mac := strings.ToLower(nic.MACAddress)
+		iface.MacAddress = mac
+
+		ethernet := map[string]any{
+			"match":     map[string]any{"macaddress": mac},
+			"addresses": entry.Addresses,
+		}
+		var routes []map[string]any
+		for _, gateway := range entry.Gateways {
+			to := "0.0.0.0/0"
+			if netip.MustParseAddr(gateway).Is6() {
+				to = "::/0"
+			}
+			routes = append(routes, map[string]any{"to": to, "via": gateway})
+		}
+		if len(routes) > 0 {
+			ethernet["routes"] = routes
+		}
+		if len(entry.Nameservers) > 0 || len(entry.Search) > 0 {
+			nameservers := make(map[string]any)
+			if len(entry.Nameservers) > 0 {
+				nameservers["addresses"] = entry.Nameservers
+			}
+			if len(entry.Search) > 0 {
+				nameservers["search"] = entry.Search
+			}
+			ethernet["nameservers"] = nameservers
+		}
+		if entry.MTU > 0 {
+			ethernet["mtu"] = entry.MTU
+		}
+		ethernets[entry.Adapter] = ethernet
+		applied = append(applied, fmt.Sprintf("%s keeps MAC address %s and static address(es) %s through cloud-init",
+			entry.Adapter, mac, strings.Join(entry.Addresses, ", ")))
+	}
+
+	data, err := yaml.Marshal(map[string]any{"version": 2, "ethernets": ethernets})
+	if err != nil {
+		return nil, err
+	}
+	if err := AttachCloudInitNetworkData(vm, string(data)); err != nil {
+		return nil, fmt.Errorf("failed to add the static addresses: %w", err)
+	}
+	return applied, nil
+}
@@ -0,0 +1,126 @@
+package kubevirt
+
+import (
+	"cmp"
+	"fmt"
+	"os"
+	"strings"
+
+	"vmx2vmi/pkg/failure"
+	"vmx2vmi/pkg/vmx"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// StorageMap translates VMware datastores to the StorageClass, volume mode and access mode of
+// the PVCs and DataVolumes holding their disks. It is read from a YAML or JSON file so batch
+// migrations keep the storage tiering of the VMware side.
+type StorageMap struct {
+	Datastores []DatastoreMapping `json:"datastores"`
+}
+
+// DatastoreMapping maps one datastore. Empty fields keep the value given on the command line.
+type DatastoreMapping struct {
+	// Datastore is the datastore name, matched exactly, or "*" for every unlisted datastore.
+	Datastore    string                            `json:"datastore"`
+	StorageClass string                            `json:"storageClass,omitempty"`
+	VolumeMode   corev1.PersistentVolumeMode       `json:"volumeMode,omitempty"`
+	AccessMode   corev1.PersistentVolumeAccessMode `json:"accessMode,omitempty"`
+}
+
+// StorageOptions selects the storage of the claims generated for the VM disks.
+type StorageOptions struct {
+	// StorageClass, VolumeMode and AccessMode apply to disks the map does not cover. Empty
+	// values are left out of the claims, so the cluster or CDI storage profile decides.
+	StorageClass string
+	VolumeMode   corev1.PersistentVolumeMode
+	AccessMode   corev1.PersistentVolumeAccessMode
+	// Map translates datastores, nil to apply the values above to every disk.
+	Map *StorageMap
+	// Datastore is the datastore of the VM directory, for disks the VMX references by a relative path.
+	Datastore string
+}
+
+// LoadStorageMap reads and validates a storage mapping file.
+func LoadStorageMap(path string) (*StorageMap, error) {
+	m, err := loadStorageMap(path)
+	return m, failure.Wrap(failure.Parse, err)
+}
+
+func loadStorageMap(path string) (*StorageMap, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read storage map: %w", err)
+	}
+	var m StorageMap
+	if err := yaml.UnmarshalStrict(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to parse storage map %s: %w", path, err)
+	}
+	seen := make(map[string]bool)
+	for _, entry := range m.Datastores {
+		if entry.Datastore == "" {
+			return nil, fmt.Errorf("storage map %s: every entry needs a datastore", path)
+		}
+		if seen[entry.Datastore] {
+			return nil, fmt.Errorf("storage map %s: datastore %q is mapped twice", path, entry.Datastore)
+		}
+		seen[entry.Datastore] = true
+		if entry.VolumeMode != "" {
+			if _, err := ParseVolumeMode(string(entry.VolumeMode)); err != nil {
+				return nil, fmt.Errorf("storage map %s, datastore %q: %w", path, entry.Datastore, err)
+			}
+		}
+		if entry.AccessMode != "" {
+			if _, err := ParseAccessMode(string(entry.AccessMode)); err != nil {
+				return nil, fmt.Errorf("storage map %s, datastore %q: %w", path, entry.Datastore, err)
+			}
+		}
+	}
+	return &m, nil
+}
+
+// DatastoreOf returns the datastore holding fileName, taken from a "[datastore] path" reference
+// or a /vmfs/volumes/<datastore>/ path, or defaultDatastore for paths relative to the VM directory.
+func DatastoreOf(fileName, defaultDatastore string) string {
+	if rest, ok := strings.CutPrefix(fileName, "["); ok {
+		if datastore, _, ok := strings.Cut(rest, "]"); ok {
+			return datastore
+		}
+	}
+	if rest, ok := strings.CutPrefix(fileName, "/vmfs/volumes/"); ok {
+		datastore, _, _ := strings.Cut(rest, "/")
+		return datastore
+	}
+	if strings.HasPrefix(fileName, "/") {
+		return ""
+	}
+	return defaultDatastore
+}
+
+// forDisk returns the storage settings of the claim holding d.
+func (o StorageOptions) forDisk(d vmx.Disk) DatastoreMapping {
+	datastore := DatastoreOf(d.FileName, o.Datastore)
+	result := DatastoreMapping{Datastore: datastore, StorageClass: o.StorageClass, VolumeMode: o.VolumeMode, AccessMode: o.AccessMode}
+	if o.Map == nil {
+		return result
+	}
+	var entry, fallback *DatastoreMapping
+	for i := range o.Map.Datastores {
+		switch o.Map.Datastores[i].Datastore {
+		case datastore:
+			entry = &o.Map.Datastores[i]
+		case "*":
+			fallback = &o.Map.Datastores[i]
+		}
+	}
+	if entry == nil {
+		entry = fallback
+	}
+	if entry != nil {
+		result.StorageClass = cmp.Or(entry.StorageClass, result.StorageClass)
+		result.VolumeMode = cmp.Or(entry.VolumeMode, result.VolumeMode)
+		result.AccessMode = cmp.Or(entry.AccessMode, result.AccessMode)
+	}
+	return result
+}
@@ -0,0 +1,59 @@
+package kubevirt
+
+import (
+	"fmt"
+
+	"vmx2vmi/pkg/vmx"
+
+	corev1 "k8s.io/api/core/v1"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+// sysprepVolume is the name of the sysprep disk and volume.
+const sysprepVolume = "sysprep"
+
+// SysprepOptions names the ConfigMap or Secret holding the Windows answer file, autounattend.xml
+// or unattend.xml, attached to the VM. At most one may be set.
+type SysprepOptions struct {
+	ConfigMap string
+	Secret    string
+}
+
+// ApplySysprep attaches the sysprep answer file of opts to vm as a CD-ROM, which Windows Setup
+// reads when the guest was generalized with sysprep before the migration. Only Windows guests,
+// detected from guestOS, can use it. It returns a description of the attached volume, for the
+// conversion report.
+func ApplySysprep(vm *kubevirtv1.VirtualMachine, vmxConfig *vmx.VMXConfig, opts SysprepOptions) ([]string, error) {
+	if opts.ConfigMap == "" && opts.Secret == "" {
+		return nil, nil
+	}
+	if opts.ConfigMap != "" && opts.Secret != "" {
+		return nil, fmt.Errorf("the sysprep answer file comes from either a ConfigMap or a Secret, not both")
+	}
+	if vmxConfig.GuestOSFamily() != "windows" {
+		return nil, fmt.Errorf("sysprep only applies to Windows guests, guest OS is '%s'", vmxConfig.GuestOS)
+	}
+
+	source := &kubevirtv1.SysprepSource{}
+	var description string
+	if opts.ConfigMap != "" {
+		source.ConfigMap = &corev1.LocalObjectReference{Name: opts.ConfigMap}
+		description = "ConfigMap " + opts.ConfigMap
+	} else {
+		source.Secret = &corev1.LocalObjectReference{Name: opts.Secret}
+		description = "Secret " + opts.Secret
+	}
+
+	spec := &vm.Spec.Template.Spec
+	spec.Domain.Devices.Disks = append(spec.Domain.Devices.Disks, kubevirtv1.Disk{
+		Name: sysprepVolume,
+		DiskDevice: kubevirtv1.DiskDevice{
+			CDRom: &kubevirtv1.CDRomTarget{Bus: kubevirtv1.DiskBusSATA},
+		},
+	})
+	spec.Volumes = append(spec.Volumes, kubevirtv1.Volume{
+		Name:         sysprepVolume,
+		VolumeSource: kubevirtv1.VolumeSource{Sysprep: source},
+	})
+	return []string{fmt.Sprintf("sysprep answer file from %s attached as a SATA CD-ROM", description)}, nil
+}
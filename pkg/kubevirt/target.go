@@ -0,0 +1,156 @@
+package kubevirt
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"vmx2vmi/pkg/cluster"
+
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+// Version is a KubeVirt release, as major.minor.
+type Version struct {
+	Major, Minor int
+}
+
+// ParseVersion parses a KubeVirt version such as v1.2 or 1.2.3; the patch release is ignored.
+func ParseVersion(value string) (Version, error) {
+	parts := strings.SplitN(strings.TrimPrefix(value, "v"), ".", 3)
+	if len(parts) < 2 {
+		return Version{}, fmt.Errorf("invalid KubeVirt version '%s': must be <major>.<minor>, e.g. 1.2", value)
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return Version{}, fmt.Errorf("invalid KubeVirt version '%s': %w", value, err)
+	}
+	// Pre-releases and builds, e.g. 1.3.0-rc.1, keep the leading digits of the minor release.
+	digits := parts[1]
+	if i := strings.IndexFunc(digits, func(r rune) bool { return r < '0' || r > '9' }); i >= 0 {
+		digits = digits[:i]
+	}
+	minor, err := strconv.Atoi(digits)
+	if err != nil {
+		return Version{}, fmt.Errorf("invalid KubeVirt version '%s': %w", value, err)
+	}
+	return Version{Major: major, Minor: minor}, nil
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+}
+
+// Before reports whether v is older than major.minor.
+func (v Version) Before(major, minor int) bool {
+	return v.Major < major || (v.Major == major && v.Minor < minor)
+}
+
+// Target is the KubeVirt installation the manifests are generated for.
+type Target struct {
+	Version Version
+	// FeatureGates are the feature gates enabled in the KubeVirt CR, nil when unknown. Gates
+	// enabled by default in the release are not listed.
+	FeatureGates map[string]bool
+	// BindingPlugins are the network binding plugins registered in the KubeVirt CR, nil when unknown.
+	BindingPlugins map[string]bool
+}
+
+// DetectTarget reads the version, feature gates and network binding plugins of the KubeVirt
+// installation of the cluster from its KubeVirt CR.
+func DetectTarget(ctx context.Context, client *cluster.Client) (*Target, error) {
+	var list kubevirtv1.KubeVirtList
+	if err := client.Get(ctx, "/apis/kubevirt.io/v1/kubevirts", &list); err != nil {
+		return nil, fmt.Errorf("failed to read the KubeVirt CR: %w", err)
+	}
+	if len(list.Items) == 0 {
+		return nil, fmt.Errorf("KubeVirt is not installed: no KubeVirt CR found")
+	}
+	kv := list.Items[0]
+	if kv.Status.ObservedKubeVirtVersion == "" {
+		return nil, fmt.Errorf("KubeVirt %s/%s does not report its version yet (phase %s)", kv.Namespace, kv.Name, kv.Status.Phase)
+	}
+	version, err := ParseVersion(kv.Status.ObservedKubeVirtVersion)
+	if err != nil {
+		return nil, err
+	}
+	target := &Target{Version: version, FeatureGates: make(map[string]bool), BindingPlugins: make(map[string]bool)}
+	if dev := kv.Spec.Configuration.DeveloperConfiguration; dev != nil {
+		for _, gate := range dev.FeatureGates {
+			target.FeatureGates[gate] = true
+		}
+	}
+	if network := kv.Spec.Configuration.NetworkConfiguration; network != nil {
+		for name := range network.Binding {
+			target.BindingPlugins[name] = true
+		}
+	}
+	return target, nil
+}
+
+// ApplyTarget adapts vm to the KubeVirt release of target. Fields with an older form in the
+// release are rewritten to it, e.g. the macvtap binding plugin to the core macvtap binding before
+// KubeVirt 1.1; fields the release does not know fail the conversion, as the API server would
+// reject or drop them. pool tells that the VM is wrapped into a VirtualMachinePool. It returns
+// the rewritten fields, for the conversion report, and the feature gates the VM needs; gates
+// known to be missing from the cluster are reported in warnings.
+func ApplyTarget(vm *kubevirtv1.VirtualMachine, pool bool, target Target) (mappings, gates, warnings []string, err error) {
+	v := target.Version
+	spec := &vm.Spec.Template.Spec
+	requireGate := func(gate, reason string) {
+		gates = append(gates, fmt.Sprintf("enable %s in spec.configuration.developerConfiguration.featureGates of the KubeVirt CR for %s", gate, reason))
+		if target.FeatureGates != nil && !target.FeatureGates[gate] {
+			warnings = append(warnings, fmt.Sprintf("%s needs the %s feature gate, which the KubeVirt CR does not enable", reason, gate))
+		}
+	}
+
+	if vm.Spec.Instancetype != nil || vm.Spec.Preference != nil {
+		if v.Before(1, 0) {
+			return nil, nil, nil, fmt.Errorf("instancetype.kubevirt.io/v1beta1 instancetypes need KubeVirt 1.0 or later, not %s; drop -use-instancetype", v)
+		}
+	}
+	if spec.EvictionStrategy != nil && *spec.EvictionStrategy == kubevirtv1.EvictionStrategyLiveMigrateIfPossible && v.Before(1, 0) {
+		return nil, nil, nil, fmt.Errorf("eviction strategy LiveMigrateIfPossible needs KubeVirt 1.0 or later, not %s", v)
+	}
+	if threads := spec.Domain.IOThreadsPolicy; threads != nil && *threads == kubevirtv1.IOThreadsPolicySupplementalPool && v.Before(1, 4) {
+		return nil, nil, nil, fmt.Errorf("IOThreads policy supplementalPool needs KubeVirt 1.4 or later, not %s", v)
+	}
+
+	for i := range spec.Domain.Devices.Interfaces {
+		iface := &spec.Domain.Devices.Interfaces[i]
+		if iface.Binding == nil || iface.Binding.Name != "macvtap" {
+			continue
+		}
+		if v.Before(1, 1) {
+			iface.Binding = nil
+			iface.InterfaceBindingMethod = kubevirtv1.InterfaceBindingMethod{DeprecatedMacvtap: &kubevirtv1.DeprecatedInterfaceMacvtap{}}
+			mappings = append(mappings, fmt.Sprintf("interface %s: macvtap binding plugin -> core macvtap binding of KubeVirt %s", iface.Name, v))
+			requireGate("Macvtap", "the macvtap binding of interface "+iface.Name)
+			continue
+		}
+		if target.BindingPlugins != nil && !target.BindingPlugins["macvtap"] {
+			return nil, nil, nil, fmt.Errorf("interface %s uses the macvtap network binding plugin, which is not registered in spec.configuration.network.binding of the KubeVirt CR", iface.Name)
+		}
+		if v.Before(1, 4) {
+			requireGate("NetworkBindingPlugins", "the macvtap binding plugin of interface "+iface.Name)
+		}
+	}
+
+	for _, fs := range spec.Domain.Devices.Filesystems {
+		if v.Before(1, 5) {
+			requireGate("ExperimentalVirtiofsSupport", "the virtiofs filesystem "+fs.Name)
+			continue
+		}
+		for _, volume := range spec.Volumes {
+			if volume.Name == fs.Name && (volume.PersistentVolumeClaim != nil || volume.DataVolume != nil) {
+				requireGate("EnableVirtioFsStorageVolumes", "the virtiofs filesystem "+fs.Name)
+			}
+		}
+	}
+
+	if pool {
+		requireGate("VMPool", "the VirtualMachinePool")
+	}
+	return mappings, gates, warnings, nil
+}
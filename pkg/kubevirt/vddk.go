@@ -0,0 +1,87 @@
+package kubevirt
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"vmx2vmi/pkg/vmx"
+
+	kubevirtv1 "kubevirt.io/api/core/v1"
+	cdiv1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
+)
+
+// VDDKSource describes how CDI reaches vSphere to import disks with its VDDK source.
+type VDDKSource struct {
+	URL string // vCenter or ESXi SDK endpoint, e.g. https://vcenter.example.com/sdk
+	// SecretRef names the Secret holding the vSphere user (accessKeyId) and password (secretKey).
+	SecretRef string
+	// Thumbprint is the SHA-1 fingerprint of the endpoint certificate, empty to skip pinning.
+	Thumbprint string
+	// InitImageURL is the image carrying the VDDK library, empty to use the v2v-vmware ConfigMap.
+	InitImageURL string
+	// DatastorePath locates the VM directory, e.g. "[datastore1] vmlin01", for relative disk file names.
+	DatastorePath string
+	// VMUUID identifies the VM in vSphere, empty to use the VMX uuid.bios.
+	VMUUID string
+}
+
+// ApplyVDDKSource replaces the PVCs of the regular disks with DataVolume templates importing
+// each disk from vSphere through CDI's VDDK source. Each DataVolume takes the name of the PVC it
+// replaces. CDI looks the VM up by its BIOS UUID and opens each disk by its datastore backing file.
+func ApplyVDDKSource(vm *kubevirtv1.VirtualMachine, vmxConfig *vmx.VMXConfig, src VDDKSource, storage StorageOptions) ([]ImportedDisk, error) {
+	uuid := src.VMUUID
+	if uuid == "" {
+		biosUUID, _ := vmxConfig.Get("uuid.bios")
+		var err error
+		if uuid, err = formatVMwareUUID(biosUUID); err != nil {
+			return nil, fmt.Errorf("uuid.bios: %w, pass the VM BIOS UUID with -vddk-vm-uuid", err)
+		}
+	}
+	return applyDataVolumeTemplates(vm, vmxConfig, "vddk", storage, func(d vmx.Disk) (*cdiv1.DataVolumeSource, error) {
+		backingFile, err := datastoreBackingFile(d.FileName, src.DatastorePath)
+		if err != nil {
+			return nil, fmt.Errorf("disk %s: %w", d.ID(), err)
+		}
+		return &cdiv1.DataVolumeSource{
+			VDDK: &cdiv1.DataVolumeSourceVDDK{
+				URL:          src.URL,
+				UUID:         uuid,
+				BackingFile:  backingFile,
+				Thumbprint:   src.Thumbprint,
+				SecretRef:    src.SecretRef,
+				InitImageURL: src.InitImageURL,
+			},
+		}, nil
+	})
+}
+
+// formatVMwareUUID converts a VMX UUID ("56 4d 6a 9b 1a 2b 3c 4d-5e 6f 70 81 92 a3 b4 c5")
+// to its canonical form ("564d6a9b-1a2b-3c4d-5e6f-708192a3b4c5").
+func formatVMwareUUID(value string) (string, error) {
+	hex := strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(value))
+	if len(hex) != 32 || strings.Trim(hex, "0123456789abcdef") != "" {
+		return "", fmt.Errorf("invalid or missing UUID %q", value)
+	}
+	return hex[0:8] + "-" + hex[8:12] + "-" + hex[12:16] + "-" + hex[16:20] + "-" + hex[20:], nil
+}
+
+// datastoreBackingFile returns the "[datastore] dir/file.vmdk" path of a VMX disk file name.
+// Absolute /vmfs/volumes paths carry the datastore; relative names are resolved against
+// datastorePath, the VM directory.
+func datastoreBackingFile(fileName, datastorePath string) (string, error) {
+	if strings.HasPrefix(fileName, "[") {
+		return fileName, nil
+	}
+	if rest, ok := strings.CutPrefix(fileName, "/vmfs/volumes/"); ok {
+		datastore, file, ok := strings.Cut(rest, "/")
+		if !ok {
+			return "", fmt.Errorf("invalid datastore path %s", fileName)
+		}
+		return fmt.Sprintf("[%s] %s", datastore, file), nil
+	}
+	if datastorePath == "" {
+		return "", fmt.Errorf("%s is relative to the VM directory, pass its datastore path with -vddk-datastore-path (e.g. \"[datastore1] %s\")", fileName, strings.TrimSuffix(fileName, path.Ext(fileName)))
+	}
+	return strings.TrimSuffix(datastorePath, "/") + "/" + fileName, nil
+}
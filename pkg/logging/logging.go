@@ -0,0 +1,179 @@
+// Package logging sets up the leveled log of vmx2vmi on log/slog, as text lines in the format of
+// the standard logger or as JSON objects for automation parsing the log, and logs formatted
+// messages through it. Packages log through slog, and return their errors instead of exiting.
+package logging
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Formats of Setup.
+const (
+	Text = "text"
+	JSON = "json"
+)
+
+// ParseLevel returns the level named debug, info, warn or error.
+func ParseLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return 0, fmt.Errorf("invalid log level '%s', must be debug, info, warn or error", name)
+	}
+	return level, nil
+}
+
+// Setup makes the default slog logger, and with it the standard logger, write the messages of
+// level and above to w in format: text lines, prefixed with the time like those of the standard
+// logger and with the level, or JSON objects with the time, level, message and attributes.
+func Setup(w io.Writer, level, format string) error {
+	l, err := ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	var handler slog.Handler
+	switch format {
+	case Text:
+		handler = &textHandler{mu: &sync.Mutex{}, w: w, level: l}
+	case JSON:
+		handler = slog.NewJSONHandler(w, &slog.HandlerOptions{Level: l})
+	default:
+		return fmt.Errorf("invalid log format '%s', must be text or json", format)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// Debugf logs a formatted message at the debug level.
+func Debugf(format string, args ...any) {
+	logf(slog.LevelDebug, format, args...)
+}
+
+// Infof logs a formatted message at the info level.
+func Infof(format string, args ...any) {
+	logf(slog.LevelInfo, format, args...)
+}
+
+// Warnf logs a formatted message at the warn level.
+func Warnf(format string, args ...any) {
+	logf(slog.LevelWarn, format, args...)
+}
+
+// Errorf logs a formatted message at the error level.
+func Errorf(format string, args ...any) {
+	logf(slog.LevelError, format, args...)
+}
+
+func logf(level slog.Level, format string, args ...any) {
+	logger := slog.Default()
+	if !logger.Enabled(context.Background(), level) {
+		return
+	}
+	record := slog.NewRecord(time.Now(), level, strings.TrimSuffix(fmt.Sprintf(format, args...), "\n"), 0)
+	logger.Handler().Handle(context.Background(), record)
+}
+
+// textHandler writes records as "2006/01/02 15:04:05 LEVEL message key=value..." lines, like the
+// default handler of slog.
+type textHandler struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	level  slog.Level
+	attrs  []slog.Attr
+	prefix string
+}
+
+func (h *textHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *textHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+	b.WriteString(r.Time.Format("2006/01/02 15:04:05 "))
+	b.WriteString(r.Level.String())
+	b.WriteString(" ")
+	b.WriteString(r.Message)
+	for _, a := range h.attrs {
+		fmt.Fprintf(&b, " %s=%v", a.Key, a.Value)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		fmt.Fprintf(&b, " %s%s=%v", h.prefix, a.Key, a.Value)
+		return true
+	})
+	b.WriteString("\n")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, b.String())
+	return err
+}
+
+func (h *textHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clone := *h
+	clone.attrs = slices.Clone(h.attrs)
+	for _, a := range attrs {
+		clone.attrs = append(clone.attrs, slog.Attr{Key: h.prefix + a.Key, Value: a.Value})
+	}
+	return &clone
+}
+
+func (h *textHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	clone := *h
+	clone.prefix = h.prefix + name + "."
+	return &clone
+}
+
+// linePrefix matches the time and level of the text lines.
+var linePrefix = regexp.MustCompile(`^\d{4}/\d\d/\d\d \d\d:\d\d:\d\d (?:((?:DEBUG|INFO|WARN|ERROR)(?:[+-]\d+)?) )?`)
+
+// Message returns the message of a line of the log of a run, in either format, and its level.
+// Lines that are not log records, such as the output of a tool, are at the info level.
+func Message(line string) (string, slog.Level) {
+	var record struct {
+		Level slog.Level `json:"level"`
+		Msg   string     `json:"msg"`
+	}
+	if strings.HasPrefix(line, "{") && json.Unmarshal([]byte(line), &record) == nil {
+		return record.Msg, record.Level
+	}
+	level := slog.LevelInfo
+	if match := linePrefix.FindStringSubmatch(line); match != nil {
+		if match[1] != "" {
+			level.UnmarshalText([]byte(match[1]))
+		}
+		line = line[len(match[0]):]
+	}
+	return strings.TrimSpace(line), level
+}
+
+// LastMessage returns the message of the last error in the log of a run read from r, or of its
+// last line.
+func LastMessage(r io.Reader) string {
+	var last, lastError string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		message, level := Message(scanner.Text())
+		if message == "" {
+			continue
+		}
+		last = message
+		if level >= slog.LevelError {
+			lastError = message
+		}
+	}
+	if lastError != "" {
+		return lastError
+	}
+	return last
+}
@@ -0,0 +1,183 @@
+package manifest
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+	poolv1alpha1 "kubevirt.io/api/pool/v1alpha1"
+	"sigs.k8s.io/yaml"
+)
+
+// helmChart is the Chart.yaml of a generated chart.
+type helmChart struct {
+	APIVersion  string `json:"apiVersion"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Type        string `json:"type"`
+	Version     string `json:"version"`
+	AppVersion  string `json:"appVersion,omitempty"`
+}
+
+// helmValues is the values.yaml of a generated chart, defaulting to the converted VM.
+type helmValues struct {
+	// Namespace of the resources; empty for the namespace of the release.
+	Namespace string `json:"namespace"`
+	// RunStrategy of the VM.
+	RunStrategy string `json:"runStrategy,omitempty"`
+	// StorageClass of the PVCs and DataVolume templates; empty keeps the classes of the conversion.
+	StorageClass string `json:"storageClass"`
+	// Networks maps the Multus networks of the conversion to those the VM is connected to.
+	Networks map[string]string `json:"networks,omitempty"`
+}
+
+// placeholderPattern matches the placeholders templated resources are marshalled with.
+var placeholderPattern = regexp.MustCompile(`__HELM_PLACEHOLDER_(\d+)__`)
+
+// helmTemplater replaces fields of the resources with Helm template expressions. The fields
+// are set to placeholders, replaced by their expression once marshalled, as YAML would quote
+// the expressions.
+type helmTemplater struct {
+	expressions []string
+}
+
+// placeholder returns the placeholder of expr.
+func (t *helmTemplater) placeholder(expr string) string {
+	t.expressions = append(t.expressions, expr)
+	return fmt.Sprintf("__HELM_PLACEHOLDER_%d__", len(t.expressions)-1)
+}
+
+// storageClass returns the placeholder of a storage class, the storageClass value or original.
+func (t *helmTemplater) storageClass(original *string) *string {
+	expr := "{{ .Values.storageClass }}"
+	if original != nil && *original != "" {
+		expr = fmt.Sprintf("{{ .Values.storageClass | default %s }}", strconv.Quote(*original))
+	}
+	p := t.placeholder(expr)
+	return &p
+}
+
+// templateVMSpec templates the run strategy, DataVolume storage classes and Multus networks of spec.
+func (t *helmTemplater) templateVMSpec(spec *kubevirtv1.VirtualMachineSpec, namespace string, values *helmValues) {
+	if spec.RunStrategy != nil {
+		values.RunStrategy = string(*spec.RunStrategy)
+		runStrategy := kubevirtv1.VirtualMachineRunStrategy(t.placeholder("{{ .Values.runStrategy }}"))
+		spec.RunStrategy = &runStrategy
+	}
+	for i := range spec.DataVolumeTemplates {
+		dv := &spec.DataVolumeTemplates[i].Spec
+		switch {
+		case dv.Storage != nil:
+			dv.Storage.StorageClassName = t.storageClass(dv.Storage.StorageClassName)
+		case dv.PVC != nil:
+			dv.PVC.StorageClassName = t.storageClass(dv.PVC.StorageClassName)
+		}
+		if dv.Source != nil && dv.Source.PVC != nil && dv.Source.PVC.Namespace == namespace {
+			dv.Source.PVC.Namespace = t.placeholder("{{ .Values.namespace | default .Release.Namespace }}")
+		}
+	}
+	for i := range spec.Template.Spec.Networks {
+		multus := spec.Template.Spec.Networks[i].Multus
+		if multus == nil {
+			continue
+		}
+		if values.Networks == nil {
+			values.Networks = make(map[string]string)
+		}
+		values.Networks[multus.NetworkName] = multus.NetworkName
+		multus.NetworkName = t.placeholder(fmt.Sprintf("{{ index .Values.networks %s }}", strconv.Quote(multus.NetworkName)))
+	}
+}
+
+// render marshals obj, a templated copy, replacing the placeholders by their expression. Braces
+// already in the resource, e.g. of a cloud-init jinja template, are escaped from Helm.
+func (t *helmTemplater) render(obj Object) ([]byte, error) {
+	data, err := yaml.Marshal(obj)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal %s %s: %w", Kind(obj), obj.GetName(), err)
+	}
+	data = bytes.ReplaceAll(data, []byte("{{"), []byte(`{{ "{{" }}`))
+	return placeholderPattern.ReplaceAllFunc(data, func(match []byte) []byte {
+		i, _ := strconv.Atoi(string(placeholderPattern.FindSubmatch(match)[1]))
+		return []byte(t.expressions[i])
+	}), nil
+}
+
+// WriteHelmChart writes a Helm chart deploying objects to dir: Chart.yaml, values.yaml and one
+// template per resource, named by FileName. The values default to the conversion and set the
+// namespace, run strategy, storage class and Multus networks of the VM, so it can be redeployed
+// to other clusters with helm install --set or a values file. It returns the paths written.
+func WriteHelmChart(dir string, objects []Object, name, version string) ([]string, error) {
+	t := &helmTemplater{}
+	values := helmValues{}
+	var templated []Object
+	for _, obj := range objects {
+		obj = obj.DeepCopyObject().(Object)
+		if values.Namespace == "" {
+			values.Namespace = obj.GetNamespace()
+		}
+		namespace := obj.GetNamespace()
+		if namespace != "" {
+			obj.SetNamespace(t.placeholder("{{ .Values.namespace | default .Release.Namespace }}"))
+		}
+		switch o := obj.(type) {
+		case *corev1.PersistentVolumeClaim:
+			o.Spec.StorageClassName = t.storageClass(o.Spec.StorageClassName)
+		case *kubevirtv1.VirtualMachine:
+			t.templateVMSpec(&o.Spec, namespace, &values)
+		case *poolv1alpha1.VirtualMachinePool:
+			t.templateVMSpec(&o.Spec.VirtualMachineTemplate.Spec, namespace, &values)
+		}
+		templated = append(templated, obj)
+	}
+
+	templatesDir := filepath.Join(dir, "templates")
+	if err := os.MkdirAll(templatesDir, 0755); err != nil {
+		return nil, err
+	}
+	var paths []string
+	write := func(path string, data []byte) error {
+		paths = append(paths, path)
+		return os.WriteFile(path, data, 0644)
+	}
+	chart, err := yaml.Marshal(helmChart{
+		APIVersion:  "v2",
+		Name:        name,
+		Description: fmt.Sprintf("Virtual machine %s converted from VMware to KubeVirt", name),
+		Type:        "application",
+		Version:     "0.1.0",
+		AppVersion:  version,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := write(filepath.Join(dir, "Chart.yaml"), chart); err != nil {
+		return nil, err
+	}
+	valuesData, err := yaml.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+	header := "# Values of the " + name + " chart, defaulting to the conversion.\n" +
+		"# namespace: namespace of the resources, empty for the namespace of the release.\n" +
+		"# storageClass: storage class of the PVCs and DataVolume templates, empty to keep those of the conversion.\n" +
+		"# networks: Multus network, as <namespace>/<name> or <name>, replacing each network of the conversion.\n"
+	if err := write(filepath.Join(dir, "values.yaml"), append([]byte(header), valuesData...)); err != nil {
+		return nil, err
+	}
+	for _, obj := range templated {
+		data, err := t.render(obj)
+		if err != nil {
+			return nil, err
+		}
+		if err := write(filepath.Join(templatesDir, FileName(obj, YAML)), data); err != nil {
+			return nil, err
+		}
+	}
+	return paths, nil
+}
@@ -0,0 +1,190 @@
+package manifest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"vmx2vmi/pkg/failure"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+	poolv1alpha1 "kubevirt.io/api/pool/v1alpha1"
+	"sigs.k8s.io/yaml"
+)
+
+// Overlays lists the environments the converted VM is deployed to with -output-format kustomize.
+// It is read from a YAML or JSON file.
+type Overlays struct {
+	Overlays []Overlay `json:"overlays"`
+}
+
+// Overlay is one environment, a kustomize overlay of the base. Empty fields keep the base.
+type Overlay struct {
+	// Name is the name of the environment and of its overlay directory.
+	Name         string `json:"name"`
+	Namespace    string `json:"namespace,omitempty"`
+	StorageClass string `json:"storageClass,omitempty"`
+	// Networks maps the Multus networks of the base, as written in the VM, to those of the
+	// environment, optionally as <namespace>/<name>.
+	Networks map[string]string `json:"networks,omitempty"`
+}
+
+// LoadOverlays reads and validates an overlays file.
+func LoadOverlays(path string) (*Overlays, error) {
+	overlays, err := loadOverlays(path)
+	return overlays, failure.Wrap(failure.Parse, err)
+}
+
+func loadOverlays(path string) (*Overlays, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read overlays: %w", err)
+	}
+	var o Overlays
+	if err := yaml.UnmarshalStrict(data, &o); err != nil {
+		return nil, fmt.Errorf("failed to parse overlays %s: %w", path, err)
+	}
+	seen := make(map[string]bool)
+	for _, overlay := range o.Overlays {
+		if errs := validation.IsDNS1123Label(overlay.Name); len(errs) > 0 {
+			return nil, fmt.Errorf("overlays %s: invalid overlay name %q: %s", path, overlay.Name, errs[0])
+		}
+		if seen[overlay.Name] {
+			return nil, fmt.Errorf("overlays %s: overlay %q is defined twice", path, overlay.Name)
+		}
+		seen[overlay.Name] = true
+		if overlay.Namespace != "" {
+			if errs := validation.IsDNS1123Label(overlay.Namespace); len(errs) > 0 {
+				return nil, fmt.Errorf("overlays %s, overlay %q: invalid namespace %q: %s", path, overlay.Name, overlay.Namespace, errs[0])
+			}
+		}
+	}
+	return &o, nil
+}
+
+// patchOperation is a JSON6902 patch operation.
+type patchOperation struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	Value string `json:"value"`
+}
+
+// patchTarget selects the resource a kustomize patch applies to.
+type patchTarget struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+// patch is an inline patch of a kustomization.
+type patch struct {
+	Target patchTarget `json:"target"`
+	Patch  string      `json:"patch"`
+}
+
+// overlayPatches returns the JSON6902 operations setting the storage class and networks of
+// overlay on obj.
+func overlayPatches(obj Object, overlay Overlay) []patchOperation {
+	var ops []patchOperation
+	var vmSpec *kubevirtv1.VirtualMachineSpec
+	prefix := "/spec"
+	switch o := obj.(type) {
+	case *corev1.PersistentVolumeClaim:
+		if overlay.StorageClass != "" {
+			ops = append(ops, patchOperation{Op: "add", Path: "/spec/storageClassName", Value: overlay.StorageClass})
+		}
+		return ops
+	case *kubevirtv1.VirtualMachine:
+		vmSpec = &o.Spec
+	case *poolv1alpha1.VirtualMachinePool:
+		vmSpec = &o.Spec.VirtualMachineTemplate.Spec
+		prefix = "/spec/virtualMachineTemplate/spec"
+	default:
+		return nil
+	}
+	if overlay.StorageClass != "" {
+		for i, template := range vmSpec.DataVolumeTemplates {
+			switch {
+			case template.Spec.Storage != nil:
+				ops = append(ops, patchOperation{Op: "add", Path: fmt.Sprintf("%s/dataVolumeTemplates/%d/spec/storage/storageClassName", prefix, i), Value: overlay.StorageClass})
+			case template.Spec.PVC != nil:
+				ops = append(ops, patchOperation{Op: "add", Path: fmt.Sprintf("%s/dataVolumeTemplates/%d/spec/pvc/storageClassName", prefix, i), Value: overlay.StorageClass})
+			}
+		}
+	}
+	for i, network := range vmSpec.Template.Spec.Networks {
+		if network.Multus == nil {
+			continue
+		}
+		if nad, ok := overlay.Networks[network.Multus.NetworkName]; ok {
+			ops = append(ops, patchOperation{Op: "replace", Path: fmt.Sprintf("%s/template/spec/networks/%d/multus/networkName", prefix, i), Value: nad})
+		}
+	}
+	return ops
+}
+
+// WriteOverlays writes one kustomize overlay per environment to dir/overlays/<name>, on top of
+// the base in dir/base holding objects. Each sets the namespace of its environment and patches the
+// storage class of the claims and DataVolume templates and the Multus networks of the VM. It
+// returns the paths written.
+func WriteOverlays(dir string, objects []Object, overlays []Overlay) ([]string, error) {
+	var paths []string
+	for _, overlay := range overlays {
+		k := kustomization{
+			APIVersion: "kustomize.config.k8s.io/v1beta1",
+			Kind:       "Kustomization",
+			Namespace:  overlay.Namespace,
+			Resources:  []string{"../../base"},
+		}
+		for from := range overlay.Networks {
+			if !referencesNetwork(objects, from) {
+				return nil, fmt.Errorf("overlay %s maps network %s, which the VM does not use", overlay.Name, from)
+			}
+		}
+		for _, obj := range objects {
+			ops := overlayPatches(obj, overlay)
+			if len(ops) == 0 {
+				continue
+			}
+			data, err := yaml.Marshal(ops)
+			if err != nil {
+				return nil, err
+			}
+			k.Patches = append(k.Patches, patch{Target: patchTarget{Kind: Kind(obj), Name: obj.GetName()}, Patch: string(data)})
+		}
+		overlayDir := filepath.Join(dir, "overlays", overlay.Name)
+		if err := os.MkdirAll(overlayDir, 0755); err != nil {
+			return nil, err
+		}
+		data, err := yaml.Marshal(k)
+		if err != nil {
+			return nil, err
+		}
+		path := filepath.Join(overlayDir, "kustomization.yaml")
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// referencesNetwork reports whether a VM among objects is connected to the Multus network nad.
+func referencesNetwork(objects []Object, nad string) bool {
+	for _, obj := range objects {
+		var networks []kubevirtv1.Network
+		switch o := obj.(type) {
+		case *kubevirtv1.VirtualMachine:
+			networks = o.Spec.Template.Spec.Networks
+		case *poolv1alpha1.VirtualMachinePool:
+			networks = o.Spec.VirtualMachineTemplate.Spec.Template.Spec.Networks
+		}
+		for _, network := range networks {
+			if network.Multus != nil && network.Multus.NetworkName == nad {
+				return true
+			}
+		}
+	}
+	return false
+}
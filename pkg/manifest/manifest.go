@@ -0,0 +1,206 @@
+// Package manifest lays out the Kubernetes resources generated for a converted VM: ordered in
+// a multi-document YAML stream or JSON List, or as a directory of files with a kustomization.yaml.
+package manifest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/yaml"
+)
+
+// Object is a generated resource.
+type Object interface {
+	metav1.Object
+	runtime.Object
+}
+
+// kindOrder is the order in which resources are applied: what the VM references comes before it.
+var kindOrder = map[string]int{
+	"Namespace":                         0,
+	"NetworkAttachmentDefinition":       1,
+	"Secret":                            2,
+	"ConfigMap":                         3,
+	"VirtualMachineInstancetype":        4,
+	"VirtualMachineClusterInstancetype": 4,
+	"VirtualMachinePreference":          5,
+	"VirtualMachineClusterPreference":   5,
+	"PersistentVolumeClaim":             6,
+	"DataVolume":                        7,
+	"VirtualMachine":                    8,
+	"VirtualMachinePool":                8,
+}
+
+// Kind returns the kind of obj.
+func Kind(obj Object) string {
+	return obj.GetObjectKind().GroupVersionKind().Kind
+}
+
+// Sort orders objects so that each resource comes after the resources it references, keeping
+// the given order among resources of the same kind. Unknown kinds go last.
+func Sort(objects []Object) {
+	rank := func(obj Object) int {
+		if r, ok := kindOrder[Kind(obj)]; ok {
+			return r
+		}
+		return len(kindOrder)
+	}
+	sort.SliceStable(objects, func(i, j int) bool {
+		return rank(objects[i]) < rank(objects[j])
+	})
+}
+
+// Encoding is the serialization of written manifests.
+type Encoding string
+
+const (
+	YAML Encoding = "yaml"
+	JSON Encoding = "json"
+)
+
+// ParseEncoding parses a -o value; empty means YAML.
+func ParseEncoding(value string) (Encoding, error) {
+	switch Encoding(value) {
+	case "", YAML:
+		return YAML, nil
+	case JSON:
+		return JSON, nil
+	}
+	return "", fmt.Errorf("invalid output encoding '%s': must be yaml or json", value)
+}
+
+// Ext returns the file extension of the encoding, with its dot.
+func (e Encoding) Ext() string {
+	return "." + string(e)
+}
+
+// list is the v1 List kubectl accepts for several objects in one JSON document.
+type list struct {
+	APIVersion string   `json:"apiVersion"`
+	Kind       string   `json:"kind"`
+	Items      []Object `json:"items"`
+}
+
+// Marshal marshals objects, in the given order, into a multi-document YAML stream, or into
+// indented JSON: the object itself when there is only one, a v1 List otherwise.
+func Marshal(objects []Object, encoding Encoding) ([]byte, error) {
+	if encoding == JSON {
+		var v any = list{APIVersion: "v1", Kind: "List", Items: objects}
+		if len(objects) == 1 {
+			v = objects[0]
+		}
+		out, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal manifests to JSON: %w", err)
+		}
+		return append(out, '\n'), nil
+	}
+	var out []byte
+	for i, obj := range objects {
+		data, err := yaml.Marshal(obj)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal %s %s: %w", Kind(obj), obj.GetName(), err)
+		}
+		if i > 0 {
+			out = append(out, "---\n"...)
+		}
+		out = append(out, data...)
+	}
+	return out, nil
+}
+
+// Document is one document of a multi-document YAML stream.
+type Document struct {
+	Kind string
+	Name string
+	Data []byte
+}
+
+// Split splits a multi-document YAML stream into its documents, skipping empty ones. The items
+// of a List, as written by Marshal in JSON, are returned as documents of their own.
+func Split(data []byte) ([]Document, error) {
+	var parts [][]byte
+	var current []byte
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		if bytes.Equal(bytes.TrimRight(line, " \r\n"), []byte("---")) || bytes.HasPrefix(line, []byte("--- ")) {
+			parts = append(parts, current)
+			current = nil
+			continue
+		}
+		current = append(current, line...)
+	}
+	parts = append(parts, current)
+
+	var documents []Document
+	for _, part := range parts {
+		if len(bytes.TrimSpace(part)) == 0 {
+			continue
+		}
+		var meta struct {
+			metav1.PartialObjectMetadata
+			Items []json.RawMessage `json:"items"`
+		}
+		if err := yaml.Unmarshal(part, &meta); err != nil {
+			return nil, fmt.Errorf("failed to parse document %d: %w", len(documents)+1, err)
+		}
+		if meta.Kind != "List" {
+			documents = append(documents, Document{Kind: meta.Kind, Name: meta.Name, Data: part})
+			continue
+		}
+		for _, item := range meta.Items {
+			var itemMeta metav1.PartialObjectMetadata
+			if err := json.Unmarshal(item, &itemMeta); err != nil {
+				return nil, fmt.Errorf("failed to parse item %d of List: %w", len(documents)+1, err)
+			}
+			documents = append(documents, Document{Kind: itemMeta.Kind, Name: itemMeta.Name, Data: item})
+		}
+	}
+	return documents, nil
+}
+
+// FileName returns the file an object is written to in a directory: <kind>-<name>.<encoding>,
+// the kind in lower case.
+func FileName(obj Object, encoding Encoding) string {
+	return strings.ToLower(Kind(obj)) + "-" + obj.GetName() + encoding.Ext()
+}
+
+// kustomization is a kustomization.yaml.
+type kustomization struct {
+	APIVersion string   `json:"apiVersion"`
+	Kind       string   `json:"kind"`
+	Namespace  string   `json:"namespace,omitempty"`
+	Resources  []string `json:"resources"`
+	Patches    []patch  `json:"patches,omitempty"`
+}
+
+// WriteFile writes obj to its own file in dir, named by FileName, and returns its path.
+func WriteFile(dir string, obj Object, encoding Encoding) (string, error) {
+	data, err := Marshal([]Object{obj}, encoding)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, FileName(obj, encoding))
+	return path, os.WriteFile(path, data, 0644)
+}
+
+// WriteKustomization writes a kustomization.yaml to dir listing the files of objects, named by
+// FileName, in order, so the directory can be applied with kubectl apply -k. It returns its path.
+func WriteKustomization(dir string, objects []Object, encoding Encoding) (string, error) {
+	k := kustomization{APIVersion: "kustomize.config.k8s.io/v1beta1", Kind: "Kustomization"}
+	for _, obj := range objects {
+		k.Resources = append(k.Resources, FileName(obj, encoding))
+	}
+	data, err := yaml.Marshal(k)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, "kustomization.yaml")
+	return path, os.WriteFile(path, data, 0644)
+}
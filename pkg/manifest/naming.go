@@ -0,0 +1,53 @@
+package manifest
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// NameData is what an -output-name template can refer to.
+type NameData struct {
+	// Name and Namespace are those of the generated VM.
+	Name      string
+	Namespace string
+	// Kind is the kind of the generated manifest, VirtualMachine or VirtualMachinePool.
+	Kind string
+	// Source is the file name of the VMX without its extension.
+	Source string
+}
+
+// NameTemplate renders the base name of the generated files.
+type NameTemplate struct {
+	tmpl *template.Template
+}
+
+// ParseNameTemplate parses an -output-name template such as {{.Namespace}}_{{.Name}}.
+func ParseNameTemplate(text string) (*NameTemplate, error) {
+	tmpl, err := template.New("output-name").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid output name template '%s': %w", text, err)
+	}
+	return &NameTemplate{tmpl: tmpl}, nil
+}
+
+// Render returns the base name of the generated files for data: the manifest is <base>.<encoding>
+// and the other files add a suffix to it. A .yaml, .yml or .json extension is dropped, as the
+// encoding decides it. The base name may contain directories, relative to the output directory.
+func (t *NameTemplate) Render(data NameData) (string, error) {
+	var b strings.Builder
+	if err := t.tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("failed to render output name: %w", err)
+	}
+	base := b.String()
+	switch strings.ToLower(filepath.Ext(base)) {
+	case ".yaml", ".yml", ".json":
+		base = strings.TrimSuffix(base, filepath.Ext(base))
+	}
+	clean := filepath.Clean(base)
+	if base == "" || filepath.IsAbs(base) || clean == "." || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) || strings.HasSuffix(base, "/") {
+		return "", fmt.Errorf("output name '%s' must be a file name relative to the output directory", base)
+	}
+	return clean, nil
+}
@@ -0,0 +1,155 @@
+package manifest
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// templateParameter is a parameter of an OpenShift Template.
+type templateParameter struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName,omitempty"`
+	Description string `json:"description,omitempty"`
+	Value       string `json:"value,omitempty"`
+	Required    bool   `json:"required,omitempty"`
+}
+
+// parameterNamePattern matches the characters not allowed in a template parameter name.
+var parameterNamePattern = regexp.MustCompile(`[^A-Z0-9_]`)
+
+// OpenShiftTemplate wraps objects into an OpenShift Template named after primary, the VM or
+// pool, with the parameters NAME, the name of primary, NAMESPACE, the namespace of every
+// resource, and <CLAIM>_SIZE, the size of each PVC and DataVolume template, all defaulting to
+// the conversion. Label values equal to the name of primary follow NAME, so its selectors keep
+// matching. It is processed with oc process, or instantiated from the OpenShift console.
+func OpenShiftTemplate(objects []Object, primary Object) (*unstructured.Unstructured, error) {
+	name, namespace := primary.GetName(), primary.GetNamespace()
+	parameters := []templateParameter{
+		{Name: "NAME", DisplayName: "Name", Description: fmt.Sprintf("Name of the %s", Kind(primary)), Value: name, Required: true},
+		{Name: "NAMESPACE", DisplayName: "Namespace", Description: "Namespace of the resources", Value: namespace, Required: true},
+	}
+	sizeParameter := func(claim string, size any) string {
+		param := parameterNamePattern.ReplaceAllString(strings.ToUpper(claim), "_") + "_SIZE"
+		parameters = append(parameters, templateParameter{
+			Name:        param,
+			DisplayName: "Size of " + claim,
+			Description: fmt.Sprintf("Storage requested for the claim %s", claim),
+			Value:       fmt.Sprint(size),
+			Required:    true,
+		})
+		return "${" + param + "}"
+	}
+
+	var items []any
+	for _, obj := range objects {
+		data, err := json.Marshal(obj)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal %s %s: %w", Kind(obj), obj.GetName(), err)
+		}
+		u := &unstructured.Unstructured{}
+		if err := u.UnmarshalJSON(data); err != nil {
+			return nil, fmt.Errorf("failed to convert %s %s: %w", Kind(obj), obj.GetName(), err)
+		}
+		if u.GetKind() == Kind(primary) && u.GetName() == name {
+			u.SetName("${NAME}")
+		}
+		if u.GetNamespace() != "" {
+			u.SetNamespace("${NAMESPACE}")
+		}
+		parameterizeLabels(u.Object, name)
+
+		switch u.GetKind() {
+		case "PersistentVolumeClaim":
+			if size, ok, _ := unstructured.NestedFieldNoCopy(u.Object, "spec", "resources", "requests", "storage"); ok {
+				if err := unstructured.SetNestedField(u.Object, sizeParameter(obj.GetName(), size), "spec", "resources", "requests", "storage"); err != nil {
+					return nil, err
+				}
+			}
+		case "VirtualMachine", "VirtualMachinePool":
+			vmSpec := []string{"spec"}
+			if u.GetKind() == "VirtualMachinePool" {
+				vmSpec = []string{"spec", "virtualMachineTemplate", "spec"}
+			}
+			templates, _, _ := unstructured.NestedSlice(u.Object, append(vmSpec, "dataVolumeTemplates")...)
+			for _, t := range templates {
+				template, ok := t.(map[string]any)
+				if !ok {
+					continue
+				}
+				dvName, _, _ := unstructured.NestedString(template, "metadata", "name")
+				for _, claimSpec := range []string{"storage", "pvc"} {
+					if size, ok, _ := unstructured.NestedFieldNoCopy(template, "spec", claimSpec, "resources", "requests", "storage"); ok {
+						if err := unstructured.SetNestedField(template, sizeParameter(dvName, size), "spec", claimSpec, "resources", "requests", "storage"); err != nil {
+							return nil, err
+						}
+					}
+				}
+				if ns, _, _ := unstructured.NestedString(template, "spec", "source", "pvc", "namespace"); ns == namespace && ns != "" {
+					if err := unstructured.SetNestedField(template, "${NAMESPACE}", "spec", "source", "pvc", "namespace"); err != nil {
+						return nil, err
+					}
+				}
+			}
+			if len(templates) > 0 {
+				if err := unstructured.SetNestedSlice(u.Object, templates, append(vmSpec, "dataVolumeTemplates")...); err != nil {
+					return nil, err
+				}
+			}
+		}
+		items = append(items, u.Object)
+	}
+
+	params := make([]any, len(parameters))
+	for i := range parameters {
+		param, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&parameters[i])
+		if err != nil {
+			return nil, err
+		}
+		params[i] = param
+	}
+	tmpl := &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "template.openshift.io/v1",
+		"kind":       "Template",
+		"metadata": map[string]any{
+			"name": name,
+			"annotations": map[string]any{
+				"openshift.io/display-name": fmt.Sprintf("%s converted from VMware", name),
+				"description":               fmt.Sprintf("%s %s converted from VMware to OpenShift Virtualization", Kind(primary), name),
+				"tags":                      "kubevirt,virtualmachine",
+			},
+		},
+		"objects":    items,
+		"parameters": params,
+	}}
+	return tmpl, nil
+}
+
+// parameterizeLabels replaces the label values equal to name by the NAME parameter, in every
+// labels and matchLabels map of obj.
+func parameterizeLabels(obj map[string]any, name string) {
+	for key, value := range obj {
+		switch v := value.(type) {
+		case map[string]any:
+			if key == "labels" || key == "matchLabels" {
+				for k, label := range v {
+					if label == name {
+						v[k] = "${NAME}"
+					}
+				}
+				continue
+			}
+			parameterizeLabels(v, name)
+		case []any:
+			for _, item := range v {
+				if m, ok := item.(map[string]any); ok {
+					parameterizeLabels(m, name)
+				}
+			}
+		}
+	}
+}
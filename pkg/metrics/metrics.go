@@ -0,0 +1,265 @@
+// Package metrics exposes the progress of a migration in the Prometheus text format: the phase,
+// attempts, failures and duration of each VM, and the bytes copied, throughput and retries of each
+// of its disks, so that long runs can be followed on the dashboards of the cluster.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"vmx2vmi/pkg/failure"
+	"vmx2vmi/pkg/logging"
+	"vmx2vmi/pkg/plan"
+	"vmx2vmi/pkg/progress"
+)
+
+// Registry holds the metrics of the VMs of a migration. Its methods may be called concurrently.
+// A nil *Registry is valid and records nothing, so that callers need not check whether metrics
+// are enabled.
+type Registry struct {
+	phases []string
+
+	mu  sync.Mutex
+	vms []*vm
+}
+
+type vm struct {
+	name     string
+	phase    string
+	attempts int
+	failures map[string]int
+	finished bool
+	duration time.Duration
+	disks    []*disk
+}
+
+// disk holds the progress of the copy of one disk. Copies restart with each attempt of the VM;
+// the bytes and retries of the previous attempts are kept in base, so the totals never decrease.
+type disk struct {
+	name           string
+	size           int64
+	copied         int64
+	bytesPerSecond float64
+	retries        int
+	baseCopied     int64
+	baseRetries    int
+}
+
+// New returns a registry whose VMs are in one of phases, the first one until SetPhase is called.
+func New(phases ...string) *Registry {
+	return &Registry{phases: phases}
+}
+
+// vm returns the metrics of the VM named name, adding them on first use. r.mu must be held.
+func (r *Registry) vm(name string) *vm {
+	i := slices.IndexFunc(r.vms, func(v *vm) bool { return v.name == name })
+	if i >= 0 {
+		return r.vms[i]
+	}
+	v := &vm{name: name, failures: map[string]int{}}
+	if len(r.phases) > 0 {
+		v.phase = r.phases[0]
+	}
+	r.vms = append(r.vms, v)
+	return v
+}
+
+// Add registers the VM named name, so that it is exposed before it starts.
+func (r *Registry) Add(name string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.vm(name)
+	r.mu.Unlock()
+}
+
+// Remove drops the metrics of the VM named name.
+func (r *Registry) Remove(name string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.vms = slices.DeleteFunc(r.vms, func(v *vm) bool { return v.name == name })
+	r.mu.Unlock()
+}
+
+// SetPhase records the phase the VM named name is in.
+func (r *Registry) SetPhase(name, phase string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.vm(name).phase = phase
+	r.mu.Unlock()
+}
+
+// Attempt records that a conversion of the VM named name starts.
+func (r *Registry) Attempt(name string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	v := r.vm(name)
+	v.attempts++
+	for _, d := range v.disks {
+		d.baseCopied += d.copied
+		d.baseRetries += d.retries
+		d.copied, d.retries, d.bytesPerSecond = 0, 0, 0
+	}
+}
+
+// Finish records that a conversion of the VM named name ended after duration, and failed with
+// an error of kind unless kind is empty.
+func (r *Registry) Finish(name string, duration time.Duration, kind string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	v := r.vm(name)
+	v.finished, v.duration = true, duration
+	if kind != "" {
+		v.failures[kind]++
+	}
+}
+
+// ObserveVM records a change of the state of a VM of a plan, named name.
+func (r *Registry) ObserveVM(name string, vm plan.VMStatus) {
+	if r == nil {
+		return
+	}
+	r.SetPhase(name, vm.State)
+	switch vm.State {
+	case plan.Running:
+		r.Attempt(name)
+	case plan.Succeeded:
+		r.Finish(name, vm.Finished.Sub(*vm.Started), "")
+	case plan.Failed:
+		r.Finish(name, vm.Finished.Sub(*vm.Started), failure.FromExitCode(vm.ExitCode).String())
+	}
+}
+
+// Observe records a progress update of a disk of the VM named name; updates of the total of
+// its disks are ignored.
+func (r *Registry) Observe(name string, u progress.Update) {
+	if r == nil || u.Type != "disk" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	v := r.vm(name)
+	i := slices.IndexFunc(v.disks, func(d *disk) bool { return d.name == u.Disk })
+	if i < 0 {
+		v.disks = append(v.disks, &disk{name: u.Disk})
+		i = len(v.disks) - 1
+	}
+	d := v.disks[i]
+	d.size, d.copied, d.bytesPerSecond, d.retries = u.TotalBytes, u.CopiedBytes, u.BytesPerSecond, u.Retries
+}
+
+// family is a metric and its samples, written in the text format.
+type family struct {
+	name, kind, help string
+	samples          []sample
+}
+
+type sample struct {
+	labels []string // name, value pairs
+	value  float64
+}
+
+// Write writes the metrics to w in the Prometheus text exposition format.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	families := r.families()
+	r.mu.Unlock()
+
+	var b strings.Builder
+	for _, f := range families {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+		for _, s := range f.samples {
+			b.WriteString(f.name)
+			if len(s.labels) > 0 {
+				b.WriteString("{")
+				for i := 0; i < len(s.labels); i += 2 {
+					if i > 0 {
+						b.WriteString(",")
+					}
+					fmt.Fprintf(&b, "%s=\"%s\"", s.labels[i], labelEscaper.Replace(s.labels[i+1]))
+				}
+				b.WriteString("}")
+			}
+			fmt.Fprintf(&b, " %g\n", s.value)
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// families returns the metrics of the VMs. r.mu must be held.
+func (r *Registry) families() []family {
+	phase := family{name: "vmx2vmi_vm_phase", kind: "gauge", help: "Phase of the VM: 1 for the phase it is in, 0 for the others."}
+	attempts := family{name: "vmx2vmi_vm_attempts_total", kind: "counter", help: "Conversions of the VM started."}
+	failures := family{name: "vmx2vmi_vm_failures_total", kind: "counter", help: "Conversions of the VM failed, by kind of failure."}
+	duration := family{name: "vmx2vmi_vm_duration_seconds", kind: "gauge", help: "Duration of the last finished conversion of the VM."}
+	size := family{name: "vmx2vmi_disk_size_bytes", kind: "gauge", help: "Bytes the copy of the disk reads."}
+	copied := family{name: "vmx2vmi_disk_copied_bytes_total", kind: "counter", help: "Bytes of the disk copied."}
+	throughput := family{name: "vmx2vmi_disk_throughput_bytes_per_second", kind: "gauge", help: "Average throughput of the current copy of the disk."}
+	retries := family{name: "vmx2vmi_disk_retries_total", kind: "counter", help: "Failed transfers of the disk that were retried."}
+	for _, v := range r.vms {
+		for _, p := range r.phases {
+			value := 0.0
+			if p == v.phase {
+				value = 1
+			}
+			phase.samples = append(phase.samples, sample{[]string{"vm", v.name, "phase", p}, value})
+		}
+		attempts.samples = append(attempts.samples, sample{[]string{"vm", v.name}, float64(v.attempts)})
+		for _, kind := range slices.Sorted(maps.Keys(v.failures)) {
+			failures.samples = append(failures.samples, sample{[]string{"vm", v.name, "kind", kind}, float64(v.failures[kind])})
+		}
+		if v.finished {
+			duration.samples = append(duration.samples, sample{[]string{"vm", v.name}, v.duration.Seconds()})
+		}
+		for _, d := range v.disks {
+			labels := []string{"vm", v.name, "disk", d.name}
+			size.samples = append(size.samples, sample{labels, float64(d.size)})
+			copied.samples = append(copied.samples, sample{labels, float64(d.baseCopied + d.copied)})
+			throughput.samples = append(throughput.samples, sample{labels, d.bytesPerSecond})
+			retries.samples = append(retries.samples, sample{labels, float64(d.baseRetries + d.retries)})
+		}
+	}
+	return []family{phase, attempts, failures, duration, size, copied, throughput, retries}
+}
+
+// ServeHTTP serves the metrics.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.Write(w)
+}
+
+// Serve serves the metrics of r at /metrics on addr, e.g. :9100, in the background, until the
+// returned server is closed.
+func Serve(addr string, r *Registry) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for metrics: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", r)
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go server.Serve(listener)
+	logging.Infof("Serving metrics on http://%s/metrics\n", listener.Addr())
+	return server, nil
+}
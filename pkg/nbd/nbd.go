@@ -0,0 +1,193 @@
+// Package nbd is a minimal read-only client of the Network Block Device protocol, enough to read
+// the exports of nbdkit and qemu-nbd: the fixed newstyle handshake with NBD_OPT_GO, and simple
+// replies to NBD_CMD_READ.
+package nbd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+const (
+	handshakeMagic = 0x4e42444d41474943 // NBDMAGIC
+	optionMagic    = 0x49484156454f5054 // IHAVEOPT
+	replyMagic     = 0x3e889045565a9
+	requestMagic   = 0x25609513
+	simpleMagic    = 0x67446698
+
+	flagFixedNewstyle = 1 << 0
+	flagNoZeroes      = 1 << 1
+
+	optGo      = 7
+	repAck     = 1
+	repInfo    = 3
+	repError   = 1 << 31
+	infoExport = 0
+
+	cmdRead = 0
+	cmdDisc = 2
+
+	// maxRead is the largest read sent in one request; servers may reject larger ones.
+	maxRead = 32 << 20
+)
+
+// Client is a connection to one NBD export. Reads are serialized, so it is safe for concurrent use.
+type Client struct {
+	conn   net.Conn
+	size   int64
+	mu     sync.Mutex
+	handle uint64
+}
+
+// Dial connects to the NBD server at address on network ("unix" or "tcp") and opens export,
+// the default export when empty.
+func Dial(network, address, export string) (*Client, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{conn: conn}
+	if err := c.handshake(export); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("NBD handshake with %s: %w", address, err)
+	}
+	return c, nil
+}
+
+func (c *Client) handshake(export string) error {
+	var hello struct {
+		Magic, Option uint64
+		Flags         uint16
+	}
+	if err := binary.Read(c.conn, binary.BigEndian, &hello); err != nil {
+		return err
+	}
+	if hello.Magic != handshakeMagic || hello.Option != optionMagic {
+		return fmt.Errorf("not a newstyle NBD server")
+	}
+	if hello.Flags&flagFixedNewstyle == 0 {
+		return fmt.Errorf("the server does not support the fixed newstyle handshake")
+	}
+	if err := binary.Write(c.conn, binary.BigEndian, uint32(flagFixedNewstyle|hello.Flags&flagNoZeroes)); err != nil {
+		return err
+	}
+
+	// NBD_OPT_GO: the export name, and one information request for the export size.
+	data := binary.BigEndian.AppendUint32(nil, uint32(len(export)))
+	data = append(data, export...)
+	data = binary.BigEndian.AppendUint16(data, 1)
+	data = binary.BigEndian.AppendUint16(data, infoExport)
+	option := binary.BigEndian.AppendUint64(nil, optionMagic)
+	option = binary.BigEndian.AppendUint32(option, optGo)
+	option = binary.BigEndian.AppendUint32(option, uint32(len(data)))
+	if _, err := c.conn.Write(append(option, data...)); err != nil {
+		return err
+	}
+
+	for {
+		var reply struct {
+			Magic  uint64
+			Option uint32
+			Type   uint32
+			Length uint32
+		}
+		if err := binary.Read(c.conn, binary.BigEndian, &reply); err != nil {
+			return err
+		}
+		if reply.Magic != replyMagic {
+			return fmt.Errorf("invalid option reply magic %#x", reply.Magic)
+		}
+		payload := make([]byte, reply.Length)
+		if _, err := io.ReadFull(c.conn, payload); err != nil {
+			return err
+		}
+		switch {
+		case reply.Type == repAck:
+			if c.size == 0 {
+				return fmt.Errorf("the server did not report the export size")
+			}
+			return nil
+		case reply.Type == repInfo && len(payload) >= 12 && binary.BigEndian.Uint16(payload) == infoExport:
+			c.size = int64(binary.BigEndian.Uint64(payload[2:]))
+		case reply.Type&repError != 0:
+			return fmt.Errorf("export '%s' refused (error %d): %s", export, reply.Type&^repError, payload)
+		}
+	}
+}
+
+// Size returns the size of the export in bytes.
+func (c *Client) Size() int64 {
+	return c.size
+}
+
+// ReadAt implements io.ReaderAt.
+func (c *Client) ReadAt(p []byte, off int64) (int, error) {
+	if off >= c.size {
+		return 0, io.EOF
+	}
+	want := len(p)
+	if remaining := c.size - off; int64(want) > remaining {
+		want = int(remaining)
+	}
+	n := 0
+	for n < want {
+		length := min(want-n, maxRead)
+		if err := c.read(p[n:n+length], off+int64(n)); err != nil {
+			return n, err
+		}
+		n += length
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (c *Client) read(p []byte, off int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handle++
+	if err := c.request(cmdRead, off, uint32(len(p))); err != nil {
+		return err
+	}
+	var reply struct {
+		Magic  uint32
+		Error  uint32
+		Handle uint64
+	}
+	if err := binary.Read(c.conn, binary.BigEndian, &reply); err != nil {
+		return err
+	}
+	if reply.Magic != simpleMagic || reply.Handle != c.handle {
+		return fmt.Errorf("unexpected NBD reply (magic %#x, handle %d)", reply.Magic, reply.Handle)
+	}
+	if reply.Error != 0 {
+		return fmt.Errorf("NBD read of %d bytes at offset %d failed with error %d", len(p), off, reply.Error)
+	}
+	_, err := io.ReadFull(c.conn, p)
+	return err
+}
+
+func (c *Client) request(command uint16, off int64, length uint32) error {
+	req := binary.BigEndian.AppendUint32(nil, requestMagic)
+	req = binary.BigEndian.AppendUint16(req, 0)
+	req = binary.BigEndian.AppendUint16(req, command)
+	req = binary.BigEndian.AppendUint64(req, c.handle)
+	req = binary.BigEndian.AppendUint64(req, uint64(off))
+	req = binary.BigEndian.AppendUint32(req, length)
+	_, err := c.conn.Write(req)
+	return err
+}
+
+// Close disconnects from the server.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handle++
+	err := c.request(cmdDisc, 0, 0)
+	return errors.Join(err, c.conn.Close())
+}
@@ -0,0 +1,185 @@
+// Package ova reads OVF packages exported by vSphere, Workstation and other hypervisors: OVA
+// archives, which are tar files holding the OVF descriptor and the disks of a VM, and OVF
+// descriptors sitting next to their disks. Members of an OVA are read in place through the tar
+// index, so multi-hundred-GB archives never have to be unpacked.
+package ova
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// member locates the content of a tar entry in the archive file.
+type member struct {
+	offset int64
+	size   int64
+}
+
+// Archive is an indexed OVA. Opening it only reads the tar headers; member contents are skipped
+// with seeks and read later through Member.
+type Archive struct {
+	Path    string
+	file    *os.File
+	members map[string]member
+	// names are the member names in archive order; the OVF descriptor comes first in valid OVAs.
+	names []string
+}
+
+// Open indexes the OVA at path. Compressed archives cannot be read in place and are rejected.
+func Open(path string) (*Archive, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open OVA %s: %w", path, err)
+	}
+	a, err := index(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to read OVA %s: %w", path, err)
+	}
+	a.Path = path
+	return a, nil
+}
+
+func index(file *os.File) (*Archive, error) {
+	magic := make([]byte, 6)
+	if n, _ := file.ReadAt(magic, 0); n >= 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		return nil, fmt.Errorf("the archive is gzip-compressed; decompress it first, as compressed members cannot be read in place")
+	} else if bytes.HasPrefix(magic, []byte("\xfd7zXZ\x00")) {
+		return nil, fmt.Errorf("the archive is xz-compressed; decompress it first, as compressed members cannot be read in place")
+	}
+
+	a := &Archive{file: file, members: make(map[string]member)}
+	reader := tar.NewReader(file)
+	for {
+		header, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeGNUSparse {
+			continue
+		}
+		if header.Typeflag == tar.TypeGNUSparse {
+			return nil, fmt.Errorf("member %s is a GNU sparse file, which cannot be read in place; repack the OVA without --sparse", header.Name)
+		}
+		// The tar reader reads no further than the header blocks, and seeks over member
+		// contents, so the file offset is where the content of this member starts.
+		offset, err := file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		name := memberName(header.Name)
+		if _, dup := a.members[name]; !dup {
+			a.names = append(a.names, name)
+		}
+		a.members[name] = member{offset: offset, size: header.Size}
+	}
+	if len(a.names) == 0 {
+		return nil, fmt.Errorf("the archive holds no files")
+	}
+	return a, nil
+}
+
+// memberName normalizes a tar entry name, e.g. ./disk1.vmdk to disk1.vmdk.
+func memberName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// Names returns the member names in archive order.
+func (a *Archive) Names() []string {
+	return a.names
+}
+
+// Member returns a reader of the content of the named member.
+func (a *Archive) Member(name string) (*io.SectionReader, error) {
+	m, ok := a.members[memberName(name)]
+	if !ok {
+		return nil, fmt.Errorf("%s holds no member %s (members: %s)", a.Path, name, strings.Join(a.names, ", "))
+	}
+	return io.NewSectionReader(a.file, m.offset, m.size), nil
+}
+
+// Descriptor returns the name and content of the OVF descriptor of the archive.
+func (a *Archive) Descriptor() (string, []byte, error) {
+	for _, name := range a.names {
+		if !strings.EqualFold(path.Ext(name), ".ovf") {
+			continue
+		}
+		section, err := a.Member(name)
+		if err != nil {
+			return "", nil, err
+		}
+		data, err := io.ReadAll(section)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to read %s from %s: %w", name, a.Path, err)
+		}
+		return name, data, nil
+	}
+	return "", nil, fmt.Errorf("%s holds no .ovf descriptor (members: %s)", a.Path, strings.Join(a.names, ", "))
+}
+
+// Close closes the archive file.
+func (a *Archive) Close() error {
+	return a.file.Close()
+}
+
+// File is a member of an OVA opened on its own; closing it closes the archive.
+type File struct {
+	*io.SectionReader
+	archive *Archive
+}
+
+// Close closes the archive of the member.
+func (f *File) Close() error {
+	return f.archive.Close()
+}
+
+// IsArchive reports whether path names an OVA archive, by its extension.
+func IsArchive(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".ova")
+}
+
+// SplitPath splits a member path of the form <archive>.ova/<member>, such as
+// exports/web01.ova/web01-disk1.vmdk, into the archive and member names. ok is false when path
+// does not go through an existing OVA file.
+func SplitPath(name string) (archive, member string, ok bool) {
+	lower := strings.ToLower(name)
+	for from := 0; ; {
+		i := strings.Index(lower[from:], ".ova"+string(filepath.Separator))
+		if i < 0 {
+			return "", "", false
+		}
+		end := from + i + len(".ova")
+		if info, err := os.Stat(name[:end]); err == nil && info.Mode().IsRegular() {
+			return name[:end], filepath.ToSlash(name[end+1:]), true
+		}
+		from = end
+	}
+}
+
+// OpenMember opens the member of an OVA addressed by a path of the form <archive>.ova/<member>.
+func OpenMember(name string) (*File, error) {
+	archivePath, memberPath, ok := SplitPath(name)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a member of an OVA archive", name)
+	}
+	a, err := Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	section, err := a.Member(memberPath)
+	if err != nil {
+		a.Close()
+		return nil, err
+	}
+	return &File{SectionReader: section, archive: a}, nil
+}
@@ -0,0 +1,432 @@
+package ova
+
+import (
+	"cmp"
+	"encoding/xml"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Envelope is the subset of an OVF descriptor (DSP0243) describing a single VM. Elements are
+// matched by local name, so OVF 1.x and 2.0 descriptors and their VMware extensions are read alike.
+type Envelope struct {
+	References    []FileReference `xml:"References>File"`
+	Disks         []VirtualDisk   `xml:"DiskSection>Disk"`
+	VirtualSystem *VirtualSystem  `xml:"VirtualSystem"`
+	// Collection is set when the package holds several VMs (a vApp).
+	Collection *struct {
+		ID string `xml:"id,attr"`
+	} `xml:"VirtualSystemCollection"`
+}
+
+// FileReference is a file of the package, e.g. a disk or an ISO image.
+type FileReference struct {
+	ID          string `xml:"id,attr"`
+	Href        string `xml:"href,attr"`
+	Size        int64  `xml:"size,attr"`
+	Compression string `xml:"compression,attr"`
+	ChunkSize   int64  `xml:"chunkSize,attr"`
+}
+
+// VirtualDisk is an entry of the DiskSection. Disks without a file reference are blank disks
+// the importer is expected to create.
+type VirtualDisk struct {
+	DiskID        string `xml:"diskId,attr"`
+	FileRef       string `xml:"fileRef,attr"`
+	Capacity      string `xml:"capacity,attr"`
+	CapacityUnits string `xml:"capacityAllocationUnits,attr"`
+	Format        string `xml:"format,attr"`
+}
+
+// VirtualSystem is the VM of the package.
+type VirtualSystem struct {
+	ID              string `xml:"id,attr"`
+	Name            string `xml:"Name"`
+	Annotation      string `xml:"AnnotationSection>Annotation"`
+	OperatingSystem struct {
+		ID          string `xml:"id,attr"`
+		OSType      string `xml:"osType,attr"`
+		Description string `xml:"Description"`
+	} `xml:"OperatingSystemSection"`
+	Hardware struct {
+		SystemType string `xml:"System>VirtualSystemType"`
+		Items      []Item `xml:"Item"`
+		// StorageItems and EthernetPortItems are the OVF 2.0 forms of disk and NIC items.
+		StorageItems      []Item   `xml:"StorageItem"`
+		EthernetPortItems []Item   `xml:"EthernetPortItem"`
+		Config            []Config `xml:"Config"`
+		ExtraConfig       []Config `xml:"ExtraConfig"`
+	} `xml:"VirtualHardwareSection"`
+}
+
+// Item is a virtual hardware item (CIM RASD); which fields are set depends on ResourceType.
+type Item struct {
+	InstanceID          string   `xml:"InstanceID"`
+	ElementName         string   `xml:"ElementName"`
+	ResourceType        int      `xml:"ResourceType"`
+	ResourceSubType     string   `xml:"ResourceSubType"`
+	VirtualQuantity     int64    `xml:"VirtualQuantity"`
+	AllocationUnits     string   `xml:"AllocationUnits"`
+	Address             string   `xml:"Address"`
+	AddressOnParent     string   `xml:"AddressOnParent"`
+	Parent              string   `xml:"Parent"`
+	HostResource        []string `xml:"HostResource"`
+	Connection          []string `xml:"Connection"`
+	AutomaticAllocation string   `xml:"AutomaticAllocation"`
+	CoresPerSocket      int64    `xml:"CoresPerSocket"`
+}
+
+// Config is a vmw:Config or vmw:ExtraConfig setting.
+type Config struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:"value,attr"`
+}
+
+// CIM resource types of the virtual hardware items read from the OVF.
+const (
+	resourceCPU          = 3
+	resourceMemory       = 4
+	resourceIDE          = 5
+	resourceSCSI         = 6
+	resourceParallelSCSI = 7 // used by some exporters instead of 6
+	resourceEthernet     = 10
+	resourceCDROM        = 15
+	resourceDVD          = 16
+	resourceDisk         = 17
+	resourceOtherStorage = 20 // SATA and NVMe controllers in VMware exports
+)
+
+// streamOptimizedFormat ends the ovf:format URI of streamOptimized VMDKs.
+const streamOptimizedFormat = "streamOptimized"
+
+// ParseEnvelope parses an OVF descriptor holding one VM.
+func ParseEnvelope(data []byte) (*Envelope, error) {
+	var envelope Envelope
+	if err := xml.Unmarshal(data, &envelope); err != nil {
+		return nil, fmt.Errorf("failed to parse OVF descriptor: %w", err)
+	}
+	if envelope.VirtualSystem == nil {
+		if envelope.Collection != nil {
+			return nil, fmt.Errorf("the OVF describes the vApp %s with several VMs; export each VM to its own OVF", envelope.Collection.ID)
+		}
+		return nil, fmt.Errorf("the OVF describes no VirtualSystem")
+	}
+	return &envelope, nil
+}
+
+// DiskFile is a disk of the VM as laid out in the package.
+type DiskFile struct {
+	// Href is the file of the disk in the package, empty for blank disks.
+	Href string
+	// CapacityBytes is the virtual size declared in the DiskSection.
+	CapacityBytes uint64
+}
+
+// VMX renders the VM as the VMX configuration VMware would create when deploying the OVF, so it
+// can be parsed like any other VMX: the hardware items become the sizing, controller, disk,
+// CD-ROM and NIC keys, vmw:Config settings their VMX names, and vmw:ExtraConfig entries are
+// copied as they are. It also returns the disks by VMX file name, with their declared capacity,
+// as the OVF does not ship descriptor files for blank disks.
+func (e *Envelope) VMX() ([]byte, map[string]DiskFile, error) {
+	vs := e.VirtualSystem
+	keys := make(map[string]string)
+	var order []string
+	set := func(key, value string) {
+		if _, ok := keys[key]; !ok {
+			order = append(order, key)
+		}
+		keys[key] = value
+	}
+
+	set(".encoding", "UTF-8")
+	set("displayName", strings.TrimSpace(vs.Name))
+	if vs.Name == "" {
+		set("displayName", vs.ID)
+	}
+	if guest := GuestOS(vs.OperatingSystem.OSType); guest != "" {
+		set("guestOS", guest)
+	}
+	if version := hardwareVersion(vs.Hardware.SystemType); version > 0 {
+		set("virtualHW.version", strconv.Itoa(version))
+	}
+	if vs.Annotation != "" {
+		set("annotation", vs.Annotation)
+	}
+
+	files := make(map[string]FileReference)
+	for _, f := range e.References {
+		files[f.ID] = f
+	}
+	disks := make(map[string]VirtualDisk)
+	for _, d := range e.Disks {
+		disks[d.DiskID] = d
+	}
+
+	items := append(append(append([]Item(nil), vs.Hardware.Items...), vs.Hardware.StorageItems...), vs.Hardware.EthernetPortItems...)
+	// Controllers are numbered per bus by their Address, or in item order without one.
+	controllers := make(map[string]string)
+	next := make(map[string]int)
+	for _, item := range items {
+		bus := ""
+		switch item.ResourceType {
+		case resourceIDE:
+			bus = "ide"
+		case resourceSCSI, resourceParallelSCSI:
+			bus = "scsi"
+		case resourceOtherStorage:
+			switch subType := strings.ToLower(item.ResourceSubType); {
+			case strings.Contains(subType, "sata") || strings.Contains(subType, "ahci"):
+				bus = "sata"
+			case strings.Contains(subType, "nvme"):
+				bus = "nvme"
+			}
+		}
+		if bus == "" {
+			continue
+		}
+		index, err := strconv.Atoi(item.Address)
+		if err != nil {
+			index = next[bus]
+		}
+		next[bus] = max(next[bus], index+1)
+		id := fmt.Sprintf("%s%d", bus, index)
+		controllers[item.InstanceID] = id
+		set(id+".present", "TRUE")
+		if bus == "scsi" {
+			set(id+".virtualDev", scsiVirtualDev(item.ResourceSubType))
+		}
+	}
+
+	diskFiles := make(map[string]DiskFile)
+	nic := 0
+	for _, item := range items {
+		switch item.ResourceType {
+		case resourceCPU:
+			set("numvcpus", strconv.FormatInt(item.VirtualQuantity, 10))
+			if item.CoresPerSocket > 0 {
+				set("cpuid.coresPerSocket", strconv.FormatInt(item.CoresPerSocket, 10))
+			}
+		case resourceMemory:
+			unit, err := allocationUnits(item.AllocationUnits)
+			if err != nil {
+				return nil, nil, fmt.Errorf("memory item %s: %w", item.InstanceID, err)
+			}
+			set("memsize", strconv.FormatInt(item.VirtualQuantity*unit>>20, 10))
+		case resourceDisk, resourceCDROM, resourceDVD:
+			controller, ok := controllers[item.Parent]
+			if !ok {
+				return nil, nil, fmt.Errorf("%s %s sits on the unknown controller %s", itemKind(item), item.InstanceID, item.Parent)
+			}
+			slot := fmt.Sprintf("%s:%s", controller, cmp.Or(item.AddressOnParent, "0"))
+			set(slot+".present", "TRUE")
+			if item.ResourceType != resourceDisk {
+				set(slot+".deviceType", "cdrom-raw")
+				if href := fileOf(item.HostResource, files); href != "" {
+					set(slot+".deviceType", "cdrom-image")
+					set(slot+".fileName", href)
+				}
+				continue
+			}
+			disk, err := diskOf(item, disks, files)
+			if err != nil {
+				return nil, nil, err
+			}
+			name := disk.Href
+			if name == "" {
+				// Blank disks get the name VMware gives them when deploying the OVF.
+				name = fmt.Sprintf("%s-%s.vmdk", keys["displayName"], strings.ReplaceAll(slot, ":", "-"))
+			}
+			set(slot+".fileName", name)
+			diskFiles[name] = disk
+		case resourceEthernet:
+			id := fmt.Sprintf("ethernet%d", nic)
+			nic++
+			set(id+".present", "TRUE")
+			set(id+".virtualDev", nicVirtualDev(item.ResourceSubType))
+			if len(item.Connection) > 0 {
+				set(id+".networkName", item.Connection[0])
+			}
+			if item.Address != "" {
+				set(id+".addressType", "static")
+				set(id+".address", item.Address)
+			}
+			if connected, err := strconv.ParseBool(item.AutomaticAllocation); err == nil {
+				set(id+".startConnected", strings.ToUpper(strconv.FormatBool(connected)))
+			}
+		}
+	}
+
+	for _, c := range vs.Hardware.Config {
+		if key, ok := configKeys[c.Key]; ok {
+			set(key, c.Value)
+		} else if strings.HasPrefix(c.Key, "tools.") {
+			set(c.Key, c.Value)
+		}
+	}
+	for _, c := range vs.Hardware.ExtraConfig {
+		set(c.Key, c.Value)
+	}
+
+	var b strings.Builder
+	for _, key := range order {
+		fmt.Fprintf(&b, "%s = \"%s\"\n", key, escapeValue(keys[key]))
+	}
+	return []byte(b.String()), diskFiles, nil
+}
+
+// diskOf resolves the DiskSection entry and file of a disk item.
+func diskOf(item Item, disks map[string]VirtualDisk, files map[string]FileReference) (DiskFile, error) {
+	if len(item.HostResource) == 0 {
+		return DiskFile{}, fmt.Errorf("disk %s has no HostResource", item.InstanceID)
+	}
+	ref := item.HostResource[0]
+	id := ref[strings.LastIndex(ref, "/")+1:]
+	disk, ok := disks[id]
+	if !ok {
+		return DiskFile{}, fmt.Errorf("disk %s refers to %s, which the DiskSection does not define", item.InstanceID, ref)
+	}
+	unit, err := allocationUnits(cmp.Or(disk.CapacityUnits, "byte"))
+	if err != nil {
+		return DiskFile{}, fmt.Errorf("disk %s: %w", id, err)
+	}
+	capacity, err := strconv.ParseInt(disk.Capacity, 10, 64)
+	if err != nil {
+		return DiskFile{}, fmt.Errorf("disk %s has capacity '%s', OVF properties are not supported", id, disk.Capacity)
+	}
+	result := DiskFile{CapacityBytes: uint64(capacity * unit)}
+	if disk.FileRef == "" {
+		return result, nil
+	}
+	file, ok := files[disk.FileRef]
+	if !ok {
+		return DiskFile{}, fmt.Errorf("disk %s refers to the file %s, which the References do not define", id, disk.FileRef)
+	}
+	if file.Compression != "" && file.Compression != "identity" {
+		return DiskFile{}, fmt.Errorf("disk file %s is %s-compressed, which cannot be read in place; export the VM without compression", file.Href, file.Compression)
+	}
+	if file.ChunkSize > 0 {
+		return DiskFile{}, fmt.Errorf("disk file %s is split into chunks of %d bytes; join the %s.NNNNNNNNN chunks into %s first", file.Href, file.ChunkSize, file.Href, file.Href)
+	}
+	if !strings.HasSuffix(disk.Format, streamOptimizedFormat) && !strings.HasSuffix(strings.ToLower(file.Href), ".vmdk") {
+		return DiskFile{}, fmt.Errorf("disk file %s has the format %s; only VMDK disks are supported", file.Href, disk.Format)
+	}
+	result.Href = file.Href
+	return result, nil
+}
+
+// fileOf returns the file of an ovf:/file/<id> host resource, e.g. the ISO of a CD-ROM.
+func fileOf(hostResources []string, files map[string]FileReference) string {
+	for _, ref := range hostResources {
+		if id, ok := strings.CutPrefix(ref, "ovf:/file/"); ok {
+			return files[id].Href
+		}
+	}
+	return ""
+}
+
+func itemKind(item Item) string {
+	if item.ResourceType == resourceDisk {
+		return "disk"
+	}
+	return "CD-ROM"
+}
+
+// configKeys maps the vmw:Config keys, named after the vSphere API, to their VMX keys.
+var configKeys = map[string]string{
+	"firmware":                         "firmware",
+	"bootOptions.efiSecureBootEnabled": "uefi.secureBoot.enabled",
+	"nestedHVEnabled":                  "vhv.enable",
+	"cpuHotAddEnabled":                 "vcpu.hotadd",
+	"memoryHotAddEnabled":              "mem.hotadd",
+	"virtualSMCPresent":                "smc.present",
+}
+
+// scsiVirtualDev maps the ResourceSubType of a SCSI controller to its VMX virtualDev.
+func scsiVirtualDev(subType string) string {
+	switch strings.ToLower(subType) {
+	case "virtualscsi", "pvscsi":
+		return "pvscsi"
+	case "lsilogicsas":
+		return "lsisas1068"
+	case "buslogic":
+		return "buslogic"
+	}
+	return "lsilogic"
+}
+
+// nicVirtualDev maps the ResourceSubType of a NIC to its VMX virtualDev.
+func nicVirtualDev(subType string) string {
+	switch subType := strings.ToLower(subType); subType {
+	case "pcnet32":
+		return "vlance"
+	case "":
+		return "e1000"
+	default:
+		return subType
+	}
+}
+
+var allocationUnitsPattern = regexp.MustCompile(`^byte\s*(?:\*\s*2\s*\^\s*(\d+))?$`)
+
+// allocationUnits returns the bytes of one unit of a DSP0004 programmatic unit such as
+// "byte * 2^20", or of the MegaBytes style units of older exporters.
+func allocationUnits(units string) (int64, error) {
+	switch strings.ToLower(strings.TrimSpace(units)) {
+	case "kilobytes", "kb":
+		return 1 << 10, nil
+	case "megabytes", "mb":
+		return 1 << 20, nil
+	case "gigabytes", "gb":
+		return 1 << 30, nil
+	}
+	m := allocationUnitsPattern.FindStringSubmatch(strings.TrimSpace(units))
+	if m == nil {
+		return 0, fmt.Errorf("unsupported allocation units '%s'", units)
+	}
+	if m[1] == "" {
+		return 1, nil
+	}
+	exp, err := strconv.Atoi(m[1])
+	if err != nil || exp > 50 {
+		return 0, fmt.Errorf("unsupported allocation units '%s'", units)
+	}
+	return 1 << exp, nil
+}
+
+// hardwareVersion returns the newest vmx-NN virtual hardware version of a VirtualSystemType,
+// which lists the versions the VM runs on, e.g. "vmx-13 vmx-14".
+func hardwareVersion(systemType string) int {
+	version := 0
+	for _, field := range strings.Fields(systemType) {
+		if n, err := strconv.Atoi(strings.TrimPrefix(field, "vmx-")); err == nil && strings.HasPrefix(field, "vmx-") {
+			version = max(version, n)
+		}
+	}
+	return version
+}
+
+// guestIDSpecial are the vSphere guest IDs whose VMX guestOS does not follow the general rule.
+var guestIDSpecial = map[string]string{
+	"windows7Server64Guest": "windows7srv-64",
+	"windows8Server64Guest": "windows8srv-64",
+	"windows9Server64Guest": "windows9srv-64",
+}
+
+var guest64Pattern = regexp.MustCompile(`_?64$`)
+
+// GuestOS converts a vSphere guest ID, e.g. ubuntu64Guest or rhel8_64Guest, to the guestOS
+// value of a VMX, ubuntu-64 or rhel8-64.
+func GuestOS(guestID string) string {
+	if guest, ok := guestIDSpecial[guestID]; ok {
+		return guest
+	}
+	guest := strings.ToLower(strings.TrimSuffix(guestID, "Guest"))
+	return guest64Pattern.ReplaceAllString(guest, "-64")
+}
+
+// escapeValue escapes the characters a VMX value cannot hold verbatim.
+func escapeValue(value string) string {
+	return strings.NewReplacer("|", "|7C", `"`, "|22", "\n", "|0A", "\r", "").Replace(value)
+}
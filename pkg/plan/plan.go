@@ -0,0 +1,288 @@
+// Package plan reads migration plans: declarative lists of VMs converted with shared and per-VM
+// options, mappings and rename rules. A plan runs each VM as its own vmx2vmi conversion, and keeps
+// the status of every VM on disk, so a plan interrupted or partly failed resumes where it stopped.
+package plan
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"vmx2vmi/pkg/failure"
+	"vmx2vmi/pkg/vmx"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Plan is a migration plan. Relative paths in it are relative to the plan file.
+type Plan struct {
+	// VCenter is where the vm entries are read from.
+	VCenter *VCenter `json:"vcenter,omitempty"`
+	// Namespace, PVC, NetworkMap and StorageMap are the defaults of the VMs.
+	Namespace  string `json:"namespace,omitempty"`
+	PVC        string `json:"pvc,omitempty"`
+	NetworkMap string `json:"networkMap,omitempty"`
+	StorageMap string `json:"storageMap,omitempty"`
+	// Rename derives the names of the VMs without one from their VMware names; the first
+	// matching rule applies.
+	Rename []RenameRule `json:"rename,omitempty"`
+	// Options are the command-line options of every VM.
+	Options Options `json:"options,omitempty"`
+	VMs     []VM    `json:"vms"`
+
+	path  string
+	rules []*regexp.Regexp
+}
+
+// VCenter locates the vCenter or ESXi host of the vm entries; the password is read from
+// $VCENTER_PASSWORD.
+type VCenter struct {
+	URL        string `json:"url"`
+	User       string `json:"user"`
+	Insecure   bool   `json:"insecure,omitempty"`
+	Thumbprint string `json:"thumbprint,omitempty"`
+}
+
+// RenameRule renames the VMs whose VMware name matches the regular expression Match to Replace,
+// in which $1 and ${name} expand to the submatches.
+type RenameRule struct {
+	Match   string `json:"match"`
+	Replace string `json:"replace"`
+}
+
+// VM is a VM of the plan: a VM of the vCenter, as -vm takes it, or a VMX, OVA or OVF file. The
+// other fields override the defaults of the plan.
+type VM struct {
+	VM         string  `json:"vm,omitempty"`
+	VMX        string  `json:"vmx,omitempty"`
+	Name       string  `json:"name,omitempty"`
+	Namespace  string  `json:"namespace,omitempty"`
+	PVC        string  `json:"pvc,omitempty"`
+	NetworkMap string  `json:"networkMap,omitempty"`
+	StorageMap string  `json:"storageMap,omitempty"`
+	Options    Options `json:"options,omitempty"`
+	// Priority orders the VMs: those of a higher priority start first, those of the same in the
+	// order of the plan.
+	Priority int `json:"priority,omitempty"`
+	// Datastore and Network name the datastore the disks of the VM are read from and the network
+	// path they travel over, whose budgets the conversion of the VM runs within.
+	Datastore string `json:"datastore,omitempty"`
+	Network   string `json:"network,omitempty"`
+}
+
+// Source returns the -vm reference or VMX path of the VM.
+func (vm VM) Source() string {
+	if vm.VM != "" {
+		return vm.VM
+	}
+	return vm.VMX
+}
+
+// Options are command-line options by flag name, without the dash. A value is a string, number
+// or boolean, or a list of them for repeatable flags.
+type Options map[string]any
+
+// reservedOptions are set by the fields of the plan and its VMs.
+var reservedOptions = map[string]string{
+	"vm": "vm", "vmx": "vmx", "name": "name", "namespace": "namespace", "pvc": "pvc",
+	"network-map": "networkMap", "storage-map": "storageMap",
+	"vcenter-url": "vcenter", "vcenter-user": "vcenter", "vcenter-insecure": "vcenter", "vcenter-thumbprint": "vcenter",
+}
+
+// ManifestOptions are the options that only shape the generated manifests, from values rather
+// than files, and leave the cluster alone. The plans run for others, such as the jobs of the REST
+// API, take no other options: not those reading or writing files, such as cloud-init,
+// output-name or overlays, nor those using the cluster, such as kubeconfig, apply or preflight.
+var ManifestOptions = []string{
+	"annotation", "anti-affinity-label", "autoattach-graphics", "autoattach-mem-balloon", "autoattach-serial-console",
+	"block-multiqueue", "cpu-model", "create-pvc", "dedicated-cpus-for-affinity", "disk-map", "disk-source",
+	"disk-tuning", "eviction-strategy", "filesystem", "gpu", "host-device", "http-cert-configmap", "http-secret",
+	"http-url", "hyperv", "inject-guest-agent", "io-thread-count", "io-threads-policy", "label", "machine-type",
+	"net-binding", "nic-model", "node-selector", "o", "output-format", "output-kind", "overcommit-guest-overhead",
+	"overcommit-ratio", "performance-node-labels", "priority-class-map", "probe", "pvc-access-mode", "pvc-overhead",
+	"pvc-volume-mode", "rdm-map", "replicas", "run-strategy", "shared-disk-map", "ssh-key", "ssh-propagation",
+	"ssh-secret", "ssh-users", "storage-class", "sysprep-configmap", "sysprep-secret", "target-kubevirt-version",
+	"termination-grace-period", "toleration", "use-instancetype", "validate", "vddk-datastore-path",
+	"vddk-init-image", "vddk-secret", "vddk-thumbprint", "vddk-url", "vddk-vm-uuid",
+}
+
+// Load reads and validates the plan file at path.
+func Load(path string) (*Plan, error) {
+	p, err := load(path)
+	return p, failure.Wrap(failure.Parse, err)
+}
+
+func load(path string) (*Plan, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read plan: %w", err)
+	}
+	p := &Plan{path: path}
+	if err := yaml.UnmarshalStrict(data, p); err != nil {
+		return nil, fmt.Errorf("failed to parse plan %s: %w", path, err)
+	}
+	if len(p.VMs) == 0 {
+		return nil, fmt.Errorf("plan %s lists no VMs", path)
+	}
+	if p.VCenter != nil && (p.VCenter.URL == "" || p.VCenter.User == "") {
+		return nil, fmt.Errorf("plan %s: vcenter needs a url and a user", path)
+	}
+	for _, rule := range p.Rename {
+		re, err := regexp.Compile(rule.Match)
+		if err != nil {
+			return nil, fmt.Errorf("plan %s: invalid rename rule '%s': %w", path, rule.Match, err)
+		}
+		p.rules = append(p.rules, re)
+	}
+	if err := p.Options.Validate(); err != nil {
+		return nil, fmt.Errorf("plan %s: %w", path, err)
+	}
+	seen := make(map[string]bool)
+	for _, vm := range p.VMs {
+		switch {
+		case (vm.VM == "") == (vm.VMX == ""):
+			return nil, fmt.Errorf("plan %s: every VM needs either a vm or a vmx", path)
+		case vm.VM != "" && p.VCenter == nil:
+			return nil, fmt.Errorf("plan %s: VM %s is read from vCenter, which needs vcenter", path, vm.VM)
+		case seen[vm.Source()]:
+			return nil, fmt.Errorf("plan %s: VM %s is listed twice", path, vm.Source())
+		case vm.PVC == "" && p.PVC == "":
+			return nil, fmt.Errorf("plan %s: VM %s has no pvc, set it on the VM or the plan, e.g. '{name}-boot'", path, vm.Source())
+		}
+		seen[vm.Source()] = true
+		if err := vm.Options.Validate(); err != nil {
+			return nil, fmt.Errorf("plan %s, VM %s: %w", path, vm.Source(), err)
+		}
+	}
+	return p, nil
+}
+
+// Validate checks that the options are not set by fields of the plan, and that their values
+// are strings, numbers, booleans or lists of them.
+func (o Options) Validate() error {
+	for name, value := range o {
+		if field, ok := reservedOptions[name]; ok {
+			return fmt.Errorf("option %s is set with the %s field", name, field)
+		}
+		values, ok := value.([]any)
+		if !ok {
+			values = []any{value}
+		}
+		for _, v := range values {
+			switch v.(type) {
+			case string, float64, bool:
+			default:
+				return fmt.Errorf("option %s must be a string, number, boolean or a list of them", name)
+			}
+		}
+	}
+	return nil
+}
+
+// OptionNames returns the names of the options used by the plan and its VMs, sorted.
+func (p *Plan) OptionNames() []string {
+	names := slices.Collect(maps.Keys(p.Options))
+	for _, vm := range p.VMs {
+		names = append(names, slices.Collect(maps.Keys(vm.Options))...)
+	}
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+// Dir returns the directory of the plan file, which the VMs are converted in.
+func (p *Plan) Dir() string {
+	return filepath.Dir(p.path)
+}
+
+// Name returns the name of the VM in the cluster: its own, the result of the first matching
+// rename rule, or "" for the conversion to derive it from the VMX displayName.
+func (p *Plan) Name(vm VM) string {
+	if vm.Name != "" || len(p.rules) == 0 {
+		return vm.Name
+	}
+	// The VMware name is the last element of an inventory path, or the displayName of a VMX.
+	source := ""
+	if vm.VM != "" && strings.Contains(vm.VM, "/") {
+		source = path.Base(vm.VM)
+	} else if vm.VMX != "" {
+		vmxPath := vm.VMX
+		if !filepath.IsAbs(vmxPath) {
+			vmxPath = filepath.Join(p.Dir(), vmxPath)
+		}
+		if config, err := vmx.ParseVMX(vmxPath); err == nil {
+			source = config.DisplayName
+		}
+	}
+	for i, re := range p.rules {
+		if source != "" && re.MatchString(source) {
+			return re.ReplaceAllString(source, p.Rename[i].Replace)
+		}
+	}
+	return ""
+}
+
+// Args returns the command-line arguments converting vm.
+func (p *Plan) Args(vm VM) []string {
+	var args []string
+	if vm.VM != "" {
+		args = append(args, "-vcenter-url", p.VCenter.URL, "-vcenter-user", p.VCenter.User, "-vm", vm.VM)
+		if p.VCenter.Insecure {
+			args = append(args, "-vcenter-insecure")
+		}
+		if p.VCenter.Thumbprint != "" {
+			args = append(args, "-vcenter-thumbprint", p.VCenter.Thumbprint)
+		}
+	} else {
+		args = append(args, "-vmx", vm.VMX)
+	}
+	if name := p.Name(vm); name != "" {
+		args = append(args, "-name", name)
+	}
+	for _, field := range []struct{ flag, value, fallback string }{
+		{"namespace", vm.Namespace, p.Namespace},
+		{"pvc", vm.PVC, p.PVC},
+		{"network-map", vm.NetworkMap, p.NetworkMap},
+		{"storage-map", vm.StorageMap, p.StorageMap},
+	} {
+		if value := cmp.Or(field.value, field.fallback); value != "" {
+			args = append(args, "-"+field.flag, value)
+		}
+	}
+
+	// The options of the VM replace those of the plan of the same name.
+	options := maps.Clone(p.Options)
+	if options == nil {
+		options = Options{}
+	}
+	maps.Copy(options, vm.Options)
+	return append(args, options.Args()...)
+}
+
+// Args returns the options as command-line arguments, sorted by name.
+func (o Options) Args() []string {
+	var args []string
+	for _, name := range slices.Sorted(maps.Keys(o)) {
+		values, ok := o[name].([]any)
+		if !ok {
+			values = []any{o[name]}
+		}
+		for _, v := range values {
+			switch v := v.(type) {
+			case string:
+				args = append(args, "-"+name, v)
+			case float64:
+				args = append(args, "-"+name, strconv.FormatFloat(v, 'f', -1, 64))
+			case bool:
+				args = append(args, "-"+name+"="+strconv.FormatBool(v))
+			}
+		}
+	}
+	return args
+}
@@ -0,0 +1,261 @@
+package plan
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"vmx2vmi/pkg/batch"
+	"vmx2vmi/pkg/failure"
+	"vmx2vmi/pkg/logging"
+	"vmx2vmi/pkg/progress"
+	"vmx2vmi/pkg/transfer"
+
+	"sigs.k8s.io/yaml"
+)
+
+// States of a VM of a plan.
+const (
+	Pending   = "pending"
+	Running   = "running"
+	Succeeded = "succeeded"
+	Failed    = "failed"
+	Skipped   = "skipped"
+)
+
+// Status is the state of the VMs of a plan, saved next to it in <plan>.status.yaml.
+type Status struct {
+	VMs []VMStatus `json:"vms"`
+}
+
+// VMStatus is the state of one VM of a plan.
+type VMStatus struct {
+	Source string `json:"source"`
+	Name   string `json:"name,omitempty"`
+	State  string `json:"state"`
+	// Args are the arguments of the last conversion; a VM converted with other arguments than
+	// the plan now gives is converted again.
+	Args     []string   `json:"args,omitempty"`
+	Attempts int        `json:"attempts,omitempty"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	// ExitCode is the exit status of the last failed conversion, see the failure package.
+	ExitCode int `json:"exitCode,omitempty"`
+	// Log is the output of the last conversion, relative to the plan.
+	Log string `json:"log,omitempty"`
+}
+
+// StatusPath returns the path of the status file of the plan.
+func (p *Plan) StatusPath() string {
+	return strings.TrimSuffix(p.path, filepath.Ext(p.path)) + ".status.yaml"
+}
+
+// LoadStatus reads the status of the plan, with a pending entry for the VMs it has not run.
+// Entries of VMs removed from the plan are dropped.
+func (p *Plan) LoadStatus() (*Status, error) {
+	saved := &Status{}
+	data, err := os.ReadFile(p.StatusPath())
+	if err == nil {
+		if err := yaml.Unmarshal(data, saved); err != nil {
+			return nil, fmt.Errorf("failed to parse plan status %s: %w", p.StatusPath(), err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read plan status: %w", err)
+	}
+	status := &Status{}
+	for _, vm := range p.VMs {
+		i := slices.IndexFunc(saved.VMs, func(s VMStatus) bool { return s.Source == vm.Source() })
+		if i < 0 {
+			status.VMs = append(status.VMs, VMStatus{Source: vm.Source(), State: Pending})
+			continue
+		}
+		status.VMs = append(status.VMs, saved.VMs[i])
+	}
+	return status, nil
+}
+
+// save writes the status atomically, so an interrupted run leaves the previous one.
+func (p *Plan) save(status *Status) error {
+	data, err := yaml.Marshal(status)
+	if err != nil {
+		return err
+	}
+	tmp := p.StatusPath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write plan status: %w", err)
+	}
+	return os.Rename(tmp, p.StatusPath())
+}
+
+// Run converts the VMs of the plan, each with its own run of command, the vmx2vmi binary, in the
+// directory of the plan. The runs are scheduled by priority, then in order, within budgets: those
+// of the datastores and networks of the VMs, each run getting its share of their bandwidth, and
+// MaxConcurrent runs at a time. VMs already converted with the same arguments are skipped; a
+// failed VM does not stop the others. notify is called, never concurrently, when a VM starts and
+// when it ends. observe, when not nil, is called with the progress updates the conversions write
+// in the json -progress mode. The status is saved after every change; the error is only about
+// saving it, and no VM starts once saving failed.
+func (p *Plan) Run(ctx context.Context, command string, budgets transfer.SchedulerConfig, notify func(i int, vm VMStatus), observe func(i int, u progress.Update)) (*Status, error) {
+	status, err := p.LoadStatus()
+	if err != nil {
+		return nil, err
+	}
+	logDir := strings.TrimSuffix(p.path, filepath.Ext(p.path)) + ".logs"
+	if err := os.MkdirAll(logDir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create the log directory of the plan: %w", err)
+	}
+	// mu guards status and saveErr, and serializes notify.
+	var mu sync.Mutex
+	var saveErr error
+	run := func(ctx context.Context, i int, rate int64) {
+		vm := p.VMs[i]
+		mu.Lock()
+		s := &status.VMs[i]
+		args := p.Args(vm)
+		if saveErr != nil {
+			mu.Unlock()
+			return
+		}
+		if s.State == Succeeded && slices.Equal(s.Args, args) {
+			notify(i, VMStatus{Source: s.Source, Name: s.Name, State: Skipped})
+			mu.Unlock()
+			return
+		}
+		started := time.Now().UTC().Truncate(time.Second)
+		s.Name, s.State, s.Args, s.Started, s.Finished, s.Error, s.ExitCode = p.Name(vm), Running, args, &started, nil, "", 0
+		s.Attempts++
+		logName := logFileName.ReplaceAllString(vm.Source(), "_") + ".log"
+		s.Log, _ = filepath.Rel(p.Dir(), filepath.Join(logDir, logName))
+		if saveErr = p.save(status); saveErr != nil {
+			mu.Unlock()
+			return
+		}
+		notify(i, *s)
+		mu.Unlock()
+
+		var onUpdate func(progress.Update)
+		if observe != nil {
+			onUpdate = func(u progress.Update) { observe(i, u) }
+		}
+		err := p.convert(ctx, command, batch.WithRate(args, rate), filepath.Join(logDir, logName), onUpdate)
+		mu.Lock()
+		defer mu.Unlock()
+		finished := time.Now().UTC().Truncate(time.Second)
+		s.Finished = &finished
+		s.State = Succeeded
+		if err != nil {
+			s.State, s.Error, s.ExitCode = Failed, err.Error(), failure.KindOf(err).ExitCode()
+		}
+		if err := p.save(status); err != nil {
+			saveErr = cmp.Or(saveErr, err)
+		}
+		notify(i, *s)
+	}
+	jobs := make([]transfer.Job, len(p.VMs))
+	for i, vm := range p.VMs {
+		jobs[i] = transfer.Job{ID: vm.Source(), VM: p.Name(vm), Priority: vm.Priority, Datastore: vm.Datastore, Network: vm.Network,
+			Run: func(ctx context.Context, grant transfer.Grant) error {
+				run(ctx, i, grant.Rate)
+				return nil
+			}}
+	}
+	transfer.NewScheduler(budgets).Run(ctx, jobs)
+	return status, saveErr
+}
+
+var logFileName = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// convert runs one conversion with its output in logPath, calling onUpdate, when not nil, with
+// the progress updates among its output. Its error is the last error the conversion logged.
+func (p *Plan) convert(ctx context.Context, command string, args []string, logPath string, onUpdate func(progress.Update)) error {
+	logFile, err := os.Create(logPath)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+	cmd := exec.CommandContext(ctx, command, args...)
+	cmd.Dir = p.Dir()
+	cmd.Stdout, cmd.Stderr = logFile, logFile
+	if onUpdate != nil {
+		output, writer := io.Pipe()
+		cmd.Stdout = io.MultiWriter(logFile, writer)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			scanner := bufio.NewScanner(output)
+			for scanner.Scan() {
+				if u, ok := progress.ParseUpdate(scanner.Text()); ok {
+					onUpdate(u)
+				}
+			}
+			// Drain what a line too long for the scanner left, so the run does not block on it.
+			io.Copy(io.Discard, output)
+		}()
+		defer func() { writer.Close(); <-done }()
+	}
+	if runErr := cmd.Run(); runErr != nil {
+		kind := failure.General
+		if exitErr, ok := runErr.(*exec.ExitError); ok {
+			kind = failure.FromExitCode(exitErr.ExitCode())
+		}
+		if last := lastLine(logPath); last != "" {
+			return failure.Wrap(kind, errors.New(last))
+		}
+		return failure.Wrap(kind, runErr)
+	}
+	return nil
+}
+
+// lastLine returns the message of the last error in the log at path, or of its last line.
+func lastLine(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	return logging.LastMessage(f)
+}
+
+// Err returns the error of a failed VM, of the kind of the exit status of its conversion.
+func (s VMStatus) Err() error {
+	if s.State != Failed {
+		return nil
+	}
+	return failure.Errorf(failure.FromExitCode(s.ExitCode), "%s", s.Error)
+}
+
+// Failed reports whether a VM of the plan failed or was not run.
+func (s *Status) Failed() bool {
+	return slices.ContainsFunc(s.VMs, func(vm VMStatus) bool { return vm.State != Succeeded })
+}
+
+// WriteTable renders the status of the VMs as an aligned table.
+func WriteTable(w io.Writer, status *Status) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "VM\tNAME\tSTATE\tATTEMPTS\tDETAIL")
+	for _, vm := range status.VMs {
+		detail := vm.Error
+		if detail == "" {
+			detail = vm.Log
+		}
+		name := vm.Name
+		if name == "" {
+			name = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\n", vm.Source, name, vm.State, vm.Attempts, detail)
+	}
+	return tw.Flush()
+}
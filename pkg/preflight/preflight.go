@@ -0,0 +1,294 @@
+// Package preflight checks that a cluster provides what the converted VMs need before a
+// migration starts: KubeVirt, CDI, Multus networks, storage classes, snapshots and feature gates.
+package preflight
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"vmx2vmi/pkg/cluster"
+	"vmx2vmi/pkg/kubevirt"
+
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	cdiv1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
+)
+
+// Status is the outcome of a check.
+type Status string
+
+const (
+	Pass Status = "PASS"
+	// Warn is a check that may cause trouble depending on the VMs, or that cannot be told apart
+	// from a default of the cluster.
+	Warn Status = "WARN"
+	Fail Status = "FAIL"
+)
+
+// Result is the outcome of one check.
+type Result struct {
+	Check  string `json:"check"`
+	Status Status `json:"status"`
+	Detail string `json:"detail"`
+}
+
+// Options describes the migration the cluster is checked for, from the conversion options.
+type Options struct {
+	Namespace string
+	// StorageClass of the PVCs and DataVolumes; empty for the default storage class.
+	StorageClass string
+	// DiskSource is the -disk-source of the VMs: pvc, vddk, http or upload.
+	DiskSource string
+	// Networks are the NetworkAttachmentDefinitions of the network map, as <namespace>/<name>
+	// or <name> in Namespace.
+	Networks []string
+	// Bindings are the network bindings of the VMs, e.g. bridge or macvtap.
+	Bindings []string
+	// Pool tells that the VMs are written as VirtualMachinePools.
+	Pool bool
+	// Filesystems tells that the VMs share volumes over virtiofs.
+	Filesystems bool
+	// SharedDisks tells that the VMs have multi-writer disks with SCSI reservations.
+	SharedDisks bool
+}
+
+// volumeSnapshotClassList is the subset of the snapshot.storage.k8s.io VolumeSnapshotClass list
+// read by the snapshot check.
+type volumeSnapshotClassList struct {
+	Items []struct {
+		Driver string `json:"driver"`
+	} `json:"items"`
+}
+
+// Run checks the cluster of client for opts. The checks after the connection go on when one
+// fails, so the report lists everything to fix.
+func Run(ctx context.Context, client *cluster.Client, opts Options) []Result {
+	var results []Result
+	add := func(check string, status Status, format string, args ...any) {
+		results = append(results, Result{Check: check, Status: status, Detail: fmt.Sprintf(format, args...)})
+	}
+
+	var version struct {
+		GitVersion string `json:"gitVersion"`
+	}
+	if err := client.Get(ctx, "/version", &version); err != nil {
+		add("Cluster", Fail, "cannot reach %s: %v", client.Config.Server, err)
+		return results
+	}
+	add("Cluster", Pass, "Kubernetes %s at %s", version.GitVersion, client.Config.Server)
+
+	var ns corev1.Namespace
+	if err := client.Get(ctx, "/api/v1/namespaces/"+opts.Namespace, &ns); err != nil {
+		add("Namespace", Fail, "namespace %s: %v", opts.Namespace, err)
+	} else {
+		add("Namespace", Pass, "namespace %s exists", opts.Namespace)
+	}
+
+	target, err := kubevirt.DetectTarget(ctx, client)
+	if err != nil {
+		add("KubeVirt", Fail, "%v", err)
+	} else {
+		add("KubeVirt", Pass, "KubeVirt %s", target.Version)
+	}
+
+	var cdis cdiv1.CDIList
+	switch err := client.Get(ctx, "/apis/cdi.kubevirt.io/v1beta1/cdis", &cdis); {
+	case err != nil || len(cdis.Items) == 0:
+		status := Fail
+		if opts.DiskSource == "pvc" {
+			// Existing claims are attached as they are; CDI only imports disks.
+			status = Warn
+		}
+		add("CDI", status, "CDI is not installed, DataVolumes cannot import disks")
+	case cdis.Items[0].Status.Phase != "Deployed":
+		add("CDI", Fail, "CDI %s is %s, not Deployed", cdis.Items[0].Name, cdis.Items[0].Status.Phase)
+	default:
+		add("CDI", Pass, "CDI %s deployed", cdis.Items[0].Status.ObservedVersion)
+		if opts.DiskSource == "upload" {
+			var config cdiv1.CDIConfig
+			if err := client.Get(ctx, "/apis/cdi.kubevirt.io/v1beta1/cdiconfigs/config", &config); err != nil {
+				add("CDI upload proxy", Fail, "cannot read the CDIConfig: %v", err)
+			} else if config.Status.UploadProxyURL == nil || *config.Status.UploadProxyURL == "" {
+				add("CDI upload proxy", Warn, "the CDIConfig has no uploadProxyURL; pass -uploadproxy-url to upload-disk")
+			} else {
+				add("CDI upload proxy", Pass, "%s", *config.Status.UploadProxyURL)
+			}
+		}
+	}
+
+	checkNetworks(ctx, client, opts, add)
+	provisioner := checkStorageClass(ctx, client, opts, add)
+
+	if provisioner != "" {
+		var classes volumeSnapshotClassList
+		switch err := client.Get(ctx, "/apis/snapshot.storage.k8s.io/v1/volumesnapshotclasses", &classes); {
+		case cluster.IsNotFound(err):
+			add("Snapshots", Warn, "the VolumeSnapshot API is not installed, VMs cannot be snapshotted")
+		case err != nil:
+			add("Snapshots", Warn, "cannot list VolumeSnapshotClasses: %v", err)
+		default:
+			found := false
+			for _, class := range classes.Items {
+				found = found || class.Driver == provisioner
+			}
+			if found {
+				add("Snapshots", Pass, "a VolumeSnapshotClass serves %s", provisioner)
+			} else {
+				add("Snapshots", Warn, "no VolumeSnapshotClass serves %s, VMs cannot be snapshotted", provisioner)
+			}
+		}
+	}
+
+	if target != nil {
+		checkFeatureGates(target, opts, add)
+	}
+	return results
+}
+
+// checkNetworks checks the Multus API and the NetworkAttachmentDefinitions of opts.
+func checkNetworks(ctx context.Context, client *cluster.Client, opts Options, add func(string, Status, string, ...any)) {
+	err := client.Get(ctx, "/apis/k8s.cni.cncf.io/v1", nil)
+	if err != nil {
+		status := Warn
+		if len(opts.Networks) > 0 {
+			status = Fail
+		}
+		add("Multus", status, "the NetworkAttachmentDefinition API is not installed, VMs only reach the pod network: %v", err)
+		return
+	}
+	add("Multus", Pass, "the NetworkAttachmentDefinition API is installed")
+	for _, network := range opts.Networks {
+		namespace, name := opts.Namespace, network
+		if i := strings.Index(network, "/"); i >= 0 {
+			namespace, name = network[:i], network[i+1:]
+		}
+		path := fmt.Sprintf("/apis/k8s.cni.cncf.io/v1/namespaces/%s/network-attachment-definitions/%s", namespace, name)
+		if err := client.Get(ctx, path, nil); err != nil {
+			add("Network "+network, Fail, "NetworkAttachmentDefinition %s/%s: %v", namespace, name, err)
+			continue
+		}
+		add("Network "+network, Pass, "NetworkAttachmentDefinition %s/%s exists", namespace, name)
+	}
+}
+
+// checkStorageClass checks the storage class of opts, or the default one, and its CDI storage
+// profile. It returns its provisioner, or "" when there is no class.
+func checkStorageClass(ctx context.Context, client *cluster.Client, opts Options, add func(string, Status, string, ...any)) string {
+	var classes storagev1.StorageClassList
+	if err := client.Get(ctx, "/apis/storage.k8s.io/v1/storageclasses", &classes); err != nil {
+		add("Storage class", Fail, "cannot list storage classes: %v", err)
+		return ""
+	}
+	var class *storagev1.StorageClass
+	for i := range classes.Items {
+		c := &classes.Items[i]
+		if opts.StorageClass == "" && c.Annotations["storageclass.kubernetes.io/is-default-class"] == "true" {
+			class = c
+		}
+		if opts.StorageClass != "" && c.Name == opts.StorageClass {
+			class = c
+		}
+	}
+	switch {
+	case class == nil && opts.StorageClass != "":
+		add("Storage class", Fail, "storage class %s does not exist", opts.StorageClass)
+		return ""
+	case class == nil:
+		status := Fail
+		if opts.DiskSource == "pvc" {
+			status = Warn
+		}
+		add("Storage class", status, "no default storage class; pass -storage-class")
+		return ""
+	}
+	binding := storagev1.VolumeBindingImmediate
+	if class.VolumeBindingMode != nil {
+		binding = *class.VolumeBindingMode
+	}
+	add("Storage class", Pass, "%s (%s, %s binding)", class.Name, class.Provisioner, binding)
+
+	// CDI derives the access and volume modes of DataVolumes using the storage API from the profile.
+	var profile cdiv1.StorageProfile
+	if err := client.Get(ctx, "/apis/cdi.kubevirt.io/v1beta1/storageprofiles/"+class.Name, &profile); err == nil {
+		if len(profile.Status.ClaimPropertySets) == 0 {
+			add("Storage profile", Warn, "the CDI storage profile of %s has no claimPropertySets; DataVolumes must set accessModes and volumeMode", class.Name)
+		} else {
+			set := profile.Status.ClaimPropertySets[0]
+			mode := "Filesystem"
+			if set.VolumeMode != nil {
+				mode = string(*set.VolumeMode)
+			}
+			add("Storage profile", Pass, "%s defaults to %v %s", class.Name, set.AccessModes, mode)
+		}
+	}
+	return class.Provisioner
+}
+
+// checkFeatureGates checks the feature gates and binding plugins the VMs of opts need.
+// Gates enabled by default are not listed in the KubeVirt CR, so a missing gate only warns.
+func checkFeatureGates(target *kubevirt.Target, opts Options, add func(string, Status, string, ...any)) {
+	gate := func(name, reason string) {
+		if target.FeatureGates[name] {
+			add("Feature gate "+name, Pass, "enabled, for %s", reason)
+		} else {
+			add("Feature gate "+name, Warn, "not enabled in the KubeVirt CR, needed for %s unless enabled by default in KubeVirt %s", reason, target.Version)
+		}
+	}
+	for _, binding := range opts.Bindings {
+		if binding != "macvtap" {
+			continue
+		}
+		if target.Version.Before(1, 1) {
+			gate("Macvtap", "the macvtap binding")
+		} else if target.BindingPlugins["macvtap"] {
+			add("Binding plugin macvtap", Pass, "registered in the KubeVirt CR")
+		} else {
+			add("Binding plugin macvtap", Fail, "not registered in spec.configuration.network.binding of the KubeVirt CR")
+		}
+		break
+	}
+	if opts.Pool {
+		gate("VMPool", "VirtualMachinePools")
+	}
+	if opts.Filesystems {
+		if target.Version.Before(1, 5) {
+			gate("ExperimentalVirtiofsSupport", "virtiofs filesystems")
+		} else {
+			gate("EnableVirtioFsStorageVolumes", "virtiofs filesystems of PVCs")
+		}
+	}
+	if opts.SharedDisks {
+		gate("PersistentReservation", "SCSI reservations of shared disks")
+	}
+}
+
+// Failed reports whether a check failed.
+func Failed(results []Result) bool {
+	for _, r := range results {
+		if r.Status == Fail {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteTable writes results as an aligned table followed by the overall outcome.
+func WriteTable(w io.Writer, results []Result) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHECK\tSTATUS\tDETAIL")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", r.Check, r.Status, r.Detail)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	outcome := "Preflight passed"
+	if Failed(results) {
+		outcome = "Preflight failed"
+	}
+	_, err := fmt.Fprintf(w, "\n%s\n", outcome)
+	return err
+}
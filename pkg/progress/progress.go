@@ -0,0 +1,310 @@
+// Package progress reports how far disk copies have gone, as terminal progress bars or as
+// JSON lines for external UIs.
+package progress
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Modes accepted by New.
+const (
+	ModeAuto = "auto" // bars when stderr is a terminal, nothing otherwise
+	ModeBar  = "bar"
+	ModeJSON = "json"
+	ModeNone = "none"
+)
+
+// Tracker renders the progress of a set of disks until Stop is called.
+type Tracker struct {
+	mode     string
+	out      io.Writer
+	interval time.Duration
+
+	mu    sync.Mutex
+	disks []*Disk
+	lines int // bar lines drawn by the previous render
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Disk is the progress of one disk copy. A nil *Disk is valid and reports nothing, so that
+// callers need not check whether progress is enabled.
+type Disk struct {
+	name string
+
+	mu      sync.Mutex
+	total   int64
+	copied  int64
+	retries int
+	start   time.Time
+	end     time.Time
+}
+
+// Update is one JSON line written in ModeJSON, for a disk or, with Type "total", for all disks.
+type Update struct {
+	Type           string  `json:"type"`
+	Disk           string  `json:"disk,omitempty"`
+	CopiedBytes    int64   `json:"copiedBytes"`
+	TotalBytes     int64   `json:"totalBytes"`
+	Percent        float64 `json:"percent"`
+	BytesPerSecond float64 `json:"bytesPerSecond"`
+	ETASeconds     float64 `json:"etaSeconds"`
+	// Retries counts the attempts of the copy that failed and were retried.
+	Retries int  `json:"retries,omitempty"`
+	Done    bool `json:"done"`
+}
+
+// ParseUpdate returns the Update of a line written in ModeJSON, and false for other lines.
+func ParseUpdate(line string) (Update, bool) {
+	var u Update
+	if !strings.HasPrefix(line, `{"type":`) || json.Unmarshal([]byte(line), &u) != nil {
+		return Update{}, false
+	}
+	return u, u.Type == "disk" || u.Type == "total"
+}
+
+// New returns a tracker for mode. Bars are drawn on stderr, JSON lines written to stdout.
+func New(mode string) (*Tracker, error) {
+	t := &Tracker{mode: mode, out: os.Stderr, interval: 500 * time.Millisecond}
+	switch mode {
+	case ModeAuto:
+		t.mode = ModeNone
+		if info, err := os.Stderr.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+			t.mode = ModeBar
+		}
+	case ModeBar, ModeNone:
+	case ModeJSON:
+		t.out, t.interval = os.Stdout, time.Second
+	default:
+		return nil, fmt.Errorf("unsupported progress mode '%s', must be auto, bar, json or none", mode)
+	}
+	return t, nil
+}
+
+// Add registers a disk of total bytes; total may be set later with SetTotal.
+func (t *Tracker) Add(name string, total int64) *Disk {
+	if t == nil || t.mode == ModeNone {
+		return nil
+	}
+	d := &Disk{name: name, total: total}
+	t.mu.Lock()
+	t.disks = append(t.disks, d)
+	t.mu.Unlock()
+	return d
+}
+
+// Start renders the progress periodically in the background.
+func (t *Tracker) Start() {
+	if t == nil || t.mode == ModeNone {
+		return
+	}
+	t.stop, t.done = make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(t.done)
+		ticker := time.NewTicker(t.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-t.stop:
+				t.render(true)
+				return
+			case <-ticker.C:
+				t.render(false)
+			}
+		}
+	}()
+}
+
+// Stop renders the final state and stops rendering.
+func (t *Tracker) Stop() {
+	if t == nil || t.stop == nil {
+		return
+	}
+	close(t.stop)
+	<-t.done
+	t.stop = nil
+}
+
+func (t *Tracker) render(final bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	updates := make([]Update, 0, len(t.disks)+1)
+	total := Update{Type: "total", Done: true}
+	var first time.Time
+	for _, d := range t.disks {
+		u := d.update()
+		updates = append(updates, u)
+		total.CopiedBytes += u.CopiedBytes
+		total.TotalBytes += u.TotalBytes
+		total.Retries += u.Retries
+		total.Done = total.Done && u.Done
+		d.mu.Lock()
+		if !d.start.IsZero() && (first.IsZero() || d.start.Before(first)) {
+			first = d.start
+		}
+		d.mu.Unlock()
+	}
+	if !first.IsZero() {
+		total.fill(time.Since(first))
+	}
+	if len(t.disks) > 1 {
+		updates = append(updates, total)
+	}
+
+	if t.mode == ModeJSON {
+		enc := json.NewEncoder(t.out)
+		for _, u := range updates {
+			enc.Encode(u)
+		}
+		return
+	}
+
+	var b strings.Builder
+	if t.lines > 0 {
+		fmt.Fprintf(&b, "\x1b[%dA", t.lines)
+	}
+	for _, u := range updates {
+		b.WriteString("\x1b[2K")
+		b.WriteString(bar(u))
+		b.WriteString("\n")
+	}
+	t.lines = len(updates)
+	if final {
+		t.lines = 0
+	}
+	io.WriteString(t.out, b.String())
+}
+
+// bar renders one progress line.
+func bar(u Update) string {
+	const width = 30
+	name := u.Disk
+	if u.Type == "total" {
+		name = "total"
+	}
+	filled := int(u.Percent / 100 * width)
+	eta := "-"
+	if u.Done {
+		eta = "done"
+	} else if u.ETASeconds > 0 {
+		eta = (time.Duration(u.ETASeconds) * time.Second).String()
+	}
+	return fmt.Sprintf("%-20s [%s%s] %5.1f%% %10s / %-10s %8.1f MB/s  ETA %s", name,
+		strings.Repeat("#", filled), strings.Repeat("-", width-filled), u.Percent,
+		formatBytes(u.CopiedBytes), formatBytes(u.TotalBytes), u.BytesPerSecond/1e6, eta)
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GiB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+	}
+	return fmt.Sprintf("%d B", n)
+}
+
+// fill derives the percentage, throughput and ETA of u from its byte counts.
+func (u *Update) fill(elapsed time.Duration) {
+	if u.TotalBytes > 0 {
+		u.Percent = min(100, float64(u.CopiedBytes)*100/float64(u.TotalBytes))
+	}
+	if elapsed > 0 {
+		u.BytesPerSecond = float64(u.CopiedBytes) / elapsed.Seconds()
+	}
+	if !u.Done && u.BytesPerSecond > 0 && u.TotalBytes > u.CopiedBytes {
+		u.ETASeconds = float64(u.TotalBytes-u.CopiedBytes) / u.BytesPerSecond
+	}
+}
+
+func (d *Disk) update() Update {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	u := Update{Type: "disk", Disk: d.name, CopiedBytes: d.copied, TotalBytes: d.total, Retries: d.retries, Done: !d.end.IsZero()}
+	if !d.start.IsZero() {
+		end := d.end
+		if end.IsZero() {
+			end = time.Now()
+		}
+		u.fill(end.Sub(d.start))
+	}
+	return u
+}
+
+// SetTotal sets the number of bytes the copy will read.
+func (d *Disk) SetTotal(total int64) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	d.total = total
+	d.mu.Unlock()
+}
+
+// Set records that copied bytes were read so far.
+func (d *Disk) Set(copied int64) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	if d.start.IsZero() {
+		d.start = time.Now()
+	}
+	d.copied = copied
+	d.mu.Unlock()
+}
+
+// Retry records that an attempt of the copy failed and is retried.
+func (d *Disk) Retry() {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	d.retries++
+	d.mu.Unlock()
+}
+
+// Done marks the copy as finished.
+func (d *Disk) Done() {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	d.copied = max(d.copied, d.total)
+	d.end = time.Now()
+	d.mu.Unlock()
+}
+
+// Wrap counts the bytes read through r. A read at offset 0 restarts the count, as a retried
+// upload does.
+func (d *Disk) Wrap(r io.ReaderAt) io.ReaderAt {
+	if d == nil {
+		return r
+	}
+	return &reader{r: r, d: d}
+}
+
+type reader struct {
+	r io.ReaderAt
+	d *Disk
+}
+
+func (r *reader) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.r.ReadAt(p, off)
+	r.d.mu.Lock()
+	if r.d.start.IsZero() || off == 0 {
+		r.d.start = time.Now()
+		r.d.copied = 0
+	}
+	r.d.copied += int64(n)
+	r.d.mu.Unlock()
+	return n, err
+}
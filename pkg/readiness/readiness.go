@@ -0,0 +1,199 @@
+// Package readiness follows an applied VM until its disks are imported, it runs and its guest
+// agent connects.
+package readiness
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"vmx2vmi/pkg/cluster"
+
+	kubevirtv1 "kubevirt.io/api/core/v1"
+	cdiv1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
+)
+
+// Stage is how far Wait follows the VM.
+type Stage int
+
+const (
+	// Imported waits for the DataVolumes of the VM to be populated.
+	Imported Stage = iota
+	// Running also waits for the VMI to run.
+	Running
+	// AgentConnected also waits for the guest agent to connect.
+	AgentConnected
+)
+
+// ParseStage parses a -wait-for value: imported, running or agent.
+func ParseStage(s string) (Stage, error) {
+	switch s {
+	case "imported":
+		return Imported, nil
+	case "running":
+		return Running, nil
+	case "agent":
+		return AgentConnected, nil
+	}
+	return 0, fmt.Errorf("invalid stage '%s': must be imported, running or agent", s)
+}
+
+// pollInterval is the time between two reads of the resources followed.
+const pollInterval = 5 * time.Second
+
+// failedStatuses are the printable statuses of a VM that does not recover without a change.
+var failedStatuses = map[kubevirtv1.VirtualMachinePrintableStatus]bool{
+	kubevirtv1.VirtualMachineStatusCrashLoopBackOff: true,
+	kubevirtv1.VirtualMachineStatusErrImagePull:     true,
+	kubevirtv1.VirtualMachineStatusImagePullBackOff: true,
+	kubevirtv1.VirtualMachineStatusPvcNotFound:      true,
+	kubevirtv1.VirtualMachineStatusDataVolumeError:  true,
+}
+
+// Step is a milestone reached by the VM, with the time it took since Wait was called.
+type Step struct {
+	Description string
+	Elapsed     time.Duration
+}
+
+// Wait polls the VM named name in namespace, as applied from vm, until it reaches stage or ctx
+// is done. The VM only runs when its run strategy starts it; otherwise Wait stops once the
+// disks are imported, or waiting for the VM to consume them. logf reports the progress. Wait
+// returns the steps reached, also on error.
+func Wait(ctx context.Context, client *cluster.Client, vm *kubevirtv1.VirtualMachine, stage Stage, logf func(format string, args ...any)) ([]Step, error) {
+	start := time.Now()
+	var steps []Step
+	reached := func(format string, args ...any) {
+		step := Step{Description: fmt.Sprintf(format, args...), Elapsed: time.Since(start).Round(time.Second)}
+		logf("%s after %s", step.Description, step.Elapsed)
+		steps = append(steps, step)
+	}
+	namespace, name := vm.Namespace, vm.Name
+
+	started := false
+	if vm.Spec.RunStrategy != nil {
+		switch *vm.Spec.RunStrategy {
+		case kubevirtv1.RunStrategyAlways, kubevirtv1.RunStrategyRerunOnFailure, kubevirtv1.RunStrategyOnce:
+			started = true
+		}
+	}
+	if !started && stage > Imported {
+		logf("The run strategy of VM %s/%s does not start it, waiting for its disks only", namespace, name)
+		stage = Imported
+	}
+
+	for _, template := range vm.Spec.DataVolumeTemplates {
+		waiting, err := waitDataVolume(ctx, client, namespace, template.Name, started, logf)
+		if err != nil {
+			return steps, err
+		}
+		if waiting {
+			reached("DataVolume %s/%s waits for the VM to start to be populated", namespace, template.Name)
+			continue
+		}
+		reached("DataVolume %s/%s imported", namespace, template.Name)
+	}
+	if stage == Imported {
+		return steps, nil
+	}
+
+	vmiPath := fmt.Sprintf("/apis/kubevirt.io/v1/namespaces/%s/virtualmachineinstances/%s", namespace, name)
+	vmPath := fmt.Sprintf("/apis/kubevirt.io/v1/namespaces/%s/virtualmachines/%s", namespace, name)
+	running := false
+	var status kubevirtv1.VirtualMachinePrintableStatus
+	for {
+		var current kubevirtv1.VirtualMachine
+		if err := client.Get(ctx, vmPath, &current); err != nil {
+			return steps, fmt.Errorf("failed to read VM: %w", err)
+		}
+		if current.Status.PrintableStatus != status {
+			status = current.Status.PrintableStatus
+			logf("VM %s/%s is %s", namespace, name, status)
+		}
+		if failedStatuses[status] {
+			return steps, fmt.Errorf("VM %s/%s is %s", namespace, name, status)
+		}
+
+		var vmi kubevirtv1.VirtualMachineInstance
+		err := client.Get(ctx, vmiPath, &vmi)
+		if err != nil && !cluster.IsNotFound(err) {
+			return steps, fmt.Errorf("failed to read VMI: %w", err)
+		}
+		if err == nil {
+			if vmi.Status.Phase == kubevirtv1.Failed {
+				return steps, fmt.Errorf("VMI %s/%s failed: %s", namespace, name, vmi.Status.Reason)
+			}
+			if !running && vmi.Status.Phase == kubevirtv1.Running {
+				running = true
+				node := ""
+				if vmi.Status.NodeName != "" {
+					node = " on " + vmi.Status.NodeName
+				}
+				reached("VMI %s/%s running%s", namespace, name, node)
+				if stage == Running {
+					return steps, nil
+				}
+			}
+			if running && agentConnected(&vmi) {
+				reached("Guest agent of %s/%s connected", namespace, name)
+				return steps, nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			if running {
+				return steps, fmt.Errorf("the guest agent of %s/%s did not connect: %w", namespace, name, ctx.Err())
+			}
+			return steps, fmt.Errorf("VMI %s/%s is not running (VM %s): %w", namespace, name, status, ctx.Err())
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// waitDataVolume polls a DataVolume until it is populated. When the VM is not started, a
+// DataVolume waiting for its first consumer is reported as waiting instead.
+func waitDataVolume(ctx context.Context, client *cluster.Client, namespace, name string, started bool, logf func(format string, args ...any)) (bool, error) {
+	path := fmt.Sprintf("/apis/cdi.kubevirt.io/v1beta1/namespaces/%s/datavolumes/%s", namespace, name)
+	var phase cdiv1.DataVolumePhase
+	var progress cdiv1.DataVolumeProgress
+	for {
+		var dv cdiv1.DataVolume
+		err := client.Get(ctx, path, &dv)
+		if err != nil && !cluster.IsNotFound(err) {
+			return false, fmt.Errorf("failed to read DataVolume: %w", err)
+		}
+		// The DataVolume of a template is created by KubeVirt shortly after the VM.
+		if err == nil {
+			if dv.Status.Phase != phase || dv.Status.Progress != progress {
+				phase, progress = dv.Status.Phase, dv.Status.Progress
+				logf("DataVolume %s/%s is %s %s", namespace, name, phase, progress)
+			}
+			switch phase {
+			case cdiv1.Succeeded:
+				return false, nil
+			case cdiv1.Failed:
+				return false, fmt.Errorf("DataVolume %s/%s failed", namespace, name)
+			case cdiv1.WaitForFirstConsumer, cdiv1.PendingPopulation:
+				if !started {
+					return true, nil
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return false, fmt.Errorf("DataVolume %s/%s is not imported (phase %q %s): %w", namespace, name, phase, progress, ctx.Err())
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// agentConnected reports whether the guest agent of vmi is connected.
+func agentConnected(vmi *kubevirtv1.VirtualMachineInstance) bool {
+	for _, c := range vmi.Status.Conditions {
+		if c.Type == kubevirtv1.VirtualMachineInstanceAgentConnected {
+			return c.Status == "True"
+		}
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+package report
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"text/tabwriter"
+
+	"vmx2vmi/pkg/vmdk"
+	"vmx2vmi/pkg/vmx"
+)
+
+// filesystemOverhead is the share of a Filesystem volume mode PVC that CDI reserves for the
+// filesystem by default (CDIConfig filesystemOverhead).
+const filesystemOverhead = 0.055
+
+// DiskUsage summarizes the size and provisioning of one virtual disk.
+type DiskUsage struct {
+	Disk           string `json:"disk"`
+	Path           string `json:"path"`
+	CapacityBytes  int64  `json:"capacityBytes"`
+	AllocatedBytes int64  `json:"allocatedBytes"`
+	Provisioning   string `json:"provisioning"`
+	// ChainDepth is the number of disks in the snapshot chain, 1 for a disk without snapshots.
+	ChainDepth int `json:"chainDepth"`
+	// SuggestedPVCSize is the PVC request fitting the disk in Filesystem volume mode.
+	SuggestedPVCSize string `json:"suggestedPVCSize"`
+	Error            string `json:"error,omitempty"`
+}
+
+// MeasureDisk opens the VMDK at path, with its snapshot chain, and summarizes its usage.
+// Failures are recorded in the Error field so that one unreadable disk does not hide the others.
+func MeasureDisk(id, path string) DiskUsage {
+	u := DiskUsage{Disk: id, Path: path}
+	chain, err := vmdk.OpenChain(path)
+	if err != nil {
+		u.Error = err.Error()
+		return u
+	}
+	defer chain.Close()
+
+	u.CapacityBytes = chain.Size()
+	u.Provisioning = chain.Provisioning()
+	u.ChainDepth = len(chain.Layers)
+	u.SuggestedPVCSize = SuggestPVCSize(u.CapacityBytes)
+	if u.AllocatedBytes, err = chain.AllocatedBytes(); err != nil {
+		u.Error = err.Error()
+	}
+	return u
+}
+
+// MeasureVMXDisks summarizes every disk of a parsed VMX. Raw device mappings are reported
+// with their descriptor capacity since their data lives on the mapped LUN, and blank OVF disks
+// with the capacity the OVF declares.
+func MeasureVMXDisks(vmxConfig *vmx.VMXConfig) []DiskUsage {
+	var usages []DiskUsage
+	for _, d := range vmxConfig.Disks {
+		if d.RawDeviceMapping != "" {
+			usages = append(usages, DiskUsage{
+				Disk:          d.ID(),
+				Path:          d.Path,
+				CapacityBytes: int64(d.CapacityBytes),
+				Provisioning:  "rdm",
+				Error:         "raw device mapping, map the LUN with -rdm-map",
+			})
+			continue
+		}
+		if d.Provisioning == "blank" {
+			usages = append(usages, DiskUsage{
+				Disk:             d.ID(),
+				Path:             d.Path,
+				CapacityBytes:    int64(d.CapacityBytes),
+				Provisioning:     d.Provisioning,
+				SuggestedPVCSize: SuggestPVCSize(int64(d.CapacityBytes)),
+			})
+			continue
+		}
+		usages = append(usages, MeasureDisk(d.ID(), d.Path))
+	}
+	return usages
+}
+
+// SuggestPVCSize returns the PVC size, in whole GiB, holding a disk of capacity bytes
+// in Filesystem volume mode. Block mode PVCs only need the capacity itself.
+func SuggestPVCSize(capacity int64) string {
+	gib := math.Ceil(float64(capacity) / (1 - filesystemOverhead) / (1 << 30))
+	return fmt.Sprintf("%dGi", int64(max(gib, 1)))
+}
+
+// WriteDiskTable renders disk usages as an aligned table.
+func WriteDiskTable(w io.Writer, usages []DiskUsage) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DISK\tCAPACITY\tALLOCATED\tPROVISIONING\tCHAIN\tPVC SIZE\tPATH")
+	for _, u := range usages {
+		if u.Error != "" && u.CapacityBytes == 0 {
+			fmt.Fprintf(tw, "%s\t-\t-\t-\t-\t-\t%s (%s)\n", u.Disk, u.Path, u.Error)
+			continue
+		}
+		pvcSize := u.SuggestedPVCSize
+		if pvcSize == "" {
+			pvcSize = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n", u.Disk, formatSize(u.CapacityBytes), formatSize(u.AllocatedBytes),
+			u.Provisioning, u.ChainDepth, pvcSize, u.Path)
+	}
+	return tw.Flush()
+}
+
+// formatSize renders a size in GiB, or MiB below 1 GiB.
+func formatSize(bytes int64) string {
+	if bytes < 1<<30 {
+		return fmt.Sprintf("%.1f MiB", float64(bytes)/(1<<20))
+	}
+	return fmt.Sprintf("%.1f GiB", float64(bytes)/(1<<30))
+}
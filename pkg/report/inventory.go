@@ -0,0 +1,55 @@
+package report
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"vmx2vmi/pkg/vsphere"
+)
+
+// WriteInventoryTable renders the VMs of an inventory listing as an aligned table. The cluster
+// column names the host of VMs outside a cluster.
+func WriteInventoryTable(w io.Writer, vms []vsphere.InventoryVM) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tFOLDER\tCLUSTER\tPOWER\tGUEST OS\tCPUS\tMEMORY\tDISKS\tNETWORKS\tTAGS")
+	for _, vm := range vms {
+		power := vm.PowerState
+		if vm.Template {
+			power = "template"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\t%s\t%d (%s)\t%s\t%s\n", vm.Name, orDash(vm.Folder), orDash(vm.Cluster, vm.Host), power,
+			orDash(vm.GuestOS, vm.GuestID), vm.CPUs, formatSize(vm.MemoryMB<<20), vm.Disks, formatSize(vm.DiskCapacityBytes),
+			orDash(strings.Join(vm.Networks, ",")), orDash(strings.Join(vm.Tags, ",")))
+	}
+	return tw.Flush()
+}
+
+// WriteInventoryCSV writes the VMs of an inventory listing as CSV with a header row, the lists
+// of networks and tags joined with semicolons.
+func WriteInventoryCSV(w io.Writer, vms []vsphere.InventoryVM) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"name", "id", "path", "datacenter", "folder", "cluster", "host", "powerState", "template",
+		"guestId", "guestOS", "cpus", "memoryMB", "disks", "diskCapacityBytes", "networks", "tags"})
+	for _, vm := range vms {
+		cw.Write([]string{vm.Name, vm.ID, vm.Path, vm.Datacenter, vm.Folder, vm.Cluster, vm.Host, vm.PowerState,
+			strconv.FormatBool(vm.Template), vm.GuestID, vm.GuestOS, strconv.Itoa(vm.CPUs),
+			strconv.FormatInt(vm.MemoryMB, 10), strconv.Itoa(vm.Disks), strconv.FormatInt(vm.DiskCapacityBytes, 10),
+			strings.Join(vm.Networks, ";"), strings.Join(vm.Tags, ";")})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// orDash returns the first non-empty value, or - when all are empty.
+func orDash(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return "-"
+}
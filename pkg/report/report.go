@@ -0,0 +1,233 @@
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"vmx2vmi/pkg/vmx"
+)
+
+// Finding describes a single source setting and what happens to it in KubeVirt.
+type Finding struct {
+	Feature string `json:"feature"` // Short name of the VMware feature (e.g. "Shared folder")
+	Setting string `json:"setting"` // VMX key(s) the finding was derived from
+	Detail  string `json:"detail"`  // Explanation and suggested replacement, if any
+}
+
+// Report is the conversion report written next to the generated manifest, as text and as JSON.
+type Report struct {
+	VMName     string `json:"vmName"`
+	SourcePath string `json:"sourcePath"`
+	// SourceSHA256 is the sha256 of the VMX the VM was converted from.
+	SourceSHA256     string     `json:"sourceSHA256,omitempty"`
+	ConverterVersion string     `json:"converterVersion,omitempty"`
+	ConvertedAt      time.Time  `json:"convertedAt"`
+	Disks            []vmx.Disk `json:"-"`
+	// GuestAgent is the guest agent recommendation for the guest OS.
+	GuestAgent string `json:"guestAgent,omitempty"`
+	// Mappings describes source settings translated into something other than a 1:1 field copy.
+	Mappings     []string  `json:"mappings"`
+	LostFeatures []Finding `json:"lostFeatures"`
+	Requirements []Finding `json:"requirements"`
+	// Settings lists every key of the VMX and what became of it, see AuditSettings.
+	Settings []Setting `json:"settings"`
+}
+
+// New builds a conversion report for the given VMX configuration.
+func New(vmName, sourcePath string, vmxConfig *vmx.VMXConfig) *Report {
+	return &Report{
+		VMName:       vmName,
+		SourcePath:   sourcePath,
+		SourceSHA256: vmxConfig.SourceSHA256,
+		Disks:        vmxConfig.Disks,
+		LostFeatures: AuditLostFeatures(vmxConfig),
+		Requirements: AuditRequirements(vmxConfig),
+	}
+}
+
+// AuditRequirements lists what the target cluster must provide for the converted VM to work,
+// such as shared storage for clustered guests.
+func AuditRequirements(vmxConfig *vmx.VMXConfig) []Finding {
+	var findings []Finding
+	for _, d := range vmxConfig.Disks {
+		if !d.Shared() {
+			continue
+		}
+		detail := "shared with other VMs; its PVC must use accessModes ReadWriteMany and volumeMode Block"
+		if strings.EqualFold(d.SharedBus, "physical") {
+			detail += ", and SCSI persistent reservations require the PersistentReservation feature gate"
+		}
+		findings = append(findings, Finding{
+			Feature: "Shared disk " + d.ID(),
+			Setting: fmt.Sprintf("%s.sharing=%q, %s%d.sharedBus=%q", d.ID(), d.Sharing, d.Bus, d.Controller, d.SharedBus),
+			Detail:  detail,
+		})
+	}
+	return findings
+}
+
+// AuditLostFeatures lists desktop and appliance integration features configured in the VMX
+// that have no equivalent in KubeVirt, so VDI and appliance migrations know what will stop working.
+func AuditLostFeatures(vmxConfig *vmx.VMXConfig) []Finding {
+	var findings []Finding
+
+	hgfsDisabled := vmxConfig.Isolation.HGFSDisabled != nil && *vmxConfig.Isolation.HGFSDisabled
+	for _, sf := range vmxConfig.SharedFolders {
+		if !sf.Enabled || hgfsDisabled {
+			continue
+		}
+		access := "read-only"
+		if sf.Writable {
+			access = "read-write"
+		}
+		findings = append(findings, Finding{
+			Feature: "Shared folder",
+			Setting: fmt.Sprintf("sharedFolder%d", sf.Index),
+			Detail: fmt.Sprintf("host path '%s' shared as '%s' (%s); HGFS does not exist in KubeVirt, use a virtiofs filesystem or a network share instead",
+				sf.HostPath, sf.GuestName, access),
+		})
+	}
+
+	if isEnabled(vmxConfig.Isolation.DragAndDropDisabled) {
+		findings = append(findings, Finding{
+			Feature: "Drag and drop",
+			Setting: "isolation.tools.dnd.disable",
+			Detail:  "host/guest drag and drop is enabled; KubeVirt consoles (VNC/serial) offer no equivalent",
+		})
+	}
+	if isEnabled(vmxConfig.Isolation.CopyDisabled) || isEnabled(vmxConfig.Isolation.PasteDisabled) {
+		findings = append(findings, Finding{
+			Feature: "Copy and paste",
+			Setting: "isolation.tools.copy.disable, isolation.tools.paste.disable",
+			Detail:  "clipboard sharing is enabled; use a remote desktop protocol (RDP, SPICE-capable client) inside the guest instead",
+		})
+	}
+
+	if len(vmxConfig.GuestInfo) > 0 {
+		keys := make([]string, 0, len(vmxConfig.GuestInfo))
+		for k := range vmxConfig.GuestInfo {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		findings = append(findings, Finding{
+			Feature: "Appliance properties (guestinfo)",
+			Setting: strings.Join(keys, ", "),
+			Detail:  "guestinfo variables are not available to the guest in KubeVirt; pass appliance configuration through cloud-init or sysprep instead",
+		})
+	}
+
+	return findings
+}
+
+// isEnabled reports whether an isolation "disable" toggle was explicitly set to FALSE.
+// Absent keys are not reported since ESXi disables these features by default.
+func isEnabled(disabled *bool) bool {
+	return disabled != nil && !*disabled
+}
+
+// WriteText renders the report in a human readable form.
+func (r *Report) WriteText(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Conversion report for VirtualMachine %s\n", r.VMName)
+	fmt.Fprintf(&b, "Source: %s\n\n", r.SourcePath)
+
+	if r.GuestAgent != "" {
+		fmt.Fprintf(&b, "Guest agent: %s\n\n", r.GuestAgent)
+	}
+
+	b.WriteString("Disks:\n")
+	if len(r.Disks) == 0 {
+		b.WriteString("  none\n")
+	}
+	for _, d := range r.Disks {
+		size, provisioning := "unknown size", d.Provisioning
+		if d.CapacityBytes > 0 {
+			size = fmt.Sprintf("%.1f GiB", float64(d.CapacityBytes)/(1<<30))
+		}
+		if provisioning == "" {
+			provisioning = "unknown provisioning"
+		}
+		fmt.Fprintf(&b, "  - %s %s: %s, %s\n", d.ID(), d.FileName, size, provisioning)
+	}
+
+	if len(r.Mappings) > 0 {
+		b.WriteString("\nMappings:\n")
+		for _, m := range r.Mappings {
+			fmt.Fprintf(&b, "  - %s\n", m)
+		}
+	}
+
+	b.WriteString("\nLost features:\n")
+	if len(r.LostFeatures) == 0 {
+		b.WriteString("  none\n")
+	}
+	for _, f := range r.LostFeatures {
+		fmt.Fprintf(&b, "  - %s [%s]: %s\n", f.Feature, f.Setting, f.Detail)
+	}
+
+	b.WriteString("\nCluster requirements:\n")
+	if len(r.Requirements) == 0 {
+		b.WriteString("  none\n")
+	}
+	for _, f := range r.Requirements {
+		fmt.Fprintf(&b, "  - %s [%s]: %s\n", f.Feature, f.Setting, f.Detail)
+	}
+
+	if len(r.Settings) > 0 {
+		outcomes := make(map[string]int)
+		for _, s := range r.Settings {
+			outcomes[s.Outcome]++
+		}
+		fmt.Fprintf(&b, "\nSource settings: %d mapped, %d dropped, %d ignored\n",
+			outcomes[OutcomeMapped], outcomes[OutcomeDropped], outcomes[OutcomeIgnored])
+		for _, s := range r.Settings {
+			if s.Outcome == OutcomeDropped {
+				fmt.Fprintf(&b, "  - dropped %s = %q: %s\n", s.Key, s.Value, s.Reason)
+			}
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// diskJSON is a disk of the report as WriteJSON renders it.
+type diskJSON struct {
+	ID            string `json:"id"`
+	FileName      string `json:"fileName"`
+	CapacityBytes uint64 `json:"capacityBytes,omitempty"`
+	Provisioning  string `json:"provisioning,omitempty"`
+}
+
+// WriteJSON renders the report as indented JSON, for audit trails and tooling.
+func (r *Report) WriteJSON(w io.Writer) error {
+	report := *r
+	// Empty lists stay lists in the JSON, not null.
+	if report.Mappings == nil {
+		report.Mappings = []string{}
+	}
+	if report.LostFeatures == nil {
+		report.LostFeatures = []Finding{}
+	}
+	if report.Requirements == nil {
+		report.Requirements = []Finding{}
+	}
+	if report.Settings == nil {
+		report.Settings = []Setting{}
+	}
+	out := struct {
+		*Report
+		Disks []diskJSON `json:"disks"`
+	}{Report: &report, Disks: []diskJSON{}}
+	for _, d := range r.Disks {
+		out.Disks = append(out.Disks, diskJSON{ID: d.ID(), FileName: d.FileName, CapacityBytes: d.CapacityBytes, Provisioning: d.Provisioning})
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(out)
+}
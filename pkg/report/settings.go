@@ -0,0 +1,430 @@
+package report
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"vmx2vmi/pkg/kubevirt"
+	"vmx2vmi/pkg/vmx"
+
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+// What the conversion did with a source setting.
+const (
+	// OutcomeMapped settings are carried over to the VirtualMachine.
+	OutcomeMapped = "mapped"
+	// OutcomeDropped settings change the VM but have no counterpart in the VirtualMachine.
+	OutcomeDropped = "dropped"
+	// OutcomeIgnored settings only matter to VMware, such as file format versions.
+	OutcomeIgnored = "ignored"
+)
+
+// Setting is a key of the source VMX and what the conversion did with it.
+type Setting struct {
+	Key     string `json:"key"`
+	Value   string `json:"value"`
+	Outcome string `json:"outcome"`
+	// Target is the field of the VirtualMachine, or the object, the setting was mapped to.
+	Target string `json:"target,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// ignoredPrefixes are VMware bookkeeping keys with no meaning outside of VMware.
+var ignoredPrefixes = []string{
+	"checkpoint.", "migrate.", "monitor.", "vmotion.", "vmxstats.", "numa.autosize.", "sched.swap.",
+	"softpoweroff", "cleanshutdown", "extendedconfigfile", "filesearchpath", "uuid.location",
+	"hpet0.", "pcibridge", "vm.genid", "replay.", "svga.vramsize", "viv.",
+}
+
+// droppedDevices explains why the devices of a VMX prefix, e.g. serial0, are not converted.
+var droppedDevices = []struct{ prefix, reason string }{
+	{"serial", "serial ports are not converted; KubeVirt gives the VM a single serial console"},
+	{"parallel", "KubeVirt has no parallel ports"},
+	{"floppy", "KubeVirt has no floppy drives"},
+	{"usb", "USB devices are not passed through; KubeVirt only adds a USB tablet for VNC consoles"},
+	{"ehci", "USB controllers are not converted; KubeVirt adds the one its devices need"},
+	{"sound", "KubeVirt VMs have no sound card"},
+	{"pcipassthru", "PCI devices are not passed through from the VMX; request them with -gpu or -host-device"},
+	{"vmci", "VMCI has no KubeVirt equivalent"},
+	{"vtpm", "the vTPM and its secrets are not migrated; KubeVirt can give the VM a new, empty TPM"},
+}
+
+// AuditSettings lists every key of the VMX, in key order, with what the conversion made of it in
+// vm, the VirtualMachine as generated. It is the evidence trail auditors ask of migrations of
+// regulated workloads: settings the VirtualMachine does not reflect are reported as dropped, even
+// when the options of the conversion left them out.
+func AuditSettings(vmxConfig *vmx.VMXConfig, vm *kubevirtv1.VirtualMachine) []Setting {
+	a := newSettingsAudit(vmxConfig, vm)
+	keys := make([]string, 0, len(vmxConfig.Raw))
+	for key := range vmxConfig.Raw {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return strings.ToLower(keys[i]) < strings.ToLower(keys[j]) })
+
+	settings := make([]Setting, 0, len(keys))
+	for _, key := range keys {
+		s := Setting{Key: key, Value: vmxConfig.Raw[key]}
+		s.Outcome, s.Target, s.Reason = a.audit(strings.ToLower(key), s.Value)
+		settings = append(settings, s)
+	}
+	return settings
+}
+
+// settingsAudit holds what AuditSettings looks up in the VirtualMachine.
+type settingsAudit struct {
+	vmxConfig *vmx.VMXConfig
+	vm        *kubevirtv1.VirtualMachine
+	spec      *kubevirtv1.VirtualMachineInstanceSpec
+	// disks maps the VMX device of each disk to its KubeVirt disk, when the VM has it.
+	disks map[string]kubevirtv1.Disk
+	// cdroms holds the VMX devices of the CD/DVD drives.
+	cdroms map[string]bool
+	// nics maps each network adapter, e.g. ethernet0, to its interface, nil when the VM has none.
+	nics map[string]*kubevirtv1.Interface
+}
+
+func newSettingsAudit(vmxConfig *vmx.VMXConfig, vm *kubevirtv1.VirtualMachine) *settingsAudit {
+	a := &settingsAudit{
+		vmxConfig: vmxConfig,
+		vm:        vm,
+		spec:      &kubevirtv1.VirtualMachineInstanceSpec{},
+		disks:     make(map[string]kubevirtv1.Disk),
+		cdroms:    make(map[string]bool),
+		nics:      make(map[string]*kubevirtv1.Interface),
+	}
+	if vm.Spec.Template != nil {
+		a.spec = &vm.Spec.Template.Spec
+	}
+	devices := &a.spec.Domain.Devices
+	for id, name := range kubevirt.DiskNames(vmxConfig.Disks) {
+		for _, disk := range devices.Disks {
+			if disk.Name == name {
+				a.disks[id] = disk
+			}
+		}
+	}
+	for _, d := range vmxConfig.CDROMs {
+		a.cdroms[d.ID()] = true
+	}
+
+	// Adapters keep their name, except the one on the pod network, which becomes the default
+	// interface; adapters skipped by the network map have none.
+	var unnamed []string
+	for _, nic := range vmxConfig.NICs {
+		name := fmt.Sprintf("ethernet%d", nic.Index)
+		a.nics[name] = a.iface(name)
+		if a.nics[name] == nil {
+			unnamed = append(unnamed, name)
+		}
+	}
+	if pod := a.iface("default"); pod != nil && len(unnamed) == 1 {
+		a.nics[unnamed[0]] = pod
+	}
+	return a
+}
+
+// iface returns the interface of the VM named name, nil when it has none.
+func (a *settingsAudit) iface(name string) *kubevirtv1.Interface {
+	for i, iface := range a.spec.Domain.Devices.Interfaces {
+		if iface.Name == name {
+			return &a.spec.Domain.Devices.Interfaces[i]
+		}
+	}
+	return nil
+}
+
+// audit returns the outcome, target and reason of the VMX key, lower-cased, of value.
+func (a *settingsAudit) audit(key, value string) (outcome, target, reason string) {
+	device, field, _ := strings.Cut(key, ".")
+	switch {
+	case key == ".encoding":
+		return OutcomeIgnored, "", "character set of the VMX file; the values were decoded with it"
+	case key == "config.version" || key == "virtualhw.productcompatibility":
+		return OutcomeIgnored, "", "version of the VMX file format"
+	case strings.HasSuffix(key, ".pcislotnumber"):
+		return OutcomeIgnored, "", "PCI slot of the VMware virtual hardware; KubeVirt places its devices itself"
+	case key == "displayname":
+		return a.name(value)
+	case key == "guestos":
+		return OutcomeMapped, fmt.Sprintf("defaults for %s guests", a.vmxConfig.GuestOSFamily()),
+			"selects the machine type, interface models, Hyper-V enlightenments and guest agent guidance"
+	case key == "numvcpus" || key == "memsize":
+		return a.sizing(key)
+	case key == "cpuid.corespersocket":
+		if a.vmxConfig.CoresPerSocket == a.vmxConfig.NumVCPUs {
+			return OutcomeMapped, "single socket", "every vCPU is a core of a single socket, as on KubeVirt"
+		}
+		return OutcomeDropped, "", "KubeVirt gets every vCPU as a core of a single socket"
+	case key == "virtualhw.version":
+		if machine := a.spec.Domain.Machine; machine != nil {
+			return OutcomeMapped, "domain.machine.type=" + machine.Type, "with the guest OS, decides between the q35 and pc machine types"
+		}
+		return OutcomeDropped, "", "the VirtualMachine leaves the machine type to the cluster default"
+	case key == "firmware" || key == "uefi.secureboot.enabled":
+		return a.firmware(key)
+	case key == "nvram":
+		return OutcomeDropped, "", "the UEFI variables are not migrated; the guest boots from its default boot entry"
+	case key == "uuid.bios":
+		return a.annotation(kubevirt.SourceUUIDAnnotation)
+	case key == "vc.uuid":
+		return a.annotation(kubevirt.SourceVCUUIDAnnotation)
+	case key == "disk.enableuuid":
+		if a.vmxConfig.DiskEnableUUID && a.hasSerials() {
+			return OutcomeMapped, "serial of each disk", "the guest sees the VMDK UUIDs as disk serials"
+		}
+		return OutcomeIgnored, "", "the guest sees no disk UUIDs"
+	case key == "vhv.enable":
+		if cpu := a.spec.Domain.CPU; a.vmxConfig.NestedVirtualization && cpu != nil && cpu.Model == kubevirtv1.CPUModeHostPassthrough {
+			return OutcomeMapped, "domain.cpu.model=" + cpu.Model, "nested hypervisors need the virtualization extensions of the host"
+		}
+		if a.vmxConfig.NestedVirtualization {
+			return OutcomeDropped, "", "the CPU model of the VirtualMachine was overridden; the guest may lack virtualization extensions"
+		}
+		return OutcomeIgnored, "", "nested virtualization is off"
+	case strings.HasPrefix(key, "sched."):
+		return a.scheduling(key)
+	case key == "powertype.poweroff":
+		if grace := a.spec.TerminationGracePeriodSeconds; grace != nil {
+			return OutcomeMapped, fmt.Sprintf("terminationGracePeriodSeconds=%d", *grace), "how long the guest gets to shut down"
+		}
+		return OutcomeDropped, "", "the VirtualMachine keeps the termination grace period of the cluster"
+	case device == "powertype":
+		return OutcomeDropped, "", "KubeVirt resets and suspends VMs its own way"
+	case key == "svga.present":
+		if autoattach := a.spec.Domain.Devices.AutoattachGraphicsDevice; autoattach != nil && !*autoattach {
+			return OutcomeMapped, "devices.autoattachGraphicsDevice=false", "the VM is headless"
+		}
+		return OutcomeMapped, "VGA device", "KubeVirt attaches a standard VGA device for the VNC console"
+	case device == "svga" || device == "mks":
+		return OutcomeDropped, "", "video and remote console settings of VMware; KubeVirt attaches a standard VGA device"
+	case device == "encryption":
+		return OutcomeDropped, "", "VM encryption is not migrated; store the disks in an encrypted StorageClass"
+	case device == "guestinfo":
+		return OutcomeDropped, "", "guestinfo variables are not available to the guest in KubeVirt; pass them through cloud-init or sysprep"
+	case strings.HasPrefix(key, "sharedfolder"):
+		return OutcomeDropped, "", "HGFS does not exist in KubeVirt; use a virtiofs filesystem or a network share"
+	case device == "isolation":
+		return OutcomeDropped, "", "host integration of VMware Tools (shared folders, clipboard, drag and drop) has no KubeVirt equivalent"
+	case device == "tools" || device == "toolsinstallmanager":
+		return OutcomeDropped, "", "VMware Tools settings; the guest agent of KubeVirt is qemu-guest-agent"
+	case device == "annotation":
+		return OutcomeDropped, "", "the notes of the VM are not kept"
+	}
+	if slot, ok := diskSlot(device); ok {
+		return a.diskSetting(slot, field, value)
+	}
+	if bus, ok := controller(device); ok {
+		return a.controllerSetting(bus, device, field)
+	}
+	if strings.HasPrefix(device, "ethernet") {
+		return a.nicSetting(device, field)
+	}
+	for _, prefix := range ignoredPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return OutcomeIgnored, "", "VMware bookkeeping with no meaning outside of VMware"
+		}
+	}
+	for _, d := range droppedDevices {
+		if !strings.HasPrefix(device, d.prefix) {
+			continue
+		}
+		if present, ok := a.vmxConfig.GetBool(device + ".present"); ok && !present {
+			return OutcomeIgnored, "", "the device is not present"
+		}
+		return OutcomeDropped, "", d.reason
+	}
+	return OutcomeDropped, "", "not read by the converter; the VirtualMachine has no counterpart"
+}
+
+func (a *settingsAudit) name(value string) (outcome, target, reason string) {
+	target = "metadata.name=" + a.vm.Name
+	if original, ok := a.vm.Annotations[kubevirt.DisplayNameAnnotation]; ok && original == value {
+		return OutcomeMapped, target, "not a valid Kubernetes name; kept verbatim in the " + kubevirt.DisplayNameAnnotation + " annotation"
+	}
+	if kubevirt.SanitizeName(value) != a.vm.Name {
+		return OutcomeDropped, "", "the VirtualMachine was named with -name"
+	}
+	return OutcomeMapped, target, "name of the VirtualMachine"
+}
+
+func (a *settingsAudit) sizing(key string) (outcome, target, reason string) {
+	if it := a.vm.Spec.Instancetype; it != nil {
+		return OutcomeMapped, fmt.Sprintf("%s %s", it.Kind, it.Name), "the VM is sized by an instancetype"
+	}
+	domain := a.spec.Domain
+	if key == "numvcpus" && domain.CPU != nil && domain.CPU.Cores > 0 {
+		return OutcomeMapped, fmt.Sprintf("domain.cpu.cores=%d", domain.CPU.Cores), "number of vCPUs"
+	}
+	if key == "memsize" && domain.Memory != nil && domain.Memory.Guest != nil {
+		return OutcomeMapped, "domain.memory.guest=" + domain.Memory.Guest.String(), "memory of the guest"
+	}
+	return OutcomeDropped, "", "the VirtualMachine does not set it"
+}
+
+func (a *settingsAudit) firmware(key string) (outcome, target, reason string) {
+	if !(key == "firmware" && a.vmxConfig.Firmware == "efi" || key == "uefi.secureboot.enabled" && a.vmxConfig.SecureBoot) {
+		return OutcomeMapped, "BIOS", "KubeVirt boots with BIOS by default"
+	}
+	if firmware := a.spec.Domain.Firmware; firmware != nil && firmware.Bootloader != nil && firmware.Bootloader.EFI != nil {
+		return OutcomeMapped, "domain.firmware.bootloader.efi", "the guest boots with UEFI"
+	}
+	if preference := a.vm.Spec.Preference; preference != nil {
+		return OutcomeMapped, fmt.Sprintf("%s %s", preference.Kind, preference.Name), "the preference gives the VM UEFI firmware"
+	}
+	return OutcomeDropped, "", "the VirtualMachine boots with BIOS"
+}
+
+func (a *settingsAudit) annotation(name string) (outcome, target, reason string) {
+	if _, ok := a.vm.Annotations[name]; ok {
+		return OutcomeMapped, "annotation " + name, "identifies the source VM"
+	}
+	return OutcomeDropped, "", "not a valid UUID"
+}
+
+func (a *settingsAudit) hasSerials() bool {
+	for _, disk := range a.spec.Domain.Devices.Disks {
+		if disk.Serial != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *settingsAudit) scheduling(key string) (outcome, target, reason string) {
+	cpu := a.spec.Domain.CPU
+	switch key {
+	case "sched.cpu.affinity":
+		if cpu != nil && cpu.DedicatedCPUPlacement {
+			return OutcomeMapped, "domain.cpu.dedicatedCpuPlacement=true", "pinned vCPUs get dedicated CPUs"
+		}
+	case "sched.cpu.shares":
+		if class := a.spec.PriorityClassName; class != "" {
+			return OutcomeMapped, "priorityClassName=" + class, "share level of the VM"
+		}
+	case "sched.mem.maxmemctl":
+		if balloon := a.spec.Domain.Devices.AutoattachMemBalloon; balloon != nil && !*balloon {
+			return OutcomeMapped, "devices.autoattachMemBalloon=false", "ballooning is disabled"
+		}
+	}
+	if key == "sched.cpu.affinity" || key == "sched.cpu.min" || key == "sched.cpu.shares" {
+		if affinity := a.spec.Affinity; affinity != nil && affinity.NodeAffinity != nil {
+			return OutcomeMapped, "affinity.nodeAffinity", "the VM needs a performance tier node"
+		}
+	}
+	return OutcomeDropped, "", "vSphere resource allocation; the VirtualMachine is scheduled on its requests"
+}
+
+// diskSlot returns the device of a key of the form <bus><N>:<U>, e.g. scsi0:1.
+func diskSlot(device string) (string, bool) {
+	_, ok := controller(device)
+	return device, ok && strings.Contains(device, ":")
+}
+
+// controller returns the bus of a storage controller or disk slot device, e.g. scsi for scsi0.
+func controller(device string) (string, bool) {
+	for _, bus := range []string{"scsi", "sata", "ide", "nvme"} {
+		rest, ok := strings.CutPrefix(device, bus)
+		if !ok {
+			continue
+		}
+		index, _, _ := strings.Cut(rest, ":")
+		if _, err := strconv.Atoi(index); err == nil {
+			return bus, true
+		}
+	}
+	return "", false
+}
+
+func (a *settingsAudit) diskSetting(slot, field, value string) (outcome, target, reason string) {
+	if present, _ := a.vmxConfig.GetBool(slot + ".present"); !present {
+		return OutcomeIgnored, "", "the device is not present"
+	}
+	if a.cdroms[slot] {
+		return OutcomeDropped, "", "CD/DVD drives are not converted; attach an ISO as a DataVolume or containerDisk cdrom"
+	}
+	disk, ok := a.disks[slot]
+	if !ok {
+		return OutcomeDropped, "", "the VirtualMachine has no disk for it"
+	}
+	target = "disk " + disk.Name
+	switch {
+	case disk.Disk != nil:
+		target += fmt.Sprintf(" (%s bus)", disk.Disk.Bus)
+	case disk.LUN != nil:
+		target += fmt.Sprintf(" (LUN, %s bus)", disk.LUN.Bus)
+	}
+	switch field {
+	case "present", "filename", "devicetype":
+		if disk.LUN != nil {
+			return OutcomeMapped, target, "the mapped LUN is presented to the VM as " + disk.Name
+		}
+		return OutcomeMapped, target, "the disk is copied to the volume of " + disk.Name
+	case "mode":
+		if strings.Contains(strings.ToLower(value), "nonpersistent") {
+			return OutcomeDropped, "", "writes persist on KubeVirt; the disk no longer reverts at power off"
+		}
+		return OutcomeMapped, target, "writes persist, as on KubeVirt"
+	case "sharing":
+		if disk.Shareable != nil && *disk.Shareable {
+			return OutcomeMapped, target + " shareable", "the disk is written by several VMs"
+		}
+	}
+	return OutcomeIgnored, "", "VMware disk option"
+}
+
+func (a *settingsAudit) controllerSetting(bus, device, field string) (outcome, target, reason string) {
+	switch field {
+	case "virtualdev":
+		return OutcomeDropped, "", "KubeVirt has no controller models; see the bus of the disks on it"
+	case "sharedbus":
+		for _, d := range a.vmxConfig.Disks {
+			if d.Shared() && fmt.Sprintf("%s%d", d.Bus, d.Controller) == device {
+				if disk, ok := a.disks[d.ID()]; ok {
+					return OutcomeMapped, "disk " + disk.Name + " shareable", "the disks on the bus are written by several VMs"
+				}
+			}
+		}
+	}
+	return OutcomeIgnored, "", fmt.Sprintf("%s controllers are implicit in KubeVirt", strings.ToUpper(bus))
+}
+
+func (a *settingsAudit) nicSetting(device, field string) (outcome, target, reason string) {
+	iface, ok := a.nics[device]
+	if !ok {
+		return OutcomeIgnored, "", "the device is not present"
+	}
+	if iface == nil {
+		return OutcomeDropped, "", "the VirtualMachine has no interface for it; the network map skips its port group"
+	}
+	target = "interface " + iface.Name
+	switch field {
+	case "present":
+		return OutcomeMapped, target, "network adapter"
+	case "virtualdev":
+		return OutcomeMapped, target + ", model " + iface.Model, "closest model the guest drives without extra drivers"
+	case "networkname":
+		for _, network := range a.spec.Networks {
+			if network.Name != iface.Name {
+				continue
+			}
+			if network.Multus != nil {
+				return OutcomeMapped, "network " + network.Multus.NetworkName, "port group of the adapter"
+			}
+			return OutcomeMapped, "pod network", "port group of the adapter"
+		}
+	case "address", "generatedaddress", "addresstype":
+		if iface.MacAddress != "" {
+			return OutcomeMapped, target + ", macAddress " + iface.MacAddress, "the guest keeps its MAC address"
+		}
+		return OutcomeDropped, "", "KubeVirt gives the interface a new MAC address"
+	case "startconnected":
+		if iface.State == kubevirtv1.InterfaceStateLinkDown {
+			return OutcomeMapped, target + ", state down", "the adapter is not connected at power on"
+		}
+		return OutcomeMapped, target, "the adapter is connected at power on"
+	}
+	return OutcomeIgnored, "", "VMware network adapter option"
+}
@@ -0,0 +1,113 @@
+package report
+
+import (
+	"fmt"
+	"strings"
+
+	"vmx2vmi/pkg/vmdk"
+)
+
+// VMDKInfo is the structured form of inspect vmdk: the descriptor with the metadata derived
+// from it and from the disk's snapshot chain.
+type VMDKInfo struct {
+	Path            string       `json:"path"`
+	Version         int          `json:"version"`
+	CID             string       `json:"cid"`
+	ParentCID       string       `json:"parentCID"`
+	CreateType      string       `json:"createType"`
+	AdapterType     string       `json:"adapterType,omitempty"`
+	HardwareVersion string       `json:"hardwareVersion,omitempty"`
+	UUID            string       `json:"uuid,omitempty"`
+	CapacityBytes   int64        `json:"capacityBytes"`
+	AllocatedBytes  int64        `json:"allocatedBytes"`
+	Provisioning    string       `json:"provisioning"`
+	Encrypted       bool         `json:"encrypted"`
+	ChangeTrackPath string       `json:"changeTrackPath,omitempty"`
+	Extents         []ExtentInfo `json:"extents"`
+	// Parents lists the snapshot chain from the immediate parent down to the base disk.
+	Parents []ParentInfo      `json:"parents,omitempty"`
+	DDB     map[string]string `json:"ddb"`
+	// Descriptor is the descriptor text as printed by inspect vmdk without -o json.
+	Descriptor string `json:"descriptor"`
+	// Error explains why the allocation or parent chain could not be read.
+	Error string `json:"error,omitempty"`
+}
+
+// ExtentInfo is one extent line of a descriptor.
+type ExtentInfo struct {
+	Access      string `json:"access"`
+	SizeSectors uint64 `json:"sizeSectors"`
+	Type        string `json:"type"`
+	FileName    string `json:"fileName,omitempty"`
+	Offset      uint64 `json:"offset,omitempty"`
+}
+
+// ParentInfo identifies one parent disk of a snapshot delta.
+type ParentInfo struct {
+	Path       string `json:"path"`
+	CID        string `json:"cid"`
+	CreateType string `json:"createType"`
+}
+
+// DescribeVMDK reads the descriptor of the VMDK at path and, when the disk can be opened,
+// its allocation and parent chain. Failing to open the chain (e.g. a missing parent or an
+// encrypted disk) is recorded in Error rather than returned.
+func DescribeVMDK(path string) (*VMDKInfo, error) {
+	text, isVMDK, err := vmdk.ExtractVMDKDescriptor(path)
+	if err != nil {
+		return nil, err
+	}
+	if !isVMDK {
+		return nil, fmt.Errorf("%s is not a VMDK", path)
+	}
+	desc, err := vmdk.ParseDescriptor(text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse descriptor of %s: %w", path, err)
+	}
+
+	info := &VMDKInfo{
+		Path:            path,
+		Version:         desc.Version,
+		CID:             desc.CID,
+		ParentCID:       desc.ParentCID,
+		CreateType:      desc.CreateType,
+		AdapterType:     desc.DDB["ddb.adapterType"],
+		HardwareVersion: desc.DDB["ddb.virtualHWVersion"],
+		UUID:            desc.UUID(),
+		CapacityBytes:   int64(desc.CapacityBytes()),
+		Provisioning:    desc.Provisioning(),
+		Encrypted:       desc.Encrypted,
+		ChangeTrackPath: desc.ChangeTrackPath,
+		Extents:         []ExtentInfo{},
+		DDB:             desc.DDB,
+		Descriptor:      strings.TrimRight(text, "\x00"),
+	}
+	for _, e := range desc.Extents {
+		info.Extents = append(info.Extents, ExtentInfo{
+			Access:      e.Access,
+			SizeSectors: e.SizeSector,
+			Type:        e.Type,
+			FileName:    e.FileName,
+			Offset:      e.Offset,
+		})
+	}
+
+	chain, err := vmdk.OpenChain(path)
+	if err != nil {
+		info.Error = err.Error()
+		return info, nil
+	}
+	defer chain.Close()
+	for _, layer := range chain.Layers[1:] {
+		info.Parents = append(info.Parents, ParentInfo{
+			Path:       layer.Path,
+			CID:        layer.Descriptor.CID,
+			CreateType: layer.Descriptor.CreateType,
+		})
+	}
+	info.Provisioning = chain.Provisioning()
+	if info.AllocatedBytes, err = chain.AllocatedBytes(); err != nil {
+		info.Error = err.Error()
+	}
+	return info, nil
+}
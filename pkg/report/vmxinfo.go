@@ -0,0 +1,122 @@
+package report
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"vmx2vmi/pkg/vmx"
+)
+
+// WriteVMX writes the configuration of a parsed VMX as read by the converter: the VM settings,
+// then a table per device kind and the guestinfo keys.
+func WriteVMX(w io.Writer, c *vmx.VMXConfig) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Name:\t%s\n", c.DisplayName)
+	fmt.Fprintf(tw, "Guest OS:\t%s (%s)\n", orDash(c.GuestOS), c.GuestOSFamily())
+	cpus := fmt.Sprintf("%d", c.NumVCPUs)
+	if c.CoresPerSocket > 0 {
+		cpus += fmt.Sprintf(" (%d cores per socket)", c.CoresPerSocket)
+	}
+	fmt.Fprintf(tw, "vCPUs:\t%s\n", cpus)
+	fmt.Fprintf(tw, "Memory:\t%d MiB\n", c.MemoryMiB)
+	hw := "-"
+	if c.VirtualHWVersion > 0 {
+		hw = fmt.Sprintf("%d", c.VirtualHWVersion)
+	}
+	fmt.Fprintf(tw, "Hardware version:\t%s\n", hw)
+	firmware := orDash(c.Firmware)
+	if c.SecureBoot {
+		firmware += " (secure boot)"
+	}
+	fmt.Fprintf(tw, "Firmware:\t%s\n", firmware)
+	fmt.Fprintf(tw, "Features:\t%s\n", orDash(strings.Join(vmxFeatures(c), ", ")))
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	section(w, "CONTROLLER\tMODEL\tSHARED BUS", len(c.Controllers), func(tw io.Writer) {
+		for _, ctrl := range c.Controllers {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", ctrl.ID(), orDash(ctrl.VirtualDev), orDash(ctrl.SharedBus))
+		}
+	})
+	section(w, "DISK\tCAPACITY\tPROVISIONING\tMODE\tSHARING\tFILE", len(c.Disks), func(tw io.Writer) {
+		for _, d := range c.Disks {
+			capacity := "-"
+			if d.CapacityBytes > 0 {
+				capacity = formatSize(int64(d.CapacityBytes))
+			}
+			provisioning := orDash(d.Provisioning)
+			if d.RawDeviceMapping != "" {
+				provisioning = "rdm (" + d.RawDeviceMapping + ")"
+			}
+			sharing := "-"
+			if d.Shared() {
+				sharing = "shared"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", d.ID(), capacity, provisioning, orDash(d.Mode), sharing, orDash(d.FileName))
+		}
+	})
+	section(w, "CD-ROM\tTYPE\tFILE", len(c.CDROMs), func(tw io.Writer) {
+		for _, d := range c.CDROMs {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", d.ID(), orDash(d.DeviceType), orDash(d.FileName))
+		}
+	})
+	section(w, "ADAPTER\tMODEL\tNETWORK\tMAC\tCONNECTED", len(c.NICs), func(tw io.Writer) {
+		for _, nic := range c.NICs {
+			fmt.Fprintf(tw, "ethernet%d\t%s\t%s\t%s\t%t\n", nic.Index, orDash(nic.VirtualDev), orDash(nic.NetworkName),
+				orDash(nic.MACAddress), nic.StartConnected)
+		}
+	})
+	section(w, "SHARED FOLDER\tHOST PATH\tENABLED\tWRITABLE", len(c.SharedFolders), func(tw io.Writer) {
+		for _, f := range c.SharedFolders {
+			fmt.Fprintf(tw, "%s\t%s\t%t\t%t\n", f.GuestName, f.HostPath, f.Enabled, f.Writable)
+		}
+	})
+	keys := make([]string, 0, len(c.GuestInfo))
+	for key := range c.GuestInfo {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	section(w, "GUESTINFO\tVALUE", len(keys), func(tw io.Writer) {
+		for _, key := range keys {
+			fmt.Fprintf(tw, "%s\t%s\n", key, c.GuestInfo[key])
+		}
+	})
+	return nil
+}
+
+// section writes a table of n rows after a blank line, nothing when n is 0.
+func section(w io.Writer, header string, n int, rows func(io.Writer)) {
+	if n == 0 {
+		return
+	}
+	fmt.Fprintln(w)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, header)
+	rows(tw)
+	tw.Flush()
+}
+
+// vmxFeatures lists the optional features the VMX enables.
+func vmxFeatures(c *vmx.VMXConfig) []string {
+	var features []string
+	if c.Template {
+		features = append(features, "template")
+	}
+	if c.NestedVirtualization {
+		features = append(features, "nested virtualization")
+	}
+	if c.DiskEnableUUID {
+		features = append(features, "disk UUIDs")
+	}
+	if c.ToolsDetected {
+		features = append(features, "VMware Tools")
+	}
+	if c.Encrypted {
+		features = append(features, "encryption")
+	}
+	return features
+}
@@ -0,0 +1,664 @@
+// Package server drives conversions through a REST API, for web frontends and other tooling. A job
+// is a migration plan, submitted as a document or with the VMX, OVF or OVA files of its VMs, and
+// run like plan run in a directory of its own, which keeps its status, logs and manifests across
+// restarts of the server.
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"vmx2vmi/pkg/failure"
+	"vmx2vmi/pkg/logging"
+	"vmx2vmi/pkg/metrics"
+	"vmx2vmi/pkg/plan"
+	"vmx2vmi/pkg/progress"
+	"vmx2vmi/pkg/transfer"
+
+	"sigs.k8s.io/yaml"
+)
+
+// States of a Job.
+const (
+	Queued    = "queued"
+	Running   = "running"
+	Succeeded = "succeeded"
+	Failed    = "failed"
+	Canceled  = "canceled"
+	// Interrupted jobs stopped with the server before all their VMs were converted; a retry
+	// resumes them.
+	Interrupted = "interrupted"
+)
+
+// Names in the directory of a job, next to the uploaded files.
+const (
+	planFile  = "plan.yaml"
+	outputDir = "output"
+)
+
+// maxPlanSize bounds the plan document of a job.
+const maxPlanSize = 1 << 20
+
+// Options configures a Server.
+type Options struct {
+	// Dir keeps the jobs, a directory each.
+	Dir string
+	// Command is the vmx2vmi binary converting the VMs.
+	Command string
+	// Parallel is the number of jobs run at a time; the VMs of a job are converted one by one.
+	Parallel int
+	// Token, when set, is the bearer token the requests must carry.
+	Token string
+	// VCenter is the vcenter the vm entries of the jobs are read from.
+	VCenter *plan.VCenter
+	// Metrics, when set, records the VMs of the jobs, named <job>/<source>, and is served at
+	// /metrics.
+	Metrics *metrics.Registry
+}
+
+// Job is the state of a job, as the API returns it.
+type Job struct {
+	ID      string    `json:"id"`
+	State   string    `json:"state"`
+	Created time.Time `json:"created"`
+	VMs     []VM      `json:"vms"`
+}
+
+// VM is the state of a VM of a job, with the last progress of its disk copies.
+type VM struct {
+	plan.VMStatus
+	Progress []progress.Update `json:"progress,omitempty"`
+}
+
+type job struct {
+	id       string
+	dir      string
+	created  time.Time
+	plan     *plan.Plan
+	state    string
+	vms      []plan.VMStatus
+	progress []map[string]progress.Update
+	cancel   context.CancelFunc
+	canceled bool
+}
+
+// Server runs the jobs submitted to its API.
+type Server struct {
+	opts  Options
+	ctx   context.Context
+	slots chan struct{}
+	wg    sync.WaitGroup
+
+	mu   sync.Mutex
+	jobs map[string]*job
+}
+
+// New returns a server running its jobs until ctx is done, with the jobs previous runs left in
+// opts.Dir.
+func New(ctx context.Context, opts Options) (*Server, error) {
+	if err := os.MkdirAll(opts.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create the job directory: %w", err)
+	}
+	entries, err := os.ReadDir(opts.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the job directory: %w", err)
+	}
+	s := &Server{opts: opts, ctx: ctx, slots: make(chan struct{}, max(opts.Parallel, 1)), jobs: make(map[string]*job)}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		j, err := s.load(entry.Name())
+		if err != nil {
+			logging.Warnf("Skipping job %s: %v", entry.Name(), err)
+			continue
+		}
+		s.jobs[j.id] = j
+	}
+	return s, nil
+}
+
+// load reads the job of a previous run from its directory.
+func (s *Server) load(id string) (*job, error) {
+	dir := filepath.Join(s.opts.Dir, id)
+	info, err := os.Stat(filepath.Join(dir, planFile))
+	if err != nil {
+		return nil, err
+	}
+	j, err := s.open(id, dir)
+	if err != nil {
+		return nil, err
+	}
+	j.created, j.state = info.ModTime().UTC(), finalState(j.vms)
+	return j, nil
+}
+
+// open reads the plan and status of the job in dir.
+func (s *Server) open(id, dir string) (*job, error) {
+	p, err := plan.Load(filepath.Join(dir, planFile))
+	if err != nil {
+		return nil, err
+	}
+	status, err := p.LoadStatus()
+	if err != nil {
+		return nil, err
+	}
+	for _, vm := range status.VMs {
+		s.opts.Metrics.Add(id + "/" + vm.Source)
+	}
+	return &job{id: id, dir: dir, plan: p, vms: status.VMs, progress: make([]map[string]progress.Update, len(status.VMs))}, nil
+}
+
+// finalState returns the state of a job that is not running from the states of its VMs.
+func finalState(vms []plan.VMStatus) string {
+	state := Succeeded
+	for _, vm := range vms {
+		switch vm.State {
+		case plan.Succeeded, plan.Skipped:
+		case plan.Failed:
+			state = Failed
+		default:
+			return Interrupted
+		}
+	}
+	return state
+}
+
+// Wait returns once the jobs stopped after the context of the server is done.
+func (s *Server) Wait() {
+	s.wg.Wait()
+}
+
+// start queues j to run once fewer than Parallel jobs run. s.mu must be held.
+func (s *Server) start(j *job) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	j.state, j.cancel, j.canceled = Queued, cancel, false
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer cancel()
+		select {
+		case s.slots <- struct{}{}:
+		case <-ctx.Done():
+			s.finish(j, nil, nil)
+			return
+		}
+		defer func() { <-s.slots }()
+		s.mu.Lock()
+		j.state = Running
+		s.mu.Unlock()
+		logging.Infof("Running job %s\n", j.id)
+		status, err := j.plan.Run(ctx, s.opts.Command, transfer.SchedulerConfig{MaxConcurrent: 1}, func(i int, vm plan.VMStatus) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.opts.Metrics.ObserveVM(j.id+"/"+vm.Source, vm)
+			switch vm.State {
+			case plan.Skipped:
+				// The VM keeps the status of the run that converted it.
+			case plan.Running:
+				j.vms[i], j.progress[i] = vm, nil
+			default:
+				j.vms[i] = vm
+			}
+		}, func(i int, u progress.Update) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.opts.Metrics.Observe(j.id+"/"+j.vms[i].Source, u)
+			if u.Type != "disk" {
+				return
+			}
+			if j.progress[i] == nil {
+				j.progress[i] = make(map[string]progress.Update)
+			}
+			j.progress[i][u.Disk] = u
+		})
+		s.finish(j, status, err)
+	}()
+}
+
+// finish records the end of a run of j.
+func (s *Server) finish(j *job, status *plan.Status, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if status != nil {
+		j.vms = status.VMs
+	}
+	switch {
+	case err != nil:
+		logging.Errorf("Failed to run job %s: %v", j.id, err)
+		j.state = Failed
+	case j.canceled:
+		j.state = Canceled
+	case s.ctx.Err() != nil:
+		j.state = Interrupted
+	default:
+		j.state = finalState(j.vms)
+	}
+	logging.Infof("Job %s %s\n", j.id, j.state)
+}
+
+// view returns the state of j for the API. s.mu must be held.
+func (j *job) view() Job {
+	v := Job{ID: j.id, State: j.state, Created: j.created, VMs: make([]VM, len(j.vms))}
+	for i, vm := range j.vms {
+		v.VMs[i].VMStatus = vm
+		for _, disk := range slices.Sorted(maps.Keys(j.progress[i])) {
+			v.VMs[i].Progress = append(v.VMs[i].Progress, j.progress[i][disk])
+		}
+	}
+	return v
+}
+
+// Handler returns the handler of the API:
+//
+//	GET    /api/v1/jobs                          list the jobs
+//	POST   /api/v1/jobs                          submit a job
+//	GET    /api/v1/jobs/{id}                     get the state and progress of a job
+//	DELETE /api/v1/jobs/{id}                     delete a job that does not run, with its files
+//	POST   /api/v1/jobs/{id}/cancel              cancel a queued or running job
+//	POST   /api/v1/jobs/{id}/retry               run a job again, resuming where it stopped
+//	GET    /api/v1/jobs/{id}/vms/{n}/log         get the output of the conversion of the nth VM
+//	GET    /api/v1/jobs/{id}/manifests           list the files the conversions generated
+//	GET    /api/v1/jobs/{id}/manifests/{path...} get a generated file
+//	GET    /metrics                              get the metrics, when Options.Metrics is set
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/jobs", s.listJobs)
+	mux.HandleFunc("POST /api/v1/jobs", s.submitJob)
+	mux.HandleFunc("GET /api/v1/jobs/{id}", s.getJob)
+	mux.HandleFunc("DELETE /api/v1/jobs/{id}", s.deleteJob)
+	mux.HandleFunc("POST /api/v1/jobs/{id}/cancel", s.cancelJob)
+	mux.HandleFunc("POST /api/v1/jobs/{id}/retry", s.retryJob)
+	mux.HandleFunc("GET /api/v1/jobs/{id}/vms/{n}/log", s.getLog)
+	mux.HandleFunc("GET /api/v1/jobs/{id}/manifests", s.listManifests)
+	mux.HandleFunc("GET /api/v1/jobs/{id}/manifests/{path...}", s.getManifest)
+	if s.opts.Metrics != nil {
+		mux.Handle("GET /metrics", s.opts.Metrics)
+	}
+	return s.authenticate(mux)
+}
+
+// authenticate checks the bearer token of the requests to next.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logging.Debugf("%s %s from %s\n", r.Method, r.URL.Path, r.RemoteAddr)
+		if s.opts.Token != "" {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.opts.Token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeError(w, http.StatusUnauthorized, errors.New("missing or invalid bearer token"))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// job returns the job of the request, or writes a not found error. s.mu must be held.
+func (s *Server) job(w http.ResponseWriter, r *http.Request) *job {
+	j := s.jobs[r.PathValue("id")]
+	if j == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("job %s not found", r.PathValue("id")))
+	}
+	return j
+}
+
+func (s *Server) listJobs(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	jobs := make([]Job, 0, len(s.jobs))
+	for _, id := range slices.Sorted(maps.Keys(s.jobs)) {
+		jobs = append(jobs, s.jobs[id].view())
+	}
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+func (s *Server) getJob(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if j := s.job(w, r); j != nil {
+		writeJSON(w, http.StatusOK, j.view())
+	}
+}
+
+// submitJob creates a job from a plan document, sent as JSON or YAML, or from a multipart form
+// of a plan field and the files of the VMs. Without a plan, or when the plan lists no VMs, the
+// uploaded VMX, OVF and OVA files are its VMs.
+func (s *Server) submitJob(w http.ResponseWriter, r *http.Request) {
+	id, err := newID()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	dir := filepath.Join(s.opts.Dir, id)
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to create the job directory: %w", err))
+		return
+	}
+	j, err := s.create(r, id, dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		status := http.StatusInternalServerError
+		switch failure.KindOf(err) {
+		case failure.Usage, failure.Parse:
+			status = http.StatusBadRequest
+		}
+		writeError(w, status, err)
+		return
+	}
+	s.mu.Lock()
+	s.jobs[id] = j
+	s.start(j)
+	v := j.view()
+	s.mu.Unlock()
+	logging.Infof("Submitted job %s with %d VMs\n", id, len(v.VMs))
+	w.Header().Set("Location", "/api/v1/jobs/"+id)
+	writeJSON(w, http.StatusCreated, v)
+}
+
+// newID returns a new job ID, sorting by creation time, e.g. 20250601-101203-3fa9c2.
+func newID() (string, error) {
+	suffix := make([]byte, 3)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	return time.Now().UTC().Format("20060102-150405") + "-" + hex.EncodeToString(suffix), nil
+}
+
+// create reads the plan and files of a submitted job into dir.
+func (s *Server) create(r *http.Request, id, dir string) (*job, error) {
+	var document []byte
+	var uploaded []string
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		reader, err := r.MultipartReader()
+		if err != nil {
+			return nil, failure.Wrap(failure.Usage, err)
+		}
+		for {
+			part, err := reader.NextPart()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return nil, failure.Errorf(failure.Usage, "failed to read the form: %w", err)
+			}
+			if part.FileName() == "" {
+				if part.FormName() == "plan" {
+					if document, err = readPlan(part); err != nil {
+						return nil, err
+					}
+				}
+				continue
+			}
+			name, err := save(dir, part)
+			if err != nil {
+				return nil, err
+			}
+			uploaded = append(uploaded, name)
+		}
+	} else {
+		var err error
+		if document, err = readPlan(r.Body); err != nil {
+			return nil, err
+		}
+	}
+
+	var p plan.Plan
+	if err := yaml.UnmarshalStrict(document, &p); err != nil {
+		return nil, failure.Errorf(failure.Parse, "failed to parse the plan: %w", err)
+	}
+	if len(p.VMs) == 0 {
+		for _, name := range uploaded {
+			switch strings.ToLower(filepath.Ext(name)) {
+			case ".vmx", ".ovf", ".ova":
+				p.VMs = append(p.VMs, plan.VM{VMX: name})
+			}
+		}
+	}
+	// The password of the server only goes to its own vCenter.
+	if p.VCenter != nil {
+		return nil, failure.Errorf(failure.Usage, "the vm entries of a job are read from the vCenter of the server, vcenter cannot be set")
+	}
+	if slices.ContainsFunc(p.VMs, func(vm plan.VM) bool { return vm.VM != "" }) {
+		p.VCenter = s.opts.VCenter
+	}
+	// The files a job reads are its uploaded files, never other files of the server.
+	type reference struct{ field, path string }
+	references := []reference{{"networkMap", p.NetworkMap}, {"storageMap", p.StorageMap}}
+	for _, vm := range p.VMs {
+		references = append(references, reference{"vmx", vm.VMX}, reference{"networkMap", vm.NetworkMap}, reference{"storageMap", vm.StorageMap})
+	}
+	for _, ref := range references {
+		if ref.path != "" && (!filepath.IsLocal(ref.path) || !slices.Contains(uploaded, filepath.Clean(ref.path))) {
+			return nil, failure.Errorf(failure.Usage, "%s %s is not a file uploaded with the job", ref.field, ref.path)
+		}
+	}
+	for _, name := range p.OptionNames() {
+		if !slices.Contains(plan.ManifestOptions, name) {
+			return nil, failure.Errorf(failure.Usage, "option %s cannot be used in a job", name)
+		}
+	}
+	// The conversions write their manifests where the API serves them from.
+	if p.Options == nil {
+		p.Options = plan.Options{}
+	}
+	p.Options["output-dir"] = outputDir
+	data, err := yaml.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, planFile), data, 0o644); err != nil {
+		return nil, fmt.Errorf("failed to write the plan: %w", err)
+	}
+	j, err := s.open(id, dir)
+	if err != nil {
+		return nil, err
+	}
+	j.created = time.Now().UTC()
+	return j, nil
+}
+
+// readPlan reads a plan document of at most maxPlanSize bytes.
+func readPlan(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxPlanSize+1))
+	if err != nil {
+		return nil, failure.Errorf(failure.Usage, "failed to read the plan: %w", err)
+	}
+	if len(data) > maxPlanSize {
+		return nil, failure.Errorf(failure.Usage, "the plan is larger than %d bytes", maxPlanSize)
+	}
+	return data, nil
+}
+
+// save writes an uploaded file to dir and returns its name.
+func save(dir string, part *multipart.Part) (string, error) {
+	name := filepath.Base(part.FileName())
+	if !filepath.IsLocal(name) || name == planFile || name == outputDir || strings.HasPrefix(name, "plan.") {
+		return "", failure.Errorf(failure.Usage, "invalid file name '%s'", name)
+	}
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		if errors.Is(err, fs.ErrExist) {
+			return "", failure.Errorf(failure.Usage, "file %s is uploaded twice", name)
+		}
+		return "", fmt.Errorf("failed to save %s: %w", name, err)
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, part); err != nil {
+		return "", failure.Errorf(failure.Usage, "failed to upload %s: %w", name, err)
+	}
+	return name, f.Close()
+}
+
+func (s *Server) deleteJob(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j := s.job(w, r)
+	if j == nil {
+		return
+	}
+	if j.state == Queued || j.state == Running {
+		writeError(w, http.StatusConflict, fmt.Errorf("job %s is %s, cancel it first", j.id, j.state))
+		return
+	}
+	if err := os.RemoveAll(j.dir); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	delete(s.jobs, j.id)
+	for _, vm := range j.vms {
+		s.opts.Metrics.Remove(j.id + "/" + vm.Source)
+	}
+	logging.Infof("Deleted job %s\n", j.id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) cancelJob(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j := s.job(w, r)
+	if j == nil {
+		return
+	}
+	if j.state != Queued && j.state != Running {
+		writeError(w, http.StatusConflict, fmt.Errorf("job %s is %s, not queued or running", j.id, j.state))
+		return
+	}
+	j.canceled = true
+	j.cancel()
+	writeJSON(w, http.StatusAccepted, j.view())
+}
+
+func (s *Server) retryJob(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j := s.job(w, r)
+	if j == nil {
+		return
+	}
+	if j.state == Queued || j.state == Running {
+		writeError(w, http.StatusConflict, fmt.Errorf("job %s is %s already", j.id, j.state))
+		return
+	}
+	s.start(j)
+	writeJSON(w, http.StatusAccepted, j.view())
+}
+
+func (s *Server) getLog(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	j := s.job(w, r)
+	if j == nil {
+		s.mu.Unlock()
+		return
+	}
+	n, err := strconv.Atoi(r.PathValue("n"))
+	if err != nil || n < 0 || n >= len(j.vms) {
+		s.mu.Unlock()
+		writeError(w, http.StatusNotFound, fmt.Errorf("job %s has no VM %s", j.id, r.PathValue("n")))
+		return
+	}
+	vm, dir := j.vms[n], j.dir
+	s.mu.Unlock()
+	if vm.Log == "" {
+		writeError(w, http.StatusNotFound, fmt.Errorf("VM %s has not run", vm.Source))
+		return
+	}
+	f, err := os.Open(filepath.Join(dir, vm.Log))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.Copy(w, f)
+}
+
+func (s *Server) listManifests(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	j := s.job(w, r)
+	s.mu.Unlock()
+	if j == nil {
+		return
+	}
+	root := filepath.Join(j.dir, outputDir)
+	files := []string{}
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		files = append(files, filepath.ToSlash(rel))
+		return err
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, files)
+}
+
+func (s *Server) getManifest(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	j := s.job(w, r)
+	s.mu.Unlock()
+	if j == nil {
+		return
+	}
+	// The root keeps the path from leaving the output directory, through .. or symbolic links.
+	root, err := os.OpenRoot(filepath.Join(j.dir, outputDir))
+	if err != nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("job %s generated no files", j.id))
+		return
+	}
+	defer root.Close()
+	f, err := root.Open(filepath.FromSlash(r.PathValue("path")))
+	if err != nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("job %s generated no file %s", j.id, r.PathValue("path")))
+		return
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil || !info.Mode().IsRegular() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("job %s generated no file %s", j.id, r.PathValue("path")))
+		return
+	}
+	contentType := "text/plain; charset=utf-8"
+	switch filepath.Ext(r.PathValue("path")) {
+	case ".json":
+		contentType = "application/json"
+	case ".yaml", ".yml":
+		contentType = "application/yaml"
+	}
+	w.Header().Set("Content-Type", contentType)
+	io.Copy(w, f)
+}
@@ -0,0 +1,230 @@
+package transfer
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"vmx2vmi/pkg/cluster"
+	"vmx2vmi/pkg/failure"
+	"vmx2vmi/pkg/logging"
+	"vmx2vmi/pkg/progress"
+)
+
+// ConvertJobOptions configures RunConvertJob.
+type ConvertJobOptions struct {
+	// Namespace is the namespace of the Job and of Claim; Name prefixes the name of the Job.
+	Namespace string
+	Name      string
+	// Image runs vmx2vmi in the Job, with nbdkit and its vddk plugin.
+	Image string
+	// VDDKInitImage, when set, provides the VDDK library like a CDI VDDK init image: it copies
+	// /vmware-vix-disklib-distrib to /opt. Otherwise Image provides it.
+	VDDKInitImage string
+	// Secret holds the vCenter user in accessKeyId and its password in secretKey, given to the
+	// conversion as $VCENTER_USER and $VCENTER_PASSWORD.
+	Secret string
+	// Claim receives the raw image: its block device, or the disk.img of its filesystem.
+	Claim string
+	// Disk is the disk of the VM the Job converts, given to convert-disk after Args.
+	Disk string
+	// Args are the flags of the conversion, in which $(VCENTER_USER) expands to the user;
+	// -disk-output and -progress json are added.
+	Args []string
+	// Progress, when set, follows the copy in the Job.
+	Progress *progress.Disk
+	Logf     func(format string, args ...any)
+}
+
+// jobPoll is the interval between two reads of the state and progress of a Job.
+const jobPoll = 5 * time.Second
+
+// RunConvertJob runs a convert-disk conversion in a Job next to the storage, writing to a claim
+// instead of a local file or device, and waits for it. The messages of the conversion are
+// passed to opts.Logf once it succeeded; when it fails, the error is the last one it logged, of
+// the kind of its exit status. The Job is deleted once done.
+func RunConvertJob(ctx context.Context, client *cluster.Client, opts ConvertJobOptions) error {
+	err := runConvertJob(ctx, client, opts)
+	return failure.Wrap(failure.Transfer, err)
+}
+
+func runConvertJob(ctx context.Context, client *cluster.Client, opts ConvertJobOptions) error {
+	var pvc corev1.PersistentVolumeClaim
+	if err := client.Get(ctx, fmt.Sprintf("/api/v1/namespaces/%s/persistentvolumeclaims/%s", opts.Namespace, opts.Claim), &pvc); err != nil {
+		return fmt.Errorf("failed to read PVC %s: %w", opts.Claim, err)
+	}
+	secretKey := func(key string) *corev1.EnvVarSource {
+		return &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: opts.Secret},
+			Key:                  key,
+		}}
+	}
+	container := corev1.Container{
+		Name:  "convert",
+		Image: opts.Image,
+		Env: []corev1.EnvVar{
+			{Name: "VCENTER_USER", ValueFrom: secretKey("accessKeyId")},
+			{Name: "VCENTER_PASSWORD", ValueFrom: secretKey("secretKey")},
+		},
+	}
+	output := "/disk/disk.img"
+	if pvc.Spec.VolumeMode != nil && *pvc.Spec.VolumeMode == corev1.PersistentVolumeBlock {
+		output = "/dev/disk"
+		container.VolumeDevices = []corev1.VolumeDevice{{Name: "disk", DevicePath: output}}
+	} else {
+		// KubeVirt and CDI keep the image of a filesystem claim in disk.img.
+		container.VolumeMounts = []corev1.VolumeMount{{Name: "disk", MountPath: "/disk"}}
+	}
+	container.Args = slices.Concat([]string{"convert-disk"}, opts.Args, []string{"-disk-output", output, "-progress", progress.ModeJSON, opts.Disk})
+	volumes := []corev1.Volume{{
+		Name: "disk",
+		VolumeSource: corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: opts.Claim},
+		},
+	}}
+	var initContainers []corev1.Container
+	if opts.VDDKInitImage != "" {
+		libMount := corev1.VolumeMount{Name: "vddk", MountPath: "/opt"}
+		initContainers = append(initContainers, corev1.Container{Name: "vddk", Image: opts.VDDKInitImage, VolumeMounts: []corev1.VolumeMount{libMount}})
+		container.VolumeMounts = append(container.VolumeMounts, libMount)
+		volumes = append(volumes, corev1.Volume{Name: "vddk", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}})
+	}
+
+	backoffLimit := int32(0)
+	job := &batchv1.Job{
+		TypeMeta: metav1.TypeMeta{APIVersion: "batch/v1", Kind: "Job"},
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: opts.Name + "-convert-",
+			Namespace:    opts.Namespace,
+			Labels:       map[string]string{"app.kubernetes.io/managed-by": cluster.FieldManager},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					RestartPolicy:  corev1.RestartPolicyNever,
+					InitContainers: initContainers,
+					Containers:     []corev1.Container{container},
+					Volumes:        volumes,
+				},
+			},
+		},
+	}
+	jobsPath := fmt.Sprintf("/apis/batch/v1/namespaces/%s/jobs", opts.Namespace)
+	if err := client.Create(ctx, jobsPath, job, job); err != nil {
+		return fmt.Errorf("failed to create the conversion Job: %w", err)
+	}
+	jobPath := jobsPath + "/" + job.Name
+	// Without a propagation policy, deleting a Job leaves its pods behind; deleting the pod of
+	// an interrupted copy stops it.
+	defer client.Delete(context.WithoutCancel(ctx), jobPath+"?propagationPolicy=Background")
+	opts.Logf("Converting in Job %s/%s, writing to PVC %s\n", opts.Namespace, job.Name, opts.Claim)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("conversion Job %s/%s did not finish: %w", opts.Namespace, job.Name, ctx.Err())
+		case <-time.After(jobPoll):
+		}
+		if err := client.Get(ctx, jobPath, job); err != nil {
+			return fmt.Errorf("failed to read the conversion Job: %w", err)
+		}
+		pod, err := jobPod(ctx, client, opts.Namespace, job.Name)
+		if err != nil {
+			return err
+		}
+		switch {
+		case job.Status.Succeeded > 0:
+			logs, err := podLogs(ctx, client, pod, 0)
+			if err != nil {
+				return err
+			}
+			follow(logs, opts.Progress)
+			relay(logs, opts.Logf)
+			return nil
+		case job.Status.Failed > 0:
+			logs, _ := podLogs(ctx, client, pod, 0)
+			kind := failure.General
+			if pod != nil {
+				for _, status := range pod.Status.ContainerStatuses {
+					if status.State.Terminated != nil {
+						kind = failure.FromExitCode(int(status.State.Terminated.ExitCode))
+					}
+				}
+			}
+			if last := logging.LastMessage(strings.NewReader(logs)); last != "" {
+				return failure.Wrap(kind, errors.New(last))
+			}
+			return failure.Errorf(kind, "conversion Job %s/%s failed", opts.Namespace, job.Name)
+		case pod != nil && pod.Status.Phase == corev1.PodRunning:
+			// The tail holds the last progress update; the conversion writes one per second.
+			if logs, err := podLogs(ctx, client, pod, 20); err == nil {
+				follow(logs, opts.Progress)
+			}
+		}
+	}
+}
+
+// jobPod returns the pod of the Job named job, nil until it is created.
+func jobPod(ctx context.Context, client *cluster.Client, namespace, job string) (*corev1.Pod, error) {
+	var pods corev1.PodList
+	if err := client.Get(ctx, fmt.Sprintf("/api/v1/namespaces/%s/pods?labelSelector=job-name%%3D%s", namespace, job), &pods); err != nil {
+		return nil, fmt.Errorf("failed to read the pod of the conversion Job: %w", err)
+	}
+	if len(pods.Items) == 0 {
+		return nil, nil
+	}
+	return &pods.Items[0], nil
+}
+
+// podLogs returns the logs of the conversion in pod, the last tailLines lines unless 0.
+func podLogs(ctx context.Context, client *cluster.Client, pod *corev1.Pod, tailLines int) (string, error) {
+	if pod == nil {
+		return "", fmt.Errorf("the pod of the conversion Job is gone")
+	}
+	path := fmt.Sprintf("/api/v1/namespaces/%s/pods/%s/log?container=convert", pod.Namespace, pod.Name)
+	if tailLines > 0 {
+		path += fmt.Sprintf("&tailLines=%d", tailLines)
+	}
+	logs, err := client.GetRaw(ctx, path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the logs of the conversion Job: %w", err)
+	}
+	return string(logs), nil
+}
+
+// follow sets disk to the last progress update of the disk in logs.
+func follow(logs string, disk *progress.Disk) {
+	var last *progress.Update
+	scanner := bufio.NewScanner(strings.NewReader(logs))
+	for scanner.Scan() {
+		if u, ok := progress.ParseUpdate(scanner.Text()); ok && u.Type == "disk" {
+			last = &u
+		}
+	}
+	if last != nil {
+		disk.SetTotal(last.TotalBytes)
+		disk.Set(last.CopiedBytes)
+	}
+}
+
+// relay passes the messages of logs, but the progress updates, to logf.
+func relay(logs string, logf func(format string, args ...any)) {
+	scanner := bufio.NewScanner(strings.NewReader(logs))
+	for scanner.Scan() {
+		if _, ok := progress.ParseUpdate(scanner.Text()); ok {
+			continue
+		}
+		if message, _ := logging.Message(scanner.Text()); message != "" {
+			logf("%s\n", message)
+		}
+	}
+}
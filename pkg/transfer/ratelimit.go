@@ -0,0 +1,169 @@
+package transfer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	k8sresource "k8s.io/apimachinery/pkg/api/resource"
+)
+
+// Limiter is a token bucket shared by every reader it wraps. A nil *Limiter or one
+// with a zero rate does not limit anything.
+type Limiter struct {
+	mu          sync.Mutex
+	bytesPerSec int64
+	burst       int64
+	tokens      float64
+	last        time.Time
+}
+
+// NewLimiter returns a limiter allowing bytesPerSec on average with bursts of up to one second of traffic.
+// A rate of zero or less disables limiting.
+func NewLimiter(bytesPerSec int64) *Limiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return &Limiter{
+		bytesPerSec: bytesPerSec,
+		burst:       bytesPerSec,
+		tokens:      float64(bytesPerSec),
+		last:        time.Now(),
+	}
+}
+
+// WaitN blocks until n bytes may be transferred or ctx is done.
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	for remaining := int64(n); remaining > 0; {
+		// Never ask for more than the bucket can ever hold.
+		chunk := min(remaining, l.burst)
+		delay := l.reserve(chunk)
+		if delay > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			case <-timer.C:
+			}
+		}
+		remaining -= chunk
+	}
+	return nil
+}
+
+// reserve takes n tokens, possibly going negative, and returns how long the caller must wait.
+func (l *Limiter) reserve(n int64) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.bytesPerSec)
+	if l.tokens > float64(l.burst) {
+		l.tokens = float64(l.burst)
+	}
+	l.last = now
+
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(l.bytesPerSec) * float64(time.Second))
+}
+
+// limitedReader throttles reads through one or more limiters.
+type limitedReader struct {
+	ctx      context.Context
+	r        io.Reader
+	limiters []*Limiter
+}
+
+// LimitReader wraps r so each read is charged against every given limiter.
+// Nil limiters are ignored.
+func LimitReader(ctx context.Context, r io.Reader, limiters ...*Limiter) io.Reader {
+	active := limiters[:0:0]
+	for _, l := range limiters {
+		if l != nil {
+			active = append(active, l)
+		}
+	}
+	if len(active) == 0 {
+		return r
+	}
+	return &limitedReader{ctx: ctx, r: r, limiters: active}
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	n, err := lr.r.Read(p)
+	if n > 0 {
+		for _, l := range lr.limiters {
+			if waitErr := l.WaitN(lr.ctx, n); waitErr != nil {
+				return n, waitErr
+			}
+		}
+	}
+	return n, err
+}
+
+// Rate returns the bytes per second allowed by l, 0 when it does not limit anything.
+func (l *Limiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+	return l.bytesPerSec
+}
+
+// limitedReaderAt throttles positioned reads through one or more limiters.
+type limitedReaderAt struct {
+	ctx      context.Context
+	r        io.ReaderAt
+	limiters []*Limiter
+}
+
+// LimitReaderAt is LimitReader for an io.ReaderAt, e.g. a disk read by a converter.
+// Nil limiters are ignored.
+func LimitReaderAt(ctx context.Context, r io.ReaderAt, limiters ...*Limiter) io.ReaderAt {
+	active := limiters[:0:0]
+	for _, l := range limiters {
+		if l != nil {
+			active = append(active, l)
+		}
+	}
+	if len(active) == 0 {
+		return r
+	}
+	return &limitedReaderAt{ctx: ctx, r: r, limiters: active}
+}
+
+func (lr *limitedReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := lr.r.ReadAt(p, off)
+	if n > 0 {
+		for _, l := range lr.limiters {
+			if waitErr := l.WaitN(lr.ctx, n); waitErr != nil {
+				return n, waitErr
+			}
+		}
+	}
+	return n, err
+}
+
+// ParseRate parses a bandwidth in bytes per second written as a quantity, e.g. 100Mi or 1G.
+// An empty string means unlimited and returns 0.
+func ParseRate(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	q, err := k8sresource.ParseQuantity(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid bandwidth '%s', use bytes per second such as 100Mi or 1G: %w", s, err)
+	}
+	if q.Sign() < 0 {
+		return 0, fmt.Errorf("invalid bandwidth '%s', must not be negative", s)
+	}
+	return q.Value(), nil
+}
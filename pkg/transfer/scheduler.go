@@ -0,0 +1,241 @@
+package transfer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Budget caps the concurrency and bandwidth of transfers sharing a resource
+// (a source datastore or a network path). Zero values mean unlimited.
+type Budget struct {
+	MaxConcurrent  int
+	BytesPerSecond int64
+}
+
+// Job is a single disk transfer scheduled as part of a batch.
+type Job struct {
+	ID        string
+	VM        string
+	Priority  int    // Higher priorities are started first
+	Datastore string // Source datastore the data is read from
+	Network   string // Network path the data travels over
+	Bytes     int64  // Expected transfer size, used to order jobs of equal priority
+	// Run performs the transfer within grant.
+	Run func(ctx context.Context, grant Grant) error
+}
+
+// Grant is what a running Job may use of the bandwidth budgets of its datastore and network.
+type Grant struct {
+	// Throttle wraps the source readers of a transfer run in this process; the transfers sharing
+	// a budget share its bandwidth.
+	Throttle func(io.Reader) io.Reader
+	// Rate is the bandwidth of a transfer run by another process, such as the conversion of a
+	// VM of a plan: the lowest of the budgets divided by the transfers each lets run at once,
+	// 0 when unlimited.
+	Rate int64
+}
+
+// Result is the outcome of a Job.
+type Result struct {
+	Job Job
+	Err error
+}
+
+// SchedulerConfig holds the budgets applied by a Scheduler. Datastores and networks
+// without an explicit entry fall back to DefaultDatastore and DefaultNetwork.
+type SchedulerConfig struct {
+	Datastores       map[string]Budget
+	Networks         map[string]Budget
+	DefaultDatastore Budget
+	DefaultNetwork   Budget
+	// MaxConcurrent caps the number of transfers running across the whole batch.
+	MaxConcurrent int
+}
+
+// resource tracks the running transfers and shared limiter of one datastore or network.
+type resource struct {
+	budget  Budget
+	running int
+	limiter *Limiter
+}
+
+func (r *resource) hasSlot() bool {
+	return r.budget.MaxConcurrent <= 0 || r.running < r.budget.MaxConcurrent
+}
+
+// share returns the bandwidth of one of the transfers the resource lets run at once, at most
+// slots when its budget does not cap them, and 0 when it is unlimited.
+func (r *resource) share(slots int) int64 {
+	if r.budget.BytesPerSecond <= 0 {
+		return 0
+	}
+	if r.budget.MaxConcurrent > 0 {
+		slots = r.budget.MaxConcurrent
+	}
+	return r.budget.BytesPerSecond / int64(max(slots, 1))
+}
+
+// ParseBudgets parses budgets written as <name>=<transfers>[,<rate>], e.g. ds-ssd=4,400Mi: at
+// most transfers at once, 0 for any number, sharing rate in bytes per second. The budget named *
+// is the default of the names without their own.
+func ParseBudgets(values []string) (map[string]Budget, Budget, error) {
+	budgets := make(map[string]Budget)
+	var fallback Budget
+	for _, value := range values {
+		name, spec, ok := strings.Cut(value, "=")
+		if !ok || name == "" {
+			return nil, Budget{}, fmt.Errorf("invalid budget '%s', use <name>=<transfers>[,<rate>], e.g. ds-ssd=4,400Mi", value)
+		}
+		transfers, rate, _ := strings.Cut(spec, ",")
+		var budget Budget
+		var err error
+		if budget.MaxConcurrent, err = strconv.Atoi(transfers); err != nil || budget.MaxConcurrent < 0 {
+			return nil, Budget{}, fmt.Errorf("invalid number of transfers '%s' in budget '%s'", transfers, value)
+		}
+		if budget.BytesPerSecond, err = ParseRate(rate); err != nil {
+			return nil, Budget{}, fmt.Errorf("budget '%s': %w", value, err)
+		}
+		if name == "*" {
+			fallback = budget
+		} else {
+			budgets[name] = budget
+		}
+	}
+	return budgets, fallback, nil
+}
+
+// Scheduler runs a batch of transfers, always starting the highest priority job whose
+// datastore and network still have capacity, so a large low-priority disk cannot hold
+// back critical VMs queued behind it on other resources.
+type Scheduler struct {
+	cfg        SchedulerConfig
+	datastores map[string]*resource
+	networks   map[string]*resource
+}
+
+// NewScheduler returns a scheduler enforcing the budgets in cfg.
+func NewScheduler(cfg SchedulerConfig) *Scheduler {
+	return &Scheduler{
+		cfg:        cfg,
+		datastores: make(map[string]*resource),
+		networks:   make(map[string]*resource),
+	}
+}
+
+func (s *Scheduler) resourceFor(pool map[string]*resource, budgets map[string]Budget, fallback Budget, name string) *resource {
+	if r, ok := pool[name]; ok {
+		return r
+	}
+	budget, ok := budgets[name]
+	if !ok {
+		budget = fallback
+	}
+	r := &resource{budget: budget, limiter: NewLimiter(budget.BytesPerSecond)}
+	pool[name] = r
+	return r
+}
+
+// Run executes jobs and returns one result per job, in the order jobs were given.
+// A failing job does not stop the others; cancelling ctx stops jobs not yet started.
+func (s *Scheduler) Run(ctx context.Context, jobs []Job) []Result {
+	results := make([]Result, len(jobs))
+	pending := make([]int, len(jobs))
+	for i := range jobs {
+		results[i].Job = jobs[i]
+		pending[i] = i
+	}
+	// Highest priority first; among equals, smaller transfers first so quick VMs are not stuck
+	// behind a huge disk, then submission order.
+	sort.SliceStable(pending, func(a, b int) bool {
+		ja, jb := jobs[pending[a]], jobs[pending[b]]
+		if ja.Priority != jb.Priority {
+			return ja.Priority > jb.Priority
+		}
+		return ja.Bytes < jb.Bytes
+	})
+
+	var (
+		mu      sync.Mutex
+		cond    = sync.NewCond(&mu)
+		running int
+		wg      sync.WaitGroup
+	)
+
+	// Wake the scheduling loop when ctx is cancelled so it can drain the queue.
+	stop := context.AfterFunc(ctx, func() {
+		mu.Lock()
+		cond.Broadcast()
+		mu.Unlock()
+	})
+	defer stop()
+
+	mu.Lock()
+	for len(pending) > 0 {
+		if ctx.Err() != nil {
+			for _, idx := range pending {
+				results[idx].Err = fmt.Errorf("transfer %s not started: %w", jobs[idx].ID, ctx.Err())
+			}
+			break
+		}
+
+		next := -1
+		if s.cfg.MaxConcurrent <= 0 || running < s.cfg.MaxConcurrent {
+			for pos, idx := range pending {
+				ds := s.resourceFor(s.datastores, s.cfg.Datastores, s.cfg.DefaultDatastore, jobs[idx].Datastore)
+				nw := s.resourceFor(s.networks, s.cfg.Networks, s.cfg.DefaultNetwork, jobs[idx].Network)
+				if ds.hasSlot() && nw.hasSlot() {
+					next = pos
+					break
+				}
+			}
+		}
+		if next < 0 {
+			cond.Wait()
+			continue
+		}
+
+		idx := pending[next]
+		pending = append(pending[:next], pending[next+1:]...)
+		job := jobs[idx]
+		ds := s.datastores[job.Datastore]
+		nw := s.networks[job.Network]
+		ds.running++
+		nw.running++
+		running++
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			grant := Grant{
+				Throttle: func(r io.Reader) io.Reader { return LimitReader(ctx, r, ds.limiter, nw.limiter) },
+				Rate:     minRate(ds.share(s.cfg.MaxConcurrent), nw.share(s.cfg.MaxConcurrent)),
+			}
+			err := job.Run(ctx, grant)
+
+			mu.Lock()
+			results[idx].Err = err
+			ds.running--
+			nw.running--
+			running--
+			cond.Broadcast()
+			mu.Unlock()
+		}()
+	}
+	mu.Unlock()
+
+	wg.Wait()
+	return results
+}
+
+// minRate returns the lowest of two bandwidths, 0 meaning unlimited.
+func minRate(a, b int64) int64 {
+	if a <= 0 || (b > 0 && b < a) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,270 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	k8sresource "k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	cdiv1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
+	uploadv1 "kubevirt.io/containerized-data-importer-api/pkg/apis/upload/v1beta1"
+
+	"vmx2vmi/pkg/cluster"
+	"vmx2vmi/pkg/failure"
+	"vmx2vmi/pkg/logging"
+	"vmx2vmi/pkg/vmdk"
+)
+
+// DigestAnnotation records on the DataVolume the sha256 of the uploaded disk content.
+const DigestAnnotation = "vmx2vmi.beezy.dev/disk-sha256"
+
+// BindImmediateAnnotation asks CDI to bind the PVC of an upload DataVolume without waiting
+// for a consumer pod, since no VM uses it yet.
+const BindImmediateAnnotation = "cdi.kubevirt.io/storage.bind.immediate.requested"
+
+// UploadOptions configures Upload.
+type UploadOptions struct {
+	Namespace  string
+	DataVolume string
+	// Size is the storage request of the DataVolume, e.g. "11Gi".
+	Size         string
+	StorageClass string
+	// ProxyURL is the CDI upload proxy; empty to use the uploadProxyURL of the CDIConfig.
+	ProxyURL string
+	// ProxyCAData is a PEM bundle trusted for the upload proxy in addition to the system roots.
+	ProxyCAData []byte
+	Insecure    bool
+	// Retries is the number of additional upload attempts after a transient failure.
+	Retries int
+	// OnRetry, when set, is called before each retry.
+	OnRetry func()
+	// ReadyTimeout bounds the wait for the DataVolume to accept uploads.
+	ReadyTimeout time.Duration
+	// Throttle, when set, wraps the data stream (e.g. a Limiter's LimitReader).
+	Throttle func(io.Reader) io.Reader
+	// Verify reads the PVC back with a pod running VerifyImage once the upload completed,
+	// and compares its digest with the one computed while uploading.
+	Verify      bool
+	VerifyImage string
+}
+
+// permanentError marks upload failures that retrying cannot fix.
+type permanentError struct{ error }
+
+func (e permanentError) Unwrap() error { return e.error }
+
+// Upload creates an upload DataVolume (unless it already exists) and streams size bytes of
+// src to it through the CDI upload proxy, the way virtctl image-upload does. The data is
+// sent gzip compressed with chunked transfer encoding, all-zero chunks as a precomputed
+// member, so unallocated ranges cost little bandwidth or CPU. Transient failures are retried with a fresh upload token. The sha256 of the
+// uploaded content is returned and recorded in DigestAnnotation on the DataVolume.
+func Upload(ctx context.Context, client *cluster.Client, src io.ReaderAt, size int64, opts UploadOptions) (string, error) {
+	sum, err := upload(ctx, client, src, size, opts)
+	return sum, failure.Wrap(failure.Transfer, err)
+}
+
+func upload(ctx context.Context, client *cluster.Client, src io.ReaderAt, size int64, opts UploadOptions) (string, error) {
+	if err := ensureUploadDataVolume(ctx, client, opts); err != nil {
+		return "", err
+	}
+	if err := waitUploadReady(ctx, client, opts); err != nil {
+		return "", err
+	}
+
+	proxyURL := opts.ProxyURL
+	if proxyURL == "" {
+		var config cdiv1.CDIConfig
+		if err := client.Get(ctx, "/apis/cdi.kubevirt.io/v1beta1/cdiconfigs/config", &config); err != nil {
+			return "", fmt.Errorf("failed to look up the upload proxy URL, pass it explicitly: %w", err)
+		}
+		if config.Status.UploadProxyURL == nil || *config.Status.UploadProxyURL == "" {
+			return "", fmt.Errorf("CDIConfig has no uploadProxyURL, expose the cdi-uploadproxy service and pass its URL explicitly")
+		}
+		proxyURL = *config.Status.UploadProxyURL
+	}
+	if !strings.Contains(proxyURL, "://") {
+		proxyURL = "https://" + proxyURL
+	}
+	tlsConfig, err := cluster.TLSConfig(opts.ProxyCAData, opts.Insecure)
+	if err != nil {
+		return "", fmt.Errorf("upload proxy: %w", err)
+	}
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment}}
+
+	var digest *vmdk.DigestReaderAt
+	for attempt := 0; ; attempt++ {
+		digest = vmdk.NewDigestReaderAt(src)
+		err = uploadOnce(ctx, client, httpClient, strings.TrimSuffix(proxyURL, "/")+"/v1beta1/upload", digest, size, opts)
+		var permanent permanentError
+		if err == nil {
+			break
+		}
+		if errors.As(err, &permanent) || attempt >= opts.Retries || ctx.Err() != nil {
+			return "", err
+		}
+		delay := time.Duration(attempt+1) * 5 * time.Second
+		logging.Warnf("Upload attempt %d of %s failed, retrying in %s: %v", attempt+1, opts.DataVolume, delay, err)
+		if opts.OnRetry != nil {
+			opts.OnRetry()
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+
+	sum, err := digest.Sum(size)
+	if err != nil {
+		return "", err
+	}
+	patch := map[string]any{"metadata": map[string]any{"annotations": map[string]string{DigestAnnotation: sum}}}
+	if err := client.MergePatch(ctx, dataVolumePath(opts.Namespace, opts.DataVolume), patch); err != nil {
+		logging.Warnf("Could not record the disk digest on DataVolume %s/%s: %v", opts.Namespace, opts.DataVolume, err)
+	}
+	if opts.Verify {
+		if err := waitDataVolumeSucceeded(ctx, client, opts.Namespace, opts.DataVolume); err != nil {
+			return sum, err
+		}
+		if err := VerifyPVC(ctx, client, opts.Namespace, opts.DataVolume, size, sum, opts.VerifyImage); err != nil {
+			return sum, err
+		}
+	}
+	return sum, nil
+}
+
+func dataVolumePath(namespace, name string) string {
+	return fmt.Sprintf("/apis/cdi.kubevirt.io/v1beta1/namespaces/%s/datavolumes/%s", namespace, name)
+}
+
+// ensureUploadDataVolume creates the upload DataVolume, or checks that an existing one can take an upload.
+func ensureUploadDataVolume(ctx context.Context, client *cluster.Client, opts UploadOptions) error {
+	var existing cdiv1.DataVolume
+	err := client.Get(ctx, dataVolumePath(opts.Namespace, opts.DataVolume), &existing)
+	if err == nil {
+		if existing.Spec.Source == nil || existing.Spec.Source.Upload == nil {
+			return fmt.Errorf("DataVolume %s/%s already exists and is not an upload DataVolume", opts.Namespace, opts.DataVolume)
+		}
+		if existing.Status.Phase == cdiv1.Succeeded {
+			return fmt.Errorf("DataVolume %s/%s already holds an uploaded image, delete it to upload again", opts.Namespace, opts.DataVolume)
+		}
+		logging.Infof("Reusing existing upload DataVolume %s/%s\n", opts.Namespace, opts.DataVolume)
+		return nil
+	}
+	if !cluster.IsNotFound(err) {
+		return fmt.Errorf("failed to look up DataVolume: %w", err)
+	}
+
+	quantity, err := k8sresource.ParseQuantity(opts.Size)
+	if err != nil {
+		return fmt.Errorf("invalid DataVolume size '%s': %w", opts.Size, err)
+	}
+	dv := &cdiv1.DataVolume{
+		TypeMeta: metav1.TypeMeta{APIVersion: "cdi.kubevirt.io/v1beta1", Kind: "DataVolume"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        opts.DataVolume,
+			Namespace:   opts.Namespace,
+			Annotations: map[string]string{BindImmediateAnnotation: "true"},
+		},
+		Spec: cdiv1.DataVolumeSpec{
+			Source: &cdiv1.DataVolumeSource{Upload: &cdiv1.DataVolumeSourceUpload{}},
+			Storage: &cdiv1.StorageSpec{
+				Resources: corev1.VolumeResourceRequirements{
+					Requests: corev1.ResourceList{corev1.ResourceStorage: quantity},
+				},
+			},
+		},
+	}
+	if opts.StorageClass != "" {
+		dv.Spec.Storage.StorageClassName = &opts.StorageClass
+	}
+	path := fmt.Sprintf("/apis/cdi.kubevirt.io/v1beta1/namespaces/%s/datavolumes", opts.Namespace)
+	if err := client.Create(ctx, path, dv, nil); err != nil {
+		return fmt.Errorf("failed to create DataVolume: %w", err)
+	}
+	logging.Infof("Created upload DataVolume %s/%s (%s)\n", opts.Namespace, opts.DataVolume, opts.Size)
+	return nil
+}
+
+// waitUploadReady polls the DataVolume until its upload server accepts data.
+func waitUploadReady(ctx context.Context, client *cluster.Client, opts UploadOptions) error {
+	timeout := opts.ReadyTimeout
+	if timeout == 0 {
+		timeout = 5 * time.Minute
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for {
+		var dv cdiv1.DataVolume
+		if err := client.Get(ctx, dataVolumePath(opts.Namespace, opts.DataVolume), &dv); err != nil {
+			return fmt.Errorf("failed to read DataVolume: %w", err)
+		}
+		switch dv.Status.Phase {
+		case cdiv1.UploadReady:
+			return nil
+		case cdiv1.Failed:
+			return fmt.Errorf("DataVolume %s/%s failed", opts.Namespace, opts.DataVolume)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("DataVolume %s/%s not ready for upload after %s (phase %q)", opts.Namespace, opts.DataVolume, timeout, dv.Status.Phase)
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+// uploadOnce requests an upload token and streams the whole disk to the upload proxy.
+func uploadOnce(ctx context.Context, client *cluster.Client, httpClient *http.Client, url string, src io.ReaderAt, size int64, opts UploadOptions) error {
+	tokenRequest := &uploadv1.UploadTokenRequest{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "upload.cdi.kubevirt.io/v1beta1", Kind: "UploadTokenRequest"},
+		ObjectMeta: metav1.ObjectMeta{Name: opts.DataVolume, Namespace: opts.Namespace},
+		Spec:       uploadv1.UploadTokenRequestSpec{PvcName: opts.DataVolume},
+	}
+	path := fmt.Sprintf("/apis/upload.cdi.kubevirt.io/v1beta1/namespaces/%s/uploadtokenrequests", opts.Namespace)
+	if err := client.Create(ctx, path, tokenRequest, tokenRequest); err != nil {
+		return permanentError{fmt.Errorf("failed to request an upload token: %w", err)}
+	}
+
+	// Compress on the fly; the proxy detects gzip and the upload server inflates it.
+	pr, pw := io.Pipe()
+	var elided int64
+	go func() {
+		var r io.Reader = io.NewSectionReader(src, 0, size)
+		if opts.Throttle != nil {
+			r = opts.Throttle(r)
+		}
+		var err error
+		elided, err = writeGzipEliding(pw, r)
+		pw.CloseWithError(err)
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, pr)
+	if err != nil {
+		pr.Close()
+		return permanentError{err}
+	}
+	req.Header.Set("Authorization", "Bearer "+tokenRequest.Status.Token)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("upload failed: %w", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		logging.Debugf("Sent %d data bytes, %d zero bytes elided\n", size-elided, elided)
+		return nil
+	case resp.StatusCode >= 500:
+		return fmt.Errorf("upload proxy returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	default:
+		return permanentError{fmt.Errorf("upload proxy returned %s: %s", resp.Status, strings.TrimSpace(string(body)))}
+	}
+}
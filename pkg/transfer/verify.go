@@ -0,0 +1,114 @@
+package transfer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	cdiv1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
+
+	"vmx2vmi/pkg/cluster"
+	"vmx2vmi/pkg/failure"
+)
+
+// DefaultVerifyImage provides the sh, head and sha256sum used by the verification pod.
+const DefaultVerifyImage = "registry.access.redhat.com/ubi9/ubi-minimal"
+
+// VerifyPVC checks that the first size bytes of the disk image in claim hash to expected,
+// by running a short-lived pod that reads the PVC back. Filesystem volumes are read from the
+// disk.img file CDI writes; block volumes from the device. CDI may have grown the image to
+// the PVC size, hence only the source size is hashed.
+func VerifyPVC(ctx context.Context, client *cluster.Client, namespace, claim string, size int64, expected, image string) error {
+	if image == "" {
+		image = DefaultVerifyImage
+	}
+	var pvc corev1.PersistentVolumeClaim
+	if err := client.Get(ctx, fmt.Sprintf("/api/v1/namespaces/%s/persistentvolumeclaims/%s", namespace, claim), &pvc); err != nil {
+		return fmt.Errorf("failed to read PVC: %w", err)
+	}
+
+	container := corev1.Container{Name: "verify", Image: image}
+	path := "/pvc/disk.img"
+	if pvc.Spec.VolumeMode != nil && *pvc.Spec.VolumeMode == corev1.PersistentVolumeBlock {
+		path = "/dev/disk"
+		container.VolumeDevices = []corev1.VolumeDevice{{Name: "disk", DevicePath: path}}
+	} else {
+		container.VolumeMounts = []corev1.VolumeMount{{Name: "disk", MountPath: "/pvc", ReadOnly: true}}
+	}
+	container.Command = []string{"sh", "-c", fmt.Sprintf("head -c %d %s | sha256sum", size, path)}
+
+	pod := &corev1.Pod{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: claim + "-verify-",
+			Namespace:    namespace,
+		},
+		Spec: corev1.PodSpec{
+			RestartPolicy: corev1.RestartPolicyNever,
+			Containers:    []corev1.Container{container},
+			Volumes: []corev1.Volume{{
+				Name: "disk",
+				VolumeSource: corev1.VolumeSource{
+					PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: claim, ReadOnly: true},
+				},
+			}},
+		},
+	}
+	podsPath := fmt.Sprintf("/api/v1/namespaces/%s/pods", namespace)
+	if err := client.Create(ctx, podsPath, pod, pod); err != nil {
+		return fmt.Errorf("failed to create verification pod: %w", err)
+	}
+	podPath := podsPath + "/" + pod.Name
+	defer client.Delete(context.Background(), podPath)
+
+	for pod.Status.Phase != corev1.PodSucceeded {
+		if pod.Status.Phase == corev1.PodFailed {
+			return fmt.Errorf("verification pod %s failed", pod.Name)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("verification pod %s did not finish: %w", pod.Name, ctx.Err())
+		case <-time.After(2 * time.Second):
+		}
+		if err := client.Get(ctx, podPath, pod); err != nil {
+			return fmt.Errorf("failed to read verification pod: %w", err)
+		}
+	}
+
+	logs, err := client.GetRaw(ctx, podPath+"/log")
+	if err != nil {
+		return fmt.Errorf("failed to read verification pod logs: %w", err)
+	}
+	fields := strings.Fields(string(logs))
+	if len(fields) == 0 {
+		return fmt.Errorf("verification pod %s printed no digest", pod.Name)
+	}
+	if fields[0] != expected {
+		return failure.Errorf(failure.Transfer, "PVC %s/%s content sha256 %s does not match source %s", namespace, claim, fields[0], expected)
+	}
+	return nil
+}
+
+// waitDataVolumeSucceeded polls a DataVolume until CDI has finished populating it.
+func waitDataVolumeSucceeded(ctx context.Context, client *cluster.Client, namespace, name string) error {
+	for {
+		var dv cdiv1.DataVolume
+		if err := client.Get(ctx, dataVolumePath(namespace, name), &dv); err != nil {
+			return fmt.Errorf("failed to read DataVolume: %w", err)
+		}
+		switch dv.Status.Phase {
+		case cdiv1.Succeeded:
+			return nil
+		case cdiv1.Failed:
+			return fmt.Errorf("DataVolume %s/%s failed", namespace, name)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("DataVolume %s/%s did not succeed (phase %q): %w", namespace, name, dv.Status.Phase, ctx.Err())
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package transfer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"sync"
+
+	"vmx2vmi/pkg/vmdk"
+)
+
+// zeroChunk is the unit in which the upload stream is checked for zeros.
+const zeroChunk = 1 << 20
+
+// zeroMember is a complete gzip member inflating to zeroChunk zero bytes, built once.
+var zeroMember = sync.OnceValue(func() []byte {
+	var b bytes.Buffer
+	zw, _ := gzip.NewWriterLevel(&b, gzip.BestCompression)
+	zw.Write(make([]byte, zeroChunk))
+	zw.Close()
+	return b.Bytes()
+})
+
+// writeGzipEliding gzip compresses r into w. All-zero chunks are not compressed but sent as
+// a precomputed gzip member of about 1 KiB; gzip readers, including the CDI upload server,
+// read concatenated members as one stream. It returns the number of zero bytes elided.
+func writeGzipEliding(w io.Writer, r io.Reader) (int64, error) {
+	var zw *gzip.Writer
+	var elided int64
+	buf := make([]byte, zeroChunk)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			break
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return elided, err
+		}
+		chunk := buf[:n]
+		if n == zeroChunk && vmdk.IsZero(chunk) {
+			if zw != nil {
+				if err := zw.Close(); err != nil {
+					return elided, err
+				}
+				zw = nil
+			}
+			if _, err := w.Write(zeroMember()); err != nil {
+				return elided, err
+			}
+			elided += int64(n)
+			continue
+		}
+		if zw == nil {
+			zw, _ = gzip.NewWriterLevel(w, gzip.BestSpeed)
+		}
+		if _, err := zw.Write(chunk); err != nil {
+			return elided, err
+		}
+	}
+	if zw == nil && elided == 0 {
+		// An empty disk still needs one member to be valid gzip.
+		zw, _ = gzip.NewWriterLevel(w, gzip.BestSpeed)
+	}
+	if zw != nil {
+		return elided, zw.Close()
+	}
+	return elided, nil
+}
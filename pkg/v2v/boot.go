@@ -0,0 +1,381 @@
+package v2v
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// What CheckBoot does with the issues it finds.
+const (
+	// BootCheckReport only reports them.
+	BootCheckReport = "report"
+	// BootCheckFix fixes those it can.
+	BootCheckFix = "fix"
+)
+
+// ParseBootCheck checks a -linux-boot-check value.
+func ParseBootCheck(s string) (string, error) {
+	switch s {
+	case BootCheckReport, BootCheckFix:
+		return s, nil
+	}
+	return "", fmt.Errorf("invalid mode '%s', must be report or fix", s)
+}
+
+// bootConfigs are the files of a Linux guest naming the devices it mounts and boots from.
+var bootConfigs = []string{
+	"/etc/fstab",
+	"/etc/default/grub",
+	"/boot/grub2/grub.cfg",
+	"/boot/grub/grub.cfg",
+	"/boot/grub/menu.lst",
+	"/boot/grub2/grubenv",
+}
+
+// blsEntries holds the Boot Loader Specification entries of RHEL 8 and later, with their own
+// kernel command lines.
+const blsEntries = "/boot/loader/entries"
+
+var (
+	// vmwareDevice matches the device names the VMware SCSI and IDE controllers give disks, which
+	// become /dev/vdX on virtio, and the by-path and by-id links of their bus and serial.
+	vmwareDevice = regexp.MustCompile(`^/dev/((sd|hd)([a-z]+)[0-9]*|disk/by-(path|id)/.+)$`)
+	// deviceParameter matches the kernel parameters naming a device.
+	deviceParameter = regexp.MustCompile(`\b(root|resume)=(/dev/\S+)`)
+	// initramfsName matches the initramfs images of RHEL (initramfs-<version>.img), Debian
+	// (initrd.img-<version>) and SUSE (initrd-<version>).
+	initramfsName = regexp.MustCompile(`^(?:initramfs-(.+)\.img|initrd\.img-(.+)|initrd-(.+))$`)
+)
+
+// virtioModules are the modules the kernel needs to find a virtio-blk disk.
+var virtioModules = []string{"virtio_pci", "virtio_blk"}
+
+// BootIssue is a setting of a Linux guest that breaks its boot once its disks move from the
+// VMware controllers to virtio.
+type BootIssue struct {
+	// File is the file of the guest holding the setting.
+	File string
+	// Line is the line of the setting, 1-based, or 0 for a file as a whole.
+	Line    int
+	Problem string
+	// Fixed reports whether CheckBoot fixed it in the guest.
+	Fixed bool
+	// setting is the text of the line naming guestDevice, the device of the guest, and device
+	// the device of the libguestfs appliance holding its filesystem, empty when it is not known.
+	setting, guestDevice, device string
+}
+
+func (i BootIssue) String() string {
+	where := i.File
+	if i.Line > 0 {
+		where = fmt.Sprintf("%s:%d", i.File, i.Line)
+	}
+	return where + ": " + i.Problem
+}
+
+// CheckBoot inspects the Linux guest of disks for the settings that stop it from booting on
+// virtio disks: /etc/fstab entries and GRUB root= and resume= parameters naming /dev/sdX,
+// /dev/hdX or the by-path and by-id links of the VMware controllers, and initramfs images
+// without the virtio modules. With fix, the device names are replaced with the UUID of their
+// filesystem, after a copy of each file is kept with a .vmx2vmi suffix; initramfs images are only
+// reported, as they must be rebuilt in the guest, which -v2v does. The disks must be in the
+// order the guest sees them and not be in use. It needs guestfish of libguestfs.
+func CheckBoot(ctx context.Context, disks []Disk, fix bool) ([]BootIssue, error) {
+	if _, err := exec.LookPath("guestfish"); err != nil {
+		return nil, fmt.Errorf("guestfish not found on PATH, install libguestfs: %w", err)
+	}
+	dir, err := os.MkdirTemp("", "vmx2vmi-boot-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	// Missing files are expected, a guest only has some of them: a leading - has guestfish go on.
+	var script strings.Builder
+	for i, file := range bootConfigs {
+		fmt.Fprintf(&script, "-download %s %s\n", file, quoteGuestfish(filepath.Join(dir, fmt.Sprint(i))))
+	}
+	fmt.Fprintf(&script, "-copy-out %s %s\n", blsEntries, quoteGuestfish(dir))
+	script.WriteString("echo @@ mountpoints\nmountpoints\necho @@ boot\n-ls /boot\n")
+	out, err := libguestfs(ctx, script.String(), "guestfish", append([]string{"--ro", "-i"}, addDrives(disks)...)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the boot settings of the guest: %w", err)
+	}
+	sections := guestfishSections(out)
+	mountpoints := make(map[string]string)
+	for _, line := range sections["mountpoints"] {
+		if device, mountpoint, ok := strings.Cut(line, ": "); ok {
+			mountpoints[mountpoint] = device
+		}
+	}
+
+	files := make(map[string]string)
+	for i, file := range bootConfigs {
+		files[file] = filepath.Join(dir, fmt.Sprint(i))
+	}
+	entries, _ := filepath.Glob(filepath.Join(dir, path.Base(blsEntries), "*.conf"))
+	for _, entry := range entries {
+		files[path.Join(blsEntries, filepath.Base(entry))] = entry
+	}
+	var names []string
+	for file, local := range files {
+		if _, err := os.Stat(local); err == nil {
+			names = append(names, file)
+		}
+	}
+	slices.Sort(names)
+
+	var issues []BootIssue
+	devices := make(map[string]bool)
+	for _, file := range names {
+		fileIssues, err := checkBootFile(files[file], file, mountpoints, len(disks))
+		if err != nil {
+			return nil, err
+		}
+		for _, issue := range fileIssues {
+			if device := issue.device; device != "" {
+				devices[device] = true
+			}
+		}
+		issues = append(issues, fileIssues...)
+	}
+
+	// A second pass reads what the first one named: the UUIDs of the devices to fix, and the
+	// modules of the initramfs images.
+	script.Reset()
+	var deviceList []string
+	if fix {
+		for device := range devices {
+			deviceList = append(deviceList, device)
+		}
+		slices.Sort(deviceList)
+		for _, device := range deviceList {
+			fmt.Fprintf(&script, "echo @@ uuid %s\n-vfs-uuid %s\n", device, device)
+		}
+	}
+	initramfs := make(map[string]string)
+	for _, name := range sections["boot"] {
+		m := initramfsName.FindStringSubmatch(name)
+		if m == nil || strings.Contains(name, "kdump") || strings.Contains(name, "rescue") {
+			continue
+		}
+		version := m[1] + m[2] + m[3]
+		initramfs[version] = "/boot/" + name
+		fmt.Fprintf(&script, "echo @@ initrd %s\n-initrd-list /boot/%s\n", version, name)
+		fmt.Fprintf(&script, "echo @@ builtin %s\n-cat /lib/modules/%s/modules.builtin\n", version, version)
+	}
+	uuids := make(map[string]string)
+	if script.Len() > 0 {
+		out, err := libguestfs(ctx, script.String(), "guestfish", append([]string{"--ro", "-i"}, addDrives(disks)...)...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to inspect the boot devices and initramfs of the guest: %w", err)
+		}
+		sections := guestfishSections(out)
+		for _, device := range deviceList {
+			if lines := sections["uuid "+device]; len(lines) > 0 {
+				uuids[device] = lines[0]
+			}
+		}
+		var versions []string
+		for version := range initramfs {
+			versions = append(versions, version)
+		}
+		slices.Sort(versions)
+		for _, version := range versions {
+			if missing := missingModules(sections["initrd "+version], sections["builtin "+version]); len(missing) > 0 {
+				modules := "module"
+				if len(missing) > 1 {
+					modules += "s"
+				}
+				issues = append(issues, BootIssue{
+					File:    initramfs[version],
+					Problem: fmt.Sprintf("initramfs lacks the %s %s the kernel needs to find its root disk on virtio; rebuild it in the guest (dracut -f --add-drivers %q) before the migration, or convert the guest with -v2v", strings.Join(missing, " and "), modules, strings.Join(virtioModules, " ")),
+				})
+			}
+		}
+	}
+	if !fix {
+		return issues, nil
+	}
+
+	script.Reset()
+	for _, file := range names {
+		changed := false
+		for i := range issues {
+			if issues[i].File == file && uuids[issues[i].device] != "" {
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+		if err := fixBootFile(files[file], file, issues, uuids); err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&script, "cp-a %s %s.vmx2vmi\nupload %s %s\n", file, file, quoteGuestfish(files[file]), file)
+	}
+	if script.Len() > 0 {
+		if _, err := libguestfs(ctx, script.String(), "guestfish", append([]string{"--rw", "-i"}, addDrives(disks)...)...); err != nil {
+			return nil, fmt.Errorf("failed to write the fixed boot settings into the guest: %w", err)
+		}
+	}
+	return issues, nil
+}
+
+// checkBootFile returns the issues of the file of the guest, read from local. The device of an
+// issue is the device mounted on the mount point of an fstab entry, or the device of the same
+// letter, as the appliance sees the disks in the order of the guest.
+func checkBootFile(local, file string, mountpoints map[string]string, disks int) ([]BootIssue, error) {
+	data, err := os.ReadFile(local)
+	if err != nil {
+		return nil, err
+	}
+	var issues []BootIssue
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if file == "/etc/fstab" {
+			fields := strings.Fields(trimmed)
+			if len(fields) < 2 || !vmwareDevice.MatchString(fields[0]) {
+				continue
+			}
+			device := mountpoints[fields[1]]
+			if device == "" {
+				device = applianceDevice(fields[0], disks)
+			}
+			issues = append(issues, BootIssue{
+				File:        file,
+				Line:        n,
+				Problem:     fmt.Sprintf("%s is mounted from %s, which the guest does not have on virtio", fields[1], fields[0]),
+				setting:     fields[0],
+				guestDevice: fields[0],
+				device:      device,
+			})
+			continue
+		}
+		for _, m := range deviceParameter.FindAllStringSubmatch(line, -1) {
+			if !vmwareDevice.MatchString(m[2]) {
+				continue
+			}
+			device := ""
+			if m[1] == "root" {
+				device = mountpoints["/"]
+			}
+			if device == "" {
+				device = applianceDevice(m[2], disks)
+			}
+			issues = append(issues, BootIssue{
+				File:        file,
+				Line:        n,
+				Problem:     fmt.Sprintf("kernel parameter %s names a device the guest does not have on virtio", m[0]),
+				setting:     m[0],
+				guestDevice: m[2],
+				device:      device,
+			})
+		}
+	}
+	return issues, scanner.Err()
+}
+
+// applianceDevice returns the device of the appliance for a /dev/sdX or /dev/hdX device of the
+// guest, or "" for the by-path and by-id links and for letters past the disks.
+func applianceDevice(device string, disks int) string {
+	m := vmwareDevice.FindStringSubmatch(device)
+	if m == nil || m[3] == "" {
+		return ""
+	}
+	index := 0
+	for _, letter := range m[3] {
+		index = index*26 + int(letter-'a') + 1
+	}
+	if index > disks {
+		return ""
+	}
+	return "/dev/sd" + strings.TrimPrefix(strings.TrimPrefix(m[1], "sd"), "hd")
+}
+
+// fixBootFile replaces, in local, the device names of the issues of file with the UUID of their
+// filesystem, and marks them fixed. Issues whose device has no UUID are left as they are.
+func fixBootFile(local, file string, issues []BootIssue, uuids map[string]string) error {
+	data, err := os.ReadFile(local)
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(string(data), "\n")
+	for i := range issues {
+		issue := &issues[i]
+		uuid := uuids[issue.device]
+		if issue.File != file || issue.Line == 0 || uuid == "" {
+			continue
+		}
+		fixed := strings.Replace(issue.setting, issue.guestDevice, "UUID="+uuid, 1)
+		lines[issue.Line-1] = strings.Replace(lines[issue.Line-1], issue.setting, fixed, 1)
+		issue.Fixed = true
+	}
+	fixed := strings.Join(lines, "\n")
+	if file == "/boot/grub2/grubenv" {
+		// GRUB reads its environment block as exactly the size it was written with, padded with #.
+		fixed = strings.TrimRight(fixed, "#")
+		if len(fixed) > len(data) {
+			for i := range issues {
+				if issues[i].File == file {
+					issues[i].Fixed = false
+				}
+			}
+			return nil
+		}
+		fixed += strings.Repeat("#", len(data)-len(fixed))
+	}
+	return os.WriteFile(local, []byte(fixed), 0o600)
+}
+
+// missingModules returns the virtioModules neither in the files of an initramfs nor built into
+// its kernel. An initramfs without modules at all could not be read, e.g. compressed with zstd,
+// and is not reported.
+func missingModules(files, builtin []string) []string {
+	if !slices.ContainsFunc(files, func(f string) bool { return strings.Contains(f, ".ko") }) {
+		return nil
+	}
+	var missing []string
+	for _, module := range virtioModules {
+		has := func(f string) bool {
+			base := path.Base(f)
+			return strings.HasPrefix(base, module+".ko") || strings.HasPrefix(base, strings.ReplaceAll(module, "_", "-")+".ko")
+		}
+		if !slices.ContainsFunc(files, has) && !slices.ContainsFunc(builtin, has) {
+			missing = append(missing, module)
+		}
+	}
+	return missing
+}
+
+// guestfishSections splits the output of a guestfish script into the sections its
+// "echo @@ <name>" commands start.
+func guestfishSections(out []byte) map[string][]string {
+	sections := make(map[string][]string)
+	name := ""
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		if after, ok := strings.CutPrefix(line, "@@ "); ok {
+			name = after
+			sections[name] = nil
+			continue
+		}
+		if line != "" {
+			sections[name] = append(sections[name], line)
+		}
+	}
+	return sections
+}
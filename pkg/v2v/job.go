@@ -0,0 +1,191 @@
+package v2v
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+	cdiv1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
+
+	"vmx2vmi/pkg/cluster"
+)
+
+// DefaultImage provides virt-v2v-in-place for the Job.
+const DefaultImage = "quay.io/kubev2v/forklift-virt-v2v:latest"
+
+// jobScript writes the domain of the guest and converts it. The domain is passed in the
+// environment, so no ConfigMap outlives the Job.
+const jobScript = `printf '%s' "$V2V_DOMAIN" > /tmp/domain.xml && exec virt-v2v-in-place -i libvirtxml /tmp/domain.xml`
+
+// JobOptions configures RunJob.
+type JobOptions struct {
+	// Image provides virt-v2v-in-place; DefaultImage when empty.
+	Image string
+	Logf  func(format string, args ...any)
+}
+
+// Claims returns the claims holding the disks of vm, in the order of its disks: those of its
+// PersistentVolumeClaim and DataVolume volumes. Cloud-init, container and other volumes are
+// left out.
+func Claims(vm *kubevirtv1.VirtualMachine) []string {
+	if vm.Spec.Template == nil {
+		return nil
+	}
+	spec := vm.Spec.Template.Spec
+	var claims []string
+	for _, disk := range spec.Domain.Devices.Disks {
+		if disk.Disk == nil {
+			continue
+		}
+		for _, volume := range spec.Volumes {
+			if volume.Name != disk.Name {
+				continue
+			}
+			switch {
+			case volume.PersistentVolumeClaim != nil:
+				claims = append(claims, volume.PersistentVolumeClaim.ClaimName)
+			case volume.DataVolume != nil:
+				claims = append(claims, volume.DataVolume.Name)
+			}
+		}
+	}
+	return claims
+}
+
+// RunJob converts the guest of the VM name in namespace with virt-v2v-in-place, in a Job
+// mounting claims, and waits for it. The VM must not run meanwhile. Claims of DataVolumes must
+// be imported. The Job is deleted once done; its logs are part of the error when it fails.
+func RunJob(ctx context.Context, client *cluster.Client, namespace, name string, claims []string, opts JobOptions) error {
+	if len(claims) == 0 {
+		return fmt.Errorf("VM %s/%s has no claims to convert", namespace, name)
+	}
+	container := corev1.Container{
+		Name:    "virt-v2v",
+		Image:   opts.Image,
+		Command: []string{"sh", "-c", jobScript},
+		Env:     []corev1.EnvVar{{Name: "LIBGUESTFS_BACKEND", Value: "direct"}},
+		Resources: corev1.ResourceRequirements{
+			// libguestfs runs its appliance with KVM when the node gives it /dev/kvm.
+			Limits: corev1.ResourceList{"devices.kubevirt.io/kvm": resource.MustParse("1")},
+		},
+	}
+	if container.Image == "" {
+		container.Image = DefaultImage
+	}
+	var volumes []corev1.Volume
+	var disks []Disk
+	for i, claim := range claims {
+		if err := checkImported(ctx, client, namespace, claim); err != nil {
+			return err
+		}
+		var pvc corev1.PersistentVolumeClaim
+		if err := client.Get(ctx, fmt.Sprintf("/api/v1/namespaces/%s/persistentvolumeclaims/%s", namespace, claim), &pvc); err != nil {
+			return fmt.Errorf("failed to read PVC %s: %w", claim, err)
+		}
+		volume := fmt.Sprintf("disk%d", i)
+		if pvc.Spec.VolumeMode != nil && *pvc.Spec.VolumeMode == corev1.PersistentVolumeBlock {
+			device := "/dev/" + volume
+			container.VolumeDevices = append(container.VolumeDevices, corev1.VolumeDevice{Name: volume, DevicePath: device})
+			disks = append(disks, Disk{Path: device, Block: true})
+		} else {
+			// KubeVirt and CDI keep the image of a filesystem claim in disk.img.
+			dir := "/disks/" + volume
+			container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{Name: volume, MountPath: dir})
+			disks = append(disks, Disk{Path: dir + "/disk.img"})
+		}
+		volumes = append(volumes, corev1.Volume{
+			Name: volume,
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: claim},
+			},
+		})
+	}
+	domainXML, err := DomainXML(name, disks)
+	if err != nil {
+		return err
+	}
+	container.Env = append(container.Env, corev1.EnvVar{Name: "V2V_DOMAIN", Value: string(domainXML)})
+
+	backoffLimit := int32(0)
+	job := &batchv1.Job{
+		TypeMeta: metav1.TypeMeta{APIVersion: "batch/v1", Kind: "Job"},
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: name + "-v2v-",
+			Namespace:    namespace,
+			Labels:       map[string]string{"app.kubernetes.io/managed-by": cluster.FieldManager},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers:    []corev1.Container{container},
+					Volumes:       volumes,
+				},
+			},
+		},
+	}
+	jobsPath := fmt.Sprintf("/apis/batch/v1/namespaces/%s/jobs", namespace)
+	if err := client.Create(ctx, jobsPath, job, job); err != nil {
+		return fmt.Errorf("failed to create the virt-v2v Job: %w", err)
+	}
+	jobName := job.Name
+	jobPath := jobsPath + "/" + jobName
+	// Without a propagation policy, deleting a Job leaves its pods behind.
+	defer client.Delete(context.WithoutCancel(ctx), jobPath+"?propagationPolicy=Background")
+	opts.Logf("Converting the guest of VM %s/%s with virt-v2v in Job %s", namespace, name, jobName)
+
+	for job.Status.Succeeded == 0 {
+		if job.Status.Failed > 0 {
+			return fmt.Errorf("virt-v2v Job %s/%s failed: %s", namespace, jobName, jobLogs(ctx, client, namespace, jobName))
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("virt-v2v Job %s/%s did not finish: %w", namespace, jobName, ctx.Err())
+		case <-time.After(5 * time.Second):
+		}
+		if err := client.Get(ctx, jobPath, job); err != nil {
+			return fmt.Errorf("failed to read virt-v2v Job: %w", err)
+		}
+	}
+	return nil
+}
+
+// checkImported fails when claim is the claim of a DataVolume CDI has not populated yet, as
+// virt-v2v would find an empty disk.
+func checkImported(ctx context.Context, client *cluster.Client, namespace, claim string) error {
+	var dv cdiv1.DataVolume
+	err := client.Get(ctx, fmt.Sprintf("/apis/cdi.kubevirt.io/v1beta1/namespaces/%s/datavolumes/%s", namespace, claim), &dv)
+	if cluster.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read DataVolume %s: %w", claim, err)
+	}
+	switch dv.Status.Phase {
+	case cdiv1.Succeeded:
+		return nil
+	case cdiv1.WaitForFirstConsumer, cdiv1.PendingPopulation:
+		return fmt.Errorf("DataVolume %s/%s waits for the VM to start to be imported; virt-v2v needs its disk first, use a StorageClass with Immediate volume binding", namespace, claim)
+	}
+	return fmt.Errorf("DataVolume %s/%s is not imported yet (phase %q)", namespace, claim, dv.Status.Phase)
+}
+
+// jobLogs returns the last lines of the logs of the pod of the Job, or why they are missing.
+func jobLogs(ctx context.Context, client *cluster.Client, namespace, job string) string {
+	var pods corev1.PodList
+	if err := client.Get(ctx, fmt.Sprintf("/api/v1/namespaces/%s/pods?labelSelector=job-name%%3D%s", namespace, job), &pods); err != nil || len(pods.Items) == 0 {
+		return "no logs: its pod is gone"
+	}
+	logs, err := client.GetRaw(ctx, fmt.Sprintf("/api/v1/namespaces/%s/pods/%s/log?tailLines=3", namespace, pods.Items[0].Name))
+	if err != nil {
+		return fmt.Sprintf("no logs: %v", err)
+	}
+	return strings.ReplaceAll(strings.TrimSpace(string(logs)), "\n", " | ")
+}
@@ -0,0 +1,227 @@
+// Package v2v converts the guest of a migrated VM with virt-v2v-in-place: it installs the virtio
+// drivers, rebuilds the initramfs and fixes the bootloader on the copied disks, so that a guest
+// that only knew VMware devices boots on KubeVirt. It runs on this host, on local images or
+// block devices, or in a Kubernetes Job mounting the claims of the VM. For Windows guests,
+// InjectDrivers only installs the virtio drivers, with the tools of libguestfs; for Linux
+// guests, CheckBoot finds, and fixes, the device names their fstab and bootloader would miss.
+package v2v
+
+import (
+	"bufio"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Where the conversion runs.
+const (
+	// ModeLocal runs virt-v2v-in-place on this host.
+	ModeLocal = "local"
+	// ModeJob runs it in a Job of the cluster.
+	ModeJob = "job"
+)
+
+// ParseMode checks a -v2v value.
+func ParseMode(s string) (string, error) {
+	switch s {
+	case ModeLocal, ModeJob:
+		return s, nil
+	}
+	return "", fmt.Errorf("invalid mode '%s', must be local or job", s)
+}
+
+// Selects reports whether selectors pick a guest of the VMware guest OS identifier guestOS, e.g.
+// windows2019srv-64, and family, as vmx.VMXConfig.GuestOSFamily returns it. A selector is a
+// family, windows, linux or other, or a glob of identifiers such as rhel7*. Without selectors,
+// every guest is picked.
+func Selects(selectors []string, guestOS, family string) bool {
+	if len(selectors) == 0 {
+		return true
+	}
+	for _, selector := range selectors {
+		if selector == family {
+			return true
+		}
+		if ok, _ := path.Match(strings.ToLower(selector), strings.ToLower(guestOS)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateSelectors checks the globs of selectors.
+func ValidateSelectors(selectors []string) error {
+	for _, selector := range selectors {
+		if _, err := path.Match(selector, ""); err != nil {
+			return fmt.Errorf("invalid guest OS selector '%s': %w", selector, err)
+		}
+	}
+	return nil
+}
+
+// Disk is a disk of the guest, in the order the guest sees them.
+type Disk struct {
+	// Path is an image file or a block device.
+	Path string
+	// Format is raw or qcow2; raw when empty.
+	Format string
+	Block  bool
+}
+
+type domain struct {
+	XMLName xml.Name     `xml:"domain"`
+	Type    string       `xml:"type,attr"`
+	Name    string       `xml:"name"`
+	Memory  domainMemory `xml:"memory"`
+	OS      domainOS     `xml:"os"`
+	Disks   []domainDisk `xml:"devices>disk"`
+}
+
+type domainMemory struct {
+	Unit  string `xml:"unit,attr"`
+	Value int    `xml:",chardata"`
+}
+
+type domainOS struct {
+	Type string `xml:"type"`
+}
+
+type domainDisk struct {
+	Type   string       `xml:"type,attr"`
+	Device string       `xml:"device,attr"`
+	Driver domainDriver `xml:"driver"`
+	Source domainSource `xml:"source"`
+	Target domainTarget `xml:"target"`
+}
+
+type domainDriver struct {
+	Name string `xml:"name,attr"`
+	Type string `xml:"type,attr"`
+}
+
+type domainSource struct {
+	File string `xml:"file,attr,omitempty"`
+	Dev  string `xml:"dev,attr,omitempty"`
+}
+
+type domainTarget struct {
+	Dev string `xml:"dev,attr"`
+	Bus string `xml:"bus,attr"`
+}
+
+// DomainXML returns the libvirt domain of a guest with disks, the input of virt-v2v-in-place.
+// virt-v2v only reads the disks from it; the other settings of the VM come from its manifest.
+func DomainXML(name string, disks []Disk) ([]byte, error) {
+	if len(disks) == 0 {
+		return nil, fmt.Errorf("guest %s has no disks to convert", name)
+	}
+	d := domain{Type: "kvm", Name: name, Memory: domainMemory{Unit: "GiB", Value: 1}, OS: domainOS{Type: "hvm"}}
+	for i, disk := range disks {
+		dd := domainDisk{
+			Type:   "file",
+			Device: "disk",
+			Driver: domainDriver{Name: "qemu", Type: disk.Format},
+			Source: domainSource{File: disk.Path},
+			Target: domainTarget{Dev: "sd" + diskLetters(i), Bus: "scsi"},
+		}
+		if dd.Driver.Type == "" {
+			dd.Driver.Type = "raw"
+		}
+		if disk.Block {
+			dd.Type, dd.Source = "block", domainSource{Dev: disk.Path}
+		}
+		d.Disks = append(d.Disks, dd)
+	}
+	data, err := xml.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// diskLetters returns the letters of the i-th disk name: a, b, ..., z, aa, ab.
+func diskLetters(i int) string {
+	if i < 26 {
+		return string(rune('a' + i))
+	}
+	return diskLetters(i/26-1) + string(rune('a'+i%26))
+}
+
+// LocalOptions configures RunLocal.
+type LocalOptions struct {
+	// VirtioWin is the virtio-win ISO or directory the drivers of Windows guests are installed
+	// from; virt-v2v looks for it in its default location when empty.
+	VirtioWin string
+	// Logf reports the output of virt-v2v line by line.
+	Logf func(format string, args ...any)
+}
+
+// RunLocal converts the guest of disks with virt-v2v-in-place on this host. The disks must not be
+// in use.
+func RunLocal(ctx context.Context, name string, disks []Disk, opts LocalOptions) error {
+	binary, err := exec.LookPath("virt-v2v-in-place")
+	if err != nil {
+		return fmt.Errorf("virt-v2v-in-place not found on PATH, install virt-v2v 2.0 or later, or use -v2v job: %w", err)
+	}
+	domainXML, err := DomainXML(name, disks)
+	if err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp("", "vmx2vmi-v2v-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	xmlPath := filepath.Join(dir, "domain.xml")
+	if err := os.WriteFile(xmlPath, domainXML, 0o600); err != nil {
+		return fmt.Errorf("failed to write the libvirt domain of the guest: %w", err)
+	}
+
+	cmd := exec.CommandContext(ctx, binary, "-i", "libvirtxml", xmlPath)
+	cmd.Env = os.Environ()
+	if os.Getenv("LIBGUESTFS_BACKEND") == "" {
+		// The default libvirt backend needs a libvirt daemon, the direct one only QEMU.
+		cmd.Env = append(cmd.Env, "LIBGUESTFS_BACKEND=direct")
+	}
+	if opts.VirtioWin != "" {
+		cmd.Env = append(cmd.Env, "VIRTIO_WIN="+opts.VirtioWin)
+	}
+	output, writer := io.Pipe()
+	cmd.Stdout, cmd.Stderr = writer, writer
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start virt-v2v-in-place: %w", err)
+	}
+	done := make(chan []string)
+	go func() { done <- logLines(output, opts.Logf) }()
+	err = cmd.Wait()
+	writer.Close()
+	last := <-done
+	if err != nil {
+		return fmt.Errorf("virt-v2v-in-place failed: %w: %s", err, strings.Join(last, " | "))
+	}
+	return nil
+}
+
+// logLines reports each line of r through logf and returns the last ones, for the error.
+func logLines(r io.Reader, logf func(format string, args ...any)) []string {
+	var last []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		logf("virt-v2v: %s", line)
+		last = append(last, line)
+		if len(last) > 3 {
+			last = last[1:]
+		}
+	}
+	return last
+}
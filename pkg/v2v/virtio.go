@@ -0,0 +1,282 @@
+package v2v
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"unicode/utf16"
+)
+
+// DefaultVirtioWin is where the virtio-win package installs the ISO of the drivers.
+const DefaultVirtioWin = "/usr/share/virtio-win/virtio-win.iso"
+
+// storageClassGUID is the device class of SCSI and RAID controllers.
+const storageClassGUID = "{4D36E97B-E325-11CE-BFC1-08002BE10318}"
+
+// virtioDriver is a driver of virtio-win injected into Windows guests.
+type virtioDriver struct {
+	// Name is the directory of the driver in virtio-win, and the base name of its files.
+	Name string
+	// Boot drivers are loaded by the boot loader, as the guest needs them to read its system disk.
+	Boot bool
+	// DeviceIDs are the PCI hardware IDs of the legacy and modern virtio devices of the driver.
+	DeviceIDs []string
+}
+
+var virtioDrivers = []virtioDriver{
+	{Name: "viostor", Boot: true, DeviceIDs: []string{"pci#ven_1af4&dev_1001&subsys_00021af4&rev_00", "pci#ven_1af4&dev_1042&subsys_11001af4&rev_01"}},
+	{Name: "vioscsi", Boot: true, DeviceIDs: []string{"pci#ven_1af4&dev_1004&subsys_00081af4&rev_00", "pci#ven_1af4&dev_1048&subsys_11001af4&rev_01"}},
+	{Name: "NetKVM"},
+}
+
+// windowsGuest is the part of the virt-inspector report InjectDrivers reads.
+type windowsGuest struct {
+	Name           string `xml:"name"`
+	Arch           string `xml:"arch"`
+	MajorVersion   int    `xml:"major_version"`
+	MinorVersion   int    `xml:"minor_version"`
+	ProductName    string `xml:"product_name"`
+	ProductVariant string `xml:"product_variant"`
+	BuildID        int    `xml:"build_id"`
+}
+
+// virtioWinDir returns the directory of the drivers of virtio-win for the guest, e.g. 2k19/amd64.
+func (g windowsGuest) virtioWinDir() (string, error) {
+	arch, ok := map[string]string{"x86_64": "amd64", "i386": "x86", "aarch64": "ARM64"}[g.Arch]
+	if !ok {
+		return "", fmt.Errorf("virtio-win has no drivers for %s guests", g.Arch)
+	}
+	server := g.ProductVariant == "Server"
+	version := ""
+	switch {
+	case g.MajorVersion == 6 && g.MinorVersion == 1 && server:
+		version = "2k8R2"
+	case g.MajorVersion == 6 && g.MinorVersion == 1:
+		version = "w7"
+	case g.MajorVersion == 6 && g.MinorVersion == 2 && server:
+		version = "2k12"
+	case g.MajorVersion == 6 && g.MinorVersion == 2:
+		version = "w8"
+	case g.MajorVersion == 6 && g.MinorVersion == 3 && server:
+		version = "2k12R2"
+	case g.MajorVersion == 6 && g.MinorVersion == 3:
+		version = "w8.1"
+	case g.MajorVersion == 10 && server:
+		// Windows Server releases since 2016 are all 10.0, told apart by their build.
+		switch {
+		case g.BuildID >= 26100:
+			version = "2k25"
+		case g.BuildID >= 20348:
+			version = "2k22"
+		case g.BuildID >= 17763:
+			version = "2k19"
+		default:
+			version = "2k16"
+		}
+	case g.MajorVersion == 10 && g.BuildID >= 22000:
+		version = "w11"
+	case g.MajorVersion == 10:
+		version = "w10"
+	default:
+		return "", fmt.Errorf("virtio-win has no drivers for %s (Windows %d.%d)", g.ProductName, g.MajorVersion, g.MinorVersion)
+	}
+	return version + "/" + arch, nil
+}
+
+// InjectDrivers installs the virtio storage and network drivers of source, a virtio-win ISO or
+// its extracted directory, into the Windows guest of disks, and registers the storage drivers
+// as boot drivers of their devices, so that Windows boots from virtio disks instead of failing
+// with INACCESSIBLE_BOOT_DEVICE (0x7B). The network driver is staged for Plug and Play to
+// install at first boot. The disks must not be in use. It needs virt-inspector, guestfish and
+// virt-win-reg of libguestfs.
+func InjectDrivers(ctx context.Context, disks []Disk, source string, logf func(format string, args ...any)) error {
+	for _, tool := range []string{"virt-inspector", "guestfish", "virt-win-reg"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			return fmt.Errorf("%s not found on PATH, install libguestfs and guestfs-tools: %w", tool, err)
+		}
+	}
+	if _, err := os.Stat(source); err != nil {
+		return fmt.Errorf("virtio-win drivers not found, install the virtio-win package or set -virtio-win: %w", err)
+	}
+	guest, err := inspectWindows(ctx, disks)
+	if err != nil {
+		return err
+	}
+	dir, err := guest.virtioWinDir()
+	if err != nil {
+		return err
+	}
+	logf("Injecting the virtio-win %s drivers into %s", dir, guest.ProductName)
+
+	staging, err := os.MkdirTemp("", "vmx2vmi-virtio-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+	// The drivers are copied to Windows\Drivers\VirtIO, a directory of their own added to the
+	// Plug and Play search path, as virt-v2v does.
+	virtio := filepath.Join(staging, "VirtIO")
+	for _, driver := range virtioDrivers {
+		if err := copyDriver(ctx, source, driver.Name+"/"+dir, filepath.Join(virtio, driver.Name)); err != nil {
+			return err
+		}
+	}
+
+	var script strings.Builder
+	fmt.Fprintf(&script, "mkdir-p /Windows/Drivers\ncopy-in %s /Windows/Drivers\n", quoteGuestfish(virtio))
+	for _, driver := range virtioDrivers {
+		if driver.Boot {
+			sys := filepath.Join(virtio, driver.Name, driver.Name+".sys")
+			fmt.Fprintf(&script, "upload %s /Windows/System32/drivers/%s.sys\n", quoteGuestfish(sys), driver.Name)
+		}
+	}
+	if _, err := libguestfs(ctx, script.String(), "guestfish", append([]string{"--rw", "-i"}, addDrives(disks)...)...); err != nil {
+		return fmt.Errorf("failed to copy the drivers into the guest: %w", err)
+	}
+
+	regPath := filepath.Join(staging, "virtio.reg")
+	if err := os.WriteFile(regPath, []byte(driverRegistry(guest)), 0o600); err != nil {
+		return err
+	}
+	args := []string{"--merge"}
+	if format := disks[0].Format; format != "" {
+		args = append(args, "--format", format)
+	}
+	for _, disk := range disks {
+		args = append(args, disk.Path)
+	}
+	if _, err := libguestfs(ctx, "", "virt-win-reg", append(args, regPath)...); err != nil {
+		return fmt.Errorf("failed to register the drivers in the guest: %w", err)
+	}
+	return nil
+}
+
+// inspectWindows returns the Windows guest on disks.
+func inspectWindows(ctx context.Context, disks []Disk) (windowsGuest, error) {
+	out, err := libguestfs(ctx, "", "virt-inspector", addDrives(disks)...)
+	if err != nil {
+		return windowsGuest{}, fmt.Errorf("failed to inspect the guest: %w", err)
+	}
+	var report struct {
+		OperatingSystems []windowsGuest `xml:"operatingsystem"`
+	}
+	if err := xml.Unmarshal(out, &report); err != nil {
+		return windowsGuest{}, fmt.Errorf("failed to parse the virt-inspector report: %w", err)
+	}
+	if len(report.OperatingSystems) == 0 {
+		return windowsGuest{}, fmt.Errorf("no operating system found on the disks")
+	}
+	guest := report.OperatingSystems[0]
+	if guest.Name != "windows" {
+		return windowsGuest{}, fmt.Errorf("the guest is %s, the virtio drivers are only injected into Windows guests", guest.Name)
+	}
+	return guest, nil
+}
+
+// copyDriver copies the files of the driver at dir of source, an ISO image or a directory,
+// into the directory to.
+func copyDriver(ctx context.Context, source, dir, to string) error {
+	if err := os.MkdirAll(filepath.Dir(to), 0o755); err != nil {
+		return err
+	}
+	if info, err := os.Stat(source); err == nil && info.IsDir() {
+		if _, err := os.Stat(filepath.Join(source, dir)); err != nil {
+			return fmt.Errorf("virtio-win %s has no drivers %s: %w", source, dir, err)
+		}
+		return os.CopyFS(to, os.DirFS(filepath.Join(source, dir)))
+	}
+	// The ISO is read by the libguestfs appliance, so that it need not be mounted on this host.
+	tmp := to + ".tmp"
+	if err := os.MkdirAll(tmp, 0o755); err != nil {
+		return err
+	}
+	if _, err := libguestfs(ctx, "", "guestfish", "--ro", "--format=raw", "-a", source, "-m", "/dev/sda", "copy-out", "/"+dir, tmp); err != nil {
+		return fmt.Errorf("virtio-win %s has no drivers %s: %w", source, dir, err)
+	}
+	// copy-out creates the last element of dir, e.g. amd64, in tmp.
+	return os.Rename(filepath.Join(tmp, filepath.Base(dir)), to)
+}
+
+// driverRegistry returns the registry changes, as a .reg file, loading the storage drivers at
+// boot and pointing Plug and Play to the staged drivers.
+func driverRegistry(guest windowsGuest) string {
+	var b strings.Builder
+	b.WriteString("Windows Registry Editor Version 5.00\n\n")
+	for _, driver := range virtioDrivers {
+		if !driver.Boot {
+			continue
+		}
+		fmt.Fprintf(&b, "[HKEY_LOCAL_MACHINE\\SYSTEM\\CurrentControlSet\\Services\\%s]\n", driver.Name)
+		fmt.Fprintf(&b, "\"Type\"=dword:00000001\n\"Start\"=dword:00000000\n\"ErrorControl\"=dword:00000001\n")
+		fmt.Fprintf(&b, "\"Group\"=\"SCSI miniport\"\n\"ImagePath\"=%s\n\n", expandString(`system32\drivers\`+driver.Name+".sys"))
+		for _, id := range driver.DeviceIDs {
+			// Windows before 8 finds the driver of its boot device in the critical device database,
+			// later versions in the driver database.
+			if guest.MajorVersion == 6 && guest.MinorVersion <= 1 {
+				fmt.Fprintf(&b, "[HKEY_LOCAL_MACHINE\\SYSTEM\\CurrentControlSet\\Control\\CriticalDeviceDatabase\\%s]\n", id)
+				fmt.Fprintf(&b, "\"Service\"=\"%s\"\n\"ClassGUID\"=\"%s\"\n\n", driver.Name, storageClassGUID)
+			} else {
+				fmt.Fprintf(&b, "[HKEY_LOCAL_MACHINE\\SYSTEM\\DriverDatabase\\DeviceIds\\%s]\n", strings.ToUpper(strings.ReplaceAll(id, "#", "\\")))
+				fmt.Fprintf(&b, "\"%s.inf\"=hex:01,ff,00,00\n\n", strings.ToLower(driver.Name))
+			}
+		}
+	}
+	b.WriteString("[HKEY_LOCAL_MACHINE\\SOFTWARE\\Microsoft\\Windows\\CurrentVersion]\n")
+	fmt.Fprintf(&b, "\"DevicePath\"=%s\n", expandString(`%SystemRoot%\inf;%SystemRoot%\Drivers\VirtIO`))
+	return b.String()
+}
+
+// expandString returns s as a REG_EXPAND_SZ value of a .reg file: hex(2) of its UTF-16LE
+// encoding, NUL-terminated.
+func expandString(s string) string {
+	var data []byte
+	for _, u := range utf16.Encode([]rune(s + "\x00")) {
+		data = append(data, byte(u), byte(u>>8))
+	}
+	encoded := hex.EncodeToString(data)
+	var pairs []string
+	for i := 0; i < len(encoded); i += 2 {
+		pairs = append(pairs, encoded[i:i+2])
+	}
+	return "hex(2):" + strings.Join(pairs, ",")
+}
+
+// addDrives returns the -a options adding disks to a libguestfs tool.
+func addDrives(disks []Disk) []string {
+	var args []string
+	for _, disk := range disks {
+		format := disk.Format
+		if format == "" {
+			format = "raw"
+		}
+		args = append(args, "--format="+format, "-a", disk.Path)
+	}
+	return args
+}
+
+// quoteGuestfish quotes a path for a guestfish script.
+func quoteGuestfish(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// libguestfs runs a libguestfs tool with script on its standard input and returns its output.
+func libguestfs(ctx context.Context, script, tool string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, tool, args...)
+	cmd.Env = os.Environ()
+	if os.Getenv("LIBGUESTFS_BACKEND") == "" {
+		cmd.Env = append(cmd.Env, "LIBGUESTFS_BACKEND=direct")
+	}
+	cmd.Stdin = strings.NewReader(script)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", tool, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,418 @@
+// Package validate checks generated manifests offline against the rules the KubeVirt, CDI and
+// Kubernetes API servers enforce through their OpenAPI schemas and admission webhooks, for the
+// fields the converter writes, so that mistakes surface at conversion time instead of at
+// kubectl apply time.
+package validate
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+
+	"vmx2vmi/pkg/manifest"
+
+	corev1 "k8s.io/api/core/v1"
+	apimachineryvalidation "k8s.io/apimachinery/pkg/api/validation"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	metav1validation "k8s.io/apimachinery/pkg/apis/meta/v1/validation"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+	instancetypev1beta1 "kubevirt.io/api/instancetype/v1beta1"
+	poolv1alpha1 "kubevirt.io/api/pool/v1alpha1"
+	cdiv1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
+)
+
+var (
+	runStrategies = sets.New(kubevirtv1.RunStrategyAlways, kubevirtv1.RunStrategyHalted, kubevirtv1.RunStrategyManual,
+		kubevirtv1.RunStrategyRerunOnFailure, kubevirtv1.RunStrategyOnce)
+	evictionStrategies = sets.New(kubevirtv1.EvictionStrategyNone, kubevirtv1.EvictionStrategyLiveMigrate,
+		kubevirtv1.EvictionStrategyLiveMigrateIfPossible, kubevirtv1.EvictionStrategyExternal)
+	diskBuses       = sets.New(kubevirtv1.DiskBusVirtio, kubevirtv1.DiskBusSATA, kubevirtv1.DiskBusSCSI, kubevirtv1.DiskBusUSB)
+	interfaceModels = sets.New("", "virtio", "e1000", "e1000e", "igb", "ne2k_pci", "pcnet", "rtl8139")
+	volumeModes     = sets.New(corev1.PersistentVolumeBlock, corev1.PersistentVolumeFilesystem)
+	accessModes     = sets.New(corev1.ReadWriteOnce, corev1.ReadOnlyMany, corev1.ReadWriteMany, corev1.ReadWriteOncePod)
+)
+
+// Validate returns the field errors of obj. Kinds it does not know are not checked.
+func Validate(obj manifest.Object) field.ErrorList {
+	var errs field.ErrorList
+	switch o := obj.(type) {
+	case *kubevirtv1.VirtualMachine:
+		errs = append(errs, validateVMSpec(&o.Spec, field.NewPath("spec"))...)
+	case *poolv1alpha1.VirtualMachinePool:
+		errs = append(errs, validatePool(o)...)
+	case *corev1.PersistentVolumeClaim:
+		errs = append(errs, validateClaimSpec(o.Spec.AccessModes, o.Spec.VolumeMode, o.Spec.Resources, true, field.NewPath("spec"))...)
+	case *corev1.Secret:
+		for key := range o.Data {
+			errs = append(errs, validateKey(key, field.NewPath("data").Key(key))...)
+		}
+		for key := range o.StringData {
+			errs = append(errs, validateKey(key, field.NewPath("stringData").Key(key))...)
+		}
+	case *instancetypev1beta1.VirtualMachineInstancetype:
+		if o.Spec.CPU.Guest == 0 {
+			errs = append(errs, field.Required(field.NewPath("spec", "cpu", "guest"), "must be at least 1"))
+		}
+		if o.Spec.Memory.Guest.Sign() <= 0 {
+			errs = append(errs, field.Invalid(field.NewPath("spec", "memory", "guest"), o.Spec.Memory.Guest.String(), "must be positive"))
+		}
+	case *instancetypev1beta1.VirtualMachinePreference:
+	default:
+		return nil
+	}
+	// The name, namespace, labels and annotations; every generated kind is namespaced.
+	meta := apimachineryvalidation.ValidateObjectMetaAccessor(obj, true, apimachineryvalidation.NameIsDNSSubdomain, field.NewPath("metadata"))
+	return append(meta, errs...)
+}
+
+// validateKey checks a key of a Secret or ConfigMap.
+func validateKey(key string, fldPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	for _, msg := range validation.IsConfigMapKey(key) {
+		errs = append(errs, field.Invalid(fldPath, key, msg))
+	}
+	return errs
+}
+
+// validateDNSLabel checks a name that must be a DNS-1123 label.
+func validateDNSLabel(name string, fldPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	if name == "" {
+		return append(errs, field.Required(fldPath, ""))
+	}
+	for _, msg := range validation.IsDNS1123Label(name) {
+		errs = append(errs, field.Invalid(fldPath, name, msg))
+	}
+	return errs
+}
+
+// setPointers counts the non-nil pointer fields of the struct v, the members of a union.
+func setPointers(v any) (count int, names []string) {
+	rv := reflect.ValueOf(v)
+	for i := 0; i < rv.NumField(); i++ {
+		if f := rv.Field(i); f.Kind() == reflect.Pointer && !f.IsNil() {
+			count++
+			names = append(names, rv.Type().Field(i).Name)
+		}
+	}
+	return count, names
+}
+
+// validateUnion checks that exactly one member of the union v is set.
+func validateUnion(v any, what string, fldPath *field.Path) field.ErrorList {
+	switch count, names := setPointers(v); {
+	case count == 0:
+		return field.ErrorList{field.Required(fldPath, fmt.Sprintf("one %s must be set", what))}
+	case count > 1:
+		return field.ErrorList{field.Invalid(fldPath, names, fmt.Sprintf("only one %s may be set", what))}
+	}
+	return nil
+}
+
+// validatePool checks a VirtualMachinePool: its replicas, its selector matching the labels of
+// its VMs, and their spec.
+func validatePool(pool *poolv1alpha1.VirtualMachinePool) field.ErrorList {
+	var errs field.ErrorList
+	specPath := field.NewPath("spec")
+	if pool.Spec.Replicas != nil && *pool.Spec.Replicas < 0 {
+		errs = append(errs, field.Invalid(specPath.Child("replicas"), *pool.Spec.Replicas, "must not be negative"))
+	}
+	if pool.Spec.Selector == nil {
+		errs = append(errs, field.Required(specPath.Child("selector"), ""))
+	}
+	if pool.Spec.VirtualMachineTemplate == nil {
+		return append(errs, field.Required(specPath.Child("virtualMachineTemplate"), ""))
+	}
+	templatePath := specPath.Child("virtualMachineTemplate")
+	if pool.Spec.Selector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(pool.Spec.Selector)
+		if err != nil {
+			errs = append(errs, field.Invalid(specPath.Child("selector"), pool.Spec.Selector, err.Error()))
+		} else if !selector.Matches(labels.Set(pool.Spec.VirtualMachineTemplate.ObjectMeta.Labels)) {
+			errs = append(errs, field.Invalid(templatePath.Child("metadata", "labels"), pool.Spec.VirtualMachineTemplate.ObjectMeta.Labels, "must match spec.selector"))
+		}
+	}
+	errs = append(errs, metav1validation.ValidateLabels(pool.Spec.VirtualMachineTemplate.ObjectMeta.Labels, templatePath.Child("metadata", "labels"))...)
+	return append(errs, validateVMSpec(&pool.Spec.VirtualMachineTemplate.Spec, templatePath.Child("spec"))...)
+}
+
+// validateVMSpec checks the spec of a VirtualMachine.
+func validateVMSpec(spec *kubevirtv1.VirtualMachineSpec, fldPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	if spec.Running != nil && spec.RunStrategy != nil {
+		errs = append(errs, field.Invalid(fldPath.Child("running"), *spec.Running, "running and runStrategy are mutually exclusive"))
+	}
+	if spec.RunStrategy != nil && !runStrategies.Has(*spec.RunStrategy) {
+		errs = append(errs, field.NotSupported(fldPath.Child("runStrategy"), *spec.RunStrategy, sets.List(runStrategies)))
+	}
+	if spec.Template == nil {
+		return append(errs, field.Required(fldPath.Child("template"), ""))
+	}
+
+	dataVolumes := sets.New[string]()
+	for i, template := range spec.DataVolumeTemplates {
+		dvPath := fldPath.Child("dataVolumeTemplates").Index(i)
+		errs = append(errs, validateDNSSubdomain(template.Name, dvPath.Child("metadata", "name"))...)
+		if dataVolumes.Has(template.Name) {
+			errs = append(errs, field.Duplicate(dvPath.Child("metadata", "name"), template.Name))
+		}
+		dataVolumes.Insert(template.Name)
+		errs = append(errs, validateDataVolumeSpec(&template.Spec, dvPath.Child("spec"))...)
+	}
+
+	vmiPath := fldPath.Child("template", "spec")
+	vmi := &spec.Template.Spec
+	errs = append(errs, metav1validation.ValidateLabels(spec.Template.ObjectMeta.Labels, fldPath.Child("template", "metadata", "labels"))...)
+	if vmi.EvictionStrategy != nil && !evictionStrategies.Has(*vmi.EvictionStrategy) {
+		errs = append(errs, field.NotSupported(vmiPath.Child("evictionStrategy"), *vmi.EvictionStrategy, sets.List(evictionStrategies)))
+	}
+	if vmi.TerminationGracePeriodSeconds != nil && *vmi.TerminationGracePeriodSeconds < 0 {
+		errs = append(errs, field.Invalid(vmiPath.Child("terminationGracePeriodSeconds"), *vmi.TerminationGracePeriodSeconds, "must not be negative"))
+	}
+	errs = append(errs, validateDomain(&vmi.Domain, spec.Instancetype != nil, vmiPath.Child("domain"))...)
+
+	// Volumes and the disks and filesystems using them.
+	volumes := make(map[string]*kubevirtv1.Volume)
+	for i := range vmi.Volumes {
+		volume := &vmi.Volumes[i]
+		volumePath := vmiPath.Child("volumes").Index(i)
+		errs = append(errs, validateDNSLabel(volume.Name, volumePath.Child("name"))...)
+		if _, ok := volumes[volume.Name]; ok {
+			errs = append(errs, field.Duplicate(volumePath.Child("name"), volume.Name))
+		}
+		volumes[volume.Name] = volume
+		errs = append(errs, validateUnion(volume.VolumeSource, "volume source", volumePath)...)
+		if volume.PersistentVolumeClaim != nil && volume.PersistentVolumeClaim.ClaimName == "" {
+			errs = append(errs, field.Required(volumePath.Child("persistentVolumeClaim", "claimName"), ""))
+		}
+		if volume.DataVolume != nil && volume.DataVolume.Name == "" {
+			errs = append(errs, field.Required(volumePath.Child("dataVolume", "name"), ""))
+		}
+	}
+	referencedDataVolumes := sets.New[string]()
+	for _, volume := range vmi.Volumes {
+		if volume.DataVolume != nil {
+			referencedDataVolumes.Insert(volume.DataVolume.Name)
+		}
+	}
+	for i, template := range spec.DataVolumeTemplates {
+		if !referencedDataVolumes.Has(template.Name) {
+			errs = append(errs, field.Invalid(fldPath.Child("dataVolumeTemplates").Index(i).Child("metadata", "name"), template.Name, "must be referenced by a dataVolume volume"))
+		}
+	}
+	devicesPath := vmiPath.Child("domain", "devices")
+	used := sets.New[string]()
+	bootOrders := make(map[uint]string)
+	for i, disk := range vmi.Domain.Devices.Disks {
+		diskPath := devicesPath.Child("disks").Index(i)
+		errs = append(errs, validateDNSLabel(disk.Name, diskPath.Child("name"))...)
+		if used.Has(disk.Name) {
+			errs = append(errs, field.Duplicate(diskPath.Child("name"), disk.Name))
+		}
+		used.Insert(disk.Name)
+		if _, ok := volumes[disk.Name]; !ok {
+			errs = append(errs, field.NotFound(diskPath.Child("name"), disk.Name))
+		}
+		if count, names := setPointers(disk.DiskDevice); count > 1 {
+			errs = append(errs, field.Invalid(diskPath, names, "only one of disk, lun and cdrom may be set"))
+		}
+		var bus kubevirtv1.DiskBus
+		switch {
+		case disk.Disk != nil:
+			bus = disk.Disk.Bus
+		case disk.CDRom != nil:
+			bus = disk.CDRom.Bus
+			if bus == kubevirtv1.DiskBusVirtio {
+				errs = append(errs, field.NotSupported(diskPath.Child("cdrom", "bus"), bus, []kubevirtv1.DiskBus{kubevirtv1.DiskBusSATA, kubevirtv1.DiskBusSCSI}))
+			}
+		case disk.LUN != nil:
+			bus = disk.LUN.Bus
+		}
+		if bus != "" && !diskBuses.Has(bus) {
+			errs = append(errs, field.NotSupported(diskPath.Child("bus"), bus, sets.List(diskBuses)))
+		}
+		if disk.BootOrder != nil {
+			if *disk.BootOrder < 1 {
+				errs = append(errs, field.Invalid(diskPath.Child("bootOrder"), *disk.BootOrder, "must be at least 1"))
+			} else if other, ok := bootOrders[*disk.BootOrder]; ok {
+				errs = append(errs, field.Invalid(diskPath.Child("bootOrder"), *disk.BootOrder, "already used by "+other))
+			}
+			bootOrders[*disk.BootOrder] = disk.Name
+		}
+	}
+	for i, filesystem := range vmi.Domain.Devices.Filesystems {
+		fsPath := devicesPath.Child("filesystems").Index(i)
+		if used.Has(filesystem.Name) {
+			errs = append(errs, field.Duplicate(fsPath.Child("name"), filesystem.Name))
+		}
+		used.Insert(filesystem.Name)
+		if _, ok := volumes[filesystem.Name]; !ok {
+			errs = append(errs, field.NotFound(fsPath.Child("name"), filesystem.Name))
+		}
+	}
+
+	// Interfaces and the networks they are connected to.
+	networks := make(map[string]*kubevirtv1.Network)
+	podNetworks := 0
+	for i := range vmi.Networks {
+		network := &vmi.Networks[i]
+		networkPath := vmiPath.Child("networks").Index(i)
+		errs = append(errs, validateDNSLabel(network.Name, networkPath.Child("name"))...)
+		if _, ok := networks[network.Name]; ok {
+			errs = append(errs, field.Duplicate(networkPath.Child("name"), network.Name))
+		}
+		networks[network.Name] = network
+		errs = append(errs, validateUnion(network.NetworkSource, "network source", networkPath)...)
+		if network.Pod != nil {
+			podNetworks++
+			if podNetworks > 1 {
+				errs = append(errs, field.Invalid(networkPath.Child("pod"), network.Name, "only one network may be the pod network"))
+			}
+		}
+		if network.Multus != nil && network.Multus.NetworkName == "" {
+			errs = append(errs, field.Required(networkPath.Child("multus", "networkName"), ""))
+		}
+	}
+	interfaces := sets.New[string]()
+	for i, iface := range vmi.Domain.Devices.Interfaces {
+		ifacePath := devicesPath.Child("interfaces").Index(i)
+		if interfaces.Has(iface.Name) {
+			errs = append(errs, field.Duplicate(ifacePath.Child("name"), iface.Name))
+		}
+		interfaces.Insert(iface.Name)
+		network, ok := networks[iface.Name]
+		if !ok {
+			errs = append(errs, field.NotFound(ifacePath.Child("name"), iface.Name))
+		}
+		count, names := setPointers(iface.InterfaceBindingMethod)
+		if iface.Binding != nil {
+			count++
+			names = append(names, "Binding")
+		}
+		if count > 1 {
+			errs = append(errs, field.Invalid(ifacePath, names, "only one binding method may be set"))
+		}
+		if iface.Masquerade != nil && ok && network.Pod == nil {
+			errs = append(errs, field.Invalid(ifacePath.Child("masquerade"), iface.Name, "masquerade binding is only supported on the pod network"))
+		}
+		if iface.SRIOV != nil && ok && network.Pod != nil {
+			errs = append(errs, field.Invalid(ifacePath.Child("sriov"), iface.Name, "SR-IOV binding is not supported on the pod network"))
+		}
+		if !interfaceModels.Has(iface.Model) {
+			errs = append(errs, field.NotSupported(ifacePath.Child("model"), iface.Model, sets.List(interfaceModels)[1:]))
+		}
+		if iface.MacAddress != "" {
+			if _, err := net.ParseMAC(iface.MacAddress); err != nil {
+				errs = append(errs, field.Invalid(ifacePath.Child("macAddress"), iface.MacAddress, "must be a MAC address such as 02:00:00:00:00:01"))
+			}
+		}
+	}
+	for name := range networks {
+		if !interfaces.Has(name) {
+			errs = append(errs, field.Invalid(vmiPath.Child("networks"), name, "network has no interface of the same name"))
+		}
+	}
+	return errs
+}
+
+// validateDNSSubdomain checks a name that must be a DNS-1123 subdomain.
+func validateDNSSubdomain(name string, fldPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	if name == "" {
+		return append(errs, field.Required(fldPath, ""))
+	}
+	for _, msg := range validation.IsDNS1123Subdomain(name) {
+		errs = append(errs, field.Invalid(fldPath, name, msg))
+	}
+	return errs
+}
+
+// validateDomain checks the CPU and memory sizing of a VMI, which an instancetype may provide.
+func validateDomain(domain *kubevirtv1.DomainSpec, instancetype bool, fldPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	if domain.CPU != nil && instancetype && (domain.CPU.Cores != 0 || domain.CPU.Sockets != 0 || domain.CPU.Threads != 0) {
+		errs = append(errs, field.Invalid(fldPath.Child("cpu"), domain.CPU, "the CPU topology must not be set together with an instancetype"))
+	}
+	if domain.Memory != nil && domain.Memory.Guest != nil {
+		guest := domain.Memory.Guest
+		if guest.Sign() <= 0 {
+			errs = append(errs, field.Invalid(fldPath.Child("memory", "guest"), guest.String(), "must be positive"))
+		}
+		if instancetype {
+			errs = append(errs, field.Invalid(fldPath.Child("memory", "guest"), guest.String(), "must not be set together with an instancetype"))
+		}
+		if limit, ok := domain.Resources.Limits[corev1.ResourceMemory]; ok && guest.Cmp(limit) > 0 {
+			errs = append(errs, field.Invalid(fldPath.Child("memory", "guest"), guest.String(), "must not exceed resources.limits.memory "+limit.String()))
+		}
+	}
+	if request, ok := domain.Resources.Requests[corev1.ResourceMemory]; ok {
+		if request.Sign() <= 0 {
+			errs = append(errs, field.Invalid(fldPath.Child("resources", "requests", "memory"), request.String(), "must be positive"))
+		}
+		if limit, ok := domain.Resources.Limits[corev1.ResourceMemory]; ok && request.Cmp(limit) > 0 {
+			errs = append(errs, field.Invalid(fldPath.Child("resources", "requests", "memory"), request.String(), "must not exceed resources.limits.memory "+limit.String()))
+		}
+	}
+	return errs
+}
+
+// validateDataVolumeSpec checks the source and claim of a DataVolume.
+func validateDataVolumeSpec(spec *cdiv1.DataVolumeSpec, fldPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	switch {
+	case spec.Source == nil && spec.SourceRef == nil:
+		errs = append(errs, field.Required(fldPath.Child("source"), "source or sourceRef must be set"))
+	case spec.Source != nil:
+		errs = append(errs, validateUnion(*spec.Source, "source", fldPath.Child("source"))...)
+		if spec.Source.PVC != nil && spec.Source.PVC.Name == "" {
+			errs = append(errs, field.Required(fldPath.Child("source", "pvc", "name"), ""))
+		}
+		if spec.Source.HTTP != nil && spec.Source.HTTP.URL == "" {
+			errs = append(errs, field.Required(fldPath.Child("source", "http", "url"), ""))
+		}
+		if spec.Source.VDDK != nil && (spec.Source.VDDK.URL == "" || spec.Source.VDDK.BackingFile == "" || spec.Source.VDDK.SecretRef == "") {
+			errs = append(errs, field.Required(fldPath.Child("source", "vddk"), "url, backingFile and secretRef must be set"))
+		}
+	}
+	switch {
+	case spec.PVC != nil && spec.Storage != nil:
+		errs = append(errs, field.Invalid(fldPath, "pvc, storage", "only one of pvc and storage may be set"))
+	case spec.PVC != nil:
+		errs = append(errs, validateClaimSpec(spec.PVC.AccessModes, spec.PVC.VolumeMode, spec.PVC.Resources, true, fldPath.Child("pvc"))...)
+	case spec.Storage != nil:
+		// CDI completes the storage spec from the storage profile; a clone takes the size of its source.
+		errs = append(errs, validateClaimSpec(spec.Storage.AccessModes, spec.Storage.VolumeMode, spec.Storage.Resources, false, fldPath.Child("storage"))...)
+	default:
+		errs = append(errs, field.Required(fldPath, "pvc or storage must be set"))
+	}
+	return errs
+}
+
+// validateClaimSpec checks the access modes, volume mode and size of a claim. The size and access
+// modes are required when requireSize is set.
+func validateClaimSpec(modes []corev1.PersistentVolumeAccessMode, volumeMode *corev1.PersistentVolumeMode, resources corev1.VolumeResourceRequirements, requireSize bool, fldPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	if requireSize && len(modes) == 0 {
+		errs = append(errs, field.Required(fldPath.Child("accessModes"), "at least one access mode is required"))
+	}
+	for i, mode := range modes {
+		if !accessModes.Has(mode) {
+			errs = append(errs, field.NotSupported(fldPath.Child("accessModes").Index(i), mode, sets.List(accessModes)))
+		}
+	}
+	if volumeMode != nil && !volumeModes.Has(*volumeMode) {
+		errs = append(errs, field.NotSupported(fldPath.Child("volumeMode"), *volumeMode, sets.List(volumeModes)))
+	}
+	size, ok := resources.Requests[corev1.ResourceStorage]
+	switch {
+	case !ok && requireSize:
+		errs = append(errs, field.Required(fldPath.Child("resources", "requests", "storage"), ""))
+	case ok && size.Sign() <= 0:
+		errs = append(errs, field.Invalid(fldPath.Child("resources", "requests", "storage"), size.String(), "must be positive"))
+	}
+	return errs
+}
@@ -0,0 +1,330 @@
+package vmdk
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"vmx2vmi/pkg/failure"
+)
+
+// maxChainDepth bounds the parent walk so that a descriptor loop cannot hang it.
+const maxChainDepth = 255
+
+// ErrEncrypted is returned when opening a disk encrypted by VM encryption, whose grains
+// cannot be read without the key held by the key management server.
+var ErrEncrypted = errors.New("disk is encrypted")
+
+// allocationMapper is implemented by disks that know which ranges they store, so that
+// a snapshot delta can defer the other ranges to its parent.
+type allocationMapper interface {
+	// mapped reports whether the data at off is stored in the disk, and for how many
+	// bytes from off that answer holds.
+	mapped(off int64) (bool, int64, error)
+}
+
+// Layer is one disk of a snapshot chain.
+type Layer struct {
+	Path       string
+	Descriptor *Descriptor
+	disk       Disk
+}
+
+// Chain is a VMDK together with the parents of its snapshot deltas, flattened into a single
+// disk: each range is read from the youngest layer storing it. A disk without a parent is a
+// chain of one layer. It implements io.ReaderAt and is safe for concurrent use.
+type Chain struct {
+	// Layers lists the disks from the leaf (index 0) down to the base disk.
+	Layers []Layer
+}
+
+// OpenChain opens the VMDK at path and, following parentFileNameHint, every parent it
+// depends on, checking that each parent's CID matches the parentCID recorded by its child.
+// -flat.vmdk, -delta.vmdk and -sesparse.vmdk data files are opened through their descriptor.
+func OpenChain(path string) (*Chain, error) {
+	c, err := openChain(path)
+	return c, failure.Wrap(failure.Parse, err)
+}
+
+func openChain(path string) (*Chain, error) {
+	c := &Chain{}
+	for {
+		layer, err := openLayer(path)
+		if err != nil {
+			c.Close()
+			if len(c.Layers) == 0 {
+				return nil, err
+			}
+			child := c.Layers[len(c.Layers)-1]
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil, newChainError(child, path, "", err)
+			}
+			return nil, fmt.Errorf("failed to open parent of %s: %w", child.Path, err)
+		}
+		if len(c.Layers) > 0 {
+			child := c.Layers[len(c.Layers)-1]
+			if !strings.EqualFold(layer.Descriptor.CID, child.Descriptor.ParentCID) {
+				layer.disk.Close()
+				c.Close()
+				return nil, newChainError(child, layer.Path, layer.Descriptor.CID, nil)
+			}
+		}
+		c.Layers = append(c.Layers, layer)
+
+		desc := layer.Descriptor
+		if !desc.HasParent() {
+			return c, nil
+		}
+		if desc.ParentFileNameHint == "" {
+			c.Close()
+			return nil, newChainError(layer, "", "", nil)
+		}
+		if len(c.Layers) > maxChainDepth {
+			c.Close()
+			return nil, fmt.Errorf("snapshot chain of %s is deeper than %d disks", c.Layers[0].Path, maxChainDepth)
+		}
+		path = ResolvePath(filepath.Dir(layer.Path), desc.ParentFileNameHint)
+	}
+}
+
+// ChainError describes a broken link of a snapshot chain: a parent that is missing, or
+// whose CID no longer matches the parentCID recorded by its child.
+type ChainError struct {
+	// Child is the snapshot delta whose parent could not be used.
+	Child string
+	// ParentHint is the child's parentFileNameHint, Parent the path it resolved to.
+	ParentHint string
+	Parent     string
+	// ExpectedCID is the child's parentCID, FoundCID the CID of Parent when it could be read.
+	ExpectedCID string
+	FoundCID    string
+	// Candidates lists the other disks next to the child, those with the expected CID first.
+	Candidates []Candidate
+	Err        error
+}
+
+// Candidate is a disk descriptor found while diagnosing a broken chain.
+type Candidate struct {
+	Path string
+	CID  string
+}
+
+func (e *ChainError) Error() string {
+	var b strings.Builder
+	switch {
+	case e.ParentHint == "":
+		fmt.Fprintf(&b, "broken snapshot chain: %s has parent CID %s but no parentFileNameHint", e.Child, e.ExpectedCID)
+	case e.FoundCID == "":
+		fmt.Fprintf(&b, "broken snapshot chain: parent %s of %s (parentFileNameHint %q, expected CID %s) is missing",
+			e.Parent, e.Child, e.ParentHint, e.ExpectedCID)
+	default:
+		fmt.Fprintf(&b, "broken snapshot chain: %s expects parent CID %s but %s has CID %s, the parent was modified after the snapshot was taken",
+			e.Child, e.ExpectedCID, e.Parent, e.FoundCID)
+	}
+	if len(e.Candidates) == 0 {
+		b.WriteString("; no other disk found in its directory")
+		return b.String()
+	}
+	b.WriteString("; disks found in its directory:")
+	for i, c := range e.Candidates {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		fmt.Fprintf(&b, " %s (CID %s", c.Path, c.CID)
+		if strings.EqualFold(c.CID, e.ExpectedCID) {
+			b.WriteString(", matches")
+		}
+		b.WriteString(")")
+	}
+	return b.String()
+}
+
+func (e *ChainError) Unwrap() error { return e.Err }
+
+// newChainError diagnoses the link between child and its parent at parentPath.
+func newChainError(child Layer, parentPath, foundCID string, err error) *ChainError {
+	e := &ChainError{
+		Child:       child.Path,
+		ParentHint:  child.Descriptor.ParentFileNameHint,
+		Parent:      parentPath,
+		ExpectedCID: child.Descriptor.ParentCID,
+		FoundCID:    foundCID,
+		Err:         err,
+	}
+	e.Candidates = findCandidates(filepath.Dir(child.Path), []string{child.Path, parentPath}, e.ExpectedCID)
+	return e
+}
+
+// findCandidates lists the disk descriptors in dir other than the excluded paths, those whose
+// CID is cid first.
+// Data files without a descriptor (-flat.vmdk, split extents) are skipped.
+func findCandidates(dir string, exclude []string, cid string) []Candidate {
+	paths, _ := filepath.Glob(filepath.Join(dir, "*.vmdk"))
+	var matching, others []Candidate
+	for _, path := range paths {
+		if slices.ContainsFunc(exclude, func(p string) bool { return p != "" && filepath.Clean(p) == filepath.Clean(path) }) {
+			continue
+		}
+		text, isVMDK, err := ExtractVMDKDescriptor(path)
+		if err != nil || !isVMDK {
+			continue
+		}
+		desc, err := ParseDescriptor(text)
+		if err != nil {
+			continue
+		}
+		if strings.EqualFold(desc.CID, cid) {
+			matching = append(matching, Candidate{Path: path, CID: desc.CID})
+		} else {
+			others = append(others, Candidate{Path: path, CID: desc.CID})
+		}
+	}
+	return append(matching, others...)
+}
+
+// openLayer opens a single disk of a chain without looking at its parent.
+func openLayer(path string) (Layer, error) {
+	for _, suffix := range []string{"-flat.vmdk", "-delta.vmdk", "-sesparse.vmdk"} {
+		if descriptor, ok := strings.CutSuffix(path, suffix); ok {
+			if _, err := os.Stat(descriptor + ".vmdk"); err == nil {
+				path = descriptor + ".vmdk"
+			}
+		}
+	}
+	text, isVMDK, err := ExtractVMDKDescriptor(path)
+	if err != nil {
+		return Layer{}, err
+	}
+	if !isVMDK {
+		return Layer{}, fmt.Errorf("%s is not a VMDK", path)
+	}
+	desc, err := ParseDescriptor(text)
+	if err != nil {
+		return Layer{}, fmt.Errorf("failed to parse descriptor of %s: %w", path, err)
+	}
+
+	if desc.Encrypted {
+		return Layer{}, fmt.Errorf("%w: %s carries encryption.keySafe; decrypt the VM in vSphere or Workstation first, or transfer the disk through VDDK with vCenter credentials", ErrEncrypted, path)
+	}
+
+	var img Disk
+	switch desc.CreateType {
+	case "monolithicSparse", "streamOptimized":
+		img, err = OpenSparseExtent(path)
+	default:
+		img, err = OpenExtents(path)
+	}
+	if err != nil {
+		return Layer{}, err
+	}
+	return Layer{Path: path, Descriptor: desc, disk: img}, nil
+}
+
+// Size returns the virtual size of the leaf disk in bytes.
+func (c *Chain) Size() int64 {
+	return c.Layers[0].disk.Size()
+}
+
+// AllocatedBytes returns the space used by all layers of the chain.
+func (c *Chain) AllocatedBytes() (int64, error) {
+	var total int64
+	for _, l := range c.Layers {
+		r, ok := l.disk.(interface{ AllocatedBytes() (int64, error) })
+		if !ok {
+			total += l.disk.Size()
+			continue
+		}
+		n, err := r.AllocatedBytes()
+		if err != nil {
+			return total, fmt.Errorf("failed to measure %s: %w", l.Path, err)
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// Provisioning returns the provisioning of the base disk, which deltas do not change.
+func (c *Chain) Provisioning() string {
+	return c.Layers[len(c.Layers)-1].Descriptor.Provisioning()
+}
+
+// ReadAt implements io.ReaderAt over the flattened disk content.
+func (c *Chain) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	size := c.Size()
+	if off >= size {
+		return 0, io.EOF
+	}
+	n := min(int64(len(p)), size-off)
+	if err := c.readLayer(0, p[:n], off); err != nil {
+		return 0, err
+	}
+	if n < int64(len(p)) {
+		return int(n), io.EOF
+	}
+	return int(n), nil
+}
+
+// readLayer fills p with the content at off as seen from layer i.
+func (c *Chain) readLayer(i int, p []byte, off int64) error {
+	img := c.Layers[i].disk
+	if i == len(c.Layers)-1 {
+		return readPadded(img, p, off)
+	}
+	mapper, isMapper := img.(allocationMapper)
+	for len(p) > 0 {
+		// Ranges past the end of a layer read as zeros through readPadded.
+		stored, run := true, int64(len(p))
+		if isMapper && off < img.Size() {
+			var err error
+			if stored, run, err = mapper.mapped(off); err != nil {
+				return err
+			}
+		}
+		chunk := p[:min(int64(len(p)), run)]
+		var err error
+		if stored {
+			err = readPadded(img, chunk, off)
+		} else {
+			err = c.readLayer(i+1, chunk, off)
+		}
+		if err != nil {
+			return err
+		}
+		p = p[len(chunk):]
+		off += int64(len(chunk))
+	}
+	return nil
+}
+
+// readPadded reads p from img at off, reading zeros past the end of img.
+func readPadded(img Disk, p []byte, off int64) error {
+	n := 0
+	if off < img.Size() {
+		var err error
+		n, err = img.ReadAt(p[:min(int64(len(p)), img.Size()-off)], off)
+		if err != nil && err != io.EOF {
+			return err
+		}
+	}
+	clear(p[n:])
+	return nil
+}
+
+// Close closes every layer.
+func (c *Chain) Close() error {
+	var firstErr error
+	for _, l := range c.Layers {
+		if err := l.disk.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
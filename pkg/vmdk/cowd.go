@@ -0,0 +1,233 @@
+package vmdk
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"vmx2vmi/pkg/failure"
+)
+
+const (
+	// cowdMagic is "COWD" as stored at the start of a VMFSSPARSE extent.
+	cowdMagic   = "COWD"
+	cowdVersion = 1
+	// cowdGTEntries is the number of entries of a COWD grain table.
+	cowdGTEntries = 4096
+)
+
+// cowdHeader is the decoded COWD header. Offsets and sizes are in sectors.
+type cowdHeader struct {
+	CapacitySectors uint32
+	GrainSectors    uint32
+	GDOffset        uint32
+	GDEntries       uint32
+}
+
+func parseCOWDHeader(buf []byte) (cowdHeader, error) {
+	if len(buf) < 32 {
+		return cowdHeader{}, fmt.Errorf("COWD header too short (%d bytes)", len(buf))
+	}
+	if string(buf[0:4]) != cowdMagic {
+		return cowdHeader{}, fmt.Errorf("missing COWD magic")
+	}
+	le := binary.LittleEndian
+	if v := le.Uint32(buf[4:8]); v != cowdVersion {
+		return cowdHeader{}, failure.Errorf(failure.Unsupported, "unsupported COWD version %d", v)
+	}
+	h := cowdHeader{
+		CapacitySectors: le.Uint32(buf[12:16]),
+		GrainSectors:    le.Uint32(buf[16:20]),
+		GDOffset:        le.Uint32(buf[20:24]),
+		GDEntries:       le.Uint32(buf[24:28]),
+	}
+	if h.GrainSectors == 0 {
+		return h, fmt.Errorf("invalid COWD grain size 0")
+	}
+	return h, nil
+}
+
+// COWDExtent reads a COWD (VMFSSPARSE) extent, the delta format of snapshots taken on ESXi
+// before 6.5 and on VMFS5 disks smaller than 2 TB. Grains that are not allocated in the
+// extent read as zeros. It is safe for concurrent use.
+type COWDExtent struct {
+	file     *os.File
+	header   cowdHeader
+	fileSize int64
+	// gd holds the sector offset of every grain table, 0 for missing tables.
+	gd []uint32
+
+	mu      sync.Mutex
+	gtCache map[uint32][]uint32
+}
+
+// OpenCOWDExtent opens the -delta.vmdk data file of a vmfsSparse disk.
+func OpenCOWDExtent(path string) (*COWDExtent, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open COWD extent %s: %w", path, err)
+	}
+	c, err := newCOWDExtent(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to open COWD extent %s: %w", path, err)
+	}
+	return c, nil
+}
+
+func newCOWDExtent(file *os.File) (*COWDExtent, error) {
+	buf := make([]byte, sectorSize)
+	if _, err := file.ReadAt(buf, 0); err != nil {
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+	header, err := parseCOWDHeader(buf)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	grains := (uint64(header.CapacitySectors) + uint64(header.GrainSectors) - 1) / uint64(header.GrainSectors)
+	tables := (grains + cowdGTEntries - 1) / cowdGTEntries
+	if tables > uint64(header.GDEntries) {
+		return nil, fmt.Errorf("grain directory of %d entries cannot map %d grain tables", header.GDEntries, tables)
+	}
+	raw := make([]byte, tables*4)
+	if _, err := file.ReadAt(raw, int64(header.GDOffset)*sectorSize); err != nil {
+		return nil, fmt.Errorf("failed to read grain directory: %w", err)
+	}
+	c := &COWDExtent{
+		file:     file,
+		header:   header,
+		fileSize: info.Size(),
+		gd:       make([]uint32, tables),
+		gtCache:  make(map[uint32][]uint32),
+	}
+	for i := range c.gd {
+		c.gd[i] = binary.LittleEndian.Uint32(raw[i*4:])
+	}
+	return c, nil
+}
+
+// grainSector returns the sector holding grainIndex, 0 when it is not allocated. Caller holds c.mu.
+func (c *COWDExtent) grainSector(grainIndex uint64) (uint32, error) {
+	gdIndex := grainIndex / cowdGTEntries
+	if gdIndex >= uint64(len(c.gd)) || c.gd[gdIndex] == 0 {
+		return 0, nil
+	}
+	gtSector := c.gd[gdIndex]
+	gt, ok := c.gtCache[gtSector]
+	if !ok {
+		raw := make([]byte, cowdGTEntries*4)
+		if _, err := c.file.ReadAt(raw, int64(gtSector)*sectorSize); err != nil {
+			return 0, fmt.Errorf("failed to read grain table %d: %w", gdIndex, err)
+		}
+		gt = make([]uint32, cowdGTEntries)
+		for i := range gt {
+			gt[i] = binary.LittleEndian.Uint32(raw[i*4:])
+		}
+		c.gtCache[gtSector] = gt
+	}
+	return gt[grainIndex%cowdGTEntries], nil
+}
+
+// mapped implements allocationMapper.
+func (c *COWDExtent) mapped(off int64) (bool, int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	grainBytes := c.GrainSize()
+	sector, err := c.grainSector(uint64(off / grainBytes))
+	if err != nil {
+		return false, 0, err
+	}
+	return sector != 0, grainBytes - off%grainBytes, nil
+}
+
+// GrainSize returns the size of a grain in bytes.
+func (c *COWDExtent) GrainSize() int64 {
+	return int64(c.header.GrainSectors) * sectorSize
+}
+
+// AllocatedBytes returns the amount of virtual disk data actually stored in the extent.
+func (c *COWDExtent) AllocatedBytes() (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var grains int64
+	totalGrains := (uint64(c.header.CapacitySectors) + uint64(c.header.GrainSectors) - 1) / uint64(c.header.GrainSectors)
+	for grainIndex := uint64(0); grainIndex < totalGrains; grainIndex++ {
+		if c.gd[grainIndex/cowdGTEntries] == 0 {
+			grainIndex += cowdGTEntries - 1 - grainIndex%cowdGTEntries
+			continue
+		}
+		sector, err := c.grainSector(grainIndex)
+		if err != nil {
+			return 0, err
+		}
+		if sector != 0 {
+			grains++
+		}
+	}
+	return min(grains*c.GrainSize(), c.Size()), nil
+}
+
+// Size returns the virtual size of the extent in bytes.
+func (c *COWDExtent) Size() int64 {
+	return int64(c.header.CapacitySectors) * sectorSize
+}
+
+// ReadAt implements io.ReaderAt over the virtual disk content.
+func (c *COWDExtent) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	size := c.Size()
+	if off >= size {
+		return 0, io.EOF
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	grainBytes := c.GrainSize()
+	n := 0
+	for n < len(p) && off < size {
+		grainIndex := uint64(off / grainBytes)
+		inGrain := off % grainBytes
+		chunk := min(int64(len(p)-n), grainBytes-inGrain, size-off)
+		dst := p[n : n+int(chunk)]
+
+		sector, err := c.grainSector(grainIndex)
+		if err != nil {
+			return n, err
+		}
+		if sector != 0 {
+			offset := int64(sector) * sectorSize
+			if offset+inGrain+chunk > c.fileSize {
+				return n, fmt.Errorf("grain %d points past the end of the file (offset %d)", grainIndex, offset)
+			}
+			if _, err := c.file.ReadAt(dst, offset+inGrain); err != nil && !errors.Is(err, io.EOF) {
+				return n, fmt.Errorf("failed to read grain %d: %w", grainIndex, err)
+			}
+		} else {
+			clear(dst)
+		}
+		n += int(chunk)
+		off += chunk
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Close closes the underlying file.
+func (c *COWDExtent) Close() error {
+	return c.file.Close()
+}
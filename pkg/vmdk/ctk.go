@@ -0,0 +1,175 @@
+package vmdk
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"vmx2vmi/pkg/failure"
+)
+
+const (
+	// ctkMagic identifies a change tracking file ("CTRK").
+	ctkMagic = 0x4b525443
+	// ctkVersion is the only change tracking file version understood.
+	ctkVersion = 1
+	// ctkHeaderSize is the size of the header preceding the per-block sequence numbers.
+	ctkHeaderSize = 512
+	// ctkStateClean marks a tracking file closed cleanly; any other state means changes may be missing.
+	ctkStateClean = 0
+)
+
+// ErrChangeTrackingReset is returned when a change ID was issued by a different tracking
+// epoch (CBT was disabled and re-enabled, or the disk was restored), so a full copy is needed.
+var ErrChangeTrackingReset = errors.New("change tracking was reset since the previous sync")
+
+// Range is a byte range of a virtual disk.
+type Range struct {
+	Offset int64
+	Length int64
+}
+
+// ChangeTracking is a parsed -ctk.vmdk Changed Block Tracking file. The disk is tracked in
+// fixed-size blocks, each recording the change sequence number of its last write; together
+// with the tracking UUID, the current sequence forms the change ID handed out after a sync.
+type ChangeTracking struct {
+	UUID      [16]byte
+	Sequence  uint64 // Sequence number of the most recent change
+	BlockSize int64  // Size of a tracked block in bytes
+	DiskSize  int64  // Size of the tracked disk in bytes
+	blocks    []uint64
+}
+
+// OpenChangeTracking reads the change tracking file at path.
+func OpenChangeTracking(path string) (*ChangeTracking, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read change tracking file %s: %w", path, err)
+	}
+	ct, err := parseChangeTracking(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid change tracking file %s: %w", path, err)
+	}
+	return ct, nil
+}
+
+func parseChangeTracking(data []byte) (*ChangeTracking, error) {
+	if len(data) < ctkHeaderSize {
+		return nil, fmt.Errorf("file too small (%d bytes)", len(data))
+	}
+	le := binary.LittleEndian
+	if le.Uint32(data[0:4]) != ctkMagic {
+		return nil, fmt.Errorf("missing change tracking magic")
+	}
+	if v := le.Uint32(data[4:8]); v != ctkVersion {
+		return nil, failure.Errorf(failure.Unsupported, "unsupported version %d", v)
+	}
+	if state := le.Uint32(data[8:12]); state != ctkStateClean {
+		return nil, fmt.Errorf("tracking state %d is not clean, changes may have been lost; take a snapshot so the file is flushed, or do a full copy", state)
+	}
+	blockSectors := le.Uint32(data[12:16])
+	if blockSectors == 0 {
+		return nil, fmt.Errorf("invalid block size of 0 sectors")
+	}
+	ct := &ChangeTracking{
+		BlockSize: int64(blockSectors) * sectorSize,
+		DiskSize:  int64(le.Uint64(data[24:32])) * sectorSize,
+		Sequence:  le.Uint64(data[32:40]),
+	}
+	copy(ct.UUID[:], data[40:56])
+
+	numBlocks := le.Uint64(data[16:24])
+	if want := uint64((ct.DiskSize + ct.BlockSize - 1) / ct.BlockSize); numBlocks != want {
+		return nil, fmt.Errorf("tracks %d blocks, a %d byte disk needs %d", numBlocks, ct.DiskSize, want)
+	}
+	if uint64(len(data)-ctkHeaderSize) < numBlocks*8 {
+		return nil, fmt.Errorf("truncated block table (%d of %d blocks)", (len(data)-ctkHeaderSize)/8, numBlocks)
+	}
+	ct.blocks = make([]uint64, numBlocks)
+	for i := range ct.blocks {
+		ct.blocks[i] = le.Uint64(data[ctkHeaderSize+i*8:])
+	}
+	return ct, nil
+}
+
+// ChangeID returns the change ID identifying the current state of the disk, in the vSphere
+// form "52 1a ... 3c 4d-5e 6f ... 7a 8b/<sequence>".
+func (ct *ChangeTracking) ChangeID() string {
+	return fmt.Sprintf("%s-%s/%d", spacedHex(ct.UUID[:8]), spacedHex(ct.UUID[8:]), ct.Sequence)
+}
+
+func spacedHex(b []byte) string {
+	parts := make([]string, len(b))
+	for i := range b {
+		parts[i] = hex.EncodeToString(b[i : i+1])
+	}
+	return strings.Join(parts, " ")
+}
+
+// parseChangeID splits a change ID returned by ChangeID into its UUID and sequence number.
+func parseChangeID(changeID string) ([16]byte, uint64, error) {
+	var uuid [16]byte
+	id, seq, ok := strings.Cut(strings.TrimSpace(changeID), "/")
+	if !ok {
+		return uuid, 0, fmt.Errorf("change ID %q has no /<sequence> suffix", changeID)
+	}
+	sequence, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil {
+		return uuid, 0, fmt.Errorf("change ID %q has an invalid sequence: %w", changeID, err)
+	}
+	raw, err := hex.DecodeString(strings.NewReplacer(" ", "", "-", "").Replace(id))
+	if err != nil || len(raw) != len(uuid) {
+		return uuid, 0, fmt.Errorf("change ID %q has an invalid UUID", changeID)
+	}
+	copy(uuid[:], raw)
+	return uuid, sequence, nil
+}
+
+// ChangedRanges returns the ranges written since the sync that returned changeID, merging
+// adjacent blocks. It returns ErrChangeTrackingReset when changeID belongs to another epoch.
+func (ct *ChangeTracking) ChangedRanges(changeID string) ([]Range, error) {
+	uuid, since, err := parseChangeID(changeID)
+	if err != nil {
+		return nil, err
+	}
+	if uuid != ct.UUID || since > ct.Sequence {
+		return nil, ErrChangeTrackingReset
+	}
+
+	var ranges []Range
+	for i, seq := range ct.blocks {
+		if seq <= since {
+			continue
+		}
+		off := int64(i) * ct.BlockSize
+		length := min(ct.BlockSize, ct.DiskSize-off)
+		if n := len(ranges); n > 0 && ranges[n-1].Offset+ranges[n-1].Length == off {
+			ranges[n-1].Length += length
+			continue
+		}
+		ranges = append(ranges, Range{Offset: off, Length: length})
+	}
+	return ranges, nil
+}
+
+// ChangeTracking opens the change tracking file of the leaf disk, or returns nil when
+// Changed Block Tracking is not enabled on it.
+func (c *Chain) ChangeTracking() (*ChangeTracking, error) {
+	leaf := c.Layers[0]
+	if leaf.Descriptor.ChangeTrackPath == "" {
+		return nil, nil
+	}
+	ct, err := OpenChangeTracking(ResolvePath(filepath.Dir(leaf.Path), leaf.Descriptor.ChangeTrackPath))
+	if err != nil {
+		return nil, err
+	}
+	if ct.DiskSize != c.Size() {
+		return nil, fmt.Errorf("change tracking file of %s tracks %d bytes but the disk is %d bytes", leaf.Path, ct.DiskSize, c.Size())
+	}
+	return ct, nil
+}
@@ -0,0 +1,221 @@
+package vmdk
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"vmx2vmi/pkg/failure"
+)
+
+// Extent is a single line of the "# Extent description" section, e.g.
+// RW 20971520 SPARSE "myvm_disk.vmdk"
+type Extent struct {
+	Access     string // RW, RDONLY or NOACCESS
+	SizeSector uint64 // Extent size in 512-byte sectors
+	Type       string // FLAT, SPARSE, ZERO, VMFS, VMFSSPARSE, VMFSRDM, VMFSRAW, SESPARSE
+	FileName   string // Extent file, relative to the descriptor
+	Offset     uint64 // Offset in sectors into FileName (FLAT/VMFS extents only)
+}
+
+// Descriptor is the parsed form of a VMDK text descriptor.
+type Descriptor struct {
+	Version    int
+	Encoding   string
+	CID        string
+	ParentCID  string
+	CreateType string
+	// ParentFileNameHint points to the parent disk of a snapshot delta, if any.
+	ParentFileNameHint string
+	// ChangeTrackPath names the -ctk.vmdk file of disks with Changed Block Tracking enabled.
+	ChangeTrackPath string
+	// Encrypted reports whether the disk is encrypted (encryption.keySafe/encryption.data).
+	Encrypted bool
+	Extents   []Extent
+	// DDB holds the disk database entries (ddb.*) keyed by their full name.
+	DDB map[string]string
+}
+
+// ParseDescriptor parses the text of a VMDK descriptor as returned by ExtractVMDKDescriptor.
+func ParseDescriptor(text string) (*Descriptor, error) {
+	desc, err := parseDescriptor(text)
+	return desc, failure.Wrap(failure.Parse, err)
+}
+
+func parseDescriptor(text string) (*Descriptor, error) {
+	desc := &Descriptor{DDB: make(map[string]string)}
+
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		// Embedded descriptors are padded with NUL bytes up to the sector boundary.
+		line := strings.TrimSpace(strings.TrimRight(scanner.Text(), "\x00"))
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if isExtentLine(line) {
+			extent, err := parseExtentLine(line)
+			if err != nil {
+				return nil, fmt.Errorf("descriptor line %d: %w", lineNum, err)
+			}
+			desc.Extents = append(desc.Extents, extent)
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		key = strings.TrimSpace(key)
+		value = strings.Trim(strings.TrimSpace(value), "\"")
+
+		switch {
+		case strings.HasPrefix(key, "ddb."):
+			desc.DDB[key] = value
+		case key == "version":
+			v, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("descriptor line %d: invalid version '%s': %w", lineNum, value, err)
+			}
+			desc.Version = v
+		case key == "encoding":
+			desc.Encoding = value
+		case key == "CID":
+			desc.CID = value
+		case key == "parentCID":
+			desc.ParentCID = value
+		case key == "createType":
+			desc.CreateType = value
+		case key == "parentFileNameHint":
+			desc.ParentFileNameHint = value
+		case key == "changeTrackPath":
+			desc.ChangeTrackPath = value
+		case key == "encryption.keySafe" || key == "encryption.data":
+			desc.Encrypted = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan descriptor: %w", err)
+	}
+	if desc.CreateType == "" {
+		return nil, fmt.Errorf("descriptor has no createType")
+	}
+	return desc, nil
+}
+
+// CapacitySectors returns the virtual disk size in sectors, i.e. the sum of all extents.
+func (d *Descriptor) CapacitySectors() uint64 {
+	var total uint64
+	for _, e := range d.Extents {
+		total += e.SizeSector
+	}
+	return total
+}
+
+// CapacityBytes returns the virtual disk size in bytes.
+func (d *Descriptor) CapacityBytes() uint64 {
+	return d.CapacitySectors() * sectorSize
+}
+
+// HasParent reports whether the descriptor is a snapshot delta linked to a parent disk.
+func (d *Descriptor) HasParent() bool {
+	return d.ParentCID != "" && !strings.EqualFold(d.ParentCID, "ffffffff")
+}
+
+// RawDeviceMapping reports whether the descriptor describes a raw device mapping
+// and, if so, whether it is in physical ("vmfsPassthroughRawDeviceMap") compatibility mode.
+func (d *Descriptor) RawDeviceMapping() (isRDM bool, physical bool) {
+	switch d.CreateType {
+	case "vmfsPassthroughRawDeviceMap":
+		return true, true
+	case "vmfsRawDeviceMap":
+		return true, false
+	}
+	for _, e := range d.Extents {
+		if e.Type == "VMFSRDM" || e.Type == "VMFSRAW" {
+			return true, false
+		}
+	}
+	return false, false
+}
+
+// Provisioning returns how the disk's space is allocated: "thin" for sparse and thin
+// provisioned disks, "thick" for preallocated flat disks, "eagerzeroedthick" for flat disks
+// zeroed at creation, "rdm" for raw device mappings.
+func (d *Descriptor) Provisioning() string {
+	if isRDM, _ := d.RawDeviceMapping(); isRDM {
+		return "rdm"
+	}
+	if d.DDB["ddb.thinProvisioned"] == "1" {
+		return "thin"
+	}
+	switch d.CreateType {
+	case "monolithicSparse", "streamOptimized", "twoGbMaxExtentSparse", "vmfsSparse", "seSparse":
+		return "thin"
+	case "vmfsThin":
+		return "thin"
+	case "vmfsEagerZeroedThick":
+		return "eagerzeroedthick"
+	case "monolithicFlat", "twoGbMaxExtentFlat", "vmfs", "vmfsPreallocated":
+		return "thick"
+	}
+	return ""
+}
+
+// UUID returns ddb.uuid as 32 lower-case hex digits, or an empty string when the descriptor has none.
+// vSphere stores it as space separated bytes, e.g. "60 00 C2 9a 3b 7f ...".
+func (d *Descriptor) UUID() string {
+	raw := d.DDB["ddb.uuid"]
+	if raw == "" {
+		return ""
+	}
+	hex := strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(raw))
+	if len(hex) != 32 || strings.Trim(hex, "0123456789abcdef") != "" {
+		return ""
+	}
+	return hex
+}
+
+func isExtentLine(line string) bool {
+	for _, access := range []string{"RW ", "RDONLY ", "NOACCESS "} {
+		if strings.HasPrefix(line, access) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseExtentLine parses: ACCESS SIZE TYPE ["FILENAME" [OFFSET]]
+func parseExtentLine(line string) (Extent, error) {
+	var extent Extent
+
+	head, quoted, hasFile := strings.Cut(line, "\"")
+	fields := strings.Fields(head)
+	if len(fields) != 3 {
+		return extent, fmt.Errorf("malformed extent line '%s'", line)
+	}
+	size, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return extent, fmt.Errorf("invalid extent size in '%s': %w", line, err)
+	}
+	extent.Access = fields[0]
+	extent.SizeSector = size
+	extent.Type = fields[2]
+
+	if hasFile {
+		fileName, tail, ok := strings.Cut(quoted, "\"")
+		if !ok {
+			return extent, fmt.Errorf("unterminated file name in extent line '%s'", line)
+		}
+		extent.FileName = fileName
+		if tail = strings.TrimSpace(tail); tail != "" {
+			offset, err := strconv.ParseUint(tail, 10, 64)
+			if err != nil {
+				return extent, fmt.Errorf("invalid extent offset in '%s': %w", line, err)
+			}
+			extent.Offset = offset
+		}
+	}
+	return extent, nil
+}
@@ -0,0 +1,82 @@
+package vmdk
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"sync"
+)
+
+// DigestReaderAt computes the sha256 of the disk content read through it. Reads must be
+// sequential from offset 0, which is how WriteRaw, WriteQcow2 and uploads consume a disk.
+type DigestReaderAt struct {
+	r io.ReaderAt
+
+	mu     sync.Mutex
+	h      hash.Hash
+	next   int64
+	broken bool
+}
+
+// NewDigestReaderAt wraps r.
+func NewDigestReaderAt(r io.ReaderAt) *DigestReaderAt {
+	return &DigestReaderAt{r: r, h: sha256.New()}
+}
+
+// ResumeDigestReaderAt wraps r to continue a digest saved by State after offset bytes.
+func ResumeDigestReaderAt(r io.ReaderAt, state []byte, offset int64) (*DigestReaderAt, error) {
+	h := sha256.New()
+	if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err != nil {
+		return nil, fmt.Errorf("invalid digest state: %w", err)
+	}
+	return &DigestReaderAt{r: r, h: h, next: offset}, nil
+}
+
+// State returns the serialized digest of the data read so far and its length, from which
+// ResumeDigestReaderAt continues.
+func (d *DigestReaderAt) State() ([]byte, int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.broken {
+		return nil, 0, fmt.Errorf("disk was not read sequentially, digest unavailable")
+	}
+	state, err := d.h.(encoding.BinaryMarshaler).MarshalBinary()
+	return state, d.next, err
+}
+
+// ReadAt implements io.ReaderAt.
+func (d *DigestReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := d.r.ReadAt(p, off)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if off != d.next {
+		d.broken = true
+	} else {
+		d.h.Write(p[:n])
+		d.next += int64(n)
+	}
+	return n, err
+}
+
+// Sum returns the hex encoded sha256 of the first size bytes, which must all have been read in order.
+func (d *DigestReaderAt) Sum(size int64) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.broken || d.next != size {
+		return "", fmt.Errorf("disk was not read sequentially, digest unavailable")
+	}
+	return hex.EncodeToString(d.h.Sum(nil)), nil
+}
+
+// SHA256 reads the first size bytes of r and returns their hex encoded sha256, e.g. to check
+// a written raw image or block device against the digest of its source.
+func SHA256(r io.ReaderAt, size int64) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(r, 0, size)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,31 @@
+package vmdk
+
+import "io"
+
+// Disk is the virtual content of a VMDK, independent of how it is stored on disk.
+// Reads past Size return io.EOF.
+type Disk interface {
+	io.ReaderAt
+	io.Closer
+	// Size returns the virtual size of the disk in bytes.
+	Size() int64
+}
+
+// Open opens any supported VMDK variant as a Disk: descriptor-only files with flat, vmfs,
+// SESparse, COWD or split extents, monolithic sparse and streamOptimized files, and snapshot
+// deltas, which are flattened onto their parents. Use OpenChain to inspect the layers.
+func Open(path string) (Disk, error) {
+	chain, err := OpenChain(path)
+	if err != nil {
+		return nil, err
+	}
+	return chain, nil
+}
+
+var (
+	_ Disk = (*Chain)(nil)
+	_ Disk = (*ExtentDisk)(nil)
+	_ Disk = (*SparseExtent)(nil)
+	_ Disk = (*SESparseExtent)(nil)
+	_ Disk = (*COWDExtent)(nil)
+)
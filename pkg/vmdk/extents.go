@@ -0,0 +1,223 @@
+package vmdk
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"vmx2vmi/pkg/failure"
+)
+
+// extentRange is one opened extent placed at its position in the virtual disk.
+type extentRange struct {
+	start  int64 // Offset of the extent in the virtual disk
+	size   int64
+	reader io.ReaderAt // nil for ZERO extents
+	closer io.Closer
+}
+
+// ExtentDisk presents the extents listed by a descriptor file as one contiguous disk,
+// e.g. the -s001.vmdk ... -sNNN.vmdk files of a twoGbMaxExtentSparse disk or the
+// -f001.vmdk files of a twoGbMaxExtentFlat disk, or the -flat.vmdk file of a
+// monolithicFlat or vmfs disk.
+type ExtentDisk struct {
+	Descriptor *Descriptor
+	extents    []extentRange
+	size       int64
+}
+
+// OpenExtents opens every extent referenced by the descriptor-only VMDK at descriptorPath.
+// Extent file names are resolved relative to the descriptor's directory.
+func OpenExtents(descriptorPath string) (*ExtentDisk, error) {
+	text, _, err := ExtractVMDKDescriptor(descriptorPath)
+	if err != nil {
+		return nil, err
+	}
+	desc, err := ParseDescriptor(text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse descriptor %s: %w", descriptorPath, err)
+	}
+	if len(desc.Extents) == 0 {
+		return nil, fmt.Errorf("descriptor %s lists no extents", descriptorPath)
+	}
+
+	disk := &ExtentDisk{Descriptor: desc}
+	dir := filepath.Dir(descriptorPath)
+	for i, e := range desc.Extents {
+		r, err := openExtent(dir, e)
+		if err != nil {
+			disk.Close()
+			return nil, fmt.Errorf("extent %d of %s: %w", i+1, descriptorPath, err)
+		}
+		r.start = disk.size
+		disk.extents = append(disk.extents, r)
+		disk.size += r.size
+	}
+	return disk, nil
+}
+
+// openExtent opens a single extent according to its type.
+func openExtent(dir string, e Extent) (extentRange, error) {
+	size := int64(e.SizeSector) * sectorSize
+	if e.Type == "ZERO" {
+		return extentRange{size: size}, nil
+	}
+
+	path := ResolvePath(dir, e.FileName)
+
+	switch e.Type {
+	case "FLAT", "VMFS":
+		f, err := os.Open(path)
+		if err != nil {
+			return extentRange{}, fmt.Errorf("failed to open flat extent: %w", err)
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return extentRange{}, err
+		}
+		offset := int64(e.Offset) * sectorSize
+		if info.Size() < offset+size {
+			f.Close()
+			return extentRange{}, fmt.Errorf("flat extent %s is %d bytes, expected at least %d", path, info.Size(), offset+size)
+		}
+		return extentRange{size: size, reader: io.NewSectionReader(f, offset, size), closer: f}, nil
+	case "SPARSE":
+		s, err := OpenSparseExtent(path)
+		if err != nil {
+			return extentRange{}, err
+		}
+		if s.Size() != size {
+			s.Close()
+			return extentRange{}, fmt.Errorf("sparse extent %s holds %d bytes, descriptor expects %d", path, s.Size(), size)
+		}
+		return extentRange{size: size, reader: s, closer: s}, nil
+	case "SESPARSE":
+		s, err := OpenSESparseExtent(path)
+		if err != nil {
+			return extentRange{}, err
+		}
+		if s.Size() != size {
+			s.Close()
+			return extentRange{}, fmt.Errorf("SESparse extent %s holds %d bytes, descriptor expects %d", path, s.Size(), size)
+		}
+		return extentRange{size: size, reader: s, closer: s}, nil
+	case "VMFSSPARSE":
+		c, err := OpenCOWDExtent(path)
+		if err != nil {
+			return extentRange{}, err
+		}
+		if c.Size() != size {
+			c.Close()
+			return extentRange{}, fmt.Errorf("COWD extent %s holds %d bytes, descriptor expects %d", path, c.Size(), size)
+		}
+		return extentRange{size: size, reader: c, closer: c}, nil
+	case "VMFSRAW", "VMFSRDM":
+		return extentRange{}, fmt.Errorf("extent %s is a raw device mapping, map the LUN with -rdm-map instead of converting it", e.FileName)
+	}
+	return extentRange{}, failure.Errorf(failure.Unsupported, "unsupported extent type %s (%s)", e.Type, e.FileName)
+}
+
+// ResolvePath resolves a disk or extent file name as referenced from dir. Relative names
+// are joined to dir. Absolute datastore paths (e.g. /vmfs/volumes/datastore1/vm/vm-flat.vmdk)
+// are used when mounted, otherwise the file is looked up next to the referencing file so
+// that a local copy of the VM directory can be converted.
+func ResolvePath(dir, name string) string {
+	if !filepath.IsAbs(name) {
+		return filepath.Join(dir, name)
+	}
+	if _, err := os.Stat(name); err == nil {
+		return name
+	}
+	local := filepath.Join(dir, filepath.Base(name))
+	if _, err := os.Stat(local); err == nil {
+		return local
+	}
+	return name
+}
+
+// Size returns the virtual size of the disk in bytes.
+func (d *ExtentDisk) Size() int64 {
+	return d.size
+}
+
+// ReadAt implements io.ReaderAt across extent boundaries.
+func (d *ExtentDisk) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	n := 0
+	for _, e := range d.extents {
+		if n == len(p) {
+			break
+		}
+		if off >= e.start+e.size {
+			continue
+		}
+		inExtent := off - e.start
+		chunk := p[n:min(len(p), n+int(e.size-inExtent))]
+		if e.reader == nil {
+			clear(chunk)
+		} else if _, err := e.reader.ReadAt(chunk, inExtent); err != nil && err != io.EOF {
+			return n, err
+		}
+		n += len(chunk)
+		off += int64(len(chunk))
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// AllocatedBytes returns the space used by the extents: the allocated grains of sparse
+// extents and the full size of flat extents.
+func (d *ExtentDisk) AllocatedBytes() (int64, error) {
+	var total int64
+	for _, e := range d.extents {
+		switch r := e.reader.(type) {
+		case nil:
+		case interface{ AllocatedBytes() (int64, error) }:
+			n, err := r.AllocatedBytes()
+			if err != nil {
+				return total, err
+			}
+			total += n
+		default:
+			total += e.size
+		}
+	}
+	return total, nil
+}
+
+// mapped implements allocationMapper by asking the sparse extent holding off. Flat and ZERO
+// extents store their whole range.
+func (d *ExtentDisk) mapped(off int64) (bool, int64, error) {
+	for _, e := range d.extents {
+		if off >= e.start+e.size {
+			continue
+		}
+		end := e.start + e.size - off
+		mapper, ok := e.reader.(allocationMapper)
+		if !ok {
+			return true, end, nil
+		}
+		stored, run, err := mapper.mapped(off - e.start)
+		return stored, min(run, end), err
+	}
+	return false, 0, fmt.Errorf("offset %d is past the end of the disk", off)
+}
+
+// Close closes every extent file.
+func (d *ExtentDisk) Close() error {
+	var firstErr error
+	for _, e := range d.extents {
+		if e.closer != nil {
+			if err := e.closer.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
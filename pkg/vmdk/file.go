@@ -0,0 +1,69 @@
+package vmdk
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"vmx2vmi/pkg/ova"
+)
+
+// file is a VMDK file as read by the descriptor and sparse extent readers: a file on disk, or a
+// member of an OVA archive read in place.
+type file interface {
+	io.ReaderAt
+	io.ReadSeeker
+	io.Closer
+	// Size returns the size of the file in bytes.
+	Size() int64
+}
+
+type osFile struct {
+	*os.File
+	size int64
+}
+
+func (f osFile) Size() int64 { return f.size }
+
+// openFile opens name, or the member of an OVA archive when name has the form
+// <archive>.ova/<member>. An OVA itself is rejected with the paths of its disks.
+func openFile(name string) (file, error) {
+	if _, _, ok := ova.SplitPath(name); ok {
+		return ova.OpenMember(name)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if ova.IsArchive(name) && info.Mode().IsRegular() {
+		f.Close()
+		return nil, archiveError(name)
+	}
+	return osFile{File: f, size: info.Size()}, nil
+}
+
+// archiveError tells how to address the disks of the OVA at name.
+func archiveError(name string) error {
+	archive, err := ova.Open(name)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+	var disks []string
+	for _, member := range archive.Names() {
+		if strings.EqualFold(path.Ext(member), ".vmdk") {
+			disks = append(disks, name+"/"+member)
+		}
+	}
+	if len(disks) == 0 {
+		return fmt.Errorf("%s is an OVA archive without VMDK disks", name)
+	}
+	return fmt.Errorf("%s is an OVA archive; pass one of its disks: %s", name, strings.Join(disks, ", "))
+}
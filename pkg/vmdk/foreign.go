@@ -0,0 +1,75 @@
+package vmdk
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"vmx2vmi/pkg/failure"
+)
+
+// ForeignFormatError is returned for disk images that are recognized but are not VMDKs,
+// with advice on how to bring them to KubeVirt.
+type ForeignFormatError struct {
+	Path   string
+	Format string // e.g. "qcow2 image", "VHDX image", "raw disk image"
+	Advice string
+}
+
+func (e *ForeignFormatError) Error() string {
+	return fmt.Sprintf("%s: %s detected instead of a VMDK, %s", e.Path, e.Format, e.Advice)
+}
+
+// Kind classifies foreign images as unsupported disks.
+func (e *ForeignFormatError) Kind() failure.Kind {
+	return failure.Unsupported
+}
+
+// foreignFormat identifies the non-VMDK image format of file from its magic numbers,
+// returning nil when it is not recognized.
+func foreignFormat(file file, path string) *ForeignFormatError {
+	head := make([]byte, 1024)
+	n, _ := file.ReadAt(head, 0)
+	head = head[:n]
+	foreign := func(format, advice string) *ForeignFormatError {
+		return &ForeignFormatError{Path: path, Format: format, Advice: advice}
+	}
+
+	switch {
+	case bytes.HasPrefix(head, []byte("QFI\xfb")):
+		return foreign("qcow2 image", "KubeVirt boots qcow2 as is, upload it with virtctl image-upload or import it with a CDI DataVolume")
+	case bytes.HasPrefix(head, []byte("vhdxfile")):
+		return foreign("VHDX image", "convert it with qemu-img convert -f vhdx -O raw, then upload the raw image")
+	case bytes.HasPrefix(head, []byte("conectix")) || hasVHDFooter(file):
+		return foreign("VHD image", "convert it with qemu-img convert -f vpc -O raw, then upload the raw image")
+	case bytes.HasPrefix(head, []byte("<<< ")) && bytes.Contains(head[:min(len(head), 64)], []byte("VirtualBox Disk Image")):
+		return foreign("VirtualBox VDI image", "convert it with qemu-img convert -f vdi -O raw, then upload the raw image")
+	case bytes.HasPrefix(head, []byte(cowdMagic)):
+		return foreign("COWD (vmfsSparse) VMDK data file", "pass its descriptor (the file name without -delta) instead")
+	case len(head) >= 8 && bytes.Equal(head[:8], []byte{0xbe, 0xba, 0xfe, 0xca, 0, 0, 0, 0}):
+		return foreign("SESparse VMDK data file", "pass its descriptor (the file name without -sesparse) instead")
+	case len(head) >= 262 && string(head[257:262]) == "ustar":
+		return foreign("tar archive", "if it is an OVA, name it .ova and pass it to -vmx, or one of its disks as <archive>.ova/<disk>.vmdk")
+	case len(head) >= 520 && string(head[512:520]) == "EFI PART",
+		len(head) >= 512 && head[510] == 0x55 && head[511] == 0xaa:
+		return foreign("raw disk image", "raw images need no conversion, upload it with virtctl image-upload; for a -flat.vmdk pass its descriptor instead")
+	}
+	iso := make([]byte, 5)
+	if _, err := file.ReadAt(iso, 0x8001); err == nil && string(iso) == "CD001" {
+		return foreign("ISO 9660 image", "attach it as a CD-ROM, e.g. with a CDI DataVolume and a cdrom disk in the VirtualMachine")
+	}
+	return nil
+}
+
+// hasVHDFooter reports whether file ends with the footer of a fixed-size VHD.
+func hasVHDFooter(file file) bool {
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil || size < 512 {
+		return false
+	}
+	cookie := make([]byte, 8)
+	if _, err := file.ReadAt(cookie, size-512); err != nil {
+		return false
+	}
+	return string(cookie) == "conectix"
+}
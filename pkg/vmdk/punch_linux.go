@@ -0,0 +1,18 @@
+//go:build linux
+
+package vmdk
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	fallocFlKeepSize  = 0x01
+	fallocFlPunchHole = 0x02
+)
+
+// punchHole deallocates the given range of f without changing its size.
+func punchHole(f *os.File, off, length int64) error {
+	return syscall.Fallocate(int(f.Fd()), fallocFlKeepSize|fallocFlPunchHole, off, length)
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package vmdk
+
+import (
+	"errors"
+	"os"
+)
+
+// punchHole is not supported on this platform; callers fall back to writing zeros.
+func punchHole(f *os.File, off, length int64) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,346 @@
+package vmdk
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	// qcow2Magic is "QFI\xfb".
+	qcow2Magic = 0x514649fb
+	// qcow2HeaderLength is the size of a version 3 header without extensions.
+	qcow2HeaderLength = 104
+	// qcow2RefcountOrder selects 16-bit refcounts, the qemu-img default.
+	qcow2RefcountOrder = 4
+	// qcow2Copied marks L1/L2 entries whose cluster has a refcount of exactly one.
+	qcow2Copied = 1 << 63
+	// qcow2Compressed marks L2 entries pointing at compressed data.
+	qcow2Compressed = 1 << 62
+	// qcow2DefaultClusterSize is the qemu-img default cluster size.
+	qcow2DefaultClusterSize = 64 * 1024
+	// qcow2DeflateWindow is the window size qemu uses to inflate compressed clusters (windowBits -12).
+	qcow2DeflateWindow = 4096
+)
+
+// Qcow2Options controls the qcow2 image layout.
+type Qcow2Options struct {
+	// ClusterSize is a power of two between 512 bytes and 2 MiB. Zero selects 64 KiB.
+	ClusterSize int
+	// Compress stores clusters deflate-compressed when that saves space.
+	Compress bool
+}
+
+// Qcow2Stats summarizes a qcow2 image conversion.
+type Qcow2Stats struct {
+	Size               int64 // Virtual size of the image
+	DataClusters       int64 // Clusters stored uncompressed
+	CompressedClusters int64 // Clusters stored compressed
+	ZeroClusters       int64 // All-zero clusters left unallocated
+	FileSize           int64 // Size of the resulting image file
+}
+
+// qcow2Writer lays out a qcow2 image in a single sequential pass: header and L1 table first,
+// then L2 tables and data clusters as they are produced, then refcount structures at the end.
+type qcow2Writer struct {
+	f           *os.File
+	clusterSize int64
+	clusterBits uint32
+	l2Entries   int64
+	l1          []uint64
+	refcounts   []uint16
+	nextCluster int64 // next free host cluster
+
+	l2Index   int64    // L1 index of the L2 table being filled, -1 when none
+	l2Table   []uint64 // entries of the L2 table being filled
+	l2Cluster int64    // host cluster reserved for l2Table
+
+	compOff int64 // next free byte of the compressed data area, 0 when none
+	compEnd int64 // end of the last cluster allocated for compressed data
+}
+
+// WriteQcow2 copies size bytes of src into a new qcow2 (version 3) image at dstPath, suitable
+// for CDI import. All-zero clusters are left unallocated.
+func WriteQcow2(src io.ReaderAt, size int64, dstPath string, opts Qcow2Options) (Qcow2Stats, error) {
+	stats := Qcow2Stats{Size: size}
+
+	clusterSize := opts.ClusterSize
+	if clusterSize == 0 {
+		clusterSize = qcow2DefaultClusterSize
+	}
+	if clusterSize < 512 || clusterSize > 2*1024*1024 || clusterSize&(clusterSize-1) != 0 {
+		return stats, fmt.Errorf("invalid qcow2 cluster size %d: must be a power of two between 512 and 2097152", clusterSize)
+	}
+
+	f, err := os.OpenFile(dstPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return stats, fmt.Errorf("failed to create %s: %w", dstPath, err)
+	}
+	defer f.Close()
+
+	w := &qcow2Writer{
+		f:           f,
+		clusterSize: int64(clusterSize),
+		l2Entries:   int64(clusterSize) / 8,
+		l2Index:     -1,
+	}
+	for c := clusterSize; c > 1; c >>= 1 {
+		w.clusterBits++
+	}
+
+	l1Size := (size + w.clusterSize*w.l2Entries - 1) / (w.clusterSize * w.l2Entries)
+	w.l1 = make([]uint64, l1Size)
+	w.alloc(1) // header
+	w.alloc(w.clustersFor(l1Size * 8))
+
+	buf := make([]byte, w.clusterSize)
+	for off := int64(0); off < size; off += w.clusterSize {
+		chunk := buf[:min(w.clusterSize, size-off)]
+		if _, err := src.ReadAt(chunk, off); err != nil && err != io.EOF {
+			return stats, fmt.Errorf("failed to read disk at offset %d: %w", off, err)
+		}
+		if IsZero(chunk) {
+			stats.ZeroClusters++
+			continue
+		}
+		// A short last cluster is padded with zeros.
+		if int64(len(chunk)) < w.clusterSize {
+			clear(buf[len(chunk):])
+			chunk = buf
+		}
+
+		entry, compressed, err := w.writeCluster(chunk, opts.Compress)
+		if err != nil {
+			return stats, fmt.Errorf("failed to write %s: %w", dstPath, err)
+		}
+		if compressed {
+			stats.CompressedClusters++
+		} else {
+			stats.DataClusters++
+		}
+		if err := w.setL2Entry(off/w.clusterSize, entry); err != nil {
+			return stats, fmt.Errorf("failed to write %s: %w", dstPath, err)
+		}
+	}
+	if err := w.flushL2(); err != nil {
+		return stats, fmt.Errorf("failed to write %s: %w", dstPath, err)
+	}
+
+	fileSize, err := w.finish(size)
+	if err != nil {
+		return stats, fmt.Errorf("failed to write %s: %w", dstPath, err)
+	}
+	stats.FileSize = fileSize
+	if err := f.Sync(); err != nil {
+		return stats, fmt.Errorf("failed to sync %s: %w", dstPath, err)
+	}
+	return stats, nil
+}
+
+// clustersFor returns the number of clusters needed to hold n bytes.
+func (w *qcow2Writer) clustersFor(n int64) int64 {
+	return (n + w.clusterSize - 1) / w.clusterSize
+}
+
+// alloc reserves n consecutive host clusters with a refcount of one and returns the first.
+func (w *qcow2Writer) alloc(n int64) int64 {
+	first := w.nextCluster
+	for i := int64(0); i < n; i++ {
+		w.refcounts = append(w.refcounts, 1)
+	}
+	w.nextCluster += n
+	return first
+}
+
+// writeCluster stores one cluster of data and returns its L2 entry.
+func (w *qcow2Writer) writeCluster(data []byte, compress bool) (uint64, bool, error) {
+	if compress {
+		compressed, err := deflateCluster(data)
+		if err != nil {
+			return 0, false, err
+		}
+		if int64(len(compressed)) < w.clusterSize-512 {
+			entry, err := w.writeCompressed(compressed)
+			return entry, true, err
+		}
+	}
+
+	cluster := w.alloc(1)
+	if _, err := w.f.WriteAt(data, cluster*w.clusterSize); err != nil {
+		return 0, false, err
+	}
+	return uint64(cluster*w.clusterSize) | qcow2Copied, false, nil
+}
+
+// writeCompressed appends compressed cluster data to the compressed area and returns its L2 entry.
+// Compressed data may straddle host clusters, which are then shared by several guest clusters.
+func (w *qcow2Writer) writeCompressed(data []byte) (uint64, error) {
+	n := int64(len(data))
+	// Spilling into the next host cluster is only possible while the compressed area is the
+	// most recent allocation, otherwise start a new area.
+	if w.compOff == 0 || (w.compOff+n > w.compEnd && w.compEnd != w.nextCluster*w.clusterSize) {
+		first := w.alloc(1)
+		w.refcounts[first] = 0
+		w.compOff = first * w.clusterSize
+		w.compEnd = w.compOff + w.clusterSize
+	}
+	for w.compOff+n > w.compEnd {
+		c := w.alloc(1)
+		w.refcounts[c] = 0
+		w.compEnd += w.clusterSize
+	}
+
+	offset := w.compOff
+	if _, err := w.f.WriteAt(data, offset); err != nil {
+		return 0, err
+	}
+	for c := offset / w.clusterSize; c <= (offset+n-1)/w.clusterSize; c++ {
+		w.refcounts[c]++
+	}
+	w.compOff += n
+
+	// Layout of a compressed L2 entry: host offset in the low x bits, additional 512-byte
+	// sectors in bits x..61, where x = 62 - (cluster_bits - 8).
+	x := 62 - (w.clusterBits - 8)
+	sectors := uint64((offset+n-1)>>9 - offset>>9)
+	return qcow2Compressed | sectors<<x | uint64(offset), nil
+}
+
+// setL2Entry records the host location of guest cluster index, switching L2 tables as needed.
+func (w *qcow2Writer) setL2Entry(index int64, entry uint64) error {
+	l1Index := index / w.l2Entries
+	if l1Index != w.l2Index {
+		if err := w.flushL2(); err != nil {
+			return err
+		}
+		w.l2Index = l1Index
+		w.l2Table = make([]uint64, w.l2Entries)
+		w.l2Cluster = w.alloc(1)
+		w.l1[l1Index] = uint64(w.l2Cluster*w.clusterSize) | qcow2Copied
+	}
+	w.l2Table[index%w.l2Entries] = entry
+	return nil
+}
+
+// flushL2 writes the L2 table being filled to its reserved cluster.
+func (w *qcow2Writer) flushL2() error {
+	if w.l2Index < 0 {
+		return nil
+	}
+	raw := make([]byte, w.clusterSize)
+	for i, e := range w.l2Table {
+		binary.BigEndian.PutUint64(raw[i*8:], e)
+	}
+	_, err := w.f.WriteAt(raw, w.l2Cluster*w.clusterSize)
+	w.l2Index = -1
+	return err
+}
+
+// finish appends the refcount blocks and table, then writes the L1 table and the header.
+// It returns the final file size.
+func (w *qcow2Writer) finish(size int64) (int64, error) {
+	perBlock := w.clusterSize * 8 / (1 << qcow2RefcountOrder)
+
+	// Refcount structures must also count themselves; iterate until the layout is stable.
+	var blocks, tableClusters int64
+	for {
+		total := w.nextCluster + blocks + tableClusters
+		newBlocks := (total + perBlock - 1) / perBlock
+		newTable := w.clustersFor(newBlocks * 8)
+		if newBlocks == blocks && newTable == tableClusters {
+			break
+		}
+		blocks, tableClusters = newBlocks, newTable
+	}
+	firstBlock := w.alloc(blocks)
+	tableCluster := w.alloc(tableClusters)
+
+	table := make([]byte, tableClusters*w.clusterSize)
+	block := make([]byte, w.clusterSize)
+	for b := int64(0); b < blocks; b++ {
+		clear(block)
+		for i := int64(0); i < perBlock; i++ {
+			c := b*perBlock + i
+			if c >= int64(len(w.refcounts)) {
+				break
+			}
+			binary.BigEndian.PutUint16(block[i*2:], w.refcounts[c])
+		}
+		if _, err := w.f.WriteAt(block, (firstBlock+b)*w.clusterSize); err != nil {
+			return 0, err
+		}
+		binary.BigEndian.PutUint64(table[b*8:], uint64((firstBlock+b)*w.clusterSize))
+	}
+	if _, err := w.f.WriteAt(table, tableCluster*w.clusterSize); err != nil {
+		return 0, err
+	}
+
+	l1 := make([]byte, len(w.l1)*8)
+	for i, e := range w.l1 {
+		binary.BigEndian.PutUint64(l1[i*8:], e)
+	}
+	if _, err := w.f.WriteAt(l1, w.clusterSize); err != nil {
+		return 0, err
+	}
+
+	var header bytes.Buffer
+	for _, v := range []any{
+		uint32(qcow2Magic),
+		uint32(3),                            // version
+		uint64(0),                            // backing_file_offset
+		uint32(0),                            // backing_file_size
+		w.clusterBits,                        // cluster_bits
+		uint64(size),                         // size
+		uint32(0),                            // crypt_method
+		uint32(len(w.l1)),                    // l1_size
+		uint64(w.clusterSize),                // l1_table_offset
+		uint64(tableCluster * w.clusterSize), // refcount_table_offset
+		uint32(tableClusters),                // refcount_table_clusters
+		uint32(0),                            // nb_snapshots
+		uint64(0),                            // snapshots_offset
+		uint64(0),                            // incompatible_features
+		uint64(0),                            // compatible_features
+		uint64(0),                            // autoclear_features
+		uint32(qcow2RefcountOrder),           // refcount_order
+		uint32(qcow2HeaderLength),            // header_length
+		uint64(0),                            // end of header extensions
+	} {
+		if err := binary.Write(&header, binary.BigEndian, v); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := w.f.WriteAt(header.Bytes(), 0); err != nil {
+		return 0, err
+	}
+
+	fileSize := w.nextCluster * w.clusterSize
+	return fileSize, w.f.Truncate(fileSize)
+}
+
+// deflateCluster compresses a cluster as raw deflate that qemu can inflate with its 4 KiB
+// window: each 4 KiB slice is compressed by a fresh compressor so no back-reference reaches
+// further than the window, and the sync-flushed slices are concatenated into one stream.
+func deflateCluster(data []byte) ([]byte, error) {
+	var out bytes.Buffer
+	for off := 0; off < len(data); off += qcow2DeflateWindow {
+		fw, err := flate.NewWriter(&out, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := fw.Write(data[off:min(off+qcow2DeflateWindow, len(data))]); err != nil {
+			return nil, err
+		}
+		if off+qcow2DeflateWindow >= len(data) {
+			err = fw.Close()
+		} else {
+			err = fw.Flush()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,220 @@
+package vmdk
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	// rawCopyChunk is the unit in which data is read and written.
+	rawCopyChunk = 1 << 20
+	// ResumeSegment is the interval at which WriteRawFrom reports checkpoints.
+	ResumeSegment = 1 << 30
+	// zeroBlock is the unit in which chunks are checked for zeros, the grain size of
+	// monolithicSparse and split sparse disks.
+	zeroBlock = 64 << 10
+)
+
+// RawStats summarizes a raw image conversion.
+type RawStats struct {
+	Size         int64 // Virtual size of the image
+	DataBytes    int64 // Bytes written
+	ZeroBytes    int64 // Bytes left as holes or punched
+	BlockDevice  bool  // Destination was a block device
+	PunchedHoles bool  // Zero ranges were deallocated with punch-hole rather than skipped
+}
+
+// RawCheckpoint reports that the data WriteRawFrom copied up to Offset is synced to disk.
+type RawCheckpoint struct {
+	Offset int64
+	// Start and SHA256 cover the data copied since the previous checkpoint.
+	Start  int64
+	SHA256 string
+}
+
+// WriteRaw copies size bytes of src to the raw image at dstPath, preserving sparseness.
+// A regular file is created (or truncated) and all-zero chunks are skipped, leaving holes.
+// An existing block device is written in place; since it may hold stale data, zero chunks
+// are deallocated with punch-hole (falling back to writing zeros when unsupported).
+func WriteRaw(src io.ReaderAt, size int64, dstPath string) (RawStats, error) {
+	return WriteRawFrom(src, size, dstPath, 0, nil)
+}
+
+// WriteRawFrom is WriteRaw starting at offset start, to resume an interrupted copy: with
+// start > 0 the existing image is kept and only the rest of the disk is copied. When
+// checkpoint is set it is called every ResumeSegment bytes, once the data is synced.
+func WriteRawFrom(src io.ReaderAt, size int64, dstPath string, start int64, checkpoint func(RawCheckpoint) error) (RawStats, error) {
+	stats := RawStats{Size: size}
+
+	var dst *os.File
+	info, err := os.Stat(dstPath)
+	if err == nil && info.Mode()&os.ModeDevice != 0 {
+		stats.BlockDevice = true
+		if dst, err = os.OpenFile(dstPath, os.O_WRONLY, 0); err != nil {
+			return stats, fmt.Errorf("failed to open block device %s: %w", dstPath, err)
+		}
+		devSize, err := dst.Seek(0, io.SeekEnd)
+		if err != nil {
+			dst.Close()
+			return stats, fmt.Errorf("failed to determine size of %s: %w", dstPath, err)
+		}
+		if devSize < size {
+			dst.Close()
+			return stats, fmt.Errorf("block device %s (%d bytes) is smaller than the disk (%d bytes)", dstPath, devSize, size)
+		}
+	} else if start > 0 {
+		if dst, err = os.OpenFile(dstPath, os.O_WRONLY, 0); err != nil {
+			return stats, fmt.Errorf("failed to open %s to resume: %w", dstPath, err)
+		}
+	} else {
+		if dst, err = os.OpenFile(dstPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644); err != nil {
+			return stats, fmt.Errorf("failed to create %s: %w", dstPath, err)
+		}
+	}
+	defer dst.Close()
+
+	buf := make([]byte, rawCopyChunk)
+	segment := sha256.New()
+	segmentStart := start
+	for off := start; off < size; {
+		chunk := buf[:min(int64(len(buf)), size-off)]
+		if _, err := src.ReadAt(chunk, off); err != nil && err != io.EOF {
+			return stats, fmt.Errorf("failed to read disk at offset %d: %w", off, err)
+		}
+
+		if err := copyChunk(dst, chunk, off, stats.BlockDevice, &stats); err != nil {
+			return stats, fmt.Errorf("failed to write %s at offset %d: %w", dstPath, off, err)
+		}
+		off += int64(len(chunk))
+
+		if checkpoint == nil {
+			continue
+		}
+		segment.Write(chunk)
+		if off%ResumeSegment == 0 && off < size {
+			if err := dst.Sync(); err != nil {
+				return stats, fmt.Errorf("failed to sync %s: %w", dstPath, err)
+			}
+			if err := checkpoint(RawCheckpoint{Offset: off, Start: segmentStart, SHA256: hex.EncodeToString(segment.Sum(nil))}); err != nil {
+				return stats, err
+			}
+			segment.Reset()
+			segmentStart = off
+		}
+	}
+
+	if !stats.BlockDevice {
+		// Extending the file over trailing zero chunks keeps them as a hole.
+		if err := dst.Truncate(size); err != nil {
+			return stats, fmt.Errorf("failed to set size of %s: %w", dstPath, err)
+		}
+	}
+	if err := dst.Sync(); err != nil {
+		return stats, fmt.Errorf("failed to sync %s: %w", dstPath, err)
+	}
+	return stats, nil
+}
+
+// copyChunk writes the chunk read at off to dst, one zeroBlock at a time so that the zero
+// grains of a partly used chunk are not written either. Runs of zero blocks are skipped,
+// leaving holes, or deallocated when zeroDst is set because dst may hold older data.
+func copyChunk(dst *os.File, chunk []byte, off int64, zeroDst bool, stats *RawStats) error {
+	for start := 0; start < len(chunk); {
+		zero := IsZero(chunk[start:min(start+zeroBlock, len(chunk))])
+		end := start
+		for end < len(chunk) && IsZero(chunk[end:min(end+zeroBlock, len(chunk))]) == zero {
+			end = min(end+zeroBlock, len(chunk))
+		}
+		run := chunk[start:end]
+		if !zero {
+			if _, err := dst.WriteAt(run, off+int64(start)); err != nil {
+				return err
+			}
+			stats.DataBytes += int64(len(run))
+		} else {
+			if zeroDst {
+				punched, err := zeroRange(dst, off+int64(start), int64(len(run)), run)
+				if err != nil {
+					return err
+				}
+				stats.PunchedHoles = stats.PunchedHoles || punched
+			}
+			stats.ZeroBytes += int64(len(run))
+		}
+		start = end
+	}
+	return nil
+}
+
+// zeroPage is compared against data to detect all-zero chunks.
+var zeroPage = make([]byte, 4096)
+
+// IsZero reports whether b contains only zero bytes.
+func IsZero(b []byte) bool {
+	for len(b) > 0 {
+		n := min(len(b), len(zeroPage))
+		if !bytes.Equal(b[:n], zeroPage[:n]) {
+			return false
+		}
+		b = b[n:]
+	}
+	return true
+}
+
+// zeroRange deallocates [off, off+length) in f, or writes the (all-zero) buf over it when
+// punching holes is not supported. It reports whether a hole was punched.
+func zeroRange(f *os.File, off, length int64, buf []byte) (bool, error) {
+	if err := punchHole(f, off, length); err == nil {
+		return true, nil
+	}
+	_, err := f.WriteAt(buf[:length], off)
+	return false, err
+}
+
+// UpdateRaw copies only the given ranges of src into the existing raw image or block device
+// at dstPath, e.g. the blocks changed since a previous WriteRaw. Zero chunks are deallocated
+// with punch-hole (or written as zeros) since the destination holds older data.
+func UpdateRaw(src io.ReaderAt, size int64, dstPath string, ranges []Range) (RawStats, error) {
+	stats := RawStats{Size: size}
+
+	info, err := os.Stat(dstPath)
+	if err != nil {
+		return stats, fmt.Errorf("incremental copy needs the image of the previous sync: %w", err)
+	}
+	stats.BlockDevice = info.Mode()&os.ModeDevice != 0
+	dst, err := os.OpenFile(dstPath, os.O_WRONLY, 0)
+	if err != nil {
+		return stats, fmt.Errorf("failed to open %s: %w", dstPath, err)
+	}
+	defer dst.Close()
+	dstSize, err := dst.Seek(0, io.SeekEnd)
+	if err != nil {
+		return stats, fmt.Errorf("failed to determine size of %s: %w", dstPath, err)
+	}
+	if dstSize < size {
+		return stats, fmt.Errorf("%s (%d bytes) is smaller than the disk (%d bytes)", dstPath, dstSize, size)
+	}
+
+	buf := make([]byte, rawCopyChunk)
+	for _, r := range ranges {
+		end := min(r.Offset+r.Length, size)
+		for off := r.Offset; off < end; {
+			chunk := buf[:min(int64(len(buf)), end-off)]
+			if _, err := src.ReadAt(chunk, off); err != nil && err != io.EOF {
+				return stats, fmt.Errorf("failed to read disk at offset %d: %w", off, err)
+			}
+			if err := copyChunk(dst, chunk, off, true, &stats); err != nil {
+				return stats, fmt.Errorf("failed to write %s at offset %d: %w", dstPath, off, err)
+			}
+			off += int64(len(chunk))
+		}
+	}
+	if err := dst.Sync(); err != nil {
+		return stats, fmt.Errorf("failed to sync %s: %w", dstPath, err)
+	}
+	return stats, nil
+}
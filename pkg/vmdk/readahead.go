@@ -0,0 +1,103 @@
+package vmdk
+
+import (
+	"io"
+	"sync"
+)
+
+// ReadAheadChunk is the unit in which ReadAhead workers read the disk.
+const ReadAheadChunk = 4 << 20
+
+// ReadAhead reads a disk ahead of a sequential consumer with a pool of workers, so reads of
+// split extents, snapshot layers and compressed grains overlap instead of waiting on each
+// other. At most workers chunks of ReadAheadChunk bytes are buffered. Reads that do not
+// continue where the previous one stopped restart the read-ahead at the new offset.
+type ReadAhead struct {
+	src     io.ReaderAt
+	size    int64
+	workers int
+
+	mu      sync.Mutex
+	next    int64 // offset of the next chunk to schedule
+	pending []*readAheadChunk
+	pool    sync.Pool
+}
+
+type readAheadChunk struct {
+	off  int64
+	buf  []byte
+	err  error
+	done chan struct{}
+}
+
+// NewReadAhead wraps the first size bytes of src. With fewer than two workers src is
+// returned unchanged.
+func NewReadAhead(src io.ReaderAt, size int64, workers int) io.ReaderAt {
+	if workers < 2 {
+		return src
+	}
+	r := &ReadAhead{src: src, size: size, workers: workers}
+	r.pool.New = func() any { return make([]byte, ReadAheadChunk) }
+	return r
+}
+
+// ReadAt implements io.ReaderAt.
+func (r *ReadAhead) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	for n < len(p) {
+		if off >= r.size {
+			return n, io.EOF
+		}
+		for len(r.pending) > 0 && off >= r.pending[0].off+int64(len(r.pending[0].buf)) {
+			r.release(r.pending[0])
+			r.pending = r.pending[1:]
+		}
+		if len(r.pending) == 0 || off < r.pending[0].off {
+			// Not a continuation: abandon what was read ahead and restart at off.
+			for _, c := range r.pending {
+				go r.release(c)
+			}
+			r.pending = nil
+			r.next = off - off%ReadAheadChunk
+		}
+		r.schedule()
+
+		c := r.pending[0]
+		<-c.done
+		if c.err != nil {
+			return n, c.err
+		}
+		copied := copy(p[n:], c.buf[off-c.off:])
+		n += copied
+		off += int64(copied)
+	}
+	return n, nil
+}
+
+// schedule starts workers on the next chunks until workers chunks are pending.
+func (r *ReadAhead) schedule() {
+	for len(r.pending) < r.workers && r.next < r.size {
+		c := &readAheadChunk{off: r.next, done: make(chan struct{})}
+		c.buf = r.pool.Get().([]byte)[:min(ReadAheadChunk, r.size-r.next)]
+		r.next += int64(len(c.buf))
+		r.pending = append(r.pending, c)
+		go func() {
+			defer close(c.done)
+			n, err := r.src.ReadAt(c.buf, c.off)
+			if err != nil && err != io.EOF {
+				c.err = err
+			}
+			// A source ending early reads as zeros, not as what the pooled buffer held before.
+			clear(c.buf[n:])
+		}()
+	}
+}
+
+// release returns the buffer of a chunk to the pool once its read finished.
+func (r *ReadAhead) release(c *readAheadChunk) {
+	<-c.done
+	r.pool.Put(c.buf[:cap(c.buf)])
+}
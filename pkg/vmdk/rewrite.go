@@ -0,0 +1,159 @@
+package vmdk
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// noParentCID is the parentCID of a disk without parent.
+const noParentCID = "ffffffff"
+
+// createTypes lists the createType values Marshal accepts.
+var createTypes = []string{
+	"monolithicSparse", "monolithicFlat", "twoGbMaxExtentSparse", "twoGbMaxExtentFlat",
+	"streamOptimized", "vmfs", "vmfsThin", "vmfsPreallocated", "vmfsEagerZeroedThick",
+	"vmfsSparse", "seSparse", "vmfsRawDeviceMap", "vmfsPassthroughRawDeviceMap",
+}
+
+// RenameExtents replaces the file name of every extent with rename(name), e.g. to point a
+// staged copy at its new data files. ZERO extents have no file and are left alone.
+func (d *Descriptor) RenameExtents(rename func(name string) string) {
+	for i := range d.Extents {
+		if d.Extents[i].FileName != "" {
+			d.Extents[i].FileName = rename(d.Extents[i].FileName)
+		}
+	}
+}
+
+// ClearParent turns a snapshot delta into a standalone disk, as after flattening its chain.
+func (d *Descriptor) ClearParent() {
+	d.ParentCID = noParentCID
+	d.ParentFileNameHint = ""
+}
+
+// SetCreateType changes the disk type, which must be one of the types VMware tools write.
+// Extents are not converted, update them to match.
+func (d *Descriptor) SetCreateType(createType string) error {
+	if !slices.Contains(createTypes, createType) {
+		return fmt.Errorf("unknown createType %q", createType)
+	}
+	d.CreateType = createType
+	return nil
+}
+
+// NewCID assigns a random content ID, which VMware expects whenever the disk content changes
+// so that children of the old content are no longer accepted as its snapshots.
+func (d *Descriptor) NewCID() error {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	d.CID = hex.EncodeToString(b)
+	return nil
+}
+
+// Marshal renders the descriptor as the text of a descriptor-only .vmdk file. DDB entries
+// are written in name order. Encrypted descriptors cannot be rewritten since their key
+// safe is not retained by ParseDescriptor.
+func (d *Descriptor) Marshal() ([]byte, error) {
+	if d.Encrypted {
+		return nil, fmt.Errorf("%w: its descriptor cannot be rewritten", ErrEncrypted)
+	}
+	if !slices.Contains(createTypes, d.CreateType) {
+		return nil, fmt.Errorf("unknown createType %q", d.CreateType)
+	}
+	if len(d.Extents) == 0 {
+		return nil, fmt.Errorf("descriptor has no extents")
+	}
+
+	// Values are written between double quotes without escaping, as VMware does.
+	values := []string{d.Encoding, d.ParentFileNameHint, d.ChangeTrackPath}
+	for _, e := range d.Extents {
+		values = append(values, e.FileName)
+	}
+	for _, v := range d.DDB {
+		values = append(values, v)
+	}
+	for _, v := range values {
+		if strings.ContainsAny(v, "\"\n") {
+			return nil, fmt.Errorf("descriptor value %q contains a double quote or a newline", v)
+		}
+	}
+
+	var b bytes.Buffer
+	b.WriteString("# Disk DescriptorFile\n")
+	fmt.Fprintf(&b, "version=%d\n", max(d.Version, 1))
+	if d.Encoding != "" {
+		fmt.Fprintf(&b, "encoding=\"%s\"\n", d.Encoding)
+	}
+	fmt.Fprintf(&b, "CID=%s\n", d.CID)
+	parentCID := d.ParentCID
+	if parentCID == "" {
+		parentCID = noParentCID
+	}
+	fmt.Fprintf(&b, "parentCID=%s\n", parentCID)
+	if d.ParentFileNameHint != "" {
+		fmt.Fprintf(&b, "parentFileNameHint=\"%s\"\n", d.ParentFileNameHint)
+	}
+	fmt.Fprintf(&b, "createType=\"%s\"\n", d.CreateType)
+
+	b.WriteString("\n# Extent description\n")
+	for _, e := range d.Extents {
+		fmt.Fprintf(&b, "%s %d %s", e.Access, e.SizeSector, e.Type)
+		if e.Type != "ZERO" {
+			fmt.Fprintf(&b, " \"%s\"", e.FileName)
+		}
+		if e.Type == "FLAT" || e.Offset != 0 {
+			fmt.Fprintf(&b, " %d", e.Offset)
+		}
+		b.WriteString("\n")
+	}
+	if d.ChangeTrackPath != "" {
+		fmt.Fprintf(&b, "\n# Change Tracking File\nchangeTrackPath=\"%s\"\n", d.ChangeTrackPath)
+	}
+
+	b.WriteString("\n# The Disk Data Base\n#DDB\n\n")
+	keys := make([]string, 0, len(d.DDB))
+	for key := range d.DDB {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		fmt.Fprintf(&b, "%s = \"%s\"\n", key, d.DDB[key])
+	}
+	return b.Bytes(), nil
+}
+
+// WriteDescriptor writes d as a descriptor-only .vmdk file at path, replacing it atomically.
+func WriteDescriptor(path string, d *Descriptor) error {
+	text, err := d.Marshal()
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write descriptor %s: %w", path, err)
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write descriptor %s: %w", path, err)
+	}
+	if _, err := tmp.Write(text); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write descriptor %s: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write descriptor %s: %w", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write descriptor %s: %w", path, err)
+	}
+	return nil
+}
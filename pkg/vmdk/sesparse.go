@@ -0,0 +1,338 @@
+package vmdk
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"vmx2vmi/pkg/failure"
+)
+
+const (
+	// seSparseMagic and seSparseVersion identify the SESparse constant header.
+	seSparseMagic   = 0x00000000cafebabe
+	seSparseVersion = 0x0000000200000001
+	// seSparseVolatileMagic identifies the SESparse volatile header.
+	seSparseVolatileMagic = 0x00000000cafecafe
+	// seSparseGrainSectors and seSparseGTSectors are the only grain and grain table sizes ESXi writes.
+	seSparseGrainSectors = 8
+	seSparseGTSectors    = 64
+	// seSparseGDEAllocated is the type of a grain directory entry pointing at a grain table.
+	seSparseGDEAllocated = 0x1000000000000000
+	// seSparse grain table entry types, held in the top four bits.
+	seSparseGTEUnallocated = 0x0
+	seSparseGTEUnmapped    = 0x1
+	seSparseGTEZero        = 0x2
+	seSparseGTEAllocated   = 0x3
+)
+
+// seSparseHeader is the decoded SESparse constant header. Offsets and sizes are in sectors.
+type seSparseHeader struct {
+	CapacitySectors      uint64
+	GrainSectors         uint64
+	GTSectors            uint64
+	VolatileHeaderOffset uint64
+	GDOffset             uint64
+	GDSectors            uint64
+	GTsOffset            uint64
+	GTsSectors           uint64
+	GrainsOffset         uint64
+}
+
+func parseSESparseHeader(buf []byte) (seSparseHeader, error) {
+	if len(buf) < sectorSize {
+		return seSparseHeader{}, fmt.Errorf("SESparse header too short (%d bytes)", len(buf))
+	}
+	le := binary.LittleEndian
+	if le.Uint64(buf[0:8]) != seSparseMagic {
+		return seSparseHeader{}, fmt.Errorf("missing SESparse magic")
+	}
+	if v := le.Uint64(buf[8:16]); v != seSparseVersion {
+		return seSparseHeader{}, failure.Errorf(failure.Unsupported, "unsupported SESparse version %#x", v)
+	}
+	h := seSparseHeader{
+		CapacitySectors:      le.Uint64(buf[16:24]),
+		GrainSectors:         le.Uint64(buf[24:32]),
+		GTSectors:            le.Uint64(buf[32:40]),
+		VolatileHeaderOffset: le.Uint64(buf[80:88]),
+		GDOffset:             le.Uint64(buf[128:136]),
+		GDSectors:            le.Uint64(buf[136:144]),
+		GTsOffset:            le.Uint64(buf[144:152]),
+		GTsSectors:           le.Uint64(buf[152:160]),
+		GrainsOffset:         le.Uint64(buf[192:200]),
+	}
+	if flags := le.Uint64(buf[40:48]); flags != 0 {
+		return h, failure.Errorf(failure.Unsupported, "unsupported SESparse flags %#x", flags)
+	}
+	if h.GrainSectors != seSparseGrainSectors {
+		return h, failure.Errorf(failure.Unsupported, "unsupported SESparse grain size %d sectors", h.GrainSectors)
+	}
+	if h.GTSectors != seSparseGTSectors {
+		return h, failure.Errorf(failure.Unsupported, "unsupported SESparse grain table size %d sectors", h.GTSectors)
+	}
+	return h, nil
+}
+
+// SESparseExtent reads a SESparse extent, the delta format of ESXi 6.5+ snapshots and of
+// disks larger than 2 TB on VMFS6. Grains that are not allocated in the extent read as zeros.
+// It is safe for concurrent use.
+type SESparseExtent struct {
+	file     *os.File
+	header   seSparseHeader
+	fileSize int64
+	// gd holds the index of every grain table, or -1 for missing tables.
+	gd []int64
+
+	mu      sync.Mutex
+	gtCache map[int64][]uint64
+}
+
+// OpenSESparseExtent opens the -sesparse.vmdk data file of a seSparse disk.
+func OpenSESparseExtent(path string) (*SESparseExtent, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open SESparse extent %s: %w", path, err)
+	}
+	s, err := newSESparseExtent(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to open SESparse extent %s: %w", path, err)
+	}
+	return s, nil
+}
+
+func newSESparseExtent(file *os.File) (*SESparseExtent, error) {
+	buf := make([]byte, sectorSize)
+	if _, err := file.ReadAt(buf, 0); err != nil {
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+	header, err := parseSESparseHeader(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	// Metadata updates go through a journal; ESXi replays it when the disk is next opened.
+	if _, err := file.ReadAt(buf, int64(header.VolatileHeaderOffset)*sectorSize); err != nil {
+		return nil, fmt.Errorf("failed to read volatile header: %w", err)
+	}
+	if binary.LittleEndian.Uint64(buf[0:8]) != seSparseVolatileMagic {
+		return nil, fmt.Errorf("missing SESparse volatile header magic")
+	}
+	if binary.LittleEndian.Uint64(buf[24:32]) != 0 {
+		return nil, fmt.Errorf("journal has not been replayed, power the VM on and off or consolidate it on ESXi first")
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	s := &SESparseExtent{
+		file:     file,
+		header:   header,
+		fileSize: info.Size(),
+		gtCache:  make(map[int64][]uint64),
+	}
+	if err := s.loadGrainDirectory(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// gtEntries is the number of grain table entries per table.
+func (s *SESparseExtent) gtEntries() uint64 {
+	return s.header.GTSectors * sectorSize / 8
+}
+
+func (s *SESparseExtent) loadGrainDirectory() error {
+	grains := (s.header.CapacitySectors + s.header.GrainSectors - 1) / s.header.GrainSectors
+	tables := (grains + s.gtEntries() - 1) / s.gtEntries()
+	if tables*8 > s.header.GDSectors*sectorSize {
+		return fmt.Errorf("grain directory of %d sectors cannot map %d grain tables", s.header.GDSectors, tables)
+	}
+	raw := make([]byte, tables*8)
+	if _, err := s.file.ReadAt(raw, int64(s.header.GDOffset)*sectorSize); err != nil {
+		return fmt.Errorf("failed to read grain directory: %w", err)
+	}
+	maxTables := s.header.GTsSectors / s.header.GTSectors
+	s.gd = make([]int64, tables)
+	for i := range s.gd {
+		gde := binary.LittleEndian.Uint64(raw[i*8:])
+		s.gd[i] = -1
+		if gde == 0 {
+			continue
+		}
+		if gde&0xffffffff00000000 != seSparseGDEAllocated {
+			return fmt.Errorf("grain directory entry %d is invalid (%#x)", i, gde)
+		}
+		index := gde & 0xffffffff
+		if index >= maxTables {
+			return fmt.Errorf("grain directory entry %d points past the grain tables (table %d)", i, index)
+		}
+		s.gd[i] = int64(index)
+	}
+	return nil
+}
+
+// grainTable returns grain table gdIndex, reading it on first use. Caller holds s.mu.
+func (s *SESparseExtent) grainTable(gdIndex uint64) ([]uint64, error) {
+	index := s.gd[gdIndex]
+	if index < 0 {
+		return nil, nil
+	}
+	if gt, ok := s.gtCache[index]; ok {
+		return gt, nil
+	}
+	raw := make([]byte, s.gtEntries()*8)
+	sector := s.header.GTsOffset + uint64(index)*s.header.GTSectors
+	if _, err := s.file.ReadAt(raw, int64(sector)*sectorSize); err != nil {
+		return nil, fmt.Errorf("failed to read grain table %d: %w", index, err)
+	}
+	gt := make([]uint64, s.gtEntries())
+	for i := range gt {
+		gt[i] = binary.LittleEndian.Uint64(raw[i*8:])
+	}
+	s.gtCache[index] = gt
+	return gt, nil
+}
+
+// grainEntry returns the grain table entry of grainIndex, 0 when its table is missing. Caller holds s.mu.
+func (s *SESparseExtent) grainEntry(grainIndex uint64) (uint64, error) {
+	gdIndex := grainIndex / s.gtEntries()
+	if gdIndex >= uint64(len(s.gd)) {
+		return 0, nil
+	}
+	gt, err := s.grainTable(gdIndex)
+	if err != nil || gt == nil {
+		return 0, err
+	}
+	gte := gt[grainIndex%s.gtEntries()]
+	switch gte >> 60 {
+	case seSparseGTEUnallocated:
+		if gte != 0 {
+			return 0, fmt.Errorf("grain %d has an invalid table entry (%#x)", grainIndex, gte)
+		}
+	case seSparseGTEUnmapped, seSparseGTEZero, seSparseGTEAllocated:
+	default:
+		return 0, fmt.Errorf("grain %d has an invalid table entry (%#x)", grainIndex, gte)
+	}
+	return gte, nil
+}
+
+// grainOffset returns the byte offset of the data of an allocated grain table entry.
+// The grain number is stored with its low 12 bits in bits 48-59 of the entry.
+func (s *SESparseExtent) grainOffset(gte uint64) int64 {
+	grain := (gte&0x0fff000000000000)>>48 | (gte&0x0000ffffffffffff)<<12
+	return int64(s.header.GrainsOffset+grain*s.header.GrainSectors) * sectorSize
+}
+
+// mapped implements allocationMapper. Zero and unmapped grains count as stored since they
+// hide the parent's data.
+func (s *SESparseExtent) mapped(off int64) (bool, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	grainBytes := s.GrainSize()
+	grainIndex := uint64(off / grainBytes)
+	gte, err := s.grainEntry(grainIndex)
+	if err != nil {
+		return false, 0, err
+	}
+	return gte != 0, grainBytes - off%grainBytes, nil
+}
+
+// GrainSize returns the size of a grain in bytes.
+func (s *SESparseExtent) GrainSize() int64 {
+	return int64(s.header.GrainSectors) * sectorSize
+}
+
+// AllocatedGrains calls fn with the index of each grain holding data, in ascending order.
+func (s *SESparseExtent) AllocatedGrains(fn func(grainIndex uint64) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	totalGrains := (s.header.CapacitySectors + s.header.GrainSectors - 1) / s.header.GrainSectors
+	for grainIndex := uint64(0); grainIndex < totalGrains; grainIndex++ {
+		if s.gd[grainIndex/s.gtEntries()] < 0 {
+			grainIndex += s.gtEntries() - 1 - grainIndex%s.gtEntries()
+			continue
+		}
+		gte, err := s.grainEntry(grainIndex)
+		if err != nil {
+			return err
+		}
+		if gte>>60 == seSparseGTEAllocated {
+			if err := fn(grainIndex); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// AllocatedBytes returns the amount of virtual disk data actually stored in the extent.
+func (s *SESparseExtent) AllocatedBytes() (int64, error) {
+	var grains int64
+	err := s.AllocatedGrains(func(uint64) error {
+		grains++
+		return nil
+	})
+	return min(grains*s.GrainSize(), s.Size()), err
+}
+
+// Size returns the virtual size of the extent in bytes.
+func (s *SESparseExtent) Size() int64 {
+	return int64(s.header.CapacitySectors) * sectorSize
+}
+
+// ReadAt implements io.ReaderAt over the virtual disk content.
+func (s *SESparseExtent) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	size := s.Size()
+	if off >= size {
+		return 0, io.EOF
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	grainBytes := s.GrainSize()
+	n := 0
+	for n < len(p) && off < size {
+		grainIndex := uint64(off / grainBytes)
+		inGrain := off % grainBytes
+		chunk := min(int64(len(p)-n), grainBytes-inGrain, size-off)
+		dst := p[n : n+int(chunk)]
+
+		gte, err := s.grainEntry(grainIndex)
+		if err != nil {
+			return n, err
+		}
+		if gte>>60 == seSparseGTEAllocated {
+			offset := s.grainOffset(gte)
+			if offset+grainBytes > s.fileSize {
+				return n, fmt.Errorf("grain %d points past the end of the file (offset %d)", grainIndex, offset)
+			}
+			if _, err := s.file.ReadAt(dst, offset+inGrain); err != nil && !errors.Is(err, io.EOF) {
+				return n, fmt.Errorf("failed to read grain %d: %w", grainIndex, err)
+			}
+		} else {
+			clear(dst)
+		}
+		n += int(chunk)
+		off += chunk
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Close closes the underlying file.
+func (s *SESparseExtent) Close() error {
+	return s.file.Close()
+}
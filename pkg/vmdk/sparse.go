@@ -0,0 +1,441 @@
+package vmdk
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"vmx2vmi/pkg/failure"
+)
+
+const (
+	// sparseHeaderSize is the size of the on-disk SparseExtentHeader.
+	sparseHeaderSize = 512
+	// gdAtEnd is the gdOffset value of streamOptimized headers whose grain directory is in the footer.
+	gdAtEnd = 0xffffffffffffffff
+	// flagValidNewLineTest marks headers carrying the end-of-line test characters.
+	flagValidNewLineTest = 1 << 0
+	// flagRedundantGT marks extents that keep a redundant grain directory and tables.
+	flagRedundantGT = 1 << 1
+	// flagZeroedGTE marks extents where a grain table entry of 1 denotes a zeroed grain.
+	flagZeroedGTE = 1 << 2
+	// flagCompressed marks extents whose grains are compressed (streamOptimized).
+	flagCompressed = 1 << 16
+	// compressionDeflate is the only compression algorithm defined for VMDK.
+	compressionDeflate = 1
+	// markerFooter is the type of the metadata marker preceding a streamOptimized footer.
+	markerFooter = 3
+	// grainCacheSize is the number of decompressed grains kept in memory.
+	grainCacheSize = 16
+)
+
+// sparseHeader is the decoded SparseExtentHeader shared by hosted sparse and streamOptimized extents.
+type sparseHeader struct {
+	Version           uint32
+	Flags             uint32
+	CapacitySectors   uint64
+	GrainSectors      uint64
+	DescriptorOffset  uint64
+	DescriptorSize    uint64
+	NumGTEsPerGT      uint32
+	RGDOffset         uint64
+	GDOffset          uint64
+	OverheadSectors   uint64
+	UncleanShutdown   bool
+	NewLineChars      [4]byte
+	CompressAlgorithm uint16
+}
+
+func parseSparseHeader(buf []byte) (sparseHeader, error) {
+	if len(buf) < sparseHeaderSize {
+		return sparseHeader{}, fmt.Errorf("sparse header too short (%d bytes)", len(buf))
+	}
+	if binary.LittleEndian.Uint32(buf[0:4]) != vmdkMagicKDMV {
+		return sparseHeader{}, fmt.Errorf("missing KDMV magic")
+	}
+	h := sparseHeader{
+		Version:           binary.LittleEndian.Uint32(buf[4:8]),
+		Flags:             binary.LittleEndian.Uint32(buf[8:12]),
+		CapacitySectors:   binary.LittleEndian.Uint64(buf[12:20]),
+		GrainSectors:      binary.LittleEndian.Uint64(buf[20:28]),
+		DescriptorOffset:  binary.LittleEndian.Uint64(buf[28:36]),
+		DescriptorSize:    binary.LittleEndian.Uint64(buf[36:44]),
+		NumGTEsPerGT:      binary.LittleEndian.Uint32(buf[44:48]),
+		RGDOffset:         binary.LittleEndian.Uint64(buf[48:56]),
+		GDOffset:          binary.LittleEndian.Uint64(buf[56:64]),
+		OverheadSectors:   binary.LittleEndian.Uint64(buf[64:72]),
+		UncleanShutdown:   buf[72] != 0,
+		NewLineChars:      [4]byte{buf[73], buf[74], buf[75], buf[76]},
+		CompressAlgorithm: binary.LittleEndian.Uint16(buf[77:79]),
+	}
+	if h.GrainSectors == 0 || h.GrainSectors&(h.GrainSectors-1) != 0 {
+		return h, fmt.Errorf("invalid grain size %d sectors", h.GrainSectors)
+	}
+	if h.NumGTEsPerGT == 0 {
+		return h, fmt.Errorf("invalid number of grain table entries per table: 0")
+	}
+	// The end-of-line characters detect files mangled by a text-mode (ASCII) transfer.
+	if h.Flags&flagValidNewLineTest != 0 && h.NewLineChars != [4]byte{'\n', ' ', '\r', '\n'} {
+		return h, fmt.Errorf("header end-of-line test failed, the file was probably corrupted by a text-mode transfer")
+	}
+	return h, nil
+}
+
+// SparseExtent reads the data of a KDMV sparse extent through its grain directory.
+// Unallocated grains read as zeros. It is safe for concurrent use.
+type SparseExtent struct {
+	file     file
+	header   sparseHeader
+	fileSize int64
+	// gd holds the sector offset of every grain table.
+	gd []uint32
+
+	mu      sync.Mutex
+	gtCache map[uint32][]uint32
+	grains  map[uint64][]byte // decompressed grains keyed by grain index
+	order   []uint64          // grain cache eviction order
+}
+
+// OpenSparseExtent opens a monolithic sparse or streamOptimized (compressed) sparse extent.
+func OpenSparseExtent(path string) (*SparseExtent, error) {
+	file, err := openFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sparse extent %s: %w", path, err)
+	}
+	s, err := newSparseExtent(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to open sparse extent %s: %w", path, err)
+	}
+	return s, nil
+}
+
+func newSparseExtent(file file) (*SparseExtent, error) {
+	buf := make([]byte, sparseHeaderSize)
+	if _, err := file.ReadAt(buf, 0); err != nil {
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+	header, err := parseSparseHeader(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	if header.Flags&flagCompressed != 0 && header.CompressAlgorithm != compressionDeflate {
+		return nil, failure.Errorf(failure.Unsupported, "unsupported grain compression algorithm %d", header.CompressAlgorithm)
+	}
+
+	// streamOptimized writers that cannot seek put the real header in a footer
+	// 1024 bytes before the end of the file, followed by the end-of-stream marker.
+	if header.GDOffset == gdAtEnd {
+		if file.Size() < 3*sectorSize {
+			return nil, fmt.Errorf("file too small to hold a footer")
+		}
+		marker := make([]byte, sectorSize)
+		if _, err := file.ReadAt(marker, file.Size()-3*sectorSize); err != nil {
+			return nil, fmt.Errorf("failed to read footer marker: %w", err)
+		}
+		if binary.LittleEndian.Uint32(marker[12:16]) != markerFooter {
+			return nil, fmt.Errorf("footer marker not found before end-of-stream")
+		}
+		if _, err := file.ReadAt(buf, file.Size()-2*sectorSize); err != nil {
+			return nil, fmt.Errorf("failed to read footer: %w", err)
+		}
+		if header, err = parseSparseHeader(buf); err != nil {
+			return nil, fmt.Errorf("invalid footer: %w", err)
+		}
+		if header.GDOffset == gdAtEnd {
+			return nil, fmt.Errorf("footer does not locate the grain directory")
+		}
+	}
+
+	s := &SparseExtent{
+		file:     file,
+		header:   header,
+		fileSize: file.Size(),
+		gtCache:  make(map[uint32][]uint32),
+		grains:   make(map[uint64][]byte),
+	}
+	if err := s.loadGrainDirectory(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// grainBytes is the size of one grain in bytes.
+func (s *SparseExtent) grainBytes() int64 {
+	return int64(s.header.GrainSectors) * sectorSize
+}
+
+func (s *SparseExtent) loadGrainDirectory() error {
+	gd, err := s.readGrainDirectory(s.header.GDOffset)
+	if err == nil {
+		s.gd = gd
+		return nil
+	}
+	// Fall back to the redundant copy maintained by hosted sparse extents.
+	if s.header.Flags&flagRedundantGT != 0 && s.header.RGDOffset != 0 {
+		if rgd, rgdErr := s.readGrainDirectory(s.header.RGDOffset); rgdErr == nil {
+			s.gd = rgd
+			return nil
+		}
+	}
+	return err
+}
+
+// readGrainDirectory reads and validates the grain directory stored at sector.
+func (s *SparseExtent) readGrainDirectory(sector uint64) ([]uint32, error) {
+	grains := (s.header.CapacitySectors + s.header.GrainSectors - 1) / s.header.GrainSectors
+	tables := (grains + uint64(s.header.NumGTEsPerGT) - 1) / uint64(s.header.NumGTEsPerGT)
+	raw := make([]byte, tables*4)
+	if _, err := s.file.ReadAt(raw, int64(sector)*sectorSize); err != nil {
+		return nil, fmt.Errorf("failed to read grain directory at sector %d: %w", sector, err)
+	}
+	gd := make([]uint32, tables)
+	gtBytes := int64(s.header.NumGTEsPerGT) * 4
+	for i := range gd {
+		gd[i] = binary.LittleEndian.Uint32(raw[i*4:])
+		if gd[i] != 0 && int64(gd[i])*sectorSize+gtBytes > s.fileSize {
+			return nil, fmt.Errorf("grain directory at sector %d: table %d points past the end of the file (sector %d)", sector, i, gd[i])
+		}
+	}
+	return gd, nil
+}
+
+// grainTable returns grain table gdIndex, reading it on first use. Caller holds s.mu.
+func (s *SparseExtent) grainTable(gdIndex uint64) ([]uint32, error) {
+	sector := s.gd[gdIndex]
+	if sector == 0 {
+		return nil, nil
+	}
+	if gt, ok := s.gtCache[sector]; ok {
+		return gt, nil
+	}
+	raw := make([]byte, int(s.header.NumGTEsPerGT)*4)
+	if _, err := s.file.ReadAt(raw, int64(sector)*sectorSize); err != nil {
+		return nil, fmt.Errorf("failed to read grain table at sector %d: %w", sector, err)
+	}
+	gt := make([]uint32, s.header.NumGTEsPerGT)
+	for i := range gt {
+		gt[i] = binary.LittleEndian.Uint32(raw[i*4:])
+	}
+	s.gtCache[sector] = gt
+	return gt, nil
+}
+
+// grain returns the content of grain grainIndex, or nil for an unallocated grain. Caller holds s.mu.
+func (s *SparseExtent) grain(grainIndex uint64) ([]byte, error) {
+	if data, ok := s.grains[grainIndex]; ok {
+		return data, nil
+	}
+
+	perGT := uint64(s.header.NumGTEsPerGT)
+	gdIndex := grainIndex / perGT
+	if gdIndex >= uint64(len(s.gd)) {
+		return nil, nil
+	}
+	gt, err := s.grainTable(gdIndex)
+	if err != nil || gt == nil {
+		return nil, err
+	}
+	sector := gt[grainIndex%perGT]
+	if !s.allocated(sector) {
+		return nil, nil
+	}
+	if int64(sector)*sectorSize >= s.fileSize {
+		return nil, fmt.Errorf("grain %d points past the end of the file (sector %d)", grainIndex, sector)
+	}
+
+	var data []byte
+	if s.header.Flags&flagCompressed != 0 {
+		data, err = s.readCompressedGrain(int64(sector) * sectorSize)
+	} else {
+		data, err = s.readGrain(int64(sector) * sectorSize)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("grain %d: %w", grainIndex, err)
+	}
+
+	if len(s.order) >= grainCacheSize {
+		delete(s.grains, s.order[0])
+		s.order = s.order[1:]
+	}
+	s.grains[grainIndex] = data
+	s.order = append(s.order, grainIndex)
+	return data, nil
+}
+
+// readGrain reads an uncompressed grain stored at offset.
+func (s *SparseExtent) readGrain(offset int64) ([]byte, error) {
+	data := make([]byte, s.grainBytes())
+	n, err := s.file.ReadAt(data, offset)
+	// A truncated last grain reads as zeros past the end of the file.
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to read grain: %w", err)
+	}
+	clear(data[n:])
+	return data, nil
+}
+
+// readCompressedGrain reads and inflates the grain marker at offset: lba (8 bytes), compressed size (4 bytes), data.
+func (s *SparseExtent) readCompressedGrain(offset int64) ([]byte, error) {
+	var markerHeader [12]byte
+	if _, err := s.file.ReadAt(markerHeader[:], offset); err != nil {
+		return nil, fmt.Errorf("failed to read grain marker: %w", err)
+	}
+	size := binary.LittleEndian.Uint32(markerHeader[8:12])
+	if size == 0 || int64(size) > 2*s.grainBytes()+sectorSize {
+		return nil, fmt.Errorf("invalid compressed grain size %d", size)
+	}
+	compressed := make([]byte, size)
+	if _, err := s.file.ReadAt(compressed, offset+12); err != nil {
+		return nil, fmt.Errorf("failed to read compressed grain: %w", err)
+	}
+
+	zr, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, fmt.Errorf("failed to inflate grain: %w", err)
+	}
+	defer zr.Close()
+	data := make([]byte, s.grainBytes())
+	n, err := io.ReadFull(zr, data)
+	// The last grain of a disk whose size is not a multiple of the grain size may be short.
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, fmt.Errorf("failed to inflate grain: %w", err)
+	}
+	clear(data[n:])
+	return data, nil
+}
+
+// allocated reports whether a grain table entry points at stored data. 0 is an unallocated
+// grain and, on extents using zeroed-grain entries, 1 a grain explicitly zeroed by a later write.
+func (s *SparseExtent) allocated(gte uint32) bool {
+	if gte == 0 {
+		return false
+	}
+	return gte != 1 || s.header.Flags&flagZeroedGTE == 0
+}
+
+// mapped implements allocationMapper. Zeroed grains count as stored since they hide the parent's data.
+func (s *SparseExtent) mapped(off int64) (bool, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	grainBytes := s.grainBytes()
+	perGT := uint64(s.header.NumGTEsPerGT)
+	grainIndex := uint64(off / grainBytes)
+	run := grainBytes - off%grainBytes
+	gdIndex := grainIndex / perGT
+	if gdIndex >= uint64(len(s.gd)) {
+		return false, run, nil
+	}
+	gt, err := s.grainTable(gdIndex)
+	if err != nil {
+		return false, 0, err
+	}
+	if gt == nil {
+		// The whole table is missing: skip to the next one.
+		return false, run + int64(perGT-1-grainIndex%perGT)*grainBytes, nil
+	}
+	return gt[grainIndex%perGT] != 0, run, nil
+}
+
+// GrainSize returns the size of a grain in bytes.
+func (s *SparseExtent) GrainSize() int64 {
+	return s.grainBytes()
+}
+
+// UncleanShutdown reports whether the extent was not closed cleanly by its last writer,
+// in which case grain tables may be inconsistent.
+func (s *SparseExtent) UncleanShutdown() bool {
+	return s.header.UncleanShutdown
+}
+
+// AllocatedGrains walks every grain table and calls fn with the index of each allocated grain,
+// in ascending order. It lets callers size or copy only the data actually stored.
+func (s *SparseExtent) AllocatedGrains(fn func(grainIndex uint64) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	perGT := uint64(s.header.NumGTEsPerGT)
+	totalGrains := (s.header.CapacitySectors + s.header.GrainSectors - 1) / s.header.GrainSectors
+	for gdIndex := range s.gd {
+		gt, err := s.grainTable(uint64(gdIndex))
+		if err != nil {
+			return err
+		}
+		for i, gte := range gt {
+			grainIndex := uint64(gdIndex)*perGT + uint64(i)
+			if grainIndex >= totalGrains {
+				break
+			}
+			if s.allocated(gte) {
+				if err := fn(grainIndex); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// AllocatedBytes returns the amount of virtual disk data actually stored in the extent.
+func (s *SparseExtent) AllocatedBytes() (int64, error) {
+	var grains int64
+	err := s.AllocatedGrains(func(uint64) error {
+		grains++
+		return nil
+	})
+	return min(grains*s.grainBytes(), s.Size()), err
+}
+
+// Size returns the virtual size of the extent in bytes.
+func (s *SparseExtent) Size() int64 {
+	return int64(s.header.CapacitySectors) * sectorSize
+}
+
+// ReadAt implements io.ReaderAt over the virtual disk content.
+func (s *SparseExtent) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	size := s.Size()
+	if off >= size {
+		return 0, io.EOF
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	grainBytes := s.grainBytes()
+	n := 0
+	for n < len(p) && off < size {
+		grainIndex := uint64(off / grainBytes)
+		inGrain := off % grainBytes
+		chunk := min(int64(len(p)-n), grainBytes-inGrain, size-off)
+
+		data, err := s.grain(grainIndex)
+		if err != nil {
+			return n, err
+		}
+		if data == nil {
+			clear(p[n : n+int(chunk)])
+		} else {
+			copy(p[n:n+int(chunk)], data[inGrain:inGrain+chunk])
+		}
+		n += int(chunk)
+		off += chunk
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Close closes the underlying file.
+func (s *SparseExtent) Close() error {
+	return s.file.Close()
+}
@@ -5,7 +5,8 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
-	"os"
+
+	"vmx2vmi/pkg/failure"
 )
 
 const (
@@ -37,8 +38,15 @@ var (
 // Supported VMDK types:
 // 1. Descriptor-only files (starting with "# Disk DescriptorFile").
 // 2. Monolithic KDMV-type files (e.g., sparse extents) with an embedded descriptor.
+//
+// Other disk image formats (qcow2, VHD/VHDX, VDI, raw, ISO) are reported with a *ForeignFormatError.
 func ExtractVMDKDescriptor(filePath string) (descriptor string, isVMDK bool, err error) {
-	file, err := os.Open(filePath)
+	descriptor, isVMDK, err = extractVMDKDescriptor(filePath)
+	return descriptor, isVMDK, failure.Wrap(failure.Parse, err)
+}
+
+func extractVMDKDescriptor(filePath string) (string, bool, error) {
+	file, err := openFile(filePath)
 	if err != nil {
 		return "", false, fmt.Errorf("failed to open file %s: %w", filePath, err)
 	}
@@ -72,6 +80,9 @@ func ExtractVMDKDescriptor(filePath string) (descriptor string, isVMDK bool, err
 
 	// 2. Check for KDMV magic number (monolithic file with embedded descriptor)
 	if len(actualInitialBytes) < 4 { // Not enough bytes for magic number
+		if foreign := foreignFormat(file, filePath); foreign != nil {
+			return "", false, foreign
+		}
 		return "", false, fmt.Errorf("file %s is too small to be a KDMV VMDK (size: %d bytes)", filePath, len(actualInitialBytes))
 	}
 
@@ -110,5 +121,8 @@ func ExtractVMDKDescriptor(filePath string) (descriptor string, isVMDK bool, err
 		return string(descriptorContentBytes), true, nil
 	}
 
+	if foreign := foreignFormat(file, filePath); foreign != nil {
+		return "", false, foreign
+	}
 	return "", false, fmt.Errorf("file %s is not a recognized VMDK format (neither descriptor-only nor KDMV)", filePath)
 }
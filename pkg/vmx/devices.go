@@ -0,0 +1,259 @@
+package vmx
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"vmx2vmi/pkg/vmdk"
+)
+
+// diskBuses are the controller types whose child devices may be virtual disks.
+var diskBuses = []string{"scsi", "sata", "ide", "nvme"}
+
+// Controller is a storage controller, e.g. scsi0.
+type Controller struct {
+	Bus   string // scsi, sata, ide or nvme
+	Index int
+	// VirtualDev is the emulated controller model, e.g. lsilogic, lsisas1068, pvscsi. Empty for sata/ide/nvme.
+	VirtualDev string
+	// SharedBus is the bus sharing mode: none, virtual or physical.
+	SharedBus string
+}
+
+// ID returns the VMX device identifier of the controller, e.g. "scsi0".
+func (c Controller) ID() string {
+	return fmt.Sprintf("%s%d", c.Bus, c.Index)
+}
+
+// Disk is a virtual disk (or CD-ROM) attached to a controller slot, e.g. scsi0:1.
+type Disk struct {
+	Bus        string // scsi, sata, ide or nvme
+	Controller int
+	Unit       int
+	FileName   string
+	DeviceType string
+	Mode       string // e.g. persistent, independent-persistent
+	// RawDeviceMapping is "physical" or "virtual" when the disk maps a LUN instead of a VMDK, empty otherwise.
+	RawDeviceMapping string
+	// Sharing is the per-disk sharing mode, "multi-writer" for disks shared by clustered guests.
+	Sharing string
+	// SharedBus is the owning controller's bus sharing mode: none, virtual or physical.
+	SharedBus string
+	// Path is FileName resolved against the VMX directory. Set by ParseVMX only.
+	Path string
+	// Descriptor is the parsed VMDK descriptor, nil when the disk file could not be read.
+	Descriptor *vmdk.Descriptor
+	// CapacityBytes is the virtual disk size taken from the descriptor, 0 when unknown.
+	CapacityBytes uint64
+	// Provisioning is thin, thick, eagerzeroedthick or rdm as derived from the descriptor, blank for
+	// disks an OVF declares without a file, empty when unknown.
+	Provisioning string
+}
+
+// Shared reports whether the disk is written by several VMs at once, either through
+// the multi-writer flag (Oracle RAC) or a shared SCSI bus (WSFC).
+func (d Disk) Shared() bool {
+	if strings.EqualFold(d.Sharing, "multi-writer") {
+		return true
+	}
+	bus := strings.ToLower(d.SharedBus)
+	return bus == "virtual" || bus == "physical"
+}
+
+// ID returns the VMX device identifier of the disk, e.g. "scsi0:1".
+func (d Disk) ID() string {
+	return fmt.Sprintf("%s%d:%d", d.Bus, d.Controller, d.Unit)
+}
+
+// NIC is a virtual network adapter (ethernetN.*).
+type NIC struct {
+	Index int
+	// VirtualDev is the emulated adapter model: vmxnet3, e1000, e1000e, vlance, ...
+	VirtualDev  string
+	NetworkName string
+	// AddressType is generated, static or vpx.
+	AddressType string
+	// MACAddress is the static address or, failing that, the generated one.
+	MACAddress     string
+	StartConnected bool
+}
+
+// parseDevices fills the controller, disk, CD-ROM and NIC fields.
+func (c *VMXConfig) parseDevices() {
+	for _, bus := range diskBuses {
+		controllers := c.indexedKeys(bus)
+		for _, idx := range sortedIndexes(controllers) {
+			fields := controllers[idx]
+			if !fieldBool(fields, "present") {
+				continue
+			}
+			c.Controllers = append(c.Controllers, Controller{
+				Bus:        bus,
+				Index:      idx,
+				VirtualDev: fields["virtualdev"],
+				SharedBus:  fields["sharedbus"],
+			})
+		}
+	}
+
+	for _, d := range c.slotDevices() {
+		d.SharedBus, _ = c.Get(fmt.Sprintf("%s%d.sharedBus", d.Bus, d.Controller))
+		if strings.Contains(strings.ToLower(d.DeviceType), "cdrom") {
+			c.CDROMs = append(c.CDROMs, d)
+			continue
+		}
+		if !isDiskDevice(d) {
+			continue
+		}
+		d.RawDeviceMapping = rawDeviceMappingFromName(d)
+		c.Disks = append(c.Disks, d)
+	}
+
+	nics := c.indexedKeys("ethernet")
+	for _, idx := range sortedIndexes(nics) {
+		fields := nics[idx]
+		if !fieldBool(fields, "present") {
+			continue
+		}
+		mac := fields["address"]
+		if mac == "" {
+			mac = fields["generatedaddress"]
+		}
+		startConnected := true
+		if v, ok := parseBool(fields["startconnected"]); ok {
+			startConnected = v
+		}
+		c.NICs = append(c.NICs, NIC{
+			Index:          idx,
+			VirtualDev:     fields["virtualdev"],
+			NetworkName:    fields["networkname"],
+			AddressType:    fields["addresstype"],
+			MACAddress:     mac,
+			StartConnected: startConnected,
+		})
+	}
+}
+
+// slotDevices returns the present devices keyed as <bus><N>:<U>.<field>, in bus/controller/unit order.
+func (c *VMXConfig) slotDevices() []Disk {
+	type slot struct {
+		disk    Disk
+		present bool
+	}
+	slots := make(map[string]*slot)
+	for key, value := range c.lowerRaw {
+		device, field, ok := strings.Cut(key, ".")
+		if !ok {
+			continue
+		}
+		for _, bus := range diskBuses {
+			rest, ok := strings.CutPrefix(device, bus)
+			if !ok {
+				continue
+			}
+			ctrlStr, unitStr, ok := strings.Cut(rest, ":")
+			if !ok {
+				break
+			}
+			ctrl, errCtrl := strconv.Atoi(ctrlStr)
+			unit, errUnit := strconv.Atoi(unitStr)
+			if errCtrl != nil || errUnit != nil {
+				break
+			}
+			s, exists := slots[device]
+			if !exists {
+				s = &slot{disk: Disk{Bus: bus, Controller: ctrl, Unit: unit}}
+				slots[device] = s
+			}
+			switch field {
+			case "present":
+				s.present, _ = parseBool(value)
+			case "filename":
+				s.disk.FileName = value
+			case "devicetype":
+				s.disk.DeviceType = value
+			case "mode":
+				s.disk.Mode = value
+			case "sharing":
+				s.disk.Sharing = value
+			}
+			break
+		}
+	}
+
+	var devices []Disk
+	for _, s := range slots {
+		if s.present {
+			devices = append(devices, s.disk)
+		}
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		a, b := devices[i], devices[j]
+		if a.Bus != b.Bus {
+			return a.Bus < b.Bus
+		}
+		if a.Controller != b.Controller {
+			return a.Controller < b.Controller
+		}
+		return a.Unit < b.Unit
+	})
+	return devices
+}
+
+// isDiskDevice filters out non-disk devices sharing the controller namespace.
+func isDiskDevice(d Disk) bool {
+	deviceType := strings.ToLower(d.DeviceType)
+	return strings.HasSuffix(strings.ToLower(d.FileName), ".vmdk") || deviceType == "scsi-passthru"
+}
+
+// rawDeviceMappingFromName applies the -rdm/-rdmp naming convention used by vSphere for mapping files.
+func rawDeviceMappingFromName(d Disk) string {
+	if strings.EqualFold(d.DeviceType, "scsi-passthru") {
+		return "physical"
+	}
+	lowerName := strings.ToLower(d.FileName)
+	switch {
+	case strings.HasSuffix(lowerName, "-rdmp.vmdk"):
+		return "physical"
+	case strings.HasSuffix(lowerName, "-rdm.vmdk"):
+		return "virtual"
+	}
+	return ""
+}
+
+// resolveDisk locates the disk's VMDK relative to vmxDir and records its descriptor, capacity,
+// provisioning type and raw device mapping mode. When the descriptor cannot be read, raw device
+// mappings are still detected from the file name convention and the error is returned.
+func resolveDisk(vmxDir string, d *Disk) error {
+	d.Path = vmdk.ResolvePath(vmxDir, d.FileName)
+	if strings.EqualFold(d.DeviceType, "scsi-passthru") {
+		d.RawDeviceMapping = "physical"
+		d.Provisioning = "rdm"
+		return nil
+	}
+
+	text, _, err := vmdk.ExtractVMDKDescriptor(d.Path)
+	if err != nil {
+		d.RawDeviceMapping = rawDeviceMappingFromName(*d)
+		return err
+	}
+	desc, err := vmdk.ParseDescriptor(text)
+	if err != nil {
+		d.RawDeviceMapping = rawDeviceMappingFromName(*d)
+		return fmt.Errorf("failed to parse descriptor of %s: %w", d.Path, err)
+	}
+
+	d.Descriptor = desc
+	d.CapacityBytes = desc.CapacityBytes()
+	d.Provisioning = desc.Provisioning()
+	d.RawDeviceMapping = ""
+	if isRDM, physical := desc.RawDeviceMapping(); isRDM {
+		d.RawDeviceMapping = "virtual"
+		if physical {
+			d.RawDeviceMapping = "physical"
+		}
+	}
+	return nil
+}
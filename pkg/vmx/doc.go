@@ -0,0 +1,8 @@
+// Package vmx parses VMware .vmx configuration files.
+//
+// Parse and ParseVMX return a VMXConfig carrying both a typed model of the VM
+// (sizing, firmware, controllers, disks, NICs, ...) and the complete set of raw
+// key/value pairs, so callers can read settings the typed model does not cover
+// through VMXConfig.Get. The exported types are meant to be embedded in other
+// tools; fields are only ever added, not renamed or removed.
+package vmx
@@ -0,0 +1,69 @@
+package vmx
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// unescapeValue decodes the |xx escape sequences VMware uses for characters that cannot
+// appear verbatim in a VMX value, e.g. |22 for a double quote and |7C for a pipe.
+// Malformed sequences are kept as-is.
+func unescapeValue(value string) []byte {
+	if !strings.Contains(value, "|") {
+		return []byte(value)
+	}
+	out := make([]byte, 0, len(value))
+	for i := 0; i < len(value); i++ {
+		if value[i] == '|' && i+2 < len(value) {
+			if b, err := strconv.ParseUint(value[i+1:i+3], 16, 8); err == nil {
+				out = append(out, byte(b))
+				i += 2
+				continue
+			}
+		}
+		out = append(out, value[i])
+	}
+	return out
+}
+
+// lookupEncoding returns the decoder for a VMX .encoding value. UTF-8 and an empty
+// name return nil, meaning values are used as-is.
+func lookupEncoding(name string) (*encoding.Decoder, error) {
+	if name == "" || strings.EqualFold(name, "UTF-8") || strings.EqualFold(name, "UTF8") {
+		return nil, nil
+	}
+	enc, err := htmlindex.Get(name)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported VMX encoding '%s': %w", name, err)
+	}
+	return enc.NewDecoder(), nil
+}
+
+// decodeValue unescapes a raw VMX value and converts it to UTF-8 using dec.
+func decodeValue(value string, dec *encoding.Decoder) (string, error) {
+	raw := unescapeValue(value)
+	if dec == nil {
+		return string(raw), nil
+	}
+	decoded, err := dec.Bytes(raw)
+	if err != nil {
+		return "", err
+	}
+	return string(decoded), nil
+}
+
+// findEncoding scans the VMX lines for the .encoding declaration, which applies to the whole file
+// regardless of where it appears.
+func findEncoding(lines []string) string {
+	for _, line := range lines {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if ok && strings.EqualFold(strings.TrimSpace(key), ".encoding") {
+			return strings.Trim(strings.TrimSpace(value), "\"")
+		}
+	}
+	return ""
+}
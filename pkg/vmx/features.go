@@ -0,0 +1,73 @@
+package vmx
+
+import (
+	"strings"
+
+	"vmx2vmi/pkg/logging"
+)
+
+// SharedFolder is a host directory exposed to the guest through HGFS (sharedFolderN.*).
+type SharedFolder struct {
+	Index     int
+	GuestName string
+	HostPath  string
+	Enabled   bool
+	Writable  bool
+}
+
+// Isolation holds the isolation.tools.*.disable settings. A nil value means
+// the key was absent and the product default applies.
+type Isolation struct {
+	HGFSDisabled        *bool
+	DragAndDropDisabled *bool
+	CopyDisabled        *bool
+	PasteDisabled       *bool
+}
+
+// parseFeatures fills the shared folder, isolation and guestinfo fields.
+func (c *VMXConfig) parseFeatures() {
+	c.Isolation = Isolation{
+		HGFSDisabled:        c.boolPtr("isolation.tools.hgfs.disable"),
+		DragAndDropDisabled: c.boolPtr("isolation.tools.dnd.disable"),
+		CopyDisabled:        c.boolPtr("isolation.tools.copy.disable"),
+		PasteDisabled:       c.boolPtr("isolation.tools.paste.disable"),
+	}
+
+	folders := c.indexedKeys("sharedfolder")
+	for _, idx := range sortedIndexes(folders) {
+		fields := folders[idx]
+		if !fieldBool(fields, "present") {
+			continue
+		}
+		c.SharedFolders = append(c.SharedFolders, SharedFolder{
+			Index:     idx,
+			GuestName: fields["guestname"],
+			HostPath:  fields["hostpath"],
+			Enabled:   fieldBool(fields, "enabled"),
+			Writable:  fieldBool(fields, "writeaccess"),
+		})
+	}
+
+	for key, value := range c.Raw {
+		if strings.HasPrefix(strings.ToLower(key), "guestinfo.") {
+			if c.GuestInfo == nil {
+				c.GuestInfo = make(map[string]string)
+			}
+			c.GuestInfo[key] = value
+		}
+	}
+}
+
+// boolPtr returns a pointer to the boolean value of key, or nil when the key is absent or not a VMX boolean.
+func (c *VMXConfig) boolPtr(key string) *bool {
+	value, found := c.Get(key)
+	if !found {
+		return nil
+	}
+	b, ok := parseBool(value)
+	if !ok {
+		logging.Warnf("Could not parse boolean value '%s' of '%s'", value, key)
+		return nil
+	}
+	return &b
+}
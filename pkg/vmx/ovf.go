@@ -0,0 +1,79 @@
+package vmx
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"vmx2vmi/pkg/ova"
+)
+
+// IsOVF reports whether path names an OVA archive or an OVF descriptor rather than a VMX file.
+func IsOVF(path string) bool {
+	return ova.IsArchive(path) || strings.EqualFold(filepath.Ext(path), ".ovf")
+}
+
+// parseOVF parses the OVF descriptor of the OVA or OVF package at path. The disks of an OVA are
+// resolved to <archive>.ova/<member> paths, which the VMDK readers open in place. SourceSHA256
+// is the digest of the OVF descriptor.
+func parseOVF(path string) (*VMXConfig, error) {
+	var descriptor []byte
+	diskDir := filepath.Dir(path)
+	if ova.IsArchive(path) {
+		archive, err := ova.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer archive.Close()
+		if _, descriptor, err = archive.Descriptor(); err != nil {
+			return nil, err
+		}
+		diskDir = path
+	} else {
+		var err error
+		if descriptor, err = os.ReadFile(path); err != nil {
+			return nil, fmt.Errorf("failed to read OVF descriptor %s: %w", path, err)
+		}
+	}
+
+	envelope, err := ova.ParseEnvelope(descriptor)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	content, disks, err := envelope.VMX()
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert the OVF of %s: %w", path, err)
+	}
+	config, err := Parse(content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the OVF of %s: %w", path, err)
+	}
+	sum := sha256.Sum256(descriptor)
+	config.SourceSHA256 = hex.EncodeToString(sum[:])
+
+	for i := range config.Disks {
+		d := &config.Disks[i]
+		disk := disks[d.FileName]
+		if disk.Href == "" {
+			// Blank disks of the OVF have no file; the claim is created empty.
+			d.Path = filepath.Join(diskDir, d.FileName)
+			d.CapacityBytes = disk.CapacityBytes
+			d.Provisioning = "blank"
+			continue
+		}
+		if err := resolveDisk(diskDir, d); err != nil {
+			return nil, fmt.Errorf("failed to read disk %s of %s: %w", d.FileName, path, err)
+		}
+		if d.CapacityBytes == 0 {
+			d.CapacityBytes = disk.CapacityBytes
+		}
+		if desc := d.Descriptor; desc != nil && desc.Encrypted {
+			config.Encrypted = true
+		}
+	}
+	config.defaultDisplayName(path)
+	return config, nil
+}
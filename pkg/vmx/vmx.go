@@ -1,12 +1,17 @@
 package vmx
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+
+	"vmx2vmi/pkg/failure"
+	"vmx2vmi/pkg/logging"
 )
 
 // VMXConfig holds extracted VMX data
@@ -14,20 +19,215 @@ type VMXConfig struct {
 	DisplayName string
 	NumVCPUs    uint32
 	MemoryMiB   int64 // VMX memsize is typically in MB
+	// CoresPerSocket is cpuid.coresPerSocket, 0 when unset.
+	CoresPerSocket uint32
+	// GuestOS is the VMware guest OS identifier, e.g. "otherlinux-64" or "windows2019srv-64".
+	GuestOS string
+	// VirtualHWVersion is the virtual hardware version (virtualHW.version), 0 when unset.
+	VirtualHWVersion int
+	// Firmware is "bios" or "efi".
+	Firmware string
+	// SecureBoot reports whether UEFI secure boot is enabled (uefi.secureBoot.enabled).
+	SecureBoot bool
+	// NestedVirtualization reports whether hardware virtualization is exposed to the guest (vhv.enable).
+	NestedVirtualization bool
+	// DiskEnableUUID reports whether disk UUIDs are exposed to the guest as serials (disk.EnableUUID).
+	DiskEnableUUID bool
+	// ToolsDetected reports whether the VMX carries VMware Tools settings (tools.*, toolsInstallManager.*),
+	// a strong hint that VMware Tools or open-vm-tools is installed in the guest.
+	ToolsDetected bool
+	// Template reports whether the VM is a vSphere template: its configuration is a .vmtx file or,
+	// read from vCenter, the VM has the template flag.
+	Template bool
+	// Encrypted reports whether VM encryption is enabled (encryption.bundle, encryption.keySafe)
+	// or, after ParseVMX, whether any disk descriptor is encrypted.
+	Encrypted bool
+	// Scheduling holds the vSphere resource allocation settings (sched.*).
+	Scheduling Scheduling
+	// SourceSHA256 is the hex encoded sha256 of the VMX file content, used to detect source drift between runs.
+	SourceSHA256 string
+	// SharedFolders lists the HGFS shared folders configured for the VM.
+	SharedFolders []SharedFolder
+	// Isolation captures the VMware Tools host/guest isolation toggles.
+	Isolation Isolation
+	// Controllers lists the storage controllers present in the VM.
+	Controllers []Controller
+	// Disks lists the virtual disks attached to the VM, in controller/unit order.
+	Disks []Disk
+	// CDROMs lists the CD/DVD drives attached to the VM, in controller/unit order.
+	CDROMs []Disk
+	// NICs lists the network adapters present in the VM, in ethernetN order.
+	NICs []NIC
+	// GuestInfo holds guestinfo.* keys, typically used by virtual appliances for first-boot configuration.
+	GuestInfo map[string]string
+	// Raw holds every key/value pair of the file, keys as written and values unescaped and decoded.
+	// VMX keys are case-insensitive; use Get for lookups.
+	Raw map[string]string
+
+	lowerRaw map[string]string
+}
+
+// Scheduling holds the vSphere CPU and memory resource allocation of the VM.
+type Scheduling struct {
+	// CPUAffinity is the list of host CPUs the VM is pinned to, e.g. "0,1,2,3". Empty means no pinning.
+	CPUAffinity string
+	// CPUShares is low, normal, high or a custom share count.
+	CPUShares string
+	// CPUMinMHz is the CPU reservation in MHz.
+	CPUMinMHz int64
+	// MemShares is low, normal, high or a custom share count.
+	MemShares string
+	// MemMinMiB is the memory reservation in MiB.
+	MemMinMiB int64
+}
+
+// CPUShareLevel normalizes CPUShares to low, normal or high. Custom share counts are compared
+// with vSphere's per-vCPU defaults (500 low, 1000 normal, 2000 high).
+func (c *VMXConfig) CPUShareLevel() string {
+	shares := strings.ToLower(c.Scheduling.CPUShares)
+	switch shares {
+	case "", "normal":
+		return "normal"
+	case "low", "high":
+		return shares
+	}
+	n, err := strconv.ParseInt(shares, 10, 64)
+	if err != nil {
+		return "normal"
+	}
+	perCPU := n / int64(max(c.NumVCPUs, 1))
+	switch {
+	case perCPU >= 2000:
+		return "high"
+	case perCPU <= 500:
+		return "low"
+	}
+	return "normal"
+}
+
+// GuestOSFamily classifies GuestOS as "windows", "linux" or "other".
+func (c *VMXConfig) GuestOSFamily() string {
+	guest := strings.ToLower(c.GuestOS)
+	switch {
+	case strings.HasPrefix(guest, "win"):
+		return "windows"
+	case strings.Contains(guest, "linux"):
+		return "linux"
+	}
+	for _, distro := range []string{"rhel", "centos", "ubuntu", "debian", "sles", "suse", "oracle", "fedora", "mandrake", "mandriva", "turbolinux", "asianux", "amazonlinux", "photon", "coreos", "almalinux", "rockylinux", "vmware-photon"} {
+		if strings.HasPrefix(guest, distro) {
+			return "linux"
+		}
+	}
+	return "other"
+}
+
+// Get returns the value of a VMX key, matched case-insensitively.
+func (c *VMXConfig) Get(key string) (string, bool) {
+	v, ok := c.lowerRaw[strings.ToLower(key)]
+	return v, ok
+}
+
+// GetBool returns the boolean value of a VMX key. ok is false when the key is absent or not a boolean.
+func (c *VMXConfig) GetBool(key string) (value bool, ok bool) {
+	v, found := c.Get(key)
+	if !found {
+		return false, false
+	}
+	return parseBool(v)
+}
+
+// GetInt returns the integer value of a VMX key. ok is false when the key is absent or not an integer.
+func (c *VMXConfig) GetInt(key string) (value int64, ok bool) {
+	v, found := c.Get(key)
+	if !found {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	return n, err == nil
+}
+
+// parseBool interprets VMX boolean values ("TRUE", "FALSE", "yes", "1", ...).
+func parseBool(value string) (bool, bool) {
+	switch strings.ToLower(value) {
+	case "true", "yes", "1":
+		return true, true
+	case "false", "no", "0":
+		return false, true
+	}
+	return false, false
 }
 
+// ParseVMX reads and parses the VMX file at vmxPath. In addition to Parse, it follows each
+// disk's fileName relative to the VMX directory to record its descriptor, virtual size,
+// provisioning type and raw device mapping mode, and falls back to the file name when the
+// VMX has no displayName. OVA archives and OVF descriptors are read as the VMX VMware would
+// create when deploying them, with their disks inside the archive or next to the descriptor.
 func ParseVMX(vmxPath string) (*VMXConfig, error) {
+	config, err := parseVMX(vmxPath)
+	return config, failure.Wrap(failure.Parse, err)
+}
+
+func parseVMX(vmxPath string) (*VMXConfig, error) {
+	if IsOVF(vmxPath) {
+		return parseOVF(vmxPath)
+	}
 	content, err := os.ReadFile(vmxPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read VMX file %s: %w", vmxPath, err)
 	}
 
+	config, err := Parse(content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse VMX file %s: %w", vmxPath, err)
+	}
+
+	config.resolveDisks(filepath.Dir(vmxPath))
+	config.defaultDisplayName(vmxPath)
+	config.Template = strings.EqualFold(filepath.Ext(vmxPath), ".vmtx")
+	return config, nil
+}
+
+// resolveDisks resolves the disks against the VMX directory, see resolveDisk.
+func (c *VMXConfig) resolveDisks(vmxDir string) {
+	for i := range c.Disks {
+		if err := resolveDisk(vmxDir, &c.Disks[i]); err != nil {
+			logging.Warnf("Could not read descriptor of disk %s (%s), its size is unknown: %v", c.Disks[i].ID(), c.Disks[i].FileName, err)
+		}
+		if desc := c.Disks[i].Descriptor; desc != nil && desc.Encrypted {
+			c.Encrypted = true
+		}
+	}
+}
+
+// defaultDisplayName names the VM after its configuration file when the VMX has no displayName.
+func (c *VMXConfig) defaultDisplayName(vmxPath string) {
+	if c.DisplayName == "" {
+		baseName := filepath.Base(vmxPath)
+		c.DisplayName = strings.TrimSuffix(baseName, filepath.Ext(baseName))
+		logging.Warnf("'displayName' not found in VMX, using filename '%s' as fallback.", c.DisplayName)
+	}
+}
+
+// Parse parses VMX content without touching the filesystem. Raw device mappings can only be
+// detected from the disk file name here; ParseVMX also inspects the disk descriptors.
+func Parse(content []byte) (*VMXConfig, error) {
+	sum := sha256.Sum256(content)
 	config := &VMXConfig{
-		NumVCPUs:  1,    // Default VCPUs
-		MemoryMiB: 1024, // Default Memory (1GiB)
+		NumVCPUs:     1,    // Default VCPUs
+		MemoryMiB:    1024, // Default Memory (1GiB)
+		Firmware:     "bios",
+		SourceSHA256: hex.EncodeToString(sum[:]),
+		Raw:          make(map[string]string),
+		lowerRaw:     make(map[string]string),
 	}
 	lines := strings.Split(string(content), "\n")
 
+	decoder, err := lookupEncoding(findEncoding(lines))
+	if err != nil {
+		return nil, err
+	}
+
 	for _, line := range lines {
 		line = strings.TrimSpace(line)
 		if line == "" || strings.HasPrefix(line, "#") {
@@ -42,30 +242,127 @@ func ParseVMX(vmxPath string) (*VMXConfig, error) {
 		key := strings.TrimSpace(parts[0])
 		value := strings.TrimSpace(parts[1])
 		value = strings.Trim(value, "\"")
+		if decoded, errDecode := decodeValue(value, decoder); errDecode == nil {
+			value = decoded
+		} else {
+			logging.Warnf("Could not decode value of '%s': %v", key, errDecode)
+		}
 
-		switch strings.ToLower(key) {
-		case "displayname":
-			config.DisplayName = value
-		case "numvcpus":
-			if cpus, errConv := strconv.ParseUint(value, 10, 32); errConv == nil {
-				config.NumVCPUs = uint32(cpus)
-			} else {
-				log.Printf("Warning: could not parse numvcpus value '%s': %v", value, errConv)
-			}
-		case "memsize":
-			if mem, errConv := strconv.ParseInt(value, 10, 64); errConv == nil {
-				config.MemoryMiB = mem
-			} else {
-				log.Printf("Warning: could not parse memsize value '%s': %v", value, errConv)
+		// Later occurrences of a key override earlier ones, as in VMware products.
+		lowerKey := strings.ToLower(key)
+		if _, dup := config.lowerRaw[lowerKey]; dup {
+			for k := range config.Raw {
+				if strings.ToLower(k) == lowerKey {
+					delete(config.Raw, k)
+				}
 			}
 		}
+		config.Raw[key] = value
+		config.lowerRaw[lowerKey] = value
 	}
 
-	if config.DisplayName == "" {
-		baseName := filepath.Base(vmxPath)
-		config.DisplayName = strings.TrimSuffix(baseName, filepath.Ext(baseName))
-		log.Printf("Warning: 'displayName' not found in VMX, using filename '%s' as fallback.", config.DisplayName)
+	config.parseGeneral()
+	config.parseFeatures()
+	config.parseDevices()
+	return config, nil
+}
+
+// parseGeneral fills the sizing, guest and firmware fields.
+func (c *VMXConfig) parseGeneral() {
+	c.DisplayName, _ = c.Get("displayName")
+	c.GuestOS, _ = c.Get("guestOS")
+
+	if value, ok := c.Get("numvcpus"); ok {
+		if cpus, errConv := strconv.ParseUint(value, 10, 32); errConv == nil {
+			c.NumVCPUs = uint32(cpus)
+		} else {
+			logging.Warnf("Could not parse numvcpus value '%s': %v", value, errConv)
+		}
+	}
+	if value, ok := c.Get("memsize"); ok {
+		if mem, errConv := strconv.ParseInt(value, 10, 64); errConv == nil {
+			c.MemoryMiB = mem
+		} else {
+			logging.Warnf("Could not parse memsize value '%s': %v", value, errConv)
+		}
+	}
+	if value, ok := c.Get("cpuid.coresPerSocket"); ok {
+		if cores, errConv := strconv.ParseUint(value, 10, 32); errConv == nil {
+			c.CoresPerSocket = uint32(cores)
+		} else {
+			logging.Warnf("Could not parse cpuid.coresPerSocket value '%s': %v", value, errConv)
+		}
+	}
+	if hw, ok := c.GetInt("virtualHW.version"); ok {
+		c.VirtualHWVersion = int(hw)
+	}
+	if firmware, ok := c.Get("firmware"); ok && strings.EqualFold(firmware, "efi") {
+		c.Firmware = "efi"
 	}
+	c.SecureBoot, _ = c.GetBool("uefi.secureBoot.enabled")
+	c.DiskEnableUUID, _ = c.GetBool("disk.EnableUUID")
+	c.NestedVirtualization, _ = c.GetBool("vhv.enable")
 
-	return config, nil
+	for _, key := range []string{"encryption.bundle", "encryption.keySafe", "encryption.data"} {
+		if _, ok := c.Get(key); ok {
+			c.Encrypted = true
+		}
+	}
+
+	for key := range c.lowerRaw {
+		if strings.HasPrefix(key, "tools.") || strings.HasPrefix(key, "toolsinstallmanager.") {
+			c.ToolsDetected = true
+			break
+		}
+	}
+
+	c.Scheduling.CPUAffinity, _ = c.Get("sched.cpu.affinity")
+	if strings.EqualFold(c.Scheduling.CPUAffinity, "all") {
+		c.Scheduling.CPUAffinity = ""
+	}
+	c.Scheduling.CPUShares, _ = c.Get("sched.cpu.shares")
+	c.Scheduling.CPUMinMHz, _ = c.GetInt("sched.cpu.min")
+	c.Scheduling.MemShares, _ = c.Get("sched.mem.shares")
+	c.Scheduling.MemMinMiB, _ = c.GetInt("sched.mem.min")
+}
+
+// indexedKeys groups raw keys of the form <prefix><N>.<field> by N, with lower-cased field names.
+// Keys with a non-numeric index (e.g. sharedFolder.maxNum, scsi0:0.present) are skipped.
+func (c *VMXConfig) indexedKeys(prefix string) map[int]map[string]string {
+	groups := make(map[int]map[string]string)
+	for key, value := range c.lowerRaw {
+		rest, ok := strings.CutPrefix(key, prefix)
+		if !ok {
+			continue
+		}
+		idxStr, field, ok := strings.Cut(rest, ".")
+		if !ok {
+			continue
+		}
+		idx, err := strconv.Atoi(idxStr)
+		if err != nil {
+			continue
+		}
+		if groups[idx] == nil {
+			groups[idx] = make(map[string]string)
+		}
+		groups[idx][field] = value
+	}
+	return groups
+}
+
+// sortedIndexes returns the keys of groups in ascending order.
+func sortedIndexes(groups map[int]map[string]string) []int {
+	indexes := make([]int, 0, len(groups))
+	for idx := range groups {
+		indexes = append(indexes, idx)
+	}
+	sort.Ints(indexes)
+	return indexes
+}
+
+// fieldBool parses a boolean field of a device group, returning false when absent or invalid.
+func fieldBool(fields map[string]string, name string) bool {
+	b, _ := parseBool(fields[name])
+	return b
 }
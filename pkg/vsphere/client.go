@@ -0,0 +1,271 @@
+// Package vsphere reads VM configurations from vCenter or ESXi through the VI/JSON API, the JSON
+// binding of the vSphere Web Services (vim25) API served by vSphere 8.0 Update 1 and later.
+// It is a minimal client, like the Kubernetes client of package cluster: it logs in, looks VMs
+// up, lists them and reads their properties. It only changes the inventory to snapshot VMs and
+// power them off for warm migrations.
+package vsphere
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// APIRelease is the vim25 release the requests are made against. vSphere serves every release
+// from 8.0.1.0, the first with the VI/JSON API, up to its own.
+const APIRelease = "8.0.1.0"
+
+// requestTimeout bounds each API call; downloads are only bounded by their context.
+const requestTimeout = 60 * time.Second
+
+// Config locates and authenticates to a vCenter or ESXi host.
+type Config struct {
+	// URL is the https URL of the host; a trailing /sdk is ignored.
+	URL      string
+	Username string
+	Password string
+	Insecure bool
+	// Thumbprint pins the certificate of the host by its SHA-1 or SHA-256 fingerprint, e.g.
+	// 9A:3C:...:E1, instead of verifying it against the system roots.
+	Thumbprint string
+}
+
+// Client is a VI/JSON session.
+type Client struct {
+	config Config
+	// host is the scheme and host of the URL, e.g. https://vcenter.example.com.
+	host    string
+	base    string
+	session string
+	http    *http.Client
+	content serviceContent
+}
+
+// MoRef is a managed object reference, e.g. {VirtualMachine vm-42}.
+type MoRef struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// MarshalJSON writes ref with the type name VI/JSON expects of managed object references in requests.
+func (ref MoRef) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		TypeName string `json:"_typeName"`
+		Type     string `json:"type"`
+		Value    string `json:"value"`
+	}{"ManagedObjectReference", ref.Type, ref.Value})
+}
+
+// serviceContent is the subset of the ServiceInstance content locating the managers. The
+// manager IDs differ between vCenter (SessionManager) and ESXi (ha-sessionmgr).
+type serviceContent struct {
+	About struct {
+		FullName   string `json:"fullName"`
+		APIType    string `json:"apiType"` // VirtualCenter or HostAgent
+		APIVersion string `json:"apiVersion"`
+	} `json:"about"`
+	RootFolder        MoRef `json:"rootFolder"`
+	PropertyCollector MoRef `json:"propertyCollector"`
+	ViewManager       MoRef `json:"viewManager"`
+	SessionManager    MoRef `json:"sessionManager"`
+	SearchIndex       MoRef `json:"searchIndex"`
+}
+
+// Fault is a vSphere fault returned by the API, e.g. InvalidLogin or ManagedObjectNotFound.
+type Fault struct {
+	Code    int
+	Type    string
+	Message string
+}
+
+func (f *Fault) Error() string {
+	if f.Message != "" {
+		return fmt.Sprintf("%s (%d): %s", f.Type, f.Code, f.Message)
+	}
+	return fmt.Sprintf("%s (%d)", f.Type, f.Code)
+}
+
+// IsNotFound reports whether err is a ManagedObjectNotFound fault.
+func IsNotFound(err error) bool {
+	var fault *Fault
+	return errors.As(err, &fault) && (fault.Type == "ManagedObjectNotFound" || fault.Code == http.StatusNotFound)
+}
+
+// Login opens a session on the host of cfg. Close it with Logout.
+func Login(ctx context.Context, cfg Config) (*Client, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid vSphere URL '%s', e.g. https://vcenter.example.com", cfg.URL)
+	}
+	u.Path = strings.TrimSuffix(strings.TrimSuffix(u.Path, "/"), "/sdk")
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.Insecure}
+	if cfg.Thumbprint != "" {
+		if tlsConfig, err = pinnedTLSConfig(cfg.Thumbprint); err != nil {
+			return nil, err
+		}
+	}
+	c := &Client{
+		config: cfg,
+		host:   u.Scheme + "://" + u.Host,
+		base:   u.String() + "/sdk/vim25/" + APIRelease,
+		http:   &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment}},
+	}
+	if _, err := c.do(ctx, http.MethodGet, "/ServiceInstance/ServiceInstance/content", nil, &c.content); err != nil {
+		var fault *Fault
+		if errors.As(err, &fault) && fault.Code == http.StatusNotFound {
+			return nil, fmt.Errorf("%s does not serve the VI/JSON API, which needs vSphere 8.0 Update 1 or later: %w", cfg.URL, err)
+		}
+		return nil, err
+	}
+	header, err := c.do(ctx, http.MethodPost, c.path(c.content.SessionManager, "Login"), map[string]string{
+		"userName": cfg.Username,
+		"password": cfg.Password,
+	}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to log in to %s as %s: %w", cfg.URL, cfg.Username, err)
+	}
+	c.session = header.Get("vmware-api-session-id")
+	if c.session == "" {
+		return nil, fmt.Errorf("failed to log in to %s: no session ID in the response", cfg.URL)
+	}
+	return c, nil
+}
+
+// pinnedTLSConfig accepts the certificate whose SHA-1 or SHA-256 fingerprint is thumbprint, and
+// no other, whatever its issuer and names.
+func pinnedTLSConfig(thumbprint string) (*tls.Config, error) {
+	want, err := hex.DecodeString(strings.NewReplacer(":", "", " ", "").Replace(thumbprint))
+	if err != nil || len(want) != sha1.Size && len(want) != sha256.Size {
+		return nil, fmt.Errorf("invalid thumbprint '%s', expected the hex SHA-1 or SHA-256 fingerprint of the certificate", thumbprint)
+	}
+	return &tls.Config{
+		// The chain is not verified, the fingerprint of the leaf certificate is.
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return fmt.Errorf("the host sent no certificate")
+			}
+			raw := state.PeerCertificates[0].Raw
+			var got []byte
+			if len(want) == sha1.Size {
+				sum := sha1.Sum(raw)
+				got = sum[:]
+			} else {
+				sum := sha256.Sum256(raw)
+				got = sum[:]
+			}
+			if !bytes.Equal(got, want) {
+				return fmt.Errorf("the certificate of the host has the thumbprint %X, not %X", got, want)
+			}
+			return nil
+		},
+	}, nil
+}
+
+// Product returns the product name and version of the host, e.g. VMware vCenter Server 8.0.2.
+func (c *Client) Product() string {
+	return c.content.About.FullName
+}
+
+// IsVCenter reports whether the session is on a vCenter rather than a standalone ESXi host.
+func (c *Client) IsVCenter() bool {
+	return c.content.About.APIType == "VirtualCenter"
+}
+
+// Logout closes the session.
+func (c *Client) Logout(ctx context.Context) error {
+	_, err := c.do(ctx, http.MethodPost, c.path(c.content.SessionManager, "Logout"), nil, nil)
+	return err
+}
+
+// Property reads a property of a managed object, e.g. the config of a VirtualMachine, into out.
+func (c *Client) Property(ctx context.Context, ref MoRef, name string, out any) error {
+	_, err := c.do(ctx, http.MethodGet, c.path(ref, name), nil, out)
+	return err
+}
+
+// Invoke calls a method of a managed object with the JSON parameters of args and decodes its
+// result into out. Methods returning nothing leave out unchanged.
+func (c *Client) Invoke(ctx context.Context, ref MoRef, method string, args, out any) error {
+	if args == nil {
+		args = struct{}{}
+	}
+	_, err := c.do(ctx, http.MethodPost, c.path(ref, method), args, out)
+	return err
+}
+
+func (c *Client) path(ref MoRef, member string) string {
+	return "/" + ref.Type + "/" + url.PathEscape(ref.Value) + "/" + member
+}
+
+// do sends body as JSON to path and decodes the response into out when both are set. It returns
+// the response headers.
+func (c *Client) do(ctx context.Context, method, path string, body, out any) (http.Header, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode request: %w", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.session != "" {
+		req.Header.Set("vmware-api-session-id", c.session)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w", method, path, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: failed to read response: %w", method, path, err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		fault := &Fault{Code: resp.StatusCode, Type: http.StatusText(resp.StatusCode)}
+		var body struct {
+			Type         string `json:"_typeName"`
+			FaultMessage []struct {
+				Message string `json:"message"`
+			} `json:"faultMessage"`
+		}
+		if json.Unmarshal(data, &body) == nil {
+			if body.Type != "" {
+				fault.Type = body.Type
+			}
+			for _, m := range body.FaultMessage {
+				fault.Message = strings.TrimSpace(fault.Message + " " + m.Message)
+			}
+		}
+		return nil, fmt.Errorf("%s %s: %w", method, path, fault)
+	}
+	if out != nil && len(bytes.TrimSpace(data)) > 0 {
+		if err := json.Unmarshal(data, out); err != nil {
+			return nil, fmt.Errorf("%s %s: failed to decode response: %w", method, path, err)
+		}
+	}
+	return resp.Header, nil
+}
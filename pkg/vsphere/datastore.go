@@ -0,0 +1,345 @@
+package vsphere
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"vmx2vmi/pkg/failure"
+	"vmx2vmi/pkg/logging"
+	"vmx2vmi/pkg/vmdk"
+	"vmx2vmi/pkg/vmx"
+)
+
+// DatastorePath is a file on a datastore, written "[datastore1] web01/web01.vmdk".
+type DatastorePath struct {
+	Datastore string
+	Path      string
+}
+
+func (p DatastorePath) String() string {
+	return "[" + p.Datastore + "] " + p.Path
+}
+
+// ParseDatastorePath parses a "[datastore] path" file name.
+func ParseDatastorePath(name string) (DatastorePath, error) {
+	rest, ok := strings.CutPrefix(strings.TrimSpace(name), "[")
+	datastore, filePath, found := strings.Cut(rest, "]")
+	if !ok || !found || datastore == "" {
+		return DatastorePath{}, fmt.Errorf("invalid datastore path '%s', e.g. [datastore1] web01/web01.vmx", name)
+	}
+	return DatastorePath{Datastore: datastore, Path: strings.TrimSpace(filePath)}, nil
+}
+
+// resolve returns the datastore path of a file referenced from the directory of p: relative names
+// are in the same directory, and /vmfs/volumes/<datastore>/<path> names are on another datastore.
+func (p DatastorePath) resolve(name string) DatastorePath {
+	if rest, ok := strings.CutPrefix(name, "/vmfs/volumes/"); ok {
+		datastore, filePath, _ := strings.Cut(rest, "/")
+		return DatastorePath{Datastore: datastore, Path: filePath}
+	}
+	if strings.HasPrefix(name, "[") {
+		if resolved, err := ParseDatastorePath(name); err == nil {
+			return resolved
+		}
+	}
+	return DatastorePath{Datastore: p.Datastore, Path: path.Join(path.Dir(p.Path), name)}
+}
+
+// DownloadOptions configures Download and DownloadVM.
+type DownloadOptions struct {
+	// Retries is the number of additional attempts after a transient failure; each attempt
+	// resumes where the previous one stopped.
+	Retries int
+	// Throttle, when set, wraps the data stream (e.g. a Limiter's LimitReader).
+	Throttle func(io.Reader) io.Reader
+	// Progress, when set, is called with the name and size of each file once its download
+	// starts, and returns a function called with the number of bytes written so far.
+	Progress func(name string, size int64) func(written int64)
+	// OnRetry, when set, is called with the name of a file before each retry of its download.
+	OnRetry func(name string)
+}
+
+// DatacenterPath returns the inventory path of the datacenter holding ref, e.g. DC1 or
+// Region/DC1, which locates its datastores in the datastore file API.
+func (c *Client) DatacenterPath(ctx context.Context, ref MoRef) (string, error) {
+	if !c.IsVCenter() {
+		return standaloneDatacenter, nil
+	}
+	var names []string
+	inDatacenter := false
+	for current := &ref; current != nil; {
+		if inDatacenter || current.Type == "Datacenter" {
+			inDatacenter = true
+			var name string
+			if err := c.Property(ctx, *current, "name", &name); err != nil {
+				return "", fmt.Errorf("failed to read the name of %s %s: %w", current.Type, current.Value, err)
+			}
+			names = append([]string{name}, names...)
+		}
+		var parent *MoRef
+		if err := c.Property(ctx, *current, "parent", &parent); err != nil {
+			return "", fmt.Errorf("failed to read the parent of %s %s: %w", current.Type, current.Value, err)
+		}
+		current = parent
+	}
+	if !inDatacenter {
+		return "", fmt.Errorf("%s %s is in no datacenter", ref.Type, ref.Value)
+	}
+	// The root folder of the inventory is not part of the path.
+	return strings.Join(names[1:], "/"), nil
+}
+
+// Download copies a datastore file to dst through the datastore file API (/folder) of the host,
+// with the session of the client. An existing, shorter dst is taken as an interrupted download
+// of the same file and resumed; transient failures are retried from where they stopped.
+func (c *Client) Download(ctx context.Context, datacenter string, src DatastorePath, dst string, opts DownloadOptions) (int64, error) {
+	n, err := c.download(ctx, datacenter, src, dst, opts)
+	return n, failure.Wrap(failure.Transfer, err)
+}
+
+func (c *Client) download(ctx context.Context, datacenter string, src DatastorePath, dst string, opts DownloadOptions) (int64, error) {
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create %s: %w", dst, err)
+	}
+	defer out.Close()
+	offset, err := out.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+
+	var progress func(int64)
+	for attempt := 0; ; attempt++ {
+		size, downloadErr := c.downloadFrom(ctx, datacenter, src, out, offset, opts, &progress)
+		if downloadErr == nil {
+			return size, out.Sync()
+		}
+		var fault *Fault
+		if errors.As(downloadErr, &fault) && fault.Code >= 400 && fault.Code < 500 || attempt >= opts.Retries || ctx.Err() != nil {
+			return 0, fmt.Errorf("failed to download %s: %w", src, downloadErr)
+		}
+		if offset, err = out.Seek(0, io.SeekEnd); err != nil {
+			return 0, err
+		}
+		delay := time.Duration(attempt+1) * 5 * time.Second
+		logging.Warnf("Download attempt %d of %s stopped at %d bytes, retrying in %s: %v", attempt+1, src, offset, delay, downloadErr)
+		if opts.OnRetry != nil {
+			opts.OnRetry(src.String())
+		}
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// downloadFrom appends the content of src from offset on to out and returns the size of src.
+func (c *Client) downloadFrom(ctx context.Context, datacenter string, src DatastorePath, out *os.File, offset int64, opts DownloadOptions, progress *func(int64)) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.fileURL(datacenter, src), nil)
+	if err != nil {
+		return 0, err
+	}
+	// The datastore file API takes the session as the SOAP session cookie.
+	req.AddCookie(&http.Cookie{Name: "vmware_soap_session", Value: c.session})
+	req.Header.Set("vmware-api-session-id", c.session)
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	size := resp.ContentLength
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// The host ignored the range or the file is new: start over.
+		if offset > 0 {
+			if err := out.Truncate(0); err != nil {
+				return 0, err
+			}
+			if _, err := out.Seek(0, io.SeekStart); err != nil {
+				return 0, err
+			}
+			offset = 0
+		}
+	case http.StatusPartialContent:
+		_, total, _ := strings.Cut(resp.Header.Get("Content-Range"), "/")
+		if size, err = strconv.ParseInt(total, 10, 64); err != nil {
+			return 0, fmt.Errorf("invalid Content-Range '%s'", resp.Header.Get("Content-Range"))
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The file was complete already.
+		return offset, nil
+	case http.StatusNotFound:
+		return 0, &Fault{Code: resp.StatusCode, Type: "FileNotFound", Message: src.String() + " does not exist"}
+	default:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return 0, &Fault{Code: resp.StatusCode, Type: http.StatusText(resp.StatusCode), Message: strings.TrimSpace(string(body))}
+	}
+
+	if *progress == nil && opts.Progress != nil {
+		*progress = opts.Progress(src.String(), size)
+	}
+	var reader io.Reader = resp.Body
+	if opts.Throttle != nil {
+		reader = opts.Throttle(reader)
+	}
+	written := offset
+	buf := make([]byte, 1<<20)
+	for {
+		n, readErr := reader.Read(buf)
+		if n > 0 {
+			if _, err := out.Write(buf[:n]); err != nil {
+				return 0, err
+			}
+			written += int64(n)
+			if *progress != nil {
+				(*progress)(written)
+			}
+		}
+		if errors.Is(readErr, io.EOF) {
+			break
+		}
+		if readErr != nil {
+			return 0, readErr
+		}
+	}
+	if size >= 0 && written != size {
+		return 0, fmt.Errorf("the transfer ended at %d of %d bytes", written, size)
+	}
+	return written, nil
+}
+
+// fileURL returns the datastore file API URL of p, e.g.
+// https://vcenter/folder/web01/web01.vmx?dcPath=DC1&dsName=datastore1.
+func (c *Client) fileURL(datacenter string, p DatastorePath) string {
+	u, _ := url.Parse(c.host)
+	u.Path = "/folder/" + p.Path
+	u.RawQuery = url.Values{"dcPath": {datacenter}, "dsName": {p.Datastore}}.Encode()
+	return u.String()
+}
+
+// DownloadVM copies the files the VM named by ref runs from into a directory named after the VM
+// in dir: its VMX, its NVRAM and, for each disk, the descriptors and extents of the whole
+// snapshot chain. Disks on other datastores or directories land in the same directory, where
+// ParseVMX and the disk readers look for them.
+// Raw device mappings are left out, their data is on the mapped LUN. It returns the path of the
+// downloaded VMX.
+func (c *Client) DownloadVM(ctx context.Context, ref string, dir string, opts DownloadOptions) (string, error) {
+	vm, err := c.FindVM(ctx, ref)
+	if err != nil {
+		return "", err
+	}
+	config, err := c.VMConfig(ctx, vm)
+	if err != nil {
+		return "", err
+	}
+	datacenter, err := c.DatacenterPath(ctx, vm)
+	if err != nil {
+		return "", err
+	}
+	vmxFile, err := ParseDatastorePath(config.Files.VMPathName)
+	if err != nil {
+		return "", fmt.Errorf("VM %s: %w", config.Name, err)
+	}
+	dir = filepath.Join(dir, strings.ReplaceAll(config.Name, "/", "_"))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+
+	// local maps the local file names to their datastore files, as two files of the same name
+	// cannot share dir. Only extents resume an earlier download; the VMX, NVRAM and descriptors
+	// are small and change as the VM runs, so they are downloaded again.
+	local := make(map[string]DatastorePath)
+	download := func(src DatastorePath, resume bool) (string, error) {
+		name := path.Base(src.Path)
+		if other, ok := local[name]; ok {
+			if other == src {
+				return filepath.Join(dir, name), nil
+			}
+			return "", fmt.Errorf("%s and %s have the same file name and cannot be downloaded into one directory", other, src)
+		}
+		local[name] = src
+		dst := filepath.Join(dir, name)
+		if !resume {
+			if err := os.Remove(dst); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return "", err
+			}
+		}
+		if _, err := c.Download(ctx, datacenter, src, dst, opts); err != nil {
+			return "", err
+		}
+		return dst, nil
+	}
+
+	vmxPath, err := download(vmxFile, false)
+	if err != nil {
+		return "", err
+	}
+	content, err := os.ReadFile(vmxPath)
+	if err != nil {
+		return "", err
+	}
+	vmxConfig, err := vmx.Parse(content)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse %s: %w", vmxFile, err)
+	}
+	if nvram, ok := vmxConfig.Get("nvram"); ok && nvram != "" {
+		if _, err := download(vmxFile.resolve(nvram), false); err != nil {
+			var fault *Fault
+			if !errors.As(err, &fault) || fault.Code != http.StatusNotFound {
+				return "", err
+			}
+			// VMs that never powered on have no NVRAM yet.
+			delete(local, path.Base(nvram))
+			os.Remove(filepath.Join(dir, path.Base(nvram)))
+		}
+	}
+
+	for _, d := range vmxConfig.Disks {
+		for descriptor := vmxFile.resolve(d.FileName); ; {
+			descriptorPath, err := download(descriptor, false)
+			if err != nil {
+				return "", fmt.Errorf("disk %s: %w", d.ID(), err)
+			}
+			text, isVMDK, err := vmdk.ExtractVMDKDescriptor(descriptorPath)
+			if err != nil || !isVMDK {
+				return "", fmt.Errorf("disk %s: %s is not a VMDK descriptor: %v", d.ID(), descriptor, err)
+			}
+			desc, err := vmdk.ParseDescriptor(text)
+			if err != nil {
+				return "", fmt.Errorf("disk %s: %w", d.ID(), err)
+			}
+			if isRDM, _ := desc.RawDeviceMapping(); isRDM {
+				break
+			}
+			for _, extent := range desc.Extents {
+				// Sparse disks hold their descriptor in their only extent.
+				if extent.Type == "ZERO" || descriptor.resolve(extent.FileName) == descriptor {
+					continue
+				}
+				if _, err := download(descriptor.resolve(extent.FileName), true); err != nil {
+					return "", fmt.Errorf("disk %s: %w", d.ID(), err)
+				}
+			}
+			if !desc.HasParent() {
+				break
+			}
+			descriptor = descriptor.resolve(desc.ParentFileNameHint)
+		}
+	}
+	return vmxPath, nil
+}
@@ -0,0 +1,361 @@
+package vsphere
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+)
+
+// InventoryVM summarizes a VM of the inventory, to choose the VMs to migrate.
+type InventoryVM struct {
+	Name string `json:"name"`
+	ID   string `json:"id"`
+	// Path is the inventory path of the VM, e.g. DC1/vm/web/web01, as -vm takes it.
+	Path       string `json:"path"`
+	Datacenter string `json:"datacenter"`
+	// Folder is the inventory path of the folder of the VM, e.g. DC1/vm/web.
+	Folder string `json:"folder"`
+	// Cluster is empty for VMs of a standalone host.
+	Cluster    string `json:"cluster,omitempty"`
+	Host       string `json:"host,omitempty"`
+	PowerState string `json:"powerState"`
+	Template   bool   `json:"template,omitempty"`
+	GuestID    string `json:"guestId,omitempty"`
+	GuestOS    string `json:"guestOS,omitempty"`
+	CPUs       int    `json:"cpus"`
+	MemoryMB   int64  `json:"memoryMB"`
+	Disks      int    `json:"disks"`
+	// DiskCapacityBytes is the total capacity of the disks, raw device mappings included.
+	DiskCapacityBytes int64    `json:"diskCapacityBytes"`
+	Networks          []string `json:"networks,omitempty"`
+	// Tags are the vCenter tags of the VM as <category>:<tag>.
+	Tags []string `json:"tags,omitempty"`
+}
+
+// InventoryFilter selects VMs by one of their properties: folder (the VM is in the folder or
+// below it), cluster, tag ([<category>:]<tag>), power (on, off or suspended) or name (a glob).
+type InventoryFilter struct {
+	Key   string
+	Value string
+}
+
+var inventoryFilterKeys = []string{"folder", "cluster", "tag", "power", "name"}
+
+// ParseInventoryFilter parses a <key>=<value> filter.
+func ParseInventoryFilter(s string) (InventoryFilter, error) {
+	key, value, ok := strings.Cut(s, "=")
+	if !ok || value == "" {
+		return InventoryFilter{}, fmt.Errorf("invalid filter '%s', expected <key>=<value>", s)
+	}
+	f := InventoryFilter{Key: strings.ToLower(strings.TrimSpace(key)), Value: strings.TrimSpace(value)}
+	switch f.Key {
+	case "folder":
+		f.Value = strings.Trim(f.Value, "/")
+	case "power":
+		states := map[string]string{"on": "poweredOn", "off": "poweredOff", "suspended": "suspended"}
+		state, ok := states[strings.TrimPrefix(strings.ToLower(f.Value), "powered")]
+		if !ok {
+			return InventoryFilter{}, fmt.Errorf("invalid power state '%s', must be on, off or suspended", f.Value)
+		}
+		f.Value = state
+	case "name":
+		if _, err := path.Match(f.Value, ""); err != nil {
+			return InventoryFilter{}, fmt.Errorf("invalid name pattern '%s': %w", f.Value, err)
+		}
+	case "cluster", "tag":
+	default:
+		return InventoryFilter{}, fmt.Errorf("unknown filter key '%s', must be one of %s", key, strings.Join(inventoryFilterKeys, ", "))
+	}
+	return f, nil
+}
+
+func (f InventoryFilter) match(vm *InventoryVM) bool {
+	switch f.Key {
+	case "folder":
+		return vm.Folder == f.Value || strings.HasPrefix(vm.Folder, f.Value+"/")
+	case "cluster":
+		return vm.Cluster == f.Value
+	case "power":
+		return vm.PowerState == f.Value
+	case "name":
+		matched, _ := path.Match(f.Value, vm.Name)
+		return matched
+	case "tag":
+		// A tag without category matches the tags of that name in every category.
+		for _, tag := range vm.Tags {
+			_, name, _ := strings.Cut(tag, ":")
+			if tag == f.Value || !strings.Contains(f.Value, ":") && name == f.Value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchFilters reports whether vm matches one filter of every key of filters.
+func matchFilters(vm *InventoryVM, filters []InventoryFilter) bool {
+	keys := map[string]bool{}
+	for _, f := range filters {
+		keys[f.Key] = keys[f.Key] || f.match(vm)
+	}
+	for _, matched := range keys {
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// Inventory lists the VMs and templates of the host matching filters, sorted by inventory path.
+// Tags are only read from vCenter, through its Automation API.
+func (c *Client) Inventory(ctx context.Context, filters []InventoryFilter) ([]InventoryVM, error) {
+	var tagFilters, otherFilters []InventoryFilter
+	for _, f := range filters {
+		if f.Key == "tag" {
+			tagFilters = append(tagFilters, f)
+		} else {
+			otherFilters = append(otherFilters, f)
+		}
+	}
+	if len(tagFilters) > 0 && !c.IsVCenter() {
+		return nil, fmt.Errorf("tags are a vCenter feature, %s has none to filter on", c.Product())
+	}
+
+	// The folders, datacenters, hosts, clusters and networks give the VMs their paths and names.
+	objects, err := c.retrieve(ctx, map[string][]string{
+		"Folder":          {"name", "parent"},
+		"Datacenter":      {"name", "parent"},
+		"HostSystem":      {"name", "parent"},
+		"ComputeResource": {"name"},
+		"Network":         {"name"},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the inventory: %w", err)
+	}
+	type node struct {
+		name   string
+		parent *MoRef
+	}
+	nodes := map[MoRef]node{}
+	for _, o := range objects {
+		var n node
+		if err := o.property("name", &n.name); err != nil {
+			return nil, err
+		}
+		if err := o.property("parent", &n.parent); err != nil {
+			return nil, err
+		}
+		nodes[o.Obj] = n
+	}
+	// folderPath returns the inventory path of a folder and its datacenter. The root folder is
+	// not part of inventory paths.
+	folderPath := func(ref MoRef) (string, string) {
+		var names []string
+		datacenter := ""
+		for {
+			n, ok := nodes[ref]
+			if !ok {
+				break
+			}
+			names = append(names, n.name)
+			if ref.Type == "Datacenter" {
+				datacenter = n.name
+			}
+			if n.parent == nil {
+				break
+			}
+			ref = *n.parent
+		}
+		slices.Reverse(names)
+		return strings.Join(names, "/"), datacenter
+	}
+
+	objects, err = c.retrieve(ctx, map[string][]string{
+		"VirtualMachine": {
+			"name", "parent", "network", "runtime.powerState", "runtime.host",
+			"config.template", "config.guestId", "config.guestFullName",
+			"config.hardware.numCPU", "config.hardware.memoryMB", "config.hardware.device",
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the VMs: %w", err)
+	}
+	vms := []InventoryVM{}
+	for _, o := range objects {
+		vm := InventoryVM{ID: o.Obj.Value}
+		var parent, host *MoRef
+		var networks []MoRef
+		var devices []Device
+		for name, out := range map[string]any{
+			"name": &vm.Name, "parent": &parent, "network": &networks,
+			"runtime.powerState": &vm.PowerState, "runtime.host": &host,
+			"config.template": &vm.Template, "config.guestId": &vm.GuestID, "config.guestFullName": &vm.GuestOS,
+			"config.hardware.numCPU": &vm.CPUs, "config.hardware.memoryMB": &vm.MemoryMB, "config.hardware.device": &devices,
+		} {
+			if err := o.property(name, out); err != nil {
+				return nil, err
+			}
+		}
+		if parent != nil {
+			vm.Folder, vm.Datacenter = folderPath(*parent)
+		}
+		vm.Path = strings.TrimPrefix(vm.Folder+"/"+vm.Name, "/")
+		if host != nil {
+			vm.Host = nodes[*host].name
+			if computeResource := nodes[*host].parent; computeResource != nil && computeResource.Type == "ClusterComputeResource" {
+				vm.Cluster = nodes[*computeResource].name
+			}
+		}
+		for _, device := range devices {
+			if device.Type == "VirtualDisk" {
+				vm.Disks++
+				vm.DiskCapacityBytes += device.CapacityInBytes
+			}
+		}
+		for _, network := range networks {
+			vm.Networks = append(vm.Networks, cmp.Or(nodes[network].name, network.Value))
+		}
+		slices.Sort(vm.Networks)
+		if matchFilters(&vm, otherFilters) {
+			vms = append(vms, vm)
+		}
+	}
+
+	if c.IsVCenter() && len(vms) > 0 {
+		refs := make([]MoRef, len(vms))
+		for i, vm := range vms {
+			refs[i] = MoRef{Type: "VirtualMachine", Value: vm.ID}
+		}
+		tags, err := c.attachedTags(ctx, refs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the tags of the VMs: %w", err)
+		}
+		for i := range vms {
+			vms[i].Tags = tags[vms[i].ID]
+			slices.Sort(vms[i].Tags)
+		}
+		vms = slices.DeleteFunc(vms, func(vm InventoryVM) bool { return !matchFilters(&vm, tagFilters) })
+	}
+	slices.SortFunc(vms, func(a, b InventoryVM) int { return strings.Compare(a.Path, b.Path) })
+	return vms, nil
+}
+
+// objectContent holds the properties of one managed object read by retrieve.
+type objectContent struct {
+	Obj   MoRef
+	Props map[string]json.RawMessage
+}
+
+// property decodes the property name of the object into out, leaving out unchanged when the
+// object has no value for it, e.g. the config of an inaccessible VM.
+func (o objectContent) property(name string, out any) error {
+	raw, ok := o.Props[name]
+	if !ok {
+		return nil
+	}
+	// Property values are typed anyType, so primitives and arrays come boxed as
+	// {"_typeName": "int", "_value": 4}.
+	var boxed struct {
+		Value json.RawMessage `json:"_value"`
+	}
+	if json.Unmarshal(raw, &boxed) == nil && boxed.Value != nil {
+		raw = boxed.Value
+	}
+	if err := json.Unmarshal(raw, out); err != nil {
+		return fmt.Errorf("failed to decode %s of %s %s: %w", name, o.Obj.Type, o.Obj.Value, err)
+	}
+	return nil
+}
+
+// retrieve reads properties of every managed object of the inventory of the types keying paths,
+// subtypes included, through a container view of the root folder and the property collector.
+func (c *Client) retrieve(ctx context.Context, paths map[string][]string) ([]objectContent, error) {
+	types := slices.Sorted(maps.Keys(paths))
+	var view MoRef
+	if err := c.Invoke(ctx, c.content.ViewManager, "CreateContainerView", map[string]any{
+		"container": c.content.RootFolder,
+		"type":      types,
+		"recursive": true,
+	}, &view); err != nil {
+		return nil, err
+	}
+	defer c.Invoke(context.WithoutCancel(ctx), view, "DestroyView", nil, nil)
+
+	type propertySpec struct {
+		TypeName string   `json:"_typeName"`
+		Type     string   `json:"type"`
+		PathSet  []string `json:"pathSet"`
+	}
+	type traversalSpec struct {
+		TypeName string `json:"_typeName"`
+		Name     string `json:"name"`
+		Type     string `json:"type"`
+		Path     string `json:"path"`
+		Skip     bool   `json:"skip"`
+	}
+	type objectSpec struct {
+		TypeName  string          `json:"_typeName"`
+		Obj       MoRef           `json:"obj"`
+		Skip      bool            `json:"skip"`
+		SelectSet []traversalSpec `json:"selectSet"`
+	}
+	spec := struct {
+		TypeName  string         `json:"_typeName"`
+		PropSet   []propertySpec `json:"propSet"`
+		ObjectSet []objectSpec   `json:"objectSet"`
+	}{
+		TypeName: "PropertyFilterSpec",
+		ObjectSet: []objectSpec{{
+			TypeName:  "ObjectSpec",
+			Obj:       view,
+			Skip:      true,
+			SelectSet: []traversalSpec{{TypeName: "TraversalSpec", Name: "view", Type: "ContainerView", Path: "view"}},
+		}},
+	}
+	for _, t := range types {
+		spec.PropSet = append(spec.PropSet, propertySpec{TypeName: "PropertySpec", Type: t, PathSet: paths[t]})
+	}
+
+	type retrieveResult struct {
+		Token   string `json:"token"`
+		Objects []struct {
+			Obj     MoRef `json:"obj"`
+			PropSet []struct {
+				Name string          `json:"name"`
+				Val  json.RawMessage `json:"val"`
+			} `json:"propSet"`
+		} `json:"objects"`
+	}
+	var objects []objectContent
+	var result *retrieveResult
+	err := c.Invoke(ctx, c.content.PropertyCollector, "RetrievePropertiesEx", map[string]any{
+		"specSet": []any{spec},
+		"options": map[string]any{"_typeName": "RetrieveOptions", "maxObjects": 500},
+	}, &result)
+	for {
+		if err != nil {
+			return nil, err
+		}
+		if result == nil {
+			return objects, nil
+		}
+		for _, o := range result.Objects {
+			content := objectContent{Obj: o.Obj, Props: map[string]json.RawMessage{}}
+			for _, p := range o.PropSet {
+				content.Props[p.Name] = p.Val
+			}
+			objects = append(objects, content)
+		}
+		if result.Token == "" {
+			return objects, nil
+		}
+		token := result.Token
+		result = nil
+		err = c.Invoke(ctx, c.content.PropertyCollector, "ContinueRetrievePropertiesEx", map[string]string{"token": token}, &result)
+	}
+}
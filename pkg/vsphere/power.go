@@ -0,0 +1,122 @@
+package vsphere
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Power states of a VM.
+const (
+	PoweredOn  = "poweredOn"
+	PoweredOff = "poweredOff"
+	Suspended  = "suspended"
+)
+
+// PowerState returns the power state of vm: poweredOn, poweredOff or suspended.
+func (c *Client) PowerState(ctx context.Context, vm MoRef) (string, error) {
+	var runtime struct {
+		PowerState string `json:"powerState"`
+	}
+	if err := c.Property(ctx, vm, "runtime", &runtime); err != nil {
+		return "", fmt.Errorf("failed to read the power state of VM %s: %w", vm.Value, err)
+	}
+	return runtime.PowerState, nil
+}
+
+// Ways PowerOff stops a VM.
+const (
+	// ShutdownGuest shuts the guest down through VMware Tools, and powers the VM off when they do
+	// not run or the guest is still running after the timeout.
+	ShutdownGuest = "guest"
+	// ShutdownHard powers the VM off at once, as pulling the plug would.
+	ShutdownHard = "hard"
+	// ShutdownManual leaves the VM to be stopped by its owners; PowerOff fails while it runs.
+	ShutdownManual = "manual"
+)
+
+// ParseShutdown checks a way of stopping VMs.
+func ParseShutdown(s string) (string, error) {
+	switch s {
+	case ShutdownGuest, ShutdownHard, ShutdownManual:
+		return s, nil
+	}
+	return "", fmt.Errorf("invalid shutdown '%s', must be guest, hard or manual", s)
+}
+
+// PowerOff stops vm the way of shutdown, waiting up to timeout for a guest shutdown.
+func (c *Client) PowerOff(ctx context.Context, vm MoRef, shutdown string, timeout time.Duration) error {
+	state, err := c.PowerState(ctx, vm)
+	if err != nil || state == PoweredOff {
+		return err
+	}
+	if shutdown == ShutdownManual {
+		return fmt.Errorf("VM %s is %s; shut it down, or let the tool stop it with a guest or hard shutdown", vm.Value, state)
+	}
+	var guest struct {
+		ToolsRunningStatus string `json:"toolsRunningStatus"`
+	}
+	if err := c.Property(ctx, vm, "guest", &guest); err != nil {
+		return fmt.Errorf("failed to read the guest state of VM %s: %w", vm.Value, err)
+	}
+	if shutdown == ShutdownGuest && state == PoweredOn && guest.ToolsRunningStatus == "guestToolsRunning" {
+		if err := c.Invoke(ctx, vm, "ShutdownGuest", nil, nil); err != nil {
+			return fmt.Errorf("failed to shut down the guest of VM %s: %w", vm.Value, err)
+		}
+		deadline := time.Now().Add(timeout)
+		for time.Now().Before(deadline) {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(2 * time.Second):
+			}
+			if state, err = c.PowerState(ctx, vm); err != nil || state == PoweredOff {
+				return err
+			}
+		}
+	}
+	if err := c.invokeTask(ctx, vm, "PowerOffVM_Task", nil, nil); err != nil {
+		return fmt.Errorf("failed to power off VM %s: %w", vm.Value, err)
+	}
+	return nil
+}
+
+// DisconnectNICs disconnects the network adapters of vm and keeps them disconnected at power on,
+// so that the VM cannot come back on the network next to its migrated copy. It returns the
+// number of adapters disconnected.
+func (c *Client) DisconnectNICs(ctx context.Context, vm MoRef) (int, error) {
+	// The devices are edited as read, so that the fields this client does not know are kept.
+	var config struct {
+		Hardware struct {
+			Device []map[string]any `json:"device"`
+		} `json:"hardware"`
+	}
+	if err := c.Property(ctx, vm, "config", &config); err != nil {
+		return 0, fmt.Errorf("failed to read the devices of VM %s: %w", vm.Value, err)
+	}
+	var changes []map[string]any
+	for _, device := range config.Hardware.Device {
+		if _, ok := device["macAddress"]; !ok {
+			continue
+		}
+		connectable, _ := device["connectable"].(map[string]any)
+		if connectable == nil {
+			connectable = map[string]any{"_typeName": "VirtualDeviceConnectInfo"}
+			device["connectable"] = connectable
+		}
+		if connectable["connected"] == false && connectable["startConnected"] == false {
+			continue
+		}
+		connectable["connected"], connectable["startConnected"] = false, false
+		changes = append(changes, map[string]any{"_typeName": "VirtualDeviceConfigSpec", "operation": "edit", "device": device})
+	}
+	if len(changes) == 0 {
+		return 0, nil
+	}
+	if err := c.invokeTask(ctx, vm, "ReconfigVM_Task", map[string]any{
+		"spec": map[string]any{"_typeName": "VirtualMachineConfigSpec", "deviceChange": changes},
+	}, nil); err != nil {
+		return 0, fmt.Errorf("failed to disconnect the network adapters of VM %s: %w", vm.Value, err)
+	}
+	return len(changes), nil
+}
@@ -0,0 +1,46 @@
+package vsphere
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// CreateSnapshot takes a snapshot of the disks of vm, without its memory, and returns it. The
+// disks of the snapshot stay unchanged while the VM runs, for a consistent copy. With quiesce,
+// VMware Tools flush the guest file systems and pause writes while the snapshot is taken, so the
+// disks are also consistent for the applications; it is skipped for VMs not running.
+func (c *Client) CreateSnapshot(ctx context.Context, vm MoRef, name, description string, quiesce bool) (MoRef, error) {
+	if quiesce {
+		state, err := c.PowerState(ctx, vm)
+		if err != nil {
+			return MoRef{}, err
+		}
+		quiesce = state == PoweredOn
+	}
+	var snapshot MoRef
+	if err := c.invokeTask(ctx, vm, "CreateSnapshot_Task", map[string]any{
+		"name":        name,
+		"description": description,
+		"memory":      false,
+		"quiesce":     quiesce,
+	}, &snapshot); err != nil {
+		var fault *Fault
+		if quiesce && errors.As(err, &fault) && (fault.Type == "ToolsUnavailable" || fault.Type == "ApplicationQuiesceFault") {
+			return MoRef{}, fmt.Errorf("failed to snapshot VM %s with quiescing, which needs VMware Tools running in the guest: %w", vm.Value, err)
+		}
+		return MoRef{}, fmt.Errorf("failed to snapshot VM %s: %w", vm.Value, err)
+	}
+	return snapshot, nil
+}
+
+// RemoveSnapshot deletes snapshot, merging its delta disks back into the VM.
+func (c *Client) RemoveSnapshot(ctx context.Context, snapshot MoRef) error {
+	if err := c.invokeTask(ctx, snapshot, "RemoveSnapshot_Task", map[string]any{
+		"removeChildren": false,
+		"consolidate":    true,
+	}, nil); err != nil {
+		return fmt.Errorf("failed to remove snapshot %s: %w", snapshot.Value, err)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package vsphere
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// attachedTags returns the tags of the objects of refs, as <category>:<tag> by object ID. Tags
+// are not part of the vim25 API: they are read from the tagging service of the vCenter
+// Automation API, in a session of its own.
+func (c *Client) attachedTags(ctx context.Context, refs []MoRef) (map[string][]string, error) {
+	var token string
+	if err := c.rest(ctx, http.MethodPost, "/session", "", nil, &token); err != nil {
+		return nil, fmt.Errorf("failed to log in to the Automation API: %w", err)
+	}
+	defer c.rest(context.WithoutCancel(ctx), http.MethodDelete, "/session", token, nil, nil)
+
+	type objectID struct {
+		Type string `json:"type"`
+		ID   string `json:"id"`
+	}
+	request := struct {
+		ObjectIDs []objectID `json:"object_ids"`
+	}{}
+	for _, ref := range refs {
+		request.ObjectIDs = append(request.ObjectIDs, objectID{Type: ref.Type, ID: ref.Value})
+	}
+	var attached []struct {
+		ObjectID objectID `json:"object_id"`
+		TagIDs   []string `json:"tag_ids"`
+	}
+	if err := c.rest(ctx, http.MethodPost, "/cis/tagging/tag-association?action=list-attached-tags-on-objects", token, request, &attached); err != nil {
+		return nil, err
+	}
+
+	names := map[string]string{}
+	categories := map[string]string{}
+	tags := map[string][]string{}
+	for _, object := range attached {
+		for _, id := range object.TagIDs {
+			if _, ok := names[id]; !ok {
+				var tag struct {
+					Name       string `json:"name"`
+					CategoryID string `json:"category_id"`
+				}
+				if err := c.rest(ctx, http.MethodGet, "/cis/tagging/tag/"+url.PathEscape(id), token, nil, &tag); err != nil {
+					return nil, err
+				}
+				if _, ok := categories[tag.CategoryID]; !ok {
+					var category struct {
+						Name string `json:"name"`
+					}
+					if err := c.rest(ctx, http.MethodGet, "/cis/tagging/category/"+url.PathEscape(tag.CategoryID), token, nil, &category); err != nil {
+						return nil, err
+					}
+					categories[tag.CategoryID] = category.Name
+				}
+				names[id] = categories[tag.CategoryID] + ":" + tag.Name
+			}
+			tags[object.ObjectID.ID] = append(tags[object.ObjectID.ID], names[id])
+		}
+	}
+	return tags, nil
+}
+
+// rest calls the Automation API of vCenter, under /api. Without a session token, it logs in with
+// the credentials of the client.
+func (c *Client) rest(ctx context.Context, method, path, token string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to encode request: %w", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(c.base, "/sdk/vim25/"+APIRelease)+"/api"+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("vmware-api-session-id", token)
+	} else {
+		req.SetBasicAuth(c.config.Username, c.config.Password)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s /api%s: %w", method, path, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("%s /api%s: failed to read response: %w", method, path, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		fault := &Fault{Code: resp.StatusCode, Type: http.StatusText(resp.StatusCode)}
+		var body struct {
+			ErrorType string `json:"error_type"`
+			Messages  []struct {
+				DefaultMessage string `json:"default_message"`
+			} `json:"messages"`
+		}
+		if json.Unmarshal(data, &body) == nil {
+			if body.ErrorType != "" {
+				fault.Type = body.ErrorType
+			}
+			for _, m := range body.Messages {
+				fault.Message = strings.TrimSpace(fault.Message + " " + m.DefaultMessage)
+			}
+		}
+		return fmt.Errorf("%s /api%s: %w", method, path, fault)
+	}
+	if out != nil && len(bytes.TrimSpace(data)) > 0 {
+		if err := json.Unmarshal(data, out); err != nil {
+			return fmt.Errorf("%s /api%s: failed to decode response: %w", method, path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package vsphere
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// taskInfo is the subset of the info of a Task the client waits on.
+type taskInfo struct {
+	State  string          `json:"state"` // queued, running, success or error
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		LocalizedMessage string `json:"localizedMessage"`
+		Fault            struct {
+			Type string `json:"_typeName"`
+		} `json:"fault"`
+	} `json:"error"`
+}
+
+// invokeTask calls a method of ref returning a Task, waits for the task and decodes its result
+// into out, when set.
+func (c *Client) invokeTask(ctx context.Context, ref MoRef, method string, args, out any) error {
+	var task MoRef
+	if err := c.Invoke(ctx, ref, method, args, &task); err != nil {
+		return err
+	}
+	for {
+		var info taskInfo
+		if err := c.Property(ctx, task, "info", &info); err != nil {
+			return fmt.Errorf("failed to follow task %s of %s: %w", task.Value, method, err)
+		}
+		switch info.State {
+		case "success":
+			if out != nil && len(info.Result) > 0 {
+				return json.Unmarshal(info.Result, out)
+			}
+			return nil
+		case "error":
+			if info.Error == nil {
+				return fmt.Errorf("%s failed", method)
+			}
+			return fmt.Errorf("%s failed: %w", method, &Fault{Type: info.Error.Fault.Type, Message: info.Error.LocalizedMessage})
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package vsphere
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha1"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"vmx2vmi/pkg/nbd"
+	"vmx2vmi/pkg/vmdk"
+)
+
+// VDDKOptions configures OpenDisk.
+type VDDKOptions struct {
+	// LibDir is the directory the VDDK library was extracted to, e.g. /opt/vmware-vix-disklib-distrib.
+	LibDir string
+	// Transports lists the VDDK transport modes to try in order, e.g. san:hotadd:nbdssl; empty
+	// lets VDDK pick the fastest available.
+	Transports string
+	// Snapshot is the ID of a snapshot of the VM, e.g. snapshot-7, whose disk is read instead of
+	// the running one. Reading a running VM needs one for a consistent image.
+	Snapshot string
+	// Nbdkit is the nbdkit binary; "nbdkit" on PATH when empty.
+	Nbdkit string
+}
+
+// Disk is a VM disk read through VDDK, served by the vddk plugin of nbdkit. VDDK reaches the
+// disk over the fastest transport it can: SAN when the LUNs are zoned to this host, HotAdd when
+// it runs in a VM of the same cluster, NBD(SSL) through the ESXi host otherwise.
+type Disk struct {
+	*nbd.Client
+	// ID is the VMX device identifier of the disk, e.g. scsi0:0.
+	ID string
+	// VMName is the name of the VM of the disk.
+	VMName string
+	File   DatastorePath
+
+	changeID  string
+	client    *Client
+	vm        MoRef
+	snapshot  *MoRef
+	deviceKey int
+	nbdkit    *exec.Cmd
+	exited    chan error
+	dir       string
+}
+
+// OpenDisk opens a disk of the VM named by ref for reading through VDDK. disk is the VMX device
+// identifier of the disk, e.g. scsi0:0, or its datastore path.
+func (c *Client) OpenDisk(ctx context.Context, ref, disk string, opts VDDKOptions) (*Disk, error) {
+	vm, err := c.FindVM(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	config, err := c.VMConfig(ctx, vm)
+	if err != nil {
+		return nil, err
+	}
+	d := &Disk{VMName: config.Name, client: c, vm: vm}
+	devices := config.Hardware.Device
+	if opts.Snapshot != "" {
+		// The disks of a snapshot are the delta files the VM wrote to when it was taken.
+		d.snapshot = &MoRef{Type: "VirtualMachineSnapshot", Value: opts.Snapshot}
+		var snapshotConfig VMConfig
+		if err := c.Property(ctx, *d.snapshot, "config", &snapshotConfig); err != nil {
+			return nil, fmt.Errorf("failed to read snapshot %s of VM %s: %w", opts.Snapshot, config.Name, err)
+		}
+		devices = snapshotConfig.Hardware.Device
+	}
+
+	controllers := controllerIDs(devices)
+	var ids []string
+	for _, device := range devices {
+		controller, ok := controllers[device.ControllerKey]
+		if device.Type != "VirtualDisk" || !ok || device.UnitNumber == nil || device.Backing == nil {
+			continue
+		}
+		id := fmt.Sprintf("%s:%d", controller, *device.UnitNumber)
+		ids = append(ids, id)
+		if id != disk && device.Backing.FileName != disk {
+			continue
+		}
+		if strings.HasPrefix(device.Backing.Type, "VirtualDiskRawDiskMapping") && device.Backing.CompatibilityMode == "physicalMode" {
+			return nil, fmt.Errorf("disk %s of VM %s is a physical raw device mapping, which VDDK cannot read; map the LUN with -rdm-map", id, config.Name)
+		}
+		if d.File, err = ParseDatastorePath(device.Backing.FileName); err != nil {
+			return nil, err
+		}
+		d.ID, d.deviceKey, d.changeID = id, device.Key, device.Backing.ChangeID
+	}
+	if d.ID == "" {
+		return nil, fmt.Errorf("VM %s has no disk %s (disks: %s)", config.Name, disk, strings.Join(ids, ", "))
+	}
+
+	if err := d.start(ctx, opts); err != nil {
+		d.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// DiskIDs returns the VMX device identifiers of the disks of vm, e.g. scsi0:0, as OpenDisk takes them.
+func (c *Client) DiskIDs(ctx context.Context, vm MoRef) ([]string, error) {
+	config, err := c.VMConfig(ctx, vm)
+	if err != nil {
+		return nil, err
+	}
+	controllers := controllerIDs(config.Hardware.Device)
+	var ids []string
+	for _, device := range config.Hardware.Device {
+		if controller, ok := controllers[device.ControllerKey]; ok && device.Type == "VirtualDisk" && device.UnitNumber != nil {
+			ids = append(ids, fmt.Sprintf("%s:%d", controller, *device.UnitNumber))
+		}
+	}
+	return ids, nil
+}
+
+// start runs nbdkit on a private Unix socket and connects to it.
+func (d *Disk) start(ctx context.Context, opts VDDKOptions) error {
+	binary, err := exec.LookPath(cmp.Or(opts.Nbdkit, "nbdkit"))
+	if err != nil {
+		return fmt.Errorf("nbdkit not found on PATH, install nbdkit and its vddk plugin (nbdkit-vddk-plugin): %w", err)
+	}
+	if opts.LibDir == "" {
+		return fmt.Errorf("the directory of the VDDK library is required")
+	}
+	if d.dir, err = os.MkdirTemp("", "vmx2vmi-vddk-"); err != nil {
+		return err
+	}
+	// The password is handed over in a file only the current user can read, never on the
+	// command line.
+	passwordFile := filepath.Join(d.dir, "password")
+	if err := os.WriteFile(passwordFile, []byte(d.client.config.Password), 0o600); err != nil {
+		return err
+	}
+	u, err := url.Parse(d.client.host)
+	if err != nil {
+		return err
+	}
+	socket := filepath.Join(d.dir, "nbd.sock")
+	pidFile := filepath.Join(d.dir, "nbdkit.pid")
+	args := []string{
+		"--foreground", "--exit-with-parent", "--readonly",
+		"--unix", socket, "--pidfile", pidFile,
+		"vddk",
+		"libdir=" + opts.LibDir,
+		"server=" + u.Hostname(),
+		"user=" + d.client.config.Username,
+		"password=+" + passwordFile,
+		"vm=moref=" + d.vm.Value,
+		"file=" + d.File.String(),
+	}
+	if port := u.Port(); port != "" {
+		args = append(args, "port="+port)
+	}
+	if u.Scheme == "https" {
+		thumbprint, err := d.client.certificateThumbprint(ctx)
+		if err != nil {
+			return err
+		}
+		args = append(args, "thumbprint="+thumbprint)
+	}
+	if opts.Transports != "" {
+		args = append(args, "transports="+opts.Transports)
+	}
+	if d.snapshot != nil {
+		args = append(args, "snapshot="+d.snapshot.Value)
+	}
+
+	var stderr bytes.Buffer
+	d.nbdkit = exec.Command(binary, args...)
+	d.nbdkit.Stderr = &stderr
+	if err := d.nbdkit.Start(); err != nil {
+		return fmt.Errorf("failed to start nbdkit: %w", err)
+	}
+	exited := make(chan error, 1)
+	d.exited = exited
+	go func() { exited <- d.nbdkit.Wait() }()
+
+	// nbdkit writes its PID file once the socket accepts connections; VDDK opens the disk when
+	// the first client connects.
+	deadline := time.NewTimer(time.Minute)
+	defer deadline.Stop()
+	for {
+		if _, err := os.Stat(pidFile); err == nil {
+			break
+		}
+		select {
+		case err := <-exited:
+			d.nbdkit = nil
+			return fmt.Errorf("nbdkit exited before serving disk %s (%v): %s", d.File, err, strings.TrimSpace(stderr.String()))
+		case <-deadline.C:
+			return fmt.Errorf("nbdkit did not start serving disk %s within a minute: %s", d.File, strings.TrimSpace(stderr.String()))
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	if d.Client, err = nbd.Dial("unix", socket, ""); err != nil {
+		return fmt.Errorf("failed to open disk %s through VDDK: %w: %s", d.File, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// certificateThumbprint returns the SHA-1 fingerprint of the certificate of the host, in the
+// colon-separated form VDDK expects. The connection is verified as the API session is.
+func (c *Client) certificateThumbprint(ctx context.Context) (string, error) {
+	transport, ok := c.http.Transport.(*http.Transport)
+	if !ok {
+		return "", fmt.Errorf("no TLS configuration to read the certificate of the host")
+	}
+	u, err := url.Parse(c.host)
+	if err != nil {
+		return "", err
+	}
+	address := u.Host
+	if u.Port() == "" {
+		address = net.JoinHostPort(u.Hostname(), "443")
+	}
+	dialer := &tls.Dialer{Config: transport.TLSClientConfig.Clone()}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the certificate of %s: %w", u.Host, err)
+	}
+	defer conn.Close()
+	certificates := conn.(*tls.Conn).ConnectionState().PeerCertificates
+	if len(certificates) == 0 {
+		return "", fmt.Errorf("%s sent no certificate", u.Host)
+	}
+	sum := sha1.Sum(certificates[0].Raw)
+	hex := make([]string, len(sum))
+	for i, b := range sum {
+		hex[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(hex, ":"), nil
+}
+
+// ChangeID returns the change ID of the disk state being read, for the next incremental read,
+// or "" when the VM does not track changes (ctkEnabled).
+func (d *Disk) ChangeID() string {
+	return d.changeID
+}
+
+// ChangedRanges returns the areas of the disk written since the state of changeID, as
+// Changed Block Tracking reports them through QueryChangedDiskAreas.
+func (d *Disk) ChangedRanges(ctx context.Context, changeID string) ([]vmdk.Range, error) {
+	if d.changeID == "" {
+		return nil, fmt.Errorf("disk %s of VM %s does not track changes; enable Changed Block Tracking (ctkEnabled) on the VM", d.ID, d.VMName)
+	}
+	var ranges []vmdk.Range
+	for start := int64(0); start < d.Size(); {
+		args := map[string]any{"deviceKey": d.deviceKey, "startOffset": start, "changeId": changeID}
+		if d.snapshot != nil {
+			args["snapshot"] = *d.snapshot
+		}
+		var info struct {
+			StartOffset int64 `json:"startOffset"`
+			Length      int64 `json:"length"`
+			ChangedArea []struct {
+				Start  int64 `json:"start"`
+				Length int64 `json:"length"`
+			} `json:"changedArea"`
+		}
+		if err := d.client.Invoke(ctx, d.vm, "QueryChangedDiskAreas", args, &info); err != nil {
+			var fault *Fault
+			if errors.As(err, &fault) && fault.Type == "FileFault" {
+				return nil, fmt.Errorf("the changes of disk %s since %s are not known, e.g. after a reset of change tracking; run a full conversion: %w", d.ID, changeID, err)
+			}
+			return nil, fmt.Errorf("failed to query the changes of disk %s: %w", d.ID, err)
+		}
+		for _, area := range info.ChangedArea {
+			ranges = append(ranges, vmdk.Range{Offset: area.Start, Length: area.Length})
+		}
+		if info.Length <= 0 {
+			break
+		}
+		start = info.StartOffset + info.Length
+	}
+	return ranges, nil
+}
+
+// Close disconnects from the disk and stops nbdkit, waiting for it to exit.
+func (d *Disk) Close() error {
+	var err error
+	if d.Client != nil {
+		err = d.Client.Close()
+	}
+	if d.nbdkit != nil && d.nbdkit.Process != nil {
+		d.nbdkit.Process.Signal(os.Interrupt)
+		// VDDK keeps the disk open until nbdkit exits, which would fail the removal of the
+		// snapshot it was read from.
+		select {
+		case <-d.exited:
+		case <-time.After(30 * time.Second):
+			d.nbdkit.Process.Kill()
+		}
+		d.nbdkit = nil
+	}
+	if d.dir != "" {
+		os.RemoveAll(d.dir)
+	}
+	return err
+}
@@ -0,0 +1,510 @@
+package vsphere
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"vmx2vmi/pkg/ova"
+	"vmx2vmi/pkg/vmx"
+)
+
+// VMConfig is the subset of a VirtualMachineConfigInfo read for a conversion.
+type VMConfig struct {
+	Name                  string `json:"name"`
+	GuestID               string `json:"guestId"`
+	Version               string `json:"version"` // vmx-NN
+	UUID                  string `json:"uuid"`
+	InstanceUUID          string `json:"instanceUuid"`
+	Template              bool   `json:"template"`
+	Firmware              string `json:"firmware"`
+	Annotation            string `json:"annotation"`
+	NestedHVEnabled       *bool  `json:"nestedHVEnabled"`
+	CPUHotAddEnabled      *bool  `json:"cpuHotAddEnabled"`
+	MemoryHotAddEnabled   *bool  `json:"memoryHotAddEnabled"`
+	ChangeTrackingEnabled *bool  `json:"changeTrackingEnabled"`
+	Files                 struct {
+		VMPathName string `json:"vmPathName"`
+	} `json:"files"`
+	BootOptions *struct {
+		EFISecureBootEnabled *bool `json:"efiSecureBootEnabled"`
+	} `json:"bootOptions"`
+	Tools *struct {
+		ToolsVersion       int    `json:"toolsVersion"`
+		ToolsUpgradePolicy string `json:"toolsUpgradePolicy"`
+		SyncTimeWithHost   *bool  `json:"syncTimeWithHost"`
+		ToolsInstallType   string `json:"toolsInstallType"`
+	} `json:"tools"`
+	KeyID *struct {
+		KeyID string `json:"keyId"`
+	} `json:"keyId"`
+	// FtInfo is set for the primary and secondary VMs of Fault Tolerance.
+	FtInfo *struct {
+		Role int `json:"role"`
+	} `json:"ftInfo"`
+	CPUAllocation    *ResourceAllocation `json:"cpuAllocation"`
+	MemoryAllocation *ResourceAllocation `json:"memoryAllocation"`
+	CPUAffinity      *struct {
+		AffinitySet []int `json:"affinitySet"`
+	} `json:"cpuAffinity"`
+	Hardware struct {
+		NumCPU            int      `json:"numCPU"`
+		NumCoresPerSocket int      `json:"numCoresPerSocket"`
+		MemoryMB          int64    `json:"memoryMB"`
+		Device            []Device `json:"device"`
+	} `json:"hardware"`
+	ExtraConfig []OptionValue `json:"extraConfig"`
+}
+
+// ResourceAllocation is the reservation and shares of the CPU (MHz) or memory (MB) of a VM.
+type ResourceAllocation struct {
+	Reservation *int64 `json:"reservation"`
+	Shares      *struct {
+		Shares int    `json:"shares"`
+		Level  string `json:"level"` // low, normal, high or custom
+	} `json:"shares"`
+}
+
+// OptionValue is an extraConfig entry; the value is a boxed xsd:anyType.
+type OptionValue struct {
+	Key   string `json:"key"`
+	Value struct {
+		Value any `json:"_value"`
+	} `json:"value"`
+}
+
+// Device is a virtual device, with the fields of the device types read for a conversion.
+type Device struct {
+	Type            string `json:"_typeName"`
+	Key             int    `json:"key"`
+	ControllerKey   int    `json:"controllerKey"`
+	UnitNumber      *int   `json:"unitNumber"`
+	BusNumber       int    `json:"busNumber"`
+	SharedBus       string `json:"sharedBus"`
+	CapacityInBytes int64  `json:"capacityInBytes"`
+	MacAddress      string `json:"macAddress"`
+	AddressType     string `json:"addressType"`
+	Backing         *struct {
+		Type              string      `json:"_typeName"`
+		FileName          string      `json:"fileName"`
+		DiskMode          string      `json:"diskMode"`
+		ThinProvisioned   *bool       `json:"thinProvisioned"`
+		EagerlyScrub      *bool       `json:"eagerlyScrub"`
+		Sharing           string      `json:"sharing"`
+		CompatibilityMode string      `json:"compatibilityMode"`
+		ChangeID          string      `json:"changeId"`
+		DeviceName        string      `json:"deviceName"`
+		Vgpu              string      `json:"vgpu"`
+		OpaqueNetworkID   string      `json:"opaqueNetworkId"`
+		Parent            *DiskParent `json:"parent"`
+		Port              *struct {
+			PortgroupKey string `json:"portgroupKey"`
+		} `json:"port"`
+	} `json:"backing"`
+	Connectable *struct {
+		StartConnected bool `json:"startConnected"`
+	} `json:"connectable"`
+}
+
+// DiskParent is the backing of the parent of a snapshot delta.
+type DiskParent struct {
+	FileName string      `json:"fileName"`
+	Parent   *DiskParent `json:"parent"`
+}
+
+// serialFileTypes maps the backings of serial ports to their VMX fileType.
+var serialFileTypes = map[string]string{
+	"VirtualSerialPortFileBackingInfo":   "file",
+	"VirtualSerialPortPipeBackingInfo":   "pipe",
+	"VirtualSerialPortDeviceBackingInfo": "device",
+	"VirtualSerialPortURIBackingInfo":    "network",
+}
+
+var morefPattern = regexp.MustCompile(`^(vm-)?\d+$`)
+
+// standaloneDatacenter is the only datacenter of a standalone ESXi host.
+const standaloneDatacenter = "ha-datacenter"
+
+// FindVM returns the VM named by ref: a managed object ID such as vm-42 (or 42 on ESXi), or an
+// inventory path such as Datacenter/vm/Folder/web01. On a standalone ESXi host, the VM name is
+// enough.
+func (c *Client) FindVM(ctx context.Context, ref string) (MoRef, error) {
+	if morefPattern.MatchString(ref) {
+		return MoRef{Type: "VirtualMachine", Value: ref}, nil
+	}
+	inventoryPath := strings.Trim(ref, "/")
+	if !c.IsVCenter() && !strings.Contains(inventoryPath, "/") {
+		inventoryPath = standaloneDatacenter + "/vm/" + inventoryPath
+	}
+	var found *MoRef
+	if err := c.Invoke(ctx, c.content.SearchIndex, "FindByInventoryPath", map[string]string{"inventoryPath": inventoryPath}, &found); err != nil {
+		return MoRef{}, fmt.Errorf("failed to look up %s: %w", ref, err)
+	}
+	if found == nil && !c.IsVCenter() {
+		return MoRef{}, fmt.Errorf("no VM at the inventory path %s; pass the VM name, %s/vm/<folders>/<name> or the VM ID, e.g. 42", inventoryPath, standaloneDatacenter)
+	}
+	if found == nil {
+		return MoRef{}, fmt.Errorf("no VM at the inventory path %s; pass <datacenter>/vm/<folders>/<name> or the VM ID, e.g. vm-42", ref)
+	}
+	if found.Type != "VirtualMachine" {
+		return MoRef{}, fmt.Errorf("%s is a %s, not a VM", ref, found.Type)
+	}
+	return *found, nil
+}
+
+// VMConfig reads the configuration of vm.
+func (c *Client) VMConfig(ctx context.Context, vm MoRef) (*VMConfig, error) {
+	var config VMConfig
+	if err := c.Property(ctx, vm, "config", &config); err != nil {
+		if IsNotFound(err) {
+			return nil, fmt.Errorf("VM %s does not exist: %w", vm.Value, err)
+		}
+		return nil, fmt.Errorf("failed to read the configuration of VM %s: %w", vm.Value, err)
+	}
+	if config.Name == "" {
+		return nil, fmt.Errorf("VM %s has no configuration; it may be inaccessible or orphaned", vm.Value)
+	}
+	return &config, nil
+}
+
+// ReadVMX reads the VM named by ref as the VMX it runs from, so it converts like a local VMX. The
+// disks keep their [datastore] paths, with the capacity, provisioning and raw device mapping mode
+// vSphere reports for them, as their descriptors are not read. It also returns the datastore path
+// of the VMX, e.g. "[datastore1] web01/web01.vmx".
+func (c *Client) ReadVMX(ctx context.Context, ref string) (*vmx.VMXConfig, string, error) {
+	vm, err := c.FindVM(ctx, ref)
+	if err != nil {
+		return nil, "", err
+	}
+	config, err := c.VMConfig(ctx, vm)
+	if err != nil {
+		return nil, "", err
+	}
+	content, disks, err := c.render(ctx, config)
+	if err != nil {
+		return nil, "", fmt.Errorf("VM %s: %w", config.Name, err)
+	}
+	vmxConfig, err := vmx.Parse(content)
+	if err != nil {
+		return nil, "", fmt.Errorf("VM %s: %w", config.Name, err)
+	}
+	for i := range vmxConfig.Disks {
+		d := &vmxConfig.Disks[i]
+		if info, ok := disks[d.ID()]; ok {
+			d.Path = d.FileName
+			d.CapacityBytes = info.CapacityBytes
+			d.Provisioning = info.Provisioning
+			d.RawDeviceMapping = info.RawDeviceMapping
+		}
+	}
+	vmxConfig.Template = config.Template
+	return vmxConfig, config.Files.VMPathName, nil
+}
+
+// diskInfo is what vSphere reports about a disk that a VMX reader takes from its descriptor.
+type diskInfo struct {
+	CapacityBytes    uint64
+	Provisioning     string
+	RawDeviceMapping string
+}
+
+// controllerBuses maps the controller device types to their VMX bus and, for SCSI, virtualDev.
+var controllerBuses = map[string][2]string{
+	"VirtualIDEController":         {"ide", ""},
+	"VirtualAHCIController":        {"sata", ""},
+	"VirtualNVMEController":        {"nvme", ""},
+	"ParaVirtualSCSIController":    {"scsi", "pvscsi"},
+	"VirtualLsiLogicController":    {"scsi", "lsilogic"},
+	"VirtualLsiLogicSASController": {"scsi", "lsisas1068"},
+	"VirtualBusLogicController":    {"scsi", "buslogic"},
+}
+
+// nicVirtualDevs maps the NIC device types to their VMX virtualDev.
+var nicVirtualDevs = map[string]string{
+	"VirtualVmxnet3":           "vmxnet3",
+	"VirtualVmxnet2":           "vmxnet",
+	"VirtualVmxnet":            "vmxnet",
+	"VirtualE1000":             "e1000",
+	"VirtualE1000e":            "e1000e",
+	"VirtualPCNet32":           "vlance",
+	"VirtualSriovEthernetCard": "sriov",
+	"VirtualVmxnet3Vrdma":      "vrdma",
+}
+
+// sharedBuses maps the sharedBus of SCSI controllers to its VMX form.
+var sharedBuses = map[string]string{
+	"noSharing":       "none",
+	"virtualSharing":  "virtual",
+	"physicalSharing": "physical",
+}
+
+// render writes config as VMX content, and returns what vSphere reports about each disk by its
+// VMX device identifier.
+func (c *Client) render(ctx context.Context, config *VMConfig) ([]byte, map[string]diskInfo, error) {
+	var b strings.Builder
+	set := func(key, value string) {
+		fmt.Fprintf(&b, "%s = \"%s\"\n", key, vmxEscaper.Replace(value))
+	}
+	setBool := func(key string, value *bool) {
+		if value != nil {
+			set(key, strings.ToUpper(strconv.FormatBool(*value)))
+		}
+	}
+
+	set(".encoding", "UTF-8")
+	set("displayName", config.Name)
+	if guest := ova.GuestOS(config.GuestID); guest != "" {
+		set("guestOS", guest)
+	}
+	if version, ok := strings.CutPrefix(config.Version, "vmx-"); ok {
+		set("virtualHW.version", version)
+	}
+	set("numvcpus", strconv.Itoa(config.Hardware.NumCPU))
+	if config.Hardware.NumCoresPerSocket > 0 {
+		set("cpuid.coresPerSocket", strconv.Itoa(config.Hardware.NumCoresPerSocket))
+	}
+	set("memsize", strconv.FormatInt(config.Hardware.MemoryMB, 10))
+	if config.UUID != "" {
+		set("uuid.bios", config.UUID)
+	}
+	if config.InstanceUUID != "" {
+		set("vc.uuid", config.InstanceUUID)
+	}
+	if config.Firmware != "" {
+		set("firmware", config.Firmware)
+	}
+	if config.BootOptions != nil {
+		setBool("uefi.secureBoot.enabled", config.BootOptions.EFISecureBootEnabled)
+	}
+	setBool("vhv.enable", config.NestedHVEnabled)
+	setBool("vcpu.hotadd", config.CPUHotAddEnabled)
+	setBool("mem.hotadd", config.MemoryHotAddEnabled)
+	setBool("ctkEnabled", config.ChangeTrackingEnabled)
+	if config.Annotation != "" {
+		set("annotation", config.Annotation)
+	}
+	if config.Tools != nil && config.Tools.ToolsVersion != 0 {
+		// VMware Tools report their version once installed in the guest.
+		set("tools.upgrade.policy", cmp.Or(config.Tools.ToolsUpgradePolicy, "manual"))
+	}
+	if config.KeyID != nil {
+		set("encryption.keySafe", config.KeyID.KeyID)
+	}
+	if config.CPUAffinity != nil && len(config.CPUAffinity.AffinitySet) > 0 {
+		cpus := make([]string, len(config.CPUAffinity.AffinitySet))
+		for i, cpu := range config.CPUAffinity.AffinitySet {
+			cpus[i] = strconv.Itoa(cpu)
+		}
+		set("sched.cpu.affinity", strings.Join(cpus, ","))
+	}
+	for _, sched := range []struct {
+		prefix     string
+		allocation *ResourceAllocation
+	}{{"sched.cpu", config.CPUAllocation}, {"sched.mem", config.MemoryAllocation}} {
+		prefix, allocation := sched.prefix, sched.allocation
+		if allocation == nil {
+			continue
+		}
+		if allocation.Reservation != nil && *allocation.Reservation > 0 {
+			set(prefix+".min", strconv.FormatInt(*allocation.Reservation, 10))
+		}
+		if shares := allocation.Shares; shares != nil {
+			if shares.Level == "custom" {
+				set(prefix+".shares", strconv.Itoa(shares.Shares))
+			} else if shares.Level != "" {
+				set(prefix+".shares", shares.Level)
+			}
+		}
+	}
+
+	controllers := controllerIDs(config.Hardware.Device)
+	for _, d := range config.Hardware.Device {
+		id, ok := controllers[d.Key]
+		if !ok {
+			continue
+		}
+		set(id+".present", "TRUE")
+		if bus := controllerBuses[d.Type]; bus[1] != "" {
+			set(id+".virtualDev", bus[1])
+			if shared, ok := sharedBuses[d.SharedBus]; ok {
+				set(id+".sharedBus", shared)
+			}
+		}
+	}
+
+	disks := make(map[string]diskInfo)
+	devices := append([]Device(nil), config.Hardware.Device...)
+	sort.SliceStable(devices, func(i, j int) bool { return devices[i].Key < devices[j].Key })
+	nic, passthrough, serial, parallel, floppy, usb := 0, 0, 0, 0, 0, 0
+	portgroups := make(map[string]string)
+	for _, d := range devices {
+		// Devices without a portable equivalent are kept so that they are reported as in a VMX.
+		switch d.Type {
+		case "VirtualPCIPassthrough":
+			id := fmt.Sprintf("pciPassthru%d", passthrough)
+			passthrough++
+			set(id+".present", "TRUE")
+			if d.Backing != nil && d.Backing.Vgpu != "" {
+				set(id+".vgpu", d.Backing.Vgpu)
+			}
+			continue
+		case "VirtualSerialPort":
+			id := fmt.Sprintf("serial%d", serial)
+			serial++
+			set(id+".present", "TRUE")
+			if d.Backing != nil && serialFileTypes[d.Backing.Type] != "" {
+				set(id+".fileType", serialFileTypes[d.Backing.Type])
+			}
+			continue
+		case "VirtualParallelPort":
+			set(fmt.Sprintf("parallel%d.present", parallel), "TRUE")
+			parallel++
+			continue
+		case "VirtualFloppy":
+			set(fmt.Sprintf("floppy%d.present", floppy), "TRUE")
+			floppy++
+			continue
+		case "VirtualUSB":
+			if d.Backing != nil && d.Backing.DeviceName != "" {
+				set(fmt.Sprintf("usb.autoConnect.device%d", usb), d.Backing.DeviceName)
+				usb++
+			}
+			continue
+		case "VirtualTPM":
+			set("vtpm.present", "TRUE")
+			continue
+		}
+		if virtualDev, ok := nicVirtualDevs[d.Type]; ok {
+			id := fmt.Sprintf("ethernet%d", nic)
+			nic++
+			set(id+".present", "TRUE")
+			set(id+".virtualDev", virtualDev)
+			network, err := c.networkName(ctx, d, portgroups)
+			if err != nil {
+				return nil, nil, err
+			}
+			if network != "" {
+				set(id+".networkName", network)
+			}
+			switch d.AddressType {
+			case "manual":
+				set(id+".addressType", "static")
+				set(id+".address", d.MacAddress)
+			case "generated":
+				set(id+".addressType", "generated")
+				set(id+".generatedAddress", d.MacAddress)
+			default:
+				set(id+".addressType", "vpx")
+				set(id+".generatedAddress", d.MacAddress)
+			}
+			if d.Connectable != nil {
+				set(id+".startConnected", strings.ToUpper(strconv.FormatBool(d.Connectable.StartConnected)))
+			}
+			continue
+		}
+
+		if d.Type != "VirtualDisk" && d.Type != "VirtualCdrom" {
+			continue
+		}
+		controller, ok := controllers[d.ControllerKey]
+		if !ok || d.UnitNumber == nil {
+			continue
+		}
+		slot := fmt.Sprintf("%s:%d", controller, *d.UnitNumber)
+		set(slot+".present", "TRUE")
+		if d.Type == "VirtualCdrom" {
+			if d.Backing != nil && d.Backing.FileName != "" {
+				set(slot+".deviceType", "cdrom-image")
+				set(slot+".fileName", d.Backing.FileName)
+			} else {
+				set(slot+".deviceType", "atapi-cdrom")
+			}
+			continue
+		}
+		if d.Backing == nil || d.Backing.FileName == "" {
+			return nil, nil, fmt.Errorf("disk %s has no backing file", slot)
+		}
+		set(slot+".fileName", d.Backing.FileName)
+		info := diskInfo{CapacityBytes: uint64(d.CapacityInBytes), Provisioning: "thick"}
+		switch {
+		case strings.HasPrefix(d.Backing.Type, "VirtualDiskRawDiskMapping"):
+			info.Provisioning = "rdm"
+			info.RawDeviceMapping = "virtual"
+			if d.Backing.CompatibilityMode == "physicalMode" {
+				info.RawDeviceMapping = "physical"
+				set(slot+".deviceType", "scsi-passthru")
+			}
+		case d.Backing.ThinProvisioned != nil && *d.Backing.ThinProvisioned:
+			info.Provisioning = "thin"
+		case d.Backing.EagerlyScrub != nil && *d.Backing.EagerlyScrub:
+			info.Provisioning = "eagerzeroedthick"
+		}
+		if d.Backing.DiskMode != "" {
+			set(slot+".mode", vmxDiskMode(d.Backing.DiskMode))
+		}
+		if d.Backing.Sharing == "sharingMultiWriter" {
+			set(slot+".sharing", "multi-writer")
+		}
+		disks[slot] = info
+	}
+
+	for _, option := range config.ExtraConfig {
+		if option.Value.Value != nil {
+			set(option.Key, fmt.Sprint(option.Value.Value))
+		}
+	}
+	return []byte(b.String()), disks, nil
+}
+
+// controllerIDs returns the VMX identifier, e.g. scsi0, of each storage controller by device key.
+func controllerIDs(devices []Device) map[int]string {
+	controllers := make(map[int]string)
+	for _, d := range devices {
+		if bus, ok := controllerBuses[d.Type]; ok {
+			controllers[d.Key] = fmt.Sprintf("%s%d", bus[0], d.BusNumber)
+		}
+	}
+	return controllers
+}
+
+// networkName returns the port group of a NIC: the network name of standard switches, the name
+// of the distributed port group, or the ID of an NSX opaque network. A standalone ESXi host does
+// not manage the distributed switches it is a member of and may not know their port group names;
+// the port group key, e.g. dvportgroup-21, stands for the name then.
+func (c *Client) networkName(ctx context.Context, d Device, portgroups map[string]string) (string, error) {
+	if d.Backing == nil {
+		return "", nil
+	}
+	switch {
+	case d.Backing.Port != nil && d.Backing.Port.PortgroupKey != "":
+		key := d.Backing.Port.PortgroupKey
+		if name, ok := portgroups[key]; ok {
+			return name, nil
+		}
+		var name string
+		err := c.Property(ctx, MoRef{Type: "DistributedVirtualPortgroup", Value: key}, "name", &name)
+		if err != nil && !c.IsVCenter() && IsNotFound(err) {
+			name, err = key, nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to read the name of distributed port group %s: %w", key, err)
+		}
+		portgroups[key] = name
+		return name, nil
+	case d.Backing.OpaqueNetworkID != "":
+		return d.Backing.OpaqueNetworkID, nil
+	}
+	return d.Backing.DeviceName, nil
+}
+
+// vmxDiskMode converts a vSphere disk mode, e.g. independent_persistent, to its VMX form.
+func vmxDiskMode(mode string) string {
+	return strings.ReplaceAll(mode, "_", "-")
+}
+
+// vmxEscaper escapes the characters a VMX value cannot hold verbatim.
+var vmxEscaper = strings.NewReplacer("|", "|7C", `"`, "|22", "\n", "|0A", "\r", "")
@@ -0,0 +1,308 @@
+// Package warm migrates the disks of a vSphere VM while it runs. Precopies copy the disks of a
+// snapshot, in full the first time and then only the blocks Changed Block Tracking reports as
+// written since the previous precopy; the cutover powers the VM off and copies the last changes,
+// so the VM is only down for the time of a short incremental sync.
+package warm
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"text/tabwriter"
+	"time"
+
+	"vmx2vmi/pkg/convert"
+	"vmx2vmi/pkg/failure"
+	"vmx2vmi/pkg/kubevirt"
+	"vmx2vmi/pkg/progress"
+	"vmx2vmi/pkg/transfer"
+	"vmx2vmi/pkg/vsphere"
+)
+
+// Phases of a warm migration.
+const (
+	PhasePrecopy   = "precopy"
+	PhaseCutover   = "cutover"
+	PhaseCompleted = "completed"
+)
+
+// State is the progress of the warm migration of one VM, saved as JSON between runs.
+type State struct {
+	// VM is the managed object ID of the VM, e.g. vm-42.
+	VM     string `json:"vm"`
+	VMName string `json:"vmName"`
+	// Phase is precopy until the cutover starts, cutover while it runs and completed after it.
+	Phase string `json:"phase"`
+	Disks []Disk `json:"disks"`
+	Syncs []Sync `json:"syncs,omitempty"`
+}
+
+// Disk is a disk of the VM and the raw image or block device it is copied to.
+type Disk struct {
+	ID        string `json:"id"`
+	Output    string `json:"output"`
+	SizeBytes int64  `json:"sizeBytes,omitempty"`
+	// ChangeID is the state of the disk the output holds, empty until its first copy.
+	ChangeID string `json:"changeId,omitempty"`
+}
+
+// Sync records one copy of the disks.
+type Sync struct {
+	// Kind is full for the first precopy, incremental for the next ones and final for the cutover.
+	Kind     string    `json:"kind"`
+	Snapshot string    `json:"snapshot,omitempty"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	// Summaries describe what was copied of each disk.
+	Summaries []string `json:"summaries"`
+}
+
+// Options configures Precopy and Cutover.
+type Options struct {
+	VDDK vsphere.VDDKOptions
+	// Outputs gives the destination of disks by device ID; the others are written to
+	// <vm>-<disk>.raw in Dir.
+	Outputs     map[string]string
+	Dir         string
+	ReadWorkers int
+	Limiters    []*transfer.Limiter
+	// Tracker, when set, shows the progress of each disk copy.
+	Tracker *progress.Tracker
+	// Quiesce quiesces the guest file systems through VMware Tools for the precopy snapshots.
+	Quiesce bool
+	// Shutdown is how the cutover stops the VM: vsphere.ShutdownGuest, ShutdownHard or
+	// ShutdownManual.
+	Shutdown string
+	// ShutdownTimeout is how long the cutover waits for the guest to shut down before it
+	// powers the VM off.
+	ShutdownTimeout time.Duration
+	// DisconnectNICs disconnects the network adapters of the VM once it is stopped, so that it
+	// cannot run on the network next to its migrated copy if it is powered on again.
+	DisconnectNICs bool
+	// Logf reports the steps of the migration.
+	Logf func(format string, args ...any)
+}
+
+// LoadState reads the state file at path.
+func LoadState(path string) (*State, error) {
+	state, err := loadState(path)
+	return state, failure.Wrap(failure.Parse, err)
+}
+
+func loadState(path string) (*State, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read warm migration state: %w", err)
+	}
+	var state State
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse warm migration state %s: %w", path, err)
+	}
+	return &state, nil
+}
+
+// save writes the state atomically, so an interrupted run leaves the previous one.
+func (s *State) save(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".tmp", append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("failed to write warm migration state: %w", err)
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Precopy copies the disks of the VM named by ref from a snapshot taken for the copy and removed
+// after it, while the VM keeps running: in full the first time, then only the changes since the
+// previous precopy. The state of the migration is kept in statePath.
+func Precopy(ctx context.Context, client *vsphere.Client, ref, statePath string, opts Options) (*State, error) {
+	vm, err := client.FindVM(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	state, err := LoadState(statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		if state, err = newState(ctx, client, vm, opts); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	if state.VM != vm.Value {
+		return nil, fmt.Errorf("%s is the state of the migration of VM %s (%s), not of %s", statePath, state.VMName, state.VM, ref)
+	}
+	if state.Phase != PhasePrecopy {
+		return nil, fmt.Errorf("VM %s was cut over, a precopy would copy a stopped VM", state.VMName)
+	}
+
+	kind := "incremental"
+	for _, disk := range state.Disks {
+		if disk.ChangeID == "" {
+			kind = "full"
+		}
+	}
+	name := fmt.Sprintf("vmx2vmi-precopy-%d", len(state.Syncs)+1)
+	opts.Logf("Taking snapshot %s of VM %s\n", name, state.VMName)
+	snapshot, err := client.CreateSnapshot(ctx, vm, name, "Warm migration precopy by vmx2vmi, removed after the copy", opts.Quiesce)
+	if err != nil {
+		return state, err
+	}
+	err = state.sync(ctx, client, statePath, kind, &snapshot, opts)
+	opts.Logf("Removing snapshot %s of VM %s\n", name, state.VMName)
+	if removeErr := client.RemoveSnapshot(context.WithoutCancel(ctx), snapshot); removeErr != nil {
+		err = errors.Join(err, fmt.Errorf("%w; remove it in vSphere", removeErr))
+	}
+	return state, err
+}
+
+// Cutover stops the VM of the migration of statePath the way of opts.Shutdown, disconnects its
+// network adapters when asked, and copies the changes since the last precopy. The disks then hold the final state of the VM.
+func Cutover(ctx context.Context, client *vsphere.Client, statePath string, opts Options) (*State, error) {
+	state, err := LoadState(statePath)
+	if err != nil {
+		return nil, err
+	}
+	if state.Phase == PhaseCompleted {
+		return state, fmt.Errorf("VM %s was already cut over", state.VMName)
+	}
+	for _, disk := range state.Disks {
+		if disk.ChangeID == "" {
+			return state, fmt.Errorf("disk %s of VM %s was never copied, run a precopy first", disk.ID, state.VMName)
+		}
+	}
+	vm := vsphere.MoRef{Type: "VirtualMachine", Value: state.VM}
+	state.Phase = PhaseCutover
+	if err := state.save(statePath); err != nil {
+		return state, err
+	}
+	opts.Logf("Stopping VM %s\n", state.VMName)
+	if err := client.PowerOff(ctx, vm, cmp.Or(opts.Shutdown, vsphere.ShutdownGuest), opts.ShutdownTimeout); err != nil {
+		return state, err
+	}
+	if opts.DisconnectNICs {
+		n, err := client.DisconnectNICs(ctx, vm)
+		if err != nil {
+			return state, err
+		}
+		opts.Logf("Disconnected %d network adapters of VM %s\n", n, state.VMName)
+	}
+	// Once the VM is off, its disks no longer change and are read without a snapshot.
+	if err := state.sync(ctx, client, statePath, "final", nil, opts); err != nil {
+		return state, err
+	}
+	state.Phase = PhaseCompleted
+	return state, state.save(statePath)
+}
+
+func newState(ctx context.Context, client *vsphere.Client, vm vsphere.MoRef, opts Options) (*State, error) {
+	config, err := client.VMConfig(ctx, vm)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := client.DiskIDs(ctx, vm)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("VM %s has no disks", config.Name)
+	}
+	state := &State{VM: vm.Value, VMName: config.Name, Phase: PhasePrecopy}
+	for _, id := range ids {
+		output, ok := opts.Outputs[id]
+		if !ok {
+			output = filepath.Join(opts.Dir, kubevirt.SanitizeName(config.Name+"-"+id)+".raw")
+		}
+		state.Disks = append(state.Disks, Disk{ID: id, Output: output})
+	}
+	for id := range opts.Outputs {
+		if !slices.ContainsFunc(state.Disks, func(d Disk) bool { return d.ID == id }) {
+			return nil, fmt.Errorf("VM %s has no disk %s", config.Name, id)
+		}
+	}
+	return state, nil
+}
+
+// sync copies every disk, from snapshot when set, and saves the state after each one so that an
+// interrupted sync only copies the remaining disks again.
+func (s *State) sync(ctx context.Context, client *vsphere.Client, statePath, kind string, snapshot *vsphere.MoRef, opts Options) error {
+	record := Sync{Kind: kind, Started: time.Now().UTC().Truncate(time.Second)}
+	vddkOptions := opts.VDDK
+	vddkOptions.Snapshot = ""
+	if snapshot != nil {
+		record.Snapshot = snapshot.Value
+		vddkOptions.Snapshot = snapshot.Value
+	}
+	for i := range s.Disks {
+		disk := &s.Disks[i]
+		summary, err := s.copyDisk(ctx, client, disk, vddkOptions, opts)
+		if err != nil {
+			return fmt.Errorf("failed to copy disk %s of VM %s: %w", disk.ID, s.VMName, err)
+		}
+		record.Summaries = append(record.Summaries, disk.ID+": "+summary)
+		if err := s.save(statePath); err != nil {
+			return err
+		}
+	}
+	record.Finished = time.Now().UTC().Truncate(time.Second)
+	s.Syncs = append(s.Syncs, record)
+	return s.save(statePath)
+}
+
+func (s *State) copyDisk(ctx context.Context, client *vsphere.Client, disk *Disk, vddkOptions vsphere.VDDKOptions, opts Options) (string, error) {
+	remote, err := client.OpenDisk(ctx, s.VM, disk.ID, vddkOptions)
+	if err != nil {
+		return "", err
+	}
+	defer remote.Close()
+	if remote.ChangeID() == "" {
+		return "", failure.Errorf(failure.Unsupported, "the disk does not track changes; enable Changed Block Tracking (ctkEnabled) on the VM for warm migrations")
+	}
+	if disk.ChangeID == "" {
+		opts.Logf("Copying disk %s of VM %s to %s\n", disk.ID, s.VMName, disk.Output)
+	} else {
+		opts.Logf("Copying the changes of disk %s of VM %s to %s\n", disk.ID, s.VMName, disk.Output)
+	}
+	diskProgress := opts.Tracker.Add(disk.ID, 0)
+	result, err := convert.VDDK{}.Convert(ctx, disk.ID, disk.Output, convert.Options{
+		Format:        "raw",
+		SinceChangeID: disk.ChangeID,
+		ReadWorkers:   opts.ReadWorkers,
+		Limiters:      opts.Limiters,
+		Progress:      diskProgress,
+		Remote:        remote,
+	})
+	if err != nil {
+		return "", err
+	}
+	diskProgress.Done()
+	disk.ChangeID, disk.SizeBytes = result.ChangeID, remote.Size()
+	return result.Summary, nil
+}
+
+// WriteStatus renders the state of a migration: its phase, the disks and the syncs so far.
+func WriteStatus(w io.Writer, s *State) error {
+	fmt.Fprintf(w, "VM %s (%s): %s, %d syncs\n\n", s.VMName, s.VM, s.Phase, len(s.Syncs))
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DISK\tOUTPUT\tSIZE\tCHANGE ID")
+	for _, disk := range s.Disks {
+		changeID := disk.ChangeID
+		if changeID == "" {
+			changeID = "- (not copied)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%.1f GiB\t%s\n", disk.ID, disk.Output, float64(disk.SizeBytes)/(1<<30), changeID)
+	}
+	if len(s.Syncs) > 0 {
+		fmt.Fprintln(tw, "\nSYNC\tKIND\tSTARTED\tDURATION")
+		for i, sync := range s.Syncs {
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", i+1, sync.Kind, sync.Started.Format(time.RFC3339), sync.Finished.Sub(sync.Started))
+		}
+	}
+	return tw.Flush()
+}
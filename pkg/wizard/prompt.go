@@ -0,0 +1,114 @@
+package wizard
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// errAborted is returned when the input ends before the wizard does.
+var errAborted = errors.New("wizard aborted")
+
+// prompter asks the questions of the wizard, one per line.
+type prompter struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+// ask returns the answer to question, def when it is empty. check, when set, validates the answer;
+// the question is asked again until it passes.
+func (p *prompter) ask(question, def string, check func(string) error) (string, error) {
+	for {
+		if def != "" {
+			fmt.Fprintf(p.out, "%s [%s]: ", question, def)
+		} else {
+			fmt.Fprintf(p.out, "%s: ", question)
+		}
+		line, err := p.in.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			fmt.Fprintln(p.out)
+			return "", errAborted
+		}
+		answer := strings.TrimSpace(line)
+		if answer == "" {
+			answer = def
+		}
+		if check != nil {
+			if err := check(answer); err != nil {
+				fmt.Fprintf(p.out, "  %v\n", err)
+				continue
+			}
+		}
+		return answer, nil
+	}
+}
+
+// choose lists choices under question and returns the one picked by its number, def when the
+// answer is empty. With other set, an answer that is not a number is returned as typed, and
+// checked by other.
+func (p *prompter) choose(question string, choices []string, def string, other func(string) error) (string, error) {
+	fmt.Fprintf(p.out, "%s\n", question)
+	for i, choice := range choices {
+		fmt.Fprintf(p.out, "  %d) %s\n", i+1, choice)
+	}
+	label := "Number"
+	if other != nil {
+		label = "Number or name"
+	}
+	return p.ask(label, def, func(answer string) error {
+		if n, err := strconv.Atoi(answer); err == nil {
+			if n < 1 || n > len(choices) {
+				return fmt.Errorf("choose a number from 1 to %d", len(choices))
+			}
+			return nil
+		}
+		if other == nil {
+			return fmt.Errorf("choose a number from 1 to %d", len(choices))
+		}
+		return other(answer)
+	})
+}
+
+// pick is choose returning the value of the choice an answer numbers, or the answer itself.
+// labels describe the values in the list, the values themselves when nil.
+func (p *prompter) pick(question string, values, labels []string, def string, other func(string) error) (string, error) {
+	if labels == nil {
+		labels = values
+	}
+	answer, err := p.choose(question, labels, def, other)
+	if err != nil {
+		return "", err
+	}
+	if n, err := strconv.Atoi(answer); err == nil {
+		return values[n-1], nil
+	}
+	return answer, nil
+}
+
+// confirm asks a yes or no question.
+func (p *prompter) confirm(question string, def bool) (bool, error) {
+	hint := "y/N"
+	if def {
+		hint = "Y/n"
+	}
+	answer, err := p.ask(fmt.Sprintf("%s (%s)", question, hint), "", func(answer string) error {
+		switch strings.ToLower(answer) {
+		case "", "y", "yes", "n", "no":
+			return nil
+		}
+		return fmt.Errorf("answer y or n")
+	})
+	if err != nil {
+		return false, err
+	}
+	switch strings.ToLower(answer) {
+	case "y", "yes":
+		return true, nil
+	case "n", "no":
+		return false, nil
+	}
+	return def, nil
+}
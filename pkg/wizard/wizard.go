@@ -0,0 +1,586 @@
+// Package wizard converts a VM interactively, for one-off migrations without a command line to
+// write: it asks for the source of the VM, the claims and storage classes of its disks, the
+// networks of its adapters and its names, previews the manifests, then converts it. The preview
+// and the conversion are runs of vmx2vmi with the flags of the answers, which it prints so that
+// the conversion can be repeated or scripted.
+package wizard
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"vmx2vmi/pkg/cluster"
+	"vmx2vmi/pkg/failure"
+	"vmx2vmi/pkg/kubevirt"
+	"vmx2vmi/pkg/logging"
+	"vmx2vmi/pkg/vmx"
+	"vmx2vmi/pkg/vsphere"
+
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/yaml"
+)
+
+// Options configures Run.
+type Options struct {
+	// In and Out are the terminal the questions are asked on; the runs of vmx2vmi also write to Out.
+	In  io.Reader
+	Out io.Writer
+	// Command runs vmx2vmi, with Args before the flags of the answers.
+	Command string
+	Args    []string
+	// VCenter is the vCenter offered to pick the VM from; the password is read from $VCENTER_PASSWORD.
+	VCenter vsphere.Config
+	// Cluster, when set, lists the storage classes and NetworkAttachmentDefinitions to pick from,
+	// and the manifests can be applied to it.
+	Cluster *cluster.Client
+	// Namespace and OutputDir are the defaults of the namespace of the VM and of the directory of
+	// the manifests, the directory of the VMX when empty.
+	Namespace string
+	OutputDir string
+}
+
+// session holds the answers of a run of the wizard.
+type session struct {
+	*prompter
+	ctx  context.Context
+	opts Options
+
+	config *vmx.VMXConfig
+	// vmxPath is the file of the VMX, empty for a VM of vCenter.
+	vmxPath    string
+	name       string
+	namespace  string
+	outputDir  string
+	args       []string
+	networkMap *kubevirt.NetworkMap
+	storageMap *kubevirt.StorageMap
+}
+
+// Run asks the questions of the wizard on opts.In, previews the manifests of the VM and converts
+// it once confirmed.
+func Run(ctx context.Context, opts Options) error {
+	s := &session{prompter: &prompter{in: bufio.NewReader(opts.In), out: opts.Out}, ctx: ctx, opts: opts}
+	err := s.run()
+	return failure.Wrap(failure.General, err)
+}
+
+func (s *session) run() error {
+	fmt.Fprintf(s.out, "Converting a VMware VM to KubeVirt. Empty answers take the default in brackets; Ctrl-D aborts.\n")
+	steps := []struct {
+		title string
+		run   func() error
+	}{
+		{"Source", s.source},
+		{"Names", s.names},
+		{"Disks", s.disks},
+		{"Networks", s.networks},
+		{"Output", s.output},
+	}
+	for _, step := range steps {
+		fmt.Fprintf(s.out, "\n== %s ==\n", step.title)
+		if err := step.run(); err != nil {
+			return err
+		}
+	}
+	return s.convert()
+}
+
+// source asks for the VM: a file, or a VM of vCenter picked from its inventory.
+func (s *session) source() error {
+	def := "1"
+	if s.opts.VCenter.URL != "" {
+		def = "2"
+	}
+	where, err := s.choose("Where is the VM?", []string{"In a VMX, OVA or OVF file", "In vCenter or on an ESXi host"}, def, nil)
+	if err != nil {
+		return err
+	}
+	if where == "1" {
+		s.vmxPath, err = s.ask("VMX, OVA or OVF file", "", func(path string) error {
+			var err error
+			s.config, err = vmx.ParseVMX(path)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		s.args = append(s.args, "-vmx", s.vmxPath)
+	} else if err := s.vcenterSource(); err != nil {
+		return err
+	}
+	fmt.Fprintf(s.out, "VM %s: %s, %d vCPUs, %d MiB of memory, %d disk(s), %d network adapter(s)\n", s.config.DisplayName,
+		cmp.Or(s.config.GuestOS, "unknown guest"), s.config.NumVCPUs, s.config.MemoryMiB, len(s.config.Disks), len(s.config.NICs))
+	return nil
+}
+
+// vcenterSource logs in to vCenter and asks for one of its VMs.
+func (s *session) vcenterSource() error {
+	cfg := s.opts.VCenter
+	var err error
+	if cfg.URL, err = s.ask("vCenter or ESXi host URL", cfg.URL, required); err != nil {
+		return err
+	}
+	if cfg.Username, err = s.ask("User", cfg.Username, required); err != nil {
+		return err
+	}
+	cfg.Password = os.Getenv("VCENTER_PASSWORD")
+	if cfg.Password == "" {
+		return failure.Errorf(failure.Usage, "the password of %s is read from $VCENTER_PASSWORD, set it before running the wizard", cfg.Username)
+	}
+	client, err := vsphere.Login(s.ctx, cfg)
+	if err != nil {
+		return fmt.Errorf("failed to connect to vSphere: %w", err)
+	}
+	defer client.Logout(context.WithoutCancel(s.ctx))
+	vms, err := client.Inventory(s.ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to list the VMs: %w", err)
+	}
+	vms = slices.DeleteFunc(vms, func(vm vsphere.InventoryVM) bool { return vm.Template })
+	if len(vms) == 0 {
+		return fmt.Errorf("%s has no VM to convert", cfg.URL)
+	}
+
+	// The rows are aligned by a tabwriter, then listed as the choices.
+	var table bytes.Buffer
+	tw := tabwriter.NewWriter(&table, 0, 0, 2, ' ', 0)
+	paths := make([]string, len(vms))
+	for i, vm := range vms {
+		paths[i] = vm.Path
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d vCPUs\t%d MiB\t%d disk(s), %s\n", vm.Name, vm.Folder, vm.PowerState, vm.CPUs, vm.MemoryMB, vm.Disks, formatSize(uint64(vm.DiskCapacityBytes)))
+	}
+	tw.Flush()
+	labels := strings.Split(strings.TrimSuffix(table.String(), "\n"), "\n")
+	ref, err := s.pick("VM to convert:", paths, labels, "", func(answer string) error {
+		if !slices.ContainsFunc(vms, func(vm vsphere.InventoryVM) bool { return vm.Name == answer || vm.Path == answer }) {
+			return fmt.Errorf("no VM is named %s", answer)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if i := slices.IndexFunc(vms, func(vm vsphere.InventoryVM) bool { return vm.Name == ref }); i >= 0 {
+		ref = vms[i].Path
+	}
+	if s.config, _, err = client.ReadVMX(s.ctx, ref); err != nil {
+		return fmt.Errorf("failed to read VM %s: %w", ref, err)
+	}
+	s.args = append(s.args, "-vcenter-url", cfg.URL, "-vcenter-user", cfg.Username)
+	if cfg.Insecure {
+		s.args = append(s.args, "-vcenter-insecure")
+	}
+	if cfg.Thumbprint != "" {
+		s.args = append(s.args, "-vcenter-thumbprint", cfg.Thumbprint)
+	}
+	s.args = append(s.args, "-vm", ref)
+	return nil
+}
+
+// names asks for the name and namespace of the KubeVirt VM.
+func (s *session) names() error {
+	var err error
+	if s.name, err = s.ask("Name of the VirtualMachine", kubevirt.SanitizeName(s.config.DisplayName), dnsLabel); err != nil {
+		return err
+	}
+	if s.namespace, err = s.ask("Namespace", s.opts.Namespace, dnsLabel); err != nil {
+		return err
+	}
+	s.args = append(s.args, "-name", s.name, "-namespace", s.namespace)
+	return nil
+}
+
+// disks asks how the disks reach the cluster, the claim of each disk and the storage class of
+// the claims, by datastore.
+func (s *session) disks() error {
+	diskSource := "pvc"
+	if s.vmxPath == "" {
+		var err error
+		diskSource, err = s.pick("How do the disks reach the cluster?", []string{"pvc", "vddk"}, []string{
+			"Copied beforehand to claims, e.g. with convert-disk (-disk-source pvc)",
+			"Imported by CDI from vCenter through VDDK (-disk-source vddk)",
+		}, "1", nil)
+		if err != nil {
+			return err
+		}
+	}
+	if diskSource == "vddk" {
+		secret, err := s.ask("Secret with the vCenter user in accessKeyId and its password in secretKey", "", dnsSubdomain)
+		if err != nil {
+			return err
+		}
+		s.args = append(s.args, "-disk-source", "vddk", "-vddk-secret", secret)
+	}
+
+	var disks []vmx.Disk
+	for _, d := range s.config.Disks {
+		switch {
+		case d.RawDeviceMapping != "":
+			fmt.Fprintf(s.out, "Disk %s maps a LUN (%s raw device mapping), the conversion report tells how to attach it\n", d.ID(), d.RawDeviceMapping)
+		case d.Shared() && len(disks) > 0:
+			fmt.Fprintf(s.out, "Disk %s is shared by several VMs, its claim is set with -shared-disk-map\n", d.ID())
+		default:
+			disks = append(disks, d)
+		}
+	}
+	var pvc string
+	for i, d := range disks {
+		fmt.Fprintf(s.out, "Disk %s: %s, %s, %s\n", d.ID(), d.FileName, formatSize(d.CapacityBytes), cmp.Or(d.Provisioning, "unknown provisioning"))
+		if i > 0 {
+			// The default of kubevirt.DiskDefinitions.
+			def := pvc + "-data-" + strings.ReplaceAll(d.ID(), ":", "-")
+			claim, err := s.ask("Claim of the disk", def, dnsSubdomain)
+			if err != nil {
+				return err
+			}
+			if claim != def {
+				s.args = append(s.args, "-disk-map", d.ID()+"="+claim)
+			}
+			continue
+		}
+		var err error
+		if pvc, err = s.ask("Claim of the boot disk", s.name+"-boot", dnsSubdomain); err != nil {
+			return err
+		}
+		s.args = append(s.args, "-pvc", pvc)
+	}
+	if len(disks) == 0 {
+		var err error
+		if pvc, err = s.ask("The VM has no disk to convert; claim of its boot disk", s.name+"-boot", dnsSubdomain); err != nil {
+			return err
+		}
+		s.args = append(s.args, "-pvc", pvc)
+		return nil
+	}
+
+	// Claims get a storage class when they are written by -create-pvc or imported by CDI.
+	if diskSource == "pvc" {
+		create, err := s.confirm("Write the manifests of the claims, sized from the disks (-create-pvc)?", true)
+		if err != nil || !create {
+			return err
+		}
+		s.args = append(s.args, "-create-pvc")
+	}
+	var datastores []string
+	byDatastore := make(map[string][]string)
+	for _, d := range disks {
+		datastore := kubevirt.DatastoreOf(d.FileName, "")
+		if _, ok := byDatastore[datastore]; !ok {
+			datastores = append(datastores, datastore)
+		}
+		byDatastore[datastore] = append(byDatastore[datastore], d.ID())
+	}
+	classes, labels, def := s.storageClasses()
+	chosen := make(map[string]string)
+	for _, datastore := range datastores {
+		question := "Storage class of the claim of " + strings.Join(byDatastore[datastore], ", ")
+		if datastore != "" {
+			question += " on datastore " + datastore
+		}
+		var class string
+		var err error
+		if len(classes) > 0 {
+			class, err = s.pick(question+":", classes, labels, def, dnsSubdomain)
+		} else {
+			class, err = s.ask(question+" (empty for the default class of the cluster)", "", optional(dnsSubdomain))
+		}
+		if err != nil {
+			return err
+		}
+		chosen[datastore] = class
+	}
+	if len(datastores) == 1 {
+		if class := chosen[datastores[0]]; class != "" {
+			s.args = append(s.args, "-storage-class", class)
+		}
+		return nil
+	}
+	// Disks on different datastores get their class from a storage map; those referenced relative
+	// to the VM directory have no datastore and take the "*" entry.
+	s.storageMap = &kubevirt.StorageMap{}
+	for _, datastore := range datastores {
+		s.storageMap.Datastores = append(s.storageMap.Datastores, kubevirt.DatastoreMapping{Datastore: cmp.Or(datastore, "*"), StorageClass: chosen[datastore]})
+	}
+	return nil
+}
+
+// storageClasses returns the storage classes of the cluster, their labels and the number of the
+// default class, or nil when they cannot be listed.
+func (s *session) storageClasses() (names, labels []string, def string) {
+	if s.opts.Cluster == nil {
+		return nil, nil, ""
+	}
+	var classes storagev1.StorageClassList
+	if err := s.opts.Cluster.Get(s.ctx, "/apis/storage.k8s.io/v1/storageclasses", &classes); err != nil {
+		logging.Warnf("Cannot list the storage classes of the cluster: %v", err)
+		return nil, nil, ""
+	}
+	for i, class := range classes.Items {
+		label := fmt.Sprintf("%s (%s)", class.Name, class.Provisioner)
+		if class.Annotations["storageclass.kubernetes.io/is-default-class"] == "true" {
+			label += ", default"
+			def = fmt.Sprint(i + 1)
+		}
+		names = append(names, class.Name)
+		labels = append(labels, label)
+	}
+	return names, labels, def
+}
+
+// networks asks for the target of each port group of the adapters of the VM.
+func (s *session) networks() error {
+	var portGroups []string
+	for _, nic := range s.config.NICs {
+		if !slices.Contains(portGroups, nic.NetworkName) {
+			portGroups = append(portGroups, nic.NetworkName)
+		}
+	}
+	if len(portGroups) == 0 {
+		fmt.Fprintf(s.out, "The VM has no network adapter\n")
+		return nil
+	}
+	targets := []string{"pod", "skip"}
+	labels := []string{"The pod network, through masquerade", "None: drop the adapters"}
+	for _, nad := range s.networkAttachments() {
+		targets = append(targets, nad)
+		labels = append(labels, "NetworkAttachmentDefinition "+nad+", bridged")
+	}
+	s.networkMap = &kubevirt.NetworkMap{}
+	pod := false
+	for _, portGroup := range portGroups {
+		// As without a mapping, the first adapter is on the pod network and the others on the
+		// NetworkAttachmentDefinition named after their port group.
+		def := ""
+		if !pod {
+			def = "1"
+		} else if i := slices.Index(targets, kubevirt.SanitizeName(portGroup)); i >= 0 {
+			def = fmt.Sprint(i + 1)
+		}
+		for {
+			target, err := s.pick(fmt.Sprintf("Network of the adapters on port group %q:", portGroup), targets, labels, def, networkName)
+			if err != nil {
+				return err
+			}
+			if target == "pod" && pod {
+				fmt.Fprintf(s.out, "  only one adapter can be on the pod network\n")
+				continue
+			}
+			pod = pod || target == "pod"
+			s.networkMap.Networks = append(s.networkMap.Networks, kubevirt.NetworkMapping{Source: portGroup, Target: target})
+			break
+		}
+	}
+	return nil
+}
+
+// networkAttachments returns the NetworkAttachmentDefinitions of the namespace of the VM and of
+// the default namespace, those of other namespaces as <namespace>/<name>.
+func (s *session) networkAttachments() []string {
+	if s.opts.Cluster == nil {
+		return nil
+	}
+	var nads []string
+	for _, ns := range slices.Compact([]string{s.namespace, "default"}) {
+		var list unstructured.UnstructuredList
+		if err := s.opts.Cluster.Get(s.ctx, fmt.Sprintf("/apis/k8s.cni.cncf.io/v1/namespaces/%s/network-attachment-definitions", ns), &list); err != nil {
+			continue
+		}
+		for _, item := range list.Items {
+			if ns == s.namespace {
+				nads = append(nads, item.GetName())
+			} else {
+				nads = append(nads, ns+"/"+item.GetName())
+			}
+		}
+	}
+	return nads
+}
+
+// output asks where the manifests are written, and whether they are applied.
+func (s *session) output() error {
+	def := s.opts.OutputDir
+	if def == "" && s.vmxPath != "" {
+		def = filepath.Dir(s.vmxPath)
+	}
+	var err error
+	if s.outputDir, err = s.ask("Directory of the manifests", cmp.Or(def, "."), required); err != nil {
+		return err
+	}
+	s.args = append(s.args, "-output-dir", s.outputDir)
+	if s.opts.Cluster == nil {
+		return nil
+	}
+	apply, err := s.confirm("Apply the manifests to the cluster once written (-apply)?", false)
+	if err != nil {
+		return err
+	}
+	if apply {
+		s.args = append(s.args, "-apply")
+	}
+	return nil
+}
+
+// convert writes the mappings next to the manifests, previews the manifests and converts the VM
+// once confirmed.
+func (s *session) convert() error {
+	var files []string
+	for _, m := range []struct {
+		flag, suffix string
+		value        any
+		set          bool
+	}{
+		{"-network-map", "-networks.yaml", s.networkMap, s.networkMap != nil},
+		{"-storage-map", "-storage.yaml", s.storageMap, s.storageMap != nil},
+	} {
+		if !m.set {
+			continue
+		}
+		if err := os.MkdirAll(s.outputDir, 0o755); err != nil {
+			return err
+		}
+		path := filepath.Join(s.outputDir, s.name+m.suffix)
+		if err := writeYAML(path, m.value); err != nil {
+			return err
+		}
+		files = append(files, path)
+		s.args = append(s.args, m.flag, path)
+	}
+
+	fmt.Fprintf(s.out, "\n== Preview ==\n")
+	preview := slices.DeleteFunc(slices.Clone(s.args), func(arg string) bool { return arg == "-apply" })
+	var manifests, report bytes.Buffer
+	if err := s.runTool(append(preview, "-stdout"), &manifests, &report); err != nil {
+		s.out.Write(report.Bytes())
+		return err
+	}
+	// The run writes its report to standard error, it follows the manifests.
+	fmt.Fprintf(s.out, "%s\n%s\n", manifests.String(), report.String())
+	fmt.Fprintf(s.out, "Command line of the conversion:\n  %s\n\n", commandLine(filepath.Base(s.opts.Command), append(slices.Clone(s.opts.Args), s.args...)))
+	ok, err := s.confirm("Convert "+s.name+"?", true)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		for _, path := range files {
+			os.Remove(path)
+		}
+		fmt.Fprintf(s.out, "Nothing converted\n")
+		return nil
+	}
+	return s.runTool(s.args, s.out, s.out)
+}
+
+// runTool runs vmx2vmi with args. A failure is classified by its exit status and reported with
+// the last error it logged.
+func (s *session) runTool(args []string, stdout, stderr io.Writer) error {
+	var logs bytes.Buffer
+	cmd := exec.CommandContext(s.ctx, s.opts.Command, append(slices.Clone(s.opts.Args), args...)...)
+	cmd.Stdout, cmd.Stderr = stdout, io.MultiWriter(stderr, &logs)
+	if runErr := cmd.Run(); runErr != nil {
+		kind := failure.General
+		var exitErr *exec.ExitError
+		if errors.As(runErr, &exitErr) {
+			kind = failure.FromExitCode(exitErr.ExitCode())
+		}
+		if last := logging.LastMessage(&logs); last != "" {
+			return failure.Wrap(kind, errors.New(last))
+		}
+		return failure.Wrap(kind, runErr)
+	}
+	return nil
+}
+
+// commandLine renders the command line of command and args for a POSIX shell.
+func commandLine(command string, args []string) string {
+	words := []string{command}
+	for _, arg := range args {
+		safe := arg != "" && strings.IndexFunc(arg, func(r rune) bool {
+			return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./:=@,+", r))
+		}) < 0
+		if !safe {
+			arg = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		}
+		words = append(words, arg)
+	}
+	return strings.Join(words, " ")
+}
+
+func writeYAML(path string, v any) error {
+	data, err := yaml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
+
+// formatSize renders a size in GiB, or MiB below 1 GiB, "unknown size" for 0.
+func formatSize(bytes uint64) string {
+	switch {
+	case bytes == 0:
+		return "unknown size"
+	case bytes < 1<<30:
+		return fmt.Sprintf("%.1f MiB", float64(bytes)/(1<<20))
+	}
+	return fmt.Sprintf("%.1f GiB", float64(bytes)/(1<<30))
+}
+
+// Checks of the answers.
+
+func required(answer string) error {
+	if answer == "" {
+		return errors.New("an answer is required")
+	}
+	return nil
+}
+
+func dnsLabel(answer string) error {
+	if errs := validation.IsDNS1123Label(answer); len(errs) > 0 {
+		return fmt.Errorf("invalid name %q: %s", answer, errs[0])
+	}
+	return nil
+}
+
+func dnsSubdomain(answer string) error {
+	if errs := validation.IsDNS1123Subdomain(answer); len(errs) > 0 {
+		return fmt.Errorf("invalid name %q: %s", answer, errs[0])
+	}
+	return nil
+}
+
+// networkName checks a NetworkAttachmentDefinition given as <name> or <namespace>/<name>.
+func networkName(answer string) error {
+	namespace, name, ok := strings.Cut(answer, "/")
+	if ok {
+		if err := dnsLabel(namespace); err != nil {
+			return err
+		}
+		return dnsSubdomain(name)
+	}
+	return dnsSubdomain(answer)
+}
+
+// optional accepts an empty answer, and otherwise those check accepts.
+func optional(check func(string) error) func(string) error {
+	return func(answer string) error {
+		if answer == "" {
+			return nil
+		}
+		return check(answer)
+	}
+}